@@ -0,0 +1,365 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package agent exposes the backup and restore entry points of zfsbackup as a gRPC service, letting a central
+// controller start, watch, and cancel backups on many hosts. Jobs run in the background of the agent, their
+// status is kept in memory for the life of the process.
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/backup"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../backup"
+	//"../helpers"
+)
+
+// The kinds of jobs an agent runs.
+const (
+	KindBackup  = "backup"
+	KindRestore = "restore"
+)
+
+// The states of a job, a job is done once it is in any state but StateRunning.
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCanceled  = "canceled"
+)
+
+// BackupRequest asks the agent to backup a dataset. Either a Snapshot, optionally incremented from
+// IncrementalFrom, or one of the Full and Incremental options picking the snapshots to use must be set.
+type BackupRequest struct {
+	Dataset         string
+	Snapshot        string
+	IncrementalFrom string
+	Full            bool
+	Incremental     bool
+	Destinations    []string
+}
+
+// RestoreRequest asks the agent to restore a backup of a dataset onto the Target dataset. Either a Snapshot must
+// be set, or Auto to restore the most recent snapshot backed up along with the backups it is incremented from.
+type RestoreRequest struct {
+	Dataset      string
+	Snapshot     string
+	Auto         bool
+	Force        bool
+	Destinations []string
+	Target       string
+}
+
+// JobRequest identifies a job started by the agent.
+type JobRequest struct {
+	ID string
+}
+
+// JobStatus describes a job started by the agent and its progress.
+type JobStatus struct {
+	ID              string
+	Kind            string
+	Dataset         string
+	State           string
+	Error           string
+	StartTime       time.Time
+	EndTime         time.Time
+	VolumesUploaded int
+	BytesUploaded   uint64
+}
+
+// Done returns true once the job is no longer running.
+func (s *JobStatus) Done() bool {
+	return s.State != StateRunning
+}
+
+// job is a job started by the agent.
+type job struct {
+	status JobStatus
+	cancel context.CancelFunc
+	// Closed, and replaced, whenever the status of the job changes
+	changed chan struct{}
+}
+
+// Service runs the backup and restore jobs requested through the agent's gRPC API. Each job starts from a copy
+// of the JobInfo the service was created with, holding the options of the agent (e.g. keys, volume size, and
+// retry options), with the dataset, snapshots, and destinations of the request applied to it.
+type Service struct {
+	template helpers.JobInfo
+
+	// The library entry points running the jobs
+	backup      func(context.Context, *helpers.JobInfo) error
+	receive     func(context.Context, *helpers.JobInfo) error
+	autoRestore func(context.Context, *helpers.JobInfo) error
+
+	mutex  sync.Mutex
+	jobs   map[string]*job
+	nextID int
+}
+
+// NewService will create a Service starting each job from a copy of the provided JobInfo.
+func NewService(template *helpers.JobInfo) *Service {
+	return &Service{
+		template:    *template,
+		backup:      backup.Backup,
+		receive:     backup.Receive,
+		autoRestore: backup.AutoRestore,
+		jobs:        make(map[string]*job),
+	}
+}
+
+// StartBackup will start backing up the requested dataset in the background and return the status of the new job.
+func (s *Service) StartBackup(ctx context.Context, req *BackupRequest) (*JobStatus, error) {
+	if req.Dataset == "" || len(req.Destinations) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a dataset and at least one destination are required")
+	}
+	if err := validateDestinations(req.Destinations); err != nil {
+		return nil, err
+	}
+
+	j := s.newJobInfo(req.Destinations)
+	j.VolumeName = req.Dataset
+	if err := j.ValidateSendFlags(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch {
+	case req.Full && req.Incremental:
+		return nil, status.Error(codes.InvalidArgument, "only one of the full and incremental options may be set")
+	case req.Full || req.Incremental:
+		if req.Snapshot != "" || req.IncrementalFrom != "" {
+			return nil, status.Error(codes.InvalidArgument, "snapshots cannot be provided along with the full or incremental options")
+		}
+		j.Full, j.Incremental = req.Full, req.Incremental
+		if err := backup.ProcessSmartOptions(ctx, j); err == backup.ErrNoOp {
+			return nil, status.Errorf(codes.FailedPrecondition, "nothing new to backup for %s", req.Dataset)
+		} else if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "could not select the snapshots to backup - %v", err)
+		}
+	case req.Snapshot == "":
+		return nil, status.Error(codes.InvalidArgument, "a snapshot, or the full or incremental option, is required")
+	default:
+		if err := selectSnapshots(ctx, j, req.Snapshot, req.IncrementalFrom); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.start(KindBackup, j, s.backup), nil
+}
+
+// StartRestore will start restoring the requested backup in the background and return the status of the new job.
+func (s *Service) StartRestore(ctx context.Context, req *RestoreRequest) (*JobStatus, error) {
+	if req.Dataset == "" || req.Target == "" || len(req.Destinations) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a dataset, a target, and at least one destination are required")
+	}
+	if req.Snapshot == "" && !req.Auto {
+		return nil, status.Error(codes.InvalidArgument, "a snapshot, or the auto option, is required")
+	}
+	if err := validateDestinations(req.Destinations); err != nil {
+		return nil, err
+	}
+
+	j := s.newJobInfo(req.Destinations)
+	j.VolumeName = req.Dataset
+	j.BaseSnapshot = helpers.SnapshotInfo{Name: req.Snapshot}
+	j.LocalVolume = req.Target
+	j.AutoRestore = req.Auto
+	j.Force = req.Force
+	if err := j.ValidateReceiveTarget(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid target - %v", err)
+	}
+
+	run := s.receive
+	if req.Auto {
+		run = s.autoRestore
+	}
+	return s.start(KindRestore, j, run), nil
+}
+
+// Status returns the status of the requested job.
+func (s *Service) Status(ctx context.Context, req *JobRequest) (*JobStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	jb, ok := s.jobs[req.ID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no job %s", req.ID)
+	}
+	st := jb.status
+	return &st, nil
+}
+
+// Cancel will cancel the requested job and return its status. Canceling a job that is done has no effect.
+func (s *Service) Cancel(ctx context.Context, req *JobRequest) (*JobStatus, error) {
+	s.mutex.Lock()
+	jb, ok := s.jobs[req.ID]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no job %s", req.ID)
+	}
+	jb.cancel()
+	return s.Status(ctx, req)
+}
+
+// Watch will call send with the status of the requested job, and again each time its progress changes, until the
+// job is done or the provided context is done.
+func (s *Service) Watch(ctx context.Context, req *JobRequest, send func(*JobStatus) error) error {
+	for {
+		s.mutex.Lock()
+		jb, ok := s.jobs[req.ID]
+		if !ok {
+			s.mutex.Unlock()
+			return status.Errorf(codes.NotFound, "no job %s", req.ID)
+		}
+		st, changed := jb.status, jb.changed
+		s.mutex.Unlock()
+
+		if err := send(&st); err != nil {
+			return err
+		}
+		if st.Done() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newJobInfo will return a copy of the service's JobInfo to run a job with.
+func (s *Service) newJobInfo(destinations []string) *helpers.JobInfo {
+	j := s.template
+	j.StartTime = time.Now()
+	j.Version = helpers.VersionNumber
+	j.Destinations = append([]string(nil), destinations...)
+	return &j
+}
+
+// start will run the provided job in the background, reporting its progress, and return its initial status.
+func (s *Service) start(kind string, j *helpers.JobInfo, run func(context.Context, *helpers.JobInfo) error) *JobStatus {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.mutex.Lock()
+	s.nextID++
+	id := kind + "-" + strconv.Itoa(s.nextID)
+	jb := &job{
+		status: JobStatus{
+			ID:        id,
+			Kind:      kind,
+			Dataset:   j.VolumeName,
+			State:     StateRunning,
+			StartTime: j.StartTime,
+		},
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+	s.jobs[id] = jb
+	st := jb.status
+	s.mutex.Unlock()
+
+	j.UploadObserver = func(size uint64, _ time.Duration) {
+		s.update(jb, func(st *JobStatus) {
+			st.VolumesUploaded++
+			st.BytesUploaded += size
+		})
+	}
+
+	helpers.AppLogger.Noticef("Starting %s job %s for %s.", kind, id, j.VolumeName)
+	go func() {
+		defer cancel()
+		err := run(ctx, j)
+		s.update(jb, func(st *JobStatus) {
+			st.EndTime = time.Now()
+			switch {
+			case err == nil:
+				st.State = StateSucceeded
+			case ctx.Err() != nil:
+				st.State = StateCanceled
+				st.Error = err.Error()
+			default:
+				st.State = StateFailed
+				st.Error = err.Error()
+			}
+		})
+		if err != nil {
+			helpers.AppLogger.Errorf("The %s job %s for %s did not complete - %v", kind, id, j.VolumeName, err)
+		} else {
+			helpers.AppLogger.Noticef("The %s job %s for %s completed.", kind, id, j.VolumeName)
+		}
+	}()
+
+	return &st
+}
+
+// update will apply the provided change to the status of the job and notify anyone watching it.
+func (s *Service) update(jb *job, change func(*JobStatus)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change(&jb.status)
+	close(jb.changed)
+	jb.changed = make(chan struct{})
+}
+
+// validateDestinations will check a backend is registered for each of the provided destinations.
+func validateDestinations(destinations []string) error {
+	for _, destination := range destinations {
+		if _, err := backends.GetBackendForURI(destination); err != nil {
+			return status.Errorf(codes.InvalidArgument, "unsupported destination %s - %v", destination, err)
+		}
+	}
+	return nil
+}
+
+// selectSnapshots will set the provided snapshots as the ones to backup, checking they exist and are in order.
+func selectSnapshots(ctx context.Context, j *helpers.JobInfo, snapshot, incrementalFrom string) error {
+	creationTime, err := helpers.GetCreationDate(ctx, fmt.Sprintf("%s@%s", j.VolumeName, snapshot))
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "could not get the creation date of %s@%s - %v", j.VolumeName, snapshot, err)
+	}
+	j.BaseSnapshot = helpers.SnapshotInfo{Name: snapshot, CreationTime: creationTime}
+
+	if incrementalFrom == "" {
+		return nil
+	}
+	incrementalFrom = strings.TrimPrefix(strings.TrimPrefix(incrementalFrom, j.VolumeName), "@")
+	creationTime, err = helpers.GetCreationDate(ctx, fmt.Sprintf("%s@%s", j.VolumeName, incrementalFrom))
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "could not get the creation date of %s@%s - %v", j.VolumeName, incrementalFrom, err)
+	}
+	j.IncrementalSnapshot = helpers.SnapshotInfo{Name: incrementalFrom, CreationTime: creationTime}
+
+	if err = j.CheckSnapshotChain([]helpers.SnapshotInfo{j.IncrementalSnapshot, j.BaseSnapshot}); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "refusing to send an incremental backup - %v", err)
+	}
+	return nil
+}
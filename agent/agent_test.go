@@ -0,0 +1,390 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// prepareAgentTest will fake the zfs binary, sending a small stream for any dataset and sleeping first for datasets
+// with "slow" in their name, and return the working directory along with the path received streams are written to.
+func prepareAgentTest(t *testing.T) (string, string) {
+	t.Helper()
+	workingDir, err := ioutil.TempDir("", "zfsbackupagenttest")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	helpers.WorkingDir = workingDir
+
+	receivedPath := filepath.Join(workingDir, "received")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in
+list)
+	for dataset; do :; done
+	printf '%%s@snap1\t1600000000\n' "$dataset" ;;
+get) echo 1600000000 ;;
+send)
+	case "$*" in
+		*slow*) exec sleep 10 ;;
+	esac
+	echo zfs stream ;;
+receive) cat >> %s ;;
+esac
+`, receivedPath)
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+
+	return workingDir, receivedPath
+}
+
+func newTestService() *Service {
+	return NewService(&helpers.JobInfo{
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		HashAlgorithm:      helpers.SHA256Hash,
+		VolumeSize:         1,
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Second,
+		MaxRetryTime:       time.Second,
+		UploadChunkSize:    10,
+		FullIfOlderThan:    -1 * time.Minute,
+	})
+}
+
+// serve will serve the provided Service over an in-memory connection and return a Client connected to it.
+func serve(t *testing.T, s *Service, serverTLS, clientTLS credentials.TransportCredentials) (*Client, func()) {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	var opts []grpc.ServerOption
+	if serverTLS != nil {
+		opts = append(opts, grpc.Creds(serverTLS))
+	}
+	server := NewServer(s, nil, opts...)
+	go server.Serve(listener)
+
+	if clientTLS == nil {
+		clientTLS = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient("passthrough:///agent",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(clientTLS),
+	)
+	if err != nil {
+		t.Fatalf("could not connect to the agent - %v", err)
+	}
+
+	return NewClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestAgentBackupAndRestore(t *testing.T) {
+	workingDir, receivedPath := prepareAgentTest(t)
+	defer os.RemoveAll(workingDir)
+	defer func() { helpers.ZFSPath = "zfs" }()
+	defer backends.ResetMemoryBackends()
+
+	client, stop := serve(t, newTestService(), nil, nil)
+	defer stop()
+	ctx := context.Background()
+
+	// Backup a dataset and watch its progress until it is done
+	destination := backends.MemoryBackendPrefix + "://agenttest"
+	started, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/data", Snapshot: "snap1", Destinations: []string{destination}})
+	if err != nil {
+		t.Fatalf("could not start the backup - %v", err)
+	}
+	if started.Kind != KindBackup || started.State != StateRunning || started.Dataset != "tank/data" {
+		t.Errorf("expected a running backup of tank/data, got %+v", started)
+	}
+
+	var updates int
+	done, err := client.Watch(ctx, started.ID, func(*JobStatus) { updates++ })
+	if err != nil {
+		t.Fatalf("could not watch the backup - %v", err)
+	}
+	if done.State != StateSucceeded || done.Error != "" {
+		t.Fatalf("expected the backup to succeed, got %+v", done)
+	}
+	if done.VolumesUploaded == 0 || done.BytesUploaded == 0 || done.EndTime.IsZero() {
+		t.Errorf("expected the progress of the backup to be reported, got %+v", done)
+	}
+	if updates == 0 {
+		t.Errorf("expected the status of the backup to be streamed")
+	}
+	if st, serr := client.Status(ctx, started.ID); serr != nil || st.State != StateSucceeded || st.BytesUploaded != done.BytesUploaded {
+		t.Errorf("expected the status of the backup to match the last streamed one, got %+v (%v)", st, serr)
+	}
+
+	b, err := backends.GetBackendForURI(destination)
+	if err != nil {
+		t.Fatalf("could not get backend - %v", err)
+	}
+	if err = b.Init(ctx, &backends.BackendConfig{TargetURI: destination}); err != nil {
+		t.Fatalf("could not init backend - %v", err)
+	}
+	objects, err := b.List(ctx, "manifests")
+	if err != nil || len(objects) != 1 {
+		t.Errorf("expected the manifest of the backup to be uploaded, got %v (%v)", objects, err)
+	}
+
+	// Restore the backup
+	started, err = client.StartRestore(ctx, &RestoreRequest{Dataset: "tank/data", Snapshot: "snap1", Target: "tank/restored", Destinations: []string{destination}})
+	if err != nil {
+		t.Fatalf("could not start the restore - %v", err)
+	}
+	if done, err = client.Watch(ctx, started.ID, nil); err != nil {
+		t.Fatalf("could not watch the restore - %v", err)
+	}
+	if done.Kind != KindRestore || done.State != StateSucceeded {
+		t.Fatalf("expected the restore to succeed, got %+v", done)
+	}
+	if received, _ := ioutil.ReadFile(receivedPath); !bytes.Equal(received, []byte("zfs stream\n")) {
+		t.Errorf("expected the stream to be received, got %q", received)
+	}
+}
+
+func TestAgentInvalidRequests(t *testing.T) {
+	client, stop := serve(t, newTestService(), nil, nil)
+	defer stop()
+	ctx := context.Background()
+	destinations := []string{backends.MemoryBackendPrefix + "://agenttest"}
+
+	testCases := []struct {
+		call func() error
+		code codes.Code
+	}{
+		{func() error {
+			_, err := client.StartBackup(ctx, &BackupRequest{Snapshot: "snap1", Destinations: destinations})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/data", Snapshot: "snap1"})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/data", Snapshot: "snap1", Destinations: []string{"bogus://bucket"}})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/data", Destinations: destinations})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/data", Full: true, Incremental: true, Destinations: destinations})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/data", Snapshot: "snap1", Full: true, Destinations: destinations})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartRestore(ctx, &RestoreRequest{Dataset: "tank/data", Snapshot: "snap1", Destinations: destinations})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.StartRestore(ctx, &RestoreRequest{Dataset: "tank/data", Target: "tank/restored", Destinations: destinations})
+			return err
+		}, codes.InvalidArgument},
+		{func() error { _, err := client.Status(ctx, "backup-1"); return err }, codes.NotFound},
+		{func() error { _, err := client.Cancel(ctx, "backup-1"); return err }, codes.NotFound},
+		{func() error { _, err := client.Watch(ctx, "backup-1", nil); return err }, codes.NotFound},
+	}
+
+	for idx, c := range testCases {
+		if code := status.Code(c.call()); code != c.code {
+			t.Errorf("%d: expected code %v, got %v", idx, c.code, code)
+		}
+	}
+}
+
+func TestAgentCancel(t *testing.T) {
+	workingDir, _ := prepareAgentTest(t)
+	defer os.RemoveAll(workingDir)
+	defer func() { helpers.ZFSPath = "zfs" }()
+	defer backends.ResetMemoryBackends()
+
+	client, stop := serve(t, newTestService(), nil, nil)
+	defer stop()
+	ctx := context.Background()
+
+	started, err := client.StartBackup(ctx, &BackupRequest{Dataset: "tank/slow", Snapshot: "snap1", Destinations: []string{backends.MemoryBackendPrefix + "://agenttest"}})
+	if err != nil {
+		t.Fatalf("could not start the backup - %v", err)
+	}
+	if _, err = client.Cancel(ctx, started.ID); err != nil {
+		t.Fatalf("could not cancel the backup - %v", err)
+	}
+
+	watchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	done, err := client.Watch(watchCtx, started.ID, nil)
+	if err != nil {
+		t.Fatalf("could not watch the backup - %v", err)
+	}
+	if done.State != StateCanceled {
+		t.Errorf("expected the backup to be canceled, got %+v", done)
+	}
+}
+
+func TestAgentMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfsbackupagenttls")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A CA signing the certificates of the agent and of a controller, and a CA nobody trusts
+	ca, caKey := writeCertificate(t, dir, "ca", nil, nil)
+	writeCertificate(t, dir, "agent", ca, caKey)
+	writeCertificate(t, dir, "controller", ca, caKey)
+	other, otherKey := writeCertificate(t, dir, "other", nil, nil)
+	writeCertificate(t, dir, "untrusted", other, otherKey)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+	serverConfig, err := ServerTLSConfig(path("agent.crt"), path("agent.key"), path("ca.crt"))
+	if err != nil {
+		t.Fatalf("could not load the agent's TLS configuration - %v", err)
+	}
+	if _, err = ServerTLSConfig(path("agent.crt"), path("agent.key"), path("agent.key")); err == nil {
+		t.Errorf("expected an error loading a CA file without certificates")
+	}
+
+	testCases := []struct {
+		client string
+		code   codes.Code
+	}{
+		// An authenticated controller gets to ask for a job that does not exist
+		{"controller", codes.NotFound},
+		{"untrusted", codes.Unavailable},
+		{"", codes.Unavailable},
+	}
+
+	for idx, c := range testCases {
+		clientConfig, cerr := ClientTLSConfig(path("controller.crt"), path("controller.key"), path("ca.crt"))
+		if cerr != nil {
+			t.Fatalf("%d: could not load the controller's TLS configuration - %v", idx, cerr)
+		}
+		switch c.client {
+		case "":
+			clientConfig.Certificates = nil
+		case "untrusted":
+			clientConfig, _ = ClientTLSConfig(path("untrusted.crt"), path("untrusted.key"), path("ca.crt"))
+		}
+		clientConfig.ServerName = "agent"
+
+		client, stop := serve(t, newTestService(), credentials.NewTLS(serverConfig), credentials.NewTLS(clientConfig))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = client.Status(ctx, "backup-1")
+		cancel()
+		stop()
+		if code := status.Code(err); code != c.code {
+			t.Errorf("%d: expected code %v, got %v (%v)", idx, c.code, code, err)
+		}
+	}
+}
+
+// writeCertificate will write a certificate and key for the provided name to dir, signed by the provided CA or
+// self-signed as a CA if none is provided.
+func writeCertificate(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key - %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("could not generate serial number - %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := ca, caKey
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("could not create certificate - %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key - %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatalf("could not write certificate - %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatalf("could not write key - %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate - %v", err)
+	}
+	return cert, key
+}
@@ -0,0 +1,266 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package agent
+
+//go:generate protoc --go_out=agentpb --go_opt=paths=source_relative --go-grpc_out=agentpb --go-grpc_opt=paths=source_relative agent.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/kietdlam/zfsbackup-go/agent/agentpb"
+)
+
+// errNoCertificates is returned when a CA file does not hold any PEM encoded certificate.
+var errNoCertificates = errors.New("no certificates could be read from the CA file")
+
+// server exposes a Service through the gRPC stubs generated from agent.proto.
+type server struct {
+	agentpb.UnimplementedAgentServer
+	s *Service
+}
+
+func (srv *server) StartBackup(ctx context.Context, req *agentpb.BackupRequest) (*agentpb.JobStatus, error) {
+	return statusToProto(srv.s.StartBackup(ctx, &BackupRequest{
+		Dataset:         req.Dataset,
+		Snapshot:        req.Snapshot,
+		IncrementalFrom: req.IncrementalFrom,
+		Full:            req.Full,
+		Incremental:     req.Incremental,
+		Destinations:    req.Destinations,
+	}))
+}
+
+func (srv *server) StartRestore(ctx context.Context, req *agentpb.RestoreRequest) (*agentpb.JobStatus, error) {
+	return statusToProto(srv.s.StartRestore(ctx, &RestoreRequest{
+		Dataset:      req.Dataset,
+		Snapshot:     req.Snapshot,
+		Auto:         req.Auto,
+		Force:        req.Force,
+		Destinations: req.Destinations,
+		Target:       req.Target,
+	}))
+}
+
+func (srv *server) Status(ctx context.Context, req *agentpb.JobRequest) (*agentpb.JobStatus, error) {
+	return statusToProto(srv.s.Status(ctx, &JobRequest{ID: req.ID}))
+}
+
+func (srv *server) Cancel(ctx context.Context, req *agentpb.JobRequest) (*agentpb.JobStatus, error) {
+	return statusToProto(srv.s.Cancel(ctx, &JobRequest{ID: req.ID}))
+}
+
+func (srv *server) Watch(req *agentpb.JobRequest, stream agentpb.Agent_WatchServer) error {
+	return srv.s.Watch(stream.Context(), &JobRequest{ID: req.ID}, func(st *JobStatus) error {
+		out, _ := statusToProto(st, nil)
+		return stream.Send(out)
+	})
+}
+
+// statusToProto will convert the status returned by a method of the Service into its message, passing along the
+// method's error.
+func statusToProto(st *JobStatus, err error) (*agentpb.JobStatus, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &agentpb.JobStatus{
+		ID:              st.ID,
+		Kind:            st.Kind,
+		Dataset:         st.Dataset,
+		State:           st.State,
+		Error:           st.Error,
+		StartTime:       timeToProto(st.StartTime),
+		EndTime:         timeToProto(st.EndTime),
+		VolumesUploaded: int64(st.VolumesUploaded),
+		BytesUploaded:   st.BytesUploaded,
+	}, nil
+}
+
+// statusFromProto will convert a status message received from the agent, passing along the call's error.
+func statusFromProto(st *agentpb.JobStatus, err error) (*JobStatus, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &JobStatus{
+		ID:              st.ID,
+		Kind:            st.Kind,
+		Dataset:         st.Dataset,
+		State:           st.State,
+		Error:           st.Error,
+		StartTime:       timeFromProto(st.StartTime),
+		EndTime:         timeFromProto(st.EndTime),
+		VolumesUploaded: int(st.VolumesUploaded),
+		BytesUploaded:   st.BytesUploaded,
+	}, nil
+}
+
+// timeToProto leaves zero times unset so they are received as zero times again, see timeFromProto.
+func timeToProto(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func timeFromProto(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// NewServer will create a gRPC server exposing the provided Service. Clients must present a certificate trusted by
+// the provided TLS configuration, see ServerTLSConfig. A nil configuration serves the API without any
+// authentication, which should only be done over a trusted transport (e.g. a local socket).
+func NewServer(s *Service, tlsConfig *tls.Config, opts ...grpc.ServerOption) *grpc.Server {
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(opts...)
+	agentpb.RegisterAgentServer(grpcServer, &server{s: s})
+	return grpcServer
+}
+
+// ServerTLSConfig will load the agent's certificate and key along with the CA certificates that client certificates
+// must be signed by, requiring clients to authenticate with a certificate (mTLS).
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLSConfig will load a controller's certificate and key along with the CA certificates that agent
+// certificates must be signed by.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: %v", caFile, errNoCertificates)
+	}
+	return pool, nil
+}
+
+// Client calls the API of an agent, e.g. from a central controller.
+type Client struct {
+	client agentpb.AgentClient
+}
+
+// NewClient will create a Client calling the agent over the provided connection.
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{client: agentpb.NewAgentClient(conn)}
+}
+
+// StartBackup will ask the agent to backup a dataset, see Service.StartBackup.
+func (c *Client) StartBackup(ctx context.Context, req *BackupRequest) (*JobStatus, error) {
+	return statusFromProto(c.client.StartBackup(ctx, &agentpb.BackupRequest{
+		Dataset:         req.Dataset,
+		Snapshot:        req.Snapshot,
+		IncrementalFrom: req.IncrementalFrom,
+		Full:            req.Full,
+		Incremental:     req.Incremental,
+		Destinations:    req.Destinations,
+	}))
+}
+
+// StartRestore will ask the agent to restore a backup, see Service.StartRestore.
+func (c *Client) StartRestore(ctx context.Context, req *RestoreRequest) (*JobStatus, error) {
+	return statusFromProto(c.client.StartRestore(ctx, &agentpb.RestoreRequest{
+		Dataset:      req.Dataset,
+		Snapshot:     req.Snapshot,
+		Auto:         req.Auto,
+		Force:        req.Force,
+		Destinations: req.Destinations,
+		Target:       req.Target,
+	}))
+}
+
+// Status will return the status of a job on the agent, see Service.Status.
+func (c *Client) Status(ctx context.Context, id string) (*JobStatus, error) {
+	return statusFromProto(c.client.Status(ctx, &agentpb.JobRequest{ID: id}))
+}
+
+// Cancel will cancel a job on the agent, see Service.Cancel.
+func (c *Client) Cancel(ctx context.Context, id string) (*JobStatus, error) {
+	return statusFromProto(c.client.Cancel(ctx, &agentpb.JobRequest{ID: id}))
+}
+
+// Watch will call progress with each status of a job streamed by the agent, returning once the job is done or
+// the stream ends, see Service.Watch. The last status received is returned.
+func (c *Client) Watch(ctx context.Context, id string, progress func(*JobStatus)) (*JobStatus, error) {
+	stream, err := c.client.Watch(ctx, &agentpb.JobRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	var last *JobStatus
+	for {
+		st, err := statusFromProto(stream.Recv())
+		if err == io.EOF {
+			return last, nil
+		} else if err != nil {
+			return last, err
+		}
+		last = st
+		if progress != nil {
+			progress(st)
+		}
+	}
+}
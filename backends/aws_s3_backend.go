@@ -25,8 +25,12 @@ import (
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -35,12 +39,18 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/cenkalti/backoff"
+	"github.com/juju/ratelimit"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/kietdlam/zfsbackup-go/helpers"
 	//"../helpers"
@@ -49,6 +59,25 @@ import (
 // AWSS3BackendPrefix is the URI prefix used for the AWSS3Backend.
 const AWSS3BackendPrefix = "s3"
 
+// s3ExpiryTagKey is the object tag holding the number of days an uploaded object should be kept for, see S3ExpiryTagging.
+const s3ExpiryTagKey = "zfsbackup-expire-days"
+
+// s3MaxDeleteBatchSize is the most keys a single DeleteObjects request can delete.
+const s3MaxDeleteBatchSize = 1000
+
+// s3MaxCopyObjectSize is the largest object a single CopyObject request can copy, larger objects are copied in parts.
+const s3MaxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+// s3RestorePollInterval is the initial delay between checks on whether an object has been restored
+// from Glacier, it grows with each check up to ten times its value.
+var s3RestorePollInterval = time.Minute
+
+// errIncompleteListing is returned when a page of a listing looks truncated, e.g. under load.
+var errIncompleteListing = errors.New("s3 backend: the listing returned by the bucket looks incomplete")
+
+// errUploadMismatch is returned when an uploaded object does not match the size or checksum of its volume.
+var errUploadMismatch = errors.New("s3 backend: the uploaded object does not match the volume")
+
 // AWSS3Backend integrates with Amazon Web Services' S3.
 type AWSS3Backend struct {
 	conf       *BackendConfig
@@ -57,6 +86,10 @@ type AWSS3Backend struct {
 	uploader   s3manageriface.UploaderAPI
 	prefix     string
 	bucketName string
+
+	// The storage class of the objects checked before downloading them, see PreDownload
+	classMutex sync.Mutex
+	classes    map[string]string
 }
 
 // Authenticate https://godoc.org/github.com/aws/aws-sdk-go/aws/session#hdr-Environment_Variables
@@ -101,6 +134,14 @@ func WithS3Uploader(c s3manageriface.UploaderAPI) Option {
 func (a *AWSS3Backend) Init(ctx context.Context, conf *BackendConfig, opts ...Option) error {
 	a.conf = conf
 
+	if conf.StorageClass != "" && !isS3StorageClass(conf.StorageClass) {
+		return fmt.Errorf("%w: %s (expected one of %s)", ErrInvalidStorageClass, conf.StorageClass, strings.Join(s3.StorageClass_Values(), ", "))
+	}
+
+	if err := validateS3SSE(conf.S3SSE, conf.S3KMSKeyID); err != nil {
+		return err
+	}
+
 	cleanPrefix := strings.TrimPrefix(a.conf.TargetURI, AWSS3BackendPrefix+"://")
 	if cleanPrefix == a.conf.TargetURI {
 		return ErrInvalidURI
@@ -118,20 +159,14 @@ func (a *AWSS3Backend) Init(ctx context.Context, conf *BackendConfig, opts ...Op
 	}
 
 	if a.client == nil {
-		awsconf := aws.NewConfig().
-			WithS3ForcePathStyle(true).
-			WithEndpoint(os.Getenv("AWS_S3_CUSTOM_ENDPOINT"))
-		if enableDebug, _ := strconv.ParseBool(os.Getenv("AWS_S3_ENABLE_DEBUG")); enableDebug {
-			awsconf = awsconf.WithLogger(logger{}).
-				WithLogLevel(aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors)
-		}
-
-		sess, err := session.NewSession(awsconf)
+		sess, err := session.NewSession(newS3Config(conf))
 		if err != nil {
 			return err
 		}
 
-		a.client = s3.New(sess)
+		client := s3.New(sess)
+		client.Handlers.Build.PushBack(injectTraceContext)
+		a.client = client
 	}
 
 	if a.uploader == nil {
@@ -147,10 +182,40 @@ func (a *AWSS3Backend) Init(ctx context.Context, conf *BackendConfig, opts ...Op
 		MaxKeys: aws.Int64(0),
 	}
 
-	_, err := a.client.ListObjectsV2WithContext(ctx, listReq)
+	var serverDate string
+	err := retryInit(ctx, conf, AWSS3BackendPrefix, func() error {
+		_, err := a.client.ListObjectsV2WithContext(ctx, listReq, withServerDate(&serverDate))
+		return err
+	}, isTransientS3Error)
+
+	// Requests refused with RequestTimeTooSkewed still carry the server time to check against
+	if skewErr := checkClockSkew(AWSS3BackendPrefix, serverDate, time.Now(), conf); skewErr != nil {
+		return skewErr
+	}
 	return err
 }
 
+func newS3Config(conf *BackendConfig) *aws.Config {
+	awsconf := aws.NewConfig().
+		WithS3ForcePathStyle(true).
+		WithEndpoint(os.Getenv("AWS_S3_CUSTOM_ENDPOINT"))
+	if enableDebug, _ := strconv.ParseBool(os.Getenv("AWS_S3_ENABLE_DEBUG")); enableDebug {
+		awsconf = awsconf.WithLogger(logger{}).
+			WithLogLevel(aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors)
+	}
+
+	if conf.DNSCacheTTL > 0 || conf.MaxConnsPerHost > 0 {
+		awsconf = awsconf.WithHTTPClient(&http.Client{Transport: newHTTPTransport(conf)})
+	}
+
+	return awsconf
+}
+
+// injectTraceContext will propagate the span found in the request's context to the endpoint.
+func injectTraceContext(r *request.Request) {
+	otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.HTTPRequest.Header))
+}
+
 func withContentMD5Header(md5sum string) request.Option {
 	return func(ro *request.Request) {
 		if md5sum != "" {
@@ -161,6 +226,48 @@ func withContentMD5Header(md5sum string) request.Option {
 	}
 }
 
+// withIfNoneMatchHeader will make the request creating the object fail if the object already exists.
+// For multipart uploads the condition is checked when completing the upload.
+func withIfNoneMatchHeader(ro *request.Request) {
+	ro.Handlers.Build.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject", "CompleteMultipartUpload":
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+	})
+}
+
+// isPreconditionFailed will check whether the provided error, or any error it wraps, is due to a failed precondition.
+func isPreconditionFailed(err error) bool {
+	for err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusPreconditionFailed {
+			return true
+		}
+		awsErr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		if awsErr.Code() == "PreconditionFailed" {
+			return true
+		}
+		err = awsErr.OrigErr()
+	}
+	return false
+}
+
+// withServerDate will record the Date header of the response to the request, if any, to the provided string.
+func withServerDate(date *string) request.Option {
+	return func(ro *request.Request) {
+		ro.Handlers.Send.PushBack(func(r *request.Request) {
+			if r.HTTPResponse != nil {
+				if d := r.HTTPResponse.Header.Get("Date"); d != "" {
+					*date = d
+				}
+			}
+		})
+	}
+}
+
 func withRequestLimiter(buffer chan bool) request.Option {
 	return func(ro *request.Request) {
 		ro.Handlers.Send.PushFront(func(r *request.Request) {
@@ -173,6 +280,21 @@ func withRequestLimiter(buffer chan bool) request.Option {
 	}
 }
 
+// withPartRetryer will retry a failed part of an upload on its own, up to maxRetries times, without restarting
+// the parts that already succeeded. The s3manager buffers each part so it can be resent as-is.
+func withPartRetryer(maxRetries int, maxDelay time.Duration) request.Option {
+	return func(ro *request.Request) {
+		switch ro.Operation.Name {
+		case "UploadPart", "PutObject":
+			ro.Retryer = client.DefaultRetryer{
+				NumMaxRetries:    maxRetries,
+				MaxRetryDelay:    maxDelay,
+				MaxThrottleDelay: maxDelay,
+			}
+		}
+	}
+}
+
 func withComputeMD5HashHandler(ro *request.Request) {
 	ro.Handlers.Build.PushBack(func(r *request.Request) {
 		reader := r.GetBody()
@@ -210,6 +332,13 @@ func (a *AWSS3Backend) Upload(ctx context.Context, vol *helpers.VolumeInfo) erro
 	key := a.prefix + vol.ObjectName
 	var options []request.Option
 	options = append(options, withRequestLimiter(a.conf.MaxParallelUploadBuffer))
+	conditional := a.conf.ConditionalUpload && !vol.IsManifest
+	if conditional {
+		options = append(options, withIfNoneMatchHeader)
+	}
+	if a.conf.UploadPartRetries > 0 {
+		options = append(options, withPartRetryer(a.conf.UploadPartRetries, a.conf.MaxBackoffTime))
+	}
 	var r io.Reader
 
 	if !vol.IsUsingPipe() {
@@ -229,17 +358,133 @@ func (a *AWSS3Backend) Upload(ctx context.Context, vol *helpers.VolumeInfo) erro
 		r = &reader{vol} // Remove the Seek interface since we are using a Pipe
 	}
 
-	// Do a MultiPart Upload - force the s3manager to compute each chunks md5 hash
-	_, err := a.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(a.bucketName),
 		Key:    aws.String(key),
 		Body:   r,
-	}, s3manager.WithUploaderRequestOptions(options...))
+	}
+	if !a.conf.ExpiresAt.IsZero() {
+		input.Expires = aws.Time(a.conf.ExpiresAt)
+	}
+	if a.conf.ExpiryTagging != "" {
+		input.Tagging = aws.String(a.conf.ExpiryTagging)
+	}
 
+	// S3 decrypts objects encrypted this way transparently, so downloads need no change
+	input.ServerSideEncryption, input.SSEKMSKeyId = a.serverSideEncryption()
+
+	// Objects are uploaded to the STANDARD storage class unless configured otherwise, lifecycle rules may transition
+	// them to others later. Manifests, and the restore script and checksums uploaded like them, are always kept in
+	// STANDARD so they can be listed and read without a restore.
+	class := s3.ObjectStorageClassStandard
+	if a.conf.StorageClass != "" && !vol.IsManifest {
+		class = a.conf.StorageClass
+		input.StorageClass = aws.String(class)
+	}
+	release, err := helpers.BackupClassLimiter.Acquire(ctx, class, helpers.OperationUpload)
+	if err != nil {
+		return err
+	}
+
+	// Do a MultiPart Upload - force the s3manager to compute each chunks md5 hash
+	_, err = a.uploader.UploadWithContext(ctx, input, s3manager.WithUploaderRequestOptions(options...))
+	release()
+
+	if conditional && isPreconditionFailed(err) {
+		helpers.AppLogger.Infof("s3 backend: Volume %s already exists in the bucket, treating it as already uploaded.", vol.ObjectName)
+		return nil
+	}
 	if err != nil {
 		helpers.AppLogger.Debugf("s3 backend: Error while uploading volume %s - %v", vol.ObjectName, err)
+		return err
 	}
-	return err
+
+	if a.conf.VerifyUploads && !vol.IsUsingPipe() {
+		return a.verifyUpload(ctx, key, vol)
+	}
+	return nil
+}
+
+// S3ExpiryTagging returns the object tags to upload the objects of a backup started at start with so they expire at
+// expiresAt. S3 lifecycle rules can only filter on exact tag values and count whole days from the creation of the
+// object, so objects are tagged with the number of days they should be kept for, rounded up, e.g.
+// zfsbackup-expire-days=30 for a lifecycle rule expiring objects with that tag after 30 days. The tagging is computed
+// once from the start of the backup, passed as the ExpiryTagging of the config, so all the objects of a backup set
+// get the same tag however long the backup takes.
+func S3ExpiryTagging(expiresAt, start time.Time) string {
+	days := int64(math.Ceil(expiresAt.Sub(start).Hours() / 24))
+	if days < 1 {
+		days = 1
+	}
+	return url.Values{s3ExpiryTagKey: []string{strconv.FormatInt(days, 10)}}.Encode()
+}
+
+// verifyUpload will HEAD the uploaded object and compare its size and ETag against the volume, catching
+// uploads silently truncated by some S3 compatible stores before the upload is considered durable.
+func (a *AWSS3Backend) verifyUpload(ctx context.Context, key string, vol *helpers.VolumeInfo) error {
+	head, err := a.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		helpers.AppLogger.Debugf("s3 backend: Could not verify the upload of volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+
+	if size := aws.Int64Value(head.ContentLength); size < 0 || uint64(size) != vol.Size {
+		helpers.AppLogger.Warningf("s3 backend: The uploaded object for volume %s is %d bytes, expected %d bytes.", vol.ObjectName, size, vol.Size)
+		return errUploadMismatch
+	}
+
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || head.SSECustomerAlgorithm != nil {
+		// The ETag of objects encrypted this way is not derived from their content
+		helpers.AppLogger.Debugf("s3 backend: Only verified the size of the uploaded object for volume %s as it is encrypted.", vol.ObjectName)
+		return nil
+	}
+
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	expected := vol.MD5Sum
+	if strings.Contains(etag, "-") {
+		if expected, err = multipartETag(vol, a.partSize(vol.Size)); err != nil {
+			return err
+		}
+	}
+	if etag != expected {
+		helpers.AppLogger.Warningf("s3 backend: The uploaded object for volume %s has the ETag %s, expected %s.", vol.ObjectName, etag, expected)
+		return errUploadMismatch
+	}
+
+	helpers.AppLogger.Debugf("s3 backend: Verified the upload of volume %s.", vol.ObjectName)
+	return nil
+}
+
+// partSize will return the size of the parts an object of the provided size is uploaded in, as the s3manager would.
+func (a *AWSS3Backend) partSize(size uint64) int64 {
+	partSize := int64(a.conf.UploadChunkSize)
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	if int64(size)/partSize >= s3manager.MaxUploadParts {
+		partSize = int64(size)/s3manager.MaxUploadParts + 1
+	}
+	return partSize
+}
+
+// multipartETag will compute the ETag of the volume were it uploaded in parts of the provided size,
+// the MD5 checksum of the concatenated MD5 checksums of each part followed by the number of parts.
+func multipartETag(vol *helpers.VolumeInfo, partSize int64) (string, error) {
+	sums := md5.New()
+	parts := 0
+	for offset := int64(0); offset < int64(vol.Size); offset += partSize {
+		part := md5.New()
+		if _, err := io.Copy(part, io.NewSectionReader(vol, offset, partSize)); err != nil {
+			return "", err
+		}
+		sums.Write(part.Sum(nil))
+		parts++
+	}
+
+	return fmt.Sprintf("%x-%d", sums.Sum(nil), parts), nil
 }
 
 // Delete will delete the given object from the configured bucket
@@ -252,17 +497,164 @@ func (a *AWSS3Backend) Delete(ctx context.Context, key string) error {
 	return err
 }
 
-// PreDownload will restore objects from Glacier as required.
+// MaxDeleteBatchSize returns the most keys a single DeleteObjects request can delete.
+func (a *AWSS3Backend) MaxDeleteBatchSize() int {
+	return s3MaxDeleteBatchSize
+}
+
+// DeleteBatch will delete the given objects from the configured bucket in a single DeleteObjects request. Keys S3
+// could not delete are returned along with the error it reported for each of them.
+func (a *AWSS3Backend) DeleteBatch(ctx context.Context, keys []string) (map[string]error, error) {
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for idx := range keys {
+		objects[idx] = &s3.ObjectIdentifier{Key: aws.String(keys[idx])}
+	}
+
+	resp, err := a.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(a.bucketName),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(map[string]error)
+	for _, e := range resp.Errors {
+		errs[aws.StringValue(e.Key)] = fmt.Errorf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
+	return errs, nil
+}
+
+// serverSideEncryption will return the server-side encryption, and KMS key, objects are stored with, if configured.
+func (a *AWSS3Backend) serverSideEncryption() (sse, kmsKeyID *string) {
+	if a.conf.S3SSE == "" {
+		return nil, nil
+	}
+	if a.conf.S3KMSKeyID != "" {
+		kmsKeyID = aws.String(a.conf.S3KMSKeyID)
+	}
+	return aws.String(a.conf.S3SSE), kmsKeyID
+}
+
+// Copy will copy the given object to another key of the configured bucket without downloading it. Objects larger than
+// a single CopyObject request allows are copied in parts of the size they would be uploaded in. Copies are encrypted
+// like uploads and keep the storage class of the object copied, so manifests stay in STANDARD.
+func (a *AWSS3Backend) Copy(ctx context.Context, source, destination string) error {
+	head, err := a.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(source),
+	})
+	if err != nil {
+		helpers.AppLogger.Debugf("s3 backend: Could not get the size of object %s to copy - %v", source, err)
+		return err
+	}
+
+	copySource := (&url.URL{Path: a.bucketName + "/" + source}).EscapedPath()
+	size := aws.Int64Value(head.ContentLength)
+	sse, kmsKeyID := a.serverSideEncryption()
+	if size <= s3MaxCopyObjectSize {
+		_, err = a.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:               aws.String(a.bucketName),
+			Key:                  aws.String(destination),
+			CopySource:           aws.String(copySource),
+			ServerSideEncryption: sse,
+			SSEKMSKeyId:          kmsKeyID,
+			StorageClass:         head.StorageClass,
+		})
+		if err != nil {
+			helpers.AppLogger.Debugf("s3 backend: Error while copying object %s to %s - %v", source, destination, err)
+		}
+		return err
+	}
+
+	return a.copyParts(ctx, copySource, destination, size, &s3.CreateMultipartUploadInput{
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+		StorageClass:         head.StorageClass,
+	})
+}
+
+// copyParts will copy the object at copySource, of the provided size, to the destination key with a multipart upload
+// started with the provided input, aborting the upload if any part cannot be copied.
+func (a *AWSS3Backend) copyParts(ctx context.Context, copySource, destination string, size int64, input *s3.CreateMultipartUploadInput) error {
+	input.Bucket = aws.String(a.bucketName)
+	input.Key = aws.String(destination)
+	upload, err := a.client.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		helpers.AppLogger.Debugf("s3 backend: Could not start the multipart copy of %s to %s - %v", copySource, destination, err)
+		return err
+	}
+
+	partSize := a.partSize(uint64(size))
+	var parts []*s3.CompletedPart
+	for offset, number := int64(0), int64(1); offset < size; offset, number = offset+partSize, number+1 {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		resp, perr := a.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(a.bucketName),
+			Key:             aws.String(destination),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			PartNumber:      aws.Int64(number),
+			UploadId:        upload.UploadId,
+		})
+		if perr != nil {
+			helpers.AppLogger.Debugf("s3 backend: Could not copy part %d of %s to %s - %v", number, copySource, destination, perr)
+			a.abortCopy(destination, upload.UploadId)
+			return perr
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: resp.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+	}
+
+	_, err = a.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(a.bucketName),
+		Key:             aws.String(destination),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		helpers.AppLogger.Debugf("s3 backend: Could not complete the multipart copy of %s to %s - %v", copySource, destination, err)
+		a.abortCopy(destination, upload.UploadId)
+	}
+	return err
+}
+
+// abortCopy will abort the provided multipart upload so its parts are not left behind. The upload is aborted even if
+// the copy was cancelled.
+func (a *AWSS3Backend) abortCopy(destination string, uploadID *string) {
+	_, err := a.client.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(a.bucketName),
+		Key:      aws.String(destination),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		helpers.AppLogger.Warningf("s3 backend: Could not abort the multipart copy to %s, its parts may need to be cleaned up - %v", destination, err)
+	}
+}
+
+// PreDownload will restore objects from Glacier or Glacier Deep Archive as required. Objects are checked, and restores
+// requested, in batches of up to MaxParallelRestores at a time and no faster than RestoreRequestRate per second, or
+// the limits of their storage class, retrying throttled requests. It then waits for every restore to complete,
+// checking on up to MaxParallelRestores at a time.
 func (a *AWSS3Backend) PreDownload(ctx context.Context, keys []string) error {
-	// First Let's check if any objects are on the GLACIER storage class
-	toRestore := make([]string, 0, len(keys))
 	restoreTier := os.Getenv("AWS_S3_GLACIER_RESTORE_TIER")
 	if restoreTier == "" {
 		restoreTier = s3.TierBulk
 	}
-	var bytesToRestore int64
 	helpers.AppLogger.Debugf("s3 backend: will use the %s restore tier when trying to restore from Glacier.", restoreTier)
-	for _, key := range keys {
+
+	var limiter *ratelimit.Bucket
+	if a.conf.RestoreRequestRate > 0 {
+		limiter = ratelimit.NewBucketWithRate(a.conf.RestoreRequestRate, 1)
+	}
+
+	// First Let's check if any objects are on the GLACIER or DEEP_ARCHIVE storage classes
+	var mutex sync.Mutex
+	toRestore := make([]string, 0, len(keys))
+	var bytesToRestore int64
+	err := a.inBatches(ctx, keys, func(ctx context.Context, key string) error {
 		resp, err := a.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 			Bucket: aws.String(a.bucketName),
 			Key:    aws.String(key),
@@ -270,68 +662,276 @@ func (a *AWSS3Backend) PreDownload(ctx context.Context, keys []string) error {
 		if err != nil {
 			return err
 		}
-		if resp.StorageClass != nil && *resp.StorageClass == s3.ObjectStorageClassGlacier {
-			helpers.AppLogger.Debugf("s3 backend: key %s will be restored from the Glacier storage class.", key)
-			bytesToRestore += *resp.ContentLength
-			// Let's Start a restore
-			toRestore = append(toRestore, key)
-			_, rerr := a.client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
-				Bucket: aws.String(a.bucketName),
-				Key:    aws.String(key),
-				RestoreRequest: &s3.RestoreRequest{
-					Days: aws.Int64(3),
-					GlacierJobParameters: &s3.GlacierJobParameters{
-						Tier: aws.String(restoreTier),
-					},
-				},
-			})
-			if rerr != nil {
-				if aerr, ok := rerr.(awserr.Error); ok && aerr.Code() != "RestoreAlreadyInProgress" {
-					helpers.AppLogger.Debugf("s3 backend: error trying to restore key %s - %s: %s", key, aerr.Code(), aerr.Message())
-					return rerr
-				}
-			}
+		// Objects in the STANDARD storage class do not report it
+		class := s3.ObjectStorageClassStandard
+		if resp.StorageClass != nil {
+			class = *resp.StorageClass
 		}
+		a.setStorageClass(key, class)
+		if class != s3.ObjectStorageClassGlacier && class != s3.ObjectStorageClassDeepArchive {
+			return nil
+		}
+
+		helpers.AppLogger.Debugf("s3 backend: key %s will be restored from the %s storage class.", key, class)
+		mutex.Lock()
+		bytesToRestore += *resp.ContentLength
+		toRestore = append(toRestore, key)
+		mutex.Unlock()
+
+		// Let's Start a restore
+		return a.requestRestore(ctx, key, class, restoreTier, limiter)
+	})
+	if err != nil {
+		return err
 	}
+
 	if len(toRestore) > 0 {
 		helpers.AppLogger.Infof("s3 backend: waiting for %d objects to restore from Glacier totaling %d bytes (this could take several hours)", len(toRestore), bytesToRestore)
 		// Now wait for the objects to be restored
-		backoffCount := 1
-		for idx := 0; idx < len(toRestore); idx++ {
-			key := toRestore[idx]
-			resp, err := a.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-				Bucket: aws.String(a.bucketName),
-				Key:    aws.String(key),
+		return a.inBatches(ctx, toRestore, a.waitForRestore)
+	}
+	return nil
+}
+
+// inBatches will call fn for each of the provided keys, running up to MaxParallelRestores calls at a time
+// and waiting for each batch to complete before starting the next one.
+func (a *AWSS3Backend) inBatches(ctx context.Context, keys []string, fn func(context.Context, string) error) error {
+	batchSize := a.conf.MaxParallelRestores
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		group, gctx := errgroup.WithContext(ctx)
+		for _, key := range keys[start:end] {
+			key := key
+			group.Go(func() error {
+				return fn(gctx, key)
 			})
-			if err != nil {
-				return err
-			}
-			if *resp.Restore == "ongoing-request=\"true\"" {
-				time.Sleep(time.Duration(backoffCount) * time.Minute)
-				idx--
-				backoffCount++
-				if backoffCount > 10 {
-					backoffCount = 10
-				}
-			} else {
-				backoffCount = 1
-				helpers.AppLogger.Debugf("s3 backend: key %s restored.", key)
-			}
+		}
+		if err := group.Wait(); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// requestRestore will request a restore of the provided key from its archival storage class, waiting on the limiter
+// and the limits of the storage class, if any, before each request and retrying requests that were throttled.
+func (a *AWSS3Backend) requestRestore(ctx context.Context, key, class, restoreTier string, limiter *ratelimit.Bucket) error {
+	be := backoff.NewExponentialBackOff()
+	if a.conf.MaxBackoffTime > 0 {
+		be.MaxInterval = a.conf.MaxBackoffTime
+	}
+	be.MaxElapsedTime = a.conf.MaxRetryTime
+
+	operation := func() error {
+		if limiter != nil {
+			if err := sleepContext(ctx, limiter.Take(1)); err != nil {
+				return backoff.Permanent(err)
+			}
+		}
+
+		release, err := helpers.BackupClassLimiter.Acquire(ctx, class, helpers.OperationRestore)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		_, err = a.client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+			Bucket: aws.String(a.bucketName),
+			Key:    aws.String(key),
+			RestoreRequest: &s3.RestoreRequest{
+				Days: aws.Int64(3),
+				GlacierJobParameters: &s3.GlacierJobParameters{
+					Tier: aws.String(restoreTier),
+				},
+			},
+		})
+		release()
+		switch {
+		case err == nil:
+			return nil
+		case isThrottled(err):
+			helpers.AppLogger.Debugf("s3 backend: restore request for key %s was throttled, will retry - %v", key, err)
+			return err
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+			return nil
+		} else if ok {
+			helpers.AppLogger.Debugf("s3 backend: error trying to restore key %s - %s: %s", key, aerr.Code(), aerr.Message())
+		}
+		return backoff.Permanent(err)
+	}
+
+	return backoff.Retry(operation, backoff.WithContext(be, ctx))
+}
+
+// waitForRestore will check on the provided key until it has been restored from Glacier, backing off
+// between checks.
+func (a *AWSS3Backend) waitForRestore(ctx context.Context, key string) error {
+	backoffCount := 1
+	for {
+		resp, err := a.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(a.bucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+		if resp.Restore == nil || *resp.Restore != "ongoing-request=\"true\"" {
+			helpers.AppLogger.Debugf("s3 backend: key %s restored.", key)
+			return nil
+		}
+
+		if err = sleepContext(ctx, time.Duration(backoffCount)*s3RestorePollInterval); err != nil {
+			return err
+		}
+		if backoffCount < 10 {
+			backoffCount++
+		}
+	}
+}
+
+// isThrottled will check whether the provided error is due to the request being throttled.
+func isThrottled(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "SlowDown" {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusTooManyRequests || reqErr.StatusCode() == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// isTransientS3Error will check whether the provided error is worth retrying, e.g. due to a network failure
+// or the request being throttled, as opposed to the request being denied or no credentials being found.
+func isTransientS3Error(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoCredentialProviders" {
+		// Wraps the errors of each credential provider tried, which may be network errors
+		return false
+	}
+	return isThrottled(err) || request.IsErrorRetryable(err) || isTransientError(err)
+}
+
+// sleepContext will sleep for the provided duration or until the context is canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 // Download will download the requseted object which can be read from the returned io.ReadCloser
 func (a *AWSS3Backend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
-	resp, err := a.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+	return a.getObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(key),
+	})
+}
+
+// DownloadRange will download length bytes of the requested object starting at offset.
+func (a *AWSS3Backend) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return a.getObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(a.bucketName),
 		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
 	})
+}
+
+// getObject will download the requested object within the download limits of its storage class, if it is known,
+// holding on to the request until the returned io.ReadCloser is closed.
+func (a *AWSS3Backend) getObject(ctx context.Context, input *s3.GetObjectInput) (io.ReadCloser, error) {
+	release, err := helpers.BackupClassLimiter.Acquire(ctx, a.storageClass(*input.Key), helpers.OperationDownload)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.GetObjectWithContext(ctx, input)
 	if err != nil {
+		release()
 		return nil, err
 	}
-	return resp.Body, nil
+	return &releasingReadCloser{ReadCloser: resp.Body, release: release}, nil
+}
+
+// isS3StorageClass will check whether the provided storage class is one objects can be uploaded to.
+func isS3StorageClass(class string) bool {
+	for _, valid := range s3.StorageClass_Values() {
+		if class == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// validateS3SSE will check the server-side encryption to upload objects with is one S3 supports, and that a KMS key
+// is only given along with a KMS based encryption.
+func validateS3SSE(sse, kmsKeyID string) error {
+	if sse == "" {
+		if kmsKeyID != "" {
+			return fmt.Errorf("%w: a KMS key ID was given without a KMS server-side encryption", ErrInvalidServerSideEncryption)
+		}
+		return nil
+	}
+
+	for _, valid := range s3.ServerSideEncryption_Values() {
+		if sse != valid {
+			continue
+		}
+		if kmsKeyID != "" && sse == s3.ServerSideEncryptionAes256 {
+			return fmt.Errorf("%w: a KMS key ID cannot be used with the %s server-side encryption", ErrInvalidServerSideEncryption, sse)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s (expected one of %s)", ErrInvalidServerSideEncryption, sse, strings.Join(s3.ServerSideEncryption_Values(), ", "))
+}
+
+// IsS3ArchiveStorageClass will check whether objects uploaded to the provided storage class must be restored before
+// they can be downloaded.
+func IsS3ArchiveStorageClass(class string) bool {
+	return class == s3.StorageClassGlacier || class == s3.StorageClassDeepArchive
+}
+
+// setStorageClass will record the storage class of the provided key.
+func (a *AWSS3Backend) setStorageClass(key, class string) {
+	a.classMutex.Lock()
+	defer a.classMutex.Unlock()
+	if a.classes == nil {
+		a.classes = make(map[string]string)
+	}
+	a.classes[key] = class
+}
+
+// storageClass will return the storage class recorded for the provided key, or an empty string if it is not known.
+func (a *AWSS3Backend) storageClass(key string) string {
+	a.classMutex.Lock()
+	defer a.classMutex.Unlock()
+	return a.classes[key]
+}
+
+// releasingReadCloser will call release once closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
 }
 
 // Close will release any resources used by the AWS S3 backend.
@@ -344,6 +944,53 @@ func (a *AWSS3Backend) Close() error {
 // List will iterate through all objects in the configured AWS S3 bucket and return
 // a list of keys, filtering by the provided prefix.
 func (a *AWSS3Backend) List(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := a.ListDetailed(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
+	}
+
+	return l, nil
+}
+
+// ListDetailed will iterate through all objects in the configured AWS S3 bucket and return
+// the details of each object, filtering by the provided prefix. Listings that look incomplete,
+// e.g. a truncated page without a continuation token, are retried as configured by the retry knobs.
+func (a *AWSS3Backend) ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	be := backoff.NewExponentialBackOff()
+	if a.conf.MaxBackoffTime > 0 {
+		be.MaxInterval = a.conf.MaxBackoffTime
+	}
+	be.MaxElapsedTime = a.conf.MaxRetryTime
+
+	var l []ObjectInfo
+	operation := func() error {
+		var err error
+		l, err = a.listObjects(ctx, prefix)
+		if err == errIncompleteListing {
+			helpers.AppLogger.Warningf("s3 backend: the listing of prefix %q in bucket %s looks incomplete, will retry.", prefix, a.bucketName)
+			return err
+		}
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		return nil
+	}
+
+	if err := backoff.Retry(operation, backoff.WithContext(be, ctx)); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// listObjects will page through the objects in the configured AWS S3 bucket with the provided prefix, returning
+// errIncompleteListing if any page contradicts itself about how many objects it holds or how to continue.
+func (a *AWSS3Backend) listObjects(ctx context.Context, prefix string) ([]ObjectInfo, error) {
 	resp, err := a.client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
 		Bucket:  aws.String(a.bucketName),
 		MaxKeys: aws.Int64(1000),
@@ -353,16 +1000,29 @@ func (a *AWSS3Backend) List(ctx context.Context, prefix string) ([]string, error
 		return nil, err
 	}
 
-	l := make([]string, 0, 1000)
+	l := make([]ObjectInfo, 0, 1000)
 	for {
+		if resp.KeyCount != nil && *resp.KeyCount != int64(len(resp.Contents)) {
+			return nil, errIncompleteListing
+		}
+
 		for _, obj := range resp.Contents {
-			l = append(l, *obj.Key)
+			l = append(l, ObjectInfo{
+				Name:         *obj.Key,
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+				StorageClass: aws.StringValue(obj.StorageClass),
+			})
 		}
 
 		if !*resp.IsTruncated {
 			break
 		}
 
+		if aws.StringValue(resp.NextContinuationToken) == "" {
+			return nil, errIncompleteListing
+		}
+
 		resp, err = a.client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
 			Bucket:            aws.String(a.bucketName),
 			MaxKeys:           aws.Int64(1000),
@@ -26,21 +26,36 @@ package backends
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/cenkalti/backoff"
 	"github.com/kietdlam/zfsbackup-go/helpers"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	//"../helpers"
 )
 
@@ -48,15 +63,110 @@ type mockS3Client struct {
 	s3iface.S3API
 
 	headcallcount int
+	getRange      string
+
+	// Restore requests tracking, the first throttleCount requests for a throttled key are throttled
+	mutex              sync.Mutex
+	restoreCalls       map[string]int
+	restoreInFlight    int
+	maxRestoreInFlight int
+	throttleCount      int
+
+	// Listings of a short listing prefix are incomplete for the first listCalls attempts
+	listCalls map[string]int
+
+	// Objects uploaded by a mockS3Uploader sharing the same store, if any
+	objects *s3ObjectStore
+
+	// The source ranges of the parts copied, and whether a multipart copy was completed or aborted
+	copyRanges []string
+	completed  bool
+	aborted    bool
+
+	// The encryption and storage class of the last object copied
+	copySSE   string
+	copyKMS   string
+	copyClass string
 }
 
 type mockS3Uploader struct {
 	s3manageriface.UploaderAPI
+
+	objects *s3ObjectStore
+	// The input of the last upload
+	input *s3manager.UploadInput
+}
+
+// s3ObjectStore keeps the bodies uploaded by a mockS3Uploader so a mockS3Client can HEAD them.
+type s3ObjectStore struct {
+	mutex    sync.Mutex
+	partSize int64
+	bodies   map[string][]byte
+	uploads  map[string]int
+}
+
+// put will store the body of an upload and count how many times the key was uploaded.
+func (s *s3ObjectStore) put(key string, body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.bodies == nil {
+		s.bodies = make(map[string][]byte)
+		s.uploads = make(map[string]int)
+	}
+	s.bodies[key] = body
+	s.uploads[key]++
+}
+
+func (s *s3ObjectStore) head(key string) (*s3.HeadObjectOutput, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, ok := s.bodies[key]
+	if !ok {
+		return nil, false
+	}
+
+	etag := fmt.Sprintf("%x", md5.Sum(body))
+	if int64(len(body)) > s.partSize {
+		var sums []byte
+		parts := 0
+		for offset := int64(0); offset < int64(len(body)); offset += s.partSize {
+			end := offset + s.partSize
+			if end > int64(len(body)) {
+				end = int64(len(body))
+			}
+			sum := md5.Sum(body[offset:end])
+			sums = append(sums, sum[:]...)
+			parts++
+		}
+		etag = fmt.Sprintf("%x-%d", md5.Sum(sums), parts)
+	}
+
+	return &s3.HeadObjectOutput{
+		StorageClass:  aws.String(s3.ObjectStorageClassStandard),
+		ContentLength: aws.Int64(int64(len(body))),
+		ETag:          aws.String(`"` + etag + `"`),
+	}, true
 }
 
 var (
-	s3BadBucket = "badbucket"
-	s3BadKey    = "badkey"
+	s3BadBucket    = "badbucket"
+	s3BadKey       = "badkey"
+	s3ExistingKey  = "existingkey"
+	s3ThrottledKey = "throttled"
+
+	// The first upload of a truncated key is cut short, every upload of a corrupt key is altered
+	s3TruncatedKey = "verifytruncated"
+	s3CorruptKey   = "verifycorrupt"
+
+	// Objects with this prefix are too large to copy in a single request
+	s3LargeKey = "large"
+
+	s3ShortListingKey = "shortlisting"
+	s3ShortPageKey    = "shortpage"
+
+	// Listing a flaky bucket fails with a network error for the first two attempts
+	s3FlakyBucket  = "flakybucket"
+	s3DeniedBucket = "deniedbucket"
 )
 
 const s3TestBucketName = "s3bucketbackendtest"
@@ -69,12 +179,82 @@ func (m *mockS3Client) DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObj
 	return nil, nil
 }
 
+func (m *mockS3Client) DeleteObjectsWithContext(ctx aws.Context, in *s3.DeleteObjectsInput, _ ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	// S3 rejects requests with too many keys as a whole
+	if len(in.Delete.Objects) > s3MaxDeleteBatchSize {
+		return nil, errTest
+	}
+
+	out := &s3.DeleteObjectsOutput{}
+	for _, obj := range in.Delete.Objects {
+		if *obj.Key == s3BadKey {
+			out.Errors = append(out.Errors, &s3.Error{Key: obj.Key, Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+		} else if !aws.BoolValue(in.Delete.Quiet) {
+			out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: obj.Key})
+		}
+	}
+	return out, nil
+}
+
+func (m *mockS3Client) CopyObjectWithContext(ctx aws.Context, in *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	if *in.Key == s3BadKey {
+		return nil, errTest
+	}
+
+	m.copySSE, m.copyKMS, m.copyClass = aws.StringValue(in.ServerSideEncryption), aws.StringValue(in.SSEKMSKeyId), aws.StringValue(in.StorageClass)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3Client) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	m.copySSE, m.copyKMS, m.copyClass = aws.StringValue(in.ServerSideEncryption), aws.StringValue(in.SSEKMSKeyId), aws.StringValue(in.StorageClass)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (m *mockS3Client) UploadPartCopyWithContext(ctx aws.Context, in *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	// Copying the second part of a bad key fails
+	if *in.Key == s3BadKey && *in.PartNumber == 2 {
+		return nil, errTest
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.copyRanges = append(m.copyRanges, *in.CopySourceRange)
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("etag%d", *in.PartNumber))}}, nil
+}
+
+func (m *mockS3Client) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	for idx, part := range in.MultipartUpload.Parts {
+		if *part.PartNumber != int64(idx+1) || *part.ETag != fmt.Sprintf("etag%d", idx+1) {
+			return nil, errTest
+		}
+	}
+	m.completed = true
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3Client) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
 func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
 	if *in.Key == s3BadKey {
 		return nil, errTest
 	}
+	m.getRange = aws.StringValue(in.Range)
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
 
-	return &s3.GetObjectOutput{}, nil
+// countList will count an attempt to list the provided key and return the number of attempts so far.
+func (m *mockS3Client) countList(key string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.listCalls == nil {
+		m.listCalls = make(map[string]int)
+	}
+	m.listCalls[key]++
+	return m.listCalls[key]
 }
 
 func (m *mockS3Client) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
@@ -82,6 +262,39 @@ func (m *mockS3Client) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObje
 		return nil, errTest
 	}
 
+	switch *in.Bucket {
+	case s3DeniedBucket:
+		m.countList(*in.Bucket)
+		return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "request")
+	case s3FlakyBucket:
+		if m.countList(*in.Bucket) <= 2 {
+			return nil, awserr.New(request.ErrCodeRequestError, "send request failed", &net.OpError{Op: "dial", Net: "tcp", Err: errTest})
+		}
+		return &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}, nil
+	}
+
+	if prefix := aws.StringValue(in.Prefix); (prefix == s3ShortListingKey || prefix == s3ShortPageKey) && in.ContinuationToken == nil {
+		m.mutex.Lock()
+		if m.listCalls == nil {
+			m.listCalls = make(map[string]int)
+		}
+		m.listCalls[prefix]++
+		attempt := m.listCalls[prefix]
+		m.mutex.Unlock()
+		if attempt == 1 && prefix == s3ShortListingKey {
+			return &s3.ListObjectsV2Output{
+				IsTruncated: aws.Bool(true),
+				Contents:    []*s3.Object{{Key: aws.String("random")}},
+			}, nil
+		} else if attempt == 1 {
+			return &s3.ListObjectsV2Output{
+				IsTruncated: aws.Bool(false),
+				KeyCount:    aws.Int64(3),
+				Contents:    []*s3.Object{{Key: aws.String("random")}},
+			}, nil
+		}
+	}
+
 	responses := make(map[string]*s3.ListObjectsV2Output)
 	responses[""] = &s3.ListObjectsV2Output{
 		IsTruncated:           aws.Bool(true),
@@ -119,15 +332,22 @@ func (m *mockS3Client) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObje
 }
 
 func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	if m.objects != nil {
+		if out, ok := m.objects.head(*in.Key); ok {
+			return out, nil
+		}
+	}
 	switch *in.Key {
 	case s3BadKey:
 		return nil, errTest
 	case "alreadyrestoring":
+		m.mutex.Lock()
 		m.headcallcount++
 		restoreString := "ongoing-request=\"true\""
 		if m.headcallcount >= 3 {
 			restoreString = ""
 		}
+		m.mutex.Unlock()
 		return &s3.HeadObjectOutput{
 			StorageClass:  aws.String(s3.ObjectStorageClassGlacier),
 			ContentLength: aws.Int64(50),
@@ -139,15 +359,58 @@ func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectI
 			ContentLength: aws.Int64(50),
 			Restore:       aws.String("ongoing-request=\"false\", expiry-date=\"Wed, 07 Nov 2012 00:00:00 GMT\""),
 		}, nil
-	default:
+	}
+	if strings.HasPrefix(*in.Key, "glacier") || strings.HasPrefix(*in.Key, s3ThrottledKey) {
+		return &s3.HeadObjectOutput{
+			StorageClass:  aws.String(s3.ObjectStorageClassGlacier),
+			ContentLength: aws.Int64(50),
+		}, nil
+	}
+	if strings.HasPrefix(*in.Key, s3LargeKey) {
 		return &s3.HeadObjectOutput{
 			StorageClass:  aws.String(s3.ObjectStorageClassStandard),
+			ContentLength: aws.Int64(s3MaxCopyObjectSize + 1),
+		}, nil
+	}
+	if strings.HasPrefix(*in.Key, "deeparchive") {
+		return &s3.HeadObjectOutput{
+			StorageClass:  aws.String(s3.ObjectStorageClassDeepArchive),
 			ContentLength: aws.Int64(50),
 		}, nil
 	}
+	if strings.HasPrefix(*in.Key, "standard") {
+		// Objects in the STANDARD storage class do not report it
+		return &s3.HeadObjectOutput{ContentLength: aws.Int64(50)}, nil
+	}
+	return &s3.HeadObjectOutput{
+		StorageClass:  aws.String(s3.ObjectStorageClassStandard),
+		ContentLength: aws.Int64(50),
+	}, nil
 }
 
 func (m *mockS3Client) RestoreObjectWithContext(ctx aws.Context, in *s3.RestoreObjectInput, _ ...request.Option) (*s3.RestoreObjectOutput, error) {
+	m.mutex.Lock()
+	if m.restoreCalls == nil {
+		m.restoreCalls = make(map[string]int)
+	}
+	m.restoreCalls[*in.Key]++
+	calls := m.restoreCalls[*in.Key]
+	m.restoreInFlight++
+	if m.restoreInFlight > m.maxRestoreInFlight {
+		m.maxRestoreInFlight = m.restoreInFlight
+	}
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		m.restoreInFlight--
+		m.mutex.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	if strings.HasPrefix(*in.Key, s3ThrottledKey) && calls <= m.throttleCount {
+		return nil, awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "requestid")
+	}
+
 	switch *in.Key {
 	case s3BadKey:
 		return nil, errTest
@@ -158,9 +421,31 @@ func (m *mockS3Client) RestoreObjectWithContext(ctx aws.Context, in *s3.RestoreO
 }
 
 func (m *mockS3Uploader) UploadWithContext(ctx aws.Context, in *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	m.input = in
 	if *in.Key == s3BadKey {
 		return nil, errTest
 	}
+	if *in.Key == s3ExistingKey {
+		// A conditional multipart upload is only rejected once it is completed
+		return nil, awserr.New("MultipartUpload", "upload multipart failed", awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), http.StatusPreconditionFailed, "requestid"))
+	}
+	if m.objects != nil {
+		body, err := ioutil.ReadAll(in.Body)
+		if err != nil {
+			return nil, err
+		}
+		switch *in.Key {
+		case s3TruncatedKey:
+			m.objects.mutex.Lock()
+			if m.objects.uploads[*in.Key] == 0 {
+				body = body[:len(body)/2]
+			}
+			m.objects.mutex.Unlock()
+		case s3CorruptKey:
+			body[0] ^= 0xff
+		}
+		m.objects.put(*in.Key, body)
+	}
 	return nil, nil
 }
 
@@ -213,6 +498,50 @@ func TestS3Init(t *testing.T) {
 			errTest: nilErrTest,
 			prefix:  "prefix",
 		},
+		{
+			conf: &BackendConfig{
+				TargetURI:    AWSS3BackendPrefix + "://goodbucket",
+				StorageClass: "GLACIER",
+			},
+			errTest: nilErrTest,
+		},
+		{
+			conf: &BackendConfig{
+				TargetURI:    AWSS3BackendPrefix + "://goodbucket",
+				StorageClass: "COLDEST",
+			},
+			errTest: func(err error) bool { return errors.Is(err, ErrInvalidStorageClass) },
+		},
+		{
+			conf: &BackendConfig{
+				TargetURI:  AWSS3BackendPrefix + "://goodbucket",
+				S3SSE:      "aws:kms",
+				S3KMSKeyID: "alias/backups",
+			},
+			errTest: nilErrTest,
+		},
+		{
+			conf: &BackendConfig{
+				TargetURI: AWSS3BackendPrefix + "://goodbucket",
+				S3SSE:     "ROT13",
+			},
+			errTest: func(err error) bool { return errors.Is(err, ErrInvalidServerSideEncryption) },
+		},
+		{
+			conf: &BackendConfig{
+				TargetURI:  AWSS3BackendPrefix + "://goodbucket",
+				S3SSE:      "AES256",
+				S3KMSKeyID: "alias/backups",
+			},
+			errTest: func(err error) bool { return errors.Is(err, ErrInvalidServerSideEncryption) },
+		},
+		{
+			conf: &BackendConfig{
+				TargetURI:  AWSS3BackendPrefix + "://goodbucket",
+				S3KMSKeyID: "alias/backups",
+			},
+			errTest: func(err error) bool { return errors.Is(err, ErrInvalidServerSideEncryption) },
+		},
 	}
 
 	for idx, c := range testCases {
@@ -226,6 +555,71 @@ func TestS3Init(t *testing.T) {
 	}
 }
 
+func TestS3InitRetry(t *testing.T) {
+	testCases := []struct {
+		bucket    string
+		retryTime time.Duration
+		errTest   errTestFunc
+		calls     int
+	}{
+		// A transient network failure at startup succeeds on retry
+		{s3FlakyBucket, time.Minute, nilErrTest, 3},
+		{s3FlakyBucket, 0, nonNilErrTest, 1},
+		// Denied requests are not retried
+		{s3DeniedBucket, time.Minute, nonNilErrTest, 1},
+	}
+
+	for idx, c := range testCases {
+		client := &mockS3Client{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:      AWSS3BackendPrefix + "://" + c.bucket,
+			MaxBackoffTime: 10 * time.Millisecond,
+			InitRetryTime:  c.retryTime,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if calls := client.listCalls[c.bucket]; calls != c.calls {
+			t.Errorf("%d: expected %d attempts to reach the bucket, got %d", idx, c.calls, calls)
+		}
+	}
+}
+
+func TestS3Config(t *testing.T) {
+	testCases := []struct {
+		conf      *BackendConfig
+		transport bool
+	}{
+		{&BackendConfig{}, false},
+		{&BackendConfig{DNSCacheTTL: time.Minute}, true},
+		{&BackendConfig{MaxConnsPerHost: 8}, true},
+	}
+
+	for idx, c := range testCases {
+		awsconf := newS3Config(c.conf)
+		if !c.transport {
+			if awsconf.HTTPClient != nil {
+				t.Errorf("%d: Did not expect a custom HTTP client to be installed", idx)
+			}
+			continue
+		}
+
+		if awsconf.HTTPClient == nil {
+			t.Errorf("%d: Expected a custom HTTP client to be installed", idx)
+			continue
+		}
+		transport, ok := awsconf.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			t.Errorf("%d: Expected a custom HTTP transport to be installed, got %T", idx, awsconf.HTTPClient.Transport)
+			continue
+		}
+		if transport.MaxConnsPerHost != c.conf.MaxConnsPerHost {
+			t.Errorf("%d: Expected max connections per host of %d, got %d", idx, c.conf.MaxConnsPerHost, transport.MaxConnsPerHost)
+		}
+	}
+}
+
 func TestS3Close(t *testing.T) {
 	testCases := []struct {
 		conf    *BackendConfig
@@ -291,6 +685,115 @@ func TestS3Delete(t *testing.T) {
 	}
 }
 
+func TestS3DeleteBatch(t *testing.T) {
+	testCases := []struct {
+		keys    []string
+		failed  []string
+		errTest errTestFunc
+	}{
+		{[]string{"key1", "key2"}, nil, nilErrTest},
+		// Some keys are deleted and some fail within the same batch
+		{[]string{"key1", s3BadKey, "key2"}, []string{s3BadKey}, nilErrTest},
+		{make([]string, s3MaxDeleteBatchSize+1), nil, errTestErrTest},
+	}
+
+	for idx, c := range testCases {
+		b := &AWSS3Backend{}
+		if err := b.Init(context.Background(), &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket"}, getOptions()...); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		if b.MaxDeleteBatchSize() != s3MaxDeleteBatchSize {
+			t.Errorf("%d: expected batches of up to %d keys, got %d", idx, s3MaxDeleteBatchSize, b.MaxDeleteBatchSize())
+		}
+
+		errs, err := b.DeleteBatch(context.Background(), c.keys)
+		if !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+			continue
+		}
+		if len(errs) != len(c.failed) {
+			t.Errorf("%d: expected %d keys to fail, got %v", idx, len(c.failed), errs)
+		}
+		for _, key := range c.failed {
+			if errs[key] == nil || !strings.Contains(errs[key].Error(), "AccessDenied") {
+				t.Errorf("%d: expected %s to fail with AccessDenied, got %v", idx, key, errs[key])
+			}
+		}
+	}
+}
+
+func TestS3Copy(t *testing.T) {
+	const partSize = 1024 * 1024 * 1024
+	testCases := []struct {
+		source      string
+		destination string
+		parts       int
+		completed   bool
+		aborted     bool
+		errTest     errTestFunc
+	}{
+		{"goodkey", "newkey", 0, false, false, nilErrTest},
+		{s3BadKey, "newkey", 0, false, false, errTestErrTest},
+		{"goodkey", s3BadKey, 0, false, false, errTestErrTest},
+		// Objects too large for a single request are copied in parts
+		{s3LargeKey, "newkey", s3MaxCopyObjectSize/partSize + 1, true, false, nilErrTest},
+		{s3LargeKey, s3BadKey, 1, false, true, errTestErrTest},
+	}
+
+	for idx, c := range testCases {
+		client := &mockS3Client{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket", UploadChunkSize: partSize}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+
+		if err := b.Copy(context.Background(), c.source, c.destination); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if len(client.copyRanges) != c.parts {
+			t.Errorf("%d: expected %d parts to be copied, got %v", idx, c.parts, client.copyRanges)
+		}
+		if c.completed != client.completed || c.aborted != client.aborted {
+			t.Errorf("%d: expected the multipart copy to be completed: %v and aborted: %v, got %v and %v", idx, c.completed, c.aborted, client.completed, client.aborted)
+		}
+		if c.completed {
+			// The last part holds whatever is left of the object
+			last := fmt.Sprintf("bytes=%d-%d", int64(c.parts-1)*partSize, int64(s3MaxCopyObjectSize))
+			if client.copyRanges[0] != fmt.Sprintf("bytes=0-%d", partSize-1) || client.copyRanges[c.parts-1] != last {
+				t.Errorf("%d: expected the parts to cover the whole object, got %v", idx, client.copyRanges)
+			}
+		}
+	}
+
+	// Copies are encrypted like uploads and keep the storage class of the object copied
+	classCases := []struct {
+		source string
+		class  string
+	}{
+		{"glacierkey", s3.ObjectStorageClassGlacier},
+		{"standardkey", ""},
+		{s3LargeKey, s3.ObjectStorageClassStandard},
+	}
+	for idx, c := range classCases {
+		client := &mockS3Client{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket", UploadChunkSize: partSize, S3SSE: "aws:kms", S3KMSKeyID: "alias/backups"}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		if err := b.Copy(context.Background(), c.source, "newkey"); err != nil {
+			t.Errorf("%d: unexpected error copying %s - %v", idx, c.source, err)
+		}
+		if client.copySSE != "aws:kms" || client.copyKMS != "alias/backups" {
+			t.Errorf("%d: expected the copy to be encrypted with aws:kms and alias/backups, got %q and %q", idx, client.copySSE, client.copyKMS)
+		}
+		if client.copyClass != c.class {
+			t.Errorf("%d: expected the copy to be stored in %q, got %q", idx, c.class, client.copyClass)
+		}
+	}
+}
+
 func TestS3Download(t *testing.T) {
 	testCases := []struct {
 		conf    *BackendConfig
@@ -324,6 +827,37 @@ func TestS3Download(t *testing.T) {
 	}
 }
 
+func TestS3DownloadRange(t *testing.T) {
+	testCases := []struct {
+		errTest errTestFunc
+		key     string
+		offset  int64
+		length  int64
+		header  string
+	}{
+		{nilErrTest, "goodkey", 0, 100, "bytes=0-99"},
+		{nilErrTest, "goodkey", 4096, 8192, "bytes=4096-12287"},
+		{errTestErrTest, s3BadKey, 0, 100, ""},
+	}
+
+	for idx, c := range testCases {
+		client := &mockS3Client{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI: AWSS3BackendPrefix + "://goodbucket",
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		if _, err := b.DownloadRange(context.Background(), c.key, c.offset, c.length); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if client.getRange != c.header {
+			t.Errorf("%d: expected Range %q, got %q", idx, c.header, client.getRange)
+		}
+	}
+}
+
 func TestS3Upload(t *testing.T) {
 	_, goodvol, badvol, err := prepareTestVols()
 	if err != nil {
@@ -384,6 +918,493 @@ func TestS3Upload(t *testing.T) {
 	}
 }
 
+func TestS3ConditionalUpload(t *testing.T) {
+	_, goodvol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	_, manifestvol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	manifestvol.IsManifest = true
+
+	testCases := []struct {
+		conditional bool
+		errTest     errTestFunc
+		key         string
+		vol         *helpers.VolumeInfo
+	}{
+		{true, nilErrTest, "goodkey", goodvol},
+		// The object already exists, the volume is treated as already uploaded
+		{true, nilErrTest, s3ExistingKey, goodvol},
+		{false, nonNilErrTest, s3ExistingKey, goodvol},
+		// Manifests are never uploaded conditionally
+		{true, nonNilErrTest, s3ExistingKey, manifestvol},
+		{true, errTestErrTest, s3BadKey, goodvol},
+	}
+
+	for idx, c := range testCases {
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:         AWSS3BackendPrefix + "://goodbucket",
+			ConditionalUpload: c.conditional,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(&mockS3Client{}), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		c.vol.ObjectName = c.key
+		if err := c.vol.OpenVolume(); err != nil {
+			t.Fatalf("%d: could not open volume due to error %v", idx, err)
+		}
+		if err := b.Upload(context.Background(), c.vol); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		c.vol.Close()
+	}
+}
+
+func TestS3UploadVerification(t *testing.T) {
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+
+	testCases := []struct {
+		verify    bool
+		chunkSize int
+		key       string
+		uploads   int
+		errTest   errTestFunc
+	}{
+		{true, 0, "verifygood", 1, nilErrTest},
+		{true, 16 * 1024 * 1024, "verifygood", 1, nilErrTest},
+		// A mismatch should be caught and the upload retried
+		{true, 0, s3TruncatedKey, 2, nilErrTest},
+		{true, 16 * 1024 * 1024, s3TruncatedKey, 2, nilErrTest},
+		{true, 0, s3CorruptKey, 3, func(e error) bool { return e == errUploadMismatch }},
+		{false, 0, s3CorruptKey, 1, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		partSize := int64(c.chunkSize)
+		if partSize == 0 {
+			partSize = s3manager.DefaultUploadPartSize
+		}
+		objects := &s3ObjectStore{partSize: partSize}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:       AWSS3BackendPrefix + "://goodbucket",
+			UploadChunkSize: c.chunkSize,
+			VerifyUploads:   c.verify,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(&mockS3Client{objects: objects}), WithS3Uploader(&mockS3Uploader{objects: objects})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		vol.ObjectName = c.key
+
+		// Retry the upload from the start of the volume as the upload chainer would
+		err := backoff.Retry(func() error {
+			if oerr := vol.OpenVolume(); oerr != nil {
+				return backoff.Permanent(oerr)
+			}
+			defer vol.Close()
+			return b.Upload(context.Background(), vol)
+		}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 2))
+		if !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if uploads := objects.uploads[c.key]; uploads != c.uploads {
+			t.Errorf("%d: Expected %d uploads, got %d instead", idx, c.uploads, uploads)
+		}
+	}
+}
+
+func TestS3ExpiryTagging(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		expiresAt time.Time
+		tagging   string
+	}{
+		{now.Add(30 * 24 * time.Hour), "zfsbackup-expire-days=30"},
+		// Partial days are rounded up so objects are never deleted early
+		{now.Add(30*24*time.Hour + time.Minute), "zfsbackup-expire-days=31"},
+		{now.Add(time.Hour), "zfsbackup-expire-days=1"},
+		{now.Add(-time.Hour), "zfsbackup-expire-days=1"},
+	}
+
+	for idx, c := range testCases {
+		if tagging := S3ExpiryTagging(c.expiresAt, now); tagging != c.tagging {
+			t.Errorf("%d: Expected tagging %q, got %q instead", idx, c.tagging, tagging)
+		}
+	}
+}
+
+func TestS3UploadExpiry(t *testing.T) {
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+	vol.ObjectName = "expirykey"
+
+	expiresAt := time.Now().Add(7*24*time.Hour + time.Hour).Truncate(time.Second)
+	testCases := []struct {
+		expiresAt time.Time
+		tagging   string
+		expires   *time.Time
+		tags      *string
+	}{
+		{time.Time{}, "", nil, nil},
+		{expiresAt, "zfsbackup-expire-days=8", &expiresAt, aws.String("zfsbackup-expire-days=8")},
+	}
+
+	for idx, c := range testCases {
+		uploader := &mockS3Uploader{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:     AWSS3BackendPrefix + "://goodbucket",
+			ExpiresAt:     c.expiresAt,
+			ExpiryTagging: c.tagging,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(&mockS3Client{}), WithS3Uploader(uploader)); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+
+		if err := vol.OpenVolume(); err != nil {
+			t.Fatalf("%d: error opening volume - %v", idx, err)
+		}
+		if err := b.Upload(context.Background(), vol); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Upload, got %v instead", idx, err)
+		}
+		vol.Close()
+
+		if uploader.input == nil {
+			t.Fatalf("%d: Expected an upload, got none", idx)
+		}
+		if got := uploader.input.Expires; (got == nil) != (c.expires == nil) || (got != nil && !got.Equal(*c.expires)) {
+			t.Errorf("%d: Expected Expires %v, got %v instead", idx, c.expires, got)
+		}
+		if got := uploader.input.Tagging; aws.StringValue(got) != aws.StringValue(c.tags) {
+			t.Errorf("%d: Expected Tagging %q, got %q instead", idx, aws.StringValue(c.tags), aws.StringValue(got))
+		}
+	}
+}
+
+func TestS3UploadStorageClass(t *testing.T) {
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+	vol.ObjectName = "classkey"
+
+	testCases := []struct {
+		class    string
+		manifest bool
+		expected *string
+	}{
+		{"", false, nil},
+		{"GLACIER", false, aws.String("GLACIER")},
+		{"DEEP_ARCHIVE", true, nil},
+	}
+
+	for idx, c := range testCases {
+		uploader := &mockS3Uploader{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:    AWSS3BackendPrefix + "://goodbucket",
+			StorageClass: c.class,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(&mockS3Client{}), WithS3Uploader(uploader)); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+
+		vol.IsManifest = c.manifest
+		if err := vol.OpenVolume(); err != nil {
+			t.Fatalf("%d: error opening volume - %v", idx, err)
+		}
+		if err := b.Upload(context.Background(), vol); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Upload, got %v instead", idx, err)
+		}
+		vol.Close()
+
+		if uploader.input == nil {
+			t.Fatalf("%d: Expected an upload, got none", idx)
+		}
+		if got := uploader.input.StorageClass; (got == nil) != (c.expected == nil) || aws.StringValue(got) != aws.StringValue(c.expected) {
+			t.Errorf("%d: Expected StorageClass %q, got %q instead", idx, aws.StringValue(c.expected), aws.StringValue(got))
+		}
+	}
+}
+
+func TestS3UploadServerSideEncryption(t *testing.T) {
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+	vol.ObjectName = "ssekey"
+
+	testCases := []struct {
+		sse      string
+		kmsKeyID string
+		expected *string
+		keyID    *string
+	}{
+		{"", "", nil, nil},
+		{"AES256", "", aws.String("AES256"), nil},
+		{"aws:kms", "", aws.String("aws:kms"), nil},
+		{"aws:kms", "arn:aws:kms:us-east-1:111122223333:key/backups", aws.String("aws:kms"), aws.String("arn:aws:kms:us-east-1:111122223333:key/backups")},
+	}
+
+	for idx, c := range testCases {
+		uploader := &mockS3Uploader{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:  AWSS3BackendPrefix + "://goodbucket",
+			S3SSE:      c.sse,
+			S3KMSKeyID: c.kmsKeyID,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(&mockS3Client{}), WithS3Uploader(uploader)); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+
+		if err := vol.OpenVolume(); err != nil {
+			t.Fatalf("%d: error opening volume - %v", idx, err)
+		}
+		if err := b.Upload(context.Background(), vol); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Upload, got %v instead", idx, err)
+		}
+		vol.Close()
+
+		if uploader.input == nil {
+			t.Fatalf("%d: Expected an upload, got none", idx)
+		}
+		if got := uploader.input.ServerSideEncryption; (got == nil) != (c.expected == nil) || aws.StringValue(got) != aws.StringValue(c.expected) {
+			t.Errorf("%d: Expected ServerSideEncryption %q, got %q instead", idx, aws.StringValue(c.expected), aws.StringValue(got))
+		}
+		if got := uploader.input.SSEKMSKeyId; (got == nil) != (c.keyID == nil) || aws.StringValue(got) != aws.StringValue(c.keyID) {
+			t.Errorf("%d: Expected SSEKMSKeyId %q, got %q instead", idx, aws.StringValue(c.keyID), aws.StringValue(got))
+		}
+	}
+}
+
+func TestS3IfNoneMatchHeader(t *testing.T) {
+	testCases := []struct {
+		operation string
+		header    string
+	}{
+		{"PutObject", "*"},
+		{"CompleteMultipartUpload", "*"},
+		{"CreateMultipartUpload", ""},
+		{"UploadPart", ""},
+	}
+
+	for idx, c := range testCases {
+		r := &request.Request{
+			Operation:   &request.Operation{Name: c.operation},
+			HTTPRequest: &http.Request{Header: http.Header{}},
+		}
+		withIfNoneMatchHeader(r)
+		r.Handlers.Build.Run(r)
+		if header := r.HTTPRequest.Header.Get("If-None-Match"); header != c.header {
+			t.Errorf("%d: expected If-None-Match header %q for %s, got %q", idx, c.header, c.operation, header)
+		}
+	}
+}
+
+func TestS3TraceContextHeader(t *testing.T) {
+	origPropagator := otel.GetTextMapPropagator()
+	defer otel.SetTextMapPropagator(origPropagator)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceID := trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	testCases := []struct {
+		ctx    context.Context
+		header string
+	}{
+		{trace.ContextWithSpanContext(context.Background(), spanCtx), "00-" + traceID.String() + "-0102030405060708-01"},
+		{context.Background(), ""},
+	}
+
+	for idx, c := range testCases {
+		r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+		r.SetContext(c.ctx)
+		injectTraceContext(r)
+		if header := r.HTTPRequest.Header.Get("traceparent"); header != c.header {
+			t.Errorf("%d: expected traceparent header %q, got %q", idx, c.header, header)
+		}
+	}
+}
+
+func TestS3ClockSkew(t *testing.T) {
+	testCases := []struct {
+		check   string
+		offset  time.Duration
+		status  int
+		errTest errTestFunc
+	}{
+		{ClockSkewCheckFail, 0, http.StatusOK, nilErrTest},
+		// The server is 20 minutes behind this host
+		{ClockSkewCheckFail, -20 * time.Minute, http.StatusOK, func(e error) bool { return e == ErrClockSkewed }},
+		{ClockSkewCheckWarn, -20 * time.Minute, http.StatusOK, nilErrTest},
+		{ClockSkewCheckOff, -20 * time.Minute, http.StatusOK, nilErrTest},
+		// A request refused for being too skewed reports why instead of the cryptic error
+		{ClockSkewCheckFail, time.Hour, http.StatusForbidden, func(e error) bool { return e == ErrClockSkewed }},
+		{ClockSkewCheckWarn, time.Hour, http.StatusForbidden, nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(c.offset).UTC().Format(http.TimeFormat))
+			if c.status != http.StatusOK {
+				w.WriteHeader(c.status)
+				fmt.Fprint(w, `<Error><Code>RequestTimeTooSkewed</Code><Message>The difference between the request time and the current time is too large.</Message></Error>`)
+				return
+			}
+			fmt.Fprint(w, `<ListBucketResult><Name>goodbucket</Name><KeyCount>0</KeyCount><IsTruncated>false</IsTruncated></ListBucketResult>`)
+		}))
+
+		sess, err := session.NewSession(aws.NewConfig().
+			WithEndpoint(server.URL).
+			WithRegion("us-east-1").
+			WithS3ForcePathStyle(true).
+			WithMaxRetries(0).
+			WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+		if err != nil {
+			t.Fatalf("%d: could not create session - %v", idx, err)
+		}
+
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:      AWSS3BackendPrefix + "://goodbucket",
+			ClockSkewCheck: c.check,
+			MaxClockSkew:   5 * time.Minute,
+		}
+		if err = b.Init(context.Background(), conf, WithS3Client(s3.New(sess)), WithS3Uploader(&mockS3Uploader{})); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		server.Close()
+	}
+}
+
+// newS3PartServer returns a server implementing just enough of the S3 API for a multipart upload.
+// The second part of an upload fails with an internal error for the first failures attempts.
+func newS3PartServer(failures int) (*httptest.Server, map[string]int, *sync.Mutex) {
+	var mutex sync.Mutex
+	attempts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		query := r.URL.Query()
+		_, initiate := query["uploads"]
+		switch {
+		case r.Method == http.MethodGet:
+			fmt.Fprint(w, `<ListBucketResult><Name>goodbucket</Name><KeyCount>0</KeyCount><IsTruncated>false</IsTruncated></ListBucketResult>`)
+		case r.Method == http.MethodPost && initiate:
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>goodbucket</Bucket><Key>goodkey</Key><UploadId>testupload</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && query.Get("partNumber") != "":
+			part := query.Get("partNumber")
+			mutex.Lock()
+			attempts[part]++
+			attempt := attempts[part]
+			mutex.Unlock()
+			if part == "2" && attempt <= failures {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>We encountered an internal error. Please try again.</Message></Error>`)
+				return
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"etag%s"`, part))
+		case r.Method == http.MethodPost:
+			mutex.Lock()
+			attempts["complete"]++
+			mutex.Unlock()
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>goodbucket</Bucket><Key>goodkey</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+
+	return server, attempts, &mutex
+}
+
+func TestS3PartLevelRetry(t *testing.T) {
+	testCases := []struct {
+		failures int
+		retries  int
+		errTest  errTestFunc
+		attempts int
+		complete int
+	}{
+		// A single failed part is retried on its own and the upload completes
+		{1, 2, nilErrTest, 2, 1},
+		// The part keeps failing past the retries allowed for it
+		{3, 2, nonNilErrTest, 3, 0},
+	}
+
+	for idx, c := range testCases {
+		_, goodvol, _, err := prepareTestVols()
+		if err != nil {
+			t.Fatalf("error preparing volume for testing - %v", err)
+		}
+
+		server, attempts, mutex := newS3PartServer(c.failures)
+		sess, err := session.NewSession(aws.NewConfig().
+			WithEndpoint(server.URL).
+			WithRegion("us-east-1").
+			WithS3ForcePathStyle(true).
+			WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+		if err != nil {
+			t.Fatalf("%d: could not create session - %v", idx, err)
+		}
+
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:               AWSS3BackendPrefix + "://goodbucket",
+			MaxParallelUploadBuffer: make(chan bool, 1),
+			MaxParallelUploads:      1,
+			MaxBackoffTime:          100 * time.Millisecond,
+			UploadChunkSize:         int(s3manager.MinUploadPartSize),
+			UploadPartRetries:       c.retries,
+		}
+		if err = b.Init(context.Background(), conf, WithS3Client(s3.New(sess))); err != nil {
+			t.Fatalf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+
+		goodvol.ObjectName = "goodkey"
+		if err = goodvol.OpenVolume(); err != nil {
+			t.Fatalf("%d: could not open volume due to error %v", idx, err)
+		}
+		if err = b.Upload(context.Background(), goodvol); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		goodvol.Close()
+		goodvol.DeleteVolume()
+		server.Close()
+
+		mutex.Lock()
+		if attempts["1"] != 1 {
+			t.Errorf("%d: expected the first part to be uploaded once, was uploaded %d times", idx, attempts["1"])
+		}
+		if attempts["2"] != c.attempts {
+			t.Errorf("%d: expected the failing part to be attempted %d times, was attempted %d times", idx, c.attempts, attempts["2"])
+		}
+		if attempts["complete"] != c.complete {
+			t.Errorf("%d: expected the upload to be completed %d times, was completed %d times", idx, c.complete, attempts["complete"])
+		}
+		mutex.Unlock()
+	}
+}
+
 func TestS3List(t *testing.T) {
 	testCases := []struct {
 		conf    *BackendConfig
@@ -425,6 +1446,47 @@ func TestS3List(t *testing.T) {
 	}
 }
 
+func TestS3ListIncomplete(t *testing.T) {
+	if ok, _ := strconv.ParseBool(os.Getenv("S3_TEST_WITH_MINIO")); ok {
+		t.Skip("incomplete listings can only be simulated with the mock client")
+	}
+
+	testCases := []struct {
+		prefix string
+		calls  int
+	}{
+		{"", 0},
+		{s3ShortListingKey, 2},
+		{s3ShortPageKey, 2},
+	}
+
+	for idx, c := range testCases {
+		client := &mockS3Client{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:      AWSS3BackendPrefix + "://goodbucket",
+			MaxBackoffTime: time.Millisecond,
+			MaxRetryTime:   10 * time.Second,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Fatalf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+
+		l, err := b.List(context.Background(), c.prefix)
+		if err != nil {
+			t.Errorf("%d: Did not get expected nil error, got %v instead", idx, err)
+			continue
+		}
+		// A complete listing spans both pages
+		if len(l) != 4 {
+			t.Errorf("%d: Did not get expected amount of items in the list, expected 4 but got %d", idx, len(l))
+		}
+		if client.listCalls[c.prefix] != c.calls {
+			t.Errorf("%d: Expected the listing to be attempted %d times, got %d", idx, c.calls, client.listCalls[c.prefix])
+		}
+	}
+}
+
 func TestS3PreDownload(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -462,6 +1524,198 @@ func TestS3PreDownload(t *testing.T) {
 	}
 }
 
+func TestS3PreDownloadLimits(t *testing.T) {
+	oldPollInterval := s3RestorePollInterval
+	s3RestorePollInterval = time.Millisecond
+	defer func() { s3RestorePollInterval = oldPollInterval }()
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("glacier%d", i))
+	}
+
+	testCases := []struct {
+		parallel      int
+		rate          float64
+		throttleCount int
+		maxRetryTime  time.Duration
+		keys          []string
+		errTest       errTestFunc
+		maxInFlight   int
+		calls         int
+	}{
+		// Restore requests are issued in batches of up to parallel keys
+		{3, 0, 0, time.Second, keys, nilErrTest, 3, 10},
+		{1, 0, 0, time.Second, keys, nilErrTest, 1, 10},
+		// Rate limited requests are still all issued
+		{10, 200, 0, time.Second, keys, nilErrTest, 10, 10},
+		// Throttled requests are retried until they succeed
+		{2, 0, 2, time.Second, append([]string{s3ThrottledKey}, keys[:3]...), nilErrTest, 2, 6},
+		// Or until the retry time runs out
+		{2, 0, 1000, 50 * time.Millisecond, []string{s3ThrottledKey}, nonNilErrTest, 1, -1},
+		// Errors stop the remaining batches
+		{2, 0, 0, time.Second, []string{"glacier1", "glacier2", s3BadKey, "glacier3", "glacier4"}, errTestErrTest, 2, 3},
+	}
+
+	for idx, c := range testCases {
+		client := &mockS3Client{throttleCount: c.throttleCount}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:           AWSS3BackendPrefix + "://goodbucket",
+			MaxParallelRestores: c.parallel,
+			RestoreRequestRate:  c.rate,
+			MaxBackoffTime:      5 * time.Millisecond,
+			MaxRetryTime:        c.maxRetryTime,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		if err := b.PreDownload(context.Background(), c.keys); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+
+		client.mutex.Lock()
+		if client.maxRestoreInFlight > c.maxInFlight {
+			t.Errorf("%d: expected at most %d restore requests in flight, got %d", idx, c.maxInFlight, client.maxRestoreInFlight)
+		}
+		calls := 0
+		for _, count := range client.restoreCalls {
+			calls += count
+		}
+		if c.calls >= 0 && calls != c.calls {
+			t.Errorf("%d: expected %d restore requests, got %d", idx, c.calls, calls)
+		}
+		if c.throttleCount > 0 && c.errTest(nil) && client.restoreCalls[s3ThrottledKey] != c.throttleCount+1 {
+			t.Errorf("%d: expected the throttled key to be requested %d times, got %d", idx, c.throttleCount+1, client.restoreCalls[s3ThrottledKey])
+		}
+		client.mutex.Unlock()
+	}
+}
+
+func TestS3ClassLimits(t *testing.T) {
+	oldPollInterval := s3RestorePollInterval
+	s3RestorePollInterval = time.Millisecond
+	defer func() { s3RestorePollInterval = oldPollInterval }()
+	defer func() { helpers.BackupClassLimiter = nil }()
+
+	keys := func(prefix string) []string {
+		var keys []string
+		for i := 0; i < 10; i++ {
+			keys = append(keys, fmt.Sprintf("%s%d", prefix, i))
+		}
+		return keys
+	}
+
+	testCases := []struct {
+		limits      []string
+		keys        []string
+		maxInFlight int
+		calls       int
+	}{
+		{nil, keys("glacier"), 10, 10},
+		{[]string{"GLACIER:restore=2"}, keys("glacier"), 2, 10},
+		// Objects in Glacier Deep Archive are restored too, within their own limits
+		{[]string{"GLACIER:restore=2", "DEEP_ARCHIVE:restore=1"}, keys("deeparchive"), 1, 10},
+		{[]string{"GLACIER:restore=1", "*:restore=3"}, keys("deeparchive"), 3, 10},
+		// Objects that do not need to be restored are not limited by the restore limits
+		{[]string{"STANDARD:restore=1"}, append(keys("standard"), keys("glacier")...), 10, 10},
+	}
+
+	for idx, c := range testCases {
+		limiter, err := helpers.NewClassLimiter(c.limits)
+		if err != nil {
+			t.Fatalf("%d: could not create limiter - %v", idx, err)
+		}
+		helpers.BackupClassLimiter = limiter
+
+		client := &mockS3Client{}
+		b := &AWSS3Backend{}
+		conf := &BackendConfig{
+			TargetURI:           AWSS3BackendPrefix + "://goodbucket",
+			MaxParallelRestores: 10,
+			MaxRetryTime:        time.Second,
+		}
+		if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+			t.Errorf("%d: Did not get expected nil error on Init, got %v instead", idx, err)
+		}
+		if err := b.PreDownload(context.Background(), c.keys); err != nil {
+			t.Errorf("%d: Did not get expected nil error, got %v instead", idx, err)
+		}
+
+		client.mutex.Lock()
+		if client.maxRestoreInFlight > c.maxInFlight {
+			t.Errorf("%d: expected at most %d restore requests in flight, got %d", idx, c.maxInFlight, client.maxRestoreInFlight)
+		}
+		calls := 0
+		for _, count := range client.restoreCalls {
+			calls += count
+		}
+		if calls != c.calls {
+			t.Errorf("%d: expected %d restore requests, got %d", idx, c.calls, calls)
+		}
+		client.mutex.Unlock()
+	}
+
+	// Downloads are held within the limits of the storage class found before downloading until they are closed
+	limiter, err := helpers.NewClassLimiter([]string{"STANDARD:download=1"})
+	if err != nil {
+		t.Fatalf("could not create limiter - %v", err)
+	}
+	helpers.BackupClassLimiter = limiter
+	b := &AWSS3Backend{}
+	if err = b.Init(context.Background(), &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket"}, getOptions()...); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+	if err = b.PreDownload(context.Background(), []string{"standard1", "glacier1"}); err != nil {
+		t.Fatalf("Did not get expected nil error, got %v instead", err)
+	}
+
+	r, err := b.Download(context.Background(), "standard1")
+	if err != nil {
+		t.Fatalf("Did not get expected nil error, got %v instead", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = b.DownloadRange(ctx, "standard1", 0, 10); err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v while the download is open, got %v instead", context.DeadlineExceeded, err)
+	}
+	if _, err = b.Download(ctx, "glacier1"); err != nil {
+		t.Errorf("Expected downloads of other storage classes to not be limited, got %v instead", err)
+	}
+	r.Close()
+	if r, err = b.Download(context.Background(), "standard1"); err != nil {
+		t.Errorf("Expected the download to proceed once the previous one was closed, got %v instead", err)
+	} else {
+		r.Close()
+	}
+}
+
+func TestS3PreDownloadCancel(t *testing.T) {
+	oldPollInterval := s3RestorePollInterval
+	s3RestorePollInterval = time.Hour
+	defer func() { s3RestorePollInterval = oldPollInterval }()
+
+	b := &AWSS3Backend{}
+	conf := &BackendConfig{
+		TargetURI:           AWSS3BackendPrefix + "://goodbucket",
+		MaxParallelRestores: 2,
+	}
+	if err := b.Init(context.Background(), conf, WithS3Client(&mockS3Client{}), WithS3Uploader(&mockS3Uploader{})); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	// The long wait for a restore should stop as soon as the context is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.PreDownload(ctx, []string{"alreadyrestoring"}); err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v, got %v instead", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected PreDownload to return once canceled, took %v", elapsed)
+	}
+}
+
 func TestS3Backend(t *testing.T) {
 	if os.Getenv("AWS_S3_CUSTOM_ENDPOINT") == "" {
 		t.Skip("No custom S3 Endpoint provided to test against")
@@ -33,6 +33,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/pkg/errors"
@@ -51,7 +52,8 @@ const (
 )
 
 var (
-	errContainerMismatch = errors.New("container name in SAS URI is different than destination container provided")
+	errContainerMismatch      = errors.New("container name in SAS URI is different than destination container provided")
+	errImmutabilityNotEnabled = errors.New("container does not have version-level immutability support enabled, it is required to apply retention policies or legal holds to blobs")
 )
 
 // AzureBackend integrates with Microsoft's Azure Storage Services.
@@ -65,6 +67,62 @@ type AzureBackend struct {
 	prefix        string
 	containerName string
 	containerSvc  azblob.ContainerURL
+	immutability  azureImmutabilityClient
+}
+
+// azureImmutabilityClient applies and inspects the immutability policies of the blobs in a container.
+type azureImmutabilityClient interface {
+	ImmutabilityEnabled(ctx context.Context) (bool, error)
+	SetImmutabilityPolicy(ctx context.Context, name string, expiry time.Time, locked bool) error
+	SetLegalHold(ctx context.Context, name string, hold bool) error
+	RetainedUntil(ctx context.Context, name string) (time.Time, bool, error)
+}
+
+type azblobImmutabilityClient struct{ containerSvc azblob.ContainerURL }
+
+func (c azblobImmutabilityClient) ImmutabilityEnabled(ctx context.Context) (bool, error) {
+	resp, err := c.containerSvc.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(resp.IsImmutableStorageWithVersioningEnabled(), "true"), nil
+}
+
+func (c azblobImmutabilityClient) SetImmutabilityPolicy(ctx context.Context, name string, expiry time.Time, locked bool) error {
+	mode := azblob.BlobImmutabilityPolicyModeUnlocked
+	if locked {
+		mode = azblob.BlobImmutabilityPolicyModeLocked
+	}
+	_, err := c.containerSvc.NewBlobURL(name).SetImmutabilityPolicy(ctx, expiry, mode, nil)
+	return err
+}
+
+func (c azblobImmutabilityClient) SetLegalHold(ctx context.Context, name string, hold bool) error {
+	_, err := c.containerSvc.NewBlobURL(name).SetLegalHold(ctx, hold)
+	return err
+}
+
+func (c azblobImmutabilityClient) RetainedUntil(ctx context.Context, name string) (time.Time, bool, error) {
+	props, err := c.containerSvc.NewBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return props.ImmutabilityPolicyExpiresOn(), props.LegalHold(), nil
+}
+
+type withAzureImmutabilityClient struct{ client azureImmutabilityClient }
+
+func (w withAzureImmutabilityClient) Apply(b Backend) {
+	switch v := b.(type) {
+	case *AzureBackend:
+		v.immutability = w.client
+	}
+}
+
+// WithAzureImmutabilityClient will override an Azure backend's client used to apply and inspect
+// immutability policies with the one provided. Primarily used to inject mock clients for testing.
+func WithAzureImmutabilityClient(c azureImmutabilityClient) Option {
+	return withAzureImmutabilityClient{c}
 }
 
 // Init will initialize the AzureBackend and verify the provided URI is valid/exists.
@@ -126,11 +184,78 @@ func (a *AzureBackend) Init(ctx context.Context, conf *BackendConfig, opts ...Op
 		a.containerSvc = svcURL.NewContainerURL(a.containerName)
 	}
 
-	_, err := a.containerSvc.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{MaxResults: 0})
-	return err
+	if a.immutability == nil {
+		a.immutability = azblobImmutabilityClient{a.containerSvc}
+	}
+
+	err := retryInit(ctx, conf, AzureBackendPrefix, func() error {
+		_, lerr := a.containerSvc.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{MaxResults: 0})
+		return lerr
+	}, isTransientError)
+	if err != nil {
+		return err
+	}
+
+	return a.validateImmutability(ctx)
+}
+
+// validateImmutability will verify the container can hold immutable blobs if we were asked to apply
+// retention policies or legal holds to the blobs we upload.
+func (a *AzureBackend) validateImmutability(ctx context.Context) error {
+	if a.conf.ImmutabilityPeriod <= 0 && !a.conf.LegalHold {
+		return nil
+	}
+
+	enabled, err := a.immutability.ImmutabilityEnabled(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to check the immutability support of the container")
+	}
+	if !enabled {
+		return errImmutabilityNotEnabled
+	}
+
+	return nil
+}
+
+// applyImmutability will set the configured time-based retention policy and legal hold on the named blob.
+func (a *AzureBackend) applyImmutability(ctx context.Context, name string) error {
+	if a.conf.ImmutabilityPeriod > 0 {
+		expiry := time.Now().Add(a.conf.ImmutabilityPeriod)
+		if err := a.immutability.SetImmutabilityPolicy(ctx, name, expiry, a.conf.ImmutabilityLocked); err != nil {
+			return errors.Wrapf(err, "failed to set retention policy on blob %s", name)
+		}
+	}
+
+	if a.conf.LegalHold {
+		if err := a.immutability.SetLegalHold(ctx, name, true); err != nil {
+			return errors.Wrapf(err, "failed to set legal hold on blob %s", name)
+		}
+	}
+
+	return nil
+}
+
+// checkRetention will return ErrObjectRetained if the named blob is still under a retention policy or legal hold.
+func (a *AzureBackend) checkRetention(ctx context.Context, name string) error {
+	until, hold, err := a.immutability.RetainedUntil(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if hold {
+		helpers.AppLogger.Debugf("azure backend: Blob %s is under a legal hold.", name)
+		return ErrObjectRetained
+	}
+	if until.After(time.Now()) {
+		helpers.AppLogger.Debugf("azure backend: Blob %s is retained until %v.", name, until)
+		return ErrObjectRetained
+	}
+
+	return nil
 }
 
-// Upload will upload the provided volume to this AzureBackend's configured container+prefix
+// Upload will upload the provided volume to this AzureBackend's configured container+prefix. Each block and the
+// requests completing the upload are retried if they do not complete within the RequestTimeout of the config.
 func (a *AzureBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
 	// We will achieve parallel upload by splitting a single upload into chunks
 	// so don't let multiple calls to this function run in parallel.
@@ -189,8 +314,10 @@ func (a *AzureBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) erro
 			case a.conf.MaxParallelUploadBuffer <- true:
 				errg.Go(func() error {
 					defer func() { <-a.conf.MaxParallelUploadBuffer }()
-					_, err := blobURL.StageBlock(ctx, blockID, bytes.NewReader(buf[:n]), azblob.LeaseAccessConditions{}, md5sum[:])
-					return err
+					return retryRequest(ctx, a.conf, AzureBackendPrefix, "upload block of "+name, func(ctx context.Context) error {
+						_, err := blobURL.StageBlock(ctx, blockID, bytes.NewReader(buf[:n]), azblob.LeaseAccessConditions{}, md5sum[:])
+						return err
+					})
 				})
 			}
 		}
@@ -212,31 +339,51 @@ func (a *AzureBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) erro
 	}
 
 	// Finally, finalize the storage blob by giving Azure the block list order
-	_, err = blobURL.CommitBlockList(ctx, blockIDs, azblob.BlobHTTPHeaders{ContentMD5: md5Raw}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	err = retryRequest(ctx, a.conf, AzureBackendPrefix, "commit "+name, func(ctx context.Context) error {
+		_, cerr := blobURL.CommitBlockList(ctx, blockIDs, azblob.BlobHTTPHeaders{ContentMD5: md5Raw}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+		return cerr
+	})
 	if err != nil {
 		helpers.AppLogger.Debugf("azure backend: Error while finalizing volume %s - %v", vol.ObjectName, err)
 	}
 
 	// Set to Cool for manifests
-	if strings.HasPrefix(name, "manifests") {
-		_, err = blobURL.SetTier(ctx, azblob.AccessTierCool, azblob.LeaseAccessConditions{})
-	} else {
-		//_, err = blobURL.SetTier(ctx, azblob.AccessTierArchive, azblob.LeaseAccessConditions{})
-		_, err = blobURL.SetTier(ctx, azblob.AccessTierCool, azblob.LeaseAccessConditions{})
-	}
+	err = retryRequest(ctx, a.conf, AzureBackendPrefix, "set the tier of "+name, func(ctx context.Context) error {
+		var terr error
+		if strings.HasPrefix(name, "manifests") {
+			_, terr = blobURL.SetTier(ctx, azblob.AccessTierCool, azblob.LeaseAccessConditions{})
+		} else {
+			//_, terr = blobURL.SetTier(ctx, azblob.AccessTierArchive, azblob.LeaseAccessConditions{})
+			_, terr = blobURL.SetTier(ctx, azblob.AccessTierCool, azblob.LeaseAccessConditions{})
+		}
+		return terr
+	})
 
 	if err != nil {
 		helpers.AppLogger.Debugf("azure backend: Error while setting block to archive tier %s", blobURL)
+		return err
+	}
+
+	err = a.applyImmutability(ctx, name)
+	if err != nil {
+		helpers.AppLogger.Debugf("azure backend: Error while applying immutability policies to volume %s - %v", vol.ObjectName, err)
 	}
 
 	return err
 }
 
-// Delete will delete the given object from the configured container
+// Delete will delete the given object from the configured container. Blobs still under a retention
+// policy or legal hold are left as-is and ErrObjectRetained is returned.
 func (a *AzureBackend) Delete(ctx context.Context, name string) error {
-	blobURL := a.containerSvc.NewBlobURL(name)
-	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
-	return err
+	return retryRequest(ctx, a.conf, AzureBackendPrefix, "delete "+name, func(ctx context.Context) error {
+		if err := a.checkRetention(ctx, name); err != nil {
+			return err
+		}
+
+		blobURL := a.containerSvc.NewBlobURL(name)
+		_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+		return err
+	})
 }
 
 // PreDownload will do nothing for this backend.
@@ -246,12 +393,14 @@ func (a *AzureBackend) PreDownload(ctx context.Context, keys []string) error {
 
 // Download will download the requseted object which can be read from the returned io.ReadCloser
 func (a *AzureBackend) Download(ctx context.Context, name string) (io.ReadCloser, error) {
-	blobURL := a.containerSvc.NewBlobURL(name)
-	resp, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false)
-	if err != nil {
-		return nil, err
-	}
-	return resp.Body(azblob.RetryReaderOptions{}), nil
+	return retryDownload(ctx, a.conf, AzureBackendPrefix, "download "+name, func(ctx context.Context) (io.ReadCloser, error) {
+		blobURL := a.containerSvc.NewBlobURL(name)
+		resp, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body(azblob.RetryReaderOptions{}), nil
+	})
 }
 
 // Close will release any resources used by the Azure backend.
@@ -262,19 +411,48 @@ func (a *AzureBackend) Close() error {
 // List will iterate through all objects in the configured Azure Storage Container and return
 // a list of blob names, filtering by the provided prefix.
 func (a *AzureBackend) List(ctx context.Context, prefix string) ([]string, error) {
-	l := make([]string, 0, 5000)
+	objects, err := a.ListDetailed(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
+	}
+
+	return l, nil
+}
+
+// ListDetailed will iterate through all objects in the configured Azure Storage Container and return
+// the details of each blob, filtering by the provided prefix.
+func (a *AzureBackend) ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	l := make([]ObjectInfo, 0, 5000)
 
 	for marker := (azblob.Marker{}); marker.NotDone(); {
-		resp, err := a.containerSvc.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
-			Prefix:     prefix,
-			MaxResults: 5000,
+		var resp *azblob.ListBlobsFlatSegmentResponse
+		err := retryRequest(ctx, a.conf, AzureBackendPrefix, "list "+prefix, func(ctx context.Context) error {
+			var lerr error
+			resp, lerr = a.containerSvc.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+				Prefix:     prefix,
+				MaxResults: 5000,
+			})
+			return lerr
 		})
 		if err != nil {
 			return nil, errors.Wrap(err, "error while listing blobs from container")
 		}
 
 		for _, obj := range resp.Segment.BlobItems {
-			l = append(l, obj.Name)
+			info := ObjectInfo{
+				Name:         obj.Name,
+				LastModified: obj.Properties.LastModified,
+				StorageClass: string(obj.Properties.AccessTier),
+			}
+			if obj.Properties.ContentLength != nil {
+				info.Size = *obj.Properties.ContentLength
+			}
+			l = append(l, info)
 		}
 
 		marker = resp.NextMarker
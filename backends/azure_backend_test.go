@@ -28,9 +28,11 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/pkg/errors"
 )
 
 func TestAzureGetBackendForURI(t *testing.T) {
@@ -260,3 +262,145 @@ func TestAzureBackend(t *testing.T) {
 		}
 	})
 }
+
+type mockImmutabilityClient struct {
+	enabled     bool
+	err         error
+	policies    map[string]time.Time
+	locked      map[string]bool
+	holds       map[string]bool
+	retainUntil time.Time
+	retainHold  bool
+}
+
+func newMockImmutabilityClient() *mockImmutabilityClient {
+	return &mockImmutabilityClient{
+		policies: make(map[string]time.Time),
+		locked:   make(map[string]bool),
+		holds:    make(map[string]bool),
+	}
+}
+
+func (m *mockImmutabilityClient) ImmutabilityEnabled(ctx context.Context) (bool, error) {
+	return m.enabled, m.err
+}
+
+func (m *mockImmutabilityClient) SetImmutabilityPolicy(ctx context.Context, name string, expiry time.Time, locked bool) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.policies[name] = expiry
+	m.locked[name] = locked
+	return nil
+}
+
+func (m *mockImmutabilityClient) SetLegalHold(ctx context.Context, name string, hold bool) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.holds[name] = hold
+	return nil
+}
+
+func (m *mockImmutabilityClient) RetainedUntil(ctx context.Context, name string) (time.Time, bool, error) {
+	return m.retainUntil, m.retainHold, m.err
+}
+
+func TestAzureApplyImmutability(t *testing.T) {
+	testCases := []struct {
+		conf   BackendConfig
+		err    error
+		policy bool
+		locked bool
+		hold   bool
+	}{
+		{BackendConfig{}, nil, false, false, false},
+		{BackendConfig{ImmutabilityPeriod: time.Hour}, nil, true, false, false},
+		{BackendConfig{ImmutabilityPeriod: time.Hour, ImmutabilityLocked: true}, nil, true, true, false},
+		{BackendConfig{LegalHold: true}, nil, false, false, true},
+		{BackendConfig{ImmutabilityPeriod: time.Hour, LegalHold: true}, nil, true, false, true},
+		{BackendConfig{ImmutabilityPeriod: time.Hour}, errors.New("failed"), false, false, false},
+	}
+
+	name := "prefix/volume"
+	for idx, c := range testCases {
+		client := newMockImmutabilityClient()
+		client.err = c.err
+		b := &AzureBackend{conf: &c.conf}
+		WithAzureImmutabilityClient(client).Apply(b)
+
+		before := time.Now()
+		err := b.applyImmutability(context.Background(), name)
+		if (err != nil) != (c.err != nil) {
+			t.Errorf("%d: expected error %v, got %v", idx, c.err, err)
+			continue
+		}
+
+		expiry, ok := client.policies[name]
+		if ok != c.policy {
+			t.Errorf("%d: expected a retention policy to be set: %v, got %v", idx, c.policy, ok)
+		} else if ok && expiry.Before(before.Add(c.conf.ImmutabilityPeriod)) {
+			t.Errorf("%d: expected the retention policy to expire no earlier than %v, got %v", idx, before.Add(c.conf.ImmutabilityPeriod), expiry)
+		}
+		if client.locked[name] != c.locked {
+			t.Errorf("%d: expected a locked retention policy: %v, got %v", idx, c.locked, client.locked[name])
+		}
+		if client.holds[name] != c.hold {
+			t.Errorf("%d: expected a legal hold to be set: %v, got %v", idx, c.hold, client.holds[name])
+		}
+	}
+}
+
+func TestAzureValidateImmutability(t *testing.T) {
+	testCases := []struct {
+		conf    BackendConfig
+		enabled bool
+		err     error
+		valid   func(error) bool
+	}{
+		{BackendConfig{}, false, nil, func(e error) bool { return e == nil }},
+		{BackendConfig{ImmutabilityPeriod: time.Hour}, true, nil, func(e error) bool { return e == nil }},
+		{BackendConfig{LegalHold: true}, true, nil, func(e error) bool { return e == nil }},
+		{BackendConfig{ImmutabilityPeriod: time.Hour}, false, nil, func(e error) bool { return e == errImmutabilityNotEnabled }},
+		{BackendConfig{LegalHold: true}, false, nil, func(e error) bool { return e == errImmutabilityNotEnabled }},
+		{BackendConfig{LegalHold: true}, true, errors.New("failed"), func(e error) bool { return e != nil && e != errImmutabilityNotEnabled }},
+	}
+
+	for idx, c := range testCases {
+		client := newMockImmutabilityClient()
+		client.enabled = c.enabled
+		client.err = c.err
+		b := &AzureBackend{conf: &c.conf, immutability: client}
+
+		if err := b.validateImmutability(context.Background()); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+}
+
+func TestAzureCheckRetention(t *testing.T) {
+	testCases := []struct {
+		until time.Time
+		hold  bool
+		err   error
+		valid func(error) bool
+	}{
+		{time.Time{}, false, nil, func(e error) bool { return e == nil }},
+		{time.Now().Add(-time.Hour), false, nil, func(e error) bool { return e == nil }},
+		{time.Now().Add(time.Hour), false, nil, func(e error) bool { return e == ErrObjectRetained }},
+		{time.Time{}, true, nil, func(e error) bool { return e == ErrObjectRetained }},
+		{time.Time{}, false, errors.New("failed"), func(e error) bool { return e != nil && e != ErrObjectRetained }},
+	}
+
+	for idx, c := range testCases {
+		client := newMockImmutabilityClient()
+		client.retainUntil = c.until
+		client.retainHold = c.hold
+		client.err = c.err
+		b := &AzureBackend{conf: &BackendConfig{}, immutability: client}
+
+		if err := b.checkRetention(context.Background(), "volume"); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+}
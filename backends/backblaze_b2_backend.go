@@ -37,23 +37,118 @@ import (
 // B2BackendPrefix is the URI prefix used for the B2Backend.
 const B2BackendPrefix = "b2"
 
-// B2Backend integrates with BackBlaze's B2 storage service.
+// B2Backend integrates with BackBlaze's B2 storage service using its native API. Large volumes are uploaded in
+// parts with b2_start_large_file and b2_upload_part, each part sent with its SHA1 checksum so B2 rejects corrupt parts.
 type B2Backend struct {
 	conf       *BackendConfig
-	bucketCli  *b2.Bucket
+	bucketCli  B2BucketInterface
 	mutex      sync.Mutex
 	prefix     string
 	bucketName string
 }
 
+// B2BucketInterface is used to abstract the underlying B2 bucket so we can mockup tests.
+type B2BucketInterface interface {
+	BucketExists(ctx context.Context) error
+	NewWriter(ctx context.Context, name, sha1 string, chunkSize, concurrentUploads int) io.WriteCloser
+	NewReader(ctx context.Context, name string) io.ReadCloser
+	DeleteObject(ctx context.Context, name string) error
+	ListObjects(prefix string) B2ObjectLister
+}
+
+// B2ObjectLister lists the names of the objects of a B2 bucket a page at a time.
+type B2ObjectLister interface {
+	// NextPage returns the names of the next page of objects, or io.EOF once all objects were listed.
+	NextPage(ctx context.Context) ([]string, error)
+}
+
+// Basic wrapper for *b2.Bucket - will not be tested
+type b2Bucket struct {
+	bucket *b2.Bucket
+}
+
+func (b *b2Bucket) BucketExists(ctx context.Context) error {
+	// Poke the bucket to ensure it exists.
+	iter := b.bucket.List(ctx, b2.ListPageSize(1))
+	iter.Next()
+	return iter.Err()
+}
+
+func (b *b2Bucket) NewWriter(ctx context.Context, name, sha1 string, chunkSize, concurrentUploads int) io.WriteCloser {
+	w := b.bucket.Object(name).NewWriter(ctx)
+	w.ConcurrentUploads = concurrentUploads
+	w.ChunkSize = chunkSize
+	w.Resume = true
+
+	sha1Opt := b2.WithAttrsOption(&b2.Attrs{SHA1: sha1})
+	sha1Opt(w)
+	return w
+}
+
+func (b *b2Bucket) NewReader(ctx context.Context, name string) io.ReadCloser {
+	return b.bucket.Object(name).NewReader(ctx)
+}
+
+func (b *b2Bucket) DeleteObject(ctx context.Context, name string) error {
+	return b.bucket.Object(name).Delete(ctx)
+}
+
+func (b *b2Bucket) ListObjects(prefix string) B2ObjectLister {
+	return &b2ObjectLister{bucket: b.bucket, cursor: &b2.Cursor{Prefix: prefix}}
+}
+
+type b2ObjectLister struct {
+	bucket *b2.Bucket
+	cursor *b2.Cursor
+}
+
+func (l *b2ObjectLister) NextPage(ctx context.Context) ([]string, error) {
+	if l.cursor == nil {
+		return nil, io.EOF
+	}
+
+	objects, next, err := l.bucket.ListCurrentObjects(ctx, 1000, l.cursor)
+	if err == io.EOF {
+		next = nil
+	} else if err != nil {
+		return nil, err
+	}
+	l.cursor = next
+
+	names := make([]string, len(objects))
+	for idx := range objects {
+		names[idx] = objects[idx].Name()
+	}
+	if len(names) == 0 && next == nil {
+		return nil, io.EOF
+	}
+	return names, nil
+}
+
+type withB2Bucket struct{ bucket B2BucketInterface }
+
+func (w withB2Bucket) Apply(b Backend) {
+	switch v := b.(type) {
+	case *B2Backend:
+		v.bucketCli = w.bucket
+	}
+}
+
+// WithB2Bucket will override a B2 backend's underlying bucket client with the one provided.
+// Primarily used to inject mock clients for testing.
+func WithB2Bucket(c B2BucketInterface) Option {
+	return withB2Bucket{c}
+}
+
 type bufferedRT struct {
-	bufChan chan bool
+	bufChan   chan bool
+	transport http.RoundTripper
 }
 
 func (b bufferedRT) RoundTrip(r *http.Request) (*http.Response, error) {
 	b.bufChan <- true
 	defer func() { <-b.bufChan }()
-	return http.DefaultTransport.RoundTrip(r)
+	return b.transport.RoundTrip(r)
 }
 
 // Init will initialize the B2Backend and verify the provided URI is valid/exists.
@@ -79,42 +174,42 @@ func (b *B2Backend) Init(ctx context.Context, conf *BackendConfig, opts ...Optio
 		opt.Apply(b)
 	}
 
-	var cliopts []b2.ClientOption
+	// Each request, including those uploading the parts of a volume, fails once its response has not started within
+	// the request timeout, see newHTTPTransport
+	var transport http.RoundTripper = newHTTPTransport(conf)
 	if conf.MaxParallelUploadBuffer != nil {
-		cliopts = append(cliopts, b2.Transport(bufferedRT{b.conf.MaxParallelUploadBuffer}))
+		transport = bufferedRT{b.conf.MaxParallelUploadBuffer, transport}
 	}
+	cliopts := []b2.ClientOption{b2.Transport(transport)}
 
-	client, err := b2.NewClient(ctx, accountID, accountKey, cliopts...)
-	if err != nil {
-		return err
-	}
+	return retryInit(ctx, conf, B2BackendPrefix, func() error {
+		if b.bucketCli == nil {
+			// Authorizing the account is a request too
+			client, err := b2.NewClient(ctx, accountID, accountKey, cliopts...)
+			if err != nil {
+				return err
+			}
 
-	b.bucketCli, err = client.Bucket(ctx, b.bucketName)
-	if err != nil {
-		return err
-	}
+			bucket, err := client.Bucket(ctx, b.bucketName)
+			if err != nil {
+				return err
+			}
+			b.bucketCli = &b2Bucket{bucket}
+		}
 
-	// Poke the bucket to ensure it exists.
-	iter := b.bucketCli.List(ctx, b2.ListPageSize(1))
-	iter.Next()
-	return iter.Err()
+		return b.bucketCli.BucketExists(ctx)
+	}, isTransientError)
 }
 
-// Upload will upload the provided volume to this B2Backend's configured bucket+prefix
+// Upload will upload the provided volume to this B2Backend's configured bucket+prefix. Volumes larger than the
+// UploadChunkSize are uploaded in parts of that size, up to MaxParallelUploads at a time.
 func (b *B2Backend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
 	// We will be doing multipart uploads, no need to allow multiple calls of Upload to initiate new uploads.
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
 	name := b.prefix + vol.ObjectName
-	w := b.bucketCli.Object(name).NewWriter(ctx)
-
-	w.ConcurrentUploads = b.conf.MaxParallelUploads
-	w.ChunkSize = b.conf.UploadChunkSize
-	w.Resume = true
-
-	sha1Opt := b2.WithAttrsOption(&b2.Attrs{SHA1: vol.SHA1Sum})
-	sha1Opt(w)
+	w := b.bucketCli.NewWriter(ctx, name, vol.SHA1Sum, b.conf.UploadChunkSize, b.conf.MaxParallelUploads)
 
 	if _, err := io.Copy(w, vol); err != nil {
 		w.Close()
@@ -122,12 +217,18 @@ func (b *B2Backend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
 		return err
 	}
 
-	return w.Close()
+	if err := w.Close(); err != nil {
+		helpers.AppLogger.Debugf("b2 backend: Error while completing the upload of volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+	return nil
 }
 
 // Delete will delete the object with the given name from the configured bucket
 func (b *B2Backend) Delete(ctx context.Context, name string) error {
-	return b.bucketCli.Object(name).Delete(ctx)
+	return retryRequest(ctx, b.conf, B2BackendPrefix, "delete "+name, func(ctx context.Context) error {
+		return b.bucketCli.DeleteObject(ctx, name)
+	})
 }
 
 // PreDownload will do nothing for this backend.
@@ -137,7 +238,7 @@ func (b *B2Backend) PreDownload(ctx context.Context, keys []string) error {
 
 // Download will download the requseted object which can be read from the returned io.ReadCloser
 func (b *B2Backend) Download(ctx context.Context, name string) (io.ReadCloser, error) {
-	return b.bucketCli.Object(name).NewReader(ctx), nil
+	return b.bucketCli.NewReader(ctx, name), nil
 }
 
 // Close will release any resources used by the B2 backend.
@@ -150,13 +251,19 @@ func (b *B2Backend) Close() error {
 // a list of object names, filtering by the provided prefix.
 func (b *B2Backend) List(ctx context.Context, prefix string) ([]string, error) {
 	var l []string
-	iter := b.bucketCli.List(ctx, b2.ListPrefix(prefix))
-	for iter.Next() {
-		obj := iter.Object()
-		l = append(l, obj.Name())
-	}
-	if err := iter.Err(); err != nil {
-		return nil, err
+	lister := b.bucketCli.ListObjects(prefix)
+	for {
+		var page []string
+		err := retryRequest(ctx, b.conf, B2BackendPrefix, "list "+prefix, func(ctx context.Context) error {
+			var lerr error
+			page, lerr = lister.NextPage(ctx)
+			return lerr
+		})
+		if err == io.EOF {
+			return l, nil
+		} else if err != nil {
+			return nil, err
+		}
+		l = append(l, page...)
 	}
-	return l, nil
 }
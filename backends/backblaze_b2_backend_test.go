@@ -20,7 +20,100 @@
 
 package backends
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+)
+
+type b2MockBucket struct {
+	bucketErr error
+	err       error // For any function that returns an error, use this error
+	reader    io.ReadCloser
+	writer    io.WriteCloser
+	list      []string
+	listErr   error
+	pageSize  int
+	pageDelay time.Duration
+	listCalls int
+
+	name              string
+	sha1              string
+	chunkSize         int
+	concurrentUploads int
+}
+
+func (m *b2MockBucket) BucketExists(ctx context.Context) error {
+	return m.bucketErr
+}
+
+func (m *b2MockBucket) NewWriter(ctx context.Context, name, sha1 string, chunkSize, concurrentUploads int) io.WriteCloser {
+	m.name, m.sha1, m.chunkSize, m.concurrentUploads = name, sha1, chunkSize, concurrentUploads
+	return m.writer
+}
+
+func (m *b2MockBucket) NewReader(ctx context.Context, name string) io.ReadCloser {
+	return m.reader
+}
+
+func (m *b2MockBucket) DeleteObject(ctx context.Context, name string) error {
+	return m.err
+}
+
+func (m *b2MockBucket) ListObjects(prefix string) B2ObjectLister {
+	return &b2MockLister{bucket: m}
+}
+
+// b2MockLister lists the objects of its bucket pageSize at a time, or all at once if not set, taking pageDelay for each.
+type b2MockLister struct {
+	bucket *b2MockBucket
+	offset int
+}
+
+func (l *b2MockLister) NextPage(ctx context.Context) ([]string, error) {
+	l.bucket.listCalls++
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(l.bucket.pageDelay):
+	}
+
+	if l.bucket.listErr != nil {
+		return nil, l.bucket.listErr
+	}
+	if l.offset == len(l.bucket.list) {
+		return nil, io.EOF
+	}
+	end := len(l.bucket.list)
+	if l.bucket.pageSize > 0 && l.offset+l.bucket.pageSize < end {
+		end = l.offset + l.bucket.pageSize
+	}
+	page := l.bucket.list[l.offset:end]
+	l.offset = end
+	return page, nil
+}
+
+type failCloseWriter struct {
+	closeWriterWrapper
+}
+
+func (f *failCloseWriter) Close() error {
+	return errTest
+}
+
+var b2TestConfig = &BackendConfig{
+	TargetURI:          B2BackendPrefix + "://bucketname/prefix/",
+	UploadChunkSize:    5 * 1024 * 1024,
+	MaxParallelUploads: 3,
+	MaxBackoffTime:     1 * time.Second,
+	MaxRetryTime:       5 * time.Second,
+}
 
 func TestB2GetBackendForURI(t *testing.T) {
 	b, err := GetBackendForURI(B2BackendPrefix + "://bucket_name")
@@ -31,3 +124,193 @@ func TestB2GetBackendForURI(t *testing.T) {
 		t.Errorf("Expected to get a backend of type B2Backend, but did not.")
 	}
 }
+
+func TestB2Init(t *testing.T) {
+	testCases := []struct {
+		bucket  *b2MockBucket
+		conf    *BackendConfig
+		errTest errTestFunc
+		prefix  string
+	}{
+		{
+			bucket:  &b2MockBucket{},
+			conf:    b2TestConfig,
+			errTest: nilErrTest,
+			prefix:  "prefix/",
+		},
+		{
+			bucket:  &b2MockBucket{bucketErr: errTest},
+			conf:    b2TestConfig,
+			errTest: errTestErrTest,
+			prefix:  "prefix/",
+		},
+		{
+			bucket:  &b2MockBucket{},
+			conf:    &BackendConfig{TargetURI: "notb2://bucketname"},
+			errTest: errInvalidURIErrTest,
+		},
+	}
+
+	for idx, c := range testCases {
+		b := &B2Backend{}
+		if err := b.Init(context.Background(), c.conf, WithB2Bucket(c.bucket)); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+		if b.prefix != c.prefix {
+			t.Errorf("%d: Expected prefix %v, got %v", idx, c.prefix, b.prefix)
+		}
+	}
+}
+
+func TestB2Upload(t *testing.T) {
+	testPayLoad, goodvol, badvol, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	readVerify := bytes.NewBuffer(nil)
+
+	testCases := []struct {
+		bucket  *b2MockBucket
+		errTest errTestFunc
+		vol     *helpers.VolumeInfo
+	}{
+		{
+			bucket:  &b2MockBucket{writer: &closeWriterWrapper{readVerify}},
+			errTest: nilErrTest,
+			vol:     goodvol,
+		},
+		{
+			bucket:  &b2MockBucket{writer: &failWriter{}},
+			errTest: errTestErrTest,
+			vol:     goodvol,
+		},
+		{
+			bucket:  &b2MockBucket{writer: &failCloseWriter{closeWriterWrapper{readVerify}}},
+			errTest: errTestErrTest,
+			vol:     goodvol,
+		},
+		{
+			bucket:  &b2MockBucket{writer: &closeWriterWrapper{readVerify}},
+			errTest: nonNilErrTest,
+			vol:     badvol,
+		},
+	}
+
+	if err = goodvol.OpenVolume(); err != nil {
+		t.Errorf("could not open good volume due to error %v", err)
+	}
+
+	for idx, c := range testCases {
+		b := &B2Backend{}
+		if err := b.Init(context.Background(), b2TestConfig, WithB2Bucket(c.bucket)); err != nil {
+			t.Errorf("%d: error setting up backend - %v", idx, err)
+			continue
+		}
+		goodvol.Seek(0, io.SeekStart)
+		readVerify.Reset()
+		errResult := b.Upload(context.Background(), c.vol)
+		if !c.errTest(errResult) {
+			t.Errorf("%d: Unexpected error, got %v", idx, errResult)
+		}
+		if errResult != nil {
+			continue
+		}
+		if !reflect.DeepEqual(testPayLoad, readVerify.Bytes()) {
+			t.Errorf("%d: read bytes not equal to given bytes", idx)
+		}
+		if expected := "prefix/" + c.vol.ObjectName; c.bucket.name != expected {
+			t.Errorf("%d: Expected object name %s, got %s", idx, expected, c.bucket.name)
+		}
+		if c.bucket.sha1 != c.vol.SHA1Sum {
+			t.Errorf("%d: Expected SHA1 %s, got %s", idx, c.vol.SHA1Sum, c.bucket.sha1)
+		}
+		if c.bucket.chunkSize != b2TestConfig.UploadChunkSize || c.bucket.concurrentUploads != b2TestConfig.MaxParallelUploads {
+			t.Errorf("%d: Expected chunk size %d and %d concurrent uploads, got %d and %d", idx,
+				b2TestConfig.UploadChunkSize, b2TestConfig.MaxParallelUploads, c.bucket.chunkSize, c.bucket.concurrentUploads)
+		}
+	}
+}
+
+func TestB2Delete(t *testing.T) {
+	testCases := []struct {
+		bucket  *b2MockBucket
+		errTest errTestFunc
+	}{
+		{bucket: &b2MockBucket{}, errTest: nilErrTest},
+		{bucket: &b2MockBucket{err: errTest}, errTest: errTestErrTest},
+	}
+
+	for idx, c := range testCases {
+		b := &B2Backend{}
+		if err := b.Init(context.Background(), b2TestConfig, WithB2Bucket(c.bucket)); err != nil {
+			t.Errorf("%d: error setting up backend - %v", idx, err)
+		} else if err = b.Delete(context.Background(), "prefix/vol1"); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+	}
+}
+
+func TestB2List(t *testing.T) {
+	testList := []string{"prefix/l", "prefix/m", "prefix/n"}
+	testCases := []struct {
+		bucket  *b2MockBucket
+		errTest errTestFunc
+		list    []string
+	}{
+		{bucket: &b2MockBucket{}, errTest: nilErrTest},
+		{bucket: &b2MockBucket{list: testList}, errTest: nilErrTest, list: testList},
+		{bucket: &b2MockBucket{list: testList, listErr: errTest}, errTest: errTestErrTest},
+	}
+
+	for idx, c := range testCases {
+		b := &B2Backend{}
+		if err := b.Init(context.Background(), b2TestConfig, WithB2Bucket(c.bucket)); err != nil {
+			t.Errorf("%d: error setting up backend - %v", idx, err)
+			continue
+		}
+		list, err := b.List(context.Background(), "prefix/")
+		if !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+		if !reflect.DeepEqual(list, c.list) {
+			t.Errorf("%d: Expected list %v, got %v", idx, c.list, list)
+		}
+	}
+}
+
+func TestB2ListTimeoutPerPage(t *testing.T) {
+	// Listing all pages takes longer than the timeout, but each page is listed well within it
+	conf := *b2TestConfig
+	conf.RequestTimeout, conf.MaxBackoffTime, conf.MaxRetryTime = 50*time.Millisecond, time.Millisecond, time.Second
+	bucket := &b2MockBucket{list: []string{"prefix/a", "prefix/b", "prefix/c", "prefix/d", "prefix/e"}, pageSize: 2, pageDelay: 20 * time.Millisecond}
+
+	b := &B2Backend{}
+	if err := b.Init(context.Background(), &conf, WithB2Bucket(bucket)); err != nil {
+		t.Fatalf("error setting up backend - %v", err)
+	}
+	// Three pages, and the call telling the listing is done
+	if l, err := b.List(context.Background(), "prefix/"); err != nil || !reflect.DeepEqual(l, bucket.list) || bucket.listCalls != 4 {
+		t.Errorf("expected all pages to be listed in 4 calls, got %v (%v) after %d calls", l, err, bucket.listCalls)
+	}
+}
+
+func TestB2Download(t *testing.T) {
+	testPayLoad := []byte("some volume contents")
+	b := &B2Backend{}
+	bucket := &b2MockBucket{reader: &closeReaderWrapper{bytes.NewReader(testPayLoad)}}
+	if err := b.Init(context.Background(), b2TestConfig, WithB2Bucket(bucket)); err != nil {
+		t.Fatalf("error setting up backend - %v", err)
+	}
+
+	r, err := b.Download(context.Background(), "prefix/vol1")
+	if err != nil {
+		t.Fatalf("Unexpected error, got %v", err)
+	}
+	testRead, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("could not read from reader - %v", err)
+	}
+	if !reflect.DeepEqual(testPayLoad, testRead) {
+		t.Errorf("read bytes not equal to given bytes")
+	}
+}
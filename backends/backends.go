@@ -42,6 +42,40 @@ type Backend interface {
 	Delete(ctx context.Context, filename string) error                    // Delete the file specified on the configured backend
 }
 
+// ObjectInfo describes an object found in a backend.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	StorageClass string // The storage class or access tier of the object, if reported by the backend
+}
+
+// DetailedLister is implemented by backends that can report object details while listing.
+type DetailedLister interface {
+	ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) // Lists all objects in the backend along with their details, filtering by the provided prefix.
+}
+
+// RangeDownloader is implemented by backends that can download part of an object.
+type RangeDownloader interface {
+	DownloadRange(ctx context.Context, filename string, offset, length int64) (io.ReadCloser, error) // Download length bytes of the requested file starting at offset.
+}
+
+// BatchDeleter is implemented by backends that can delete several objects in a single request.
+type BatchDeleter interface {
+	MaxDeleteBatchSize() int                                                       // The most files DeleteBatch can be given at once.
+	DeleteBatch(ctx context.Context, filenames []string) (map[string]error, error) // Delete the files specified, returning the error of each file that could not be deleted.
+}
+
+// Copier is implemented by backends that can copy an object to another name without downloading and uploading it again.
+type Copier interface {
+	Copy(ctx context.Context, source, destination string) error // Copy the file source to destination on the configured backend, replacing it if it exists.
+}
+
+// SpaceReporter is implemented by backends that can report how much space is left to upload to, e.g. on a filesystem or under a quota.
+type SpaceReporter interface {
+	FreeSpace(ctx context.Context) (uint64, error) // Returns the number of bytes that can still be uploaded to the backend.
+}
+
 // Option lets users inject functionality to specific backends
 type Option interface {
 	Apply(Backend)
@@ -55,6 +89,26 @@ type BackendConfig struct {
 	MaxRetryTime            time.Duration
 	TargetURI               string
 	UploadChunkSize         int
+	UploadPartRetries       int
+	DNSCacheTTL             time.Duration
+	MaxConnsPerHost         int
+	IPFamily                string
+	MaxParallelRestores     int
+	RestoreRequestRate      float64
+	ImmutabilityPeriod      time.Duration
+	ImmutabilityLocked      bool
+	LegalHold               bool
+	ConditionalUpload       bool
+	InitRetryTime           time.Duration
+	VerifyUploads           bool
+	ExpiresAt               time.Time
+	ExpiryTagging           string
+	ClockSkewCheck          string
+	MaxClockSkew            time.Duration
+	StorageClass            string
+	S3SSE                   string
+	S3KMSKeyID              string
+	RequestTimeout          time.Duration
 }
 
 var (
@@ -62,6 +116,16 @@ var (
 	ErrInvalidURI = errors.New("backends: invalid URI provided to backend")
 	// ErrInvalidPrefix is returned when a backend destination is provided with a URI prefix that isn't registered.
 	ErrInvalidPrefix = errors.New("backends: the provided prefix does not exist")
+	// ErrObjectRetained is returned when an object cannot be deleted yet as it is under a retention policy or legal hold.
+	ErrObjectRetained = errors.New("backends: the object is under a retention policy or legal hold")
+	// ErrInvalidStorageClass is returned when a backend is configured with a storage class it does not support.
+	ErrInvalidStorageClass = errors.New("backends: the storage class is not supported by the backend")
+	// ErrInvalidServerSideEncryption is returned when a backend is configured with a server-side encryption it does not support.
+	ErrInvalidServerSideEncryption = errors.New("backends: the server-side encryption configuration is not supported by the backend")
+	// ErrRequestTimeout is returned when a request to a backend did not complete within the configured request timeout, and retrying it did not help.
+	ErrRequestTimeout = errors.New("backends: the request did not complete within the request timeout")
+	// ErrFreeSpaceUnsupported is returned by a SpaceReporter when the destination it is configured with cannot report its free space, e.g. an SFTP server without the statvfs extension.
+	ErrFreeSpaceUnsupported = errors.New("backends: the destination cannot report its free space")
 )
 
 // GetBackendForURI will try and parse the URI for a matching backend to use.
@@ -80,10 +144,16 @@ func GetBackendForURI(uri string) (Backend, error) {
 		return &AWSS3Backend{}, nil
 	case FileBackendPrefix:
 		return &FileBackend{}, nil
+	case MemoryBackendPrefix:
+		return &MemoryBackend{}, nil
 	case AzureBackendPrefix:
 		return &AzureBackend{}, nil
 	case B2BackendPrefix:
 		return &B2Backend{}, nil
+	case SwiftBackendPrefix:
+		return &SwiftBackend{}, nil
+	case SSHBackendPrefix:
+		return &SSHBackend{}, nil
 	default:
 		return nil, ErrInvalidPrefix
 	}
@@ -95,7 +95,7 @@ func prepareTestVols() (payload []byte, goodVol *helpers.VolumeInfo, badVol *hel
 		return
 	}
 	reader := bytes.NewReader(payload)
-	goodVol, err = helpers.CreateSimpleVolume(context.Background(), false)
+	goodVol, err = helpers.CreateSimpleVolume(context.Background(), false, "")
 	if err != nil {
 		return
 	}
@@ -109,7 +109,7 @@ func prepareTestVols() (payload []byte, goodVol *helpers.VolumeInfo, badVol *hel
 	}
 	goodVol.ObjectName = strings.Join([]string{"this", "is", "just", "a", "test"}, "-") + ".ext"
 
-	badVol, err = helpers.CreateSimpleVolume(context.Background(), false)
+	badVol, err = helpers.CreateSimpleVolume(context.Background(), false, "")
 	if err != nil {
 		return
 	}
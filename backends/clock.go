@@ -0,0 +1,97 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// What to do when the clock of this host is out of sync with the clock of a backend when initializing it.
+const (
+	ClockSkewCheckOff  = "off"
+	ClockSkewCheckWarn = "warn"
+	ClockSkewCheckFail = "fail"
+)
+
+var (
+	// ErrInvalidClockSkewCheck is returned when an unknown clock skew check is configured.
+	ErrInvalidClockSkewCheck = fmt.Errorf("invalid clock skew check, expected one of %s, %s, or %s", ClockSkewCheckOff, ClockSkewCheckWarn, ClockSkewCheckFail)
+	// ErrClockSkewed is returned when the clock of this host is further off the clock of a backend than allowed.
+	ErrClockSkewed = errors.New("backends: the clock of this host is out of sync with the backend")
+)
+
+// ValidateClockSkewCheck will return an error if the provided clock skew check is not one of the supported ones.
+func ValidateClockSkewCheck(check string) error {
+	switch check {
+	case "", ClockSkewCheckOff, ClockSkewCheckWarn, ClockSkewCheckFail:
+		return nil
+	}
+	return ErrInvalidClockSkewCheck
+}
+
+// clockSkew will return how far ahead of the server time, as found in the Date header of a response, the
+// provided time is, negative when it is behind, and false if the header could not be parsed.
+func clockSkew(date string, now time.Time) (time.Duration, bool) {
+	if date == "" {
+		return 0, false
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(serverTime), true
+}
+
+// checkClockSkew will compare the clock of this host against the Date header of a response from the backend,
+// warning about or failing with ErrClockSkewed when they are further apart than the MaxClockSkew of the provided
+// config allows. Signed requests are refused once the clocks are too far apart (e.g. with RequestTimeTooSkewed
+// for S3), which is hard to tell apart from a credentials issue without this check.
+func checkClockSkew(prefix, date string, now time.Time, conf *BackendConfig) error {
+	if conf.ClockSkewCheck == "" || conf.ClockSkewCheck == ClockSkewCheckOff || conf.MaxClockSkew <= 0 {
+		return nil
+	}
+
+	skew, ok := clockSkew(date, now)
+	if !ok {
+		helpers.AppLogger.Debugf("%s backend: could not check the clock of this host against %s, no valid Date header was received.", prefix, conf.TargetURI)
+		return nil
+	}
+	if skew <= conf.MaxClockSkew && skew >= -conf.MaxClockSkew {
+		return nil
+	}
+
+	direction := "ahead of"
+	if skew < 0 {
+		direction, skew = "behind", -skew
+	}
+	msg := fmt.Sprintf("%s backend: the clock of this host is %v %s the clock of %s, more than the %v allowed. Requests may be refused as their signatures expire, please sync the clock of this host with NTP (e.g. with chronyd or systemd-timesyncd).", prefix, skew.Round(time.Second), direction, conf.TargetURI, conf.MaxClockSkew)
+	if conf.ClockSkewCheck == ClockSkewCheckFail {
+		helpers.AppLogger.Error(msg)
+		return ErrClockSkewed
+	}
+	helpers.AppLogger.Warning(msg)
+	return nil
+}
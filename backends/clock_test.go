@@ -0,0 +1,90 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backends
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		date  string
+		skew  time.Duration
+		valid bool
+	}{
+		{now.Format(http.TimeFormat), 0, true},
+		{now.Add(-20 * time.Minute).Format(http.TimeFormat), 20 * time.Minute, true},
+		{now.Add(time.Hour).Format(http.TimeFormat), -time.Hour, true},
+		{"Wed, 01 Jan 2020 12:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"yesterday", 0, false},
+	}
+
+	for idx, c := range testCases {
+		skew, ok := clockSkew(c.date, now)
+		if ok != c.valid || skew != c.skew {
+			t.Errorf("%d: expected a skew of %v (%v), got %v (%v)", idx, c.skew, c.valid, skew, ok)
+		}
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		check   string
+		max     time.Duration
+		date    string
+		errTest errTestFunc
+	}{
+		{ClockSkewCheckFail, 5 * time.Minute, now.Add(-time.Minute).Format(http.TimeFormat), nilErrTest},
+		{ClockSkewCheckFail, 5 * time.Minute, now.Add(-20 * time.Minute).Format(http.TimeFormat), func(e error) bool { return e == ErrClockSkewed }},
+		{ClockSkewCheckFail, 5 * time.Minute, now.Add(20 * time.Minute).Format(http.TimeFormat), func(e error) bool { return e == ErrClockSkewed }},
+		// Only a warning is logged
+		{ClockSkewCheckWarn, 5 * time.Minute, now.Add(-20 * time.Minute).Format(http.TimeFormat), nilErrTest},
+		{ClockSkewCheckOff, 5 * time.Minute, now.Add(-20 * time.Minute).Format(http.TimeFormat), nilErrTest},
+		{ClockSkewCheckFail, 0, now.Add(-20 * time.Minute).Format(http.TimeFormat), nilErrTest},
+		// A missing or invalid Date header cannot be checked against
+		{ClockSkewCheckFail, 5 * time.Minute, "", nilErrTest},
+		{ClockSkewCheckFail, 5 * time.Minute, "yesterday", nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		conf := &BackendConfig{TargetURI: "s3://goodbucket", ClockSkewCheck: c.check, MaxClockSkew: c.max}
+		if err := checkClockSkew(AWSS3BackendPrefix, c.date, now, conf); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+	}
+}
+
+func TestValidateClockSkewCheck(t *testing.T) {
+	for idx, check := range []string{"", ClockSkewCheckOff, ClockSkewCheckWarn, ClockSkewCheckFail} {
+		if err := ValidateClockSkewCheck(check); err != nil {
+			t.Errorf("%d: expected %q to be valid, got %v", idx, check, err)
+		}
+	}
+	if err := ValidateClockSkewCheck("ignore"); err != ErrInvalidClockSkewCheck {
+		t.Errorf("expected error %v, got %v", ErrInvalidClockSkewCheck, err)
+	}
+}
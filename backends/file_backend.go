@@ -23,9 +23,11 @@ package backends
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/kietdlam/zfsbackup-go/helpers"
 	//"../helpers"
@@ -100,6 +102,51 @@ func (f *FileBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error
 	return w.Close()
 }
 
+// Copy will copy the given file to another path of the configured local destination. The copy is written to a
+// temporary file first so an interrupted copy never leaves a partial file under the destination name.
+func (f *FileBackend) Copy(ctx context.Context, source, destination string) error {
+	r, err := os.Open(filepath.Join(f.localPath, source))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	destinationPath := filepath.Join(f.localPath, destination)
+	destinationDir := filepath.Dir(destinationPath)
+	if err = os.MkdirAll(destinationDir, os.ModePerm); err != nil {
+		helpers.AppLogger.Debugf("file backend: Could not create path %s due to error - %v", destinationDir, err)
+		return err
+	}
+
+	w, err := ioutil.TempFile(destinationDir, ".copy")
+	if err != nil {
+		helpers.AppLogger.Debugf("file backend: Could not create a file in %s due to error - %v", destinationDir, err)
+		return err
+	}
+	defer os.Remove(w.Name())
+
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		helpers.AppLogger.Debugf("file backend: Error while copying %s to %s - %v", source, destination, err)
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(w.Name(), destinationPath)
+}
+
+// FreeSpace will return the number of bytes available to unprivileged users on the filesystem of the configured local destination
+func (f *FileBackend) FreeSpace(ctx context.Context) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(f.localPath, &stat); err != nil {
+		helpers.AppLogger.Debugf("file backend: Could not get the free space of %s due to error - %v", f.localPath, err)
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
 // Delete will delete the given object from the provided path
 func (f *FileBackend) Delete(ctx context.Context, filename string) error {
 	return os.Remove(filepath.Join(f.localPath, filename))
@@ -115,6 +162,20 @@ func (f *FileBackend) Download(ctx context.Context, filename string) (io.ReadClo
 	return os.Open(filepath.Join(f.localPath, filename))
 }
 
+// DownloadRange will open the file for reading length bytes starting at offset
+func (f *FileBackend) DownloadRange(ctx context.Context, filename string, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(f.localPath, filename))
+	if err != nil {
+		return nil, err
+	}
+	return &sectionReadCloser{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
 // Close does nothing for this backend.
 func (f *FileBackend) Close() error {
 	return nil
@@ -122,7 +183,22 @@ func (f *FileBackend) Close() error {
 
 // List will return a list of all files matching the provided prefix
 func (f *FileBackend) List(ctx context.Context, prefix string) ([]string, error) {
-	l := make([]string, 0, 1000)
+	objects, err := f.ListDetailed(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
+	}
+
+	return l, nil
+}
+
+// ListDetailed will return the details of all files matching the provided prefix
+func (f *FileBackend) ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	l := make([]ObjectInfo, 0, 1000)
 	err := filepath.Walk(f.localPath, func(path string, fi os.FileInfo, werr error) error {
 		if werr != nil {
 			return werr
@@ -130,7 +206,11 @@ func (f *FileBackend) List(ctx context.Context, prefix string) ([]string, error)
 
 		trimmedPath := strings.TrimPrefix(path, f.localPath+string(filepath.Separator))
 		if !fi.IsDir() && strings.HasPrefix(trimmedPath, prefix) {
-			l = append(l, trimmedPath)
+			l = append(l, ObjectInfo{
+				Name:         trimmedPath,
+				Size:         fi.Size(),
+				LastModified: fi.ModTime(),
+			})
 		}
 		return nil
 	})
@@ -29,7 +29,9 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -137,6 +139,59 @@ func TestFileDelete(t *testing.T) {
 	}
 }
 
+func TestFileCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filebackendcopy")
+	if err != nil {
+		t.Fatalf("Error trying to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "source"), []byte("contents"), 0644); err != nil {
+		t.Fatalf("Error trying to create a file to copy: %v", err)
+	}
+
+	b := &FileBackend{}
+	if err = b.Init(context.Background(), &BackendConfig{TargetURI: "file://" + dir}); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	testCases := []struct {
+		source      string
+		destination string
+		errTest     errTestFunc
+	}{
+		{"source", "copy", nilErrTest},
+		// Missing directories are created and existing files replaced
+		{"source", filepath.Join("new", "prefix", "copy"), nilErrTest},
+		{"source", "copy", nilErrTest},
+		{"missing", "copy", nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		if err = b.Copy(context.Background(), c.source, c.destination); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if data, rerr := ioutil.ReadFile(filepath.Join(dir, c.destination)); rerr != nil || string(data) != "contents" {
+			t.Errorf("%d: Expected the copy to hold the contents of the source, got %q (%v)", idx, data, rerr)
+		}
+	}
+
+	// No temporary files are left behind
+	objects, err := b.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Expected nil error listing the copies, got %v", err)
+	}
+	sort.Strings(objects)
+	expected := []string{"copy", filepath.Join("new", "prefix", "copy"), "source"}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("Expected the objects %v, got %v", expected, objects)
+	}
+}
+
 func TestFileList(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "filebackendtesttempdir")
 	if err != nil {
@@ -242,6 +297,58 @@ func TestFileDownload(t *testing.T) {
 	}
 }
 
+func TestFileDownloadRange(t *testing.T) {
+	w, err := ioutil.TempFile("", "filebackendtestfile")
+	if err != nil {
+		t.Fatalf("Error trying to create a tempfile: %v", err)
+	}
+	defer os.Remove(w.Name())
+
+	testPayLoad := make([]byte, 1024*1024)
+	if _, err = rand.Read(testPayLoad); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	if _, err = w.Write(testPayLoad); err != nil {
+		t.Fatalf("could not write to temp file testing - %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not write temp file testing - %v", err)
+	}
+
+	tempName := strings.TrimPrefix(w.Name(), os.TempDir())
+
+	b := &FileBackend{}
+	if err = b.Init(context.Background(), validFileConfig); err != nil {
+		t.Fatalf("Expected error %v, got %v", nil, err)
+	}
+
+	testCases := []struct {
+		offset int64
+		length int64
+		want   []byte
+	}{
+		{0, 100, testPayLoad[:100]},
+		{4096, 8192, testPayLoad[4096 : 4096+8192]},
+		// Ranges past the end of the file are truncated
+		{int64(len(testPayLoad)) - 10, 100, testPayLoad[len(testPayLoad)-10:]},
+	}
+
+	for idx, c := range testCases {
+		r, rerr := b.DownloadRange(context.Background(), tempName, c.offset, c.length)
+		if rerr != nil {
+			t.Errorf("%d: Expected nil error, got %v", idx, rerr)
+			continue
+		}
+		testRead, terr := ioutil.ReadAll(r)
+		r.Close()
+		if terr != nil {
+			t.Errorf("%d: could not read from reader - %v", idx, terr)
+		} else if !bytes.Equal(testRead, c.want) {
+			t.Errorf("%d: read %d bytes not equal to the requested range", idx, len(testRead))
+		}
+	}
+}
+
 func TestFileUpload(t *testing.T) {
 	testPayLoad, goodVol, badVol, err := prepareTestVols()
 	if err != nil {
@@ -300,3 +407,35 @@ func TestFileUpload(t *testing.T) {
 		}
 	}
 }
+
+func TestFileFreeSpace(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "zfsbackupfreespace")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	b := &FileBackend{}
+	if err = b.Init(context.Background(), &BackendConfig{TargetURI: FileBackendPrefix + "://" + tempDir}); err != nil {
+		t.Fatalf("could not initialize file backend - %v", err)
+	}
+
+	var reporter SpaceReporter = b
+	free, err := reporter.FreeSpace(context.Background())
+	if err != nil {
+		t.Fatalf("could not get the free space - %v", err)
+	}
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(tempDir, &stat); err != nil {
+		t.Fatalf("could not stat the filesystem - %v", err)
+	}
+	if total := uint64(stat.Blocks) * uint64(stat.Bsize); free == 0 || free > total {
+		t.Errorf("expected the free space to be between 0 and the size of the filesystem (%d), got %d", total, free)
+	}
+
+	// The destination went away since the backend was initialized
+	os.RemoveAll(tempDir)
+	if _, err = reporter.FreeSpace(context.Background()); !os.IsNotExist(err) {
+		t.Errorf("expected a missing destination to fail, got %v", err)
+	}
+}
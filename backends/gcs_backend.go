@@ -25,8 +25,10 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
@@ -56,13 +58,17 @@ type GCSClientInterface interface {
 	DeleteObject(c context.Context, b, o string) error
 	NewWriter(c context.Context, b, o string, h uint32, chunkSize int) io.WriteCloser
 	NewReader(c context.Context, b, o string) (io.ReadCloser, error)
-	ListBucket(c context.Context, b, p string) ([]string, error)
+	// ListBucketPage returns the names of a page of the objects with the prefix p, starting from the page token t, along
+	// with the token of the next page, empty once all objects were listed.
+	ListBucketPage(c context.Context, b, p, t string) ([]string, string, error)
 	Close() error
 }
 
 // Basic wrapper for *storage.Client - will not be tested
 type gcsClient struct {
 	client *storage.Client
+	// Timeout of each chunk of a resumable upload, if any
+	chunkTimeout time.Duration
 }
 
 func (g *gcsClient) BucketExists(ctx context.Context, bucket string) error {
@@ -79,6 +85,7 @@ func (g *gcsClient) NewWriter(ctx context.Context, bucket, object string, crc32H
 	w.CRC32C = crc32Hash
 	w.SendCRC32C = true
 	w.ChunkSize = chunkSize
+	w.ChunkTransferTimeout = g.chunkTimeout
 	return w
 }
 
@@ -90,22 +97,19 @@ func (g *gcsClient) Close() error {
 	return g.client.Close()
 }
 
-func (g *gcsClient) ListBucket(ctx context.Context, bucket, prefix string) ([]string, error) {
+func (g *gcsClient) ListBucketPage(ctx context.Context, bucket, prefix, pageToken string) ([]string, string, error) {
 	q := &storage.Query{Prefix: prefix}
-	objects := g.client.Bucket(bucket).Objects(ctx, q)
-	l := make([]string, 0, 1000)
-	for {
-		attrs, err := objects.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("gs backend: could not list bucket due to error - %v", err)
-		}
+	var objects []*storage.ObjectAttrs
+	next, err := iterator.NewPager(g.client.Bucket(bucket).Objects(ctx, q), 1000, pageToken).NextPage(&objects)
+	if err != nil {
+		return nil, "", fmt.Errorf("gs backend: could not list bucket due to error - %v", err)
+	}
 
-		l = append(l, attrs.Name)
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
 	}
-	return l, nil
+	return l, next, nil
 }
 
 type withGCSClient struct{ client GCSClientInterface }
@@ -148,13 +152,25 @@ func (g *GoogleCloudStorageBackend) Init(ctx context.Context, conf *BackendConfi
 		if err != nil {
 			return err
 		}
-		g.client = &gcsClient{client}
+		g.client = &gcsClient{client: client, chunkTimeout: conf.RequestTimeout}
 	}
 
-	return g.client.BucketExists(ctx, g.bucketName)
+	return retryInit(ctx, conf, GoogleCloudStorageBackendPrefix, func() error {
+		return g.client.BucketExists(ctx, g.bucketName)
+	}, isTransientGCSError)
+}
+
+// isTransientGCSError will check whether the provided error is worth retrying, e.g. due to a network failure
+// or the service being unavailable, as opposed to the request being denied or the bucket not existing.
+func isTransientGCSError(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return isTransientStatus(gerr.Code)
+	}
+	return isTransientError(err)
 }
 
-// Upload will upload the provided VolumeInfo to Google's Cloud Storage
+// Upload will upload the provided VolumeInfo to Google's Cloud Storage. Each chunk of the upload that does not
+// complete within the RequestTimeout of the config is retried by the storage client.
 func (g *GoogleCloudStorageBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
 	g.conf.MaxParallelUploadBuffer <- true
 	defer func() {
@@ -174,7 +190,9 @@ func (g *GoogleCloudStorageBackend) Upload(ctx context.Context, vol *helpers.Vol
 
 // Delete will delete the given object from the configured bucket
 func (g *GoogleCloudStorageBackend) Delete(ctx context.Context, filename string) error {
-	return g.client.DeleteObject(ctx, g.bucketName, filename)
+	return retryRequest(ctx, g.conf, GoogleCloudStorageBackendPrefix, "delete "+filename, func(ctx context.Context) error {
+		return g.client.DeleteObject(ctx, g.bucketName, filename)
+	})
 }
 
 // PreDownload does nothing on this backend.
@@ -184,7 +202,9 @@ func (g *GoogleCloudStorageBackend) PreDownload(ctx context.Context, objects []s
 
 // Download will download the requseted object which can be read from the return io.ReadCloser.
 func (g *GoogleCloudStorageBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
-	return g.client.NewReader(ctx, g.bucketName, filename)
+	return retryDownload(ctx, g.conf, GoogleCloudStorageBackendPrefix, "download "+filename, func(ctx context.Context) (io.ReadCloser, error) {
+		return g.client.NewReader(ctx, g.bucketName, filename)
+	})
 }
 
 // Close will release any resources used by the GCS backend.
@@ -198,5 +218,25 @@ func (g *GoogleCloudStorageBackend) Close() error {
 // List will iterate through all objects in the configured GCS bucket and return
 // a list of object names, filtering by the prefix provided.
 func (g *GoogleCloudStorageBackend) List(ctx context.Context, prefix string) ([]string, error) {
-	return g.client.ListBucket(ctx, g.bucketName, prefix)
+	var l []string
+	for pageToken := ""; ; {
+		var (
+			page []string
+			next string
+		)
+		err := retryRequest(ctx, g.conf, GoogleCloudStorageBackendPrefix, "list "+prefix, func(ctx context.Context) error {
+			var lerr error
+			page, next, lerr = g.client.ListBucketPage(ctx, g.bucketName, prefix, pageToken)
+			return lerr
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		l = append(l, page...)
+		if next == "" {
+			return l, nil
+		}
+		pageToken = next
+	}
 }
@@ -27,6 +27,7 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -62,8 +63,8 @@ func (g *gcsMockClient) Close() error {
 	return g.err
 }
 
-func (g *gcsMockClient) ListBucket(ctx context.Context, bucket, prefix string) ([]string, error) {
-	return g.list, g.err
+func (g *gcsMockClient) ListBucketPage(ctx context.Context, bucket, prefix, pageToken string) ([]string, string, error) {
+	return g.list, "", g.err
 }
 
 const (
@@ -448,3 +449,97 @@ func TestGCSUpload(t *testing.T) {
 		}
 	}
 }
+
+// A client whose first few calls stall until their context is done
+type gcsSlowClient struct {
+	gcsMockClient
+	stalls int
+	calls  int
+}
+
+func (g *gcsSlowClient) stall(ctx context.Context) error {
+	if g.calls++; g.calls <= g.stalls {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (g *gcsSlowClient) DeleteObject(ctx context.Context, bucket, object string) error {
+	return g.stall(ctx)
+}
+
+func (g *gcsSlowClient) ListBucketPage(ctx context.Context, bucket, prefix, pageToken string) ([]string, string, error) {
+	if err := g.stall(ctx); err != nil {
+		return nil, "", err
+	}
+	return g.list, "", nil
+}
+
+// A client listing each of its pages, one at a time, in the provided delay
+type gcsPagedClient struct {
+	gcsMockClient
+	pages [][]string
+	delay time.Duration
+	calls int
+}
+
+func (g *gcsPagedClient) ListBucketPage(ctx context.Context, bucket, prefix, pageToken string) ([]string, string, error) {
+	g.calls++
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	case <-time.After(g.delay):
+	}
+
+	page := 0
+	if pageToken != "" {
+		page, _ = strconv.Atoi(pageToken)
+	}
+	if page+1 < len(g.pages) {
+		return g.pages[page], strconv.Itoa(page + 1), nil
+	}
+	return g.pages[page], "", nil
+}
+
+func TestGCSListTimeoutPerPage(t *testing.T) {
+	// Listing all pages takes longer than the timeout, but each page is listed well within it
+	conf := &BackendConfig{TargetURI: testBucketGood, RequestTimeout: 50 * time.Millisecond, MaxBackoffTime: time.Millisecond, MaxRetryTime: time.Second}
+	client := &gcsPagedClient{pages: [][]string{{"a", "b"}, {"c"}, {"d", "e"}, {"f"}}, delay: 20 * time.Millisecond}
+
+	b := &GoogleCloudStorageBackend{}
+	if err := b.Init(context.Background(), conf, WithGCSClient(client)); err != nil {
+		t.Fatalf("error setting up backend - %v", err)
+	}
+	if l, err := b.List(context.Background(), ""); err != nil || !reflect.DeepEqual(l, []string{"a", "b", "c", "d", "e", "f"}) || client.calls != 4 {
+		t.Errorf("expected all pages to be listed in 4 calls, got %v (%v) after %d calls", l, err, client.calls)
+	}
+}
+
+func TestGCSRequestTimeout(t *testing.T) {
+	conf := &BackendConfig{TargetURI: testBucketGood, RequestTimeout: 20 * time.Millisecond, MaxBackoffTime: time.Millisecond, MaxRetryTime: time.Minute}
+
+	testCases := []struct {
+		stalls int
+		calls  int
+	}{
+		{0, 1},
+		{1, 2},
+		{2, 3},
+	}
+
+	for idx, c := range testCases {
+		client := &gcsSlowClient{gcsMockClient: gcsMockClient{list: []string{"a"}}, stalls: c.stalls}
+		b := &GoogleCloudStorageBackend{}
+		if err := b.Init(context.Background(), conf, WithGCSClient(client)); err != nil {
+			t.Fatalf("%d: error setting up backend - %v", idx, err)
+		}
+		if err := b.Delete(context.Background(), "a"); err != nil || client.calls != c.calls {
+			t.Errorf("%d: expected the delete to succeed after %d calls, got %v after %d calls", idx, c.calls, err, client.calls)
+		}
+		client.calls = 0
+		if l, err := b.List(context.Background(), ""); err != nil || !reflect.DeepEqual(l, client.list) || client.calls != c.calls {
+			t.Errorf("%d: expected the list %v after %d calls, got %v (%v) after %d calls", idx, client.list, c.calls, l, err, client.calls)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// MemoryBackendPrefix is the URI prefix used for the MemoryBackend.
+const MemoryBackendPrefix = "mem"
+
+// memoryObject is an object held by a MemoryBackend.
+type memoryObject struct {
+	data         []byte
+	lastModified time.Time
+}
+
+// memoryStore holds the objects of every MemoryBackend initialized with the same URI.
+type memoryStore struct {
+	mutex   sync.Mutex
+	objects map[string]memoryObject
+}
+
+var (
+	memoryStoresMutex sync.Mutex
+	memoryStores      = make(map[string]*memoryStore)
+)
+
+// MemoryBackend keeps objects in memory, it is primarily meant for tests and pipelines that should not depend on
+// a real destination. Backends initialized with the same URI (e.g. mem://test) share their objects for the life of
+// the process, or until ResetMemoryBackends is called.
+type MemoryBackend struct {
+	conf   *BackendConfig
+	store  *memoryStore
+	errors map[string]error
+}
+
+type withMemoryErrors struct{ errors map[string]error }
+
+func (w withMemoryErrors) Apply(b Backend) {
+	switch v := b.(type) {
+	case *MemoryBackend:
+		v.errors = w.errors
+	}
+}
+
+// WithMemoryErrors will make a memory backend fail any operation on the provided keys with the error provided for
+// it. Listing a prefix found in the provided keys fails as well. Primarily used to exercise failure paths in tests.
+func WithMemoryErrors(errors map[string]error) Option {
+	return withMemoryErrors{errors}
+}
+
+// ResetMemoryBackends will discard the objects held by every memory backend.
+func ResetMemoryBackends() {
+	memoryStoresMutex.Lock()
+	defer memoryStoresMutex.Unlock()
+	memoryStores = make(map[string]*memoryStore)
+}
+
+// Init will initialize the MemoryBackend, attaching it to the objects of any other memory backend with the same URI.
+func (m *MemoryBackend) Init(ctx context.Context, conf *BackendConfig, opts ...Option) error {
+	m.conf = conf
+
+	name := strings.TrimPrefix(m.conf.TargetURI, MemoryBackendPrefix+"://")
+	if name == m.conf.TargetURI {
+		return ErrInvalidURI
+	}
+
+	for _, opt := range opts {
+		opt.Apply(m)
+	}
+
+	memoryStoresMutex.Lock()
+	defer memoryStoresMutex.Unlock()
+	if memoryStores[name] == nil {
+		memoryStores[name] = &memoryStore{objects: make(map[string]memoryObject)}
+	}
+	m.store = memoryStores[name]
+
+	return nil
+}
+
+// Upload will read the provided VolumeInfo into memory
+func (m *MemoryBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	if m.conf.MaxParallelUploadBuffer != nil {
+		m.conf.MaxParallelUploadBuffer <- true
+		defer func() {
+			<-m.conf.MaxParallelUploadBuffer
+		}()
+	}
+
+	if err := m.errors[vol.ObjectName]; err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(vol)
+	if err != nil {
+		helpers.AppLogger.Debugf("memory backend: Error while reading volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+	m.store.objects[vol.ObjectName] = memoryObject{data: data, lastModified: time.Now()}
+
+	return nil
+}
+
+// Delete will delete the given object
+func (m *MemoryBackend) Delete(ctx context.Context, filename string) error {
+	if err := m.errors[filename]; err != nil {
+		return err
+	}
+
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+	if _, ok := m.store.objects[filename]; !ok {
+		return &os.PathError{Op: "remove", Path: filename, Err: os.ErrNotExist}
+	}
+	delete(m.store.objects, filename)
+
+	return nil
+}
+
+// Copy will copy the given object to another name
+func (m *MemoryBackend) Copy(ctx context.Context, source, destination string) error {
+	if err := m.errors[destination]; err != nil {
+		return err
+	}
+	data, err := m.get(source)
+	if err != nil {
+		return err
+	}
+
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+	m.store.objects[destination] = memoryObject{data: append([]byte(nil), data...), lastModified: time.Now()}
+
+	return nil
+}
+
+// PreDownload does nothing on this backend.
+func (m *MemoryBackend) PreDownload(ctx context.Context, objects []string) error {
+	return nil
+}
+
+// Download will return a reader of the given object
+func (m *MemoryBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	data, err := m.get(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// DownloadRange will return a reader of length bytes of the given object starting at offset
+func (m *MemoryBackend) DownloadRange(ctx context.Context, filename string, offset, length int64) (io.ReadCloser, error) {
+	data, err := m.get(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(io.NewSectionReader(bytes.NewReader(data), offset, length)), nil
+}
+
+func (m *MemoryBackend) get(filename string) ([]byte, error) {
+	if err := m.errors[filename]; err != nil {
+		return nil, err
+	}
+
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+	obj, ok := m.store.objects[filename]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+
+	return obj.data, nil
+}
+
+// Close does nothing for this backend, the objects are kept for other memory backends with the same URI.
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+// List will return a sorted list of all objects matching the provided prefix
+func (m *MemoryBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := m.ListDetailed(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
+	}
+
+	return l, nil
+}
+
+// ListDetailed will return the details of all objects matching the provided prefix, sorted by name
+func (m *MemoryBackend) ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	if err := m.errors[prefix]; err != nil {
+		return nil, err
+	}
+
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+	l := make([]ObjectInfo, 0, len(m.store.objects))
+	for name, obj := range m.store.objects {
+		if strings.HasPrefix(name, prefix) {
+			l = append(l, ObjectInfo{
+				Name:         name,
+				Size:         int64(len(obj.data)),
+				LastModified: obj.lastModified,
+			})
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+
+	return l, nil
+}
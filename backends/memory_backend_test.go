@@ -0,0 +1,202 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryGetBackendForURI(t *testing.T) {
+	b, err := GetBackendForURI(MemoryBackendPrefix + "://test")
+	if err != nil {
+		t.Errorf("Error while trying to get backend: %v", err)
+	}
+	if _, ok := b.(*MemoryBackend); !ok {
+		t.Errorf("Expected to get a backend of type MemoryBackend, but did not.")
+	}
+}
+
+func TestMemoryInit(t *testing.T) {
+	testCases := []struct {
+		uri     string
+		errTest errTestFunc
+	}{
+		{"mem://", nilErrTest},
+		{"mem://test", nilErrTest},
+		{"file://test", errInvalidURIErrTest},
+	}
+
+	for idx, c := range testCases {
+		b := &MemoryBackend{}
+		if err := b.Init(context.Background(), &BackendConfig{TargetURI: c.uri}); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	defer ResetMemoryBackends()
+
+	testPayLoad, goodVol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	defer goodVol.DeleteVolume()
+	if err = goodVol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+
+	config := &BackendConfig{
+		TargetURI:               MemoryBackendPrefix + "://test",
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	b := &MemoryBackend{}
+	if err = b.Init(context.Background(), config); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	if err = b.Upload(context.Background(), goodVol); err != nil {
+		t.Fatalf("Expected nil error uploading the volume, got %v", err)
+	}
+	b.Close()
+
+	// Another backend with the same URI should find the uploaded object, one with another URI should not
+	other := &MemoryBackend{}
+	if err = other.Init(context.Background(), &BackendConfig{TargetURI: MemoryBackendPrefix + "://other"}); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	if l, lerr := other.List(context.Background(), ""); lerr != nil || len(l) != 0 {
+		t.Errorf("Expected an empty listing for another URI, got %v (%v)", l, lerr)
+	}
+
+	b = &MemoryBackend{}
+	if err = b.Init(context.Background(), config); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	listCases := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{goodVol.ObjectName}},
+		{"this-is", []string{goodVol.ObjectName}},
+		{"that", []string{}},
+	}
+	for idx, c := range listCases {
+		l, lerr := b.List(context.Background(), c.prefix)
+		if lerr != nil {
+			t.Errorf("%d: Expected nil error, got %v", idx, lerr)
+		} else if !reflect.DeepEqual(l, c.expected) {
+			t.Errorf("%d: Expected to list %v, got %v", idx, c.expected, l)
+		}
+	}
+
+	r, err := b.Download(context.Background(), goodVol.ObjectName)
+	if err != nil {
+		t.Fatalf("Expected nil error downloading the volume, got %v", err)
+	}
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(read, testPayLoad) {
+		t.Errorf("Expected to download the uploaded bytes, got %d bytes (%v)", len(read), err)
+	}
+
+	r, err = b.DownloadRange(context.Background(), goodVol.ObjectName, 4096, 100)
+	if err != nil {
+		t.Fatalf("Expected nil error downloading a range of the volume, got %v", err)
+	}
+	read, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(read, testPayLoad[4096:4096+100]) {
+		t.Errorf("Expected to download the requested range, got %d bytes (%v)", len(read), err)
+	}
+
+	if err = b.Delete(context.Background(), goodVol.ObjectName); err != nil {
+		t.Errorf("Expected nil error deleting the volume, got %v", err)
+	}
+	if err = b.Delete(context.Background(), goodVol.ObjectName); !os.IsNotExist(err) {
+		t.Errorf("Expected a does not exist error deleting the volume again, got %v", err)
+	}
+	if _, err = b.Download(context.Background(), goodVol.ObjectName); !os.IsNotExist(err) {
+		t.Errorf("Expected a does not exist error downloading a deleted volume, got %v", err)
+	}
+	if l, lerr := b.List(context.Background(), ""); lerr != nil || len(l) != 0 {
+		t.Errorf("Expected an empty listing after deleting the volume, got %v (%v)", l, lerr)
+	}
+}
+
+func TestMemoryErrors(t *testing.T) {
+	defer ResetMemoryBackends()
+
+	_, goodVol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	defer goodVol.DeleteVolume()
+	if err = goodVol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+
+	config := &BackendConfig{TargetURI: MemoryBackendPrefix + "://errors"}
+	b := &MemoryBackend{}
+	if err = b.Init(context.Background(), config); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	if err = b.Upload(context.Background(), goodVol); err != nil {
+		t.Fatalf("Expected nil error uploading the volume, got %v", err)
+	}
+
+	failing := &MemoryBackend{}
+	if err = failing.Init(context.Background(), config, WithMemoryErrors(map[string]error{goodVol.ObjectName: errTest, "manifests": errTest})); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	testCases := []struct {
+		operation func() error
+		errTest   errTestFunc
+	}{
+		{func() error { return failing.Upload(context.Background(), goodVol) }, errTestErrTest},
+		{func() error { _, err := failing.Download(context.Background(), goodVol.ObjectName); return err }, errTestErrTest},
+		{func() error {
+			_, err := failing.DownloadRange(context.Background(), goodVol.ObjectName, 0, 1)
+			return err
+		}, errTestErrTest},
+		{func() error { return failing.Delete(context.Background(), goodVol.ObjectName) }, errTestErrTest},
+		{func() error { return failing.Copy(context.Background(), goodVol.ObjectName, "copy") }, errTestErrTest},
+		{func() error { return failing.Copy(context.Background(), "copy", goodVol.ObjectName) }, errTestErrTest},
+		{func() error { return b.Copy(context.Background(), goodVol.ObjectName, "copy") }, nilErrTest},
+		{func() error { _, err := failing.Download(context.Background(), "copy"); return err }, nilErrTest},
+		{func() error { _, err := failing.List(context.Background(), "manifests"); return err }, errTestErrTest},
+		{func() error { _, err := failing.List(context.Background(), ""); return err }, nilErrTest},
+		// Only the backend the errors were injected into fails
+		{func() error { _, err := b.Download(context.Background(), goodVol.ObjectName); return err }, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		if err := c.operation(); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+	}
+}
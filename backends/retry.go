@@ -0,0 +1,245 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// retryInit will run the provided connectivity check of a backend's Init, retrying it with backoff for up to
+// the InitRetryTime of the provided config while it fails with an error the provided function deems transient,
+// e.g. the object store being briefly unreachable when a scheduled backup starts. Any other error, such as
+// invalid credentials or a missing bucket, is returned right away.
+func retryInit(ctx context.Context, conf *BackendConfig, prefix string, check func() error, transient func(error) bool) error {
+	if conf.InitRetryTime <= 0 {
+		return check()
+	}
+
+	be := backoff.NewExponentialBackOff()
+	if conf.MaxBackoffTime > 0 {
+		be.MaxInterval = conf.MaxBackoffTime
+	}
+	be.MaxElapsedTime = conf.InitRetryTime
+
+	operation := func() error {
+		err := check()
+		if err != nil && transient(err) && ctx.Err() == nil {
+			helpers.AppLogger.Warningf("%s backend: could not reach %s, will retry - %v", prefix, conf.TargetURI, err)
+			return err
+		} else if err != nil {
+			return backoff.Permanent(err)
+		}
+		return nil
+	}
+
+	return backoff.Retry(operation, backoff.WithContext(be, ctx))
+}
+
+// retryRequest will run the provided backend API call with a context that is canceled if the call has not returned
+// within the RequestTimeout of the provided config, so a single stuck call fails fast instead of hanging the whole
+// operation. Calls that timed out are retried with backoff for up to the MaxRetryTime of the config, or the default of
+// the backoff if not set, while the provided context is not done. Any other error is returned right away. A
+// RequestTimeout of 0 or less runs the call without a timeout.
+func retryRequest(ctx context.Context, conf *BackendConfig, prefix, op string, call func(ctx context.Context) error) error {
+	if conf.RequestTimeout <= 0 {
+		return call(ctx)
+	}
+
+	operation := func() error {
+		cancel, timedOut, err := timeRequest(ctx, conf.RequestTimeout, call)
+		cancel()
+		if timedOut && err == nil {
+			// The call returned just as it timed out, nothing was left to cancel
+			return nil
+		}
+		return checkRequestTimeout(ctx, conf, prefix, op, timedOut, err)
+	}
+
+	return backoff.Retry(operation, requestBackOff(ctx, conf))
+}
+
+// retryDownload is like retryRequest for calls returning a reader of an object. The timeout only applies until the call
+// returns so reading the object is not cut short, the context of the call is only canceled once the reader is closed.
+func retryDownload(ctx context.Context, conf *BackendConfig, prefix, op string, call func(ctx context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if conf.RequestTimeout <= 0 {
+		return call(ctx)
+	}
+
+	var r io.ReadCloser
+	operation := func() error {
+		var rc io.ReadCloser
+		cancel, timedOut, err := timeRequest(ctx, conf.RequestTimeout, func(ctx context.Context) error {
+			var cerr error
+			rc, cerr = call(ctx)
+			return cerr
+		})
+		if timedOut || err != nil {
+			if rc != nil {
+				rc.Close()
+			}
+			cancel()
+			return checkRequestTimeout(ctx, conf, prefix, op, timedOut, err)
+		}
+		r = &cancelReadCloser{ReadCloser: rc, cancel: cancel}
+		return nil
+	}
+
+	if err := backoff.Retry(operation, requestBackOff(ctx, conf)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// timeRequest will run the provided call with a context that is canceled once the provided timeout passes before the
+// call returned, reporting whether it did. The returned cancel function must be called once done with the result of the call.
+func timeRequest(ctx context.Context, timeout time.Duration, call func(ctx context.Context) error) (context.CancelFunc, bool, error) {
+	rctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	err := call(rctx)
+	return cancel, !timer.Stop(), err
+}
+
+// checkRequestTimeout will return the error of a call that timed out so it is retried, and any other error as permanent.
+func checkRequestTimeout(ctx context.Context, conf *BackendConfig, prefix, op string, timedOut bool, err error) error {
+	if timedOut && ctx.Err() == nil {
+		helpers.AppLogger.Warningf("%s backend: %s did not complete within %v, will retry - %v", prefix, op, conf.RequestTimeout, err)
+		return fmt.Errorf("%w: %s (%v)", ErrRequestTimeout, op, conf.RequestTimeout)
+	} else if err != nil {
+		return backoff.Permanent(err)
+	}
+	return nil
+}
+
+func requestBackOff(ctx context.Context, conf *BackendConfig) backoff.BackOff {
+	be := backoff.NewExponentialBackOff()
+	if conf.MaxBackoffTime > 0 {
+		be.MaxInterval = conf.MaxBackoffTime
+	}
+	if conf.MaxRetryTime > 0 {
+		be.MaxElapsedTime = conf.MaxRetryTime
+	}
+	return backoff.WithContext(be, ctx)
+}
+
+// cancelReadCloser will cancel the context of the request it reads the response of once closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// isTransientError will check whether the provided error is due to a network failure or the server being
+// unavailable or throttling requests, as opposed to e.g. the request being denied, so it is worth retrying.
+func isTransientError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *url.Error:
+			// Implements net.Error but wraps errors such as the request being canceled
+			err = e.Err
+			continue
+		case net.Error:
+			return true
+		case interface{ StatusCode() int }:
+			return isTransientStatus(e.StatusCode())
+		case interface{ Response() *http.Response }:
+			return e.Response() != nil && isTransientStatus(e.Response().StatusCode)
+		}
+
+		switch e := err.(type) {
+		case interface{ OrigErr() error }:
+			err = e.OrigErr()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return err == io.ErrUnexpectedEOF
+		}
+	}
+
+	return false
+}
+
+// authErrorCodes are the error codes object stores such as S3 reply with when they reject the credentials of a request.
+var authErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"NoCredentialProviders": true,
+	"AuthenticationFailed":  true,
+}
+
+// IsAuthError will check whether the provided error is due to a destination rejecting the credentials it was accessed
+// with, or no credentials being found, as opposed to e.g. a network failure.
+func IsAuthError(err error) bool {
+	for err != nil {
+		if err == ErrSSHNoKeyFile || strings.Contains(err.Error(), "ssh: unable to authenticate") {
+			return true
+		}
+		if e, ok := err.(interface{ Code() string }); ok && authErrorCodes[e.Code()] {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ StatusCode() int }:
+			return isAuthStatus(e.StatusCode())
+		case interface{ Response() *http.Response }:
+			return e.Response() != nil && isAuthStatus(e.Response().StatusCode)
+		}
+
+		switch e := err.(type) {
+		case interface{ OrigErr() error }:
+			err = e.OrigErr()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+func isAuthStatus(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
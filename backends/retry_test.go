@@ -0,0 +1,259 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type statusError int
+
+func (s statusError) Error() string   { return fmt.Sprintf("status %d", int(s)) }
+func (s statusError) StatusCode() int { return int(s) }
+
+func TestIsTransientError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	testCases := []struct {
+		err       error
+		transient bool
+	}{
+		{refused, true},
+		{&net.DNSError{Err: "server misbehaving", Name: "bucket.example.com", IsTemporary: true}, true},
+		{&url.Error{Op: "Get", URL: "https://bucket.example.com", Err: refused}, true},
+		{&url.Error{Op: "Get", URL: "https://bucket.example.com", Err: context.Canceled}, false},
+		{errors.Wrap(refused, "failed to list"), true},
+		{io.ErrUnexpectedEOF, true},
+		{statusError(http.StatusServiceUnavailable), true},
+		{statusError(http.StatusTooManyRequests), true},
+		{statusError(http.StatusForbidden), false},
+		{statusError(http.StatusNotFound), false},
+		{errTest, false},
+		{nil, false},
+	}
+
+	for idx, c := range testCases {
+		if transient := isTransientError(c.err); transient != c.transient {
+			t.Errorf("%d: expected %v to be transient %v, got %v", idx, c.err, c.transient, transient)
+		}
+	}
+}
+
+type codeError string
+
+func (c codeError) Error() string { return "code " + string(c) }
+func (c codeError) Code() string  { return string(c) }
+
+func TestIsAuthError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		auth bool
+	}{
+		{statusError(http.StatusForbidden), true},
+		{statusError(http.StatusUnauthorized), true},
+		{errors.Wrap(statusError(http.StatusForbidden), "failed to upload"), true},
+		{fmt.Errorf("could not list: %w", codeError("InvalidAccessKeyId")), true},
+		{codeError("NoCredentialProviders"), true},
+		{ErrSSHNoKeyFile, true},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), true},
+		{codeError("NoSuchBucket"), false},
+		{statusError(http.StatusServiceUnavailable), false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, false},
+		{errTest, false},
+		{nil, false},
+	}
+
+	for idx, c := range testCases {
+		if auth := IsAuthError(c.err); auth != c.auth {
+			t.Errorf("%d: expected %v to be an auth error %v, got %v", idx, c.err, c.auth, auth)
+		}
+	}
+}
+
+func TestRetryInit(t *testing.T) {
+	transientErr := statusError(http.StatusServiceUnavailable)
+	deniedErr := statusError(http.StatusForbidden)
+
+	testCases := []struct {
+		retryTime time.Duration
+		failures  []error
+		errTest   errTestFunc
+		calls     int
+	}{
+		// A transient failure at startup succeeds on retry
+		{time.Minute, []error{transientErr, transientErr}, nilErrTest, 3},
+		// Denied requests are not retried
+		{time.Minute, []error{deniedErr}, func(e error) bool { return e == deniedErr }, 1},
+		{time.Minute, []error{transientErr, deniedErr}, func(e error) bool { return e == deniedErr }, 2},
+		// Retries are disabled
+		{0, []error{transientErr}, func(e error) bool { return e == transientErr }, 1},
+		{time.Minute, nil, nilErrTest, 1},
+	}
+
+	for idx, c := range testCases {
+		conf := &BackendConfig{TargetURI: "mem://init", MaxBackoffTime: 10 * time.Millisecond, InitRetryTime: c.retryTime}
+		calls := 0
+		err := retryInit(context.Background(), conf, MemoryBackendPrefix, func() error {
+			calls++
+			if calls <= len(c.failures) {
+				return c.failures[calls-1]
+			}
+			return nil
+		}, isTransientError)
+		if !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if calls != c.calls {
+			t.Errorf("%d: expected %d connectivity checks, got %d", idx, c.calls, calls)
+		}
+	}
+
+	// Retries stop once the retry time elapsed or the context is cancelled
+	conf := &BackendConfig{TargetURI: "mem://init", MaxBackoffTime: 10 * time.Millisecond, InitRetryTime: 100 * time.Millisecond}
+	start := time.Now()
+	if err := retryInit(context.Background(), conf, MemoryBackendPrefix, func() error { return transientErr }, isTransientError); err != transientErr {
+		t.Errorf("expected %v once the retry time elapsed, got %v", transientErr, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected retries to stop after the retry time, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conf.InitRetryTime = time.Hour
+	calls := 0
+	err := retryInit(ctx, conf, MemoryBackendPrefix, func() error {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return transientErr
+	}, isTransientError)
+	if err == nil || calls != 2 {
+		t.Errorf("expected retries to stop once cancelled after 2 checks, got %d checks and error %v", calls, err)
+	}
+}
+
+// slowCall returns a call that blocks until its context is done for the first stalls calls, and then succeeds.
+func slowCall(stalls int, calls *int) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		*calls++
+		if *calls <= stalls {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+}
+
+func TestRetryRequest(t *testing.T) {
+	testCases := []struct {
+		retryTime time.Duration
+		stalls    int
+		errTest   errTestFunc
+		calls     int
+	}{
+		// A stuck call is timed out and retried
+		{time.Minute, 0, nilErrTest, 1},
+		{time.Minute, 1, nilErrTest, 2},
+		{time.Minute, 3, nilErrTest, 4},
+		// The retries are given up on once the retry time elapsed
+		{500 * time.Millisecond, 1000, func(e error) bool { return errors.Is(e, ErrRequestTimeout) }, -1},
+	}
+
+	for idx, c := range testCases {
+		conf := &BackendConfig{RequestTimeout: 20 * time.Millisecond, MaxBackoffTime: time.Millisecond, MaxRetryTime: c.retryTime}
+		calls := 0
+		err := retryRequest(context.Background(), conf, MemoryBackendPrefix, "list", slowCall(c.stalls, &calls))
+		if !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if c.calls >= 0 && calls != c.calls {
+			t.Errorf("%d: expected %d calls, got %d", idx, c.calls, calls)
+		}
+	}
+
+	// Other errors are not retried
+	calls := 0
+	conf := &BackendConfig{RequestTimeout: time.Minute, MaxBackoffTime: time.Millisecond}
+	if err := retryRequest(context.Background(), conf, MemoryBackendPrefix, "delete", func(ctx context.Context) error {
+		calls++
+		return errTest
+	}); err != errTest || calls != 1 {
+		t.Errorf("expected %v after a single call, got %v after %d calls", errTest, err, calls)
+	}
+
+	// Without a request timeout a call is only stopped by its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	calls = 0
+	conf = &BackendConfig{}
+	if err := retryRequest(ctx, conf, MemoryBackendPrefix, "list", slowCall(1, &calls)); err != context.DeadlineExceeded || calls != 1 {
+		t.Errorf("expected the call to run until its context is done, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryDownload(t *testing.T) {
+	conf := &BackendConfig{RequestTimeout: 20 * time.Millisecond, MaxBackoffTime: time.Millisecond, MaxRetryTime: time.Minute}
+	calls := 0
+	var lastCtx context.Context
+	r, err := retryDownload(context.Background(), conf, MemoryBackendPrefix, "download", func(ctx context.Context) (io.ReadCloser, error) {
+		lastCtx = ctx
+		if err := slowCall(2, &calls)(ctx); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader("payload")), nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected the download to succeed after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	// Reading the object is not subject to the request timeout, only closing the reader ends the request
+	time.Sleep(2 * conf.RequestTimeout)
+	if lastCtx.Err() != nil {
+		t.Errorf("expected the request to still be active while reading, got %v", lastCtx.Err())
+	}
+	if b, rerr := ioutil.ReadAll(r); rerr != nil || string(b) != "payload" {
+		t.Errorf("expected to read the payload, got %q - %v", b, rerr)
+	}
+	r.Close()
+	if lastCtx.Err() == nil {
+		t.Errorf("expected the request to be canceled once the reader was closed")
+	}
+
+	calls = 0
+	if _, err = retryDownload(context.Background(), conf, MemoryBackendPrefix, "download", func(ctx context.Context) (io.ReadCloser, error) {
+		calls++
+		return nil, errTest
+	}); err != errTest || calls != 1 {
+		t.Errorf("expected %v after a single call, got %v after %d calls", errTest, err, calls)
+	}
+}
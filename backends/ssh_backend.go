@@ -0,0 +1,325 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// SSHBackendPrefix is the URI prefix used for the SSHBackend.
+const SSHBackendPrefix = "ssh"
+
+// ErrSSHNoKeyFile is returned when the SSH backend is used without a private key to authenticate with.
+var ErrSSHNoKeyFile = errors.New("ssh backend: the SSH_KEY_FILE environmental variable must be set to the path of a private key")
+
+// SSHBackend provides an on-prem destination storage option, storing volumes as files under a directory of a remote
+// host over SFTP. Up to MaxParallelUploads SFTP channels are opened over the same SSH connection so parallel
+// uploads do not share a single channel's flow control window.
+type SSHBackend struct {
+	conf       *BackendConfig
+	sshClient  *ssh.Client
+	clients    []*sftp.Client
+	pool       chan *sftp.Client
+	remotePath string
+}
+
+// Init will initialize the SSHBackend and verify the provided URI is valid and the remote directory exists.
+func (s *SSHBackend) Init(ctx context.Context, conf *BackendConfig, opts ...Option) error {
+	s.conf = conf
+
+	if !strings.HasPrefix(s.conf.TargetURI, SSHBackendPrefix+"://") {
+		return ErrInvalidURI
+	}
+
+	u, err := url.Parse(s.conf.TargetURI)
+	if err != nil || u.Host == "" {
+		return ErrInvalidURI
+	}
+	s.remotePath = path.Clean("/" + u.Path)
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	sshConf, err := s.clientConfig(u)
+	if err != nil {
+		return err
+	}
+
+	for _, opt := range opts {
+		opt.Apply(s)
+	}
+
+	return retryInit(ctx, conf, SSHBackendPrefix, func() error {
+		s.Close()
+		if err := s.connect(ctx, address, sshConf); err != nil {
+			return err
+		}
+
+		fi, err := s.clients[0].Stat(s.remotePath)
+		if err != nil {
+			helpers.AppLogger.Errorf("ssh backend: Error while verifying path %s - %v", s.remotePath, err)
+			return err
+		}
+		if !fi.IsDir() {
+			helpers.AppLogger.Errorf("ssh backend: Provided path is not a directory!")
+			return ErrInvalidURI
+		}
+		return nil
+	}, isTransientError)
+}
+
+// clientConfig will build the SSH client configuration, authenticating with the private key found at SSH_KEY_FILE
+// and verifying the host key against SSH_KNOWN_HOSTS, or ~/.ssh/known_hosts if not set.
+func (s *SSHBackend) clientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+
+	keyFile := os.Getenv("SSH_KEY_FILE")
+	if keyFile == "" {
+		return nil, ErrSSHNoKeyFile
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		helpers.AppLogger.Errorf("ssh backend: Could not read the private key %s - %v", keyFile, err)
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if passphrase := os.Getenv("SSH_KEY_PASSPHRASE"); passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		helpers.AppLogger.Errorf("ssh backend: Could not parse the private key %s - %v", keyFile, err)
+		return nil, err
+	}
+
+	knownHostsFile := os.Getenv("SSH_KNOWN_HOSTS")
+	if knownHostsFile == "" {
+		home, herr := os.UserHomeDir()
+		if herr != nil {
+			return nil, herr
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		helpers.AppLogger.Errorf("ssh backend: Could not read the known hosts file %s - %v", knownHostsFile, err)
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// connect will open the SSH connection and an SFTP channel for each parallel upload.
+func (s *SSHBackend) connect(ctx context.Context, address string, sshConf *ssh.ClientConfig) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, sshConf)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.sshClient = ssh.NewClient(c, chans, reqs)
+
+	channels := s.conf.MaxParallelUploads
+	if channels < 1 {
+		channels = 1
+	}
+
+	s.pool = make(chan *sftp.Client, channels)
+	for i := 0; i < channels; i++ {
+		client, err := sftp.NewClient(s.sshClient)
+		if err != nil {
+			return err
+		}
+		s.clients = append(s.clients, client)
+		s.pool <- client
+	}
+
+	return nil
+}
+
+// Upload will stream the provided VolumeInfo to a file under the configured remote directory. The volume is written
+// to a temporary file first so an interrupted upload never leaves a partial file under the volume's name.
+func (s *SSHBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	s.conf.MaxParallelUploadBuffer <- true
+	defer func() {
+		<-s.conf.MaxParallelUploadBuffer
+	}()
+
+	client := <-s.pool
+	defer func() {
+		s.pool <- client
+	}()
+
+	destinationPath := path.Join(s.remotePath, vol.ObjectName)
+	destinationDir := path.Dir(destinationPath)
+	if err := client.MkdirAll(destinationDir); err != nil {
+		helpers.AppLogger.Debugf("ssh backend: Could not create path %s due to error - %v", destinationDir, err)
+		return err
+	}
+
+	tempPath := path.Join(destinationDir, ".upload-"+path.Base(destinationPath))
+	w, err := client.Create(tempPath)
+	if err != nil {
+		helpers.AppLogger.Debugf("ssh backend: Could not create file %s due to error - %v", tempPath, err)
+		return err
+	}
+
+	if _, err = io.Copy(w, vol); err != nil {
+		w.Close()
+		client.Remove(tempPath)
+		helpers.AppLogger.Debugf("ssh backend: Error while uploading volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+	if err = w.Close(); err != nil {
+		client.Remove(tempPath)
+		return err
+	}
+
+	if err = client.PosixRename(tempPath, destinationPath); err != nil {
+		client.Remove(tempPath)
+		helpers.AppLogger.Debugf("ssh backend: Could not rename %s to %s due to error - %v", tempPath, destinationPath, err)
+		return err
+	}
+	return nil
+}
+
+// FreeSpace will return the number of bytes available to unprivileged users on the filesystem of the configured remote
+// directory, or ErrFreeSpaceUnsupported if the SFTP server does not support the statvfs extension.
+func (s *SSHBackend) FreeSpace(ctx context.Context) (uint64, error) {
+	if _, ok := s.clients[0].HasExtension("statvfs@openssh.com"); !ok {
+		return 0, ErrFreeSpaceUnsupported
+	}
+	stat, err := s.clients[0].StatVFS(s.remotePath)
+	if err != nil {
+		helpers.AppLogger.Debugf("ssh backend: Could not get the free space of %s due to error - %v", s.remotePath, err)
+		return 0, err
+	}
+	return stat.Favail * stat.Frsize, nil
+}
+
+// Delete will delete the given object from the configured remote directory
+func (s *SSHBackend) Delete(ctx context.Context, filename string) error {
+	return s.clients[0].Remove(path.Join(s.remotePath, filename))
+}
+
+// PreDownload does nothing on this backend.
+func (s *SSHBackend) PreDownload(ctx context.Context, objects []string) error {
+	return nil
+}
+
+// Download will open the remote file for reading
+func (s *SSHBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return s.clients[0].Open(path.Join(s.remotePath, filename))
+}
+
+// Close will close the SFTP channels and the SSH connection to the remote host.
+func (s *SSHBackend) Close() error {
+	for _, client := range s.clients {
+		client.Close()
+	}
+	s.clients = nil
+
+	var err error
+	if s.sshClient != nil {
+		err = s.sshClient.Close()
+		s.sshClient = nil
+	}
+	return err
+}
+
+// List will return a list of all files matching the provided prefix
+func (s *SSHBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := s.ListDetailed(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
+	}
+
+	return l, nil
+}
+
+// ListDetailed will walk the configured remote directory and return the details of all files matching the provided prefix
+func (s *SSHBackend) ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	l := make([]ObjectInfo, 0, 1000)
+	walker := s.clients[0].Walk(s.remotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+
+		fi := walker.Stat()
+		trimmedPath := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.remotePath), "/")
+		if !fi.IsDir() && strings.HasPrefix(trimmedPath, prefix) && !strings.HasPrefix(path.Base(trimmedPath), ".upload-") {
+			l = append(l, ObjectInfo{
+				Name:         trimmedPath,
+				Size:         fi.Size(),
+				LastModified: fi.ModTime(),
+			})
+		}
+	}
+
+	return l, nil
+}
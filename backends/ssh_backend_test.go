@@ -0,0 +1,332 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSigner(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate a key - %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("could not create a signer - %v", err)
+	}
+	return signer, priv
+}
+
+// startSSHServer will start an in-process SSH server that accepts the provided public key and serves SFTP
+// sessions on the local filesystem. The number of SFTP channels opened is counted in channels.
+func startSSHServer(t *testing.T, hostKey ssh.Signer, authorized ssh.PublicKey, channels *int32) (string, func()) {
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errTest
+		},
+	}
+	conf.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen - %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, conf, channels)
+		}
+	}()
+
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func serveSSHConn(conn net.Conn, conf *ssh.ServerConfig, channels *int32) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				// The payload of a subsystem request is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				atomic.AddInt32(channels, 1)
+				go func() {
+					defer channel.Close()
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					server.Serve()
+				}()
+			}
+		}()
+	}
+}
+
+type sshTest struct {
+	dir       string
+	addr      string
+	channels  int32
+	keyFile   string
+	knownFile string
+	stop      func()
+}
+
+// prepareSSHTest will start an SSH server with a known host key and write the client key and known hosts
+// files the SSH backend is pointed to with the SSH_KEY_FILE and SSH_KNOWN_HOSTS environmental variables.
+func prepareSSHTest(t *testing.T) *sshTest {
+	dir, err := ioutil.TempDir("", "sshbackendtest")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+
+	st := &sshTest{dir: dir}
+	hostKey, _ := newTestSigner(t)
+	clientKey, clientPriv := newTestSigner(t)
+	st.addr, st.stop = startSSHServer(t, hostKey, clientKey.PublicKey(), &st.channels)
+
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatalf("could not marshal the client key - %v", err)
+	}
+	st.keyFile = filepath.Join(dir, "id_ed25519")
+	if err = ioutil.WriteFile(st.keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("could not write the client key - %v", err)
+	}
+
+	st.knownFile = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(st.addr)}, hostKey.PublicKey())
+	if err = ioutil.WriteFile(st.knownFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("could not write the known hosts file - %v", err)
+	}
+
+	if err = os.MkdirAll(filepath.Join(dir, "backups"), os.ModePerm); err != nil {
+		t.Fatalf("could not create the backup directory - %v", err)
+	}
+
+	os.Setenv("SSH_KEY_FILE", st.keyFile)
+	os.Setenv("SSH_KNOWN_HOSTS", st.knownFile)
+	return st
+}
+
+func (st *sshTest) cleanup() {
+	st.stop()
+	os.Unsetenv("SSH_KEY_FILE")
+	os.Unsetenv("SSH_KNOWN_HOSTS")
+	os.RemoveAll(st.dir)
+}
+
+func (st *sshTest) uri() string {
+	return SSHBackendPrefix + "://backup@" + st.addr + filepath.Join(st.dir, "backups")
+}
+
+func TestSSHGetBackendForURI(t *testing.T) {
+	b, err := GetBackendForURI(SSHBackendPrefix + "://user@host/path")
+	if err != nil {
+		t.Errorf("Error while trying to get backend: %v", err)
+	}
+	if _, ok := b.(*SSHBackend); !ok {
+		t.Errorf("Expected to get a backend of type SSHBackend, but did not.")
+	}
+}
+
+func TestSSHInit(t *testing.T) {
+	st := prepareSSHTest(t)
+	defer st.cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(st.dir, "afile"), []byte("test"), 0600); err != nil {
+		t.Fatalf("could not write test file - %v", err)
+	}
+
+	otherHostKey, _ := newTestSigner(t)
+	otherKnownFile := filepath.Join(st.dir, "other_known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(st.addr)}, otherHostKey.PublicKey())
+	if err := ioutil.WriteFile(otherKnownFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("could not write the known hosts file - %v", err)
+	}
+
+	_, otherPriv := newTestSigner(t)
+	block, err := ssh.MarshalPrivateKey(otherPriv, "")
+	if err != nil {
+		t.Fatalf("could not marshal a client key - %v", err)
+	}
+	otherKeyFile := filepath.Join(st.dir, "id_other")
+	if err = ioutil.WriteFile(otherKeyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("could not write a client key - %v", err)
+	}
+
+	testCases := []struct {
+		uri       string
+		keyFile   string
+		knownFile string
+		errTest   errTestFunc
+	}{
+		{st.uri(), st.keyFile, st.knownFile, nilErrTest},
+		{st.uri() + "/missing", st.keyFile, st.knownFile, nonNilErrTest},
+		{SSHBackendPrefix + "://" + st.addr + filepath.Join(st.dir, "afile"), st.keyFile, st.knownFile, errInvalidURIErrTest},
+		{st.uri(), st.keyFile, otherKnownFile, nonNilErrTest},
+		{st.uri(), otherKeyFile, st.knownFile, nonNilErrTest},
+		{st.uri(), "", st.knownFile, func(e error) bool { return e == ErrSSHNoKeyFile }},
+		{"notssh://" + st.addr + "/backups", st.keyFile, st.knownFile, errInvalidURIErrTest},
+	}
+
+	for idx, c := range testCases {
+		os.Setenv("SSH_KEY_FILE", c.keyFile)
+		os.Setenv("SSH_KNOWN_HOSTS", c.knownFile)
+
+		b := &SSHBackend{}
+		if err := b.Init(context.Background(), &BackendConfig{TargetURI: c.uri}); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+		b.Close()
+	}
+}
+
+func TestSSHBackend(t *testing.T) {
+	st := prepareSSHTest(t)
+	defer st.cleanup()
+
+	testPayLoad, goodvol, badvol, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	if err = goodvol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+	goodvol.ObjectName = "sub/dir/" + goodvol.ObjectName
+
+	b := &SSHBackend{}
+	conf := &BackendConfig{
+		TargetURI:               st.uri(),
+		MaxParallelUploads:      3,
+		MaxParallelUploadBuffer: make(chan bool, 3),
+	}
+	if err = b.Init(context.Background(), conf); err != nil {
+		t.Fatalf("error setting up backend - %v", err)
+	}
+	defer b.Close()
+
+	if channels := atomic.LoadInt32(&st.channels); channels != 3 {
+		t.Errorf("Expected 3 SFTP channels to be opened, got %d", channels)
+	}
+
+	if err = b.Upload(context.Background(), goodvol); err != nil {
+		t.Fatalf("Unexpected error uploading the volume, got %v", err)
+	}
+	if err = b.Upload(context.Background(), badvol); err == nil {
+		t.Errorf("Expected an error uploading a deleted volume, got nil")
+	}
+
+	var reporter SpaceReporter = b
+	free, err := reporter.FreeSpace(context.Background())
+	if err != nil {
+		t.Errorf("Unexpected error getting the free space, got %v", err)
+	}
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(st.dir, &stat); err != nil {
+		t.Fatalf("could not stat the filesystem - %v", err)
+	}
+	if total := uint64(stat.Blocks) * uint64(stat.Bsize); free == 0 || free > total {
+		t.Errorf("Expected the free space to be between 0 and the size of the filesystem (%d), got %d", total, free)
+	}
+
+	objects, err := b.ListDetailed(context.Background(), "")
+	if err != nil {
+		t.Errorf("Unexpected error listing, got %v", err)
+	}
+	expected := []ObjectInfo{{Name: goodvol.ObjectName, Size: int64(len(testPayLoad))}}
+	for idx := range objects {
+		objects[idx].LastModified = expected[0].LastModified
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("Expected objects %v, got %v", expected, objects)
+	}
+
+	if list, lerr := b.List(context.Background(), "sub/other"); lerr != nil || len(list) != 0 {
+		t.Errorf("Expected no objects with an unmatched prefix, got %v (error %v)", list, lerr)
+	}
+
+	r, err := b.Download(context.Background(), goodvol.ObjectName)
+	if err != nil {
+		t.Fatalf("Unexpected error downloading the volume, got %v", err)
+	}
+	testRead, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Errorf("could not read from reader - %v", err)
+	}
+	if !reflect.DeepEqual(testPayLoad, testRead) {
+		t.Errorf("read bytes not equal to given bytes")
+	}
+
+	if err = b.Delete(context.Background(), goodvol.ObjectName); err != nil {
+		t.Errorf("Unexpected error deleting the volume, got %v", err)
+	}
+	if _, err = b.Download(context.Background(), goodvol.ObjectName); err == nil {
+		t.Errorf("Expected an error downloading a deleted volume, got nil")
+	}
+	if err = b.Delete(context.Background(), goodvol.ObjectName); err == nil {
+		t.Errorf("Expected an error deleting a missing volume, got nil")
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ncw/swift"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// SwiftBackendPrefix is the URI prefix used for the SwiftBackend.
+const SwiftBackendPrefix = "swift"
+
+// swiftListLimit is the number of objects requested per page when listing a container, it may be overridden for testing.
+var swiftListLimit = 1000
+
+// SwiftBackend integrates with OpenStack Swift object storage, authenticating against Keystone v3. Volumes larger
+// than the UploadChunkSize are uploaded as dynamic large objects (DLO) whose segments are kept in a separate
+// "<container>_segments" container so they do not show up when listing the backup container.
+type SwiftBackend struct {
+	conf             *BackendConfig
+	conn             *swift.Connection
+	mutex            sync.Mutex
+	segmentsCreated  bool
+	prefix           string
+	container        string
+	segmentContainer string
+}
+
+// Init will initialize the SwiftBackend and verify the provided URI is valid/exists.
+func (s *SwiftBackend) Init(ctx context.Context, conf *BackendConfig, opts ...Option) error {
+	s.conf = conf
+
+	cleanPrefix := strings.TrimPrefix(s.conf.TargetURI, SwiftBackendPrefix+"://")
+	if cleanPrefix == s.conf.TargetURI {
+		return ErrInvalidURI
+	}
+
+	uriParts := strings.Split(cleanPrefix, "/")
+
+	s.container = uriParts[0]
+	s.segmentContainer = s.container + "_segments"
+	if len(uriParts) > 1 {
+		s.prefix = strings.Join(uriParts[1:], "/")
+	}
+
+	s.conn = &swift.Connection{
+		AuthUrl:      os.Getenv("OS_AUTH_URL"),
+		UserName:     os.Getenv("OS_USERNAME"),
+		ApiKey:       os.Getenv("OS_PASSWORD"),
+		Tenant:       os.Getenv("OS_PROJECT_NAME"),
+		Region:       os.Getenv("OS_REGION_NAME"),
+		Domain:       os.Getenv("OS_USER_DOMAIN_NAME"),
+		TenantDomain: os.Getenv("OS_PROJECT_DOMAIN_NAME"),
+		AuthVersion:  3,
+		Transport:    newHTTPTransport(conf),
+	}
+	if s.conn.Domain == "" {
+		s.conn.Domain = "Default"
+	}
+
+	for _, opt := range opts {
+		opt.Apply(s)
+	}
+
+	return retryInit(ctx, conf, SwiftBackendPrefix, func() error {
+		if !s.conn.Authenticated() {
+			if err := s.conn.Authenticate(); err != nil {
+				return err
+			}
+		}
+
+		// Ensure the container exists
+		_, _, err := s.conn.Container(s.container)
+		return err
+	}, isSwiftTransientError)
+}
+
+// isSwiftTransientError will check whether the provided error is worth retrying, the swift package reports
+// HTTP failures with the status code as a field rather than a method.
+func isSwiftTransientError(err error) bool {
+	if e, ok := err.(*swift.Error); ok {
+		return isTransientStatus(e.StatusCode)
+	}
+	return isTransientError(err)
+}
+
+// Upload will upload the provided volume to this SwiftBackend's configured container+prefix. Volumes larger than the
+// UploadChunkSize are uploaded as a dynamic large object made of segments of that size.
+func (s *SwiftBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	s.conf.MaxParallelUploadBuffer <- true
+	defer func() {
+		<-s.conf.MaxParallelUploadBuffer
+	}()
+
+	name := s.prefix + vol.ObjectName
+	if !vol.IsUsingPipe() && vol.Size <= uint64(s.conf.UploadChunkSize) {
+		if _, err := s.conn.ObjectPut(s.container, name, vol, true, vol.MD5Sum, "application/octet-stream", nil); err != nil {
+			helpers.AppLogger.Debugf("swift backend: Error while uploading volume %s - %v", vol.ObjectName, err)
+			return err
+		}
+		return nil
+	}
+
+	if err := s.createSegmentContainer(); err != nil {
+		helpers.AppLogger.Debugf("swift backend: Could not create the segment container %s - %v", s.segmentContainer, err)
+		return err
+	}
+
+	w, err := s.conn.DynamicLargeObjectCreate(&swift.LargeObjectOpts{
+		Container:        s.container,
+		ObjectName:       name,
+		CheckHash:        true,
+		ContentType:      "application/octet-stream",
+		ChunkSize:        int64(s.conf.UploadChunkSize),
+		SegmentContainer: s.segmentContainer,
+	})
+	if err != nil {
+		helpers.AppLogger.Debugf("swift backend: Error while starting the upload of volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+
+	if _, err = io.Copy(w, vol); err != nil {
+		helpers.AppLogger.Debugf("swift backend: Error while uploading volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+
+	// Closing the file writes the manifest that ties the segments together
+	if err = w.Close(); err != nil {
+		helpers.AppLogger.Debugf("swift backend: Error while writing the manifest of volume %s - %v", vol.ObjectName, err)
+		return err
+	}
+	return nil
+}
+
+// FreeSpace will return the number of bytes that can still be stored in the account under the quota set in its
+// X-Account-Meta-Quota-Bytes metadata, or ErrFreeSpaceUnsupported if the account has no quota set.
+func (s *SwiftBackend) FreeSpace(ctx context.Context) (uint64, error) {
+	info, headers, err := s.conn.Account()
+	if err != nil {
+		helpers.AppLogger.Debugf("swift backend: Could not get the details of the account due to error - %v", err)
+		return 0, err
+	}
+	quotaHeader, ok := headers["X-Account-Meta-Quota-Bytes"]
+	if !ok {
+		return 0, ErrFreeSpaceUnsupported
+	}
+	quota, err := strconv.ParseInt(quotaHeader, 10, 64)
+	if err != nil {
+		helpers.AppLogger.Debugf("swift backend: Could not parse the quota of the account %q - %v", quotaHeader, err)
+		return 0, err
+	}
+	if info.BytesUsed >= quota {
+		return 0, nil
+	}
+	return uint64(quota - info.BytesUsed), nil
+}
+
+// createSegmentContainer will create the container segments are uploaded to, once per backend.
+func (s *SwiftBackend) createSegmentContainer() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.segmentsCreated {
+		return nil
+	}
+	if err := s.conn.ContainerCreate(s.segmentContainer, nil); err != nil {
+		return err
+	}
+	s.segmentsCreated = true
+	return nil
+}
+
+// Delete will delete the object with the given name from the configured container, along with its segments
+// if it is a dynamic large object.
+func (s *SwiftBackend) Delete(ctx context.Context, name string) error {
+	return s.conn.DynamicLargeObjectDelete(s.container, name)
+}
+
+// PreDownload will do nothing for this backend.
+func (s *SwiftBackend) PreDownload(ctx context.Context, keys []string) error {
+	return nil
+}
+
+// Download will download the requseted object which can be read from the returned io.ReadCloser
+func (s *SwiftBackend) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, _, err := s.conn.ObjectOpen(s.container, name, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close will release any resources used by the Swift backend.
+func (s *SwiftBackend) Close() error {
+	s.conn = nil
+	return nil
+}
+
+// List will iterate through all objects in the configured Swift container, a page at a time, and return
+// a list of object names, filtering by the provided prefix.
+func (s *SwiftBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	var l []string
+	opts := &swift.ObjectsOpts{Prefix: prefix, Limit: swiftListLimit}
+	err := s.conn.ObjectsWalk(s.container, opts, func(opts *swift.ObjectsOpts) (interface{}, error) {
+		names, err := s.conn.ObjectNames(s.container, opts)
+		if err == nil {
+			l = append(l, names...)
+		}
+		return names, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListDetailed will iterate through all objects in the configured Swift container, a page at a time, and return
+// the details of all objects matching the provided prefix.
+func (s *SwiftBackend) ListDetailed(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var l []ObjectInfo
+	opts := &swift.ObjectsOpts{Prefix: prefix, Limit: swiftListLimit}
+	err := s.conn.ObjectsWalk(s.container, opts, func(opts *swift.ObjectsOpts) (interface{}, error) {
+		objects, err := s.conn.Objects(s.container, opts)
+		for _, object := range objects {
+			l = append(l, ObjectInfo{
+				Name:         object.Name,
+				Size:         object.Bytes,
+				LastModified: object.LastModified,
+			})
+		}
+		return objects, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,424 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+const (
+	swiftTestContainer = "backups"
+	swiftTestRegion    = "RegionOne"
+)
+
+// fakeKeystone will serve Keystone v3 password authentication requests in front of the swifttest server, which
+// only supports v1 authentication, returning a catalog that points to its storage URL.
+func fakeKeystone(srv *swifttest.SwiftServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v3/auth/tokens" {
+			http.NotFound(w, r)
+			return
+		}
+
+		var req struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Name     string `json:"name"`
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		v1 := &swift.Connection{
+			AuthUrl:  srv.AuthURL,
+			UserName: req.Auth.Identity.Password.User.Name,
+			ApiKey:   req.Auth.Identity.Password.User.Password,
+		}
+		if err := v1.Authenticate(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var resp struct {
+			Token struct {
+				Catalog []map[string]interface{} `json:"catalog"`
+			} `json:"token"`
+		}
+		resp.Token.Catalog = []map[string]interface{}{{
+			"type": "object-store",
+			"endpoints": []map[string]string{
+				{"interface": "public", "region": swiftTestRegion, "url": v1.StorageUrl},
+			},
+		}}
+
+		w.Header().Set("X-Subject-Token", v1.AuthToken)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&resp)
+	}
+}
+
+// prepareSwiftTest will start a fake Swift server with an empty container and point the OS_* environmental
+// variables to it. The returned function should be called to stop the server.
+func prepareSwiftTest(t *testing.T) (*swift.Connection, *swifttest.SwiftServer, func()) {
+	srv, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatalf("could not start the fake swift server - %v", err)
+	}
+	keystone := httptest.NewServer(fakeKeystone(srv))
+
+	env := map[string]string{
+		"OS_AUTH_URL":     keystone.URL + "/v3",
+		"OS_USERNAME":     swifttest.TEST_ACCOUNT,
+		"OS_PASSWORD":     swifttest.TEST_ACCOUNT,
+		"OS_PROJECT_NAME": "project",
+		"OS_REGION_NAME":  swiftTestRegion,
+	}
+	for k, v := range env {
+		if err = os.Setenv(k, v); err != nil {
+			t.Fatalf("could not set %s - %v", k, err)
+		}
+	}
+
+	conn := &swift.Connection{AuthUrl: srv.AuthURL, UserName: swifttest.TEST_ACCOUNT, ApiKey: swifttest.TEST_ACCOUNT}
+	if err = conn.Authenticate(); err != nil {
+		t.Fatalf("could not authenticate to the fake swift server - %v", err)
+	}
+	if err = conn.ContainerCreate(swiftTestContainer, nil); err != nil {
+		t.Fatalf("could not create the test container - %v", err)
+	}
+
+	return conn, srv, func() {
+		keystone.Close()
+		srv.Close()
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func initSwiftTest(t *testing.T, chunkSize int) *SwiftBackend {
+	b := &SwiftBackend{}
+	conf := &BackendConfig{
+		TargetURI:               SwiftBackendPrefix + "://" + swiftTestContainer + "/prefix/",
+		UploadChunkSize:         chunkSize,
+		MaxParallelUploads:      1,
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := b.Init(context.Background(), conf); err != nil {
+		t.Fatalf("error setting up backend - %v", err)
+	}
+	return b
+}
+
+func TestSwiftGetBackendForURI(t *testing.T) {
+	b, err := GetBackendForURI(SwiftBackendPrefix + "://container_name")
+	if err != nil {
+		t.Errorf("Error while trying to get backend: %v", err)
+	}
+	if _, ok := b.(*SwiftBackend); !ok {
+		t.Errorf("Expected to get a backend of type SwiftBackend, but did not.")
+	}
+}
+
+func TestSwiftInit(t *testing.T) {
+	_, _, cleanup := prepareSwiftTest(t)
+	defer cleanup()
+
+	testCases := []struct {
+		uri      string
+		password string
+		errTest  errTestFunc
+		prefix   string
+	}{
+		{SwiftBackendPrefix + "://" + swiftTestContainer, swifttest.TEST_ACCOUNT, nilErrTest, ""},
+		{SwiftBackendPrefix + "://" + swiftTestContainer + "/some/prefix", swifttest.TEST_ACCOUNT, nilErrTest, "some/prefix"},
+		{SwiftBackendPrefix + "://missing", swifttest.TEST_ACCOUNT, func(e error) bool { return e == swift.ContainerNotFound }, ""},
+		{SwiftBackendPrefix + "://" + swiftTestContainer, "wrong", func(e error) bool { return e == swift.AuthorizationFailed }, ""},
+		{"notswift://" + swiftTestContainer, swifttest.TEST_ACCOUNT, errInvalidURIErrTest, ""},
+	}
+
+	for idx, c := range testCases {
+		if err := os.Setenv("OS_PASSWORD", c.password); err != nil {
+			t.Fatalf("%d: could not set OS_PASSWORD - %v", idx, err)
+		}
+		b := &SwiftBackend{}
+		if err := b.Init(context.Background(), &BackendConfig{TargetURI: c.uri}); !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+		if b.prefix != c.prefix {
+			t.Errorf("%d: Expected prefix %v, got %v", idx, c.prefix, b.prefix)
+		}
+	}
+}
+
+func TestSwiftUpload(t *testing.T) {
+	conn, _, cleanup := prepareSwiftTest(t)
+	defer cleanup()
+
+	testPayLoad, goodvol, badvol, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	if err = goodvol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+
+	testCases := []struct {
+		chunkSize int
+		vol       *helpers.VolumeInfo
+		errTest   errTestFunc
+		segments  int
+	}{
+		{len(testPayLoad), goodvol, nilErrTest, 0},
+		{1024 * 1024, goodvol, nilErrTest, 10},
+		{3 * 1024 * 1024, goodvol, nilErrTest, 4},
+		{len(testPayLoad), badvol, nonNilErrTest, 0},
+	}
+
+	for idx, c := range testCases {
+		b := initSwiftTest(t, c.chunkSize)
+		goodvol.Seek(0, io.SeekStart)
+
+		err := b.Upload(context.Background(), c.vol)
+		if !c.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		name := "prefix/" + c.vol.ObjectName
+		r, err := b.Download(context.Background(), name)
+		if err != nil {
+			t.Errorf("%d: could not download the uploaded volume - %v", idx, err)
+			continue
+		}
+		testRead, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%d: could not read from reader - %v", idx, err)
+		}
+		if !reflect.DeepEqual(testPayLoad, testRead) {
+			t.Errorf("%d: read bytes not equal to given bytes", idx)
+		}
+
+		segments := 0
+		if _, headers, herr := conn.Object(swiftTestContainer, name); herr != nil {
+			t.Errorf("%d: could not get the uploaded object - %v", idx, herr)
+		} else if headers.IsLargeObjectDLO() {
+			_, objs, serr := conn.LargeObjectGetSegments(swiftTestContainer, name)
+			if serr != nil {
+				t.Errorf("%d: could not get the segments of the uploaded object - %v", idx, serr)
+			}
+			segments = len(objs)
+		}
+		if segments != c.segments {
+			t.Errorf("%d: Expected %d segments, got %d", idx, c.segments, segments)
+		}
+	}
+}
+
+func TestSwiftList(t *testing.T) {
+	conn, srv, cleanup := prepareSwiftTest(t)
+	defer cleanup()
+
+	defer func(limit int) { swiftListLimit = limit }(swiftListLimit)
+	swiftListLimit = 2
+
+	// The fake server ignores the limit of container listings, so cut each page short ourselves.
+	pages := 0
+	srv.SetOverride("/v1/AUTH_"+swifttest.TEST_ACCOUNT+"/"+swiftTestContainer, func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+		body := recorder.Body.String()
+		if r.Method == http.MethodGet {
+			pages++
+			if lines := strings.SplitAfter(body, "\n"); len(lines) > swiftListLimit {
+				body = strings.Join(lines[:swiftListLimit], "")
+			}
+		}
+		for k, v := range recorder.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(recorder.Code)
+		io.WriteString(w, body)
+	})
+
+	names := []string{"prefix/a", "prefix/b", "prefix/c", "prefix/d", "prefix/e", "other/f"}
+	for _, name := range names {
+		if err := conn.ObjectPutString(swiftTestContainer, name, name, ""); err != nil {
+			t.Fatalf("could not create object %s - %v", name, err)
+		}
+	}
+
+	b := initSwiftTest(t, 1024)
+	testCases := []struct {
+		prefix string
+		list   []string
+		pages  int
+	}{
+		{"prefix/", names[:5], 3},
+		{"other/", names[5:], 1},
+		{"", []string{"other/f", "prefix/a", "prefix/b", "prefix/c", "prefix/d", "prefix/e"}, 4},
+		{"none/", nil, 1},
+	}
+
+	for idx, c := range testCases {
+		pages = 0
+		list, err := b.List(context.Background(), c.prefix)
+		if err != nil {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+		sort.Strings(list)
+		if !reflect.DeepEqual(list, c.list) {
+			t.Errorf("%d: Expected list %v, got %v", idx, c.list, list)
+		}
+		if pages != c.pages {
+			t.Errorf("%d: Expected the listing to take %d pages, got %d", idx, c.pages, pages)
+		}
+	}
+}
+
+func TestSwiftListDetailed(t *testing.T) {
+	conn, _, cleanup := prepareSwiftTest(t)
+	defer cleanup()
+
+	names := []string{"prefix/a", "prefix/bb", "other/ccc"}
+	for _, name := range names {
+		if err := conn.ObjectPutString(swiftTestContainer, name, name, ""); err != nil {
+			t.Fatalf("could not create object %s - %v", name, err)
+		}
+	}
+
+	b := initSwiftTest(t, 1024)
+	objects, err := b.ListDetailed(context.Background(), "prefix/")
+	if err != nil {
+		t.Fatalf("Unexpected error listing, got %v", err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 objects, got %v", objects)
+	}
+	for idx, object := range objects {
+		if object.Name != names[idx] || object.Size != int64(len(names[idx])) || object.LastModified.IsZero() {
+			t.Errorf("%d: Expected %s of %d bytes with a modification time, got %+v", idx, names[idx], len(names[idx]), object)
+		}
+	}
+}
+
+func TestSwiftFreeSpace(t *testing.T) {
+	conn, _, cleanup := prepareSwiftTest(t)
+	defer cleanup()
+
+	if err := conn.ObjectPutString(swiftTestContainer, "prefix/a", "some data", ""); err != nil {
+		t.Fatalf("could not create object - %v", err)
+	}
+
+	b := initSwiftTest(t, 1024)
+	var reporter SpaceReporter = b
+	if _, err := reporter.FreeSpace(context.Background()); err != ErrFreeSpaceUnsupported {
+		t.Errorf("Expected %v without a quota, got %v", ErrFreeSpaceUnsupported, err)
+	}
+
+	info, _, err := conn.Account()
+	if err != nil {
+		t.Fatalf("could not get the account details - %v", err)
+	}
+	testCases := []struct {
+		quota    int64
+		expected uint64
+	}{
+		{info.BytesUsed + 1024, 1024},
+		{info.BytesUsed, 0},
+		// The account may already be over a quota lowered after the data was stored
+		{0, 0},
+	}
+
+	for idx, c := range testCases {
+		if err = conn.AccountUpdate(swift.Headers{"X-Account-Meta-Quota-Bytes": strconv.FormatInt(c.quota, 10)}); err != nil {
+			t.Fatalf("%d: could not set the quota - %v", idx, err)
+		}
+		free, err := reporter.FreeSpace(context.Background())
+		if err != nil {
+			t.Errorf("%d: Unexpected error getting the free space, got %v", idx, err)
+		}
+		if free != c.expected {
+			t.Errorf("%d: Expected %d bytes free, got %d", idx, c.expected, free)
+		}
+	}
+}
+
+func TestSwiftDelete(t *testing.T) {
+	conn, _, cleanup := prepareSwiftTest(t)
+	defer cleanup()
+
+	_, goodvol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+	if err = goodvol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+
+	b := initSwiftTest(t, 1024*1024)
+	if err = b.Upload(context.Background(), goodvol); err != nil {
+		t.Fatalf("could not upload the volume - %v", err)
+	}
+
+	if err = b.Delete(context.Background(), "prefix/"+goodvol.ObjectName); err != nil {
+		t.Errorf("Unexpected error deleting the volume, got %v", err)
+	}
+	if _, _, err = conn.Object(swiftTestContainer, "prefix/"+goodvol.ObjectName); err != swift.ObjectNotFound {
+		t.Errorf("Expected the manifest to be deleted, got %v", err)
+	}
+	if segments, err := conn.ObjectNamesAll(b.segmentContainer, nil); err != nil || len(segments) != 0 {
+		t.Errorf("Expected the segments to be deleted, got %v (error %v)", segments, err)
+	}
+
+	if err = b.Delete(context.Background(), "prefix/missing"); err != swift.ObjectNotFound {
+		t.Errorf("Expected %v deleting a missing object, got %v", swift.ObjectNotFound, err)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Address families the backends can be restricted to, or prefer, when connecting to their endpoints.
+const (
+	IPFamilyAny        = "any"
+	IPFamilyIPv4       = "ipv4"
+	IPFamilyIPv6       = "ipv6"
+	IPFamilyPreferIPv4 = "prefer-ipv4"
+	IPFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// ErrInvalidIPFamily is returned when an unknown address family is configured.
+var ErrInvalidIPFamily = fmt.Errorf("invalid address family, expected one of %s, %s, %s, %s, or %s", IPFamilyAny, IPFamilyIPv4, IPFamilyIPv6, IPFamilyPreferIPv4, IPFamilyPreferIPv6)
+
+// ValidateIPFamily will return an error if the provided address family is not one of the supported ones.
+func ValidateIPFamily(family string) error {
+	switch family {
+	case "", IPFamilyAny, IPFamilyIPv4, IPFamilyIPv6, IPFamilyPreferIPv4, IPFamilyPreferIPv6:
+		return nil
+	}
+	return ErrInvalidIPFamily
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// withIPFamily will return a dial function that restricts the provided one to the configured address
+// family, or tries the preferred address family first and falls back to the other one.
+func withIPFamily(dial dialFunc, family string) dialFunc {
+	var first, second string
+	switch family {
+	case IPFamilyIPv4:
+		first = "4"
+	case IPFamilyIPv6:
+		first = "6"
+	case IPFamilyPreferIPv4:
+		first, second = "4", "6"
+	case IPFamilyPreferIPv6:
+		first, second = "6", "4"
+	default:
+		return dial
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		// Only the generic networks can be narrowed to an address family
+		if network != "tcp" && network != "udp" {
+			return dial(ctx, network, address)
+		}
+
+		conn, err := dial(ctx, network+first, address)
+		if err == nil || second == "" || ctx.Err() != nil {
+			return conn, err
+		}
+		return dial(ctx, network+second, address)
+	}
+}
+
+// lookupHost is used by the caching resolver to resolve hosts, it may be overridden for testing.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// cachingResolver caches the addresses a host resolves to for a fixed period of time so
+// that parallel requests to the same endpoint do not each trigger a DNS lookup.
+type cachingResolver struct {
+	ttl     time.Duration
+	lookup  func(ctx context.Context, host string) ([]string, error)
+	mutex   sync.Mutex
+	entries map[string]resolverEntry
+}
+
+type resolverEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newCachingResolver(ttl time.Duration, lookup func(ctx context.Context, host string) ([]string, error)) *cachingResolver {
+	return &cachingResolver{
+		ttl:     ttl,
+		lookup:  lookup,
+		entries: make(map[string]resolverEntry),
+	}
+}
+
+// LookupHost will return the cached addresses for the provided host, looking them up if
+// they are not cached or have expired.
+func (r *cachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	entry, ok := r.entries[host]
+	r.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	r.entries[host] = resolverEntry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+	r.mutex.Unlock()
+
+	return addrs, nil
+}
+
+// dialContext will return a dial function that resolves hosts using this resolver before
+// dialing with the provided dialer, trying each address until one succeeds.
+func (r *cachingResolver) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fmt.Errorf("no addresses found for host %s", host)
+		for _, addr := range addrs {
+			conn, derr := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if derr == nil {
+				return conn, nil
+			}
+			err = derr
+		}
+
+		return nil, err
+	}
+}
+
+// newHTTPTransport will return an HTTP transport that keeps connections alive so they are reused across
+// parallel requests. DNS lookups are cached, connections per host are limited, and connections are restricted
+// to an address family if configured to do so. Requests, including each part of an upload, fail once their
+// response has not started within the configured request timeout, so the client retries them.
+func newHTTPTransport(conf *BackendConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if conf.DNSCacheTTL > 0 {
+		transport.DialContext = newCachingResolver(conf.DNSCacheTTL, lookupHost).dialContext(dialer)
+	}
+	transport.DialContext = withIPFamily(transport.DialContext, conf.IPFamily)
+
+	if conf.RequestTimeout > 0 {
+		transport.ResponseHeaderTimeout = conf.RequestTimeout
+	}
+
+	if conf.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = conf.MaxConnsPerHost
+		transport.MaxIdleConnsPerHost = conf.MaxConnsPerHost
+	}
+
+	return transport
+}
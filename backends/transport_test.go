@@ -0,0 +1,272 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingResolver(t *testing.T) {
+	lookups := 0
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		if host == "bad.host" {
+			return nil, errTest
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+
+	r := newCachingResolver(50*time.Millisecond, lookup)
+
+	testCases := []struct {
+		host    string
+		sleep   time.Duration
+		errTest errTestFunc
+		lookups int
+	}{
+		{"good.host", 0, nilErrTest, 1},
+		{"good.host", 0, nilErrTest, 1},
+		{"other.host", 0, nilErrTest, 2},
+		{"good.host", 100 * time.Millisecond, nilErrTest, 3},
+		{"bad.host", 0, errTestErrTest, 4},
+		{"bad.host", 0, errTestErrTest, 5},
+	}
+
+	for idx, c := range testCases {
+		time.Sleep(c.sleep)
+		if _, err := r.LookupHost(context.Background(), c.host); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if lookups != c.lookups {
+			t.Errorf("%d: Expected %d lookups, got %d", idx, c.lookups, lookups)
+		}
+	}
+}
+
+func startTestListener(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen on a local port - %v", err)
+	}
+	go func() {
+		for {
+			conn, aerr := listener.Accept()
+			if aerr != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return listener, port
+}
+
+func TestCachingResolverDial(t *testing.T) {
+	listener, port := startTestListener(t)
+	defer listener.Close()
+
+	lookups := 0
+	r := newCachingResolver(time.Minute, func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, nil
+	})
+	dial := r.dialContext(&net.Dialer{Timeout: time.Second})
+
+	for i := 0; i < 3; i++ {
+		conn, derr := dial(context.Background(), "tcp", net.JoinHostPort("endpoint.invalid", port))
+		if derr != nil {
+			t.Fatalf("%d: could not dial through the caching resolver - %v", i, derr)
+		}
+		conn.Close()
+	}
+
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup for repeated dials, got %d", lookups)
+	}
+}
+
+func TestNewHTTPTransport(t *testing.T) {
+	listener, port := startTestListener(t)
+	defer listener.Close()
+
+	// Only the caching resolver knows how to resolve this host
+	origLookupHost := lookupHost
+	defer func() { lookupHost = origLookupHost }()
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"127.0.0.1"}, nil
+	}
+
+	testCases := []struct {
+		conf            *BackendConfig
+		cachingDialer   bool
+		maxConnsPerHost int
+	}{
+		{&BackendConfig{}, false, 0},
+		{&BackendConfig{DNSCacheTTL: time.Minute}, true, 0},
+		{&BackendConfig{MaxConnsPerHost: 16}, false, 16},
+		{&BackendConfig{DNSCacheTTL: time.Minute, MaxConnsPerHost: 16}, true, 16},
+	}
+
+	for idx, c := range testCases {
+		transport := newHTTPTransport(c.conf)
+		conn, err := transport.DialContext(context.Background(), "tcp", net.JoinHostPort("endpoint.invalid", port))
+		if c.cachingDialer && err != nil {
+			t.Errorf("%d: Expected the caching dialer to be installed, got %v", idx, err)
+		} else if !c.cachingDialer && err == nil {
+			t.Errorf("%d: Did not expect the caching dialer to be installed", idx)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if transport.MaxConnsPerHost != c.maxConnsPerHost || transport.MaxIdleConnsPerHost != c.maxConnsPerHost {
+			t.Errorf("%d: Expected max connections per host of %d, got %d (%d idle)", idx, c.maxConnsPerHost, transport.MaxConnsPerHost, transport.MaxIdleConnsPerHost)
+		}
+		if transport.IdleConnTimeout == 0 {
+			t.Errorf("%d: Expected idle connections to be kept alive", idx)
+		}
+	}
+}
+
+func TestWithIPFamily(t *testing.T) {
+	testCases := []struct {
+		family   string
+		network  string
+		failing  map[string]bool
+		networks []string
+		errTest  errTestFunc
+	}{
+		{IPFamilyAny, "tcp", nil, []string{"tcp"}, nilErrTest},
+		{"", "tcp", nil, []string{"tcp"}, nilErrTest},
+		{IPFamilyIPv4, "tcp", nil, []string{"tcp4"}, nilErrTest},
+		{IPFamilyIPv6, "tcp", nil, []string{"tcp6"}, nilErrTest},
+		{IPFamilyIPv4, "tcp", map[string]bool{"tcp4": true}, []string{"tcp4"}, errTestErrTest},
+		{IPFamilyPreferIPv4, "tcp", nil, []string{"tcp4"}, nilErrTest},
+		{IPFamilyPreferIPv4, "tcp", map[string]bool{"tcp4": true}, []string{"tcp4", "tcp6"}, nilErrTest},
+		{IPFamilyPreferIPv6, "tcp", map[string]bool{"tcp6": true}, []string{"tcp6", "tcp4"}, nilErrTest},
+		{IPFamilyPreferIPv6, "tcp", map[string]bool{"tcp6": true, "tcp4": true}, []string{"tcp6", "tcp4"}, errTestErrTest},
+		// Networks already restricted to an address family are left as-is
+		{IPFamilyIPv6, "tcp4", nil, []string{"tcp4"}, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		var networks []string
+		dial := withIPFamily(func(ctx context.Context, network, address string) (net.Conn, error) {
+			networks = append(networks, network)
+			if c.failing[network] {
+				return nil, errTest
+			}
+			return nil, nil
+		}, c.family)
+
+		if _, err := dial(context.Background(), c.network, "endpoint.invalid:443"); !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error, got %v instead", idx, err)
+		}
+		if !reflect.DeepEqual(networks, c.networks) {
+			t.Errorf("%d: Expected the dialer to use the networks %v, got %v", idx, c.networks, networks)
+		}
+	}
+}
+
+func TestNewHTTPTransportIPFamily(t *testing.T) {
+	listener, port := startTestListener(t)
+	defer listener.Close()
+
+	testCases := []struct {
+		family  string
+		errTest errTestFunc
+	}{
+		{IPFamilyAny, nilErrTest},
+		{IPFamilyIPv4, nilErrTest},
+		{IPFamilyIPv6, nonNilErrTest},
+		{IPFamilyPreferIPv4, nilErrTest},
+		{IPFamilyPreferIPv6, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		transport := newHTTPTransport(&BackendConfig{IPFamily: c.family})
+		conn, err := transport.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+		if !c.errTest(err) {
+			t.Errorf("%d: Did not get expected error dialing an IPv4 listener with the %s address family, got %v instead", idx, c.family, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestValidateIPFamily(t *testing.T) {
+	testCases := []struct {
+		family string
+		err    error
+	}{
+		{"", nil},
+		{IPFamilyAny, nil},
+		{IPFamilyIPv4, nil},
+		{IPFamilyPreferIPv6, nil},
+		{"ipv5", ErrInvalidIPFamily},
+		{"IPv4", ErrInvalidIPFamily},
+	}
+
+	for idx, c := range testCases {
+		if err := ValidateIPFamily(c.family); err != c.err {
+			t.Errorf("%d: Expected error %v, got %v", idx, c.err, err)
+		}
+	}
+}
+
+func TestNewHTTPTransportRequestTimeout(t *testing.T) {
+	// The first request stalls before responding
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newHTTPTransport(&BackendConfig{RequestTimeout: 50 * time.Millisecond})}
+	start := time.Now()
+	if _, err := client.Get(server.URL); err == nil || !isTransientError(err) {
+		t.Errorf("expected the stalled request to time out with a transient error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("expected the stalled request to fail fast, took %v", elapsed)
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the next request to succeed, got %v", err)
+	}
+	resp.Body.Close()
+
+	if transport := newHTTPTransport(&BackendConfig{}); transport.ResponseHeaderTimeout != 0 {
+		t.Errorf("expected no request timeout by default, got %v", transport.ResponseHeaderTimeout)
+	}
+}
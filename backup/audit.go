@@ -0,0 +1,46 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// recordAuditEvent will record the provided event in the audit log. The operation itself is not failed when it
+// cannot be recorded.
+func recordAuditEvent(e *helpers.AuditEvent) {
+	if err := helpers.RecordAuditEvent(e); err != nil {
+		helpers.AppLogger.Errorf("Could not record the %s of %s in the audit log %s due to error - %v", e.Operation, e.Target, helpers.AuditLogPath, err)
+	}
+}
+
+// restoreTarget will return where the backup sets of the provided JobInfo are restored to, as recorded in the audit log.
+func restoreTarget(j *helpers.JobInfo) string {
+	switch {
+	case j.OutputFile != "":
+		return j.OutputFile
+	case j.SSHHost != "":
+		return j.SSHHost + ":" + j.ReceiveTarget()
+	default:
+		return j.ReceiveTarget()
+	}
+}
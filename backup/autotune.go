@@ -0,0 +1,233 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// tuneImprovement is the relative throughput improvement over the best throughput seen so far
+// required to keep ramping up the number of parallel uploads.
+const tuneImprovement = 0.05
+
+// parallelismTuner is an AIMD controller for the number of parallel uploads. It ramps up by one
+// upload at a time while throughput improves, reverts the last step once throughput plateaus, and
+// halves the number of parallel uploads when uploads fail (e.g. due to throttling).
+type parallelismTuner struct {
+	min, max int
+	limit    int
+	// best is the best throughput observed since the last decrease
+	best float64
+	// increased is true when the last decision was to ramp up
+	increased bool
+}
+
+func newParallelismTuner(min, max int) *parallelismTuner {
+	return &parallelismTuner{min: min, max: max, limit: min}
+}
+
+// observe will return the number of parallel uploads to use given the throughput, in bytes per
+// second, and the number of failed upload attempts observed over the last window of uploads.
+func (t *parallelismTuner) observe(throughput float64, failures int) int {
+	switch {
+	case failures > 0:
+		t.limit /= 2
+		if t.limit < t.min {
+			t.limit = t.min
+		}
+		// Throughput observed at the previous limit no longer applies
+		t.best = 0
+		t.increased = false
+	case throughput > t.best*(1+tuneImprovement):
+		t.best = throughput
+		t.increased = t.limit < t.max
+		if t.increased {
+			t.limit++
+		}
+	case t.increased:
+		// The last increase did not help, settle on the previous limit
+		t.limit--
+		t.increased = false
+	}
+
+	return t.limit
+}
+
+// uploadLimiter bounds the number of concurrent uploads to the limit of its tuner, feeding it
+// the throughput and failures observed over each window of completed uploads.
+type uploadLimiter struct {
+	prefix string
+	tuner  *parallelismTuner
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	active int
+
+	// The current window of uploads
+	windowStart time.Time
+	completed   int
+	bytes       uint64
+	failures    int
+}
+
+func newUploadLimiter(ctx context.Context, prefix string, tuner *parallelismTuner) *uploadLimiter {
+	l := &uploadLimiter{prefix: prefix, tuner: tuner, windowStart: time.Now()}
+	l.cond = sync.NewCond(&l.mutex)
+
+	// Wake up any waiting uploads once cancelled
+	go func() {
+		<-ctx.Done()
+		l.mutex.Lock()
+		l.cond.Broadcast()
+		l.mutex.Unlock()
+	}()
+
+	return l
+}
+
+// acquire will block until an upload may start under the current limit.
+func (l *uploadLimiter) acquire(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.active >= l.tuner.limit && ctx.Err() == nil {
+		l.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.active++
+	return nil
+}
+
+// failed will record a failed upload attempt.
+func (l *uploadLimiter) failed() {
+	l.mutex.Lock()
+	l.failures++
+	l.mutex.Unlock()
+}
+
+// release will record a completed upload of the provided size and adjust the limit once a window
+// of as many uploads as the current limit has completed.
+func (l *uploadLimiter) release(size uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	l.completed++
+	l.bytes += size
+
+	if l.completed >= l.tuner.limit {
+		elapsed := time.Since(l.windowStart).Seconds()
+		throughput := float64(l.bytes) / elapsed
+		previous := l.tuner.limit
+		if limit := l.tuner.observe(throughput, l.failures); limit != previous {
+			helpers.AppLogger.Infof("%s backend: Changing the number of parallel uploads from %d to %d (%s/s with %d failed attempts).", l.prefix, previous, limit, humanize.IBytes(uint64(throughput)), l.failures)
+		}
+		l.windowStart, l.completed, l.bytes, l.failures = time.Now(), 0, 0, 0
+	}
+	l.cond.Broadcast()
+}
+
+// limit will return the current number of parallel uploads allowed.
+func (l *uploadLimiter) limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.tuner.limit
+}
+
+const (
+	// compressionHeadroom is how much faster than the uploads volumes must be compressed before
+	// the compression level is raised.
+	compressionHeadroom = 2.0
+	// uploadRateWeight is the weight given to the latest upload when averaging the upload throughput.
+	uploadRateWeight = 0.3
+)
+
+// nextCompressionLevel will return the compression level to use for the next volume given the rate,
+// in compressed bytes per second, the last volume was compressed at and the rate volumes are uploaded at.
+// The level is lowered when compression cannot keep up with the uploads and raised when it is so
+// much faster that the uploads can afford better compression, within the provided bounds.
+func nextCompressionLevel(level, min, max int, compressRate, uploadRate float64) int {
+	switch {
+	case compressRate <= 0 || uploadRate <= 0:
+		// Nothing to compare against yet
+	case compressRate < uploadRate && level > min:
+		level--
+	case compressRate > uploadRate*compressionHeadroom && level < max:
+		level++
+	}
+
+	return level
+}
+
+// compressionLevelTuner adapts the compression level of each volume to the rate volumes are uploaded at.
+type compressionLevelTuner struct {
+	min, max int
+	// parallel is the number of volumes uploaded at a time
+	parallel int
+
+	mutex sync.Mutex
+	level int
+	// uploadRate is the moving average of the upload throughput of a single volume
+	uploadRate float64
+}
+
+func newCompressionLevelTuner(j *helpers.JobInfo) *compressionLevelTuner {
+	return &compressionLevelTuner{min: j.MinCompressionLevel, max: j.MaxCompressionLevel, parallel: j.MaxParallelUploads, level: j.CompressionLevel}
+}
+
+// recordUpload will record a volume of the provided size being uploaded in the provided time.
+func (t *compressionLevelTuner) recordUpload(size uint64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.uploadRate == 0 {
+		t.uploadRate = rate
+	} else {
+		t.uploadRate = uploadRateWeight*rate + (1-uploadRateWeight)*t.uploadRate
+	}
+}
+
+// observe will return the compression level to use for the next volume given the rate, in compressed
+// bytes per second, the last volume was compressed at.
+func (t *compressionLevelTuner) observe(compressRate float64) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Volumes are uploaded in parallel, compression has to keep up with all of them
+	uploadRate := t.uploadRate * float64(t.parallel)
+	previous := t.level
+	t.level = nextCompressionLevel(t.level, t.min, t.max, compressRate, uploadRate)
+	if t.level != previous {
+		helpers.AppLogger.Infof("Changing the compression level from %d to %d (compressing at %s/s, uploading at %s/s).", previous, t.level, humanize.IBytes(uint64(compressRate)), humanize.IBytes(uint64(uploadRate)))
+	}
+
+	return t.level
+}
@@ -21,8 +21,10 @@
 package backup
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -38,7 +40,8 @@ import (
 	"github.com/cenkalti/backoff"
 	"github.com/dustin/go-humanize"
 	"github.com/miolini/datacounter"
-	"github.com/nightlyone/lockfile"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/kietdlam/zfsbackup-go/backends"
@@ -48,15 +51,17 @@ import (
 )
 
 var (
-	ErrNoOp       = errors.New("nothing new to sync")
-	manifestmutex sync.Mutex
+	ErrNoOp = errors.New("nothing new to sync")
+	// ErrTooManyFailures is returned when a multi-dataset run is aborted because too many of its datasets failed.
+	ErrTooManyFailures = errors.New("too many datasets failed to backup, aborting the remaining datasets")
+	manifestmutex      sync.Mutex
 )
 
 // ProcessSmartOptions will compute the snapshots to use
 func ProcessSmartOptions(ctx context.Context, jobInfo *helpers.JobInfo) error {
 	snapshots, err := helpers.GetSnapshots(context.Background(), jobInfo.VolumeName)
 	if err != nil {
-		return err
+		return zfsError("list snapshots", jobInfo.VolumeName, err)
 	}
 	jobInfo.BaseSnapshot = snapshots[0]
 	if jobInfo.Full {
@@ -65,11 +70,15 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *helpers.JobInfo) error {
 	}
 	lastComparableSnapshots := make([]*helpers.SnapshotInfo, len(jobInfo.Destinations))
 	lastBackup := make([]*helpers.SnapshotInfo, len(jobInfo.Destinations))
+	var chainBackups []*helpers.JobInfo
 	for idx := range jobInfo.Destinations {
 		destBackups, derr := getBackupsForTarget(ctx, jobInfo.VolumeName, jobInfo.Destinations[idx], jobInfo)
 		if derr != nil {
 			return derr
 		}
+		if idx == 0 {
+			chainBackups = destBackups
+		}
 		if len(destBackups) == 0 {
 			continue
 		}
@@ -107,7 +116,14 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *helpers.JobInfo) error {
 		if lastComparableSnapshots[0].Equal(&snapshots[0]) {
 			return ErrNoOp
 		}
+		if chainBackups[0].RawSend != jobInfo.RawSend {
+			return fmt.Errorf("the last backup set of %s was sent with raw set to %v, an incremental backup must be sent the same way to be received on top of it - try doing a full backup instead", jobInfo.VolumeName, chainBackups[0].RawSend)
+		}
 		jobInfo.IncrementalSnapshot = *lastComparableSnapshots[0]
+		if err = selectIncrementalBookmark(ctx, jobInfo); err != nil {
+			return err
+		}
+		return jobInfo.CheckSnapshotChain(snapshotChain(jobInfo, chainBackups))
 	}
 
 	if jobInfo.FullIfOlderThan != -1*time.Minute {
@@ -129,6 +145,10 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *helpers.JobInfo) error {
 		if lastBackup[0].Equal(&snapshots[0]) {
 			return ErrNoOp
 		}
+		if chainBackups[0].RawSend != jobInfo.RawSend {
+			helpers.AppLogger.Infof("Last backup set was sent with raw set to %v, which an incremental backup cannot be received on top of, performing full backup.", chainBackups[0].RawSend)
+			return nil
+		}
 
 		if ok, verr := validateSnapShotExists(ctx, lastComparableSnapshots[0], jobInfo.VolumeName); verr != nil {
 			return verr
@@ -137,10 +157,41 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *helpers.JobInfo) error {
 			return nil
 		}
 		jobInfo.IncrementalSnapshot = *lastBackup[0]
+		if err = selectIncrementalBookmark(ctx, jobInfo); err != nil {
+			return err
+		}
+		return jobInfo.CheckSnapshotChain(snapshotChain(jobInfo, chainBackups))
 	}
 	return nil
 }
 
+// snapshotChain will follow the incremental snapshot of the provided job back through the
+// provided backups to the full backup it depends on. The chain is returned oldest first and
+// ends with the job's base snapshot. Backups are linked by snapshot name only since their
+// creation times are what is being checked.
+func snapshotChain(jobInfo *helpers.JobInfo, backups []*helpers.JobInfo) []helpers.SnapshotInfo {
+	byName := make(map[string]*helpers.JobInfo, len(backups))
+	for _, bkp := range backups {
+		if _, ok := byName[bkp.BaseSnapshot.Name]; !ok {
+			byName[bkp.BaseSnapshot.Name] = bkp
+		}
+	}
+
+	chain := []helpers.SnapshotInfo{jobInfo.BaseSnapshot}
+	visited := make(map[string]bool)
+	for current := jobInfo.IncrementalSnapshot; current.Name != "" && !visited[current.Name]; {
+		visited[current.Name] = true
+		chain = append([]helpers.SnapshotInfo{current}, chain...)
+		bkp, ok := byName[current.Name]
+		if !ok {
+			break
+		}
+		current = bkp.IncrementalSnapshot
+	}
+
+	return chain
+}
+
 // Will list all backups found in the target destination
 func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *helpers.JobInfo) ([]*helpers.JobInfo, error) {
 	// Prepare the backend client
@@ -175,6 +226,12 @@ func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *he
 		if strings.Compare(decodedManifest.VolumeName, volume) == 0 {
 			decodedManifests = append(decodedManifests, decodedManifest)
 		}
+		// The members of a grouped backup are only recorded in the group's manifest, which is named after the group
+		for _, member := range decodedManifest.GroupMembers {
+			if strings.Compare(member.VolumeName, volume) == 0 {
+				decodedManifests = append(decodedManifests, member)
+			}
+		}
 	}
 
 	sort.SliceStable(decodedManifests, func(i, j int) bool {
@@ -185,29 +242,104 @@ func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *he
 
 // Backup will initiate a backup with the provided configuration.
 func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, span := helpers.StartSpan(pctx, "backup",
+		attribute.String("zfs.dataset", jobInfo.VolumeName),
+		attribute.String("zfs.snapshot", jobInfo.BaseSnapshot.Name),
+		attribute.String("zfs.incremental", jobInfo.IncrementalSnapshot.Name),
+		attribute.StringSlice("zfsbackup.destinations", jobInfo.Destinations),
+	)
+	destinations := append([]string(nil), jobInfo.Destinations...)
+
+	// Nothing would be in the backup set but the stream's headers, leave the chain to increment from the same snapshot next time
+	if isUnchanged(ctx, jobInfo) {
+		jobInfo.Unchanged = true
+		if helpers.JSONOutput {
+			var doneOutput = struct {
+				VolumeName          string
+				IncrementalSnapshot string
+				Unchanged           bool
+			}{jobInfo.VolumeName, jobInfo.IncrementalSnapshot.Name, true}
+			if j, jerr := json.Marshal(doneOutput); jerr != nil {
+				helpers.AppLogger.Errorf("could not ouput json due to error - %v", jerr)
+			} else {
+				fmt.Fprintf(helpers.Stdout, "%s", string(j))
+			}
+		} else {
+			fmt.Fprintf(helpers.Stdout, "Done.\n\tNo changes to %s since %s, no backup set was created.\n", jobInfo.VolumeName, jobInfo.IncrementalSnapshot.Name)
+		}
+		helpers.EndSpan(span, nil)
+		return nil
+	}
+
+	helpers.ThrottleUploads(jobInfo.MaxUploadBytesPerSecond)
+	err := runBackup(ctx, jobInfo)
+	if err == ErrSnapshotChanged && jobInfo.OnSnapshotChange == helpers.SnapshotChangeRestart && restartBackup(ctx, jobInfo, destinations) {
+		err = runBackup(ctx, jobInfo)
+	}
+	if !jobInfo.DryRun {
+		recordAuditEvent(helpers.NewAuditEvent(helpers.AuditBackup, jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, strings.Join(destinations, ","), jobInfo.TotalBytesWritten(), err))
+	}
+	span.SetAttributes(
+		attribute.Int64("zfsbackup.stream_bytes", int64(jobInfo.ZFSStreamBytes)),
+		attribute.Int64("zfsbackup.bytes_written", int64(jobInfo.TotalBytesWritten())),
+		attribute.Int("zfsbackup.volumes", len(jobInfo.Volumes)),
+	)
+	helpers.EndSpan(span, err)
+
+	return err
+}
+
+func runBackup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
-	if jobInfo.Resume {
+	// Nothing is sent, uploaded or recorded during a dry run, no lock is needed to estimate the send stream
+	if jobInfo.DryRun {
+		return dryRun(ctx, jobInfo)
+	}
+
+	// Make sure nobody else is backing up the same dataset to the same destinations we are!
+	lockFilePath := runLockPath(jobInfo)
+	lock, waited, lerr := acquireRunLock(ctx, lockFilePath, jobInfo.WaitForLock)
+	if lerr == ErrAlreadyRunning {
+		helpers.AppLogger.Errorf("Another execution of %s is already backing up %s to the same destinations (lock file %s), use --waitForLock to wait for it to finish instead.", helpers.ProgramName, jobInfo.VolumeName, lockFilePath)
+		return lerr
+	} else if lerr != nil {
+		helpers.AppLogger.Errorf("Cannot lock %s, reason: %v", lockFilePath, lerr)
+		return lerr
+	}
+	defer lock.release()
+
+	// The other execution may have already backed up what the "smart" option picked for this one
+	if waited && !jobInfo.Resume && jobInfo.StartAtVolume == 0 && (jobInfo.Incremental || jobInfo.FullIfOlderThan != -1*time.Minute) {
+		if err := ProcessSmartOptions(ctx, jobInfo); err != nil {
+			if err == ErrNoOp {
+				helpers.AppLogger.Noticef("Nothing new to backup for %s after waiting for the other execution to finish.", jobInfo.VolumeName)
+			}
+			return err
+		}
+	}
+
+	if jobInfo.Resume || jobInfo.StartAtVolume > 0 {
 		if err := tryResume(ctx, jobInfo); err != nil {
 			return err
 		}
 	}
 
-	// Make sure nobody else is working on the same volume/dataset we are!
-	lockFilePath := filepath.Join(os.TempDir(), fmt.Sprintf("zfsbackup.%x.lck", md5.Sum([]byte(jobInfo.VolumeName))))
-	lock, lferr := lockfile.New(lockFilePath)
-	if lferr != nil {
-		helpers.AppLogger.Errorf("Cannot init lock. reason: %v", lferr)
-		return lferr
+	if jobInfo.StartAtVolume > 0 {
+		if err := startAtVolume(ctx, jobInfo); err != nil {
+			return err
+		}
+	}
+
+	if !jobInfo.SingleObject && jobInfo.SingleObjectBelow > 0 {
+		selectSingleObject(ctx, jobInfo)
 	}
-	lferr = lock.TryLock()
 
-	if lferr != nil {
-		helpers.AppLogger.Errorf("Cannot lock %q, reason: %v. If no other execution of %s is working on %s, you may forcefully remove the lock file located %s.", lock, lferr, helpers.ProgramName, jobInfo.VolumeName, lockFilePath)
-		return lferr
+	if jobInfo.ExpireAfter > 0 {
+		expiresAt := jobInfo.StartTime.Add(jobInfo.ExpireAfter)
+		jobInfo.ExpiresAt = &expiresAt
 	}
-	defer lock.Unlock()
 
 	fileBufferSize := jobInfo.MaxFileBuffer
 	if fileBufferSize == 0 {
@@ -223,7 +355,15 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		return fmt.Errorf("selected base snapshot does not exist")
 	}
 
-	if jobInfo.IncrementalSnapshot.Name != "" {
+	if jobInfo.IncrementalBookmark != "" {
+		if ok, verr := validateBookmarkExists(ctx, jobInfo); verr != nil {
+			helpers.AppLogger.Errorf("Cannot validate if selected incremental bookmark exists due to error - %v", verr)
+			return verr
+		} else if !ok {
+			helpers.AppLogger.Errorf("Selected incremental bookmark does not exist or was not created from %s!", jobInfo.IncrementalSnapshot.Name)
+			return fmt.Errorf("selected incremental bookmark does not exist")
+		}
+	} else if jobInfo.IncrementalSnapshot.Name != "" {
 		if ok, verr := validateSnapShotExists(ctx, &jobInfo.IncrementalSnapshot, jobInfo.VolumeName); verr != nil {
 			helpers.AppLogger.Errorf("Cannot validate if selected incremental snapshot exists due to error - %v", verr)
 			return verr
@@ -233,6 +373,80 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		}
 	}
 
+	// A raw stream is only encrypted if the dataset is, the volumes are otherwise stored as they are sent
+	if jobInfo.RawSend && jobInfo.EncryptKey == nil {
+		if encrypted, eerr := helpers.IsEncrypted(ctx, jobInfo.VolumeName); eerr != nil {
+			helpers.AppLogger.Warningf("Could not check whether %s is encrypted - %v", jobInfo.VolumeName, eerr)
+		} else if !encrypted {
+			helpers.AppLogger.Warningf("Sending %s raw but it is not encrypted and no key to encrypt it with was provided, its backup set will not be encrypted.", jobInfo.VolumeName)
+		}
+	}
+
+	recordSnapshotGUIDs(ctx, jobInfo)
+
+	if jobInfo.CompressedSend {
+		// The blocks are sent with the compression of the dataset, which the pool restored to must support
+		compression, err := helpers.GetZFSProperty(ctx, "compression", jobInfo.VolumeName)
+		if err != nil {
+			helpers.AppLogger.Warningf("Could not get the compression of %s, restores will assume lz4 - %v", jobInfo.VolumeName, err)
+		}
+		jobInfo.SendCompression = compression
+	}
+
+	if jobInfo.SyncUserProperties {
+		props, err := helpers.GetUserProperties(ctx, jobInfo.VolumeName, jobInfo.UserPropertyNamespaces)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not get the user properties of %s due to error - %v", jobInfo.VolumeName, err)
+			return err
+		}
+		helpers.AppLogger.Debugf("Recording %d user properties of %s in the manifest.", len(props), jobInfo.VolumeName)
+		jobInfo.UserProperties = props
+	}
+
+	if jobInfo.MetadataHook != "" {
+		metadata, err := helpers.RunMetadataHook(ctx, jobInfo.MetadataHook, jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not get the metadata of %s from the metadata hook due to error - %v", jobInfo.VolumeName, err)
+			return err
+		}
+		helpers.AppLogger.Debugf("Recording %d entries from the metadata hook of %s in the manifest.", len(metadata), jobInfo.VolumeName)
+		jobInfo.Metadata = helpers.MergeMetadata(jobInfo.Metadata, metadata)
+	}
+
+	if err := checkScratchSpace(jobInfo); err != nil {
+		return err
+	}
+
+	if jobInfo.CheckDestinationSpace {
+		if err := checkDestinationSpace(ctx, jobInfo); err != nil {
+			return err
+		}
+	}
+
+	if jobInfo.ObjectCountWarning > 0 || jobInfo.MaxObjectCount > 0 {
+		if err := checkDestinationObjectCounts(ctx, jobInfo); err != nil {
+			return err
+		}
+	}
+
+	var sharedVolumes map[string]*helpers.VolumeInfo
+	if jobInfo.DedupVolumes && !canShareVolumes(jobInfo) {
+		helpers.AppLogger.Warningf("Not deduplicating the volumes of %s, encrypted or signed volumes are never identical to volumes already uploaded.", jobInfo.VolumeName)
+	} else if jobInfo.DedupVolumes {
+		var serr error
+		if sharedVolumes, serr = sharedVolumeIndex(ctx, jobInfo); serr != nil {
+			helpers.AppLogger.Errorf("Could not read the volumes uploaded by other backup sets due to error - %v", serr)
+			return serr
+		}
+		helpers.AppLogger.Debugf("Found %d volumes uploaded to all destinations that can be shared.", len(sharedVolumes))
+	}
+
+	var levels *compressionLevelTuner
+	if jobInfo.AdaptiveCompressionLevel && !jobInfo.SingleObject {
+		levels = newCompressionLevelTuner(jobInfo)
+		jobInfo.UploadObserver = levels.recordUpload
+	}
+
 	startCh := make(chan *helpers.VolumeInfo, fileBufferSize) // Sent to ZFS command and meant to be closed when done
 	stepCh := make(chan *helpers.VolumeInfo, fileBufferSize)  // Used as input to first backend, closed when final manifest is sent through
 
@@ -247,6 +461,17 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		fileBuffer <- true
 	}
 
+	// The uploads that did not make the quorum are not part of the pipeline and may outlive it
+	var quorum *quorumUploader
+	if jobInfo.UploadQuorum > 0 {
+		var qerr error
+		if quorum, qerr = prepareQuorumUploader(ctx, jobInfo, uploadBuffer); qerr != nil {
+			return qerr
+		}
+		// Cancel them when the backup fails, before their upload buffer is closed
+		defer quorum.finish(0)
+	}
+
 	var group *errgroup.Group
 	group, ctx = errgroup.WithContext(ctx)
 
@@ -276,19 +501,35 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 
 	// Start the ZFS send stream
 	group.Go(func() error {
-		return sendStream(ctx, jobInfo, startCh, fileBuffer)
+		release := pinWorker(jobInfo.CompressionCPUs, "compression")
+		defer release()
+		return sendStream(ctx, jobInfo, startCh, fileBuffer, levels)
 	})
 
 	var usedBackends []backends.Backend
 	var channels []<-chan *helpers.VolumeInfo
 	channels = append(channels, stepCh)
+	if len(sharedVolumes) > 0 {
+		channels = append(channels, shareVolumesChainer(ctx, stepCh, sharedVolumes))
+	}
 
 	if jobInfo.MaxFileBuffer != 0 {
 		jobInfo.Destinations = append(jobInfo.Destinations, backends.DeleteBackendPrefix+"://")
 	}
 
 	// Prepare backends and setup plumbing
+	if quorum != nil {
+		out, waitgroup := quorum.chain(ctx, channels[len(channels)-1], jobInfo)
+		channels = append(channels, out)
+		usedBackends = append(usedBackends, quorum.backends...)
+		group.Go(waitgroup.Wait)
+	}
+
 	for _, destination := range jobInfo.Destinations {
+		if quorum != nil && destination != backends.DeleteBackendPrefix+"://" {
+			// Uploaded to by the quorum uploader
+			continue
+		}
 		backend, berr := prepareBackend(ctx, jobInfo, destination, uploadBuffer)
 		if berr != nil {
 			helpers.AppLogger.Errorf("Could not initialize backend due to error - %v.", berr)
@@ -322,12 +563,14 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 					jobInfo.Volumes = append(jobInfo.Volumes, vol)
 					manifestmutex.Unlock()
 					// Write a manifest file and save it locally in order to resume later
-					manifestVol, err := saveManifest(ctx, jobInfo, false)
-					if err != nil {
-						return err
-					}
-					if err = manifestVol.DeleteVolume(); err != nil {
-						helpers.AppLogger.Warningf("Error deleting temporary manifest file  - %v", err)
+					if !jobInfo.InGroup {
+						manifestVol, err := saveManifest(ctx, jobInfo, false)
+						if err != nil {
+							return err
+						}
+						if err = manifestVol.DeleteVolume(); err != nil {
+							helpers.AppLogger.Warningf("Error deleting temporary manifest file  - %v", err)
+						}
 					}
 					maniwg.Done()
 				} else {
@@ -349,16 +592,45 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 
 	// Final Manifest Creation
 	group.Go(func() error {
-		// TODO: How to incorporate contexts in this go routine?
-		maniwg.Wait() // Wait until the ZFS send command has completed and all volumes have been uploaded to all backends.
-		helpers.AppLogger.Infof("All volumes dispatched in pipeline, finalizing manifest file.")
+		// Wait until the ZFS send command has completed and all volumes have been uploaded to all backends.
+		dispatched := make(chan struct{})
+		go func() {
+			maniwg.Wait()
+			close(dispatched)
+		}()
+		select {
+		case <-dispatched:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		manifestmutex.Lock()
 		jobInfo.EndTime = time.Now()
 		manifestmutex.Unlock()
+		if jobInfo.InGroup {
+			// The group's manifest will be written once all of its members are backed up
+			helpers.AppLogger.Infof("All volumes dispatched in pipeline.")
+			close(stepCh)
+			return nil
+		}
+		if jobInfo.GenerateRestoreScript {
+			if err := uploadRestoreScript(ctx, jobInfo); err != nil {
+				return err
+			}
+		}
+		if jobInfo.GenerateChecksums {
+			if err := uploadChecksums(ctx, jobInfo); err != nil {
+				return err
+			}
+		}
+		helpers.AppLogger.Infof("All volumes dispatched in pipeline, finalizing manifest file.")
 		manifestVol, err := saveManifest(ctx, jobInfo, true)
 		if err != nil {
 			return err
 		}
+		if err = uploadManifestParts(ctx, jobInfo); err != nil {
+			manifestVol.DeleteVolume()
+			return err
+		}
 		stepCh <- manifestVol
 		close(stepCh)
 		return nil
@@ -366,7 +638,19 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 
 	err := group.Wait() // Wait for ZFS Send to finish, Backends to finish, and Manifest files to be copied/uploaded
 	if err != nil {
-		return err
+		return checkSnapshotsChanged(pctx, jobInfo, err)
+	}
+
+	if !jobInfo.InGroup {
+		if err = uploadManifestMirrors(ctx, jobInfo); err != nil {
+			return err
+		}
+	}
+
+	if quorum != nil {
+		// The manifest was written once the volumes reached the quorum, the remaining uploads only add copies
+		helpers.AppLogger.Debugf("Waiting up to %v for the uploads to the destinations that missed the quorum.", jobInfo.QuorumStragglerTimeout)
+		quorum.finish(jobInfo.QuorumStragglerTimeout)
 	}
 
 	totalWrittenBytes := jobInfo.TotalBytesWritten()
@@ -397,6 +681,234 @@ func Backup(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	return nil
 }
 
+// BackupGroup will backup each member of the provided group, in order, and will only write
+// the group's manifest once every member has been backed up. If any member fails, no manifest
+// is written and the group is not considered backed up, leaving any uploaded volumes to be
+// removed by the clean command.
+func BackupGroup(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	if len(jobInfo.GroupMembers) == 0 {
+		return fmt.Errorf("no datasets provided for group %s", jobInfo.GroupName)
+	}
+
+	// The members are uploaded to the same destinations, the volumes they can share only need to be read once
+	var sharedVolumes map[string]*helpers.VolumeInfo
+	for idx, member := range jobInfo.GroupMembers {
+		helpers.AppLogger.Infof("Backing up %s (%d of %d) as part of group %s.", member.VolumeName, idx+1, len(jobInfo.GroupMembers), jobInfo.GroupName)
+		member.InGroup = true
+		member.SharedVolumes = sharedVolumes
+		if err := Backup(ctx, member); err != nil {
+			helpers.AppLogger.Errorf("Could not backup %s due to error - %v. No manifest will be written for group %s.", member.VolumeName, err, jobInfo.GroupName)
+			return err
+		}
+		jobInfo.ZFSStreamBytes += member.ZFSStreamBytes
+		sharedVolumes = member.SharedVolumes
+	}
+
+	helpers.AppLogger.Infof("All members of group %s were backed up, finalizing manifest file.", jobInfo.GroupName)
+	jobInfo.EndTime = time.Now()
+	if jobInfo.GenerateChecksums {
+		if err := uploadChecksums(ctx, jobInfo); err != nil {
+			return err
+		}
+	}
+	manifestVol, err := saveManifest(ctx, jobInfo, true)
+	if err != nil {
+		return err
+	}
+	defer manifestVol.DeleteVolume()
+
+	if err = uploadManifestParts(ctx, jobInfo); err != nil {
+		return err
+	}
+	for _, destination := range jobInfo.Destinations {
+		if err = uploadManifest(ctx, jobInfo, manifestVol, destination); err != nil {
+			helpers.AppLogger.Errorf("Could not upload manifest for group %s to %s due to error - %v.", jobInfo.GroupName, destination, err)
+			return err
+		}
+	}
+	if err = uploadManifestMirrors(ctx, jobInfo); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(helpers.Stdout, "Done.\n\tGroup: %s\n\tDatasets: %d\n\tElapsed Time: %v\n", jobInfo.GroupName, len(jobInfo.GroupMembers), time.Since(jobInfo.StartTime))
+
+	return nil
+}
+
+// BackupDatasets will backup each of the provided datasets, in order, under their own manifest. A dataset
+// that fails to backup does not stop the remaining datasets from being backed up unless the number of
+// failed datasets crosses the MaxFailures threshold, in which case the run is aborted as a systemic
+// failure and ErrTooManyFailures is returned.
+func BackupDatasets(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	if len(jobInfo.Datasets) == 0 {
+		return errors.New("no datasets provided to backup")
+	}
+
+	var failed, skipped []string
+	var lastErr error
+	failedDatasets := make(map[string]bool)
+	for idx, dataset := range jobInfo.Datasets {
+		helpers.AppLogger.Infof("Backing up %s (%d of %d).", dataset.VolumeName, idx+1, len(jobInfo.Datasets))
+		var err error
+		if dataset.IncrementalSnapshot.Name != "" && failedDatasets[dataset.VolumeName] {
+			// A snapshot list may back up several snapshots of a dataset, later ones may increment from the failed one
+			err = fmt.Errorf("an earlier backup of %s failed", dataset.VolumeName)
+		} else {
+			err = Backup(ctx, dataset)
+		}
+		if err != nil {
+			lastErr = err
+			failed = append(failed, dataset.VolumeName)
+			failedDatasets[dataset.VolumeName] = true
+			if jobInfo.FailureThresholdCrossed(len(failed), len(jobInfo.Datasets)) {
+				helpers.AppLogger.Errorf("Could not backup %s due to error - %v. %d of %d datasets have failed (%s), crossing the max failures threshold of %s, aborting the remaining datasets.", dataset.VolumeName, err, len(failed), len(jobInfo.Datasets), strings.Join(failed, ", "), jobInfo.MaxFailures)
+				return ErrTooManyFailures
+			}
+			helpers.AppLogger.Errorf("Could not backup %s due to error - %v. Continuing with the remaining datasets.", dataset.VolumeName, err)
+			continue
+		}
+		if dataset.Unchanged {
+			skipped = append(skipped, dataset.VolumeName)
+			continue
+		}
+		jobInfo.ZFSStreamBytes += dataset.ZFSStreamBytes
+	}
+
+	if len(failed) == len(jobInfo.Datasets) {
+		helpers.AppLogger.Errorf("All %d datasets failed to backup: %s", len(failed), strings.Join(failed, ", "))
+		return fmt.Errorf("%d of %d datasets failed to backup - %w", len(failed), len(jobInfo.Datasets), lastErr)
+	} else if len(failed) > 0 {
+		helpers.AppLogger.Errorf("%d of %d datasets failed to backup: %s", len(failed), len(jobInfo.Datasets), strings.Join(failed, ", "))
+		return fmt.Errorf("%w, %d of %d datasets failed (%s)", ErrPartialBackup, len(failed), len(jobInfo.Datasets), strings.Join(failed, ", "))
+	}
+
+	// Every dataset was skipped, there was nothing to backup
+	jobInfo.Unchanged = len(skipped) == len(jobInfo.Datasets)
+	if len(skipped) > 0 {
+		fmt.Fprintf(helpers.Stdout, "Done.\n\tDatasets: %d\n\tSkipped (unchanged): %d (%s)\n\tElapsed Time: %v\n", len(jobInfo.Datasets), len(skipped), strings.Join(skipped, ", "), time.Since(jobInfo.StartTime))
+		return nil
+	}
+	fmt.Fprintf(helpers.Stdout, "Done.\n\tDatasets: %d\n\tElapsed Time: %v\n", len(jobInfo.Datasets), time.Since(jobInfo.StartTime))
+
+	return nil
+}
+
+// isUnchanged will return true if the provided dataset should skip unchanged backups and no more than its unchanged
+// threshold was written to the snapshot to backup since the snapshot it increments from. Full backups are never
+// skipped, and datasets are backed up when the amount written cannot be checked.
+func isUnchanged(ctx context.Context, j *helpers.JobInfo) bool {
+	if !j.SkipUnchanged || j.IncrementalSnapshot.Name == "" {
+		return false
+	}
+	if j.IncrementalBookmark != "" {
+		helpers.AppLogger.Debugf("Not checking what was written to %s since %s, it is incremented from the bookmark %s.", j.VolumeName, j.IncrementalSnapshot.Name, j.IncrementalBookmark)
+		return false
+	}
+
+	written, err := helpers.GetWrittenSince(ctx, j.VolumeName, j.BaseSnapshot.Name, j.IncrementalSnapshot.Name)
+	if err != nil {
+		helpers.AppLogger.Warningf("Could not check what was written to %s@%s since %s, backing it up - %v", j.VolumeName, j.BaseSnapshot.Name, j.IncrementalSnapshot.Name, err)
+		return false
+	}
+	if written > j.UnchangedThreshold {
+		helpers.AppLogger.Debugf("%d bytes were written to %s@%s since %s.", written, j.VolumeName, j.BaseSnapshot.Name, j.IncrementalSnapshot.Name)
+		return false
+	}
+
+	helpers.AppLogger.Noticef("Skipping %s as only %d bytes were written to %s since %s, the last snapshot backed up.", j.VolumeName, written, j.BaseSnapshot.Name, j.IncrementalSnapshot.Name)
+	return true
+}
+
+func uploadManifest(ctx context.Context, j *helpers.JobInfo, manifestVol *helpers.VolumeInfo, destination string) error {
+	uploadBuffer := make(chan bool, 1)
+	defer close(uploadBuffer)
+
+	backend, berr := prepareBackend(ctx, j, destination, uploadBuffer)
+	if berr != nil {
+		return berr
+	}
+	defer backend.Close()
+
+	in := make(chan *helpers.VolumeInfo, 1)
+	out, wg := retryUploadChainer(ctx, in, backend, j, destination)
+	in <- manifestVol
+	close(in)
+	<-out
+
+	return wg.Wait()
+}
+
+// uploadRestoreScript will write out and upload the restore script of the backup set to every destination,
+// recording its name in the manifest so it is kept for as long as the backup set is.
+func uploadRestoreScript(ctx context.Context, j *helpers.JobInfo) error {
+	name, err := uploadPlainObject(ctx, j, "restore script", j.RestoreScriptObjectName(), func(w io.Writer, destinations []string) error {
+		return j.WriteRestoreScript(w, destinations)
+	})
+	if err != nil {
+		return err
+	}
+	j.RestoreScript = name
+	return nil
+}
+
+// uploadChecksums will write out and upload the checksums of the volumes of the backup set, as they are stored, to
+// every destination, recording its name in the manifest so it is kept for as long as the backup set is.
+func uploadChecksums(ctx context.Context, j *helpers.JobInfo) error {
+	name, err := uploadPlainObject(ctx, j, "checksums", j.ChecksumsObjectName(), func(w io.Writer, _ []string) error {
+		return j.WriteChecksums(w)
+	})
+	if err != nil {
+		return err
+	}
+	j.Checksums = name
+	return nil
+}
+
+// uploadPlainObject will upload the object written out by the provided function to every destination under the
+// provided name, neither compressed nor encrypted, returning its name once uploaded. The kind of object is used
+// for logging. It is uploaded like a manifest, so it is kept in a storage class it can be read from right away.
+func uploadPlainObject(ctx context.Context, j *helpers.JobInfo, kind, name string, write func(io.Writer, []string) error) (string, error) {
+	var destinations []string
+	for _, destination := range j.Destinations {
+		if destination != backends.DeleteBackendPrefix+"://" {
+			destinations = append(destinations, destination)
+		}
+	}
+
+	manifestmutex.Lock()
+	object, err := helpers.CreateSimpleVolume(ctx, false, "")
+	if err == nil {
+		err = write(object, destinations)
+		if cerr := object.Close(); err == nil {
+			err = cerr
+		}
+	}
+	manifestmutex.Unlock()
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not write %s due to error - %v", kind, err)
+		return "", err
+	}
+	defer object.DeleteVolume()
+	object.ObjectName = name
+	object.IsManifest = true
+
+	for _, destination := range destinations {
+		if err = uploadManifest(ctx, j, object, destination); err != nil {
+			helpers.AppLogger.Errorf("Could not upload %s to %s due to error - %v.", kind, destination, err)
+			return "", err
+		}
+	}
+	helpers.AppLogger.Infof("Uploaded %s %s.", kind, object.ObjectName)
+
+	return object.ObjectName, nil
+}
+
 func saveManifest(ctx context.Context, j *helpers.JobInfo, final bool) (*helpers.VolumeInfo, error) {
 	manifestmutex.Lock()
 	defer manifestmutex.Unlock()
@@ -408,44 +920,79 @@ func saveManifest(ctx context.Context, j *helpers.JobInfo, final bool) (*helpers
 		helpers.AppLogger.Errorf("Error trying to create manifest volume - %v", err)
 		return nil, err
 	}
-	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifest.ObjectName)))
 	manifest.IsFinalManifest = final
-	jsonEnc := json.NewEncoder(manifest)
-	err = jsonEnc.Encode(j)
+	j.MinReaderVersion = j.RequiredReaderVersion()
+	j.CompressionAlgorithm = helpers.CompressorAlgorithm(j.Compressor)
+	if j.MerkleRoot, err = j.ComputeMerkleRoot(); err != nil {
+		// Volumes carried over from older manifests may not have their checksums recorded
+		helpers.AppLogger.Warningf("Could not compute the merkle root of the backup set, the manifest will not record one - %v", err)
+	}
+	format := j.ManifestFormat
+	if format == "" {
+		format = helpers.ManifestFormatJSON
+	}
+	if err = writeManifestParts(ctx, j, manifest.ObjectName, format); err != nil {
+		helpers.AppLogger.Errorf("Could not split the manifest into parts due to error - %v", err)
+		return nil, err
+	}
+	if len(j.ManifestParts) > 0 {
+		// The volumes are recorded in the parts, the manifest only ties them together
+		j.MinReaderVersion = j.RequiredReaderVersion()
+		volumes := j.Volumes
+		j.Volumes = nil
+		err = helpers.EncodeManifest(manifest, j, format)
+		j.Volumes = volumes
+	} else {
+		err = helpers.EncodeManifest(manifest, j, format)
+	}
 	if err != nil {
-		helpers.AppLogger.Errorf("Could not JSON Encode job information due to error - %v", err)
+		helpers.AppLogger.Errorf("Could not encode job information as a %s manifest due to error - %v", format, err)
 		return nil, err
 	}
 	if err = manifest.Close(); err != nil {
 		helpers.AppLogger.Errorf("Could not close manifest volume due to error - %v", err)
 		return nil, err
 	}
+	if err = cacheManifest(j, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// cacheManifest will copy the provided manifest volume, or manifest part, to the local cache of every destination.
+func cacheManifest(j *helpers.JobInfo, manifest *helpers.VolumeInfo) error {
+	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifest.ObjectName)))
 	for _, destination := range j.Destinations {
 		if destination == backends.DeleteBackendPrefix+"://" {
 			continue
 		}
 		safeFolder := fmt.Sprintf("%x", md5.Sum([]byte(destination)))
 		dest := filepath.Join(helpers.WorkingDir, "cache", safeFolder, safeManifestFile)
-		if err = manifest.CopyTo(dest); err != nil {
+		if err := manifest.CopyTo(dest); err != nil {
 			helpers.AppLogger.Warningf("Could not write manifest volume due to error - %v", err)
-			return nil, err
+			return err
 		}
 		helpers.AppLogger.Debugf("Copied manifest to local cache for destination %s.", destination)
 	}
-	return manifest, nil
+	return nil
 }
 
-func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.VolumeInfo, buffer <-chan bool) error {
+func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.VolumeInfo, buffer <-chan bool, levels *compressionLevelTuner) error {
 	var group *errgroup.Group
 	group, ctx = errgroup.WithContext(ctx)
 
 	cmd := helpers.GetZFSSendCommand(ctx, j)
 	cin, cout := io.Pipe()
-	cmd.Stdout = cout
-	cmd.Stderr = os.Stderr
-	counter := datacounter.NewReaderCounter(cin)
+	sent := datacounter.NewWriterCounter(cout)
+	stderr := helpers.NewStderrCapture(os.Stderr)
+	cmd.Stdout = sent
+	cmd.Stderr = stderr
+	stream := bufio.NewReaderSize(cin, helpers.CompressibilityProbeSize)
+	// The whole stream is hashed, including any bytes skipped when resuming, before being split into volumes
+	streamHash := sha256.New()
+	counter := datacounter.NewReaderCounter(io.TeeReader(stream, streamHash))
 	usingPipe := false
-	if j.MaxFileBuffer == 0 {
+	if j.MaxFileBuffer == 0 || j.SingleObject {
 		usingPipe = true
 	}
 
@@ -454,6 +1001,9 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 		defer close(c)
 		var err error
 		var volume *helpers.VolumeInfo
+		// The time spent compressing the current volume, used to adapt the compression level
+		var compressTime time.Duration
+		level := j.CompressionLevel
 		skipBytes, volNum := j.TotalBytesStreamedAndVols()
 		lastTotalBytes = skipBytes
 		for {
@@ -471,25 +1021,38 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 			}
 
 			// Setup next Volume
-			if volume == nil || volume.Counter() >= (j.VolumeSize*humanize.MiByte)-50*humanize.KiByte {
+			if volume == nil || !j.SingleObject && volume.Counter() >= (j.VolumeSize*humanize.MiByte)-50*humanize.KiByte {
 				if volume != nil {
 					helpers.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
 					volume.ZFSStreamBytes = counter.Count() - lastTotalBytes
 					lastTotalBytes = counter.Count()
+					start := time.Now()
 					if err = volume.Close(); err != nil {
 						helpers.AppLogger.Errorf("Error while trying to close volume %s - %v", volume.ObjectName, err)
 						return err
 					}
+					compressTime += time.Since(start)
+					if levels != nil && compressTime > 0 {
+						level = levels.observe(float64(volume.Size) / compressTime.Seconds())
+					}
 					if !usingPipe {
 						c <- volume
 					}
 				}
 				<-buffer
-				volume, err = helpers.CreateBackupVolume(ctx, j, volNum)
+				compressor := j.Compressor
+				if compressor == helpers.AdaptiveCompressor {
+					// Select a codec based on how well the start of this volume compresses
+					sample, _ := stream.Peek(helpers.CompressibilityProbeSize)
+					compressor = helpers.SelectCompressor(sample)
+					helpers.AppLogger.Debugf("Selected the %s codec for volume %d.", compressor, volNum)
+				}
+				volume, err = helpers.CreateBackupVolumeWithLevel(ctx, j, volNum, compressor, level)
 				if err != nil {
 					helpers.AppLogger.Errorf("Error while creating volume %d - %v", volNum, err)
 					return err
 				}
+				compressTime = 0
 				helpers.AppLogger.Debugf("Starting volume %s", volume.ObjectName)
 				volNum++
 				if usingPipe {
@@ -498,7 +1061,9 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 			}
 
 			// Write a little at a time and break the output between volumes as needed
+			start := time.Now()
 			_, ierr := io.CopyN(volume, counter, helpers.BufferSize*2)
+			compressTime += time.Since(start)
 			if ierr == io.EOF {
 				// We are done!
 				helpers.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
@@ -524,12 +1089,22 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 	err := cmd.Start()
 	if err != nil {
 		helpers.AppLogger.Errorf("Error starting zfs command - %v", err)
-		return err
+		return zfsError("zfs send", j.VolumeName, err)
 	}
 
 	group.Go(func() error {
-		defer cout.Close()
-		return cmd.Wait()
+		// The send can only be run again while none of its stream was written, or the stream would be duplicated
+		attempts := 0
+		err := retryZFS(ctx, j, "zfs send", func() error {
+			attempts++
+			if attempts == 1 {
+				return zfsError("zfs send", j.VolumeName, stderr.Wrap(cmd.Wait()))
+			}
+			return runZFSSend(ctx, j, sent)
+		}, func() bool { return sent.Count() == 0 })
+		// A failed send must not end the stream as if it was complete, or its last volume would be uploaded
+		cout.CloseWithError(err)
+		return err
 	})
 
 	defer func() {
@@ -560,6 +1135,7 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 	helpers.AppLogger.Infof("zfs send completed without error")
 	manifestmutex.Lock()
 	j.ZFSStreamBytes = counter.Count()
+	j.StreamSHA256 = fmt.Sprintf("%x", streamHash.Sum(nil))
 	manifestmutex.Unlock()
 	return nil
 }
@@ -619,6 +1195,107 @@ func tryResume(ctx context.Context, j *helpers.JobInfo) error {
 	return nil
 }
 
+// startAtVolume will setup the provided job to start uploading at its StartAtVolume volume number. The
+// volumes before it are taken from the previous attempt's manifest and must be found in every destination.
+func startAtVolume(ctx context.Context, j *helpers.JobInfo) error {
+	helpers.AppLogger.Warningf("Starting the upload at volume %d is an expert option, volumes 1 through %d are trusted to be intact at the destination(s).", j.StartAtVolume, j.StartAtVolume-1)
+
+	volumes, err := volumesBefore(j.Volumes, j.StartAtVolume)
+	if err != nil {
+		helpers.AppLogger.Errorf("Cannot start at volume %d - %v", j.StartAtVolume, err)
+		return err
+	}
+
+	for _, destination := range j.Destinations {
+		backend, berr := prepareBackend(ctx, j, destination, nil)
+		if berr != nil {
+			helpers.AppLogger.Errorf("Could not initialize backend due to error - %v.", berr)
+			return berr
+		}
+		verr := validateVolumesPresent(ctx, backend, volumes)
+		backend.Close()
+		if verr != nil {
+			helpers.AppLogger.Errorf("Cannot start at volume %d for destination %s - %v", j.StartAtVolume, destination, verr)
+			return verr
+		}
+	}
+
+	manifestmutex.Lock()
+	j.Volumes = volumes
+	manifestmutex.Unlock()
+	helpers.AppLogger.Infof("Will be starting the upload at volume %d.", j.StartAtVolume)
+
+	return nil
+}
+
+// volumesBefore will return volumes 1 through start-1, in order, from the provided volumes.
+func volumesBefore(volumes []*helpers.VolumeInfo, start int64) ([]*helpers.VolumeInfo, error) {
+	sorted := make([]*helpers.VolumeInfo, len(volumes))
+	copy(sorted, volumes)
+	sort.Sort(helpers.ByVolumeNumber(sorted))
+
+	before := make([]*helpers.VolumeInfo, 0, start)
+	for _, vol := range sorted {
+		if vol.VolumeNumber >= start {
+			break
+		}
+		if vol.VolumeNumber != int64(len(before)+1) {
+			break
+		}
+		before = append(before, vol)
+	}
+
+	if int64(len(before)) != start-1 {
+		return nil, fmt.Errorf("the previous manifest only records volumes 1 through %d, cannot start at volume %d", len(before), start)
+	}
+
+	return before, nil
+}
+
+// validateVolumesPresent will check that each of the provided volumes can be found in the backend.
+func validateVolumesPresent(ctx context.Context, backend backends.Backend, volumes []*helpers.VolumeInfo) error {
+	for _, vol := range volumes {
+		objects, err := backend.List(ctx, vol.ObjectName)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, obj := range objects {
+			if obj == vol.ObjectName {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("volume %s could not be found", vol.ObjectName)
+		}
+	}
+
+	return nil
+}
+
+// selectSingleObject will stream the backup as a single object instead of splitting it into
+// volumes if the send stream is estimated to be small enough.
+func selectSingleObject(ctx context.Context, j *helpers.JobInfo) {
+	if j.Resume || j.StartAtVolume > 0 || len(j.Destinations) != 1 {
+		helpers.AppLogger.Infof("Will not stream the backup as a single object when resuming or uploading to multiple destinations.")
+		return
+	}
+
+	estimate, err := helpers.GetZFSSendEstimate(ctx, j)
+	if err != nil {
+		helpers.AppLogger.Warningf("Could not estimate the size of the send stream, will split it into volumes - %v", err)
+		return
+	}
+
+	if estimate < j.SingleObjectBelow*humanize.MiByte {
+		helpers.AppLogger.Infof("The send stream is estimated to be %s, will stream it as a single object.", humanize.IBytes(estimate))
+		j.SingleObject = true
+	}
+}
+
 func retryUploadChainer(ctx context.Context, in <-chan *helpers.VolumeInfo, b backends.Backend, j *helpers.JobInfo, dest string) (<-chan *helpers.VolumeInfo, *errgroup.Group) {
 	out := make(chan *helpers.VolumeInfo)
 	parts := strings.Split(dest, "://")
@@ -630,16 +1307,34 @@ func retryUploadChainer(ctx context.Context, in <-chan *helpers.VolumeInfo, b ba
 		gwg = new(errgroup.Group)
 	}
 
+	// Start as many workers as allowed, the limiter decides how many of them may upload at a time
+	var limiter *uploadLimiter
+	if j.AutoTuneUploads && j.MaxParallelUploads > 1 {
+		limiter = newUploadLimiter(ctx, prefix, newParallelismTuner(j.MinParallelUploads, j.MaxParallelUploads))
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(j.MaxParallelUploads)
 	for i := 0; i < j.MaxParallelUploads; i++ {
 		gwg.Go(func() error {
 			defer wg.Done()
-			for vol := range in {
+			release := pinWorker(j.UploadCPUs, prefix+" upload")
+			defer release()
+			for {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				default:
+				case vol, ok := <-in:
+					if !ok {
+						return nil
+					}
+					if isSharedUpload(vol, prefix) {
+						helpers.AppLogger.Debugf("%s backend: Skipping volume %s as it was uploaded by another backup set", prefix, vol.ObjectName)
+						if err := sendVolume(ctx, out, vol); err != nil {
+							return err
+						}
+						continue
+					}
 					helpers.AppLogger.Debugf("%s backend: Processing volume %s", prefix, vol.ObjectName)
 					// Prepare the backoff retryer (forces the user configured retry options across all backends)
 					be := backoff.NewExponentialBackOff()
@@ -647,21 +1342,62 @@ func retryUploadChainer(ctx context.Context, in <-chan *helpers.VolumeInfo, b ba
 					be.MaxElapsedTime = j.MaxRetryTime
 					retryconf := backoff.WithContext(be, ctx)
 
-					operation := volUploadWrapper(ctx, b, vol, prefix)
-					if err := backoff.Retry(operation, retryconf); err != nil {
+					uctx, span := startUploadSpan(ctx, vol, prefix)
+					operation := withUploadDeadline(uctx, j, vol, prefix, func(actx context.Context) func() error {
+						return volUploadWrapper(actx, b, vol, prefix)
+					})
+					if j.VerifyUploads == helpers.VerifyUploadsReadback && prefix != backends.DeleteBackendPrefix {
+						operation = withReadback(uctx, b, vol, prefix, j.HashAlgorithm, operation)
+					}
+					if limiter != nil {
+						if err := limiter.acquire(ctx); err != nil {
+							return err
+						}
+						upload := operation
+						operation = func() error {
+							err := upload()
+							if err != nil {
+								limiter.failed()
+							}
+							return err
+						}
+					}
+					start := time.Now()
+					err := backoff.Retry(countAttempts(operation, span), retryconf)
+					if err == nil && j.UploadObserver != nil && prefix != backends.DeleteBackendPrefix && !vol.IsManifest {
+						j.UploadObserver(vol.Size, time.Since(start))
+					}
+					if limiter != nil {
+						limiter.release(vol.Size)
+					}
+					helpers.EndSpan(span, err)
+					if err != nil {
 						helpers.AppLogger.Errorf("%s backend: Failed to upload volume %s due to error: %v", prefix, vol.ObjectName, err)
-						return err
+						if ctx.Err() != nil {
+							return err
+						}
+						kind := helpers.ErrBackendUnreachable
+						if errors.Is(err, errReadbackMismatch) {
+							kind = helpers.ErrChecksumMismatch
+						} else if backends.IsAuthError(err) {
+							kind = helpers.ErrAuthFailed
+						}
+						return &helpers.OperationError{Op: "upload to " + dest, Dataset: j.VolumeName, Volume: vol.ObjectName, Kind: kind, Err: err}
 					}
 					helpers.AppLogger.Debugf("%s backend: Processed volume %s", prefix, vol.ObjectName)
-					out <- vol
+					if err := sendVolume(ctx, out, vol); err != nil {
+						return err
+					}
 				}
 			}
-			return nil
 		})
 	}
 
 	gwg.Go(func() error {
 		wg.Wait()
+		if limiter != nil {
+			helpers.AppLogger.Noticef("%s backend: Settled on %d parallel uploads.", prefix, limiter.limit())
+		}
 		helpers.AppLogger.Debugf("%s backend: closing out channel.", prefix)
 		close(out)
 		return nil
@@ -670,6 +1406,46 @@ func retryUploadChainer(ctx context.Context, in <-chan *helpers.VolumeInfo, b ba
 	return out, gwg
 }
 
+// pinWorker will pin the calling goroutine to the provided CPUs, if any, continuing unpinned if it cannot be.
+func pinWorker(cpus []int, worker string) func() {
+	release, err := helpers.PinToCPUs(cpus)
+	if err != nil {
+		helpers.AppLogger.Warningf("Could not pin the %s worker to CPUs %v, continuing without - %v", worker, cpus, err)
+	}
+	return release
+}
+
+// sendVolume will pass the provided volume down the pipeline, giving up if the backup was aborted
+// as nothing may be left to receive it.
+func sendVolume(ctx context.Context, out chan<- *helpers.VolumeInfo, vol *helpers.VolumeInfo) error {
+	select {
+	case out <- vol:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startUploadSpan will start a span around the upload of the provided volume to a backend.
+func startUploadSpan(ctx context.Context, vol *helpers.VolumeInfo, prefix string) (context.Context, trace.Span) {
+	return helpers.StartSpan(ctx, "upload",
+		attribute.String("zfsbackup.backend", prefix),
+		attribute.String("zfsbackup.object", vol.ObjectName),
+		attribute.Int64("zfsbackup.volume", vol.VolumeNumber),
+		attribute.Int64("zfsbackup.bytes", int64(vol.Size)),
+	)
+}
+
+// countAttempts will record the number of times the provided operation was attempted on the span.
+func countAttempts(operation backoff.Operation, span trace.Span) backoff.Operation {
+	var attempts int
+	return func() error {
+		attempts++
+		span.SetAttributes(attribute.Int("zfsbackup.attempts", attempts))
+		return operation()
+	}
+}
+
 func volUploadWrapper(ctx context.Context, b backends.Backend, vol *helpers.VolumeInfo, prefix string) func() error {
 	return func() error {
 		if err := vol.OpenVolume(); err != nil {
@@ -23,15 +23,41 @@ package backup
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+
 	"github.com/kietdlam/zfsbackup-go/backends"
 	"github.com/kietdlam/zfsbackup-go/helpers"
 	//"../backends"
@@ -69,6 +95,101 @@ func (m *mockBackend) Download(ctx context.Context, filename string) (io.ReadClo
 
 func (m *mockBackend) Delete(ctx context.Context, filename string) error { return nil }
 
+// A backend that can report object details and keeps track of what was downloaded
+type mockDetailedBackend struct {
+	mockBackend
+	objects    []backends.ObjectInfo
+	downloaded []string
+}
+
+func (m *mockDetailedBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	objects, _ := m.ListDetailed(ctx, prefix)
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = objects[idx].Name
+	}
+	return l, nil
+}
+
+func (m *mockDetailedBackend) ListDetailed(ctx context.Context, prefix string) ([]backends.ObjectInfo, error) {
+	var objects []backends.ObjectInfo
+	for _, obj := range m.objects {
+		if strings.HasPrefix(obj.Name, prefix) {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+func (m *mockDetailedBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	m.downloaded = append(m.downloaded, filename)
+	return ioutil.NopCloser(bytes.NewBufferString(filename)), nil
+}
+
+// A backend that keeps track of how many bytes were requested through ranged downloads
+type mockRangeBackend struct {
+	backends.Backend
+	requested int64
+}
+
+func (m *mockRangeBackend) DownloadRange(ctx context.Context, filename string, offset, length int64) (io.ReadCloser, error) {
+	m.requested += length
+	return m.Backend.(backends.RangeDownloader).DownloadRange(ctx, filename, offset, length)
+}
+
+// A backend deleting objects in batches, failing the objects in failures that many times first, or always when negative
+type mockBatchDeleteBackend struct {
+	backends.Backend
+	batchSize int
+
+	mutex       sync.Mutex
+	deleted     map[string]bool
+	failures    map[string]int
+	batches     []int
+	inFlight    int
+	maxInFlight int
+}
+
+func (m *mockBatchDeleteBackend) MaxDeleteBatchSize() int {
+	return m.batchSize
+}
+
+func (m *mockBatchDeleteBackend) DeleteBatch(ctx context.Context, filenames []string) (map[string]error, error) {
+	m.mutex.Lock()
+	m.batches = append(m.batches, len(filenames))
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	m.mutex.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.inFlight--
+	errs := make(map[string]error)
+	for _, name := range filenames {
+		switch {
+		case name == "retained":
+			errs[name] = backends.ErrObjectRetained
+		case m.failures[name] != 0:
+			if m.failures[name] > 0 {
+				m.failures[name]--
+			}
+			errs[name] = errTest
+		default:
+			m.deleted[name] = true
+		}
+	}
+	return errs, nil
+}
+
+func (m *mockBatchDeleteBackend) Delete(ctx context.Context, filename string) error {
+	errs, _ := m.DeleteBatch(ctx, []string{filename})
+	return errs[filename]
+}
+
 type errTestFunc func(error) bool
 
 func nilErrTest(e error) bool              { return e == nil }
@@ -97,7 +218,7 @@ func TestRetryUploadChainer(t *testing.T) {
 		},
 		{
 			vol:   badVol,
-			valid: os.IsNotExist,
+			valid: func(e error) bool { return errors.Is(e, os.ErrNotExist) && errors.Is(e, helpers.ErrBackendUnreachable) },
 		},
 	}
 
@@ -135,7 +256,7 @@ func prepareTestVols() (payload []byte, goodVol *helpers.VolumeInfo, badVol *hel
 		return
 	}
 	reader := bytes.NewReader(payload)
-	goodVol, err = helpers.CreateSimpleVolume(context.Background(), false)
+	goodVol, err = helpers.CreateSimpleVolume(context.Background(), false, "")
 	if err != nil {
 		return
 	}
@@ -148,7 +269,7 @@ func prepareTestVols() (payload []byte, goodVol *helpers.VolumeInfo, badVol *hel
 		return
 	}
 
-	badVol, err = helpers.CreateSimpleVolume(context.Background(), false)
+	badVol, err = helpers.CreateSimpleVolume(context.Background(), false, "")
 	if err != nil {
 		return
 	}
@@ -161,3 +282,6260 @@ func prepareTestVols() (payload []byte, goodVol *helpers.VolumeInfo, badVol *hel
 
 	return
 }
+
+func TestSelectManifests(t *testing.T) {
+	now := time.Now()
+	objects := []backends.ObjectInfo{
+		{Name: "manifests|b", LastModified: now.Add(-2 * time.Hour)},
+		{Name: "manifests|d", LastModified: now.Add(-96 * time.Hour)},
+		{Name: "manifests|a", LastModified: now.Add(-1 * time.Hour)},
+		{Name: "manifests|c", LastModified: now.Add(-48 * time.Hour)},
+	}
+
+	testCases := []struct {
+		limit     int
+		newerThan time.Duration
+		selected  []string
+		skipped   []string
+	}{
+		{0, 0, []string{"manifests|a", "manifests|b", "manifests|c", "manifests|d"}, nil},
+		{2, 0, []string{"manifests|a", "manifests|b"}, []string{"manifests|c", "manifests|d"}},
+		{10, 0, []string{"manifests|a", "manifests|b", "manifests|c", "manifests|d"}, nil},
+		{0, 72 * time.Hour, []string{"manifests|a", "manifests|b", "manifests|c"}, []string{"manifests|d"}},
+		{1, 72 * time.Hour, []string{"manifests|a"}, []string{"manifests|b", "manifests|c", "manifests|d"}},
+		{0, time.Minute, nil, []string{"manifests|a", "manifests|b", "manifests|c", "manifests|d"}},
+	}
+
+	names := func(objs []backends.ObjectInfo) []string {
+		var l []string
+		for _, obj := range objs {
+			l = append(l, obj.Name)
+		}
+		return l
+	}
+
+	for idx, c := range testCases {
+		selected, skipped := selectManifests(objects, c.limit, c.newerThan, now)
+		if got := names(selected); !reflect.DeepEqual(got, c.selected) {
+			t.Errorf("%d: expected selected manifests %v, got %v", idx, c.selected, got)
+		}
+		if got := names(skipped); !reflect.DeepEqual(got, c.skipped) {
+			t.Errorf("%d: expected skipped manifests %v, got %v", idx, c.skipped, got)
+		}
+	}
+}
+
+func TestSyncSelectedCache(t *testing.T) {
+	now := time.Now()
+	objects := []backends.ObjectInfo{
+		{Name: "manifests|old", LastModified: now.Add(-96 * time.Hour)},
+		{Name: "manifests|new", LastModified: now.Add(-1 * time.Hour)},
+		{Name: "manifests|newer", LastModified: now.Add(-1 * time.Minute)},
+	}
+
+	testCases := []struct {
+		limit      int
+		newerThan  time.Duration
+		downloaded []string
+		skipped    int
+	}{
+		{1, 0, []string{"manifests|newer"}, 2},
+		{0, 24 * time.Hour, []string{"manifests|new", "manifests|newer"}, 1},
+		{5, 0, []string{"manifests|new", "manifests|newer", "manifests|old"}, 0},
+	}
+
+	for idx, c := range testCases {
+		localCache, err := ioutil.TempDir("", "zfsbackuplisttest")
+		if err != nil {
+			t.Fatalf("could not create temp dir - %v", err)
+		}
+		defer os.RemoveAll(localCache)
+
+		b := &mockDetailedBackend{objects: objects}
+		j := &helpers.JobInfo{ManifestPrefix: "manifests", ListLimit: c.limit, ListNewerThan: c.newerThan}
+		safeManifests, skipped, err := syncSelectedCache(context.Background(), j, localCache, b)
+		if err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+
+		sort.Strings(b.downloaded)
+		if !reflect.DeepEqual(b.downloaded, c.downloaded) {
+			t.Errorf("%d: expected only %v to be downloaded, got %v", idx, c.downloaded, b.downloaded)
+		}
+		if len(safeManifests) != len(c.downloaded) {
+			t.Errorf("%d: expected %d manifests in the local cache, got %d", idx, len(c.downloaded), len(safeManifests))
+		}
+		if len(skipped) != c.skipped {
+			t.Errorf("%d: expected %d skipped manifests, got %d", idx, c.skipped, len(skipped))
+		}
+
+		// A second pass should be served from the local cache
+		b.downloaded = nil
+		if _, _, err = syncSelectedCache(context.Background(), j, localCache, b); err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+		} else if len(b.downloaded) != 0 {
+			t.Errorf("%d: expected cached manifests to not be downloaded again, got %v", idx, b.downloaded)
+		}
+	}
+}
+
+func TestSyncSelectedCacheMirrors(t *testing.T) {
+	now := time.Now()
+	objects := []backends.ObjectInfo{
+		{Name: "manifests|old", LastModified: now.Add(-96 * time.Hour)},
+		{Name: "mirror/manifests|old", LastModified: now.Add(-96 * time.Hour)},
+		{Name: "mirror/manifests|new", LastModified: now.Add(-1 * time.Hour)},
+		{Name: "mirror/manifests|new.part1", LastModified: now.Add(-1 * time.Hour)},
+	}
+
+	testCases := []struct {
+		limit      int
+		downloaded []string
+		skipped    int
+	}{
+		{1, []string{"mirror/manifests|new", "mirror/manifests|new.part1"}, 1},
+		{0, []string{"manifests|old", "mirror/manifests|new", "mirror/manifests|new.part1"}, 0},
+	}
+
+	for idx, c := range testCases {
+		localCache, err := ioutil.TempDir("", "zfsbackuplisttest")
+		if err != nil {
+			t.Fatalf("could not create temp dir - %v", err)
+		}
+		defer os.RemoveAll(localCache)
+
+		b := &mockDetailedBackend{objects: objects}
+		j := &helpers.JobInfo{ManifestPrefix: "manifests", ManifestMirrorPrefixes: []string{"mirror/manifests"}, ListLimit: c.limit}
+		safeManifests, skipped, err := syncSelectedCache(context.Background(), j, localCache, b)
+		if err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+
+		sort.Strings(b.downloaded)
+		if !reflect.DeepEqual(b.downloaded, c.downloaded) {
+			t.Errorf("%d: expected only %v to be downloaded, got %v", idx, c.downloaded, b.downloaded)
+		}
+		if len(skipped) != c.skipped {
+			t.Errorf("%d: expected %d skipped manifests, got %d", idx, c.skipped, len(skipped))
+		}
+
+		// The copy is cached under the name of the manifest it stands in for
+		safeName := fmt.Sprintf("%x", md5.Sum([]byte("manifests|new")))
+		if len(safeManifests) == 0 || safeManifests[0] != safeName {
+			t.Errorf("%d: expected the copy to be cached as manifests|new, got %v", idx, safeManifests)
+		}
+		if _, serr := os.Stat(filepath.Join(localCache, fmt.Sprintf("%x", md5.Sum([]byte("manifests|new.part1"))))); serr != nil {
+			t.Errorf("%d: expected the copy of the manifest part to be cached - %v", idx, serr)
+		}
+	}
+}
+
+func prepareCacheTest(t *testing.T) (string, string) {
+	t.Helper()
+	workingDir, err := ioutil.TempDir("", "zfsbackupcachetest")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	target, err := ioutil.TempDir("", "zfsbackupcachetarget")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	helpers.WorkingDir = workingDir
+	return workingDir, "file://" + target
+}
+
+func TestGroupManifest(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	now := time.Now().Round(time.Second)
+	group := &helpers.JobInfo{
+		VolumeName:     "mygroup",
+		BaseSnapshot:   helpers.SnapshotInfo{Name: "20200101T000000Z", CreationTime: now},
+		GroupName:      "mygroup",
+		Compressor:     helpers.InternalCompressor,
+		Separator:      "|",
+		ManifestPrefix: "manifests",
+		Destinations:   []string{destination},
+		GroupMembers: []*helpers.JobInfo{
+			{
+				VolumeName:   "tank/db",
+				BaseSnapshot: helpers.SnapshotInfo{Name: "snap2", CreationTime: now},
+				Volumes:      []*helpers.VolumeInfo{{ObjectName: "tank/db|snap2.zstream.gz.vol1", VolumeNumber: 1, Size: 10}, {ObjectName: "tank/db|snap2.zstream.gz.vol2", VolumeNumber: 2, Size: 5}},
+			},
+			{
+				VolumeName:          "tank/app",
+				BaseSnapshot:        helpers.SnapshotInfo{Name: "snap2", CreationTime: now},
+				IncrementalSnapshot: helpers.SnapshotInfo{Name: "snap1", CreationTime: now.Add(-time.Hour)},
+				Volumes:             []*helpers.VolumeInfo{{ObjectName: "tank/app|snap1|to|snap2.zstream.gz.vol1", VolumeNumber: 1, Size: 7}},
+			},
+		},
+	}
+
+	manifestVol, err := saveManifest(context.Background(), group, true)
+	if err != nil {
+		t.Fatalf("could not save group manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+
+	decoded, err := readManifest(context.Background(), filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestVol.ObjectName)))), group)
+	if err != nil {
+		t.Fatalf("could not read group manifest - %v", err)
+	}
+
+	if decoded.GroupName != "mygroup" {
+		t.Errorf("expected group name %s, got %s", "mygroup", decoded.GroupName)
+	}
+	if len(decoded.GroupMembers) != 2 {
+		t.Fatalf("expected 2 group members, got %d", len(decoded.GroupMembers))
+	}
+	for idx, member := range group.GroupMembers {
+		if decoded.GroupMembers[idx].VolumeName != member.VolumeName {
+			t.Errorf("%d: expected member %s, got %s", idx, member.VolumeName, decoded.GroupMembers[idx].VolumeName)
+		}
+		if !decoded.GroupMembers[idx].IncrementalSnapshot.Equal(&member.IncrementalSnapshot) {
+			t.Errorf("%d: expected incremental snapshot %v, got %v", idx, member.IncrementalSnapshot, decoded.GroupMembers[idx].IncrementalSnapshot)
+		}
+	}
+
+	var names []string
+	for _, vol := range decoded.AllVolumes() {
+		names = append(names, vol.ObjectName)
+	}
+	expected := []string{"tank/db|snap2.zstream.gz.vol1", "tank/db|snap2.zstream.gz.vol2", "tank/app|snap1|to|snap2.zstream.gz.vol1"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected volumes %v, got %v", expected, names)
+	}
+	if total := decoded.TotalBytesWritten(); total != 22 {
+		t.Errorf("expected 22 bytes written for the group, got %d", total)
+	}
+}
+
+func TestSelectBatchRestores(t *testing.T) {
+	manifestTree := map[string][]*helpers.JobInfo{
+		"tank/db":       {{VolumeName: "tank/db", BaseSnapshot: helpers.SnapshotInfo{Name: "snap1"}}},
+		"tank/app":      {{VolumeName: "tank/app", BaseSnapshot: helpers.SnapshotInfo{Name: "snap1"}}},
+		"tank/app/logs": {{VolumeName: "tank/app/logs", BaseSnapshot: helpers.SnapshotInfo{Name: "snap1"}}},
+	}
+
+	testCases := []struct {
+		selectors []string
+		all       bool
+		lastPath  bool
+		targetMap []string
+		targets   []string
+		snapshots []string
+		failed    []bool
+	}{
+		{[]string{"tank/db", "tank/app@snap1"}, false, true, nil, []string{"restore/db", "restore/app"}, []string{"", "snap1"}, []bool{false, false}},
+		{nil, true, true, nil, []string{"restore/app", "restore/logs", "restore/db"}, []string{"", "", ""}, []bool{false, false, false}},
+		{[]string{"tank/db", "tank/app"}, false, false, []string{"tank/db=other/db"}, []string{"other/db", "restore"}, []string{"", ""}, []bool{false, true}},
+		{[]string{"tank/db", "tank/missing", "tank/db@snap1"}, false, true, nil, []string{"restore/db", "restore/missing", "restore/db"}, []string{"", "", "snap1"}, []bool{false, true, true}},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			BatchSelectors: c.selectors,
+			BatchAll:       c.all,
+			LocalVolume:    "restore",
+			LastPath:       c.lastPath,
+			TargetMap:      c.targetMap,
+			Force:          true,
+		}
+		restores := selectBatchRestores(j, manifestTree)
+		if len(restores) != len(c.targets) {
+			t.Errorf("%d: expected %d restores, got %d", idx, len(c.targets), len(restores))
+			continue
+		}
+		for ridx, r := range restores {
+			if target := r.job.ReceiveTarget(); target != c.targets[ridx] {
+				t.Errorf("%d: expected restore %d to restore to %s, got %s", idx, ridx, c.targets[ridx], target)
+			}
+			if r.job.BaseSnapshot.Name != c.snapshots[ridx] {
+				t.Errorf("%d: expected restore %d to restore snapshot %q, got %q", idx, ridx, c.snapshots[ridx], r.job.BaseSnapshot.Name)
+			}
+			if (r.err != nil) != c.failed[ridx] {
+				t.Errorf("%d: expected restore %d to fail to resolve to be %v, got error %v", idx, ridx, c.failed[ridx], r.err)
+			}
+			if !r.job.Force || !r.job.AutoRestore || len(r.job.BatchSelectors) != 0 {
+				t.Errorf("%d: expected restore %d to carry over the receive options", idx, ridx)
+			}
+		}
+	}
+}
+
+func TestRunBatchRestore(t *testing.T) {
+	var restores []*batchRestore
+	for _, volume := range []string{"tank/a", "tank/b", "tank/fail", "tank/c", "tank/d", "tank/unresolved"} {
+		r := &batchRestore{job: &helpers.JobInfo{VolumeName: volume, LocalVolume: "restore", LastPath: true}}
+		if volume == "tank/unresolved" {
+			r.err = errTest
+		}
+		restores = append(restores, r)
+	}
+
+	testCases := []struct {
+		parallel int
+		max      int
+	}{
+		{0, 1},
+		{1, 1},
+		{2, 2},
+		{10, 5},
+	}
+
+	for idx, c := range testCases {
+		var mutex sync.Mutex
+		var running, maxRunning, calls int
+		results := runBatchRestore(context.Background(), restores, c.parallel, func(ctx context.Context, r *batchRestore) error {
+			mutex.Lock()
+			calls++
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+			r.job.BaseSnapshot.Name = "newest"
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			if r.job.VolumeName == "tank/fail" {
+				return errTest
+			}
+			return nil
+		})
+
+		if calls != 5 {
+			t.Errorf("%d: expected the 5 resolved restores to be run, got %d", idx, calls)
+		}
+		if maxRunning != c.max {
+			t.Errorf("%d: expected at most %d restores at a time, got %d", idx, c.max, maxRunning)
+		}
+		if len(results) != len(restores) {
+			t.Errorf("%d: expected %d results, got %d", idx, len(restores), len(results))
+			continue
+		}
+		for ridx, result := range results {
+			restored := restores[ridx].job.VolumeName != "tank/fail" && restores[ridx].job.VolumeName != "tank/unresolved"
+			if result.Dataset != restores[ridx].job.VolumeName || result.Restored != restored || (result.Error == "") != restored {
+				t.Errorf("%d: unexpected result %d - %+v", idx, ridx, result)
+			}
+			if restores[ridx].err == nil && (result.Snapshot != "newest" || result.Target != restores[ridx].job.ReceiveTarget()) {
+				t.Errorf("%d: expected result %d to record the restored snapshot and target, got %+v", idx, ridx, result)
+			}
+		}
+	}
+}
+
+func TestReportBatchRestore(t *testing.T) {
+	results := []BatchRestoreResult{
+		{Dataset: "tank/db", Snapshot: "snap2", Target: "restore/db", Restored: true, Elapsed: time.Minute},
+		{Dataset: "tank/app", Snapshot: "snap1", Target: "restore/app", Error: "testing error"},
+	}
+
+	oldStdout := helpers.Stdout
+	defer func() {
+		helpers.Stdout = oldStdout
+		helpers.JSONOutput = false
+	}()
+
+	testCases := []struct {
+		json     bool
+		expected []string
+	}{
+		{false, []string{"Restored 1 of 2 backup sets:", "OK\ttank/db@snap2\trestore/db\t1m0s", "FAIL\ttank/app@snap1\trestore/app\t0s\ttesting error"}},
+		{true, nil},
+	}
+
+	for idx, c := range testCases {
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		helpers.JSONOutput = c.json
+		if err := reportBatchRestore(results); err != nil {
+			t.Errorf("%d: unexpected error reporting results - %v", idx, err)
+			continue
+		}
+
+		if c.json {
+			var decoded []BatchRestoreResult
+			if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+				t.Errorf("%d: could not decode JSON output - %v", idx, err)
+			} else if !reflect.DeepEqual(decoded, results) {
+				t.Errorf("%d: expected JSON output to decode to %v, got %v", idx, results, decoded)
+			}
+			continue
+		}
+		for _, line := range c.expected {
+			if !strings.Contains(out.String(), line+"\n") {
+				t.Errorf("%d: expected output to contain %q, got %q", idx, line, out.String())
+			}
+		}
+	}
+}
+
+func TestGroupReceiveJobs(t *testing.T) {
+	manifest := &helpers.JobInfo{
+		VolumeName: "mygroup",
+		GroupName:  "mygroup",
+		GroupMembers: []*helpers.JobInfo{
+			{VolumeName: "tank/db", BaseSnapshot: helpers.SnapshotInfo{Name: "snap2"}},
+			{VolumeName: "tank/app", BaseSnapshot: helpers.SnapshotInfo{Name: "snap2"}, IncrementalSnapshot: helpers.SnapshotInfo{Name: "snap1"}},
+			{VolumeName: "tank/app/logs", BaseSnapshot: helpers.SnapshotInfo{Name: "snap2"}},
+		},
+	}
+
+	testCases := []struct {
+		fullPath bool
+		lastPath bool
+		expected []string
+	}{
+		{true, false, []string{"restore/db", "restore/app", "restore/app/logs"}},
+		{false, true, []string{"restore/db", "restore/app", "restore/logs"}},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			VolumeName:   "mygroup",
+			BaseSnapshot: helpers.SnapshotInfo{Name: "20200101T000000Z"},
+			LocalVolume:  "restore",
+			FullPath:     c.fullPath,
+			LastPath:     c.lastPath,
+			Force:        true,
+		}
+		jobs := groupReceiveJobs(j, manifest)
+		if len(jobs) != len(manifest.GroupMembers) {
+			t.Errorf("%d: expected %d jobs, got %d", idx, len(manifest.GroupMembers), len(jobs))
+			continue
+		}
+		for jidx, job := range jobs {
+			member := manifest.GroupMembers[jidx]
+			if job.VolumeName != member.VolumeName || !job.BaseSnapshot.Equal(&member.BaseSnapshot) || !job.IncrementalSnapshot.Equal(&member.IncrementalSnapshot) {
+				t.Errorf("%d: expected job %d to restore %s@%s, got %s@%s", idx, jidx, member.VolumeName, member.BaseSnapshot.Name, job.VolumeName, job.BaseSnapshot.Name)
+			}
+			if !job.Force || job.LocalVolume != "restore" || len(job.GroupMembers) != 0 {
+				t.Errorf("%d: expected job %d to carry over the receive options", idx, jidx)
+			}
+			if volume := job.ReceiveTarget(); volume != c.expected[jidx] {
+				t.Errorf("%d: expected job %d to restore to %s, got %s", idx, jidx, c.expected[jidx], volume)
+			}
+		}
+	}
+}
+
+func TestBackupGroupFailure(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	newMember := func(volume string) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volume,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap", CreationTime: time.Now()},
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+		}
+	}
+
+	group := newMember("mygroup")
+	group.GroupName = "mygroup"
+	// Neither of these datasets exist, so the first member will fail
+	group.GroupMembers = []*helpers.JobInfo{newMember("zfsbackup/does/not/exist"), newMember("zfsbackup/does/not/exist/either")}
+
+	if err := BackupGroup(context.Background(), group); err == nil {
+		t.Fatalf("expected the group backup to fail")
+	}
+
+	if files, err := ioutil.ReadDir(target); err != nil {
+		t.Errorf("could not read target dir - %v", err)
+	} else if len(files) != 0 {
+		t.Errorf("expected nothing to be written to the target, found %d files", len(files))
+	}
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not get cache dir - %v", err)
+	}
+	if files, err := ioutil.ReadDir(localCachePath); err != nil {
+		t.Errorf("could not read cache dir - %v", err)
+	} else if len(files) != 0 {
+		t.Errorf("expected no manifest to be written to the local cache, found %d files", len(files))
+	}
+}
+
+func TestExtractManifest(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	manifest := &helpers.JobInfo{
+		VolumeName:     "tank/db",
+		BaseSnapshot:   helpers.SnapshotInfo{Name: "snap2", CreationTime: time.Now().Round(time.Second)},
+		Compressor:     helpers.InternalCompressor,
+		EncryptTo:      "backups@example.com",
+		SignFrom:       "signer@example.com",
+		Separator:      "|",
+		ManifestPrefix: "manifests",
+		Destinations:   []string{destination},
+		Volumes:        []*helpers.VolumeInfo{{ObjectName: "tank/db|snap2.zstream.gz.vol1", VolumeNumber: 1, Size: 10}},
+		GroupMembers:   []*helpers.JobInfo{{VolumeName: "tank/db/child", EncryptTo: "backups@example.com"}},
+	}
+
+	manifestVol, err := saveManifest(context.Background(), manifest, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+
+	expected, err := readManifest(context.Background(), filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestVol.ObjectName)))), manifest)
+	if err != nil {
+		t.Fatalf("could not read manifest - %v", err)
+	}
+
+	testCases := []struct {
+		includeKeyInfo bool
+		encryptTo      string
+		signFrom       string
+	}{
+		{true, "backups@example.com", "signer@example.com"},
+		{false, "", ""},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			VolumeName:     "tank/db",
+			BaseSnapshot:   helpers.SnapshotInfo{Name: "snap2"},
+			Separator:      "|",
+			ManifestPrefix: "manifests",
+			Destinations:   []string{destination},
+		}
+		outputPath := filepath.Join(workingDir, fmt.Sprintf("manifest%d.json", idx))
+		if err = ExtractManifest(context.Background(), j, outputPath, c.includeKeyInfo); err != nil {
+			t.Errorf("%d: could not extract manifest - %v", idx, err)
+			continue
+		}
+
+		rawManifest, rerr := ioutil.ReadFile(outputPath)
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted manifest - %v", idx, rerr)
+			continue
+		}
+		extracted, derr := decodeManifest(rawManifest, outputPath)
+		if derr != nil {
+			t.Errorf("%d: could not decode extracted manifest - %v", idx, derr)
+			continue
+		}
+
+		if extracted.EncryptTo != c.encryptTo || extracted.SignFrom != c.signFrom || extracted.GroupMembers[0].EncryptTo != c.encryptTo {
+			t.Errorf("%d: expected key info %q/%q, got %q/%q", idx, c.encryptTo, c.signFrom, extracted.EncryptTo, extracted.SignFrom)
+		}
+
+		// Other than the key info, the extracted manifest should match what restore would parse
+		want := *expected
+		want.EncryptTo, want.SignFrom = extracted.EncryptTo, extracted.SignFrom
+		want.GroupMembers = []*helpers.JobInfo{{VolumeName: "tank/db/child", EncryptTo: extracted.GroupMembers[0].EncryptTo}}
+		if !reflect.DeepEqual(&want, extracted) {
+			t.Errorf("%d: extracted manifest does not match the manifest restore would parse\n%+v\n%+v", idx, &want, extracted)
+		}
+	}
+}
+
+func TestManifestFormat(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	testCases := []struct {
+		format string
+		binary bool
+	}{
+		// Manifests written before the format could be selected
+		{"", false},
+		{helpers.ManifestFormatJSON, false},
+		{helpers.ManifestFormatBinary, true},
+	}
+
+	var expected *helpers.JobInfo
+	for idx, c := range testCases {
+		manifest := &helpers.JobInfo{
+			VolumeName:     "tank/db",
+			BaseSnapshot:   helpers.SnapshotInfo{Name: "snap2", CreationTime: time.Now().Round(time.Second)},
+			Compressor:     helpers.InternalCompressor,
+			Separator:      "|",
+			ManifestPrefix: "manifests",
+			ManifestFormat: c.format,
+			Destinations:   []string{destination},
+			Volumes:        []*helpers.VolumeInfo{{ObjectName: "tank/db|snap2.zstream.gz.vol1", VolumeNumber: 1, Size: 10, SHA256Sum: "abc"}},
+			GroupMembers:   []*helpers.JobInfo{{VolumeName: "tank/db/child"}},
+		}
+
+		manifestVol, err := saveManifest(context.Background(), manifest, true)
+		if err != nil {
+			t.Fatalf("%d: could not save manifest - %v", idx, err)
+		}
+		manifestVol.DeleteVolume()
+		manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestVol.ObjectName))))
+
+		rawManifest, err := readRawManifest(context.Background(), manifestPath, manifest)
+		if err != nil {
+			t.Fatalf("%d: could not read manifest - %v", idx, err)
+		}
+		if helpers.IsBinaryManifest(rawManifest) != c.binary {
+			t.Errorf("%d: expected a binary manifest: %v, got %v", idx, c.binary, !c.binary)
+		}
+
+		// Manifests read the same whatever their format
+		decoded, err := readManifest(context.Background(), manifestPath, manifest)
+		if err != nil {
+			t.Errorf("%d: could not decode manifest - %v", idx, err)
+			continue
+		}
+		decoded.BaseSnapshot.CreationTime = decoded.BaseSnapshot.CreationTime.UTC()
+		if expected == nil {
+			expected = decoded
+		} else if !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("%d: decoded manifest does not match the JSON manifest\n%+v\n%+v", idx, expected, decoded)
+		}
+
+		// Extracted manifests are always JSON
+		outputPath := filepath.Join(workingDir, fmt.Sprintf("manifest%d.json", idx))
+		if err = ExtractManifest(context.Background(), manifest, outputPath, true); err != nil {
+			t.Errorf("%d: could not extract manifest - %v", idx, err)
+			continue
+		}
+		extracted, err := ioutil.ReadFile(outputPath)
+		if err != nil {
+			t.Errorf("%d: could not read extracted manifest - %v", idx, err)
+			continue
+		}
+		if fields := make(map[string]interface{}); json.Unmarshal(extracted, &fields) != nil || fields["VolumeName"] != "tank/db" {
+			t.Errorf("%d: expected the extracted manifest to be JSON, got %s", idx, extracted)
+		}
+	}
+}
+
+func TestVolumesBefore(t *testing.T) {
+	volumes := []*helpers.VolumeInfo{{VolumeNumber: 3}, {VolumeNumber: 1}, {VolumeNumber: 2}, {VolumeNumber: 5}}
+
+	testCases := []struct {
+		start   int64
+		numbers []int64
+		valid   errTestFunc
+	}{
+		{1, nil, nilErrTest},
+		{2, []int64{1}, nilErrTest},
+		{4, []int64{1, 2, 3}, nilErrTest},
+		{5, nil, nonNilErrTest},
+		{6, nil, nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		before, err := volumesBefore(volumes, c.start)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		var numbers []int64
+		for _, vol := range before {
+			numbers = append(numbers, vol.VolumeNumber)
+		}
+		if !reflect.DeepEqual(numbers, c.numbers) {
+			t.Errorf("%d: expected volumes %v, got %v", idx, c.numbers, numbers)
+		}
+	}
+}
+
+func TestStartAtVolume(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	if _, err := getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	newJob := func() *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         "tank",
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+			Compressor:         helpers.InternalCompressor,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxParallelUploads: 1,
+		}
+	}
+
+	// A previous attempt uploaded 3 volumes
+	previous := newJob()
+	for i := int64(1); i <= 3; i++ {
+		previous.Volumes = append(previous.Volumes, &helpers.VolumeInfo{ObjectName: fmt.Sprintf("tank|snap.zstream.gz.vol%d", i), VolumeNumber: i, ZFSStreamBytes: 100})
+	}
+	manifestVol, err := saveManifest(context.Background(), previous, false)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	manifestVol.DeleteVolume()
+
+	// Only the first volume is found at the destination
+	if err = ioutil.WriteFile(filepath.Join(target, "tank|snap.zstream.gz.vol1"), []byte("vol1"), 0644); err != nil {
+		t.Fatalf("could not write volume - %v", err)
+	}
+
+	testCases := []struct {
+		start int64
+		vols  int
+		valid errTestFunc
+	}{
+		{1, 0, nilErrTest},
+		{2, 1, nilErrTest},
+		{3, 0, nonNilErrTest},
+		{5, 0, nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		j := newJob()
+		j.StartAtVolume = c.start
+		if err = tryResume(context.Background(), j); err != nil {
+			t.Errorf("%d: could not resume - %v", idx, err)
+			continue
+		}
+		err = startAtVolume(context.Background(), j)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(j.Volumes) != c.vols {
+			t.Errorf("%d: expected %d previous volumes, got %d", idx, c.vols, len(j.Volumes))
+		}
+		if skipBytes, volNum := j.TotalBytesStreamedAndVols(); skipBytes != uint64(100*c.vols) || volNum != c.start {
+			t.Errorf("%d: expected to skip %d bytes and start at volume %d, got %d bytes and volume %d", idx, 100*c.vols, c.start, skipBytes, volNum)
+		}
+	}
+}
+
+func TestSharedVolumeIndex(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+	otherTarget, err := ioutil.TempDir("", "zfsbackupcachetarget")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(otherTarget)
+	otherDestination := "file://" + otherTarget
+
+	for _, dest := range []string{destination, otherDestination} {
+		if _, err = getCacheDir(dest); err != nil {
+			t.Fatalf("could not create cache dir - %v", err)
+		}
+	}
+
+	newSet := func(volumeName string, destinations []string, volumes ...*helpers.VolumeInfo) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volumeName,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+			Compressor:         helpers.InternalCompressor,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       destinations,
+			MaxParallelUploads: 1,
+			Volumes:            volumes,
+		}
+	}
+
+	sets := []*helpers.JobInfo{
+		newSet("tank/a", []string{destination, otherDestination},
+			&helpers.VolumeInfo{ObjectName: "tank/a|snap.zstream.gz.vol1", VolumeNumber: 1, SHA256Sum: "aaaa", Size: 10},
+			&helpers.VolumeInfo{ObjectName: "tank/a|snap.zstream.gz.vol2", VolumeNumber: 2, Size: 10},
+		),
+		newSet("tank/b", []string{destination},
+			&helpers.VolumeInfo{ObjectName: "tank/b|snap.zstream.gz.vol1", VolumeNumber: 1, SHA256Sum: "bbbb", Size: 10},
+		),
+	}
+
+	for _, set := range sets {
+		manifestVol, merr := saveManifest(context.Background(), set, true)
+		if merr != nil {
+			t.Fatalf("could not save manifest - %v", merr)
+		}
+		for _, dest := range set.Destinations {
+			if merr = uploadManifest(context.Background(), set, manifestVol, dest); merr != nil {
+				t.Fatalf("could not upload manifest - %v", merr)
+			}
+		}
+		manifestVol.DeleteVolume()
+	}
+
+	testCases := []struct {
+		destinations []string
+		shared       map[string]string
+	}{
+		{
+			[]string{destination},
+			map[string]string{"aaaa-10": "tank/a|snap.zstream.gz.vol1", "bbbb-10": "tank/b|snap.zstream.gz.vol1"},
+		},
+		{
+			[]string{destination, otherDestination},
+			map[string]string{"aaaa-10": "tank/a|snap.zstream.gz.vol1"},
+		},
+	}
+
+	for idx, c := range testCases {
+		j := newSet("tank/c", c.destinations)
+		index, ierr := sharedVolumeIndex(context.Background(), j)
+		if ierr != nil {
+			t.Errorf("%d: unexpected error - %v", idx, ierr)
+			continue
+		}
+		shared := make(map[string]string)
+		for key, vol := range index {
+			shared[key] = vol.ObjectName
+		}
+		if !reflect.DeepEqual(shared, c.shared) {
+			t.Errorf("%d: expected shared volumes %v, got %v", idx, c.shared, shared)
+		}
+	}
+}
+
+func TestShareVolumesChainer(t *testing.T) {
+	index := map[string]*helpers.VolumeInfo{
+		"aaaa-10": {ObjectName: "tank/a|snap.zstream.gz.vol1", SHA256Sum: "aaaa", Size: 10},
+	}
+
+	testCases := []struct {
+		vol        *helpers.VolumeInfo
+		objectName string
+		shared     bool
+	}{
+		{&helpers.VolumeInfo{ObjectName: "tank/c|snap.zstream.gz.vol1", SHA256Sum: "aaaa", Size: 10}, "tank/a|snap.zstream.gz.vol1", true},
+		{&helpers.VolumeInfo{ObjectName: "tank/c|snap.zstream.gz.vol2", SHA256Sum: "aaaa", Size: 11}, "tank/c|snap.zstream.gz.vol2", false},
+		{&helpers.VolumeInfo{ObjectName: "tank/c|snap.zstream.gz.vol3", SHA256Sum: "cccc", Size: 10}, "tank/c|snap.zstream.gz.vol3", false},
+		{&helpers.VolumeInfo{ObjectName: "manifests|tank/c|snap.manifest.gz", SHA256Sum: "aaaa", Size: 10, IsManifest: true}, "manifests|tank/c|snap.manifest.gz", false},
+	}
+
+	in := make(chan *helpers.VolumeInfo, len(testCases))
+	for _, c := range testCases {
+		in <- c.vol
+	}
+	close(in)
+
+	out := shareVolumesChainer(context.Background(), in, index)
+	for idx, c := range testCases {
+		vol, ok := <-out
+		if !ok {
+			t.Fatalf("%d: expected a volume, channel was closed", idx)
+		}
+		if vol.ObjectName != c.objectName {
+			t.Errorf("%d: expected object name %s, got %s", idx, c.objectName, vol.ObjectName)
+		}
+		if vol.SharedObject != c.shared {
+			t.Errorf("%d: expected shared to be %v, got %v", idx, c.shared, vol.SharedObject)
+		}
+		if isSharedUpload(vol, backends.FileBackendPrefix) != c.shared {
+			t.Errorf("%d: expected the upload to be skipped: %v", idx, c.shared)
+		}
+		if isSharedUpload(vol, backends.DeleteBackendPrefix) {
+			t.Errorf("%d: expected the delete backend to always process the volume", idx)
+		}
+	}
+	if _, ok := <-out; ok {
+		t.Errorf("expected the out channel to be closed")
+	}
+}
+
+func TestUnreferencedObjects(t *testing.T) {
+	setA := &helpers.JobInfo{
+		VolumeName: "tank/a",
+		Volumes:    []*helpers.VolumeInfo{{ObjectName: "a.vol1"}, {ObjectName: "a.vol2"}},
+	}
+	setB := &helpers.JobInfo{
+		VolumeName: "tank/b",
+		Volumes:    []*helpers.VolumeInfo{{ObjectName: "a.vol1", SharedObject: true}, {ObjectName: "b.vol2"}},
+	}
+	brokenSet := &helpers.JobInfo{
+		VolumeName: "tank/c",
+		Volumes:    []*helpers.VolumeInfo{{ObjectName: "a.vol2", SharedObject: true}, {ObjectName: "c.vol2"}, {ObjectName: "c.vol3"}},
+	}
+	scriptSet := &helpers.JobInfo{
+		VolumeName:    "tank/d",
+		Volumes:       []*helpers.VolumeInfo{{ObjectName: "d.vol1"}},
+		RestoreScript: "d.restore.sh",
+	}
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	expiredSet := &helpers.JobInfo{
+		VolumeName: "tank/e",
+		Volumes:    []*helpers.VolumeInfo{{ObjectName: "e.vol1"}, {ObjectName: "e.vol2"}},
+		ExpiresAt:  &past,
+	}
+	expiringSet := &helpers.JobInfo{
+		VolumeName: "tank/f",
+		Volumes:    []*helpers.VolumeInfo{{ObjectName: "f.vol1"}, {ObjectName: "f.vol2"}},
+		ExpiresAt:  &future,
+	}
+
+	testCases := []struct {
+		objects      []string
+		manifests    []*helpers.JobInfo
+		removeBroken bool
+		unreferenced []string
+		broken       int
+	}{
+		// Shared volumes are kept while any backup set refers to them
+		{[]string{"manifests|a", "a.vol1", "a.vol2", "b.vol2", "orphan"}, []*helpers.JobInfo{setA, setB}, false, []string{"orphan"}, 0},
+		// Deleting a backup set only deletes volumes no other set refers to
+		{[]string{"a.vol1", "a.vol2", "b.vol2"}, []*helpers.JobInfo{setB}, false, []string{"a.vol2"}, 0},
+		{[]string{"a.vol1", "a.vol2", "b.vol2"}, []*helpers.JobInfo{setA}, false, []string{"b.vol2"}, 0},
+		{[]string{"a.vol1", "a.vol2", "b.vol2"}, nil, false, []string{"a.vol1", "a.vol2", "b.vol2"}, 0},
+		// Broken backup sets keep their volumes unless forced, shared volumes are kept regardless
+		{[]string{"a.vol1", "a.vol2", "b.vol2", "c.vol2"}, []*helpers.JobInfo{setA, setB, brokenSet}, false, nil, 0},
+		{[]string{"a.vol1", "a.vol2", "b.vol2", "c.vol2"}, []*helpers.JobInfo{setA, setB, brokenSet}, true, []string{"c.vol2"}, 1},
+		{[]string{"a.vol2", "c.vol2"}, []*helpers.JobInfo{brokenSet}, true, []string{"a.vol2", "c.vol2"}, 1},
+		// Restore scripts are kept for as long as their backup set is
+		{[]string{"d.vol1", "d.restore.sh"}, []*helpers.JobInfo{scriptSet}, false, nil, 0},
+		{[]string{"d.vol1", "d.restore.sh"}, nil, false, []string{"d.vol1", "d.restore.sh"}, 0},
+		// Expired backup sets whose volumes are partly deleted already are removed without forcing
+		{[]string{"e.vol2"}, []*helpers.JobInfo{expiredSet}, false, []string{"e.vol2"}, 1},
+		{[]string{"e.vol1", "e.vol2"}, []*helpers.JobInfo{expiredSet}, false, nil, 0},
+		{[]string{"f.vol2"}, []*helpers.JobInfo{expiringSet}, false, nil, 0},
+	}
+
+	for idx, c := range testCases {
+		unreferenced, broken := unreferencedObjects(c.objects, c.manifests, "manifests", c.removeBroken)
+		if !reflect.DeepEqual(unreferenced, c.unreferenced) {
+			t.Errorf("%d: expected unreferenced objects %v, got %v", idx, c.unreferenced, unreferenced)
+		}
+		if len(broken) != c.broken {
+			t.Errorf("%d: expected %d broken backup sets, got %d", idx, c.broken, len(broken))
+		}
+	}
+}
+
+func TestExpiredObjects(t *testing.T) {
+	now := time.Now()
+	details := []backends.ObjectInfo{
+		{Name: "old.vol1", LastModified: now.Add(-48 * time.Hour)},
+		{Name: "old.vol2", LastModified: now.Add(-25 * time.Hour)},
+		{Name: "new.vol1", LastModified: now.Add(-time.Hour)},
+		{Name: "new.vol2", LastModified: now},
+		{Name: "unknown.vol1"},
+	}
+
+	endTimes := map[string]time.Time{
+		"unknown.vol1": now.Add(-time.Hour),
+		"missing.vol1": now.Add(-48 * time.Hour),
+		"new.vol1":     now.Add(-48 * time.Hour),
+	}
+
+	testCases := []struct {
+		objects     []string
+		gracePeriod time.Duration
+		expired     []string
+		recent      int
+		unknown     int
+	}{
+		{[]string{"old.vol1", "old.vol2", "new.vol1", "new.vol2"}, 24 * time.Hour, []string{"old.vol1", "old.vol2"}, 2, 0},
+		{[]string{"old.vol1", "old.vol2", "new.vol1", "new.vol2"}, 30 * time.Minute, []string{"old.vol1", "old.vol2", "new.vol1"}, 1, 0},
+		{[]string{"new.vol1", "new.vol2"}, 24 * time.Hour, nil, 2, 0},
+		// Objects without a modification time are aged by the end time of their backup set
+		{[]string{"unknown.vol1", "missing.vol1", "old.vol1"}, 24 * time.Hour, []string{"missing.vol1", "old.vol1"}, 1, 0},
+		// Or are kept if they belong to none, they may belong to a backup still uploading
+		{[]string{"orphan.vol1", "new.vol2", "old.vol1"}, 24 * time.Hour, []string{"old.vol1"}, 1, 1},
+		{nil, 24 * time.Hour, nil, 0, 0},
+	}
+
+	for idx, c := range testCases {
+		expired, recent, unknown := expiredObjects(c.objects, details, endTimes, c.gracePeriod, now)
+		if !reflect.DeepEqual(expired, c.expired) {
+			t.Errorf("%d: expected expired objects %v, got %v", idx, c.expired, expired)
+		}
+		if recent != c.recent {
+			t.Errorf("%d: expected %d recent objects, got %d", idx, c.recent, recent)
+		}
+		if unknown != c.unknown {
+			t.Errorf("%d: expected %d objects of unknown age, got %d", idx, c.unknown, unknown)
+		}
+	}
+}
+
+func TestDeleteObjects(t *testing.T) {
+	oldRetryTime := deleteRetryTime
+	deleteRetryTime = 2 * time.Second
+	defer func() { deleteRetryTime = oldRetryTime }()
+
+	objects := []string{"retained"}
+	for idx := 0; idx < 250; idx++ {
+		objects = append(objects, fmt.Sprintf("vol%d", idx))
+	}
+
+	testCases := []struct {
+		batchSize int
+		batched   bool
+		failures  map[string]int
+		valid     errTestFunc
+		// The number of delete requests made, including retries
+		requests int
+	}{
+		{100, true, nil, nilErrTest, 3},
+		// Only the objects of a batch that failed are retried
+		{100, true, map[string]int{"vol5": 2, "vol240": 1}, nilErrTest, 6},
+		{100, true, map[string]int{"vol5": -1}, nonNilErrTest, -1},
+		// Backends that cannot delete in batches delete each object on its own
+		{100, false, map[string]int{"vol5": 1}, nilErrTest, len(objects) + 1},
+		{100, false, map[string]int{"vol5": -1}, errTestErrTest, -1},
+	}
+
+	for idx, c := range testCases {
+		failures := make(map[string]int)
+		for name, count := range c.failures {
+			failures[name] = count
+		}
+		mock := &mockBatchDeleteBackend{batchSize: c.batchSize, deleted: make(map[string]bool), failures: failures}
+		var backend backends.Backend = mock
+		if !c.batched {
+			backend = plainBackend{mock}
+		}
+
+		err := deleteObjects(context.Background(), backend, "mock://", objects)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+		if c.requests >= 0 && len(mock.batches) != c.requests {
+			t.Errorf("%d: expected %d delete requests, got %d", idx, c.requests, len(mock.batches))
+		}
+		if mock.maxInFlight > 5 {
+			t.Errorf("%d: expected at most 5 delete requests at once, got %d", idx, mock.maxInFlight)
+		}
+		for bidx, size := range mock.batches {
+			if (c.batched && size > c.batchSize) || (!c.batched && size != 1) {
+				t.Errorf("%d: delete request %d was for %d objects", idx, bidx, size)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		if len(mock.deleted) != len(objects)-1 || mock.deleted["retained"] {
+			t.Errorf("%d: expected every object but the retained one to be deleted, %d were", idx, len(mock.deleted))
+		}
+	}
+}
+
+func TestCleanGracePeriod(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"old.vol1", "new.vol1"} {
+		path := filepath.Join(target, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("could not write object %s - %v", name, err)
+		}
+		if strings.HasPrefix(name, "old") {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatalf("could not change the modification time of %s - %v", name, err)
+			}
+		}
+	}
+
+	testCases := []struct {
+		gracePeriod time.Duration
+		remaining   []string
+	}{
+		// Recently created unreferenced objects may belong to a backup in progress
+		{24 * time.Hour, []string{"new.vol1"}},
+		{0, nil},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			Destinations:   []string{destination},
+			ManifestPrefix: "manifests",
+			GracePeriod:    c.gracePeriod,
+		}
+		if err := Clean(context.Background(), j, false); err != nil {
+			t.Fatalf("%d: unexpected error cleaning the destination - %v", idx, err)
+		}
+
+		var remaining []string
+		files, err := ioutil.ReadDir(target)
+		if err != nil {
+			t.Fatalf("%d: could not read the destination - %v", idx, err)
+		}
+		for _, f := range files {
+			remaining = append(remaining, f.Name())
+		}
+		if !reflect.DeepEqual(remaining, c.remaining) {
+			t.Errorf("%d: expected objects %v to remain, got %v", idx, c.remaining, remaining)
+		}
+	}
+}
+
+func TestSharedVolumeIndexIsCached(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+	if _, err := getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	newSet := func(volumeName string, volumes ...*helpers.VolumeInfo) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volumeName,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+			Compressor:         helpers.InternalCompressor,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxParallelUploads: 1,
+			Volumes:            volumes,
+		}
+	}
+	upload := func(set *helpers.JobInfo) {
+		manifestVol, err := saveManifest(context.Background(), set, true)
+		if err != nil {
+			t.Fatalf("could not save manifest - %v", err)
+		}
+		defer manifestVol.DeleteVolume()
+		if err = uploadManifest(context.Background(), set, manifestVol, destination); err != nil {
+			t.Fatalf("could not upload manifest - %v", err)
+		}
+	}
+
+	upload(newSet("tank/a", &helpers.VolumeInfo{ObjectName: "tank/a|snap.zstream.gz.vol1", VolumeNumber: 1, SHA256Sum: "aaaa", Size: 10}))
+
+	// A group's members share the job's index, the set uploaded after it was read must not be read again
+	cached := newSet("tank/c")
+	if _, err := sharedVolumeIndex(context.Background(), cached); err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	upload(newSet("tank/b", &helpers.VolumeInfo{ObjectName: "tank/b|snap.zstream.gz.vol1", VolumeNumber: 1, SHA256Sum: "bbbb", Size: 10}))
+
+	testCases := []struct {
+		j        *helpers.JobInfo
+		expected []string
+	}{
+		{cached, []string{"aaaa-10"}},
+		{newSet("tank/c"), []string{"aaaa-10", "bbbb-10"}},
+	}
+
+	for idx, c := range testCases {
+		index, err := sharedVolumeIndex(context.Background(), c.j)
+		if err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+		var keys []string
+		for key := range index {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("%d: expected shared volumes %v, got %v", idx, c.expected, keys)
+		}
+	}
+}
+
+func TestEstimateCosts(t *testing.T) {
+	f, err := ioutil.TempFile("", "zfsbackuppricetable")
+	if err != nil {
+		t.Fatalf("could not create temp file - %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(`{"Currency": "USD", "Default": 0.02, "StorageClasses": {"STANDARD": 0.025, "GLACIER": 0.005}}`); err != nil {
+		t.Fatalf("could not write price table - %v", err)
+	}
+	f.Close()
+
+	prices, err := LoadPriceTable(f.Name())
+	if err != nil {
+		t.Fatalf("could not load price table - %v", err)
+	}
+
+	const gib = 1024 * 1024 * 1024
+	full := &helpers.JobInfo{
+		VolumeName:   "tank/a",
+		BaseSnapshot: helpers.SnapshotInfo{Name: "snap1"},
+		Volumes:      []*helpers.VolumeInfo{{ObjectName: "a.vol1", Size: 4 * gib}, {ObjectName: "a.vol2", Size: 2 * gib}},
+	}
+	incremental := &helpers.JobInfo{
+		VolumeName:          "tank/a",
+		BaseSnapshot:        helpers.SnapshotInfo{Name: "snap2"},
+		IncrementalSnapshot: helpers.SnapshotInfo{Name: "snap1"},
+		Volumes:             []*helpers.VolumeInfo{{ObjectName: "a.vol2", Size: 2 * gib, SharedObject: true}, {ObjectName: "a.vol3", Size: gib / 2}},
+	}
+	storageClasses := map[string]string{"a.vol1": "GLACIER", "a.vol2": "STANDARD", "a.vol3": "DEEP_ARCHIVE"}
+
+	testCases := []struct {
+		manifests  []*helpers.JobInfo
+		classes    map[string]string
+		setCosts   []float64
+		totalBytes uint64
+		totalCost  float64
+	}{
+		{[]*helpers.JobInfo{full}, storageClasses, []float64{4*0.005 + 2*0.025}, 6 * gib, 4*0.005 + 2*0.025},
+		// Shared volumes count towards each set but only once towards the total, unknown classes use the default price
+		{[]*helpers.JobInfo{full, incremental}, storageClasses, []float64{4*0.005 + 2*0.025, 2*0.025 + 0.5*0.02}, 6*gib + gib/2, 4*0.005 + 2*0.025 + 0.5*0.02},
+		// Without storage classes everything is priced at the default price
+		{[]*helpers.JobInfo{full, incremental}, nil, []float64{6 * 0.02, 2.5 * 0.02}, 6*gib + gib/2, 6.5 * 0.02},
+		{nil, storageClasses, []float64{}, 0, 0},
+	}
+
+	for idx, c := range testCases {
+		report := estimateCosts(c.manifests, c.classes, prices)
+		if report.Currency != "USD" {
+			t.Errorf("%d: expected currency USD, got %s", idx, report.Currency)
+		}
+		if len(report.Sets) != len(c.setCosts) {
+			t.Errorf("%d: expected %d backup sets, got %d", idx, len(c.setCosts), len(report.Sets))
+			continue
+		}
+		for sidx, cost := range c.setCosts {
+			if math.Abs(report.Sets[sidx].MonthlyCost-cost) > 1e-9 {
+				t.Errorf("%d: expected backup set %d to cost %f, got %f", idx, sidx, cost, report.Sets[sidx].MonthlyCost)
+			}
+		}
+		if report.TotalBytes != c.totalBytes {
+			t.Errorf("%d: expected %d total bytes, got %d", idx, c.totalBytes, report.TotalBytes)
+		}
+		if math.Abs(report.TotalMonthlyCost-c.totalCost) > 1e-9 {
+			t.Errorf("%d: expected a total cost of %f, got %f", idx, c.totalCost, report.TotalMonthlyCost)
+		}
+	}
+}
+
+func TestRunLock(t *testing.T) {
+	defer func(interval time.Duration) { runLockPollInterval = interval }(runLockPollInterval)
+	runLockPollInterval = 10 * time.Millisecond
+
+	j := &helpers.JobInfo{VolumeName: fmt.Sprintf("tank/runlock%d", time.Now().UnixNano()), Destinations: []string{"file:///a", "file:///b"}}
+	path := runLockPath(j)
+	defer os.Remove(path)
+
+	// The order the destinations are provided in does not matter, the dataset and destinations do
+	if reordered := runLockPath(&helpers.JobInfo{VolumeName: j.VolumeName, Destinations: []string{"file:///b", "file:///a"}}); reordered != path {
+		t.Errorf("expected the same lock for reordered destinations, got %s and %s", path, reordered)
+	}
+	if other := runLockPath(&helpers.JobInfo{VolumeName: j.VolumeName, Destinations: []string{"file:///a"}}); other == path {
+		t.Errorf("expected a different lock for different destinations")
+	}
+
+	lock, waited, err := acquireRunLock(context.Background(), path, false)
+	if err != nil || waited {
+		t.Fatalf("expected to acquire the lock without waiting, got waited=%v and error %v", waited, err)
+	}
+
+	// A second invocation exits as already running
+	if _, _, err = acquireRunLock(context.Background(), path, false); err != ErrAlreadyRunning {
+		t.Errorf("expected error %v, got %v", ErrAlreadyRunning, err)
+	}
+
+	// Or waits for as long as it is allowed to
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, waited, err = acquireRunLock(ctx, path, true)
+	cancel()
+	if err != context.DeadlineExceeded || !waited {
+		t.Errorf("expected to wait until the deadline, got waited=%v and error %v", waited, err)
+	}
+
+	// Until the lock is released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lock.release()
+	}()
+	lock, waited, err = acquireRunLock(context.Background(), path, true)
+	if err != nil || !waited {
+		t.Fatalf("expected to acquire the lock after waiting, got waited=%v and error %v", waited, err)
+	}
+	if err = lock.release(); err != nil {
+		t.Errorf("unexpected error releasing the lock - %v", err)
+	}
+
+	// The lock is released with the process holding it, closing the file without unlocking is the same
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open the lock file - %v", err)
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("could not lock the lock file - %v", err)
+	}
+	f.Close()
+	if lock, _, err = acquireRunLock(context.Background(), path, false); err != nil {
+		t.Fatalf("expected to acquire the lock once its holder is gone, got error %v", err)
+	}
+	lock.release()
+}
+
+func TestBackupAlreadyRunning(t *testing.T) {
+	j := &helpers.JobInfo{VolumeName: fmt.Sprintf("tank/running%d", time.Now().UnixNano()), Destinations: []string{"file:///a"}}
+	path := runLockPath(j)
+	defer os.Remove(path)
+
+	lock, _, err := acquireRunLock(context.Background(), path, false)
+	if err != nil {
+		t.Fatalf("could not acquire the lock - %v", err)
+	}
+	defer lock.release()
+
+	if err = Backup(context.Background(), j); err != ErrAlreadyRunning {
+		t.Errorf("expected error %v, got %v", ErrAlreadyRunning, err)
+	}
+}
+
+func TestRollbackDecision(t *testing.T) {
+	testCases := []struct {
+		existed   bool
+		existsNow bool
+		action    rollbackAction
+	}{
+		{true, true, rollbackToCheckpoint},
+		{true, false, rollbackToCheckpoint},
+		// A restore into a new target created it before failing
+		{false, true, rollbackDestroyTarget},
+		{false, false, rollbackNothing},
+	}
+
+	for idx, c := range testCases {
+		checkpoint := &restoreCheckpoint{target: "tank/data", existed: c.existed}
+		if action := checkpoint.decide(c.existsNow); action != c.action {
+			t.Errorf("%d: expected rollback action %d, got %d", idx, c.action, action)
+		}
+	}
+}
+
+func TestRestoreRollback(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackuprollback")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to log the commands run and report datasets and snapshots from marker files
+	logPath := filepath.Join(workingDir, "commands")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %[1]s
+case "$1" in
+list)
+	if [ "$3" = "-o" ]; then
+		[ -e "%[2]s/$(echo "$5" | tr / _)" ] || { echo "cannot open '$5': dataset does not exist" >&2; exit 1; }
+	elif [ -e "%[2]s/snapshots" ]; then
+		printf 'tank/data@snap1\t1717210800\n'
+	fi ;;
+get) echo 1717210809 ;;
+esac
+`, logPath, workingDir)
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	checkpointName := regexp.MustCompile(restoreCheckpointPrefix + `[0-9]+`)
+	testCases := []struct {
+		rollback  bool
+		existed   bool
+		snapshots bool
+		// Whether the restore fails, and if so whether it got as far as creating the target
+		fails   bool
+		creates bool
+		// The commands run that change anything
+		commands []string
+	}{
+		{true, false, false, true, true, []string{"destroy -r tank/data"}},
+		{true, false, false, true, false, nil},
+		{true, false, false, false, true, nil},
+		{true, true, true, true, false, []string{"rollback -r tank/data@snap1"}},
+		{true, true, true, false, false, nil},
+		// A snapshot is only taken when the target has none to roll back to
+		{true, true, false, true, false, []string{"snapshot tank/data@zfsbackup-pre-restore-N", "rollback -r tank/data@zfsbackup-pre-restore-N", "destroy tank/data@zfsbackup-pre-restore-N"}},
+		{true, true, false, false, false, []string{"snapshot tank/data@zfsbackup-pre-restore-N", "destroy tank/data@zfsbackup-pre-restore-N"}},
+		{false, false, false, true, true, nil},
+	}
+
+	for idx, c := range testCases {
+		os.Remove(logPath)
+		os.Remove(filepath.Join(workingDir, "tank_data"))
+		os.Remove(filepath.Join(workingDir, "snapshots"))
+		if c.existed {
+			ioutil.WriteFile(filepath.Join(workingDir, "tank_data"), nil, 0600)
+		}
+		if c.snapshots {
+			ioutil.WriteFile(filepath.Join(workingDir, "snapshots"), nil, 0600)
+		}
+
+		j := &helpers.JobInfo{VolumeName: "tank/data", LocalVolume: "tank/data", RollbackOnFailure: c.rollback}
+		err = withRollback(context.Background(), j, func() error {
+			if c.creates {
+				ioutil.WriteFile(filepath.Join(workingDir, "tank_data"), nil, 0600)
+			}
+			if c.fails {
+				return errTest
+			}
+			return nil
+		})
+		if c.fails && err != errTest || !c.fails && err != nil {
+			t.Errorf("%d: expected the error of the restore to be returned, got %v", idx, err)
+		}
+
+		logged, _ := ioutil.ReadFile(logPath)
+		var commands []string
+		for _, command := range strings.Split(strings.TrimSpace(string(logged)), "\n") {
+			if command == "" || strings.HasPrefix(command, "list") || strings.HasPrefix(command, "get") {
+				continue
+			}
+			commands = append(commands, checkpointName.ReplaceAllString(command, restoreCheckpointPrefix+"N"))
+		}
+		if !reflect.DeepEqual(commands, c.commands) {
+			t.Errorf("%d: expected zfs commands %v, got %v", idx, c.commands, commands)
+		}
+	}
+}
+
+func TestKeyNormalizationRoundTrip(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	newJob := func(keyCase, datasetSep string) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:          "Tank/Data",
+			BaseSnapshot:        helpers.SnapshotInfo{Name: "Snap1"},
+			Compressor:          helpers.InternalCompressor,
+			CompressionLevel:    6,
+			Separator:           "|",
+			ManifestPrefix:      "manifests",
+			Destinations:        []string{destination},
+			MaxFileBuffer:       1,
+			MaxParallelUploads:  1,
+			KeyCase:             keyCase,
+			KeyDatasetSeparator: datasetSep,
+		}
+	}
+
+	// Backup a volume and its manifest with normalized keys
+	sent := newJob(helpers.KeyCaseLower, "+")
+	vol, err := helpers.CreateBackupVolume(context.Background(), sent, 1)
+	if err != nil {
+		t.Fatalf("could not create volume - %v", err)
+	}
+	if _, err = vol.Write([]byte("zfs stream")); err != nil {
+		t.Fatalf("could not write volume - %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("could not close volume - %v", err)
+	}
+	defer vol.DeleteVolume()
+	if err = uploadManifest(context.Background(), sent, vol, destination); err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+	sent.Volumes = []*helpers.VolumeInfo{vol}
+
+	manifestVol, err := saveManifest(context.Background(), sent, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+	if err = uploadManifest(context.Background(), sent, manifestVol, destination); err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+	if err = os.RemoveAll(localCachePath); err != nil {
+		t.Fatalf("could not clear the local cache - %v", err)
+	}
+
+	// Listing should find the backup set along with the normalization used
+	listJob := newJob("", "")
+	backend, err := prepareBackend(context.Background(), listJob, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+	if localCachePath, err = getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+	safeManifests, _, err := syncCache(context.Background(), listJob, localCachePath, backend)
+	if err != nil {
+		t.Fatalf("could not sync cache - %v", err)
+	}
+	listed, err := readAndSortManifests(context.Background(), localCachePath, safeManifests, listJob)
+	if err != nil {
+		t.Fatalf("could not read manifests - %v", err)
+	}
+	if len(listed) != 1 {
+		t.Fatalf("expected 1 backup set, got %d", len(listed))
+	}
+	if listed[0].VolumeName != "Tank/Data" || listed[0].KeyCase != helpers.KeyCaseLower || listed[0].KeyDatasetSeparator != "+" {
+		t.Errorf("expected the backup set of Tank/Data to record its key normalization, got %s with %q and %q", listed[0].VolumeName, listed[0].KeyCase, listed[0].KeyDatasetSeparator)
+	}
+
+	objects, err := backend.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("could not list objects - %v", err)
+	}
+	for _, volume := range listed[0].Volumes {
+		found := false
+		for _, obj := range objects {
+			found = found || obj == volume.ObjectName
+		}
+		if !found {
+			t.Errorf("volume %s recorded in the manifest was not found in %v", volume.ObjectName, objects)
+		}
+	}
+	if err = os.RemoveAll(localCachePath); err != nil {
+		t.Fatalf("could not clear the local cache - %v", err)
+	}
+
+	// Restoring should only resolve the manifest when using the same normalization
+	testCases := []struct {
+		keyCase    string
+		datasetSep string
+		valid      errTestFunc
+	}{
+		{helpers.KeyCaseLower, "+", nilErrTest},
+		{listed[0].KeyCase, listed[0].KeyDatasetSeparator, nilErrTest},
+		{helpers.KeyCasePreserve, "", nonNilErrTest},
+		{helpers.KeyCaseLower, "", nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		restoreJob := newJob(c.keyCase, c.datasetSep)
+		if localCachePath, err = getCacheDir(destination); err != nil {
+			t.Fatalf("%d: could not create cache dir - %v", idx, err)
+		}
+		manifest, ferr := fetchManifest(context.Background(), restoreJob, backend, localCachePath)
+		if !c.valid(ferr) {
+			t.Errorf("%d: error %v did not pass validation function", idx, ferr)
+			continue
+		}
+		if ferr == nil && manifest.VolumeName != "Tank/Data" {
+			t.Errorf("%d: expected the manifest for Tank/Data, got %s", idx, manifest.VolumeName)
+		}
+		os.RemoveAll(localCachePath)
+	}
+}
+
+func TestSingleObjectRoundTrip(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	payload := make([]byte, 3*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	payloadPath := filepath.Join(workingDir, "payload")
+	if err := ioutil.WriteFile(payloadPath, payload, 0600); err != nil {
+		t.Fatalf("could not write payload - %v", err)
+	}
+
+	// Fake the zfs binary to estimate, send, and receive the payload
+	receivedPath := filepath.Join(workingDir, "received")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "send" ] && [ "$2" = "-nP" ]; then
+	printf 'full\ttank/test@snap\t%d\nsize\t%d\n'
+elif [ "$1" = "send" ]; then
+	cat %s
+elif [ "$1" = "receive" ]; then
+	cat > %s
+fi
+`, len(payload), len(payload), payloadPath, receivedPath)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		VolumeSize:         1,
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Second,
+		MaxRetryTime:       time.Second,
+		LocalVolume:        "tank/restored",
+		SingleObjectBelow:  1,
+	}
+
+	// A stream estimated above the threshold is split into volumes
+	selectSingleObject(context.Background(), j)
+	if j.SingleObject {
+		t.Fatalf("expected a %d byte stream to not be streamed as a single object below 1 MiB", len(payload))
+	}
+	j.SingleObjectBelow = 4
+	selectSingleObject(context.Background(), j)
+	if !j.SingleObject {
+		t.Fatalf("expected a %d byte stream to be streamed as a single object below 4 MiB", len(payload))
+	}
+
+	// Stream the backup, uploading the object while it is being written
+	buffer := make(chan bool, 1)
+	buffer <- true
+	volumes := make(chan *helpers.VolumeInfo)
+	uploadErr := make(chan error, 1)
+	go func() {
+		var err error
+		for vol := range volumes {
+			j.Volumes = append(j.Volumes, vol)
+			if uerr := uploadManifest(context.Background(), j, vol, destination); uerr != nil && err == nil {
+				err = uerr
+			}
+		}
+		uploadErr <- err
+	}()
+	if err := sendStream(context.Background(), j, volumes, buffer, nil); err != nil {
+		t.Fatalf("could not send stream - %v", err)
+	}
+	if err := <-uploadErr; err != nil {
+		t.Fatalf("could not upload stream - %v", err)
+	}
+
+	if len(j.Volumes) != 1 {
+		t.Fatalf("expected a single object, got %d", len(j.Volumes))
+	}
+	if strings.Contains(j.Volumes[0].ObjectName, ".vol") {
+		t.Errorf("expected the single object %s to not carry a volume number", j.Volumes[0].ObjectName)
+	}
+
+	backend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+
+	testCases := []struct {
+		volumes []*helpers.VolumeInfo
+		valid   errTestFunc
+	}{
+		{[]*helpers.VolumeInfo{j.Volumes[0], j.Volumes[0]}, nonNilErrTest},
+		{j.Volumes, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		manifest := *j
+		manifest.Volumes = c.volumes
+		err = receiveManifest(context.Background(), j, &manifest, backend)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		received, rerr := ioutil.ReadFile(receivedPath)
+		if rerr != nil {
+			t.Errorf("%d: could not read received stream - %v", idx, rerr)
+		} else if !bytes.Equal(received, payload) {
+			t.Errorf("%d: received stream not equal to the original payload", idx)
+		}
+	}
+}
+
+func TestStreamDigest(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	payload := make([]byte, 3*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	payloadPath := filepath.Join(workingDir, "payload")
+	if err := ioutil.WriteFile(payloadPath, payload, 0600); err != nil {
+		t.Fatalf("could not write payload - %v", err)
+	}
+
+	// Fake the zfs binary to send and receive the payload
+	receivedPath := filepath.Join(workingDir, "received")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "send" ]; then
+	cat %s
+elif [ "$1" = "receive" ]; then
+	cat > %s
+fi
+`, payloadPath, receivedPath)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		VolumeSize:         1,
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Second,
+		MaxRetryTime:       time.Second,
+		LocalVolume:        "tank/restored",
+	}
+
+	buffer := make(chan bool, 10)
+	for i := 0; i < cap(buffer); i++ {
+		buffer <- true
+	}
+	volumes := make(chan *helpers.VolumeInfo, cap(buffer))
+	if err := sendStream(context.Background(), j, volumes, buffer, nil); err != nil {
+		t.Fatalf("could not send stream - %v", err)
+	}
+	for vol := range volumes {
+		defer vol.DeleteVolume()
+		if err := uploadManifest(context.Background(), j, vol, destination); err != nil {
+			t.Fatalf("could not upload volume %s - %v", vol.ObjectName, err)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+	if len(j.Volumes) < 2 {
+		t.Fatalf("expected the stream to be split into multiple volumes, got %d", len(j.Volumes))
+	}
+	if expected := fmt.Sprintf("%x", sha256.Sum256(payload)); j.StreamSHA256 != expected {
+		t.Fatalf("expected the stream digest %s to be recorded, got %s", expected, j.StreamSHA256)
+	}
+
+	backend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+
+	// Each volume passes its own checksum, only the order of the reassembly is wrong
+	reordered := append([]*helpers.VolumeInfo{j.Volumes[1], j.Volumes[0]}, j.Volumes[2:]...)
+
+	testCases := []struct {
+		volumes      []*helpers.VolumeInfo
+		verifyStream bool
+		streamSHA256 string
+		valid        errTestFunc
+		received     func([]byte) bool
+	}{
+		{j.Volumes, true, j.StreamSHA256, nilErrTest, func(b []byte) bool { return bytes.Equal(b, payload) }},
+		{reordered, true, j.StreamSHA256, func(e error) bool { return errors.Is(e, ErrStreamDigestMismatch) }, func(b []byte) bool { return len(b) == len(payload)-streamDigestHoldBack }},
+		{reordered, false, j.StreamSHA256, nilErrTest, func(b []byte) bool { return len(b) == len(payload) && !bytes.Equal(b, payload) }},
+		{j.Volumes, true, "", nonNilErrTest, nil},
+	}
+
+	for idx, c := range testCases {
+		os.Remove(receivedPath)
+		manifest := *j
+		manifest.Volumes = c.volumes
+		manifest.StreamSHA256 = c.streamSHA256
+		receiver := *j
+		receiver.VerifyStream = c.verifyStream
+		err = receiveManifest(context.Background(), &receiver, &manifest, backend)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if c.received == nil {
+			continue
+		}
+		received, rerr := ioutil.ReadFile(receivedPath)
+		if rerr != nil {
+			t.Errorf("%d: could not read received stream - %v", idx, rerr)
+		} else if !c.received(received) {
+			t.Errorf("%d: received stream of %d bytes did not pass validation function", idx, len(received))
+		}
+	}
+}
+
+func TestRestoreToFile(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	payload := make([]byte, 3*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	payloadPath := filepath.Join(workingDir, "payload")
+	if err := ioutil.WriteFile(payloadPath, payload, 0600); err != nil {
+		t.Fatalf("could not write payload - %v", err)
+	}
+
+	// Fake the zfs binary to send the payload, it should never be asked to receive it
+	receivedPath := filepath.Join(workingDir, "received")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "send" ]; then
+	cat %s
+elif [ "$1" = "receive" ]; then
+	cat > %s
+fi
+`, payloadPath, receivedPath)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		VolumeSize:         1,
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Second,
+		MaxRetryTime:       time.Second,
+	}
+
+	buffer := make(chan bool, 10)
+	for i := 0; i < cap(buffer); i++ {
+		buffer <- true
+	}
+	volumes := make(chan *helpers.VolumeInfo, cap(buffer))
+	if err := sendStream(context.Background(), j, volumes, buffer, nil); err != nil {
+		t.Fatalf("could not send stream - %v", err)
+	}
+	for vol := range volumes {
+		defer vol.DeleteVolume()
+		if err := uploadManifest(context.Background(), j, vol, destination); err != nil {
+			t.Fatalf("could not upload volume %s - %v", vol.ObjectName, err)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+	if len(j.Volumes) < 2 {
+		t.Fatalf("expected the stream to be split into multiple volumes, got %d", len(j.Volumes))
+	}
+
+	backend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+
+	existingPath := filepath.Join(workingDir, "existing.zfs")
+	if err = ioutil.WriteFile(existingPath, []byte("keep me"), 0600); err != nil {
+		t.Fatalf("could not write existing file - %v", err)
+	}
+	reordered := append([]*helpers.VolumeInfo{j.Volumes[1], j.Volumes[0]}, j.Volumes[2:]...)
+
+	testCases := []struct {
+		outputFile     string
+		volumes        []*helpers.VolumeInfo
+		streamSHA256   string
+		zfsStreamBytes uint64
+		valid          errTestFunc
+		written        func([]byte) bool
+	}{
+		{filepath.Join(workingDir, "verified.zfs"), j.Volumes, j.StreamSHA256, j.ZFSStreamBytes, nilErrTest, func(b []byte) bool { return bytes.Equal(b, payload) }},
+		// Legacy backup sets without a stream digest or size are still written
+		{filepath.Join(workingDir, "legacy.zfs"), j.Volumes, "", 0, nilErrTest, func(b []byte) bool { return bytes.Equal(b, payload) }},
+		{filepath.Join(workingDir, "reordered.zfs"), reordered, j.StreamSHA256, j.ZFSStreamBytes, func(e error) bool {
+			return errors.Is(e, ErrStreamDigestMismatch) && errors.Is(e, helpers.ErrChecksumMismatch)
+		}, nil},
+		{filepath.Join(workingDir, "huge.zfs"), j.Volumes, j.StreamSHA256, 1 << 62, func(e error) bool { return e == ErrInsufficientSpace }, nil},
+		{existingPath, j.Volumes, j.StreamSHA256, j.ZFSStreamBytes, nonNilErrTest, func(b []byte) bool { return string(b) == "keep me" }},
+	}
+
+	for idx, c := range testCases {
+		manifest := *j
+		manifest.Volumes = c.volumes
+		manifest.StreamSHA256 = c.streamSHA256
+		manifest.ZFSStreamBytes = c.zfsStreamBytes
+		receiver := *j
+		receiver.OutputFile = c.outputFile
+		err = receiveManifest(context.Background(), &receiver, &manifest, backend)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if _, serr := os.Stat(c.outputFile + ".partial"); !os.IsNotExist(serr) {
+			t.Errorf("%d: expected the partial file to be cleaned up, got %v", idx, serr)
+		}
+		written, rerr := ioutil.ReadFile(c.outputFile)
+		if c.written == nil {
+			if !os.IsNotExist(rerr) {
+				t.Errorf("%d: expected no file to be written, got %v", idx, rerr)
+			}
+			continue
+		}
+		if rerr != nil {
+			t.Errorf("%d: could not read written stream - %v", idx, rerr)
+		} else if !c.written(written) {
+			t.Errorf("%d: written stream of %d bytes did not pass validation function", idx, len(written))
+		}
+	}
+
+	if _, err = os.Stat(receivedPath); !os.IsNotExist(err) {
+		t.Errorf("expected zfs receive to never be called when writing to a file, got %v", err)
+	}
+}
+
+func TestObjectCountThresholds(t *testing.T) {
+	planCases := []struct {
+		job      *helpers.JobInfo
+		estimate uint64
+		planned  int
+	}{
+		{&helpers.JobInfo{VolumeSize: 1}, 3 * humanize.MiByte, 4},
+		{&helpers.JobInfo{VolumeSize: 1}, 3*humanize.MiByte + 1, 5},
+		{&helpers.JobInfo{VolumeSize: 1, GenerateRestoreScript: true}, 3 * humanize.MiByte, 5},
+		{&helpers.JobInfo{VolumeSize: 200}, 0, 2},
+		{&helpers.JobInfo{VolumeSize: 1, SingleObject: true}, 3 * humanize.MiByte, 2},
+	}
+
+	for idx, c := range planCases {
+		if planned := plannedObjectCount(c.job, c.estimate); planned != c.planned {
+			t.Errorf("%d: expected %d planned objects, got %d", idx, c.planned, planned)
+		}
+	}
+
+	checkCases := []struct {
+		existing, planned, warnAt, max int
+		valid                          errTestFunc
+	}{
+		{10, 5, 0, 0, nilErrTest},
+		{10, 5, 12, 0, nilErrTest},
+		{10, 5, 12, 15, nilErrTest},
+		{10, 5, 12, 14, func(e error) bool { return e == ErrTooManyObjects }},
+		{10, 5, 0, 14, func(e error) bool { return e == ErrTooManyObjects }},
+	}
+
+	for idx, c := range checkCases {
+		if err := checkObjectCount("file:///backups", c.existing, c.planned, c.warnAt, c.max); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+
+	// The existing objects are listed from the destination and the new volumes planned from an estimate
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(filepath.Join(strings.TrimPrefix(destination, "file://"), fmt.Sprintf("object%d", i)), nil, 0600); err != nil {
+			t.Fatalf("could not write object - %v", err)
+		}
+	}
+
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "send" ] && [ "$2" = "-nP" ]; then
+	printf 'full\ttank/test@snap\t%d\nsize\t%d\n'
+fi
+`, 3*humanize.MiByte, 3*humanize.MiByte)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		max   int
+		valid errTestFunc
+	}{
+		{9, nilErrTest},
+		{8, func(e error) bool { return e == ErrTooManyObjects }},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			VolumeName:     "tank/test",
+			BaseSnapshot:   helpers.SnapshotInfo{Name: "snap"},
+			Destinations:   []string{destination},
+			VolumeSize:     1,
+			MaxObjectCount: c.max,
+		}
+		if err := checkDestinationObjectCounts(context.Background(), j); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+}
+
+func TestScratchThresholds(t *testing.T) {
+	estimateCases := []struct {
+		job           *helpers.JobInfo
+		bytes, inodes uint64
+	}{
+		{&helpers.JobInfo{VolumeSize: 200, MaxFileBuffer: 5}, 1000 * humanize.MiByte, 6},
+		{&helpers.JobInfo{VolumeSize: 1, MaxFileBuffer: 1}, humanize.MiByte, 2},
+		{&helpers.JobInfo{VolumeSize: 200, MaxFileBuffer: 0}, 0, 0},
+		{&helpers.JobInfo{VolumeSize: 200, MaxFileBuffer: 5, SingleObject: true}, 0, 0},
+	}
+
+	for idx, c := range estimateCases {
+		if bytes, inodes := estimateScratchUsage(c.job); bytes != c.bytes || inodes != c.inodes {
+			t.Errorf("%d: expected %d bytes and %d inodes, got %d bytes and %d inodes", idx, c.bytes, c.inodes, bytes, inodes)
+		}
+	}
+
+	insufficient := func(e error) bool { return e == ErrInsufficientScratch }
+	checkCases := []struct {
+		bytes, inodes, availBytes, availInodes, totalInodes uint64
+		fail                                                bool
+		valid                                               errTestFunc
+	}{
+		{100, 6, 100, 6, 10, true, nilErrTest},
+		{100, 6, 99, 6, 10, true, insufficient},
+		{100, 6, 100, 5, 10, true, insufficient},
+		{100, 6, 99, 5, 10, false, nilErrTest},
+		// Filesystems not reporting their inodes are only checked for free space
+		{100, 6, 100, 0, 0, true, nilErrTest},
+		{100, 6, 99, 0, 0, true, insufficient},
+	}
+
+	for idx, c := range checkCases {
+		if err := checkScratchUsage("/tmp", c.bytes, c.inodes, c.availBytes, c.availInodes, c.totalInodes, c.fail); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+
+	// No scratch filesystem can hold five volumes of an EiB
+	testCases := []struct {
+		check      string
+		volumeSize uint64
+		valid      errTestFunc
+	}{
+		{helpers.ScratchCheckFail, 1, nilErrTest},
+		{helpers.ScratchCheckFail, 1 << 40, insufficient},
+		{helpers.ScratchCheckWarn, 1 << 40, nilErrTest},
+		{helpers.ScratchCheckOff, 1 << 40, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{VolumeSize: c.volumeSize, MaxFileBuffer: 5, ScratchCheck: c.check}
+		if err := checkScratchSpace(j); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+}
+
+func TestDestinationSpace(t *testing.T) {
+	insufficient := func(e error) bool { return e == ErrInsufficientDestinationSpace }
+	checkCases := []struct {
+		estimate, available, minFree uint64
+		valid                        errTestFunc
+	}{
+		{100, 100, 0, nilErrTest},
+		{100, 99, 0, insufficient},
+		{100, 150, 50, nilErrTest},
+		{100, 150, 51, insufficient},
+		{0, 10, 20, insufficient},
+	}
+
+	for idx, c := range checkCases {
+		if err := checkFreeSpace("file:///backups", c.estimate, c.available, c.minFree); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+
+	// The file backend reports the free space of its filesystem, the memory backend does not report any
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "send" ] && [ "$2" = "-nP" ]; then
+	printf 'full\ttank/test@snap\t%d\nsize\t%d\n'
+fi
+`, 3*humanize.MiByte, 3*humanize.MiByte)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		destination string
+		minFree     uint64
+		valid       errTestFunc
+	}{
+		{destination, 0, nilErrTest},
+		{destination, 1 << 40, insufficient},
+		{"mem://freespace", 1 << 40, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			VolumeName:   "tank/test",
+			BaseSnapshot: helpers.SnapshotInfo{Name: "snap"},
+			Destinations: []string{c.destination},
+			MinFreeSpace: c.minFree,
+		}
+		if err := checkDestinationSpace(context.Background(), j); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	// Load a key ring with the expected signer and another known key
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	expected, err := openpgp.NewEntity("expected", "", "expected@example.com", config)
+	if err != nil {
+		t.Fatalf("could not generate key - %v", err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", config)
+	if err != nil {
+		t.Fatalf("could not generate key - %v", err)
+	}
+	ringPath := filepath.Join(workingDir, "secring.asc")
+	ringFile, err := os.Create(ringPath)
+	if err != nil {
+		t.Fatalf("could not create key ring - %v", err)
+	}
+	armored, err := armor.Encode(ringFile, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("could not create key ring - %v", err)
+	}
+	for _, entity := range []*openpgp.Entity{expected, other} {
+		if err = entity.SerializePrivate(armored, config); err != nil {
+			t.Fatalf("could not write key ring - %v", err)
+		}
+	}
+	armored.Close()
+	ringFile.Close()
+	if err = helpers.LoadPrivateRing(ringPath); err != nil {
+		t.Fatalf("could not load key ring - %v", err)
+	}
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		EncryptKey:         expected,
+	}
+
+	// Upload a validly signed, a tampered, and a volume signed by another key
+	signers := []*openpgp.Entity{expected, expected, other}
+	for idx, signer := range signers {
+		j.SignKey = signer
+		vol, verr := helpers.CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if verr != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, verr)
+		}
+		if _, verr = vol.Write(bytes.Repeat([]byte("zfs stream"), 64*1024)); verr != nil {
+			t.Fatalf("%d: could not write volume - %v", idx, verr)
+		}
+		if verr = vol.Close(); verr != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, verr)
+		}
+		defer vol.DeleteVolume()
+		if verr = uploadManifest(context.Background(), j, vol, destination); verr != nil {
+			t.Fatalf("%d: could not upload volume - %v", idx, verr)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+	tamper := func(objectName string) {
+		objectPath := filepath.Join(strings.TrimPrefix(destination, "file://"), objectName)
+		data, terr := ioutil.ReadFile(objectPath)
+		if terr != nil {
+			t.Fatalf("could not read %s - %v", objectName, terr)
+		}
+		data[len(data)/2] ^= 0xff
+		if terr = ioutil.WriteFile(objectPath, data, 0600); terr != nil {
+			t.Fatalf("could not tamper with %s - %v", objectName, terr)
+		}
+	}
+	tamper(j.Volumes[1].ObjectName)
+
+	if _, err = getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+	j.SignKey = expected
+	manifestVol, err := saveManifest(context.Background(), j, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+	if err = uploadManifest(context.Background(), j, manifestVol, destination); err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+
+	oldStdout := helpers.Stdout
+	helpers.JSONOutput = true
+	defer func() {
+		helpers.Stdout = oldStdout
+		helpers.JSONOutput = false
+	}()
+
+	verify := func(trustedSigners ...string) ([]SignatureResult, error) {
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		verifyJob := &helpers.JobInfo{
+			VolumeName:     j.VolumeName,
+			BaseSnapshot:   j.BaseSnapshot,
+			Separator:      j.Separator,
+			ManifestPrefix: j.ManifestPrefix,
+			Destinations:   j.Destinations,
+			EncryptKey:     expected,
+			SignKey:        expected,
+			TrustedSigners: trustedSigners,
+		}
+		verr := VerifySignatures(context.Background(), verifyJob)
+		var results []SignatureResult
+		if jerr := json.Unmarshal(out.Bytes(), &results); jerr != nil {
+			t.Fatalf("could not decode report %q - %v", out.String(), jerr)
+		}
+		return results, verr
+	}
+
+	results, err := verify()
+	if err != errSignatureVerificationFailed {
+		t.Errorf("expected signature verification to fail, got %v", err)
+	}
+	testCases := []struct {
+		object string
+		signer *openpgp.Entity
+		valid  bool
+	}{
+		{manifestVol.ObjectName, expected, true},
+		{j.Volumes[0].ObjectName, expected, true},
+		{j.Volumes[1].ObjectName, nil, false},
+		{j.Volumes[2].ObjectName, other, false},
+	}
+	if len(results) != len(testCases) {
+		t.Fatalf("expected %d results, got %d", len(testCases), len(results))
+	}
+	for idx, c := range testCases {
+		if results[idx].Object != c.object || results[idx].Valid != c.valid {
+			t.Errorf("%d: expected %s to be valid=%v, got %s valid=%v (%s)", idx, c.object, c.valid, results[idx].Object, results[idx].Valid, results[idx].Error)
+		}
+		if c.signer != nil && results[idx].SignerKeyID != c.signer.PrimaryKey.KeyIdString() {
+			t.Errorf("%d: expected signer %s, got %s", idx, c.signer.PrimaryKey.KeyIdString(), results[idx].SignerKeyID)
+		}
+	}
+
+	// Signatures by keys in the keyring that are not trusted signers should be rejected
+	results, err = verify(other.PrimaryKey.KeyIdString())
+	if err != errSignatureVerificationFailed {
+		t.Errorf("expected signature verification to fail, got %v", err)
+	}
+	if len(results) != 1 || results[0].Valid || results[0].Error != helpers.ErrUntrustedSigner.Error() {
+		t.Errorf("expected the manifest to be reported as signed by an untrusted key, got %v", results)
+	}
+	if _, err = verify(expected.PrimaryKey.KeyIdString()); err != errSignatureVerificationFailed {
+		t.Errorf("expected signature verification of the tampered and other volumes to fail, got %v", err)
+	}
+
+	// A tampered manifest should not be trusted to list the volumes
+	tamper(manifestVol.ObjectName)
+	results, err = verify()
+	if err != errSignatureVerificationFailed {
+		t.Errorf("expected signature verification to fail, got %v", err)
+	}
+	if len(results) != 1 || results[0].Valid {
+		t.Errorf("expected only the manifest to be reported as invalid, got %v", results)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		vol, verr := helpers.CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if verr != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, verr)
+		}
+		if _, verr = vol.Write(bytes.Repeat([]byte(fmt.Sprintf("zfs stream %d", idx)), 64*1024)); verr != nil {
+			t.Fatalf("%d: could not write volume - %v", idx, verr)
+		}
+		if verr = vol.Close(); verr != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, verr)
+		}
+		defer vol.DeleteVolume()
+		if verr = uploadManifest(context.Background(), j, vol, destination); verr != nil {
+			t.Fatalf("%d: could not upload volume - %v", idx, verr)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+
+	if _, err := getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+	manifestVol, err := saveManifest(context.Background(), j, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+	if err = uploadManifest(context.Background(), j, manifestVol, destination); err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+	if j.MerkleRoot == "" {
+		t.Fatalf("expected the manifest to record a merkle root")
+	}
+
+	oldStdout := helpers.Stdout
+	helpers.JSONOutput = true
+	defer func() {
+		helpers.Stdout = oldStdout
+		helpers.JSONOutput = false
+	}()
+
+	verify := func(rootOnly bool) ([]IntegrityResult, error) {
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		verifyJob := &helpers.JobInfo{
+			VolumeName:     j.VolumeName,
+			BaseSnapshot:   j.BaseSnapshot,
+			Separator:      j.Separator,
+			ManifestPrefix: j.ManifestPrefix,
+			Destinations:   j.Destinations,
+		}
+		verr := VerifyIntegrity(context.Background(), verifyJob, rootOnly)
+		var results []IntegrityResult
+		if jerr := json.Unmarshal(out.Bytes(), &results); jerr != nil {
+			t.Fatalf("could not decode report %q - %v", out.String(), jerr)
+		}
+		return results, verr
+	}
+
+	results, err := verify(false)
+	if err != nil {
+		t.Errorf("expected the backup set to pass integrity verification, got %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+
+	// Alter a single volume at the destination
+	objectPath := filepath.Join(strings.TrimPrefix(destination, "file://"), j.Volumes[1].ObjectName)
+	data, err := ioutil.ReadFile(objectPath)
+	if err != nil {
+		t.Fatalf("could not read %s - %v", j.Volumes[1].ObjectName, err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err = ioutil.WriteFile(objectPath, data, 0600); err != nil {
+		t.Fatalf("could not alter %s - %v", j.Volumes[1].ObjectName, err)
+	}
+
+	results, err = verify(false)
+	if err != errIntegrityVerificationFailed {
+		t.Errorf("expected integrity verification to fail, got %v", err)
+	}
+	testCases := []struct {
+		object string
+		valid  bool
+	}{
+		{"merkle root " + j.MerkleRoot, true},
+		{j.Volumes[0].ObjectName, true},
+		{j.Volumes[1].ObjectName, false},
+		{j.Volumes[2].ObjectName, true},
+	}
+	if len(results) != len(testCases) {
+		t.Fatalf("expected %d results, got %d", len(testCases), len(results))
+	}
+	for idx, c := range testCases {
+		if results[idx].Object != c.object || results[idx].Valid != c.valid {
+			t.Errorf("%d: expected %s to be valid=%v, got %s valid=%v (%s)", idx, c.object, c.valid, results[idx].Object, results[idx].Valid, results[idx].Error)
+		}
+	}
+
+	// Only the root is checked against the manifest without downloading the volumes
+	if results, err = verify(true); err != nil || len(results) != 1 {
+		t.Errorf("expected only the merkle root to be verified, got %v - %v", results, err)
+	}
+}
+
+func TestVerifyHashAlgorithms(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	// A group mixing a set recorded with md5 and a set inheriting sha256 from the group
+	group := &helpers.JobInfo{
+		VolumeName:         "backups",
+		GroupName:          "backups",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		HashAlgorithm:      helpers.SHA256Hash,
+		Destinations:       []string{destination},
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		GroupMembers: []*helpers.JobInfo{
+			{VolumeName: "tank/old", BaseSnapshot: helpers.SnapshotInfo{Name: "snap"}, HashAlgorithm: helpers.MD5Hash},
+			{VolumeName: "tank/new", BaseSnapshot: helpers.SnapshotInfo{Name: "snap"}},
+		},
+	}
+
+	for idx, member := range group.GroupMembers {
+		member.Compressor, member.Separator, member.Destinations = group.Compressor, group.Separator, group.Destinations
+		member.MaxFileBuffer, member.MaxParallelUploads = 1, 1
+		vol, verr := helpers.CreateBackupVolume(context.Background(), member, 1)
+		if verr != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, verr)
+		}
+		if _, verr = vol.Write(bytes.Repeat([]byte(member.VolumeName), 1024)); verr != nil {
+			t.Fatalf("%d: could not write volume - %v", idx, verr)
+		}
+		if verr = vol.Close(); verr != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, verr)
+		}
+		defer vol.DeleteVolume()
+		if verr = uploadManifest(context.Background(), member, vol, destination); verr != nil {
+			t.Fatalf("%d: could not upload volume - %v", idx, verr)
+		}
+		member.Volumes = append(member.Volumes, vol)
+	}
+	if md5Vol := group.GroupMembers[0].Volumes[0]; md5Vol.MD5Sum == "" || md5Vol.HashSum != "" {
+		t.Fatalf("expected the volume of the md5 set to record its md5 checksum once")
+	}
+
+	if _, err := getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+	manifestVol, err := saveManifest(context.Background(), group, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+	if err = uploadManifest(context.Background(), group, manifestVol, destination); err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+
+	oldStdout := helpers.Stdout
+	helpers.JSONOutput = true
+	defer func() {
+		helpers.Stdout = oldStdout
+		helpers.JSONOutput = false
+	}()
+
+	testCases := []struct {
+		strict  bool
+		valid   errTestFunc
+		results []bool
+	}{
+		{false, nilErrTest, []bool{true, true, true}},
+		// The md5 set is flagged, its volume still verifies with md5
+		{true, func(e error) bool { return e == errIntegrityVerificationFailed }, []bool{true, false, true, true}},
+	}
+
+	for idx, c := range testCases {
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		verifyJob := &helpers.JobInfo{
+			VolumeName:          group.VolumeName,
+			BaseSnapshot:        group.BaseSnapshot,
+			Separator:           group.Separator,
+			ManifestPrefix:      group.ManifestPrefix,
+			Destinations:        group.Destinations,
+			HashAlgorithm:       helpers.SHA256Hash,
+			StrictHashAlgorithm: c.strict,
+		}
+		verr := VerifyIntegrity(context.Background(), verifyJob, false)
+		if !c.valid(verr) {
+			t.Errorf("%d: error %v did not pass validation function", idx, verr)
+		}
+		var results []IntegrityResult
+		if jerr := json.Unmarshal(out.Bytes(), &results); jerr != nil {
+			t.Fatalf("%d: could not decode report %q - %v", idx, out.String(), jerr)
+		}
+		if len(results) != len(c.results) {
+			t.Errorf("%d: expected %d results, got %v", idx, len(c.results), results)
+			continue
+		}
+		for ridx, valid := range c.results {
+			if results[ridx].Valid != valid {
+				t.Errorf("%d: expected result %d to be valid=%v, got %v", idx, ridx, valid, results[ridx])
+			}
+		}
+	}
+
+	// Volumes are hashed with the algorithm recorded for them, falling back to SHA256
+	backend, err := prepareBackend(context.Background(), group, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+	vol := group.GroupMembers[0].Volumes[0]
+	checksumCases := []struct {
+		algorithm string
+		sha256Sum string
+		md5Sum    string
+		hashSum   string
+		valid     bool
+	}{
+		{helpers.MD5Hash, vol.SHA256Sum, vol.MD5Sum, "", true},
+		{helpers.MD5Hash, vol.SHA256Sum, vol.SHA256Sum, "", false},
+		{"", vol.SHA256Sum, vol.MD5Sum, "", true},
+		// Volumes without a checksum computed with their algorithm are verified with their SHA256 checksum
+		{helpers.MD5Hash, vol.SHA256Sum, "", "", true},
+		{helpers.SHA256Hash, vol.MD5Sum, vol.MD5Sum, "", false},
+		{"unregistered", vol.SHA256Sum, vol.MD5Sum, vol.MD5Sum, false},
+	}
+
+	for idx, c := range checksumCases {
+		check := &helpers.VolumeInfo{ObjectName: vol.ObjectName, SHA256Sum: c.sha256Sum, MD5Sum: c.md5Sum, HashSum: c.hashSum}
+		results := verifyVolumeChecksums(context.Background(), backend, []*helpers.VolumeInfo{check}, map[*helpers.VolumeInfo]string{check: c.algorithm})
+		if len(results) != 1 || results[0].Valid != c.valid {
+			t.Errorf("%d: expected the volume to be valid=%v with %q, got %v", idx, c.valid, c.algorithm, results)
+		}
+	}
+}
+
+func TestBackupDatasetsFailureThreshold(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	// Fake the zfs binary so datasets with "fail" in their name fail to send
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+if [ "$1" = "list" ]; then
+	for dataset; do :; done
+	printf '%s@snap\t1600000000\n' "$dataset"
+	exit 0
+fi
+case "$*" in
+	*fail*) exit 1 ;;
+esac
+echo zfs stream
+`
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	newJob := func(volume string) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volume,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap", CreationTime: time.Unix(1600000000, 0)},
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+		}
+	}
+	datasets := []string{"tank/fail1", "tank/ok1", "tank/fail2", "tank/ok2", "tank/fail3"}
+
+	testCases := []struct {
+		threshold string
+		backedUp  []string
+		valid     errTestFunc
+	}{
+		{"", []string{"tank/ok1", "tank/ok2"}, func(e error) bool { return e != nil && e != ErrTooManyFailures && ExitStatus(e) == ExitPartialBackup }},
+		{"3", []string{"tank/ok1", "tank/ok2"}, func(e error) bool { return e != nil && e != ErrTooManyFailures && ExitStatus(e) == ExitPartialBackup }},
+		{"1", []string{"tank/ok1"}, func(e error) bool { return e == ErrTooManyFailures }},
+		{"20%", []string{"tank/ok1"}, func(e error) bool { return e == ErrTooManyFailures }},
+		{"40%", []string{"tank/ok1", "tank/ok2"}, func(e error) bool { return e == ErrTooManyFailures }},
+		{"0", nil, func(e error) bool { return e == ErrTooManyFailures }},
+	}
+
+	for idx, c := range testCases {
+		os.RemoveAll(target)
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatalf("%d: could not create target - %v", idx, err)
+		}
+		localCachePath, err := getCacheDir(destination)
+		if err != nil {
+			t.Fatalf("%d: could not get cache dir - %v", idx, err)
+		}
+		os.RemoveAll(localCachePath)
+
+		run := newJob("")
+		run.MaxFailures = c.threshold
+		for _, dataset := range datasets {
+			run.Datasets = append(run.Datasets, newJob(dataset))
+		}
+		err = BackupDatasets(context.Background(), run)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+
+		backend, err := prepareBackend(context.Background(), run, destination, nil)
+		if err != nil {
+			t.Fatalf("%d: could not prepare backend - %v", idx, err)
+		}
+		manifests, err := backend.List(context.Background(), "manifests")
+		backend.Close()
+		if err != nil {
+			t.Fatalf("%d: could not list manifests - %v", idx, err)
+		}
+		if len(manifests) != len(c.backedUp) {
+			t.Errorf("%d: expected %d datasets to be backed up, found manifests %v", idx, len(c.backedUp), manifests)
+			continue
+		}
+		for _, dataset := range c.backedUp {
+			found := false
+			for _, manifest := range manifests {
+				found = found || strings.Contains(manifest, dataset+"|")
+			}
+			if !found {
+				t.Errorf("%d: expected %s to be backed up, found manifests %v", idx, dataset, manifests)
+			}
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	// Fake the zfs binary so datasets with "fail" in their name fail to send
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+if [ "$1" = "list" ]; then
+	for dataset; do :; done
+	printf '%s@snap\t1600000000\n' "$dataset"
+	exit 0
+fi
+case "$*" in
+	*fail*) exit 1 ;;
+esac
+echo zfs stream
+`
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	exporter := tracetest.NewInMemoryExporter()
+	origProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(origProvider)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	testCases := []struct {
+		volume  string
+		uploads bool
+		valid   errTestFunc
+	}{
+		{"tank/ok", true, nilErrTest},
+		{"tank/fail", false, nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		exporter.Reset()
+		os.RemoveAll(target)
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatalf("%d: could not create target - %v", idx, err)
+		}
+
+		j := &helpers.JobInfo{
+			VolumeName:         c.volume,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap", CreationTime: time.Unix(1600000000, 0)},
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+		}
+		if err := Backup(context.Background(), j); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+
+		var backupSpan *tracetest.SpanStub
+		var uploads []tracetest.SpanStub
+		for _, span := range exporter.GetSpans() {
+			switch span.Name {
+			case "backup":
+				span := span
+				backupSpan = &span
+			case "upload":
+				uploads = append(uploads, span)
+			}
+		}
+		if backupSpan == nil {
+			t.Errorf("%d: expected a backup span to be recorded", idx)
+			continue
+		}
+
+		var dataset string
+		for _, attr := range backupSpan.Attributes {
+			if attr.Key == "zfs.dataset" {
+				dataset = attr.Value.AsString()
+			}
+		}
+		if dataset != c.volume {
+			t.Errorf("%d: expected the backup span to record dataset %s, got %q", idx, c.volume, dataset)
+		}
+		if failed := backupSpan.Status.Code == codes.Error; failed == c.uploads {
+			t.Errorf("%d: unexpected status %v recorded on the backup span", idx, backupSpan.Status)
+		}
+
+		if c.uploads && len(uploads) == 0 {
+			t.Errorf("%d: expected upload spans to be recorded", idx)
+		} else if !c.uploads && len(uploads) != 0 {
+			t.Errorf("%d: did not expect upload spans to be recorded, got %d", idx, len(uploads))
+		}
+		backendUploads := make(map[string]int)
+		for _, upload := range uploads {
+			if upload.Parent.SpanID() != backupSpan.SpanContext.SpanID() {
+				t.Errorf("%d: expected upload span %v to be a child of the backup span", idx, upload.Attributes)
+			}
+			if upload.SpanContext.TraceID() != backupSpan.SpanContext.TraceID() {
+				t.Errorf("%d: expected upload span %v to share the backup span's trace", idx, upload.Attributes)
+			}
+			for _, attr := range upload.Attributes {
+				if attr.Key == "zfsbackup.backend" {
+					backendUploads[attr.Value.AsString()]++
+				}
+			}
+		}
+		if c.uploads && backendUploads["file"] == 0 {
+			t.Errorf("%d: expected upload spans for the file backend, got %v", idx, backendUploads)
+		}
+	}
+}
+
+func TestSnapshotChange(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	// Fake the zfs binary so the first send fails, having the snapshot destroyed and created again unless the
+	// mode is fail, or destroyed and not created again if the mode is destroy
+	state := filepath.Join(workingDir, "state")
+	if err := os.Mkdir(state, 0755); err != nil {
+		t.Fatalf("could not create state dir - %v", err)
+	}
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+state=%s
+mode=$(cat $state/mode)
+for last; do :; done
+guid=111
+creation=1600000000
+if [ -f $state/changed ]; then
+	if [ "$mode" = destroy ]; then
+		[ "$1" = get ] && echo "cannot open '$last': dataset does not exist" >&2 && exit 1
+		[ "$1" = list ] && exit 0
+	fi
+	guid=222
+	creation=1600000100
+fi
+case "$1" in
+	list) printf '%%s@snap\t%%s\n' "$last" $creation ;;
+	get) if [ "$6" = guid ]; then echo $guid; else echo $creation; fi ;;
+	send)
+		if [ ! -f $state/sent ]; then
+			touch $state/sent
+			[ "$mode" != fail ] && touch $state/changed
+			exit 1
+		fi
+		echo zfs stream ;;
+esac
+`, state)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		mode     string
+		policy   string
+		guid     string
+		backedUp bool
+		valid    errTestFunc
+	}{
+		{"recreate", helpers.SnapshotChangeAbort, "111", false, func(e error) bool { return e == ErrSnapshotChanged }},
+		{"recreate", helpers.SnapshotChangeRestart, "222", true, nilErrTest},
+		{"destroy", helpers.SnapshotChangeRestart, "111", false, func(e error) bool { return e == ErrSnapshotChanged }},
+		// A send failing for any other reason is not mistaken for a snapshot change
+		{"fail", helpers.SnapshotChangeRestart, "111", false, func(e error) bool { return e != nil && e != ErrSnapshotChanged }},
+	}
+
+	for idx, c := range testCases {
+		os.RemoveAll(target)
+		os.Remove(filepath.Join(state, "sent"))
+		os.Remove(filepath.Join(state, "changed"))
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatalf("%d: could not create target - %v", idx, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(state, "mode"), []byte(c.mode), 0600); err != nil {
+			t.Fatalf("%d: could not write mode - %v", idx, err)
+		}
+
+		j := &helpers.JobInfo{
+			VolumeName:         "tank/test",
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap", CreationTime: time.Unix(1600000000, 0)},
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+			OnSnapshotChange:   c.policy,
+		}
+		if err := Backup(context.Background(), j); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+		if j.BaseSnapshot.GUID != c.guid {
+			t.Errorf("%d: expected the snapshot GUID %s to be recorded, got %s", idx, c.guid, j.BaseSnapshot.GUID)
+		}
+		if len(j.Destinations) != 2 {
+			t.Errorf("%d: expected the destinations to be set up once, got %v", idx, j.Destinations)
+		}
+
+		manifests, _ := filepath.Glob(filepath.Join(target, "manifests*"))
+		if backedUp := len(manifests) > 0; backedUp != c.backedUp {
+			t.Errorf("%d: expected backed up to be %v, found manifests %v", idx, c.backedUp, manifests)
+		}
+		if c.backedUp && !j.BaseSnapshot.CreationTime.Equal(time.Unix(1600000100, 0)) {
+			t.Errorf("%d: expected the creation time of the snapshot created again, got %v", idx, j.BaseSnapshot.CreationTime)
+		}
+	}
+}
+
+func TestDatasetOverrides(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+if [ "$1" = "list" ]; then
+	for dataset; do :; done
+	printf '%s@snap\t1600000000\n' "$dataset"
+	exit 0
+fi
+echo zfs stream
+`
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	key, err := openpgp.NewEntity("backup", "", "backup@example.com", config)
+	if err != nil {
+		t.Fatalf("could not generate key - %v", err)
+	}
+	ringPath := filepath.Join(workingDir, "secring.asc")
+	ringFile, err := os.Create(ringPath)
+	if err != nil {
+		t.Fatalf("could not create key ring - %v", err)
+	}
+	armored, err := armor.Encode(ringFile, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("could not create key ring - %v", err)
+	}
+	if err = key.SerializePrivate(armored, config); err != nil {
+		t.Fatalf("could not write key ring - %v", err)
+	}
+	armored.Close()
+	ringFile.Close()
+	if err = helpers.LoadPrivateRing(ringPath); err != nil {
+		t.Fatalf("could not load key ring - %v", err)
+	}
+
+	// Everything is compressed and encrypted globally, except for the overridden dataset
+	overrides := []string{"tank/media:compressor=none,encryptTo=none"}
+	newJob := func(volume string) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volume,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap", CreationTime: time.Unix(1600000000, 0)},
+			Compressor:         helpers.ZstdCompressor,
+			CompressionLevel:   6,
+			EncryptTo:          "backup@example.com",
+			EncryptKey:         key,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+			DatasetOverrides:   overrides,
+		}
+	}
+
+	testCases := []struct {
+		dataset    string
+		compressor string
+		encrypted  bool
+	}{
+		{"tank/db", helpers.ZstdCompressor, true},
+		{"tank/media", helpers.NoCompressor, false},
+	}
+
+	run := newJob("tank/db,tank/media")
+	for _, c := range testCases {
+		dataset := newJob(c.dataset)
+		if err = dataset.ApplyDatasetOverride(); err != nil {
+			t.Fatalf("could not apply dataset override for %s - %v", c.dataset, err)
+		}
+		run.Datasets = append(run.Datasets, dataset)
+	}
+	if err = BackupDatasets(context.Background(), run); err != nil {
+		t.Fatalf("could not backup datasets - %v", err)
+	}
+
+	backend, err := prepareBackend(context.Background(), run, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not get cache dir - %v", err)
+	}
+
+	for idx, c := range testCases {
+		// Each manifest is read with the keys it was written with
+		reader := &helpers.JobInfo{
+			VolumeName:     c.dataset,
+			BaseSnapshot:   helpers.SnapshotInfo{Name: "snap"},
+			Separator:      "|",
+			ManifestPrefix: "manifests",
+		}
+		if c.encrypted {
+			reader.EncryptKey = key
+		}
+		manifestPath, merr := syncManifest(context.Background(), reader, backend, localCachePath)
+		if merr != nil {
+			t.Errorf("%d: could not sync manifest for %s - %v", idx, c.dataset, merr)
+			continue
+		}
+		manifest, merr := readManifest(context.Background(), manifestPath, reader)
+		if merr != nil {
+			t.Errorf("%d: could not read manifest for %s - %v", idx, c.dataset, merr)
+			continue
+		}
+
+		if manifest.Compressor != c.compressor {
+			t.Errorf("%d: expected the manifest for %s to record the compressor %s, got %s", idx, c.dataset, c.compressor, manifest.Compressor)
+		}
+		if (manifest.EncryptTo != "") != c.encrypted {
+			t.Errorf("%d: expected the manifest for %s to record encrypted=%v, got encryptTo %q", idx, c.dataset, c.encrypted, manifest.EncryptTo)
+		}
+		for _, vol := range manifest.Volumes {
+			if strings.Contains(vol.ObjectName, ".pgp.") != c.encrypted {
+				t.Errorf("%d: expected volume %s to be encrypted=%v", idx, vol.ObjectName, c.encrypted)
+			}
+		}
+	}
+}
+
+func TestCustomHashRoundTrip(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	if _, err := helpers.GetHash("fnv128a"); err != nil {
+		if err = helpers.RegisterHash("fnv128a", fnv.New128a); err != nil {
+			t.Fatalf("could not register hash - %v", err)
+		}
+	}
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		HashAlgorithm:      "fnv128a",
+	}
+
+	vol, err := helpers.CreateBackupVolume(context.Background(), j, 1)
+	if err != nil {
+		t.Fatalf("could not create volume - %v", err)
+	}
+	if _, err = vol.Write(bytes.Repeat([]byte("zfs stream"), 64*1024)); err != nil {
+		t.Fatalf("could not write volume - %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("could not close volume - %v", err)
+	}
+	defer vol.DeleteVolume()
+	if err = uploadManifest(context.Background(), j, vol, destination); err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+	j.Volumes = []*helpers.VolumeInfo{vol}
+
+	// The algorithm and checksum should survive the manifest
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		t.Fatalf("could not encode manifest - %v", err)
+	}
+	manifest := new(helpers.JobInfo)
+	if err = json.Unmarshal(encoded, manifest); err != nil {
+		t.Fatalf("could not decode manifest - %v", err)
+	}
+	if manifest.HashAlgorithm != "fnv128a" || manifest.Volumes[0].HashSum == "" || manifest.Volumes[0].HashSum != vol.HashSum {
+		t.Fatalf("expected the manifest to record the fnv128a checksum %s, got %s checksum %s", vol.HashSum, manifest.HashAlgorithm, manifest.Volumes[0].HashSum)
+	}
+
+	backend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+
+	tampered := &helpers.VolumeInfo{
+		ObjectName: manifest.Volumes[0].ObjectName,
+		SHA256Sum:  manifest.Volumes[0].SHA256Sum,
+		HashSum:    strings.Repeat("0", len(manifest.Volumes[0].HashSum)),
+	}
+
+	testCases := []struct {
+		volume    *helpers.VolumeInfo
+		algorithm string
+		valid     errTestFunc
+	}{
+		{manifest.Volumes[0], manifest.HashAlgorithm, nilErrTest},
+		{tampered, manifest.HashAlgorithm, func(e error) bool {
+			var oerr *helpers.OperationError
+			return errors.As(e, &oerr) && oerr.Kind == helpers.ErrChecksumMismatch && oerr.Volume == vol.ObjectName
+		}},
+		{manifest.Volumes[0], "", nilErrTest},
+		{tampered, "", nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		c.volume.ObjectName = vol.ObjectName
+		downloaded := make(chan *helpers.VolumeInfo, 1)
+		err = processSequence(context.Background(), downloadSequence{volume: c.volume, c: downloaded}, backend, false, c.algorithm)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err == nil {
+			(<-downloaded).DeleteVolume()
+		}
+	}
+
+	// Restoring a backup set verified with an unregistered algorithm should fail up front
+	manifest.HashAlgorithm = "unregistered"
+	if err = receiveManifest(context.Background(), j, manifest, backend); err != helpers.ErrUnknownHash {
+		t.Errorf("expected error %v, got %v", helpers.ErrUnknownHash, err)
+	}
+}
+
+func TestSnapshotChain(t *testing.T) {
+	snap := func(name string, hour int) helpers.SnapshotInfo {
+		return helpers.SnapshotInfo{Name: name, CreationTime: time.Date(2020, 1, 1, hour, 0, 0, 0, time.UTC)}
+	}
+
+	// weekly was renamed after the fact and now appears older than the full backup it increments from
+	backups := []*helpers.JobInfo{
+		{VolumeName: "tank/data", BaseSnapshot: snap("daily2", 5), IncrementalSnapshot: snap("daily1", 4)},
+		{VolumeName: "tank/data", BaseSnapshot: snap("daily1", 4), IncrementalSnapshot: snap("weekly", 1)},
+		{VolumeName: "tank/data", BaseSnapshot: snap("weekly", 1), IncrementalSnapshot: snap("full", 2)},
+		{VolumeName: "tank/data", BaseSnapshot: snap("full", 2)},
+	}
+
+	testCases := []struct {
+		base        helpers.SnapshotInfo
+		incremental helpers.SnapshotInfo
+		chain       []string
+		valid       bool
+	}{
+		{snap("daily3", 6), helpers.SnapshotInfo{}, []string{"daily3"}, true},
+		{snap("daily3", 6), snap("full", 2), []string{"full", "daily3"}, true},
+		{snap("daily3", 6), snap("daily2", 5), []string{"full", "weekly", "daily1", "daily2", "daily3"}, false},
+		{snap("daily3", 3), snap("unknown", 2), []string{"unknown", "daily3"}, true},
+		{snap("daily3", 3), snap("daily1", 4), []string{"full", "weekly", "daily1", "daily3"}, false},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{VolumeName: "tank/data", BaseSnapshot: c.base, IncrementalSnapshot: c.incremental, StrictSnapshotOrder: true}
+		chain := snapshotChain(j, backups)
+		names := make([]string, len(chain))
+		for i := range chain {
+			names[i] = chain[i].Name
+		}
+		if !reflect.DeepEqual(names, c.chain) {
+			t.Errorf("%d: expected chain %v, got %v", idx, c.chain, names)
+			continue
+		}
+		if err := j.CheckSnapshotChain(chain); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+	}
+}
+
+func TestManifestReaderVersion(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	backend, err := prepareBackend(context.Background(), &helpers.JobInfo{}, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+
+	// writeManifest will write the manifest to the local cache as-is, like a newer version of zfsbackup would have
+	writeManifest := func(j *helpers.JobInfo) {
+		manifestVol, merr := helpers.CreateManifestVolume(context.Background(), j)
+		if merr != nil {
+			t.Fatalf("could not create manifest volume - %v", merr)
+		}
+		defer manifestVol.DeleteVolume()
+		if merr = json.NewEncoder(manifestVol).Encode(j); merr != nil {
+			t.Fatalf("could not encode manifest - %v", merr)
+		}
+		if merr = manifestVol.Close(); merr != nil {
+			t.Fatalf("could not close manifest volume - %v", merr)
+		}
+		if merr = manifestVol.CopyTo(filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestVol.ObjectName))))); merr != nil {
+			t.Fatalf("could not copy manifest to the cache - %v", merr)
+		}
+	}
+
+	testCases := []struct {
+		snapshot   string
+		compressor string
+		version    float64
+		save       bool
+		valid      errTestFunc
+	}{
+		{"plain", helpers.InternalCompressor, .3, true, nilErrTest},
+		{"adaptive", helpers.AdaptiveCompressor, .4, true, nilErrTest},
+		{"current", helpers.InternalCompressor, helpers.VersionNumber, false, nilErrTest},
+		{"future", helpers.InternalCompressor, helpers.VersionNumber + .1, false, nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			VolumeName:     "tank/data",
+			BaseSnapshot:   helpers.SnapshotInfo{Name: c.snapshot},
+			Compressor:     c.compressor,
+			Separator:      "|",
+			ManifestPrefix: "manifests",
+			Destinations:   []string{destination},
+			Version:        helpers.VersionNumber,
+		}
+		if c.save {
+			manifestVol, serr := saveManifest(context.Background(), j, true)
+			if serr != nil {
+				t.Fatalf("%d: could not save manifest - %v", idx, serr)
+			}
+			manifestVol.DeleteVolume()
+		} else {
+			j.MinReaderVersion = c.version
+			writeManifest(j)
+		}
+
+		manifest, ferr := fetchManifest(context.Background(), j, backend, localCachePath)
+		if !c.valid(ferr) {
+			t.Errorf("%d: error %v did not pass validation function", idx, ferr)
+			continue
+		}
+		if ferr == nil && manifest.MinReaderVersion != c.version {
+			t.Errorf("%d: expected a min reader version of %v recorded in the manifest, got %v", idx, c.version, manifest.MinReaderVersion)
+		}
+	}
+}
+
+func TestReadVolumeRange(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	payload := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+
+	j := &helpers.JobInfo{
+		VolumeName:           "tank/test",
+		BaseSnapshot:         helpers.SnapshotInfo{Name: "snap"},
+		Compressor:           helpers.SeekableZstdCompressor,
+		CompressionLevel:     6,
+		CompressionBlockSize: 64,
+		Separator:            "|",
+		ManifestPrefix:       "manifests",
+		Destinations:         []string{destination},
+		MaxFileBuffer:        1,
+		MaxParallelUploads:   1,
+	}
+
+	vol, err := helpers.CreateBackupVolume(context.Background(), j, 1)
+	if err != nil {
+		t.Fatalf("could not create volume - %v", err)
+	}
+	if _, err = vol.Write(payload); err != nil {
+		t.Fatalf("could not write volume - %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("could not close volume - %v", err)
+	}
+	defer vol.DeleteVolume()
+	if err = uploadManifest(context.Background(), j, vol, destination); err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+	j.Volumes = []*helpers.VolumeInfo{vol}
+
+	// The block size and compressor should survive the manifest
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		t.Fatalf("could not encode manifest - %v", err)
+	}
+	manifest := new(helpers.JobInfo)
+	if err = json.Unmarshal(encoded, manifest); err != nil {
+		t.Fatalf("could not decode manifest - %v", err)
+	}
+	if manifest.CompressionBlockSize != 64 || manifest.Volumes[0].Compressor != helpers.SeekableZstdCompressor {
+		t.Fatalf("expected the manifest to record 64KiB %s blocks, got %dKiB %s blocks", helpers.SeekableZstdCompressor, manifest.CompressionBlockSize, manifest.Volumes[0].Compressor)
+	}
+
+	fileBackend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer fileBackend.Close()
+
+	testCases := []struct {
+		offset int64
+		length int64
+		valid  errTestFunc
+	}{
+		{0, 100, nilErrTest},
+		// Spans two blocks
+		{64*1024 - 50, 100, nilErrTest},
+		{1000000, 4096, nilErrTest},
+		// Truncated to the end of the volume
+		{int64(len(payload)) - 10, 100, nilErrTest},
+		{int64(len(payload)), 100, func(e error) bool { return e == io.EOF }},
+	}
+
+	for idx, c := range testCases {
+		backend := &mockRangeBackend{Backend: fileBackend}
+		data, rerr := ReadVolumeRange(context.Background(), backend, manifest, manifest.Volumes[0], c.offset, c.length)
+		if !c.valid(rerr) {
+			t.Errorf("%d: error %v did not pass validation function", idx, rerr)
+			continue
+		}
+		if rerr != nil {
+			continue
+		}
+		end := c.offset + c.length
+		if end > int64(len(payload)) {
+			end = int64(len(payload))
+		}
+		if !bytes.Equal(data, payload[c.offset:end]) {
+			t.Errorf("%d: read %d bytes not equal to the requested region of the volume", idx, len(data))
+		}
+		// Only the seek table and the blocks holding the range should have been downloaded
+		if backend.requested > int64(vol.Size)/4 {
+			t.Errorf("%d: expected only a few blocks to be downloaded, downloaded %d of %d bytes", idx, backend.requested, vol.Size)
+		}
+	}
+
+	// Volumes that are not seekable or backends without ranged downloads are rejected
+	gzipped := &helpers.VolumeInfo{ObjectName: vol.ObjectName, Size: vol.Size, Compressor: helpers.InternalCompressor}
+	if _, err = ReadVolumeRange(context.Background(), fileBackend, manifest, gzipped, 0, 100); err == nil {
+		t.Errorf("expected an error reading a range of a volume that is not seekable")
+	}
+	if _, err = ReadVolumeRange(context.Background(), &mockBackend{}, manifest, manifest.Volumes[0], 0, 100); err == nil {
+		t.Errorf("expected an error reading a range from a backend without ranged downloads")
+	}
+
+	// A range of the stream spanning two volumes is written to the output file
+	streamVol := *manifest.Volumes[0]
+	streamVol.ZFSStreamBytes = uint64(len(payload))
+	manifest.Volumes = []*helpers.VolumeInfo{&streamVol, &streamVol}
+	outputFile := filepath.Join(workingDir, "stream")
+	restoreJob := &helpers.JobInfo{OutputFile: outputFile, OutputOffset: int64(len(payload)) - 100, OutputLength: 200}
+	if err = writeStreamRange(context.Background(), restoreJob, manifest, &mockRangeBackend{Backend: fileBackend}); err != nil {
+		t.Fatalf("could not write the range of the stream - %v", err)
+	}
+	written, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("could not read the range of the stream written - %v", err)
+	}
+	if expected := append(append([]byte{}, payload[len(payload)-100:]...), payload[:100]...); !bytes.Equal(written, expected) {
+		t.Errorf("expected the %d bytes written to span the end of the first volume and the start of the second", len(written))
+	}
+	restoreJob.OutputFile = filepath.Join(workingDir, "past")
+	restoreJob.OutputOffset = 2 * int64(len(payload))
+	if err = writeStreamRange(context.Background(), restoreJob, manifest, &mockRangeBackend{Backend: fileBackend}); err == nil {
+		t.Errorf("expected an error writing a range past the end of the stream")
+	}
+	if _, err = os.Stat(restoreJob.OutputFile); !os.IsNotExist(err) {
+		t.Errorf("expected no output file to be left behind, got %v", err)
+	}
+}
+
+func TestUploadRestoreScript(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	j := &helpers.JobInfo{
+		VolumeName:          "tank/test",
+		BaseSnapshot:        helpers.SnapshotInfo{Name: "snap2"},
+		IncrementalSnapshot: helpers.SnapshotInfo{Name: "snap1"},
+		Compressor:          helpers.ZstdCompressor,
+		Separator:           "|",
+		ManifestPrefix:      "manifests",
+		Destinations:        []string{destination, backends.DeleteBackendPrefix + "://"},
+		MaxParallelUploads:  1,
+		MaxBackoffTime:      time.Second,
+		MaxRetryTime:        time.Second,
+		Volumes: []*helpers.VolumeInfo{
+			{ObjectName: "tank/test|snap1|to|snap2.zstream.zst.vol1", SHA256Sum: "aaaa"},
+			{ObjectName: "tank/test|snap1|to|snap2.zstream.zst.vol2", SHA256Sum: "bbbb"},
+		},
+	}
+
+	if err := uploadRestoreScript(context.Background(), j); err != nil {
+		t.Fatalf("could not upload restore script - %v", err)
+	}
+	if j.RestoreScript != "tank/test|snap1|to|snap2.restore.sh" {
+		t.Errorf("expected the restore script to be recorded in the manifest, got %q", j.RestoreScript)
+	}
+
+	script, err := ioutil.ReadFile(filepath.Join(strings.TrimPrefix(destination, "file://"), j.RestoreScript))
+	if err != nil {
+		t.Fatalf("could not read uploaded restore script - %v", err)
+	}
+	for _, expected := range []string{
+		"# Destination: " + destination,
+		"aaaa  tank/test|snap1|to|snap2.zstream.zst.vol1",
+		"zstd -dc < 'tank/test|snap1|to|snap2.zstream.zst.vol2'",
+	} {
+		if !strings.Contains(string(script), expected) {
+			t.Errorf("expected the restore script to contain %q, got:\n%s", expected, script)
+		}
+	}
+	if strings.Contains(string(script), backends.DeleteBackendPrefix+"://") {
+		t.Errorf("expected the restore script to not list the delete backend as a destination")
+	}
+}
+
+func TestParallelismTuner(t *testing.T) {
+	type step struct {
+		throughput float64
+		failures   int
+		limit      int
+	}
+
+	testCases := []struct {
+		min, max int
+		steps    []step
+	}{
+		// Ramp up while throughput improves, stopping at the max
+		{1, 4, []step{{100, 0, 2}, {200, 0, 3}, {300, 0, 4}, {400, 0, 4}, {500, 0, 4}}},
+		// Revert the last increase once throughput plateaus and hold there
+		{1, 8, []step{{100, 0, 2}, {200, 0, 3}, {205, 0, 2}, {205, 0, 2}, {150, 0, 2}}},
+		// Back off on failures and ramp up again from there
+		{2, 8, []step{{100, 0, 3}, {200, 0, 4}, {300, 0, 5}, {300, 1, 2}, {50, 0, 3}, {100, 0, 4}}},
+		// Never back off below the min
+		{3, 4, []step{{100, 0, 4}, {100, 2, 3}, {100, 5, 3}}},
+		// A fixed range never changes
+		{2, 2, []step{{100, 0, 2}, {200, 0, 2}, {200, 1, 2}}},
+	}
+
+	for idx, c := range testCases {
+		tuner := newParallelismTuner(c.min, c.max)
+		if tuner.limit != c.min {
+			t.Errorf("%d: expected the tuner to start at %d parallel uploads, got %d", idx, c.min, tuner.limit)
+		}
+		for sidx, s := range c.steps {
+			if limit := tuner.observe(s.throughput, s.failures); limit != s.limit {
+				t.Errorf("%d: expected %d parallel uploads after step %d, got %d", idx, s.limit, sidx, limit)
+				break
+			}
+		}
+	}
+}
+
+func TestUploadLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	limiter := newUploadLimiter(ctx, "test", newParallelismTuner(2, 4))
+	for i := 0; i < 2; i++ {
+		if err := limiter.acquire(ctx); err != nil {
+			t.Fatalf("unexpected error acquiring upload %d - %v", i, err)
+		}
+	}
+
+	// A third upload must wait for one of the first two to complete
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.acquire(ctx) }()
+	select {
+	case <-acquired:
+		t.Fatalf("expected the third upload to wait while the limit is reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	limiter.release(1024)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("unexpected error acquiring the third upload - %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the third upload to start once an upload completed")
+	}
+
+	// A completed window of uploads with throughput better than nothing ramps up the limit
+	limiter.release(1024)
+	if limit := limiter.limit(); limit != 3 {
+		t.Errorf("expected the limit to ramp up to 3, got %d", limit)
+	}
+
+	// Waiting uploads are released on cancellation
+	for i := 0; i < 2; i++ {
+		if err := limiter.acquire(ctx); err != nil {
+			t.Fatalf("unexpected error acquiring upload %d - %v", i, err)
+		}
+	}
+	go func() { acquired <- limiter.acquire(ctx) }()
+	cancel()
+	select {
+	case err := <-acquired:
+		if err != context.Canceled {
+			t.Errorf("expected %v when cancelled, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the waiting upload to be released on cancellation")
+	}
+}
+
+func TestCompressionLevelTuner(t *testing.T) {
+	testCases := []struct {
+		level, min, max          int
+		compressRate, uploadRate float64
+		next                     int
+	}{
+		// Compression cannot keep up with the uploads
+		{6, 1, 9, 50, 100, 5},
+		// Already at the lowest level allowed
+		{2, 2, 9, 50, 100, 2},
+		// Plenty of CPU headroom to compress better
+		{6, 1, 9, 300, 100, 7},
+		// Already at the highest level allowed
+		{7, 1, 7, 300, 100, 7},
+		// Keeping up without enough headroom to compress better
+		{6, 1, 9, 150, 100, 6},
+		{6, 1, 9, 100, 100, 6},
+		// No uploads observed yet
+		{6, 1, 9, 50, 0, 6},
+		{6, 1, 9, 0, 100, 6},
+	}
+
+	for idx, c := range testCases {
+		if next := nextCompressionLevel(c.level, c.min, c.max, c.compressRate, c.uploadRate); next != c.next {
+			t.Errorf("%d: expected compression level %d, got %d", idx, c.next, next)
+		}
+	}
+
+	// The upload throughput of a single volume is scaled by the number of parallel uploads
+	tuner := newCompressionLevelTuner(&helpers.JobInfo{CompressionLevel: 6, MinCompressionLevel: 4, MaxCompressionLevel: 8, MaxParallelUploads: 2})
+	if level := tuner.observe(50); level != 6 {
+		t.Errorf("expected the compression level to be kept before any upload completed, got %d", level)
+	}
+	tuner.recordUpload(100, time.Second)
+	steps := []struct {
+		compressRate float64
+		level        int
+	}{
+		{150, 5}, {150, 4}, {150, 4}, {300, 4}, {450, 5}, {450, 6}, {1000, 7}, {1000, 8}, {1000, 8},
+	}
+	for sidx, s := range steps {
+		if level := tuner.observe(s.compressRate); level != s.level {
+			t.Errorf("expected compression level %d after step %d, got %d", s.level, sidx, level)
+			break
+		}
+	}
+}
+
+// A backend standing in for a region, it can be down or hold uploads until released
+type mockRegionBackend struct {
+	mockBackend
+	down    bool
+	release chan struct{}
+
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *mockRegionBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	if m.down {
+		return errTest
+	}
+	if m.release != nil {
+		select {
+		case <-m.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	b, err := ioutil.ReadAll(vol)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.objects == nil {
+		m.objects = make(map[string][]byte)
+	}
+	m.objects[vol.ObjectName] = b
+	return nil
+}
+
+func (m *mockRegionBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	b, ok := m.objects[filename]
+	if m.down || !ok {
+		return nil, errTest
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestQuorumUploader(t *testing.T) {
+	j := &helpers.JobInfo{MaxBackoffTime: 10 * time.Millisecond, MaxRetryTime: 50 * time.Millisecond}
+
+	testCases := []struct {
+		quorum int
+		down   []bool
+		valid  errTestFunc
+		placed []string
+	}{
+		{2, []bool{false, false, false}, nilErrTest, []string{"region0", "region1", "region2"}},
+		// A region being down does not fail the upload
+		{2, []bool{false, true, false}, nilErrTest, []string{"region0", "region2"}},
+		{3, []bool{false, true, false}, func(e error) bool { return e == errQuorumUnreachable }, nil},
+		{2, []bool{true, true, false}, func(e error) bool { return e == errQuorumUnreachable }, nil},
+		{1, []bool{true, true, false}, nilErrTest, []string{"region2"}},
+	}
+
+	for idx, c := range testCases {
+		payload, vol, _, err := prepareTestVols()
+		if err != nil {
+			t.Fatalf("error preparing volumes for testing - %v", err)
+		}
+		vol.ObjectName = "volume"
+
+		q := newQuorumUploader(context.Background(), c.quorum)
+		regions := make([]*mockRegionBackend, len(c.down))
+		for ridx := range c.down {
+			regions[ridx] = &mockRegionBackend{down: c.down[ridx]}
+			q.backends = append(q.backends, regions[ridx])
+			q.destinations = append(q.destinations, fmt.Sprintf("region%d", ridx))
+		}
+
+		err = q.upload(context.Background(), vol, j)
+		q.wait()
+		vol.DeleteVolume()
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		sort.Strings(vol.Placement)
+		if !reflect.DeepEqual(vol.Placement, c.placed) {
+			t.Errorf("%d: expected the volume to be placed in %v, got %v", idx, c.placed, vol.Placement)
+		}
+		for ridx, region := range regions {
+			if !c.down[ridx] && !bytes.Equal(region.objects["volume"], payload) {
+				t.Errorf("%d: expected region %d to hold the volume", idx, ridx)
+			}
+		}
+	}
+}
+
+func TestQuorumUploaderBackground(t *testing.T) {
+	j := &helpers.JobInfo{MaxBackoffTime: 10 * time.Millisecond, MaxRetryTime: 50 * time.Millisecond}
+	payload, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	vol.ObjectName = "volume"
+
+	slow := &mockRegionBackend{release: make(chan struct{})}
+	q := newQuorumUploader(context.Background(), 2)
+	q.backends = []backends.Backend{&mockRegionBackend{}, slow, &mockRegionBackend{}}
+	q.destinations = []string{"region0", "region1", "region2"}
+
+	// The quorum is reached without waiting for the slow region
+	if err = q.upload(context.Background(), vol, j); err != nil {
+		t.Fatalf("unexpected error uploading the volume - %v", err)
+	}
+	manifestmutex.Lock()
+	placed := len(vol.Placement)
+	manifestmutex.Unlock()
+	if placed != 2 {
+		t.Errorf("expected the volume to be placed in 2 regions once the quorum is reached, got %d", placed)
+	}
+
+	// The slow region still completes its upload once the volume is deleted locally
+	if err = vol.DeleteVolume(); err != nil {
+		t.Fatalf("could not delete volume - %v", err)
+	}
+	close(slow.release)
+	q.wait()
+	if len(vol.Placement) != 3 {
+		t.Errorf("expected the volume to be placed in all 3 regions, got %v", vol.Placement)
+	}
+	if !bytes.Equal(slow.objects["volume"], payload) {
+		t.Errorf("expected the slow region to hold the volume")
+	}
+}
+
+func TestQuorumUploaderFinish(t *testing.T) {
+	j := &helpers.JobInfo{MaxBackoffTime: 10 * time.Millisecond, MaxRetryTime: time.Minute}
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+	vol.ObjectName = "volume"
+
+	// The slow region never completes its upload
+	slow := &mockRegionBackend{release: make(chan struct{})}
+	q := newQuorumUploader(context.Background(), 2)
+	q.backends = []backends.Backend{&mockRegionBackend{}, slow, &mockRegionBackend{}}
+	q.destinations = []string{"region0", "region1", "region2"}
+
+	if err = q.upload(context.Background(), vol, j); err != nil {
+		t.Fatalf("unexpected error uploading the volume - %v", err)
+	}
+
+	start := time.Now()
+	q.finish(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the straggling upload to be cancelled once the timeout passed, waited %v", elapsed)
+	}
+	if len(vol.Placement) != 2 {
+		t.Errorf("expected the volume to be placed in 2 regions, got %v", vol.Placement)
+	}
+	if _, ok := slow.objects["volume"]; ok {
+		t.Errorf("did not expect the slow region to hold the volume")
+	}
+}
+
+func TestPlacementBackend(t *testing.T) {
+	regions := []*mockRegionBackend{
+		{objects: map[string][]byte{"manifest": []byte("manifest0"), "volume1": []byte("volume1")}},
+		{objects: map[string][]byte{"manifest": []byte("manifest1"), "volume1": []byte("volume1"), "volume2": []byte("volume2")}, down: true},
+		{objects: map[string][]byte{"manifest": []byte("manifest2"), "volume2": []byte("volume2"), "volume3": []byte("volume3")}},
+	}
+	p := &placementBackend{placement: make(map[string][]string)}
+	for idx := range regions {
+		p.backends = append(p.backends, regions[idx])
+		p.destinations = append(p.destinations, fmt.Sprintf("region%d", idx))
+	}
+	p.place([]*helpers.VolumeInfo{
+		{ObjectName: "volume1", Placement: []string{"region0", "region1"}},
+		{ObjectName: "volume2", Placement: []string{"region2", "region1"}},
+	})
+
+	testCases := []struct {
+		filename string
+		content  string
+		valid    errTestFunc
+	}{
+		// Without a recorded placement, the destinations are tried in order
+		{"manifest", "manifest0", nilErrTest},
+		{"volume1", "volume1", nilErrTest},
+		// The region down is skipped
+		{"volume2", "volume2", nilErrTest},
+		{"volume3", "volume3", nilErrTest},
+		{"volume4", "", errTestErrTest},
+	}
+
+	for idx, c := range testCases {
+		r, err := p.Download(context.Background(), c.filename)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(content) != c.content {
+			t.Errorf("%d: expected to download %s, got %s", idx, c.content, content)
+		}
+	}
+
+	if candidates := p.candidates("volume2"); !reflect.DeepEqual(candidates, []int{1, 2, 0}) {
+		t.Errorf("expected the regions the volume was placed in to be tried first, got %v", candidates)
+	}
+}
+
+// A backend corrupting the first few objects it is asked to read back
+type mockCorruptingBackend struct {
+	mockRegionBackend
+	corrupt int
+	uploads int
+}
+
+func (m *mockCorruptingBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	m.uploads++
+	return m.mockRegionBackend.Upload(ctx, vol)
+}
+
+func (m *mockCorruptingBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	r, err := m.mockRegionBackend.Download(ctx, filename)
+	if err != nil || m.corrupt == 0 {
+		return r, err
+	}
+	m.corrupt--
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b[0] ^= 0xff
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestVerifyReadback(t *testing.T) {
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+
+	testCases := []struct {
+		verify  string
+		corrupt int
+		uploads int
+		valid   errTestFunc
+	}{
+		{helpers.VerifyUploadsReadback, 0, 1, nilErrTest},
+		// A corrupted read back should have the volume uploaded again
+		{helpers.VerifyUploadsReadback, 1, 2, nilErrTest},
+		{helpers.VerifyUploadsReadback, 2, 3, nilErrTest},
+		// The object is named once the retries are exhausted
+		{helpers.VerifyUploadsReadback, 1000, 0, func(e error) bool {
+			return errors.Is(e, errReadbackMismatch) && errors.Is(e, helpers.ErrChecksumMismatch) && strings.Contains(e.Error(), vol.ObjectName+" was read back with the checksum")
+		}},
+		// Only a readback verification downloads the volume again
+		{helpers.VerifyUploadsETag, 1, 1, nilErrTest},
+		{"", 1, 1, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Millisecond,
+			MaxRetryTime:       2 * time.Second,
+			VerifyUploads:      c.verify,
+		}
+		b := &mockCorruptingBackend{corrupt: c.corrupt}
+		in := make(chan *helpers.VolumeInfo, 1)
+		out, wg := retryUploadChainer(context.Background(), in, b, j, "mock://")
+		in <- vol
+		close(in)
+		for range out {
+		}
+		if err := wg.Wait(); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+		if c.uploads > 0 && b.uploads != c.uploads {
+			t.Errorf("%d: expected %d uploads, got %d", idx, c.uploads, b.uploads)
+		}
+	}
+}
+
+// A backend whose first few uploads stall until they are cancelled
+type mockStallingBackend struct {
+	mockBackend
+	stalls  int
+	uploads int
+}
+
+func (m *mockStallingBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	m.uploads++
+	if m.uploads <= m.stalls {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return m.mockBackend.Upload(ctx, vol)
+}
+
+func TestUploadDeadline(t *testing.T) {
+	deadlineCases := []struct {
+		job      *helpers.JobInfo
+		size     uint64
+		deadline time.Duration
+	}{
+		{&helpers.JobInfo{}, 100 * humanize.MiByte, 0},
+		{&helpers.JobInfo{UploadTimeout: time.Minute}, 100 * humanize.MiByte, time.Minute},
+		{&helpers.JobInfo{MinUploadThroughput: 1024}, 100 * humanize.MiByte, 100 * time.Second},
+		{&helpers.JobInfo{MinUploadThroughput: 1024}, humanize.MiByte, minUploadDeadline},
+		{&helpers.JobInfo{MinUploadThroughput: 1024, UploadTimeout: time.Second}, humanize.MiByte, 2 * time.Second},
+	}
+
+	for idx, c := range deadlineCases {
+		if deadline := uploadDeadline(c.job, c.size); deadline != c.deadline {
+			t.Errorf("%d: expected a deadline of %v, got %v", idx, c.deadline, deadline)
+		}
+	}
+
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	defer vol.DeleteVolume()
+
+	testCases := []struct {
+		stalls  int
+		uploads int
+		valid   errTestFunc
+	}{
+		{0, 1, nilErrTest},
+		// A stalled upload should be cancelled and uploaded again
+		{1, 2, nilErrTest},
+		{2, 3, nilErrTest},
+		{1000, 0, func(e error) bool {
+			return errors.Is(e, errUploadStalled) && errors.Is(e, helpers.ErrBackendUnreachable)
+		}},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Millisecond,
+			MaxRetryTime:       time.Second,
+			UploadTimeout:      50 * time.Millisecond,
+		}
+		b := &mockStallingBackend{stalls: c.stalls}
+		in := make(chan *helpers.VolumeInfo, 1)
+		out, wg := retryUploadChainer(context.Background(), in, b, j, "mock://")
+		in <- vol
+		close(in)
+		for range out {
+		}
+		if err := wg.Wait(); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+		if c.uploads > 0 && b.uploads != c.uploads {
+			t.Errorf("%d: expected %d uploads, got %d", idx, c.uploads, b.uploads)
+		}
+	}
+}
+
+type mockResumeBackend struct {
+	mockRegionBackend
+	ranged    bool
+	failAfter int // Fail the next download after this many bytes, if not 0
+
+	downloads []int64 // The offsets downloaded from
+}
+
+func (m *mockResumeBackend) download(filename string, offset int64) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	b, ok := m.objects[filename]
+	if !ok {
+		return nil, errTest
+	}
+	m.downloads = append(m.downloads, offset)
+	var r io.Reader = bytes.NewReader(b[offset:])
+	if m.failAfter != 0 {
+		r = io.MultiReader(io.LimitReader(r, int64(m.failAfter)), iotest.ErrReader(errTest))
+		m.failAfter = 0
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+func (m *mockResumeBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return m.download(filename, 0)
+}
+
+func (m *mockResumeBackend) DownloadRange(ctx context.Context, filename string, offset, length int64) (io.ReadCloser, error) {
+	if !m.ranged {
+		return nil, errTest
+	}
+	return m.download(filename, offset)
+}
+
+// plainBackend hides the methods of the wrapped backend not part of the Backend interface, like DownloadRange
+type plainBackend struct {
+	backends.Backend
+}
+
+func TestResumeSequence(t *testing.T) {
+	payload := bytes.Repeat([]byte("zfs stream"), 64*1024)
+	volume := &helpers.VolumeInfo{
+		ObjectName: "tank/test|snap.zstream.vol1",
+		Size:       uint64(len(payload)),
+		SHA256Sum:  fmt.Sprintf("%x", sha256.Sum256(payload)),
+	}
+	corrupted := append([]byte("corrupted!"), payload[10:1024]...)
+
+	testCases := []struct {
+		ranged    bool
+		partial   []byte
+		failAfter int
+		valid     errTestFunc
+		downloads []int64
+		kept      int // The bytes left in the partial file after a failed download
+	}{
+		{true, nil, 0, nilErrTest, []int64{0}, 0},
+		{true, payload[:4096], 0, nilErrTest, []int64{4096}, 0},
+		// Without ranged downloads, the object is downloaded again and its first part is skipped
+		{false, payload[:4096], 0, nilErrTest, []int64{0}, 0},
+		// An object already downloaded is not downloaded again
+		{true, payload, 0, nilErrTest, nil, 0},
+		// A failed download keeps what was downloaded so far for the next attempt
+		{true, payload[:4096], 8192, nonNilErrTest, []int64{4096}, 4096 + 8192},
+		{true, corrupted, 0, nonNilErrTest, []int64{1024}, 0},
+		{true, append(payload, 'x'), 0, nonNilErrTest, nil, 0},
+	}
+
+	for idx, c := range testCases {
+		dir := t.TempDir()
+		path := partialVolumePath(dir, volume.ObjectName)
+		if c.partial != nil {
+			if err := ioutil.WriteFile(path, c.partial, 0600); err != nil {
+				t.Fatalf("%d: could not write partial download - %v", idx, err)
+			}
+		}
+
+		mock := &mockResumeBackend{ranged: c.ranged, failAfter: c.failAfter}
+		mock.objects = map[string][]byte{volume.ObjectName: payload}
+		var backend backends.Backend = mock
+		if !c.ranged {
+			backend = plainBackend{mock}
+		}
+
+		downloaded := make(chan *helpers.VolumeInfo, 1)
+		err := resumeSequence(context.Background(), downloadSequence{volume: volume, c: downloaded}, backend, dir, "")
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if !reflect.DeepEqual(mock.downloads, c.downloads) {
+			t.Errorf("%d: expected downloads from offsets %v, got %v", idx, c.downloads, mock.downloads)
+		}
+
+		if err != nil {
+			info, serr := os.Stat(path)
+			switch {
+			case c.kept == 0 && !os.IsNotExist(serr):
+				t.Errorf("%d: expected the partial download to be removed, got %v", idx, serr)
+			case c.kept != 0 && (serr != nil || info.Size() != int64(c.kept)):
+				t.Errorf("%d: expected the partial download to keep %d bytes, got %v (%v)", idx, c.kept, info, serr)
+			}
+			continue
+		}
+
+		vol := <-downloaded
+		if vol.Size != volume.Size {
+			t.Errorf("%d: expected a volume of %d bytes, got %d", idx, volume.Size, vol.Size)
+		}
+		if err = vol.OpenVolume(); err != nil {
+			t.Errorf("%d: could not open volume - %v", idx, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(vol)
+		vol.Close()
+		if !bytes.Equal(b, payload) {
+			t.Errorf("%d: downloaded volume does not match the object", idx)
+		}
+		vol.DeleteVolume()
+		if _, serr := os.Stat(path); !os.IsNotExist(serr) {
+			t.Errorf("%d: expected the volume to be deleted once received, got %v", idx, serr)
+		}
+	}
+}
+
+func TestManifestMirrors(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+	mirrorTarget, err := ioutil.TempDir("", "zfsbackupmirrortarget")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(mirrorTarget)
+
+	j := &helpers.JobInfo{
+		VolumeName:                 "tank/test",
+		BaseSnapshot:               helpers.SnapshotInfo{Name: "snap", CreationTime: time.Now().Round(time.Second)},
+		Compressor:                 helpers.InternalCompressor,
+		CompressionLevel:           6,
+		Separator:                  "|",
+		ManifestPrefix:             "manifests",
+		ManifestMirrorPrefixes:     []string{"mirror/manifests"},
+		ManifestMirrorDestinations: []string{"file://" + mirrorTarget},
+		Destinations:               []string{destination},
+		MaxFileBuffer:              1,
+		MaxParallelUploads:         1,
+	}
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	manifestVol, err := saveManifest(context.Background(), j, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	err = uploadManifest(context.Background(), j, manifestVol, destination)
+	manifestVol.DeleteVolume()
+	if err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+	if err = uploadManifestMirrors(context.Background(), j); err != nil {
+		t.Fatalf("could not upload manifest copies - %v", err)
+	}
+
+	name, err := manifestObjectName(context.Background(), j)
+	if err != nil {
+		t.Fatalf("could not compute manifest name - %v", err)
+	}
+	mirrorName := mirrorObjectName(j, name, "mirror/manifests")
+	if mirrorName != "mirror/manifests"+strings.TrimPrefix(name, "manifests") {
+		t.Fatalf("unexpected name %s for the copy of manifest %s", mirrorName, name)
+	}
+
+	// Every copy is byte-identical to the manifest
+	locations := []string{
+		filepath.Join(target, name),
+		filepath.Join(target, mirrorName),
+		filepath.Join(mirrorTarget, name),
+		filepath.Join(mirrorTarget, mirrorName),
+	}
+	manifest, err := ioutil.ReadFile(locations[0])
+	if err != nil {
+		t.Fatalf("could not read manifest - %v", err)
+	}
+	for idx, location := range locations[1:] {
+		if b, rerr := ioutil.ReadFile(location); rerr != nil || !bytes.Equal(b, manifest) {
+			t.Errorf("%d: expected the copy %s to match the manifest (%v)", idx, location, rerr)
+		}
+	}
+
+	backend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	defer backend.Close()
+	cached := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(name))))
+
+	// Remove each location in turn, restoring falls back to the next one
+	testCases := []struct {
+		remove string
+		valid  errTestFunc
+		listed bool
+	}{
+		{"", nilErrTest, true},
+		{locations[0], nilErrTest, true},
+		{locations[1], nilErrTest, false},
+		{locations[2], nilErrTest, false},
+		{locations[3], nonNilErrTest, false},
+	}
+
+	for idx, c := range testCases {
+		if c.remove != "" {
+			if err = os.Remove(c.remove); err != nil {
+				t.Fatalf("%d: could not remove %s - %v", idx, c.remove, err)
+			}
+		}
+		os.Remove(cached)
+
+		restored, err := fetchManifest(context.Background(), j, backend, localCachePath)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err == nil && restored.VolumeName != j.VolumeName {
+			t.Errorf("%d: expected the manifest of %s, got %s", idx, j.VolumeName, restored.VolumeName)
+		}
+
+		// Listing only falls back to the copies in the same destination
+		safeManifests, _, err := syncCache(context.Background(), j, localCachePath, backend)
+		if err != nil {
+			t.Errorf("%d: could not sync cache - %v", idx, err)
+			continue
+		}
+		listed := false
+		for _, safeManifest := range safeManifests {
+			listed = listed || safeManifest == filepath.Base(cached)
+		}
+		if listed != c.listed {
+			t.Errorf("%d: expected the manifest to be listed: %v, got %v", idx, c.listed, listed)
+		}
+	}
+}
+
+func TestDiscoverDecryptionKey(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	var keys []*openpgp.Entity
+	for _, name := range []string{"old", "current", "stranger"} {
+		key, kerr := openpgp.NewEntity(name, "", name+"@example.com", config)
+		if kerr != nil {
+			t.Fatalf("could not generate key - %v", kerr)
+		}
+		keys = append(keys, key)
+	}
+	loadRing := func(ring ...*openpgp.Entity) {
+		ringPath := filepath.Join(workingDir, "secring.asc")
+		ringFile, rerr := os.Create(ringPath)
+		if rerr != nil {
+			t.Fatalf("could not create key ring - %v", rerr)
+		}
+		armored, rerr := armor.Encode(ringFile, openpgp.PrivateKeyType, nil)
+		if rerr != nil {
+			t.Fatalf("could not create key ring - %v", rerr)
+		}
+		for _, key := range ring {
+			if rerr = key.SerializePrivate(armored, config); rerr != nil {
+				t.Fatalf("could not write key ring - %v", rerr)
+			}
+		}
+		armored.Close()
+		ringFile.Close()
+		if rerr = helpers.LoadPrivateRing(ringPath); rerr != nil {
+			t.Fatalf("could not load key ring - %v", rerr)
+		}
+	}
+
+	testCases := []struct {
+		ring     []*openpgp.Entity
+		encrypt  *openpgp.Entity
+		discover bool
+		expected *openpgp.Entity
+		errTest  errTestFunc
+	}{
+		// The key the manifest was encrypted to is found among the others
+		{keys, keys[1], true, keys[1], nilErrTest},
+		{keys[:2], keys[0], true, keys[0], nilErrTest},
+		// The key is not in the secret key ring
+		{keys[:2], keys[2], true, nil, func(e error) bool {
+			return errors.Is(e, helpers.ErrNoDecryptionKey) && errors.Is(e, helpers.ErrKeyMissing)
+		}},
+		// Unencrypted manifests do not need a key
+		{keys, nil, true, nil, nilErrTest},
+		// Without discovery the key must be provided
+		{keys, keys[1], false, nil, nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		loadRing(c.ring...)
+
+		manifest := &helpers.JobInfo{
+			VolumeName:     "tank/db",
+			BaseSnapshot:   helpers.SnapshotInfo{Name: "snap", CreationTime: time.Now().Round(time.Second)},
+			Compressor:     helpers.InternalCompressor,
+			Separator:      "|",
+			ManifestPrefix: "manifests",
+			Destinations:   []string{destination},
+			EncryptKey:     c.encrypt,
+		}
+		manifestVol, err := saveManifest(context.Background(), manifest, true)
+		if err != nil {
+			t.Fatalf("%d: could not save manifest - %v", idx, err)
+		}
+		manifestVol.DeleteVolume()
+		manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestVol.ObjectName))))
+
+		reader := &helpers.JobInfo{
+			VolumeName:            "tank/db",
+			BaseSnapshot:          helpers.SnapshotInfo{Name: "snap"},
+			Separator:             "|",
+			ManifestPrefix:        "manifests",
+			DiscoverDecryptionKey: c.discover,
+		}
+		decoded, err := readManifest(context.Background(), manifestPath, reader)
+		if !c.errTest(err) {
+			t.Errorf("%d: unexpected error reading the manifest - %v", idx, err)
+		}
+		// The key ring is loaded from disk, compare the keys by ID
+		if (reader.EncryptKey == nil) != (c.expected == nil) || (c.expected != nil && reader.EncryptKey.PrimaryKey.KeyId != c.expected.PrimaryKey.KeyId) {
+			t.Errorf("%d: expected the discovered key to be %v, got %v", idx, c.expected, reader.EncryptKey)
+		}
+		if err == nil && decoded.VolumeName != manifest.VolumeName {
+			t.Errorf("%d: expected the manifest of %s to be decoded, got %s", idx, manifest.VolumeName, decoded.VolumeName)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	root := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(root)
+
+	// A multi-volume backup set stored under the old/ prefix
+	source := destination + "/old"
+	if err := os.MkdirAll(filepath.Join(root, "old"), 0755); err != nil {
+		t.Fatalf("could not create the old prefix - %v", err)
+	}
+	if _, err := getCacheDir(source); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+	set := &helpers.JobInfo{
+		VolumeName:         "tank/db",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		HashAlgorithm:      helpers.SHA256Hash,
+		Destinations:       []string{source},
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+	}
+	for number := int64(1); number <= 3; number++ {
+		vol, err := helpers.CreateBackupVolume(context.Background(), set, number)
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", number, err)
+		}
+		if _, err = vol.Write(bytes.Repeat([]byte{byte(number)}, int(number)*1024)); err != nil {
+			t.Fatalf("%d: could not write volume - %v", number, err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("%d: could not close volume - %v", number, err)
+		}
+		defer vol.DeleteVolume()
+		if err = uploadManifest(context.Background(), set, vol, source); err != nil {
+			t.Fatalf("%d: could not upload volume - %v", number, err)
+		}
+		set.Volumes = append(set.Volumes, vol)
+	}
+	manifestVol, err := saveManifest(context.Background(), set, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+	if err = uploadManifest(context.Background(), set, manifestVol, source); err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+	objects := []string{set.Volumes[0].ObjectName, set.Volumes[1].ObjectName, set.Volumes[2].ObjectName, manifestVol.ObjectName}
+
+	oldStdout := helpers.Stdout
+	helpers.Stdout = ioutil.Discard
+	defer func() { helpers.Stdout = oldStdout }()
+
+	writeObject := func(prefix, name string, data []byte) {
+		if werr := os.MkdirAll(filepath.Dir(filepath.Join(root, prefix, name)), 0755); werr != nil {
+			t.Fatalf("could not create prefix %s - %v", prefix, werr)
+		}
+		if werr := ioutil.WriteFile(filepath.Join(root, prefix, name), data, 0644); werr != nil {
+			t.Fatalf("could not write %s%s - %v", prefix, name, werr)
+		}
+	}
+	exists := func(prefix, name string) bool {
+		_, serr := os.Stat(filepath.Join(root, prefix, name))
+		return serr == nil
+	}
+
+	testCases := []struct {
+		to      string
+		setup   func()
+		move    bool
+		errTest errTestFunc
+	}{
+		{"copy/", nil, false, nilErrTest},
+		// An interrupted migration copied the first volume and part of the second
+		{"resume/", func() {
+			data, rerr := ioutil.ReadFile(filepath.Join(root, "old", objects[0]))
+			if rerr != nil {
+				t.Fatalf("could not read volume - %v", rerr)
+			}
+			writeObject("resume/", objects[0], data)
+			writeObject("resume/", objects[1], data[:10])
+		}, false, nilErrTest},
+		// A bad copy of the same size is caught when verifying the copies, and copied again when resumed
+		{"corrupt/", func() { writeObject("corrupt/", objects[0], make([]byte, set.Volumes[0].Size)) }, false, func(e error) bool { return e == errIntegrityVerificationFailed }},
+		{"corrupt/", nil, false, nilErrTest},
+		{"moved/", nil, true, nilErrTest},
+	}
+
+	for idx, c := range testCases {
+		if c.setup != nil {
+			c.setup()
+		}
+
+		job := &helpers.JobInfo{
+			VolumeName:         set.VolumeName,
+			BaseSnapshot:       set.BaseSnapshot,
+			Separator:          set.Separator,
+			ManifestPrefix:     set.ManifestPrefix,
+			Destinations:       []string{destination},
+			MaxParallelUploads: 2,
+			MaxBackoffTime:     time.Millisecond,
+			MaxRetryTime:       time.Millisecond,
+		}
+		err = Migrate(context.Background(), job, "old/", c.to, c.move)
+		if !c.errTest(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+
+		// The manifest only shows under the new prefix once every volume was copied and verified
+		if exists(c.to, manifestVol.ObjectName) != (err == nil) {
+			t.Errorf("%d: expected the manifest to be copied: %v", idx, err == nil)
+		}
+		for _, object := range objects {
+			if exists("old/", object) == (c.move && err == nil) {
+				t.Errorf("%d: expected %s to be deleted from the old prefix: %v", idx, object, c.move && err == nil)
+			}
+		}
+		if err != nil {
+			continue
+		}
+
+		// The backup set restores from its new prefix
+		verify := &helpers.JobInfo{
+			VolumeName:     set.VolumeName,
+			BaseSnapshot:   set.BaseSnapshot,
+			Separator:      set.Separator,
+			ManifestPrefix: set.ManifestPrefix,
+			Destinations:   []string{destination + "/" + c.to},
+		}
+		if verr := VerifyIntegrity(context.Background(), verify, false); verr != nil {
+			t.Errorf("%d: the migrated backup set failed integrity verification - %v", idx, verr)
+		}
+	}
+
+	// Migrating a backup set that is no longer under the prefix fails
+	job := &helpers.JobInfo{
+		VolumeName:     set.VolumeName,
+		BaseSnapshot:   helpers.SnapshotInfo{Name: "missing"},
+		Separator:      set.Separator,
+		ManifestPrefix: set.ManifestPrefix,
+		Destinations:   []string{destination},
+	}
+	if err = Migrate(context.Background(), job, "old/", "new/", false); err == nil {
+		t.Errorf("expected an error migrating a missing backup set")
+	}
+}
+
+func TestMigrateKeepsSharedVolumes(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	root := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(root)
+
+	source := destination + "/old"
+	if err := os.MkdirAll(filepath.Join(root, "old"), 0755); err != nil {
+		t.Fatalf("could not create the old prefix - %v", err)
+	}
+	if _, err := getCacheDir(source); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	oldStdout := helpers.Stdout
+	helpers.Stdout = ioutil.Discard
+	defer func() { helpers.Stdout = oldStdout }()
+
+	newSet := func(volumeName string) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volumeName,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+			Compressor:         helpers.InternalCompressor,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			HashAlgorithm:      helpers.SHA256Hash,
+			Destinations:       []string{source},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+		}
+	}
+	addVolume := func(set *helpers.JobInfo, data []byte) *helpers.VolumeInfo {
+		vol, err := helpers.CreateBackupVolume(context.Background(), set, int64(len(set.Volumes)+1))
+		if err != nil {
+			t.Fatalf("could not create volume - %v", err)
+		}
+		if _, err = vol.Write(data); err != nil {
+			t.Fatalf("could not write volume - %v", err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("could not close volume - %v", err)
+		}
+		defer vol.DeleteVolume()
+		if err = uploadManifest(context.Background(), set, vol, source); err != nil {
+			t.Fatalf("could not upload volume - %v", err)
+		}
+		set.Volumes = append(set.Volumes, vol)
+		return vol
+	}
+	uploadSet := func(set *helpers.JobInfo) string {
+		manifestVol, err := saveManifest(context.Background(), set, true)
+		if err != nil {
+			t.Fatalf("could not save manifest - %v", err)
+		}
+		defer manifestVol.DeleteVolume()
+		if err = uploadManifest(context.Background(), set, manifestVol, source); err != nil {
+			t.Fatalf("could not upload manifest - %v", err)
+		}
+		return manifestVol.ObjectName
+	}
+
+	// The second volume of tank/b was deduplicated with the volume tank/a uploaded
+	first := newSet("tank/a")
+	sharedVol := addVolume(first, bytes.Repeat([]byte{1}, 1024))
+	uploadSet(first)
+	second := newSet("tank/b")
+	ownVol := addVolume(second, bytes.Repeat([]byte{2}, 1024))
+	second.Volumes = append(second.Volumes, &helpers.VolumeInfo{
+		ObjectName:   sharedVol.ObjectName,
+		VolumeNumber: 2,
+		SHA256Sum:    sharedVol.SHA256Sum,
+		MD5Sum:       sharedVol.MD5Sum,
+		CRC32CSum32:  sharedVol.CRC32CSum32,
+		HashSum:      sharedVol.HashSum,
+		Size:         sharedVol.Size,
+		SharedObject: true,
+	})
+	secondManifest := uploadSet(second)
+
+	exists := func(prefix, name string) bool {
+		_, serr := os.Stat(filepath.Join(root, prefix, name))
+		return serr == nil
+	}
+
+	testCases := []struct {
+		set     *helpers.JobInfo
+		deleted []string
+		kept    []string
+	}{
+		// tank/a still refers to the shared volume under the old prefix
+		{second, []string{ownVol.ObjectName, secondManifest}, []string{sharedVol.ObjectName}},
+		// Once moved, no backup set under the old prefix refers to it anymore
+		{first, []string{sharedVol.ObjectName}, nil},
+	}
+
+	for idx, c := range testCases {
+		job := &helpers.JobInfo{
+			VolumeName:         c.set.VolumeName,
+			BaseSnapshot:       c.set.BaseSnapshot,
+			Separator:          c.set.Separator,
+			ManifestPrefix:     c.set.ManifestPrefix,
+			Destinations:       []string{destination},
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Millisecond,
+			MaxRetryTime:       time.Millisecond,
+		}
+		if err := Migrate(context.Background(), job, "old/", "new/", true); err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+		for _, object := range c.deleted {
+			if exists("old/", object) {
+				t.Errorf("%d: expected %s to be deleted from the old prefix", idx, object)
+			}
+		}
+		for _, object := range c.kept {
+			if !exists("old/", object) {
+				t.Errorf("%d: expected %s to be kept under the old prefix", idx, object)
+			}
+		}
+		for _, vol := range c.set.Volumes {
+			if !exists("new/", vol.ObjectName) {
+				t.Errorf("%d: expected %s to be copied to the new prefix", idx, vol.ObjectName)
+			}
+		}
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	// Each dataset reports how much was written to snap2 since snap1
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+if [ "$1" = "list" ]; then
+	for dataset; do :; done
+	printf '%s@snap2\t1600000100\n%s@snap1\t1600000000\n' "$dataset" "$dataset"
+	exit 0
+fi
+if [ "$1" = "get" ]; then
+	case "$6" in
+	written@*)
+		case "$7" in
+		tank/idle@*) echo 0 ;;
+		tank/touched@*) echo 4096 ;;
+		tank/busy@*) echo 1048576 ;;
+		*) echo "cannot get '$6'" >&2; exit 1 ;;
+		esac ;;
+	*) echo 1 ;;
+	esac
+	exit 0
+fi
+echo zfs stream
+`
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	oldStdout := helpers.Stdout
+	defer func() { helpers.Stdout = oldStdout }()
+
+	datasets := []string{"tank/idle", "tank/touched", "tank/busy", "tank/unknown"}
+	newJob := func(volume string, threshold uint64, incremental bool) *helpers.JobInfo {
+		j := &helpers.JobInfo{
+			VolumeName:         volume,
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap2", CreationTime: time.Unix(1600000100, 0)},
+			Compressor:         helpers.NoCompressor,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+			SkipUnchanged:      true,
+			UnchangedThreshold: threshold,
+		}
+		if incremental {
+			j.IncrementalSnapshot = helpers.SnapshotInfo{Name: "snap1", CreationTime: time.Unix(1600000000, 0)}
+		}
+		return j
+	}
+
+	testCases := []struct {
+		threshold   uint64
+		incremental bool
+		skipped     []string
+	}{
+		{0, true, []string{"tank/idle"}},
+		{64 * 1024, true, []string{"tank/idle", "tank/touched"}},
+		// Full backups are never skipped
+		{64 * 1024, false, nil},
+	}
+
+	for idx, c := range testCases {
+		run := newJob(strings.Join(datasets, ","), c.threshold, c.incremental)
+		for _, dataset := range datasets {
+			run.Datasets = append(run.Datasets, newJob(dataset, c.threshold, c.incremental))
+		}
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		if err := BackupDatasets(context.Background(), run); err != nil {
+			t.Errorf("%d: could not backup datasets - %v", idx, err)
+			continue
+		}
+
+		// Skipped datasets are not backed up, datasets that could not be checked are
+		for _, dataset := range run.Datasets {
+			backedUp := len(dataset.Volumes) > 0
+			isSkipped := false
+			for _, name := range c.skipped {
+				isSkipped = isSkipped || name == dataset.VolumeName
+			}
+			if backedUp == isSkipped {
+				t.Errorf("%d: expected %s to be skipped: %v", idx, dataset.VolumeName, isSkipped)
+			}
+		}
+
+		summary := out.String()
+		if len(c.skipped) == 0 && strings.Contains(summary, "Skipped") {
+			t.Errorf("%d: expected no skipped datasets in the summary, got %q", idx, summary)
+		} else if len(c.skipped) > 0 && !strings.Contains(summary, fmt.Sprintf("Skipped (unchanged): %d (%s)", len(c.skipped), strings.Join(c.skipped, ", "))) {
+			t.Errorf("%d: expected the skipped datasets %v in the summary, got %q", idx, c.skipped, summary)
+		}
+	}
+
+	// A single unchanged dataset is not backed up either, leaving no manifest so the next backup increments from snap1
+	target := strings.TrimPrefix(destination, "file://")
+	singleCases := []struct {
+		volume    string
+		unchanged bool
+	}{
+		{"tank/idle", true},
+		{"tank/busy", false},
+		{"tank/unknown", false},
+	}
+
+	for idx, c := range singleCases {
+		os.RemoveAll(target)
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatalf("%d: could not create target - %v", idx, err)
+		}
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		j := newJob(c.volume, 0, true)
+		if err := Backup(context.Background(), j); err != nil {
+			t.Errorf("%d: could not backup %s - %v", idx, c.volume, err)
+			continue
+		}
+
+		if j.Unchanged != c.unchanged {
+			t.Errorf("%d: expected %s to be unchanged: %v", idx, c.volume, c.unchanged)
+		}
+		if noChanges := strings.Contains(out.String(), "No changes to "+c.volume+" since snap1"); noChanges != c.unchanged {
+			t.Errorf("%d: expected the summary to report no changes: %v, got %q", idx, c.unchanged, out.String())
+		}
+
+		backend, err := prepareBackend(context.Background(), j, destination, nil)
+		if err != nil {
+			t.Fatalf("%d: could not prepare backend - %v", idx, err)
+		}
+		manifests, err := backend.List(context.Background(), "manifests")
+		backend.Close()
+		if err != nil {
+			t.Fatalf("%d: could not list manifests - %v", idx, err)
+		}
+		if created := len(manifests) > 0; created == c.unchanged {
+			t.Errorf("%d: expected a backup set to be created: %v, found manifests %v", idx, !c.unchanged, manifests)
+		}
+	}
+
+	// An unchanged dataset is reported in JSON when requested
+	helpers.JSONOutput = true
+	defer func() { helpers.JSONOutput = false }()
+	out := bytes.NewBuffer(nil)
+	helpers.Stdout = out
+	if err := Backup(context.Background(), newJob("tank/idle", 0, true)); err != nil {
+		t.Fatalf("could not backup tank/idle - %v", err)
+	}
+	var result struct {
+		VolumeName          string
+		IncrementalSnapshot string
+		Unchanged           bool
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("expected JSON output, got %q - %v", out.String(), err)
+	}
+	if !result.Unchanged || result.VolumeName != "tank/idle" || result.IncrementalSnapshot != "snap1" {
+		t.Errorf("expected tank/idle to be reported unchanged since snap1, got %+v", result)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	zfsExit := exec.Command("sh", "-c", "exit 1").Run()
+	sshExit := exec.Command("sh", "-c", "exit 255").Run()
+	notFound := exec.Command(filepath.Join(os.TempDir(), "zfsbackup-missing-zfs")).Run()
+
+	testCases := []struct {
+		err    error
+		status int
+	}{
+		{nil, ExitSuccess},
+		{errors.New("something went wrong"), ExitFailure},
+		{ErrTooManyFailures, ExitFailure},
+		{ErrNothingToBackUp, ExitNothingToBackUp},
+		{fmt.Errorf("%w, 1 of 3 datasets failed (tank/a)", ErrPartialBackup), ExitPartialBackup},
+		{ErrAlreadyRunning, ExitAlreadyRunning},
+		{helpers.ErrStartWindowMissed, ExitStartWindowMissed},
+		{&helpers.OperationError{Op: "initialize s3://bucket", Kind: helpers.ErrAuthFailed, Err: errors.New("403 Forbidden")}, ExitAuthFailed},
+		{&helpers.OperationError{Op: "upload to gs://bucket", Kind: helpers.ErrBackendUnreachable}, ExitBackendUnreachable},
+		{&helpers.OperationError{Op: "restore", Kind: helpers.ErrChainBroken}, ExitChainBroken},
+		{&helpers.OperationError{Op: "download", Kind: helpers.ErrChecksumMismatch}, ExitChecksumMismatch},
+		{&helpers.OperationError{Op: "decrypt", Kind: helpers.ErrKeyMissing}, ExitKeyMissing},
+		{zfsError("zfs send", "tank/data", zfsExit), ExitZFSFailed},
+		{zfsError("list snapshots", "tank/data", notFound), ExitZFSFailed},
+		// ssh failing to reach the host receiving the stream is not a zfs failure
+		{zfsError("zfs receive", "tank/data", sshExit), ExitFailure},
+		// The category is kept when wrapped, e.g. when every dataset of a multi-dataset backup failed
+		{fmt.Errorf("2 of 2 datasets failed to backup - %w", zfsError("zfs send", "tank/data", zfsExit)), ExitZFSFailed},
+	}
+
+	for idx, c := range testCases {
+		if status := ExitStatus(c.err); status != c.status {
+			t.Errorf("%d: expected exit status %d for %v, got %d", idx, c.status, c.err, status)
+		}
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	type step struct {
+		receive bool
+		idx     int
+		allowed bool
+	}
+
+	testCases := []struct {
+		volumes int
+		bytes   uint64
+		sizes   []uint64
+		steps   []step
+	}{
+		// Unbounded, volumes still start in order
+		{0, 0, []uint64{10, 10, 10}, []step{{false, 1, false}, {false, 0, true}, {false, 1, true}, {false, 2, true}}},
+		{2, 0, []uint64{10, 10, 10, 10}, []step{{false, 0, true}, {false, 1, true}, {false, 2, false}, {true, 0, false}, {false, 2, true}, {false, 3, false}, {true, 1, false}, {false, 3, true}}},
+		{0, 25, []uint64{10, 10, 10, 30}, []step{{false, 0, true}, {false, 1, true}, {false, 2, false}, {true, 0, false}, {false, 2, true}, {false, 3, false}, {true, 1, false}, {false, 3, false}, {true, 2, false}, {false, 3, true}}},
+		// The next volume to receive is allowed even if larger than the limit
+		{1, 5, []uint64{10, 10}, []step{{false, 0, true}, {false, 1, false}, {true, 0, false}, {false, 1, true}}},
+	}
+
+	for idx, c := range testCases {
+		ahead := newReadAhead(c.volumes, c.bytes, c.sizes)
+		for sidx, s := range c.steps {
+			if s.receive {
+				ahead.received(s.idx)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			err := ahead.acquire(ctx, s.idx)
+			cancel()
+			if (err == nil) != s.allowed {
+				t.Errorf("%d: step %d: expected volume %d to be allowed %v, got error %v", idx, sidx, s.idx, s.allowed, err)
+			}
+		}
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	manifests := map[string]string{
+		"manifests|tank-a|snap1.manifest": "manifest a",
+		"manifests|tank-b|snap1.manifest": "manifest b",
+		"manifests|tank-c|snap1.manifest": "manifest c",
+	}
+	for name, content := range manifests {
+		if err := ioutil.WriteFile(filepath.Join(target, name), []byte(content), 0644); err != nil {
+			t.Fatalf("could not write manifest %s - %v", name, err)
+		}
+	}
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+	cachePath := func(name string) string {
+		return filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(name))))
+	}
+	// a is cached as-is, b was truncated, c is missing and a manifest no longer in the destination is still cached
+	cached := map[string]string{
+		cachePath("manifests|tank-a|snap1.manifest"):   "manifest a",
+		cachePath("manifests|tank-b|snap1.manifest"):   "manif",
+		cachePath("manifests|tank-old|snap1.manifest"): "manifest old",
+	}
+	for path, content := range cached {
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("could not write cached manifest %s - %v", path, err)
+		}
+	}
+	partialDir, err := resumeDir(destination)
+	if err != nil {
+		t.Fatalf("could not create the resume dir - %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(partialDir, "vol1"), []byte("partial"), 0644); err != nil {
+		t.Fatalf("could not write partial volume - %v", err)
+	}
+
+	j := &helpers.JobInfo{ManifestPrefix: "manifests", Destinations: []string{destination}}
+	backend, err := prepareBackend(context.Background(), j, destination, nil)
+	if err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	report, err := verifyDestinationCache(context.Background(), j, destination, backend, false)
+	backend.Close()
+	if err != nil {
+		t.Fatalf("could not verify the cache - %v", err)
+	}
+	if !reflect.DeepEqual(report.Missing, []string{"manifests|tank-c|snap1.manifest"}) {
+		t.Errorf("expected c to be missing from the cache, got %v", report.Missing)
+	}
+	if !reflect.DeepEqual(report.WrongSize, []string{"manifests|tank-b|snap1.manifest"}) {
+		t.Errorf("expected b to be of the wrong size, got %v", report.WrongSize)
+	}
+	if len(report.Stale) != 1 || filepath.Join(localCachePath, report.Stale[0]) != cachePath("manifests|tank-old|snap1.manifest") {
+		t.Errorf("expected the old manifest to be stale, got %v", report.Stale)
+	}
+	if !report.SizesChecked || report.Repaired {
+		t.Errorf("expected the sizes to be checked and nothing to be repaired, got %+v", report)
+	}
+
+	oldStdout := helpers.Stdout
+	defer func() { helpers.Stdout = oldStdout }()
+	out := bytes.NewBuffer(nil)
+	helpers.Stdout = out
+
+	// Nothing is changed without repairing
+	if err = VerifyCache(context.Background(), j, false); err != errCacheOutOfSync {
+		t.Errorf("expected %v verifying a cache out of sync, got %v", errCacheOutOfSync, err)
+	}
+	if b, _ := ioutil.ReadFile(cachePath("manifests|tank-b|snap1.manifest")); string(b) != "manif" {
+		t.Errorf("expected the cache to be left as-is, got %q for b", b)
+	}
+	if !strings.Contains(out.String(), "out of sync") || !strings.Contains(out.String(), "Wrong size\tmanifests|tank-b|snap1.manifest") {
+		t.Errorf("unexpected report %q", out.String())
+	}
+
+	if err = VerifyCache(context.Background(), j, true); err != nil {
+		t.Fatalf("could not repair the cache - %v", err)
+	}
+	files, err := ioutil.ReadDir(localCachePath)
+	if err != nil {
+		t.Fatalf("could not list the cache dir - %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if len(names) != len(manifests)+1 {
+		t.Errorf("expected the manifests and the partial downloads in the cache dir, got %v", names)
+	}
+	for name, content := range manifests {
+		if b, rerr := ioutil.ReadFile(cachePath(name)); rerr != nil || string(b) != content {
+			t.Errorf("expected %s to be cached as %q, got %q (%v)", name, content, b, rerr)
+		}
+	}
+	if b, rerr := ioutil.ReadFile(filepath.Join(partialDir, "vol1")); rerr != nil || string(b) != "partial" {
+		t.Errorf("expected the partial downloads to be kept, got %q (%v)", b, rerr)
+	}
+	if siblings, _ := filepath.Glob(localCachePath + ".rebuild*"); len(siblings) != 0 {
+		t.Errorf("expected the rebuild dirs to be removed, found %v", siblings)
+	}
+
+	out.Reset()
+	if err = VerifyCache(context.Background(), j, false); err != nil {
+		t.Errorf("expected the repaired cache to be in sync, got %v", err)
+	}
+	if !strings.Contains(out.String(), "in sync") {
+		t.Errorf("unexpected report %q", out.String())
+	}
+}
+
+func TestOperationErrors(t *testing.T) {
+	helpers.ZFSPath = "false"
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	missingDir := filepath.Join(os.TempDir(), "zfsbackup-missing-target")
+	os.RemoveAll(missingDir)
+
+	job := &helpers.JobInfo{
+		VolumeName:   "tank/data",
+		BaseSnapshot: helpers.SnapshotInfo{Name: "snap2"},
+	}
+	incremental := &helpers.JobInfo{
+		VolumeName:          "tank/data",
+		BaseSnapshot:        helpers.SnapshotInfo{Name: "snap2"},
+		IncrementalSnapshot: helpers.SnapshotInfo{Name: "snap1"},
+	}
+
+	testCases := []struct {
+		run  func() error
+		kind error
+	}{
+		{
+			run: func() error {
+				_, err := prepareBackend(context.Background(), job, backends.FileBackendPrefix+"://"+missingDir, make(chan bool, 1))
+				return err
+			},
+			kind: helpers.ErrBackendUnreachable,
+		},
+		{
+			run: func() error {
+				return restoreChain(context.Background(), job, []*helpers.JobInfo{incremental})
+			},
+			kind: helpers.ErrChainBroken,
+		},
+	}
+
+	for idx, c := range testCases {
+		err := c.run()
+		var oerr *helpers.OperationError
+		if !errors.As(err, &oerr) || !errors.Is(err, c.kind) {
+			t.Errorf("%d: expected an operation error of kind %v, got %v", idx, c.kind, err)
+			continue
+		}
+		if oerr.Dataset != job.VolumeName {
+			t.Errorf("%d: expected the error to name dataset %s, got %q", idx, job.VolumeName, oerr.Dataset)
+		}
+	}
+}
+
+func TestRestoreChainKeyPrefix(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+	if _, err := getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	// Fake the zfs binary to receive the streams one after the other
+	receivedPath := filepath.Join(workingDir, "received")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "receive" ]; then
+	cat >> %s
+fi
+`, receivedPath)
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	// A chain of backup sets sent with hashed dataset names in their keys
+	snap1 := helpers.SnapshotInfo{Name: "snap1", CreationTime: time.Now().Add(-time.Hour)}
+	snap2 := helpers.SnapshotInfo{Name: "snap2", CreationTime: time.Now()}
+	newSet := func(base, incremental helpers.SnapshotInfo, payload string) *helpers.JobInfo {
+		set := &helpers.JobInfo{
+			VolumeName:          "tank/data",
+			BaseSnapshot:        base,
+			IncrementalSnapshot: incremental,
+			Compressor:          helpers.InternalCompressor,
+			CompressionLevel:    6,
+			Separator:           "|",
+			KeyPrefix:           helpers.KeyPrefixHash,
+			ManifestPrefix:      "manifests",
+			Destinations:        []string{destination},
+			MaxFileBuffer:       1,
+			MaxParallelUploads:  1,
+		}
+		vol, err := helpers.CreateBackupVolume(context.Background(), set, 1)
+		if err != nil {
+			t.Fatalf("could not create volume - %v", err)
+		}
+		vol.Write([]byte(payload))
+		if err = vol.Close(); err != nil {
+			t.Fatalf("could not close volume - %v", err)
+		}
+		defer vol.DeleteVolume()
+		if err = uploadManifest(context.Background(), set, vol, destination); err != nil {
+			t.Fatalf("could not upload volume - %v", err)
+		}
+		set.Volumes = []*helpers.VolumeInfo{vol}
+		manifestVol, err := saveManifest(context.Background(), set, true)
+		if err != nil {
+			t.Fatalf("could not save manifest - %v", err)
+		}
+		defer manifestVol.DeleteVolume()
+		if err = uploadManifest(context.Background(), set, manifestVol, destination); err != nil {
+			t.Fatalf("could not upload manifest - %v", err)
+		}
+		return set
+	}
+	full := newSet(snap1, helpers.SnapshotInfo{}, "full")
+	incremental := newSet(snap2, snap1, "incremental")
+	incremental.ParentSnap = full
+
+	// The restore is requested with the default key prefix, each set is looked up with the one it was sent with
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/data",
+		BaseSnapshot:       snap2,
+		Separator:          "|",
+		KeyPrefix:          helpers.KeyPrefixPath,
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		LocalVolume:        "tank/restored",
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Millisecond,
+		MaxRetryTime:       time.Second,
+	}
+	if err := restoreChain(context.Background(), j, []*helpers.JobInfo{full, incremental}); err != nil {
+		t.Fatalf("could not restore the chain - %v", err)
+	}
+	if received, err := ioutil.ReadFile(receivedPath); err != nil || string(received) != "fullincremental" {
+		t.Errorf("expected both backup sets to be received in order, got %q (%v)", received, err)
+	}
+}
+
+func TestManifestParts(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	// Over 1MiB of volumes in either manifest format
+	volumes := make([]*helpers.VolumeInfo, 12000)
+	for idx := range volumes {
+		volumes[idx] = &helpers.VolumeInfo{
+			ObjectName:   fmt.Sprintf("tank/test|snap.zstream.gz.vol%d", idx+1),
+			VolumeNumber: int64(idx + 1),
+			SHA256Sum:    fmt.Sprintf("%064x", idx+1),
+			Size:         1024,
+		}
+	}
+
+	testCases := []struct {
+		maxSize uint64
+		format  string
+		split   bool
+	}{
+		{0, helpers.ManifestFormatJSON, false},
+		{16, helpers.ManifestFormatJSON, false},
+		{1, helpers.ManifestFormatJSON, true},
+		{1, helpers.ManifestFormatBinary, true},
+	}
+
+	for idx, c := range testCases {
+		os.RemoveAll(target)
+		os.MkdirAll(target, os.ModePerm)
+		j := &helpers.JobInfo{
+			VolumeName:         "tank/test",
+			BaseSnapshot:       helpers.SnapshotInfo{Name: fmt.Sprintf("snap%d", idx), CreationTime: time.Now().Round(time.Second)},
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			ManifestFormat:     c.format,
+			MaxManifestSize:    c.maxSize,
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			Volumes:            volumes,
+		}
+
+		manifestVol, err := saveManifest(context.Background(), j, true)
+		if err != nil {
+			t.Fatalf("%d: could not save manifest - %v", idx, err)
+		}
+		if err = uploadManifestParts(context.Background(), j); err == nil {
+			err = uploadManifest(context.Background(), j, manifestVol, destination)
+		}
+		manifestVol.DeleteVolume()
+		if err != nil {
+			t.Fatalf("%d: could not upload manifest - %v", idx, err)
+		}
+
+		if (len(j.ManifestParts) > 1) != c.split {
+			t.Errorf("%d: expected the manifest to be split: %v, got %d parts", idx, c.split, len(j.ManifestParts))
+			continue
+		}
+		if len(j.Volumes) != len(volumes) {
+			t.Errorf("%d: expected the job to keep its %d volumes, got %d", idx, len(volumes), len(j.Volumes))
+		}
+		for _, part := range j.ManifestParts {
+			fi, serr := os.Stat(filepath.Join(target, part))
+			if serr != nil || !helpers.IsManifestPart(part) {
+				t.Errorf("%d: expected the manifest part %s to be uploaded - %v", idx, part, serr)
+			} else if uint64(fi.Size()) > c.maxSize*1024*1024 {
+				t.Errorf("%d: expected the manifest part %s to be at most %d MiB, got %d bytes", idx, part, c.maxSize, fi.Size())
+			}
+		}
+
+		backend, err := prepareBackend(context.Background(), j, destination, nil)
+		if err != nil {
+			t.Fatalf("%d: could not prepare backend - %v", idx, err)
+		}
+		name, err := manifestObjectName(context.Background(), j)
+		if err != nil {
+			t.Fatalf("%d: could not compute manifest name - %v", idx, err)
+		}
+		safeName := fmt.Sprintf("%x", md5.Sum([]byte(name)))
+
+		// The parts are synced along with the manifest and read as part of it
+		os.RemoveAll(localCachePath)
+		os.MkdirAll(localCachePath, os.ModePerm)
+		safeManifests, _, err := syncCache(context.Background(), j, localCachePath, backend)
+		if err != nil || !reflect.DeepEqual(safeManifests, []string{safeName}) {
+			t.Errorf("%d: expected only the manifest %s to be listed, got %v (%v)", idx, safeName, safeManifests, err)
+		}
+		readers := []func() (*helpers.JobInfo, error){
+			func() (*helpers.JobInfo, error) {
+				return readManifest(context.Background(), filepath.Join(localCachePath, safeName), j)
+			},
+			func() (*helpers.JobInfo, error) {
+				os.RemoveAll(localCachePath)
+				os.MkdirAll(localCachePath, os.ModePerm)
+				return fetchManifest(context.Background(), j, backend, localCachePath)
+			},
+			func() (*helpers.JobInfo, error) {
+				os.RemoveAll(localCachePath)
+				os.MkdirAll(localCachePath, os.ModePerm)
+				selectJob := *j
+				selectJob.ListLimit = 1
+				safeManifests, _, serr := syncSelectedCache(context.Background(), &selectJob, localCachePath, backend)
+				if serr != nil || len(safeManifests) != 1 {
+					return nil, fmt.Errorf("expected a single manifest to be selected, got %v (%v)", safeManifests, serr)
+				}
+				return readManifest(context.Background(), filepath.Join(localCachePath, safeManifests[0]), j)
+			},
+		}
+		for ridx, read := range readers {
+			manifest, rerr := read()
+			if rerr != nil {
+				t.Errorf("%d.%d: could not read manifest - %v", idx, ridx, rerr)
+				continue
+			}
+			if !reflect.DeepEqual(manifest.ManifestParts, j.ManifestParts) || len(manifest.Volumes) != len(volumes) {
+				t.Errorf("%d.%d: expected %d volumes in %d parts, got %d volumes in %d parts", idx, ridx, len(volumes), len(j.ManifestParts), len(manifest.Volumes), len(manifest.ManifestParts))
+				continue
+			}
+			for vidx, vol := range manifest.Volumes {
+				if vol.ObjectName != volumes[vidx].ObjectName || vol.SHA256Sum != volumes[vidx].SHA256Sum {
+					t.Errorf("%d.%d: expected volume %s at %d, got %s", idx, ridx, volumes[vidx].ObjectName, vidx, vol.ObjectName)
+					break
+				}
+			}
+		}
+
+		// A missing part makes the manifest unreadable
+		if c.split {
+			os.RemoveAll(localCachePath)
+			os.MkdirAll(localCachePath, os.ModePerm)
+			os.Remove(filepath.Join(target, j.ManifestParts[len(j.ManifestParts)-1]))
+			if _, err = fetchManifest(context.Background(), j, backend, localCachePath); err == nil {
+				t.Errorf("%d: expected an error reading a manifest missing one of its parts", idx)
+			}
+		}
+		backend.Close()
+	}
+}
+
+// A backend that keeps track of how many times it was asked to upload a volume
+type mockUploadCountingBackend struct {
+	mockBackend
+	uploads int
+}
+
+func (m *mockUploadCountingBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	m.uploads++
+	return m.mockBackend.Upload(ctx, vol)
+}
+
+func TestDryRun(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	// The destination does not exist, initializing its backend would fail
+	err := os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+	if err != nil {
+		t.Fatalf("could not remove target - %v", err)
+	}
+
+	// Any backend prepared for a mock destination is kept to check it was never uploaded to
+	var prepared []*mockUploadCountingBackend
+	backendForURI = func(uri string) (backends.Backend, error) {
+		if strings.HasPrefix(uri, "mock://") {
+			b := &mockUploadCountingBackend{}
+			prepared = append(prepared, b)
+			return b, nil
+		}
+		return backends.GetBackendForURI(uri)
+	}
+	defer func() { backendForURI = backends.GetBackendForURI }()
+
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+if [ "$1" = "list" ]; then
+	for dataset; do :; done
+	printf '%s@snap\t1600000000\n' "$dataset"
+	exit 0
+fi
+case "$*" in
+	*-nP*) printf 'full\ttank/data@snap\t2621440\nsize\t2621440\n'; exit 0 ;;
+esac
+# A dry run must not send the stream
+exit 1
+`
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	// Hooks with side effects are not run either
+	hookPath := filepath.Join(workingDir, "hook")
+	hookRan := filepath.Join(workingDir, "hook-ran")
+	if err = ioutil.WriteFile(hookPath, []byte("#!/bin/sh\ntouch "+hookRan+"\n"), 0700); err != nil {
+		t.Fatalf("could not write metadata hook - %v", err)
+	}
+
+	oldStdout := helpers.Stdout
+	defer func() { helpers.Stdout = oldStdout }()
+
+	for idx, maxFileBuffer := range []int{1, 0} {
+		stdout := bytes.NewBuffer(nil)
+		helpers.Stdout = stdout
+		j := &helpers.JobInfo{
+			VolumeName:         "tank/data",
+			BaseSnapshot:       helpers.SnapshotInfo{Name: "snap", CreationTime: time.Unix(1600000000, 0)},
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination, "mock://dryrun"},
+			MaxFileBuffer:      maxFileBuffer,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+			MetadataHook:       hookPath,
+			DryRun:             true,
+		}
+		if err = Backup(context.Background(), j); err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+
+		if j.ZFSStreamBytes != 2621440 {
+			t.Errorf("%d: expected a send stream of %d bytes, got %d", idx, 2621440, j.ZFSStreamBytes)
+		}
+		// The stream is only estimated, the volumes are named from the estimate
+		if len(j.Volumes) != 0 {
+			t.Errorf("%d: expected no volumes to be created, got %d", idx, len(j.Volumes))
+		}
+		if !strings.Contains(stdout.String(), "Volumes That Would Be Uploaded: up to 3") {
+			t.Errorf("%d: expected the summary to report up to 3 volumes, got %q", idx, stdout.String())
+		}
+		for _, b := range prepared {
+			if b.uploads != 0 {
+				t.Errorf("%d: expected Upload to never be called, got %d uploads", idx, b.uploads)
+			}
+		}
+		if _, err = os.Stat(strings.TrimPrefix(destination, "file://")); !os.IsNotExist(err) {
+			t.Errorf("%d: expected the destination to be left untouched, got %v", idx, err)
+		}
+		if _, err = os.Stat(hookRan); !os.IsNotExist(err) {
+			t.Errorf("%d: expected the metadata hook not to run, got %v", idx, err)
+		}
+		// Nothing should be cached as if it were uploaded either
+		if _, err = os.Stat(filepath.Join(workingDir, "cache", fmt.Sprintf("%x", md5.Sum([]byte(destination))))); !os.IsNotExist(err) {
+			t.Errorf("%d: expected no cache for the destination, got %v", idx, err)
+		}
+	}
+	if len(prepared) != 0 {
+		t.Errorf("expected no backend to be prepared for a dry run, got %d", len(prepared))
+	}
+}
+
+func TestVerifyCiphertext(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	key, err := openpgp.NewEntity("backup", "", "backup@example.com", config)
+	if err != nil {
+		t.Fatalf("could not generate key - %v", err)
+	}
+
+	j := &helpers.JobInfo{
+		VolumeName:         "tank/test",
+		BaseSnapshot:       helpers.SnapshotInfo{Name: "snap"},
+		Compressor:         helpers.InternalCompressor,
+		CompressionLevel:   6,
+		Separator:          "|",
+		ManifestPrefix:     "manifests",
+		Destinations:       []string{destination},
+		MaxFileBuffer:      1,
+		MaxParallelUploads: 1,
+		EncryptTo:          "backup@example.com",
+		EncryptKey:         key,
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		vol, verr := helpers.CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if verr != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, verr)
+		}
+		if _, verr = vol.Write(bytes.Repeat([]byte(fmt.Sprintf("zfs stream %d", idx)), 64*1024)); verr != nil {
+			t.Fatalf("%d: could not write volume - %v", idx, verr)
+		}
+		if verr = vol.Close(); verr != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, verr)
+		}
+		defer vol.DeleteVolume()
+		if verr = uploadManifest(context.Background(), j, vol, destination); verr != nil {
+			t.Fatalf("%d: could not upload volume - %v", idx, verr)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+
+	oldStdout := helpers.Stdout
+	helpers.JSONOutput = true
+	defer func() {
+		helpers.Stdout = oldStdout
+		helpers.JSONOutput = false
+	}()
+
+	// Without a key, nothing can be verified before the checksums were uploaded
+	verifyJob := &helpers.JobInfo{
+		VolumeName:   j.VolumeName,
+		BaseSnapshot: j.BaseSnapshot,
+		Separator:    j.Separator,
+		Destinations: j.Destinations,
+	}
+	helpers.Stdout = bytes.NewBuffer(nil)
+	if err = VerifyCiphertext(context.Background(), verifyJob); err == nil {
+		t.Errorf("expected an error verifying a backup set without checksums")
+	}
+
+	if err = uploadChecksums(context.Background(), j); err != nil {
+		t.Fatalf("could not upload checksums - %v", err)
+	}
+	if j.Checksums != j.ChecksumsObjectName() {
+		t.Errorf("expected the checksums %s to be recorded in the manifest, got %q", j.ChecksumsObjectName(), j.Checksums)
+	}
+
+	verify := func() ([]IntegrityResult, error) {
+		out := bytes.NewBuffer(nil)
+		helpers.Stdout = out
+		verr := VerifyCiphertext(context.Background(), verifyJob)
+		var results []IntegrityResult
+		if jerr := json.Unmarshal(out.Bytes(), &results); jerr != nil {
+			t.Fatalf("could not decode report %q - %v", out.String(), jerr)
+		}
+		return results, verr
+	}
+
+	results, err := verify()
+	if err != nil {
+		t.Errorf("expected the encrypted backup set to pass keyless verification, got %v", err)
+	}
+	if len(results) != len(j.Volumes) {
+		t.Fatalf("expected %d results, got %d", len(j.Volumes), len(results))
+	}
+
+	// Alter a single volume at the destination
+	objectPath := filepath.Join(strings.TrimPrefix(destination, "file://"), j.Volumes[1].ObjectName)
+	data, err := ioutil.ReadFile(objectPath)
+	if err != nil {
+		t.Fatalf("could not read %s - %v", j.Volumes[1].ObjectName, err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err = ioutil.WriteFile(objectPath, data, 0600); err != nil {
+		t.Fatalf("could not alter %s - %v", j.Volumes[1].ObjectName, err)
+	}
+
+	results, err = verify()
+	if err != errIntegrityVerificationFailed {
+		t.Errorf("expected keyless verification to fail, got %v", err)
+	}
+	if len(results) != len(j.Volumes) {
+		t.Fatalf("expected %d results, got %d", len(j.Volumes), len(results))
+	}
+	for idx, vol := range j.Volumes {
+		if results[idx].Object != vol.ObjectName || results[idx].Valid != (idx != 1) {
+			t.Errorf("%d: expected %s to be valid=%v, got %s valid=%v (%s)", idx, vol.ObjectName, idx != 1, results[idx].Object, results[idx].Valid, results[idx].Error)
+		}
+	}
+}
+
+func TestPruneBackupSets(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	backupSet := func(dataset, snapshot, from string, age time.Duration, volumes ...*helpers.VolumeInfo) *helpers.JobInfo {
+		j := &helpers.JobInfo{
+			VolumeName:   dataset,
+			BaseSnapshot: helpers.SnapshotInfo{Name: snapshot, CreationTime: now.Add(-age)},
+			Volumes:      volumes,
+		}
+		if from != "" {
+			j.IncrementalSnapshot = helpers.SnapshotInfo{Name: from}
+		}
+		return j
+	}
+
+	full1 := backupSet("tank/a", "s1", "", 40*day, &helpers.VolumeInfo{ObjectName: "full1.vol1"})
+	inc1 := backupSet("tank/a", "s2", "s1", 39*day, &helpers.VolumeInfo{ObjectName: "inc1.vol1"})
+	full2 := backupSet("tank/a", "s3", "", 30*day, &helpers.VolumeInfo{ObjectName: "full2.vol1"})
+	inc2 := backupSet("tank/a", "s4", "s3", 29*day, &helpers.VolumeInfo{ObjectName: "inc2.vol1"})
+	inc3 := backupSet("tank/a", "s5", "s4", 1*day, &helpers.VolumeInfo{ObjectName: "inc3.vol1"})
+	// Deduplicated against the oldest full backup set, the shared volume must outlive it
+	full3 := backupSet("tank/a", "s6", "", 10*day, &helpers.VolumeInfo{ObjectName: "full1.vol1", SharedObject: true}, &helpers.VolumeInfo{ObjectName: "full3.vol1"})
+	otherFull := backupSet("tank/b", "s1", "", 50*day, &helpers.VolumeInfo{ObjectName: "other1.vol1"})
+	otherInc := backupSet("tank/b", "s2", "s1", 49*day, &helpers.VolumeInfo{ObjectName: "other2.vol1"})
+	orphanInc := backupSet("tank/c", "s2", "s1", 20*day, &helpers.VolumeInfo{ObjectName: "orphan.vol1"})
+	lastFull := backupSet("tank/c", "s3", "", 15*day, &helpers.VolumeInfo{ObjectName: "last.vol1"})
+	// Link the chains by the creation time of their base snapshots too, as recorded in real manifests
+	inc1.IncrementalSnapshot.CreationTime = full1.BaseSnapshot.CreationTime
+	inc2.IncrementalSnapshot.CreationTime = full2.BaseSnapshot.CreationTime
+	inc3.IncrementalSnapshot.CreationTime = inc2.BaseSnapshot.CreationTime
+	otherInc.IncrementalSnapshot.CreationTime = otherFull.BaseSnapshot.CreationTime
+
+	manifests := []*helpers.JobInfo{full1, inc1, full2, inc2, inc3, full3, otherFull, otherInc, orphanInc, lastFull}
+	objects := []string{"full1.vol1", "inc1.vol1", "full2.vol1", "inc2.vol1", "inc3.vol1", "full3.vol1", "other1.vol1", "other2.vol1", "orphan.vol1", "last.vol1"}
+
+	testCases := []struct {
+		keepFullCount int
+		keepDuration  time.Duration
+		pruned        []*helpers.JobInfo
+		deleted       []string
+	}{
+		// The newest full backup set is kept along with the chain the newest backup set depends on
+		{1, 0, []*helpers.JobInfo{full1, inc1, orphanInc}, []string{"inc1.vol1", "orphan.vol1"}},
+		// Full backup sets are kept with every incremental backup set descending from them
+		{2, 0, []*helpers.JobInfo{full1, inc1, orphanInc}, []string{"inc1.vol1", "orphan.vol1"}},
+		{3, 0, []*helpers.JobInfo{orphanInc}, []string{"orphan.vol1"}},
+		// A recent incremental backup set keeps the older full backup set it depends on, but not a newer full
+		{0, 7 * day, []*helpers.JobInfo{full1, inc1, full3, orphanInc}, []string{"full1.vol1", "inc1.vol1", "full3.vol1", "orphan.vol1"}},
+		{0, 39*day + time.Hour, nil, nil},
+		// Either policy retaining a backup set keeps it
+		{1, 7 * day, []*helpers.JobInfo{full1, inc1, orphanInc}, []string{"inc1.vol1", "orphan.vol1"}},
+		{0, 60 * day, nil, nil},
+	}
+
+	for idx, c := range testCases {
+		keep, prune := pruneBackupSets(manifests, c.keepFullCount, c.keepDuration, now)
+		if len(keep)+len(prune) != len(manifests) {
+			t.Errorf("%d: expected %d backup sets to be kept or pruned, got %d", idx, len(manifests), len(keep)+len(prune))
+		}
+		if !reflect.DeepEqual(prune, c.pruned) {
+			t.Errorf("%d: expected to prune %v, got %v", idx, c.pruned, prune)
+		}
+		for _, manifest := range keep {
+			if manifest.IncrementalSnapshot.Name == "" || manifest == orphanInc {
+				continue
+			}
+			found := false
+			for _, base := range keep {
+				if base.VolumeName == manifest.VolumeName && base.BaseSnapshot.Name == manifest.IncrementalSnapshot.Name {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%d: kept %s@%s without the backup set it depends on", idx, manifest.VolumeName, manifest.BaseSnapshot.Name)
+			}
+		}
+		unreferenced, _ := unreferencedObjects(objects, keep, "manifests", false)
+		if !reflect.DeepEqual(unreferenced, c.deleted) {
+			t.Errorf("%d: expected to delete %v, got %v", idx, c.deleted, unreferenced)
+		}
+	}
+}
+
+// A backend that keeps track of how many downloads are in progress at once
+type mockConcurrentBackend struct {
+	mockRegionBackend
+	delays    map[string]time.Duration
+	active    int
+	peak      int
+	downloads map[string]int
+}
+
+func (m *mockConcurrentBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	b, ok := m.objects[filename]
+	m.downloads[filename]++
+	if m.active++; m.active > m.peak {
+		m.peak = m.active
+	}
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		m.active--
+		m.mutex.Unlock()
+	}()
+
+	if !ok {
+		return nil, errTest
+	}
+	time.Sleep(m.delays[filename])
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestParallelVolumeDownloads(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	manifest := &helpers.JobInfo{
+		VolumeName:   "tank/test",
+		BaseSnapshot: helpers.SnapshotInfo{Name: "snap"},
+		Compressor:   helpers.NoCompressor,
+	}
+	backend := &mockConcurrentBackend{delays: make(map[string]time.Duration)}
+	backend.objects = make(map[string][]byte)
+	var payload []byte
+	for i := 1; i <= 8; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i)}, 64*1024+i)
+		name := fmt.Sprintf("tank/test|snap.zstream.vol%d", i)
+		backend.objects[name] = b
+		// Later volumes download faster so they finish out of order
+		backend.delays[name] = time.Duration(9-i) * 10 * time.Millisecond
+		manifest.Volumes = append(manifest.Volumes, &helpers.VolumeInfo{
+			ObjectName: name,
+			Size:       uint64(len(b)),
+			SHA256Sum:  fmt.Sprintf("%x", sha256.Sum256(b)),
+			Compressor: helpers.NoCompressor,
+		})
+		payload = append(payload, b...)
+	}
+	last := manifest.Volumes[len(manifest.Volumes)-1].ObjectName
+
+	testCases := []struct {
+		maxFileBuffer int
+		maxDownloads  int
+		readAhead     int
+		resumable     bool
+		peak          int
+	}{
+		{4, 0, 0, false, 4},
+		{4, 2, 0, false, 2},
+		{4, 1, 0, false, 1},
+		{2, 8, 0, false, 2},
+		// No more volumes than read ahead of the volume being received are downloaded at a time
+		{4, 0, 1, false, 1},
+		{4, 0, 3, false, 3},
+		// The last volume was already downloaded by a previous run that was interrupted
+		{4, 2, 0, true, 2},
+	}
+
+	for idx, c := range testCases {
+		backend.peak, backend.downloads = 0, make(map[string]int)
+		if c.resumable {
+			dir, err := resumeDir(destination)
+			if err != nil {
+				t.Fatalf("%d: could not create the resume dir - %v", idx, err)
+			}
+			if err = ioutil.WriteFile(partialVolumePath(dir, last), backend.objects[last], 0600); err != nil {
+				t.Fatalf("%d: could not write the downloaded volume - %v", idx, err)
+			}
+		}
+
+		outputFile := filepath.Join(workingDir, fmt.Sprintf("stream%d.zfs", idx))
+		j := &helpers.JobInfo{
+			Destinations:         []string{destination},
+			MaxFileBuffer:        c.maxFileBuffer,
+			MaxParallelDownloads: c.maxDownloads,
+			ReadAheadVolumes:     c.readAhead,
+			ResumableRestore:     c.resumable,
+			OutputFile:           outputFile,
+			MaxBackoffTime:       time.Second,
+			MaxRetryTime:         time.Second,
+		}
+		set := *manifest
+		if err := receiveBackupSet(context.Background(), j, &set, backend); err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+
+		if backend.peak != c.peak {
+			t.Errorf("%d: expected at most %d downloads at a time, got %d", idx, c.peak, backend.peak)
+		}
+		for _, vol := range manifest.Volumes {
+			expected := 1
+			if c.resumable && vol.ObjectName == last {
+				expected = 0
+			}
+			if backend.downloads[vol.ObjectName] != expected {
+				t.Errorf("%d: expected %s to be downloaded %d times, got %d", idx, vol.ObjectName, expected, backend.downloads[vol.ObjectName])
+			}
+		}
+		if written, err := ioutil.ReadFile(outputFile); err != nil {
+			t.Errorf("%d: could not read written stream - %v", idx, err)
+		} else if !bytes.Equal(written, payload) {
+			t.Errorf("%d: the volumes were not written in order", idx)
+		}
+	}
+}
+
+func TestResumeRestore(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	full := &helpers.JobInfo{VolumeName: "tank/data", BaseSnapshot: helpers.SnapshotInfo{Name: "s1", CreationTime: created}}
+	inc1 := &helpers.JobInfo{VolumeName: "tank/data", BaseSnapshot: helpers.SnapshotInfo{Name: "s2", CreationTime: created.Add(time.Hour)}, IncrementalSnapshot: full.BaseSnapshot, ParentSnap: full}
+	inc2 := &helpers.JobInfo{VolumeName: "tank/data", BaseSnapshot: helpers.SnapshotInfo{Name: "s3", CreationTime: created.Add(2 * time.Hour)}, IncrementalSnapshot: inc1.BaseSnapshot, ParentSnap: inc1}
+
+	chain := restoreSnapshotChain(inc2)
+	if len(chain) != 3 || chain[0].Name != "s1" || chain[2].Name != "s3" {
+		t.Errorf("expected the chain s1, s2, s3, got %v", chain)
+	}
+
+	state := func(completed []helpers.SnapshotInfo, inProgress *helpers.JobInfo) *helpers.RestoreState {
+		s := helpers.NewRestoreState("", "tank/data", "restore/data", "s3")
+		s.Completed = completed
+		if inProgress != nil {
+			s.InProgress = &inProgress.BaseSnapshot
+		}
+		return s
+	}
+
+	testCases := []struct {
+		state *helpers.RestoreState
+		jobs  []*helpers.JobInfo
+		token string
+		abort bool
+		valid bool
+	}{
+		// A restore that was not started before
+		{nil, []*helpers.JobInfo{full, inc1, inc2}, "", false, true},
+		// Stopped between backup sets, the target holds the snapshots received
+		{state([]helpers.SnapshotInfo{full.BaseSnapshot}, nil), []*helpers.JobInfo{inc1, inc2}, "", false, true},
+		// Stopped while receiving, the partial receive it left is discarded
+		{state([]helpers.SnapshotInfo{full.BaseSnapshot}, inc1), []*helpers.JobInfo{inc1, inc2}, "1-abc-def", true, true},
+		{state(nil, full), []*helpers.JobInfo{full, inc1, inc2}, "1-abc-def", true, true},
+		{state(nil, full), []*helpers.JobInfo{full, inc1, inc2}, "", false, true},
+		// Partially received state the restore did not leave is never discarded
+		{nil, []*helpers.JobInfo{full, inc1, inc2}, "1-abc-def", false, false},
+		{state([]helpers.SnapshotInfo{full.BaseSnapshot}, nil), []*helpers.JobInfo{inc1, inc2}, "1-abc-def", false, false},
+		{state([]helpers.SnapshotInfo{full.BaseSnapshot}, inc2), []*helpers.JobInfo{inc1, inc2}, "1-abc-def", false, false},
+		{state(nil, full), nil, "1-abc-def", false, false},
+		// A snapshot recorded as received is missing from the target, e.g. it was rolled back since
+		{state([]helpers.SnapshotInfo{full.BaseSnapshot}, inc1), []*helpers.JobInfo{full, inc1, inc2}, "", false, false},
+	}
+
+	for idx, c := range testCases {
+		abort, err := resumeRestore(c.state, c.jobs, c.token)
+		if c.valid != (err == nil) {
+			t.Errorf("%d: expected valid=%v, got error %v", idx, c.valid, err)
+		}
+		if abort != c.abort {
+			t.Errorf("%d: expected abort=%v, got %v", idx, c.abort, abort)
+		}
+	}
+}
+
+func TestRetryZFS(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupretry")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	countPath := filepath.Join(workingDir, "runs")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		stderr   string
+		failures int
+		// Whether part of the stream is written before failing
+		partial  bool
+		retries  int
+		patterns []string
+		runs     int
+		valid    bool
+	}{
+		{"cannot open 'tank/data@snap1': dataset is busy", 2, false, 3, nil, 3, true},
+		{"cannot send 'tank/data': pool I/O is currently suspended", 1, false, 3, nil, 2, true},
+		// Retries are bounded
+		{"cannot open 'tank/data@snap1': dataset is busy", 5, false, 3, nil, 4, false},
+		{"cannot open 'tank/data@snap1': dataset is busy", 1, false, 0, nil, 1, false},
+		// Permanent failures are not retried
+		{"cannot open 'tank/data@snap1': dataset does not exist", 1, false, 3, nil, 1, false},
+		{"internal error: unexpected failure", 1, false, 3, nil, 1, false},
+		// A send that wrote part of its stream cannot be run again without duplicating it
+		{"cannot open 'tank/data@snap1': dataset is busy", 1, true, 3, nil, 1, false},
+		// The patterns are configurable
+		{"cannot send: lock held by another process", 1, false, 3, []string{"lock held"}, 2, true},
+		{"cannot open 'tank/data@snap1': dataset is busy", 1, false, 3, []string{"lock held"}, 1, false},
+	}
+
+	for idx, c := range testCases {
+		partial := ""
+		if c.partial {
+			partial = "printf partial"
+		}
+		script := fmt.Sprintf(`#!/bin/sh
+runs=$(($(cat %[1]s 2>/dev/null || echo 0) + 1))
+echo $runs > %[1]s
+if [ $runs -le %[2]d ]; then
+	%[3]s
+	echo "%[4]s" >&2
+	exit 1
+fi
+printf stream
+`, countPath, c.failures, partial, c.stderr)
+		if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+			t.Fatalf("could not write fake zfs binary - %v", err)
+		}
+		os.Remove(countPath)
+
+		j := &helpers.JobInfo{
+			VolumeName:       "tank/data",
+			BaseSnapshot:     helpers.SnapshotInfo{Name: "snap1"},
+			ZFSRetries:       c.retries,
+			ZFSRetryPatterns: c.patterns,
+			MaxBackoffTime:   time.Millisecond,
+		}
+		out := new(bytes.Buffer)
+		err = retryZFS(context.Background(), j, "zfs send", func() error {
+			return runZFSSend(context.Background(), j, out)
+		}, func() bool { return out.Len() == 0 })
+
+		if c.valid != (err == nil) {
+			t.Errorf("%d: expected valid=%v, got error %v", idx, c.valid, err)
+		}
+		if err != nil && !errors.Is(err, helpers.ErrZFSFailed) {
+			t.Errorf("%d: expected a zfs failure, got %v", idx, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), c.stderr) {
+			t.Errorf("%d: expected the error to include the output of zfs, got %v", idx, err)
+		}
+		if c.valid && out.String() != "stream" {
+			t.Errorf("%d: expected the stream to be written once, got %q", idx, out.String())
+		}
+		runs, _ := ioutil.ReadFile(countPath)
+		if got := strings.TrimSpace(string(runs)); got != strconv.Itoa(c.runs) {
+			t.Errorf("%d: expected zfs to be run %d times, got %s", idx, c.runs, got)
+		}
+	}
+
+	// Nothing is run again once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	j := &helpers.JobInfo{VolumeName: "tank/data", ZFSRetries: 3, MaxBackoffTime: time.Millisecond}
+	retryZFS(ctx, j, "zfs receive", func() error {
+		calls++
+		cancel()
+		return &helpers.ZFSCommandError{Stderr: "dataset is busy", Err: errors.New("exit status 1")}
+	}, nil)
+	if calls != 1 {
+		t.Errorf("expected a single call once the context is done, got %d", calls)
+	}
+}
+
+func TestSelectIncrementalBookmark(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupbookmark")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to list the snapshots and bookmarks of tank/data, daily1 and daily2 were pruned
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+case "$7" in
+	snapshot) printf 'tank/data@daily3\t1500000300\n' ;;
+	bookmark) printf 'tank/data#other2\t1500000200\t222\ntank/data#daily2\t1500000200\t222\ntank/data#kept\t1500000100\t111\n' ;;
+esac
+`
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		snapshot helpers.SnapshotInfo
+		bookmark string
+	}{
+		// The snapshot still exists, no need for a bookmark
+		{helpers.SnapshotInfo{Name: "daily3", CreationTime: time.Unix(1500000300, 0)}, ""},
+		{helpers.SnapshotInfo{Name: "daily1", CreationTime: time.Unix(1500000100, 0), GUID: "111"}, "kept"},
+		// A bookmark of the same name as the snapshot is preferred
+		{helpers.SnapshotInfo{Name: "daily2", CreationTime: time.Unix(1500000200, 0), GUID: "222"}, "daily2"},
+		{helpers.SnapshotInfo{Name: "daily1", CreationTime: time.Unix(1500000100, 0), GUID: "999"}, ""},
+		// Without a GUID recorded the creation time is compared
+		{helpers.SnapshotInfo{Name: "daily1", CreationTime: time.Unix(1500000100, 0)}, "kept"},
+		{helpers.SnapshotInfo{Name: "daily0", CreationTime: time.Unix(1500000000, 0)}, ""},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{VolumeName: "tank/data", IncrementalSnapshot: c.snapshot}
+		if err := selectIncrementalBookmark(context.Background(), j); err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+		if j.IncrementalBookmark != c.bookmark {
+			t.Errorf("%d: expected to increment from the bookmark %q, got %q", idx, c.bookmark, j.IncrementalBookmark)
+		}
+	}
+
+	existCases := []struct {
+		bookmark string
+		snapshot helpers.SnapshotInfo
+		exists   bool
+	}{
+		{"kept", helpers.SnapshotInfo{Name: "kept", CreationTime: time.Unix(1500000100, 0)}, true},
+		{"kept", helpers.SnapshotInfo{Name: "daily1", CreationTime: time.Unix(1500000100, 0), GUID: "111"}, true},
+		// The bookmark was not created from the snapshot
+		{"kept", helpers.SnapshotInfo{Name: "kept", CreationTime: time.Unix(1500000200, 0)}, false},
+		{"missing", helpers.SnapshotInfo{Name: "missing", CreationTime: time.Unix(1500000100, 0)}, false},
+	}
+
+	for idx, c := range existCases {
+		j := &helpers.JobInfo{VolumeName: "tank/data", IncrementalSnapshot: c.snapshot, IncrementalBookmark: c.bookmark}
+		exists, err := validateBookmarkExists(context.Background(), j)
+		if err != nil {
+			t.Errorf("%d: unexpected error - %v", idx, err)
+			continue
+		}
+		if exists != c.exists {
+			t.Errorf("%d: expected the bookmark to exist to be %v, got %v", idx, c.exists, exists)
+		}
+	}
+}
+
+func TestResolveIncrementalBookmark(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+	if _, err := getCacheDir(destination); err != nil {
+		t.Fatalf("could not create cache dir - %v", err)
+	}
+
+	// Fake the zfs binary to list the bookmarks of tank/data, only the snapshot kept was created from was backed up
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+case "$7" in
+	bookmark) printf 'tank/data#other\t1500000200\t222\ntank/data#kept\t1500000100\t111\n' ;;
+esac
+`
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	backedUp := &helpers.JobInfo{
+		VolumeName:     "tank/data",
+		BaseSnapshot:   helpers.SnapshotInfo{Name: "daily1", CreationTime: time.Unix(1500000100, 0), GUID: "111"},
+		Compressor:     helpers.InternalCompressor,
+		Separator:      "|",
+		ManifestPrefix: "manifests",
+		Destinations:   []string{destination},
+	}
+	manifestVol, err := saveManifest(context.Background(), backedUp, true)
+	if err != nil {
+		t.Fatalf("could not save manifest - %v", err)
+	}
+	defer manifestVol.DeleteVolume()
+	if err = uploadManifest(context.Background(), backedUp, manifestVol, destination); err != nil {
+		t.Fatalf("could not upload manifest - %v", err)
+	}
+
+	testCases := []struct {
+		bookmark string
+		snapshot string
+		valid    errTestFunc
+	}{
+		// The backup set is recorded as incrementing from the snapshot, not the bookmark
+		{"kept", "daily1", nilErrTest},
+		// The snapshot other was created from was never backed up
+		{"other", "", nonNilErrTest},
+		{"missing", "", nonNilErrTest},
+	}
+
+	for idx, c := range testCases {
+		j := &helpers.JobInfo{
+			VolumeName:          "tank/data",
+			BaseSnapshot:        helpers.SnapshotInfo{Name: "daily3", CreationTime: time.Unix(1500000300, 0)},
+			IncrementalBookmark: c.bookmark,
+			Separator:           "|",
+			ManifestPrefix:      "manifests",
+			Destinations:        []string{destination},
+		}
+		if err := ResolveIncrementalBookmark(context.Background(), j); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if j.IncrementalSnapshot.Name != c.snapshot {
+			t.Errorf("%d: expected to increment from the snapshot %q, got %q", idx, c.snapshot, j.IncrementalSnapshot.Name)
+		}
+	}
+}
+
+func TestIncrementalGroupBackup(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	target := strings.TrimPrefix(destination, "file://")
+	defer os.RemoveAll(target)
+
+	// Fake the zfs binary so every dataset has snap1, and snap2 once the snap2 file exists
+	snap2 := filepath.Join(workingDir, "snap2")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+if [ "$1" = "list" ]; then
+	for dataset; do :; done
+	[ -e ` + snap2 + ` ] && printf '%s@snap2\t1600000100\n' "$dataset"
+	printf '%s@snap1\t1600000000\n' "$dataset"
+	exit 0
+fi
+echo zfs stream
+`
+	if err := ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	helpers.ZFSPath = zfsPath
+	defer func() { helpers.ZFSPath = "zfs" }()
+
+	newJob := func(volume string) *helpers.JobInfo {
+		return &helpers.JobInfo{
+			VolumeName:         volume,
+			StartTime:          time.Now(),
+			Compressor:         helpers.InternalCompressor,
+			CompressionLevel:   6,
+			Separator:          "|",
+			ManifestPrefix:     "manifests",
+			Destinations:       []string{destination},
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Second,
+			MaxRetryTime:       time.Second,
+			VolumeSize:         1,
+			FullIfOlderThan:    -1 * time.Minute,
+		}
+	}
+	backupGroup := func(name string, incremental bool) {
+		group := newJob("mygroup")
+		group.GroupName = "mygroup"
+		group.GenerateChecksums = true
+		group.BaseSnapshot = helpers.SnapshotInfo{Name: name, CreationTime: time.Now()}
+		for _, volume := range []string{"tank/a", "tank/b"} {
+			member := newJob(volume)
+			member.Full = !incremental
+			member.Incremental = incremental
+			// The smart options resolve the snapshots of each member from the earlier backups of that dataset
+			if err := ProcessSmartOptions(context.Background(), member); err != nil {
+				t.Fatalf("%s: could not process the smart options of %s - %v", name, volume, err)
+			}
+			group.GroupMembers = append(group.GroupMembers, member)
+		}
+		if err := BackupGroup(context.Background(), group); err != nil {
+			t.Fatalf("%s: could not backup the group - %v", name, err)
+		}
+
+		// The checksums of the group cover the volumes of every member
+		f, err := os.Open(filepath.Join(target, group.Checksums))
+		if err != nil {
+			t.Fatalf("%s: expected the checksums of the group to be uploaded - %v", name, err)
+		}
+		defer f.Close()
+		checksums, err := helpers.ParseChecksums(f)
+		if err != nil {
+			t.Fatalf("%s: could not parse the checksums of the group - %v", name, err)
+		}
+		if len(checksums) != len(group.AllVolumes()) || len(checksums) < len(group.GroupMembers) {
+			t.Errorf("%s: expected a checksum for each of the %d volumes of the group, got %d", name, len(group.AllVolumes()), len(checksums))
+		}
+	}
+
+	backupGroup("full", false)
+	if err := ioutil.WriteFile(snap2, nil, 0600); err != nil {
+		t.Fatalf("could not add snap2 - %v", err)
+	}
+	backupGroup("incremental", true)
+
+	for idx, volume := range []string{"tank/a", "tank/b"} {
+		backups, err := getBackupsForTarget(context.Background(), volume, destination, newJob(volume))
+		if err != nil {
+			t.Errorf("%d: could not list the backups of %s - %v", idx, volume, err)
+			continue
+		}
+		if len(backups) != 2 {
+			t.Errorf("%d: expected 2 backups of %s, got %d", idx, volume, len(backups))
+			continue
+		}
+		if backups[0].BaseSnapshot.Name != "snap2" || backups[0].IncrementalSnapshot.Name != "snap1" {
+			t.Errorf("%d: expected %s@snap2 to be incremented from snap1, got %s@%s from %q", idx, volume, volume, backups[0].BaseSnapshot.Name, backups[0].IncrementalSnapshot.Name)
+		}
+		if backups[1].BaseSnapshot.Name != "snap1" || backups[1].IncrementalSnapshot.Name != "" {
+			t.Errorf("%d: expected a full backup of %s@snap1, got %s@%s from %q", idx, volume, volume, backups[1].BaseSnapshot.Name, backups[1].IncrementalSnapshot.Name)
+		}
+	}
+}
+
+// A backend serving the objects it holds that keeps track of what was pre downloaded
+type mockPreDownloadBackend struct {
+	mockRegionBackend
+	predownloaded []string
+}
+
+func (m *mockPreDownloadBackend) PreDownload(ctx context.Context, objects []string) error {
+	m.predownloaded = append(m.predownloaded, objects...)
+	return nil
+}
+
+func TestVerifyBackupSet(t *testing.T) {
+	workingDir, destination := prepareCacheTest(t)
+	defer os.RemoveAll(workingDir)
+	defer os.RemoveAll(strings.TrimPrefix(destination, "file://"))
+
+	j := &helpers.JobInfo{
+		VolumeName:       "tank/test",
+		BaseSnapshot:     helpers.SnapshotInfo{Name: "snap"},
+		Compressor:       helpers.InternalCompressor,
+		CompressionLevel: 6,
+		Separator:        "|",
+		MaxFileBuffer:    1,
+	}
+	objects := make(map[string][]byte)
+	for idx := 0; idx < 3; idx++ {
+		vol, verr := helpers.CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if verr != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, verr)
+		}
+		if _, verr = vol.Write(bytes.Repeat([]byte(fmt.Sprintf("zfs stream %d", idx)), 64*1024)); verr != nil {
+			t.Fatalf("%d: could not write volume - %v", idx, verr)
+		}
+		if verr = vol.Close(); verr != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, verr)
+		}
+		defer vol.DeleteVolume()
+		if verr = vol.OpenVolume(); verr != nil {
+			t.Fatalf("%d: could not open volume - %v", idx, verr)
+		}
+		b, verr := ioutil.ReadAll(vol)
+		vol.Close()
+		if verr != nil {
+			t.Fatalf("%d: could not read volume - %v", idx, verr)
+		}
+		objects[vol.ObjectName] = b
+		j.Volumes = append(j.Volumes, vol)
+	}
+
+	testCases := []struct {
+		tamper func(objects map[string][]byte, vol *helpers.VolumeInfo)
+		valid  []bool
+	}{
+		{nil, []bool{true, true, true}},
+		// The checksum of the altered volume no longer matches the manifest
+		{func(objects map[string][]byte, vol *helpers.VolumeInfo) {
+			objects[vol.ObjectName][len(objects[vol.ObjectName])/2] ^= 0xff
+		}, []bool{true, false, true}},
+		// The checksum of a volume corrupted before it was uploaded matches, but it cannot be decompressed
+		{func(objects map[string][]byte, vol *helpers.VolumeInfo) {
+			b := objects[vol.ObjectName]
+			b[len(b)/2] ^= 0xff
+			vol.SHA256Sum = fmt.Sprintf("%x", sha256.Sum256(b))
+		}, []bool{true, false, true}},
+	}
+
+	for idx, c := range testCases {
+		manifest := &helpers.JobInfo{
+			VolumeName:   j.VolumeName,
+			BaseSnapshot: j.BaseSnapshot,
+			Compressor:   j.Compressor,
+		}
+		backend := &mockPreDownloadBackend{}
+		backend.objects = make(map[string][]byte)
+		for _, vol := range j.Volumes {
+			manifest.Volumes = append(manifest.Volumes, &helpers.VolumeInfo{
+				ObjectName: vol.ObjectName,
+				SHA256Sum:  vol.SHA256Sum,
+				HashSum:    vol.HashSum,
+				Compressor: vol.Compressor,
+			})
+			backend.objects[vol.ObjectName] = append([]byte(nil), objects[vol.ObjectName]...)
+		}
+		if c.tamper != nil {
+			c.tamper(backend.objects, manifest.Volumes[1])
+		}
+
+		results := verifyBackupSet(context.Background(), backend, manifest, &helpers.JobInfo{})
+		if len(backend.predownloaded) != len(manifest.Volumes) {
+			t.Errorf("%d: expected %d volumes to be pre downloaded, got %v", idx, len(manifest.Volumes), backend.predownloaded)
+		}
+		if len(results) != len(c.valid) {
+			t.Errorf("%d: expected %d results, got %d", idx, len(c.valid), len(results))
+			continue
+		}
+		for vidx, valid := range c.valid {
+			if results[vidx].Object != manifest.Volumes[vidx].ObjectName || results[vidx].Valid != valid {
+				t.Errorf("%d: expected %s to be valid=%v, got %s valid=%v (%s)", idx, manifest.Volumes[vidx].ObjectName, valid, results[vidx].Object, results[vidx].Valid, results[vidx].Error)
+			}
+		}
+	}
+
+	// The report outputs the result of each volume and the overall result
+	oldStdout := helpers.Stdout
+	defer func() { helpers.Stdout = oldStdout }()
+	out := bytes.NewBuffer(nil)
+	helpers.Stdout = out
+	report := VerificationReport{Results: []IntegrityResult{{Object: "vol1", Valid: true}, {Object: "vol2", Error: "checksum mismatch"}}}
+	if err := reportVerification(j, report); err != nil {
+		t.Fatalf("could not report the verification - %v", err)
+	}
+	for _, expected := range []string{"PASS\tvol1", "FAIL\tvol2\tchecksum mismatch", "Overall: FAIL (1 of 2 checks passed)"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the report to contain %q, got %q", expected, out.String())
+		}
+	}
+}
+
+func TestDependencyTrees(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2020, 1, 1, hour, 0, 0, 0, time.UTC) }
+	manifest := func(volume, snapshot string, hour int, base string, baseHour int) *helpers.JobInfo {
+		j := &helpers.JobInfo{VolumeName: volume, BaseSnapshot: helpers.SnapshotInfo{Name: snapshot, CreationTime: at(hour)}}
+		if base != "" {
+			j.IncrementalSnapshot = helpers.SnapshotInfo{Name: base, CreationTime: at(baseHour)}
+		}
+		return j
+	}
+	manifests := []*helpers.JobInfo{
+		manifest("tank/a", "s1", 1, "", 0),
+		manifest("tank/a", "s2", 2, "s1", 1),
+		manifest("tank/a", "s3", 3, "s2", 2),
+		manifest("tank/a", "s4", 4, "s1", 1),
+		manifest("tank/a", "s5", 5, "", 0),
+		manifest("tank/a", "s7", 7, "s6", 6),
+		manifest("tank/b", "s1", 1, "", 0),
+	}
+
+	trees := dependencyTrees(linkManifests(manifests))
+
+	expectedTree := `tank/a
+  @s1 (full, 2020-01-01T01:00:00Z)
+    @s2 (incremental from @s1, 2020-01-01T02:00:00Z)
+      @s3 (incremental from @s2, 2020-01-01T03:00:00Z)
+    @s4 (incremental from @s1, 2020-01-01T04:00:00Z)
+  @s5 (full, 2020-01-01T05:00:00Z)
+  @s7 (incremental from @s6, base not found, 2020-01-01T07:00:00Z)
+tank/b
+  @s1 (full, 2020-01-01T01:00:00Z)
+`
+	if got := renderDependencyTree(trees); got != expectedTree {
+		t.Errorf("expected the tree\n%s\ngot\n%s", expectedTree, got)
+	}
+
+	expectedDOT := `digraph backups {
+	n0 [label="tank/a@s1", shape=box];
+	n1 [label="tank/a@s2"];
+	n2 [label="tank/a@s3"];
+	n1 -> n2;
+	n0 -> n1;
+	n3 [label="tank/a@s4"];
+	n0 -> n3;
+	n4 [label="tank/a@s5", shape=box];
+	n5 [label="tank/a@s7", style=dashed];
+	n6 [label="tank/b@s1", shape=box];
+}
+`
+	if got := renderDependencyDOT(trees); got != expectedDOT {
+		t.Errorf("expected the graph\n%s\ngot\n%s", expectedDOT, got)
+	}
+
+	oldStdout := helpers.Stdout
+	helpers.JSONOutput = true
+	defer func() {
+		helpers.Stdout = oldStdout
+		helpers.JSONOutput = false
+	}()
+	out := bytes.NewBuffer(nil)
+	helpers.Stdout = out
+	if err := printDependencyTrees(helpers.ListFormatTree, trees); err != nil {
+		t.Fatalf("could not output the trees - %v", err)
+	}
+	var decoded []DatasetTree
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("could not decode %q - %v", out.String(), err)
+	}
+	if len(decoded) != 2 || len(decoded[0].Roots) != 3 || len(decoded[0].Roots[0].Children) != 2 || decoded[0].Roots[0].Children[0].Children[0].Snapshot != "s3" || !decoded[0].Roots[2].MissingBase {
+		t.Errorf("unexpected JSON trees %s", out.String())
+	}
+}
+
+// A backend keeping the config it was initialized with
+type mockConfigBackend struct {
+	mockBackend
+	conf *backends.BackendConfig
+}
+
+func (m *mockConfigBackend) Init(ctx context.Context, conf *backends.BackendConfig, opts ...backends.Option) error {
+	m.conf = conf
+	return nil
+}
+
+func TestPrepareBackendExpiryTagging(t *testing.T) {
+	backend := &mockConfigBackend{}
+	backendForURI = func(uri string) (backends.Backend, error) { return backend, nil }
+	defer func() { backendForURI = backends.GetBackendForURI }()
+
+	// The objects are tagged from the start of the job, however long ago it started
+	start := time.Now().Add(-36 * time.Hour)
+	expiresAt := start.Add(30 * 24 * time.Hour)
+	j := &helpers.JobInfo{StartTime: start, ExpireAfter: 30 * 24 * time.Hour, ExpiresAt: &expiresAt}
+
+	if _, err := prepareBackend(context.Background(), j, "mock://", nil); err != nil {
+		t.Fatalf("could not prepare backend - %v", err)
+	}
+	if !backend.conf.ExpiresAt.Equal(expiresAt) || backend.conf.ExpiryTagging != "zfsbackup-expire-days=30" {
+		t.Errorf("expected the objects to expire at %v and be tagged to expire after 30 days, got %v and %q", expiresAt, backend.conf.ExpiresAt, backend.conf.ExpiryTagging)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+var errBatchRestoreFailed = errors.New("one or more backup sets of the batch failed to restore")
+
+// BatchRestoreResult is the outcome of restoring the backup set of a single dataset as part of a batch.
+type BatchRestoreResult struct {
+	Dataset  string
+	Snapshot string `json:",omitempty"`
+	Target   string `json:",omitempty"`
+	Restored bool
+	Error    string `json:",omitempty"`
+	Elapsed  time.Duration
+}
+
+// batchRestore is a single restore of a batch, err is set if it could not be resolved to a backup set to restore.
+type batchRestore struct {
+	job         *helpers.JobInfo
+	volumeSnaps []*helpers.JobInfo
+	err         error
+}
+
+// BatchRestore will restore the backup sets selected by the provided JobInfo's BatchSelectors, or the newest
+// backup set of every dataset found in the target destination when BatchAll is set, restoring up to
+// MaxParallelBatchRestores of them at a time. Each selector is either a dataset, to restore its newest backup set,
+// or a dataset@snapshot. A dataset is received into the local volume it is mapped to by the TargetMap, or under
+// the LocalVolume with the -d or -e options. A failed restore does not stop the others, the outcome of each is
+// reported once all of them are done and an error is returned if any failed.
+func BatchRestore(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareRestoreBackend(ctx, jobInfo)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	// Sync the local cache once for the whole batch
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		helpers.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return serr
+	}
+
+	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if derr != nil {
+		return derr
+	}
+
+	restores := selectBatchRestores(jobInfo, linkManifests(decodedManifests))
+	helpers.AppLogger.Infof("Restoring %d backup sets, %d at a time.", len(restores), jobInfo.MaxParallelBatchRestores)
+	results := runBatchRestore(ctx, restores, jobInfo.MaxParallelBatchRestores, func(ctx context.Context, r *batchRestore) error {
+		return withRollback(ctx, r.job, func() error { return restoreChain(ctx, r.job, r.volumeSnaps) })
+	})
+
+	if err := reportBatchRestore(results); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if !result.Restored {
+			failed++
+		}
+	}
+	if failed > 0 {
+		helpers.AppLogger.Errorf("%d of %d backup sets failed to restore.", failed, len(results))
+		return errBatchRestoreFailed
+	}
+
+	helpers.AppLogger.Noticef("Done. Restored %d backup sets. Elapsed Time: %v", len(results), time.Since(jobInfo.StartTime))
+	return nil
+}
+
+// selectBatchRestores will resolve the selectors of the provided JobInfo to the backup sets found in the provided
+// manifest tree, computing the receive options of each. Selectors that could not be resolved are returned with an error.
+func selectBatchRestores(jobInfo *helpers.JobInfo, manifestTree map[string][]*helpers.JobInfo) []*batchRestore {
+	selectors := jobInfo.BatchSelectors
+	if jobInfo.BatchAll {
+		selectors = make([]string, 0, len(manifestTree))
+		for volume := range manifestTree {
+			selectors = append(selectors, volume)
+		}
+		sort.Strings(selectors)
+	}
+
+	restores := make([]*batchRestore, 0, len(selectors))
+	seen := make(map[string]bool, len(selectors))
+	for _, selector := range selectors {
+		job := *jobInfo
+		job.BatchSelectors = nil
+		job.AutoRestore = true
+		job.BaseSnapshot = helpers.SnapshotInfo{}
+		job.IncrementalSnapshot = helpers.SnapshotInfo{}
+		parts := strings.SplitN(selector, "@", 2)
+		job.VolumeName = parts[0]
+		if len(parts) == 2 {
+			job.BaseSnapshot.Name = parts[1]
+		}
+
+		r := &batchRestore{job: &job, volumeSnaps: manifestTree[job.VolumeName]}
+		restores = append(restores, r)
+		target, mapped := jobInfo.MappedTarget(job.VolumeName)
+		if mapped {
+			job.LocalVolume = target
+			job.FullPath = false
+			job.LastPath = false
+		}
+
+		switch {
+		case seen[job.VolumeName]:
+			r.err = fmt.Errorf("%s was selected more than once", job.VolumeName)
+		case len(r.volumeSnaps) == 0:
+			r.err = fmt.Errorf("could not find any backup sets for %s", job.VolumeName)
+		case !mapped && !job.FullPath && !job.LastPath:
+			r.err = fmt.Errorf("%s is not mapped to a local volume and neither the -d nor -e option was provided", job.VolumeName)
+		default:
+			r.err = job.ValidateReceiveTarget()
+		}
+		seen[job.VolumeName] = true
+	}
+
+	return restores
+}
+
+// runBatchRestore will run the provided restore function for each of the provided restores, up to parallel of them
+// at a time, and return the outcome of each in the same order. Restores that could not be resolved are not run.
+func runBatchRestore(ctx context.Context, restores []*batchRestore, parallel int, restore func(context.Context, *batchRestore) error) []BatchRestoreResult {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]BatchRestoreResult, len(restores))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for idx := range restores {
+		r := restores[idx]
+		result := &results[idx]
+		result.Dataset = r.job.VolumeName
+		if r.err != nil {
+			helpers.AppLogger.Errorf("Will not restore %s - %v", r.job.VolumeName, r.err)
+			result.Error = r.err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			start := time.Now()
+			helpers.AppLogger.Infof("Restoring %s to %s.", r.job.VolumeName, r.job.ReceiveTarget())
+			err := restore(ctx, r)
+			result.Snapshot = r.job.BaseSnapshot.Name
+			result.Target = r.job.ReceiveTarget()
+			result.Elapsed = time.Since(start)
+			if err != nil {
+				helpers.AppLogger.Errorf("Could not restore %s due to error - %v", r.job.VolumeName, err)
+				result.Error = err.Error()
+				return
+			}
+			result.Restored = true
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// reportBatchRestore will output the outcome of each restore of a batch.
+func reportBatchRestore(results []BatchRestoreResult) error {
+	if helpers.JSONOutput {
+		j, jerr := json.Marshal(results)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(helpers.Stdout, string(j))
+		return nil
+	}
+
+	restored := 0
+	output := make([]string, 0, len(results)+1)
+	for _, result := range results {
+		status := "FAIL"
+		if result.Restored {
+			status = "OK"
+			restored++
+		}
+		line := fmt.Sprintf("%s\t%s@%s\t%s\t%v", status, result.Dataset, result.Snapshot, result.Target, result.Elapsed.Round(time.Second))
+		if result.Error != "" {
+			line = fmt.Sprintf("%s\t%s", line, result.Error)
+		}
+		output = append(output, line)
+	}
+	output = append([]string{fmt.Sprintf("Restored %d of %d backup sets:\n", restored, len(results))}, output...)
+	fmt.Fprintln(helpers.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+)
+
+// ResolveIncrementalBookmark will find the snapshot the bookmark the provided job increments from was created from
+// by matching the bookmark's GUID against the snapshots recorded in the manifests of each destination. The backup set
+// is recorded as incrementing from that snapshot so restores can link it to the backup set it is received on top of.
+// An error is returned if the bookmark does not exist or its snapshot was not backed up to every destination.
+func ResolveIncrementalBookmark(ctx context.Context, j *helpers.JobInfo) error {
+	bookmarks, err := helpers.GetBookmarks(ctx, j.VolumeName)
+	if err != nil {
+		return zfsError("list bookmarks", j.VolumeName, err)
+	}
+	var guid string
+	for _, bookmark := range bookmarks {
+		if bookmark.Name == j.IncrementalBookmark {
+			guid = bookmark.GUID
+			break
+		}
+	}
+	if guid == "" {
+		return fmt.Errorf("the bookmark %s#%s does not exist", j.VolumeName, j.IncrementalBookmark)
+	}
+
+	var chainBackups []*helpers.JobInfo
+	for idx, destination := range j.Destinations {
+		backups, berr := getBackupsForTarget(ctx, j.VolumeName, destination, j)
+		if berr != nil {
+			return berr
+		}
+		source := backupOfGUID(backups, guid)
+		if source == nil {
+			return fmt.Errorf("no backup set of %s in %s was sent from the snapshot the bookmark %s was created from - try doing a full backup instead", j.VolumeName, destination, j.IncrementalBookmark)
+		}
+		if idx == 0 {
+			j.IncrementalSnapshot = source.BaseSnapshot
+			chainBackups = backups
+		}
+	}
+
+	helpers.AppLogger.Infof("The bookmark %s was created from %s, incrementing from it.", j.IncrementalBookmark, j.IncrementalSnapshot.Name)
+	return j.CheckSnapshotChain(snapshotChain(j, chainBackups))
+}
+
+// backupOfGUID will return the backup whose snapshot has the provided GUID, if any.
+func backupOfGUID(backups []*helpers.JobInfo, guid string) *helpers.JobInfo {
+	for _, bkp := range backups {
+		if bkp.BaseSnapshot.GUID == guid {
+			return bkp
+		}
+	}
+	return nil
+}
+
+// validateBookmarkExists will check that the bookmark the incremental stream of the provided job is sent from
+// exists and was created from the snapshot the job increments from.
+func validateBookmarkExists(ctx context.Context, j *helpers.JobInfo) (bool, error) {
+	bookmarks, err := helpers.GetBookmarks(ctx, j.VolumeName)
+	if err != nil {
+		return false, err
+	}
+	for _, bookmark := range bookmarks {
+		if bookmark.Name == j.IncrementalBookmark {
+			return bookmarkOf(&bookmark, &j.IncrementalSnapshot), nil
+		}
+	}
+
+	return false, nil
+}
+
+// selectIncrementalBookmark will have the provided job send its incremental stream from a bookmark of the snapshot
+// it increments from when that snapshot no longer exists, e.g. because it was pruned once backed up. A bookmark of
+// the same name as the snapshot is preferred. The job is left as is if the snapshot exists or it has no bookmark.
+func selectIncrementalBookmark(ctx context.Context, j *helpers.JobInfo) error {
+	if ok, err := validateSnapShotExists(ctx, &j.IncrementalSnapshot, j.VolumeName); err != nil || ok {
+		return err
+	}
+
+	bookmarks, err := helpers.GetBookmarks(ctx, j.VolumeName)
+	if err != nil {
+		return fmt.Errorf("could not list the bookmarks of %s to increment from in place of %s - %w", j.VolumeName, j.IncrementalSnapshot.Name, err)
+	}
+	for idx := range bookmarks {
+		if !bookmarkOf(&bookmarks[idx], &j.IncrementalSnapshot) {
+			continue
+		}
+		if j.IncrementalBookmark == "" || bookmarks[idx].Name == j.IncrementalSnapshot.Name {
+			j.IncrementalBookmark = bookmarks[idx].Name
+		}
+	}
+	if j.IncrementalBookmark != "" {
+		helpers.AppLogger.Infof("The snapshot %s to increment from no longer exists, incrementing from its bookmark %s instead.", j.IncrementalSnapshot.Name, j.IncrementalBookmark)
+	}
+
+	return nil
+}
+
+// bookmarkOf will return true if the provided bookmark was created from the provided snapshot. Bookmarks keep the
+// GUID and creation time of their snapshot, the GUID is compared when the snapshot's was recorded.
+func bookmarkOf(bookmark, snapshot *helpers.SnapshotInfo) bool {
+	if snapshot.GUID != "" && bookmark.GUID != "" {
+		return snapshot.GUID == bookmark.GUID
+	}
+	return bookmark.CreationTime.Equal(snapshot.CreationTime)
+}
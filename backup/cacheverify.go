@@ -0,0 +1,302 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+var errCacheOutOfSync = errors.New("the local cache of manifests does not match the destination")
+
+// CacheReport describes how the local cache of manifests of a destination differs from the manifests found in it.
+type CacheReport struct {
+	Destination string
+	// Manifests found in the destination but not in the cache
+	Missing []string `json:",omitempty"`
+	// Cached files, by their name in the cache, of manifests no longer found in the destination
+	Stale []string `json:",omitempty"`
+	// Manifests cached with a size other than the one of the manifest in the destination, e.g. truncated
+	WrongSize []string `json:",omitempty"`
+	// Whether the sizes could be compared, not all backends report them
+	SizesChecked bool
+	Repaired     bool
+}
+
+// InSync returns true if no difference between the cache and the destination was found.
+func (r *CacheReport) InSync() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0 && len(r.WrongSize) == 0
+}
+
+// VerifyCache will compare the local cache of manifests of each destination, which list, clean and restore read
+// from, against the manifests found in the destination, reporting any cached manifest missing, no longer found in
+// the destination or of a different size. If repair is set, a cache that differs is rebuilt from the manifests in
+// the destination and swapped in place of the old one once complete.
+func VerifyCache(pctx context.Context, jobInfo *helpers.JobInfo, repair bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	var reports []*CacheReport
+	outOfSync := false
+	for _, destination := range jobInfo.Destinations {
+		backend, err := prepareBackend(ctx, jobInfo, destination, nil)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", destination, err)
+			return err
+		}
+
+		report, err := verifyDestinationCache(ctx, jobInfo, destination, backend, repair)
+		backend.Close()
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+		if !report.InSync() && !report.Repaired {
+			outOfSync = true
+		}
+	}
+
+	if err := reportCache(reports); err != nil {
+		return err
+	}
+	if outOfSync {
+		return errCacheOutOfSync
+	}
+	return nil
+}
+
+// verifyDestinationCache will check, and repair if requested, the local cache of the provided destination.
+func verifyDestinationCache(ctx context.Context, jobInfo *helpers.JobInfo, destination string, backend backends.Backend, repair bool) (*CacheReport, error) {
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", destination, err)
+		return nil, err
+	}
+
+	manifests, err := cachedManifestSources(ctx, jobInfo, backend)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not list the manifests of target %s due to error - %v.", destination, err)
+		return nil, err
+	}
+
+	report, err := checkCache(localCachePath, manifests)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not check the cache dir of target %s due to error - %v.", destination, err)
+		return nil, err
+	}
+	report.Destination = destination
+
+	if repair && !report.InSync() {
+		helpers.AppLogger.Noticef("Rebuilding the local cache of manifests of %s from the %d manifests found in it.", destination, len(manifests))
+		if err = rebuildCache(ctx, localCachePath, backend, manifests); err != nil {
+			helpers.AppLogger.Errorf("Could not rebuild the cache dir of target %s due to error - %v.", destination, err)
+			return nil, err
+		}
+		report.Repaired = true
+	}
+
+	return report, nil
+}
+
+// cachedManifest is a manifest, or part of one, that belongs in the local cache, with the object it is downloaded from.
+type cachedManifest struct {
+	Name   string
+	Source string
+	// The size of the object, -1 if unknown
+	Size int64
+}
+
+// cachedManifestSources will list the manifests of the provided backend as syncCache caches them, along with their
+// size if the backend reports it. Manifests only found as copies under the mirror prefixes are downloaded from the copy.
+func cachedManifestSources(ctx context.Context, j *helpers.JobInfo, backend backends.Backend) ([]cachedManifest, error) {
+	var manifests []cachedManifest
+	if lister, ok := backend.(backends.DetailedLister); ok {
+		objects, err := lister.ListDetailed(ctx, j.ManifestPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			manifests = append(manifests, cachedManifest{Name: obj.Name, Source: obj.Name, Size: obj.Size})
+		}
+	} else {
+		names, err := backend.List(ctx, j.ManifestPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			manifests = append(manifests, cachedManifest{Name: name, Source: name, Size: -1})
+		}
+	}
+
+	names := make([]string, len(manifests))
+	for idx := range manifests {
+		names[idx] = manifests[idx].Name
+	}
+	sources, err := listManifestMirrors(ctx, j, backend, names)
+	if err != nil {
+		return nil, err
+	}
+	for name, source := range sources {
+		manifests = append(manifests, cachedManifest{Name: name, Source: source, Size: -1})
+	}
+
+	sort.Slice(manifests, func(i, k int) bool { return manifests[i].Name < manifests[k].Name })
+	return manifests, nil
+}
+
+// checkCache will compare the files of the provided cache dir against the provided manifests.
+func checkCache(localCachePath string, manifests []cachedManifest) (*CacheReport, error) {
+	files, err := ioutil.ReadDir(localCachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := make(map[string]os.FileInfo, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			cached[file.Name()] = file
+		}
+	}
+
+	report := &CacheReport{SizesChecked: true}
+	for _, manifest := range manifests {
+		safeName := fmt.Sprintf("%x", md5.Sum([]byte(manifest.Name)))
+		file, ok := cached[safeName]
+		delete(cached, safeName)
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, manifest.Name)
+		case manifest.Size < 0:
+			report.SizesChecked = false
+		case file.Size() != manifest.Size:
+			report.WrongSize = append(report.WrongSize, manifest.Name)
+		}
+	}
+	for name := range cached {
+		report.Stale = append(report.Stale, name)
+	}
+	sort.Strings(report.Stale)
+
+	return report, nil
+}
+
+// rebuildCache will download the provided manifests to a new cache dir next to the provided one and swap it in place
+// of the old one once all of them were downloaded, so the cache is never left partially rebuilt. Subdirectories of the
+// old cache dir, such as the partial downloads of a resumable restore, are moved to the new one.
+func rebuildCache(ctx context.Context, localCachePath string, backend backends.Backend, manifests []cachedManifest) error {
+	rebuildPath, err := ioutil.TempDir(filepath.Dir(localCachePath), filepath.Base(localCachePath)+".rebuild")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rebuildPath)
+
+	sources := make([]string, len(manifests))
+	for idx := range manifests {
+		sources[idx] = manifests[idx].Source
+	}
+	if err = backend.PreDownload(ctx, sources); err != nil {
+		return fmt.Errorf("could not prepare manifests for download due to error - %v", err)
+	}
+	for _, manifest := range manifests {
+		safeName := fmt.Sprintf("%x", md5.Sum([]byte(manifest.Name)))
+		if err = downloadTo(ctx, backend, manifest.Source, filepath.Join(rebuildPath, safeName)); err != nil {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(localCachePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			if err = os.Rename(filepath.Join(localCachePath, file.Name()), filepath.Join(rebuildPath, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	oldPath := rebuildPath + ".old"
+	if err = os.Rename(localCachePath, oldPath); err != nil {
+		return err
+	}
+	if err = os.Rename(rebuildPath, localCachePath); err != nil {
+		// Put the old cache back rather than leave none
+		if rerr := os.Rename(oldPath, localCachePath); rerr != nil {
+			helpers.AppLogger.Errorf("Could not restore the previous cache dir %s from %s due to error - %v", localCachePath, oldPath, rerr)
+		}
+		return err
+	}
+
+	return os.RemoveAll(oldPath)
+}
+
+// reportCache will output the provided reports.
+func reportCache(reports []*CacheReport) error {
+	if helpers.JSONOutput {
+		j, jerr := json.Marshal(reports)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(helpers.Stdout, string(j))
+		return nil
+	}
+
+	var output []string
+	for _, report := range reports {
+		status := "in sync"
+		if report.Repaired {
+			status = "repaired"
+		} else if !report.InSync() {
+			status = "out of sync"
+		}
+		output = append(output, fmt.Sprintf("Local cache of %s: %s", report.Destination, status))
+		for _, name := range report.Missing {
+			output = append(output, fmt.Sprintf("\tMissing\t%s", name))
+		}
+		for _, name := range report.Stale {
+			output = append(output, fmt.Sprintf("\tStale\t%s", name))
+		}
+		for _, name := range report.WrongSize {
+			output = append(output, fmt.Sprintf("\tWrong size\t%s", name))
+		}
+		if !report.SizesChecked {
+			output = append(output, "\tThe backend does not report object sizes, only missing and stale manifests were checked.")
+		}
+	}
+	fmt.Fprintln(helpers.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
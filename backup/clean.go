@@ -23,6 +23,7 @@ package backup
 import (
 	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -32,13 +33,19 @@ import (
 	"github.com/cenkalti/backoff"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/kietdlam/zfsbackup-go/backends"
 	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
 	//"../helpers"
 )
 
+// deleteRetryTime is how long the objects that could not be deleted are retried for.
+var deleteRetryTime = 10 * time.Minute
+
 // Clean will remove files found in the desination that are not found in any of the manifests found locally or in the destination.
 // If cleanLocal is true, then local manifests not found in the destination are ignored and deleted. This function will optionally
-// delete broken backup sets in the destination if the --force flag is provided.
+// delete broken backup sets in the destination if the --force flag is provided, and the backup sets the retention policy set
+// by KeepFullCount and KeepDuration allows to delete, see pruneBackupSets.
 func Clean(pctx context.Context, jobInfo *helpers.JobInfo, cleanLocal bool) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
@@ -78,12 +85,24 @@ func Clean(pctx context.Context, jobInfo *helpers.JobInfo, cleanLocal bool) erro
 		decodedManifests = append(decodedManifests, decodedManifest)
 	}
 
+	// Drop the backup sets the retention policy allows to delete so their volumes are no longer referenced
+	var prunedManifests []*helpers.JobInfo
+	if jobInfo.KeepFullCount > 0 || jobInfo.KeepDuration > 0 {
+		decodedManifests, prunedManifests = pruneBackupSets(decodedManifests, jobInfo.KeepFullCount, jobInfo.KeepDuration, time.Now())
+		for _, manifest := range prunedManifests {
+			helpers.AppLogger.Noticef("Pruning backup set %s@%s.", manifest.VolumeName, manifest.BaseSnapshot.Name)
+		}
+	}
+
 	if !cleanLocal {
 		if len(localOnlyFiles) > 0 {
 			helpers.AppLogger.Noticef("There are %d local manifests not found in the destination, use --cleanLocal to delete these locally and any of their volumes found in the destination.", len(localOnlyFiles))
 			for _, manifest := range localOnlyFiles {
 				manifestPath := filepath.Join(localCachePath, manifest)
 				decodedManifest, oerr := readManifest(ctx, manifestPath, jobInfo)
+				if errors.Is(oerr, errManifestPart) {
+					continue
+				}
 				if oerr != nil {
 					helpers.AppLogger.Errorf("Could not read manifest %s due to error - %v", manifestPath, oerr)
 					return oerr
@@ -110,57 +129,43 @@ func Clean(pctx context.Context, jobInfo *helpers.JobInfo, cleanLocal bool) erro
 		return err
 	}
 
-	// Remove Manifest Files
-	for idx := 0; idx < len(allObjects); idx++ {
-		if strings.HasPrefix(allObjects[idx], jobInfo.ManifestPrefix) {
-			allObjects = append(allObjects[:idx], allObjects[idx+1:]...)
-			idx--
+	allObjects, brokenManifests := unreferencedObjects(allObjects, decodedManifests, jobInfo.ManifestPrefix, jobInfo.Force)
+	if len(jobInfo.ManifestMirrorPrefixes) > 0 {
+		// Copies of manifests are not referenced by any manifest, only remove those of broken backup sets below
+		kept := allObjects[:0]
+		for _, obj := range allObjects {
+			if !hasManifestMirrorPrefix(jobInfo, obj) {
+				kept = append(kept, obj)
+			}
 		}
+		allObjects = kept
 	}
-
-	// Go through all manifests and remove from the allObjects list what we know should exist
-	for _, manifest := range decodedManifests {
-		for vidx, vol := range manifest.Volumes {
-			found := false
-			for idx := range allObjects {
-				if strings.Compare(vol.ObjectName, allObjects[idx]) == 0 {
-					allObjects = append(allObjects[:idx], allObjects[idx+1:]...)
-					found = true
-					break
-				}
+	allObjects, err = filterGracePeriod(ctx, backend, allObjects, manifestEndTimes(append(brokenManifests, prunedManifests...)), jobInfo.GracePeriod)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not list object details in backend %s due to error - %v", target, err)
+		return err
+	}
+	for _, manifest := range append(brokenManifests, prunedManifests...) {
+		// Compute the manifest object name and cache name to delete
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.SignKey = jobInfo.SignKey
+		manifest.EncryptKey = jobInfo.EncryptKey
+		tempManifest, terr := helpers.CreateManifestVolume(ctx, manifest)
+		if terr != nil {
+			helpers.AppLogger.Errorf("Could not compute manifest path due to error - %v.", terr)
+			return terr
+		}
+		tempManifest.Close()
+		tempManifest.DeleteVolume()
+		for _, name := range append([]string{tempManifest.ObjectName}, manifest.ManifestParts...) {
+			allObjects = append(allObjects, name)
+			for _, prefix := range jobInfo.ManifestMirrorPrefixes {
+				allObjects = append(allObjects, mirrorObjectName(jobInfo, name, prefix))
 			}
-
-			if !found {
-				// Broken backup set! inform the user!
-				if jobInfo.Force {
-					helpers.AppLogger.Warningf("The following backup set is missing volume %s. Removing entire backupset:\n\n%s", vol.ObjectName, manifest.String())
-
-					// Compute the manifest object name and cache name to delete
-					manifest.ManifestPrefix = jobInfo.ManifestPrefix
-					manifest.SignKey = jobInfo.SignKey
-					manifest.EncryptKey = jobInfo.EncryptKey
-					tempManifest, terr := helpers.CreateManifestVolume(ctx, manifest)
-					if terr != nil {
-						helpers.AppLogger.Errorf("Could not compute manifest path due to error - %v.", terr)
-						return terr
-					}
-					allObjects = append(allObjects, tempManifest.ObjectName)
-					tempManifest.Close()
-					tempManifest.DeleteVolume()
-					manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(tempManifest.ObjectName))))
-					err = os.Remove(manifestPath)
-					if err != nil {
-						helpers.AppLogger.Errorf("Could not delete local manifest %s due to error - %v. Continuing.", manifestPath, err)
-					}
-
-					// Delete all volumes already processed in the manifest
-					for i := 0; i < vidx; i++ {
-						allObjects = append(allObjects, manifest.Volumes[i].ObjectName)
-					}
-					break
-				} else {
-					helpers.AppLogger.Warningf("The following backup set is missing volume %s:\n\n%s\n\nPass the --force flag to delete this backup set.", vol.ObjectName, manifest.String())
-				}
+			manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(name))))
+			err = os.Remove(manifestPath)
+			if err != nil {
+				helpers.AppLogger.Errorf("Could not delete local manifest %s due to error - %v. Continuing.", manifestPath, err)
 			}
 		}
 	}
@@ -168,14 +173,38 @@ func Clean(pctx context.Context, jobInfo *helpers.JobInfo, cleanLocal bool) erro
 	helpers.AppLogger.Noticef("Starting to delete %d objects in destination.", len(allObjects))
 
 	// Whatever is left in allObjects was not found in any manifest, delete 'em
+	helpers.AppLogger.Debugf("Waiting to delete %d objects in destination.", len(allObjects))
+	err = deleteObjects(ctx, backend, target, allObjects)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not finish clean operation due to error, aborting: %v", err)
+		return err
+	}
+
+	helpers.AppLogger.Noticef("Done.")
+	return nil
+}
+
+// deleteObjects will delete the provided objects from the backend, in batches when it can delete several objects in a
+// single request, and one by one otherwise. Objects under a retention policy or legal hold are skipped.
+func deleteObjects(ctx context.Context, backend backends.Backend, target string, objects []string) error {
+	batcher, _ := backend.(backends.BatchDeleter)
+	batchSize := 1
+	if batcher != nil && batcher.MaxDeleteBatchSize() > 1 {
+		batchSize = batcher.MaxDeleteBatchSize()
+	}
+
 	var group *errgroup.Group
 	group, ctx = errgroup.WithContext(ctx)
 
-	deleteChan := make(chan string, len(allObjects))
-	for _, obj := range allObjects {
-		deleteChan <- obj
+	batches := make(chan []string, len(objects)/batchSize+1)
+	for start := 0; start < len(objects); start += batchSize {
+		end := start + batchSize
+		if end > len(objects) {
+			end = len(objects)
+		}
+		batches <- objects[start:end]
 	}
-	close(deleteChan)
+	close(batches)
 
 	// Let's not slam the endpoint with a lot of concurrent requests, pick a sensible default and stick to it
 	for i := 0; i < 5; i++ {
@@ -184,38 +213,234 @@ func Clean(pctx context.Context, jobInfo *helpers.JobInfo, cleanLocal bool) erro
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				case objectPath, ok := <-deleteChan:
+				case batch, ok := <-batches:
 					if !ok {
 						return nil
 					}
-
-					be := backoff.NewExponentialBackOff()
-					be.MaxInterval = time.Minute
-					be.MaxElapsedTime = 10 * time.Minute
-					retryconf := backoff.WithContext(be, ctx)
-
-					operation := func() error {
-						return backend.Delete(ctx, objectPath)
+					if err := deleteBatch(ctx, backend, batcher, target, batch); err != nil {
+						return err
 					}
+				}
+			}
+		})
+	}
 
-					if berr := backoff.Retry(operation, retryconf); berr != nil {
-						helpers.AppLogger.Errorf("Could not delete object %s in due to error - %v", objectPath, berr)
-						return berr
-					}
+	return group.Wait()
+}
 
-					helpers.AppLogger.Debugf("Deleted %s.", filepath.Join(target, objectPath))
+// deleteBatch will delete the provided objects with a single request if a batcher is provided, or the only object
+// provided otherwise, retrying the objects that could not be deleted. The outcome of each object is recorded and an
+// error is returned if any of them could still not be deleted once out of retries.
+func deleteBatch(ctx context.Context, backend backends.Backend, batcher backends.BatchDeleter, target string, batch []string) error {
+	be := backoff.NewExponentialBackOff()
+	be.MaxInterval = time.Minute
+	be.MaxElapsedTime = deleteRetryTime
+	retryconf := backoff.WithContext(be, ctx)
+
+	remaining := batch
+	failures := make(map[string]error)
+	retained := make(map[string]bool)
+	operation := func() error {
+		errs := make(map[string]error)
+		if batcher != nil {
+			var err error
+			if errs, err = batcher.DeleteBatch(ctx, remaining); err != nil {
+				for _, objectPath := range remaining {
+					failures[objectPath] = err
 				}
+				return err
 			}
-		})
+		} else if err := backend.Delete(ctx, remaining[0]); err != nil {
+			errs[remaining[0]] = err
+		}
+
+		// Only retry the objects that failed, some of a batch may have been deleted
+		var failed []string
+		for _, objectPath := range remaining {
+			switch err := errs[objectPath]; err {
+			case nil:
+				delete(failures, objectPath)
+			case backends.ErrObjectRetained:
+				delete(failures, objectPath)
+				retained[objectPath] = true
+			default:
+				failures[objectPath] = err
+				failed = append(failed, objectPath)
+			}
+		}
+		remaining = failed
+		if len(failed) > 0 {
+			return fmt.Errorf("could not delete %d of %d objects", len(failed), len(batch))
+		}
+		return nil
 	}
+	berr := backoff.Retry(operation, retryconf)
 
-	helpers.AppLogger.Debugf("Waiting to delete %d objects in destination.", len(allObjects))
-	err = group.Wait()
-	if err != nil {
-		helpers.AppLogger.Errorf("Could not finish clean operation due to error, aborting: %v", err)
-		return err
+	for _, objectPath := range batch {
+		event := helpers.NewAuditEvent(helpers.AuditDelete, "", "", filepath.Join(target, objectPath), 0, failures[objectPath])
+		switch {
+		case failures[objectPath] != nil:
+			helpers.AppLogger.Errorf("Could not delete object %s in due to error - %v", objectPath, failures[objectPath])
+		case retained[objectPath]:
+			event.Result = helpers.AuditRetained
+			helpers.AppLogger.Warningf("Skipping %s as it is still under a retention policy or legal hold.", filepath.Join(target, objectPath))
+		default:
+			helpers.AppLogger.Debugf("Deleted %s.", filepath.Join(target, objectPath))
+		}
+		recordAuditEvent(event)
 	}
 
-	helpers.AppLogger.Noticef("Done.")
-	return nil
+	if berr != nil && len(batch) == 1 {
+		return failures[batch[0]]
+	}
+	return berr
+}
+
+// filterGracePeriod will return the provided objects last modified longer ago than the grace period. A concurrent
+// backup only uploads its manifest once all of its volumes are uploaded, so its volumes look unreferenced until then.
+// Objects the backend does not report a modification time for are aged by the end time of the backup set they belong
+// to, and kept if they belong to none, see expiredObjects.
+func filterGracePeriod(ctx context.Context, backend backends.Backend, objects []string, endTimes map[string]time.Time, gracePeriod time.Duration) ([]string, error) {
+	if gracePeriod <= 0 || len(objects) == 0 {
+		return objects, nil
+	}
+
+	var details []backends.ObjectInfo
+	if lister, ok := backend.(backends.DetailedLister); ok {
+		var err error
+		if details, err = lister.ListDetailed(ctx, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	expired, recent, unknown := expiredObjects(objects, details, endTimes, gracePeriod, time.Now())
+	if recent > 0 {
+		helpers.AppLogger.Noticef("Skipping %d unreferenced objects modified within the last %v, they may belong to a backup still in progress.", recent, gracePeriod)
+	}
+	if unknown > 0 {
+		helpers.AppLogger.Warningf("Skipping %d unreferenced objects the backend does not report a modification time for, they may belong to a backup still in progress. Use a grace period of 0 to delete them anyway.", unknown)
+	}
+	return expired, nil
+}
+
+// expiredObjects will return the provided objects last modified before the grace period along with how many were
+// modified within it and how many are of unknown age. Objects without a modification time are aged by the provided end
+// time of the backup set they belong to, and never returned if they belong to none.
+func expiredObjects(objects []string, details []backends.ObjectInfo, endTimes map[string]time.Time, gracePeriod time.Duration, now time.Time) ([]string, int, int) {
+	modified := make(map[string]time.Time, len(details))
+	for _, obj := range details {
+		modified[obj.Name] = obj.LastModified
+	}
+
+	var expired []string
+	unknown := 0
+	cutoff := now.Add(-gracePeriod)
+	for _, obj := range objects {
+		lastModified := modified[obj]
+		if lastModified.IsZero() {
+			lastModified = endTimes[obj]
+		}
+		if lastModified.IsZero() {
+			helpers.AppLogger.Debugf("Keeping %s as its modification time is unknown.", obj)
+			unknown++
+			continue
+		}
+		if !lastModified.Before(cutoff) {
+			helpers.AppLogger.Debugf("Keeping %s as it was last modified within the grace period.", obj)
+			continue
+		}
+		expired = append(expired, obj)
+	}
+
+	return expired, len(objects) - len(expired) - unknown, unknown
+}
+
+// manifestEndTimes will return the end time of the provided backup sets for each of their objects.
+func manifestEndTimes(manifests []*helpers.JobInfo) map[string]time.Time {
+	endTimes := make(map[string]time.Time)
+	for _, manifest := range manifests {
+		for _, vol := range manifest.AllVolumes() {
+			endTimes[vol.ObjectName] = manifest.EndTime
+		}
+		if manifest.RestoreScript != "" {
+			endTimes[manifest.RestoreScript] = manifest.EndTime
+		}
+		if manifest.Checksums != "" {
+			endTimes[manifest.Checksums] = manifest.EndTime
+		}
+	}
+	return endTimes
+}
+
+// unreferencedObjects will return the provided objects that are not referenced by any of the provided manifests,
+// ignoring manifest files. Volumes may be shared between backup sets, so an object is only returned once no backup
+// set refers to it. If removeBroken is true, backup sets missing any of their volumes are returned and no longer
+// count as references to their remaining volumes. Expired backup sets missing any of their volumes are always
+// returned, their objects are expected to disappear.
+func unreferencedObjects(objects []string, manifests []*helpers.JobInfo, manifestPrefix string, removeBroken bool) ([]string, []*helpers.JobInfo) {
+	exists := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		exists[obj] = true
+	}
+
+	// Count how many backup sets refer to each object
+	refs := make(map[string]int)
+	for _, manifest := range manifests {
+		for _, vol := range manifest.AllVolumes() {
+			refs[vol.ObjectName]++
+		}
+		if manifest.RestoreScript != "" {
+			refs[manifest.RestoreScript]++
+		}
+		if manifest.Checksums != "" {
+			refs[manifest.Checksums]++
+		}
+	}
+
+	now := time.Now()
+	var broken []*helpers.JobInfo
+	for _, manifest := range manifests {
+		volumes := manifest.AllVolumes()
+		for _, vol := range volumes {
+			if exists[vol.ObjectName] {
+				continue
+			}
+
+			switch {
+			case manifest.Expired(now):
+				// The destination already started deleting the objects of this expired backup set, finish the job
+				helpers.AppLogger.Infof("The following backup set expired on %v and volume %s was already deleted. Removing entire backupset:\n\n%s", *manifest.ExpiresAt, vol.ObjectName, manifest.String())
+			case removeBroken:
+				// Broken backup set! inform the user!
+				helpers.AppLogger.Warningf("The following backup set is missing volume %s. Removing entire backupset:\n\n%s", vol.ObjectName, manifest.String())
+			default:
+				helpers.AppLogger.Warningf("The following backup set is missing volume %s:\n\n%s\n\nPass the --force flag to delete this backup set.", vol.ObjectName, manifest.String())
+				continue
+			}
+			for _, v := range volumes {
+				refs[v.ObjectName]--
+			}
+			if manifest.RestoreScript != "" {
+				refs[manifest.RestoreScript]--
+			}
+			if manifest.Checksums != "" {
+				refs[manifest.Checksums]--
+			}
+			broken = append(broken, manifest)
+			break
+		}
+	}
+
+	var unreferenced []string
+	for _, obj := range objects {
+		if strings.HasPrefix(obj, manifestPrefix) {
+			continue
+		}
+		if refs[obj] > 0 {
+			continue
+		}
+		unreferenced = append(unreferenced, obj)
+	}
+
+	return unreferenced, broken
 }
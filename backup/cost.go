@@ -0,0 +1,205 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+const bytesPerGiB = 1024 * 1024 * 1024
+
+// PriceTable describes the monthly price of storing a GiB of data in each storage class of a backend.
+// Objects in a storage class not listed, or whose storage class is not known, are priced at the Default price.
+type PriceTable struct {
+	Currency       string
+	Default        float64
+	StorageClasses map[string]float64
+}
+
+// LoadPriceTable will read a PriceTable from the JSON file at the provided path.
+func LoadPriceTable(path string) (*PriceTable, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := new(PriceTable)
+	if err = json.Unmarshal(raw, prices); err != nil {
+		return nil, fmt.Errorf("could not decode the price table %s - %v", path, err)
+	}
+	if prices.Default < 0 {
+		return nil, fmt.Errorf("the default price in the price table %s must not be negative", path)
+	}
+	for class, price := range prices.StorageClasses {
+		if price < 0 {
+			return nil, fmt.Errorf("the price of the %s storage class in the price table %s must not be negative", class, path)
+		}
+	}
+
+	return prices, nil
+}
+
+// monthlyCost will return the estimated monthly cost of storing the provided number of bytes in the storage class.
+func (p *PriceTable) monthlyCost(storageClass string, size uint64) float64 {
+	price, ok := p.StorageClasses[storageClass]
+	if !ok {
+		price = p.Default
+	}
+	return float64(size) / bytesPerGiB * price
+}
+
+// SetCost is the estimated monthly storage cost of a single backup set.
+type SetCost struct {
+	VolumeName          string
+	BaseSnapshot        string
+	IncrementalSnapshot string `json:",omitempty"`
+	Bytes               uint64
+	BytesByClass        map[string]uint64
+	MonthlyCost         float64
+}
+
+// CostReport is the estimated monthly storage cost of the backup sets found in a destination.
+type CostReport struct {
+	Currency         string
+	Sets             []SetCost
+	TotalBytes       uint64
+	TotalMonthlyCost float64
+}
+
+// EstimateCost will read the manifests found in the target destination and output an estimate of what
+// storing each backup set, and all of them together, costs per month according to the provided price table.
+// The estimate is an approximation: it only accounts for the size of each volume as recorded in its manifest
+// and not for the manifests themselves, minimum storage durations, requests or retrieval fees.
+func EstimateCost(pctx context.Context, jobInfo *helpers.JobInfo, prices *PriceTable) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	// Sync the local cache
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		helpers.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return serr
+	}
+
+	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if derr != nil {
+		return derr
+	}
+
+	// Find out which storage class each object is in, if the backend can tell us
+	storageClasses := make(map[string]string)
+	if lister, ok := backend.(backends.DetailedLister); ok {
+		objects, lerr := lister.ListDetailed(ctx, "")
+		if lerr != nil {
+			helpers.AppLogger.Errorf("Could not list object details in backend %s due to error - %v", target, lerr)
+			return lerr
+		}
+		for _, obj := range objects {
+			storageClasses[obj.Name] = obj.StorageClass
+		}
+	} else {
+		helpers.AppLogger.Warningf("The backend does not support listing object details, all objects will be priced at the default price.")
+	}
+
+	report := estimateCosts(decodedManifests, storageClasses, prices)
+
+	if helpers.JSONOutput {
+		j, jerr := json.Marshal(report)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(helpers.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf("Estimated monthly storage cost of %d backup sets (an approximation based on the volume sizes recorded in each manifest, excluding request and retrieval fees):\n", len(report.Sets))}
+	for _, set := range report.Sets {
+		name := set.VolumeName + "@" + set.BaseSnapshot
+		if set.IncrementalSnapshot != "" {
+			name = fmt.Sprintf("%s (incremental from %s)", name, set.IncrementalSnapshot)
+		}
+		output = append(output, fmt.Sprintf("\t%s: %.2f %s/month for %s", name, set.MonthlyCost, report.Currency, humanize.IBytes(set.Bytes)))
+	}
+	output = append(output, fmt.Sprintf("\nTotal: %.2f %s/month for %s", report.TotalMonthlyCost, report.Currency, humanize.IBytes(report.TotalBytes)))
+	fmt.Fprintln(helpers.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
+
+// estimateCosts will price the volumes of each of the provided manifests using the storage class of each object,
+// objects missing from storageClasses are priced at the default price. Volumes shared between backup sets are
+// included in the cost of every set referring to them but only counted once in the totals.
+func estimateCosts(manifests []*helpers.JobInfo, storageClasses map[string]string, prices *PriceTable) *CostReport {
+	report := &CostReport{Currency: prices.Currency, Sets: make([]SetCost, 0, len(manifests))}
+	counted := make(map[string]bool)
+	for _, manifest := range manifests {
+		set := SetCost{
+			VolumeName:          manifest.VolumeName,
+			BaseSnapshot:        manifest.BaseSnapshot.Name,
+			IncrementalSnapshot: manifest.IncrementalSnapshot.Name,
+			BytesByClass:        make(map[string]uint64),
+		}
+		for _, vol := range manifest.AllVolumes() {
+			class := storageClasses[vol.ObjectName]
+			cost := prices.monthlyCost(class, vol.Size)
+			set.Bytes += vol.Size
+			set.BytesByClass[class] += vol.Size
+			set.MonthlyCost += cost
+
+			if !counted[vol.ObjectName] {
+				counted[vol.ObjectName] = true
+				report.TotalBytes += vol.Size
+				report.TotalMonthlyCost += cost
+			}
+		}
+		report.Sets = append(report.Sets, set)
+	}
+
+	return report
+}
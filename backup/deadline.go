@@ -0,0 +1,76 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// minUploadDeadline is the least time given to upload a volume when its deadline is derived from the minimum
+// upload throughput alone, so small volumes like the manifest are not cut off by the latency of the connection.
+const minUploadDeadline = time.Minute
+
+// errUploadStalled is returned when the upload of a volume did not complete before its deadline.
+var errUploadStalled = errors.New("the upload of the volume did not complete before its deadline")
+
+// uploadDeadline will return how long an attempt at uploading a volume of the provided size may take: the fixed
+// UploadTimeout plus the time it takes to upload the volume at MinUploadThroughput KiB/s. A deadline derived from
+// the throughput alone is at least minUploadDeadline. A deadline of 0 means uploads are not cut off.
+func uploadDeadline(j *helpers.JobInfo, size uint64) time.Duration {
+	deadline := j.UploadTimeout
+	if j.MinUploadThroughput > 0 {
+		deadline += time.Duration(float64(size) / float64(j.MinUploadThroughput*humanize.KiByte) * float64(time.Second))
+		if j.UploadTimeout == 0 && deadline < minUploadDeadline {
+			deadline = minUploadDeadline
+		}
+	}
+
+	return deadline
+}
+
+// withUploadDeadline will run each attempt of the upload operation built by the provided function with a context
+// cancelled once the deadline of the volume passed, failing the attempt with errUploadStalled so it is retried.
+// Piped volumes cannot be uploaded again and have no known size, their uploads are not cut off.
+func withUploadDeadline(ctx context.Context, j *helpers.JobInfo, vol *helpers.VolumeInfo, prefix string, build func(context.Context) func() error) func() error {
+	deadline := uploadDeadline(j, vol.Size)
+	if deadline == 0 || vol.IsUsingPipe() {
+		return build(ctx)
+	}
+
+	return func() error {
+		dctx, cancel := context.WithTimeout(ctx, deadline)
+		defer cancel()
+
+		err := build(dctx)()
+		if err != nil && dctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			helpers.AppLogger.Warningf("%s backend: The upload of volume %s stalled, it did not complete within %v. Retrying it.", prefix, vol.ObjectName, deadline)
+			return errUploadStalled
+		}
+		return err
+	}
+}
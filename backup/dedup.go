@@ -0,0 +1,145 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// sharedVolumeKey identifies volumes with identical contents.
+func sharedVolumeKey(vol *helpers.VolumeInfo) string {
+	return fmt.Sprintf("%s-%d", vol.SHA256Sum, vol.Size)
+}
+
+// canShareVolumes reports whether the volumes of the provided job could be identical to volumes already
+// uploaded. Encrypted or signed volumes never are, as each is encrypted with a new session key and its
+// signature records the time it was written.
+func canShareVolumes(j *helpers.JobInfo) bool {
+	return j.EncryptKey == nil && j.SignKey == nil
+}
+
+// sharedVolumeIndex will read the manifests of the backup sets found in every destination and
+// return the volumes that were uploaded to all of them, keyed by their contents. The index is
+// cached on the job so the members of a group only read it once.
+func sharedVolumeIndex(ctx context.Context, j *helpers.JobInfo) (map[string]*helpers.VolumeInfo, error) {
+	if j.SharedVolumes != nil {
+		return j.SharedVolumes, nil
+	}
+
+	index := make(map[string]*helpers.VolumeInfo)
+	first := true
+	for _, destination := range j.Destinations {
+		volumes, err := uploadedVolumes(ctx, j, destination)
+		if err != nil {
+			return nil, err
+		}
+
+		if first {
+			index, first = volumes, false
+			continue
+		}
+
+		// Only volumes found in every destination can be shared
+		for key, vol := range index {
+			if other, ok := volumes[key]; !ok || other.ObjectName != vol.ObjectName {
+				delete(index, key)
+			}
+		}
+	}
+
+	j.SharedVolumes = index
+	return index, nil
+}
+
+// uploadedVolumes will return the volumes of every backup set found in the destination, keyed by their contents.
+func uploadedVolumes(ctx context.Context, j *helpers.JobInfo, destination string) (map[string]*helpers.VolumeInfo, error) {
+	backend, err := prepareBackend(ctx, j, destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+
+	localCachePath, err := getCacheDir(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	safeManifests, _, err := syncCache(ctx, j, localCachePath, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make(map[string]*helpers.VolumeInfo)
+	for _, manifest := range safeManifests {
+		manifestPath := filepath.Join(localCachePath, manifest)
+		decodedManifest, err := readManifest(ctx, manifestPath, j)
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest %s due to error - %v", manifestPath, err)
+		}
+
+		for _, vol := range decodedManifest.AllVolumes() {
+			if vol.SHA256Sum != "" {
+				volumes[sharedVolumeKey(vol)] = vol
+			}
+		}
+	}
+
+	return volumes, nil
+}
+
+// shareVolumesChainer will point volumes identical to one found in the provided index to the
+// already uploaded object instead. The backends will skip uploading these volumes.
+func shareVolumesChainer(ctx context.Context, in <-chan *helpers.VolumeInfo, index map[string]*helpers.VolumeInfo) <-chan *helpers.VolumeInfo {
+	out := make(chan *helpers.VolumeInfo)
+	go func() {
+		defer close(out)
+		for vol := range in {
+			if !vol.IsManifest && !vol.IsUsingPipe() {
+				if shared, ok := index[sharedVolumeKey(vol)]; ok {
+					helpers.AppLogger.Infof("Volume %s is identical to %s, referencing it instead of uploading it again.", vol.ObjectName, shared.ObjectName)
+					vol.ObjectName = shared.ObjectName
+					vol.SharedObject = true
+				}
+			}
+
+			select {
+			case out <- vol:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// isSharedUpload reports whether the volume was already uploaded by another backup set and should not
+// be uploaded to the backend again.
+func isSharedUpload(vol *helpers.VolumeInfo, prefix string) bool {
+	return vol.SharedObject && prefix != backends.DeleteBackendPrefix
+}
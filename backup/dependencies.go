@@ -0,0 +1,74 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"fmt"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// backupSetDependencies links backup sets to the backup sets they were sent incrementally from. Several backup sets of
+// the same snapshot may exist, e.g. a backup retried to another destination, so an incremental backup set depends on
+// every backup set of its base snapshot rather than a single parent.
+type backupSetDependencies struct {
+	bySnapshot map[string][]*helpers.JobInfo
+	children   map[*helpers.JobInfo][]*helpers.JobInfo
+}
+
+// newBackupSetDependencies will link the provided backup sets of a dataset, keeping the order they were provided in.
+func newBackupSetDependencies(sets []*helpers.JobInfo) *backupSetDependencies {
+	d := &backupSetDependencies{
+		bySnapshot: make(map[string][]*helpers.JobInfo),
+		children:   make(map[*helpers.JobInfo][]*helpers.JobInfo),
+	}
+	for _, set := range sets {
+		key := snapshotKey(set.BaseSnapshot)
+		d.bySnapshot[key] = append(d.bySnapshot[key], set)
+	}
+	for _, set := range sets {
+		for _, base := range d.bases(set) {
+			d.children[base] = append(d.children[base], set)
+		}
+	}
+	return d
+}
+
+// bases will return the backup sets the provided backup set was sent incrementally from, none for a full backup set
+// or when its base could not be found.
+func (d *backupSetDependencies) bases(set *helpers.JobInfo) []*helpers.JobInfo {
+	if set.IncrementalSnapshot.Name == "" {
+		return nil
+	}
+	return d.bySnapshot[snapshotKey(set.IncrementalSnapshot)]
+}
+
+// incrementals will return the backup sets sent incrementally from the snapshot of the provided backup set.
+func (d *backupSetDependencies) incrementals(set *helpers.JobInfo) []*helpers.JobInfo {
+	return d.children[set]
+}
+
+// snapshotKey identifies a snapshot by its name and time of creation, as linkManifests matches incremental backup sets
+// to their parents.
+func snapshotKey(s helpers.SnapshotInfo) string {
+	return fmt.Sprintf("%s@%d", s.Name, s.CreationTime.UnixNano())
+}
@@ -0,0 +1,98 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+)
+
+// dryRun will estimate the size of the send stream with zfs send -nP and log the volumes it would be split into and
+// uploaded to each destination as. The stream is not sent, no hooks are run and the destinations are not touched.
+func dryRun(ctx context.Context, j *helpers.JobInfo) error {
+	if !j.SingleObject && j.SingleObjectBelow > 0 {
+		selectSingleObject(ctx, j)
+	}
+
+	estimate, err := helpers.GetZFSSendEstimate(ctx, j)
+	if err != nil {
+		helpers.AppLogger.Errorf("Dry run: could not estimate the size of the send stream - %v", err)
+		return err
+	}
+	j.ZFSStreamBytes = estimate
+
+	volumes := int64(1)
+	if !j.SingleObject && j.VolumeSize > 0 {
+		size := j.VolumeSize * humanize.MiByte
+		if volumes = int64((estimate + size - 1) / size); volumes == 0 {
+			volumes = 1
+		}
+	}
+	helpers.AppLogger.Noticef("Dry run: the send stream is estimated to be %s and to be split into up to %d volume(s) before compression.", humanize.IBytes(estimate), volumes)
+
+	for _, destination := range dryRunDestinations(j) {
+		for volnum := int64(1); volnum <= volumes; volnum++ {
+			helpers.AppLogger.Noticef("Dry run: would upload %s to %s", j.BackupVolumeObjectName(volnum, j.Compressor), destination)
+		}
+	}
+	printDryRunSummary(j, volumes)
+
+	return nil
+}
+
+// dryRunDestinations will return the destinations volumes would be uploaded to.
+func dryRunDestinations(j *helpers.JobInfo) []string {
+	var destinations []string
+	for _, destination := range j.Destinations {
+		if destination != backends.DeleteBackendPrefix+"://" {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations
+}
+
+// printDryRunSummary will output how much would have been sent, and where, by the dry run.
+func printDryRunSummary(j *helpers.JobInfo, volumes int64) {
+	destinations := dryRunDestinations(j)
+	if helpers.JSONOutput {
+		var doneOutput = struct {
+			DryRun        bool
+			TotalZFSBytes uint64
+			Volumes       int64
+			Destinations  []string
+		}{true, j.ZFSStreamBytes, volumes, destinations}
+		if o, jerr := json.Marshal(doneOutput); jerr != nil {
+			helpers.AppLogger.Errorf("could not ouput json due to error - %v", jerr)
+		} else {
+			fmt.Fprintf(helpers.Stdout, "%s", string(o))
+		}
+		return
+	}
+
+	fmt.Fprintf(helpers.Stdout, "Dry run, nothing was sent or uploaded.\n\tEstimated ZFS Stream Bytes: %d (%s)\n\tVolumes That Would Be Uploaded: up to %d\n\tDestinations: %s", j.ZFSStreamBytes, humanize.IBytes(j.ZFSStreamBytes), volumes, strings.Join(destinations, ", "))
+}
@@ -0,0 +1,103 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"errors"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// The exit statuses of zfsbackup, so automation can tell the categories of failure apart. Anything not categorized
+// below exits with ExitFailure.
+const (
+	// ExitSuccess is the exit status when the command completed successfully.
+	ExitSuccess = 0
+	// ExitFailure is the exit status of any failure not categorized below.
+	ExitFailure = 1
+	// ExitStartWindowMissed is the exit status when a backup was not started within its allowed start window.
+	ExitStartWindowMissed = 3
+	// ExitNothingToBackUp is the exit status when no dataset changed since its last backup so no backup set was created.
+	ExitNothingToBackUp = 4
+	// ExitPartialBackup is the exit status when some, but not all, of the datasets of a multi-dataset backup failed.
+	ExitPartialBackup = 5
+	// ExitAuthFailed is the exit status when a destination rejected the credentials it was accessed with.
+	ExitAuthFailed = 6
+	// ExitBackendUnreachable is the exit status when a destination could not be initialized or written to.
+	ExitBackendUnreachable = 7
+	// ExitZFSFailed is the exit status when a zfs command failed.
+	ExitZFSFailed = 8
+	// ExitChainBroken is the exit status when a backup set, or the snapshot it increments from, is missing.
+	ExitChainBroken = 9
+	// ExitChecksumMismatch is the exit status when data did not match the checksum recorded for it.
+	ExitChecksumMismatch = 10
+	// ExitKeyMissing is the exit status when a key needed to encrypt, sign or decrypt was not found.
+	ExitKeyMissing = 11
+	// ExitAlreadyRunning is the exit status when another backup of the same dataset to the same destinations is
+	// already running (EX_TEMPFAIL), so schedulers can tell an overlapping run apart from a failed one.
+	ExitAlreadyRunning = 75
+)
+
+var (
+	// ErrNothingToBackUp is reported when no dataset changed since its last backup, see SkipUnchanged.
+	ErrNothingToBackUp = errors.New("no dataset changed since its last backup, nothing to backup")
+	// ErrPartialBackup is returned when some, but not all, of the datasets of a multi-dataset backup failed.
+	ErrPartialBackup = errors.New("some of the datasets failed to backup")
+)
+
+// exitStatuses maps the errors and kinds of failure to their exit status, the first one matched wins.
+var exitStatuses = []struct {
+	err    error
+	status int
+}{
+	{ErrAlreadyRunning, ExitAlreadyRunning},
+	{helpers.ErrStartWindowMissed, ExitStartWindowMissed},
+	{ErrNothingToBackUp, ExitNothingToBackUp},
+	{ErrPartialBackup, ExitPartialBackup},
+	{helpers.ErrAuthFailed, ExitAuthFailed},
+	{helpers.ErrKeyMissing, ExitKeyMissing},
+	{helpers.ErrChecksumMismatch, ExitChecksumMismatch},
+	{helpers.ErrChainBroken, ExitChainBroken},
+	{helpers.ErrZFSFailed, ExitZFSFailed},
+	{helpers.ErrBackendUnreachable, ExitBackendUnreachable},
+}
+
+// ExitStatus will return the exit status for the provided error returned by a command, ExitSuccess if nil.
+func ExitStatus(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+	for _, e := range exitStatuses {
+		if errors.Is(err, e.err) {
+			return e.status
+		}
+	}
+	return ExitFailure
+}
+
+// zfsError will wrap the provided error of running a zfs command so it is reported as a zfs failure, unless ssh
+// failed to reach the remote host the command was run on, which is returned as-is.
+func zfsError(op, dataset string, err error) error {
+	if err == nil || helpers.IsSSHError(err) {
+		return err
+	}
+	return &helpers.OperationError{Op: op, Dataset: dataset, Kind: helpers.ErrZFSFailed, Err: err}
+}
@@ -0,0 +1,88 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// ErrInsufficientDestinationSpace is returned when a destination does not have the free space to store a backup.
+var ErrInsufficientDestinationSpace = errors.New("not enough free space in the destination to store the backup")
+
+// checkFreeSpace will fail with ErrInsufficientDestinationSpace when storing a backup of the provided estimated size
+// in a destination would leave it with less than minFree bytes of the provided available bytes.
+func checkFreeSpace(destination string, estimate, available, minFree uint64) error {
+	if available < minFree || available-minFree < estimate {
+		helpers.AppLogger.Errorf("The backup is estimated to take up to %s but only %s are available in %s, keeping %s free. Free up space in the destination or lower --minFreeSpace.", humanize.IBytes(estimate), humanize.IBytes(available), destination, humanize.IBytes(minFree))
+		return ErrInsufficientDestinationSpace
+	}
+
+	return nil
+}
+
+// checkDestinationSpace will check each destination that can report its free space has room for the backup, estimated
+// from the size of its send stream as volumes are compressed. Destinations that cannot report it are not checked.
+func checkDestinationSpace(ctx context.Context, j *helpers.JobInfo) error {
+	estimate, err := helpers.GetZFSSendEstimate(ctx, j)
+	if err != nil {
+		helpers.AppLogger.Warningf("Could not estimate the size of the send stream, will not check the free space of the destinations - %v", err)
+		return nil
+	}
+	minFree := j.MinFreeSpace * humanize.MiByte
+
+	for _, destination := range j.Destinations {
+		backend, err := prepareBackend(ctx, j, destination, nil)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not initialize backend for destination %s due to error - %v.", destination, err)
+			return err
+		}
+		reporter, ok := backend.(backends.SpaceReporter)
+		if !ok {
+			backend.Close()
+			helpers.AppLogger.Debugf("Destination %s cannot report its free space, not checking it.", destination)
+			continue
+		}
+		available, err := reporter.FreeSpace(ctx)
+		backend.Close()
+		if err == backends.ErrFreeSpaceUnsupported {
+			helpers.AppLogger.Debugf("Destination %s cannot report its free space, not checking it.", destination)
+			continue
+		} else if err != nil {
+			helpers.AppLogger.Warningf("Could not get the free space of destination %s, not checking it - %v", destination, err)
+			continue
+		}
+		helpers.AppLogger.Debugf("Destination %s has %s available, the backup is estimated to take up to %s.", destination, humanize.IBytes(available), humanize.IBytes(estimate))
+
+		if err = checkFreeSpace(destination, estimate, available, minFree); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
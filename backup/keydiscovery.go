@@ -0,0 +1,73 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// discoverDecryptionKey will look for the private key the manifest at the provided path was encrypted to in the loaded
+// secret key ring when the provided JobInfo should discover its decryption key and has no key yet. The key found is
+// used to decrypt the manifest and the volumes of its backup set. Unencrypted manifests do not require a key.
+func discoverDecryptionKey(manifestPath string, j *helpers.JobInfo) error {
+	if !j.DiscoverDecryptionKey || j.EncryptKey != nil {
+		return nil
+	}
+
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	key, recipients, err := helpers.FindDecryptionKey(f)
+	if err == helpers.ErrNoDecryptionKey {
+		keyIDs := make([]string, len(recipients))
+		for idx, keyID := range recipients {
+			keyIDs[idx] = fmt.Sprintf("%016X", keyID)
+		}
+		helpers.AppLogger.Errorf("The manifest %s was encrypted to the key(s) %s, none of which have their private key in the secret key ring.", manifestPath, strings.Join(keyIDs, ", "))
+		return &helpers.OperationError{Op: "decrypt", Dataset: j.VolumeName, Kind: helpers.ErrKeyMissing, Err: err}
+	} else if err != nil {
+		helpers.AppLogger.Errorf("Could not read the keys the manifest %s was encrypted to due to error - %v", manifestPath, err)
+		return err
+	}
+
+	if key == nil {
+		helpers.AppLogger.Debugf("The manifest %s is not encrypted, there is no decryption key to discover.", manifestPath)
+		return nil
+	}
+
+	var identities []string
+	for name := range key.Identities {
+		identities = append(identities, name)
+	}
+	sort.Strings(identities)
+	helpers.AppLogger.Noticef("Discovered the key %s (%s) the backup set was encrypted to.", key.PrimaryKey.KeyIdString(), strings.Join(identities, ", "))
+	j.EncryptKey = key
+	return nil
+}
@@ -24,13 +24,17 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/kietdlam/zfsbackup-go/backends"
 	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
 	//"../helpers"
 )
 
@@ -59,7 +63,14 @@ func List(pctx context.Context, jobInfo *helpers.JobInfo, startswith string, bef
 	}
 
 	// Sync the local cache
-	safeManifests, localOnlyFiles, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	var safeManifests, localOnlyFiles []string
+	var skippedManifests []backends.ObjectInfo
+	var serr error
+	if jobInfo.ListLimit > 0 || jobInfo.ListNewerThan > 0 {
+		safeManifests, skippedManifests, serr = syncSelectedCache(ctx, jobInfo, localCachePath, backend)
+	} else {
+		safeManifests, localOnlyFiles, serr = syncCache(ctx, jobInfo, localCachePath, backend)
+	}
 	if serr != nil {
 		helpers.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
 		return serr
@@ -96,6 +107,10 @@ func List(pctx context.Context, jobInfo *helpers.JobInfo, startswith string, bef
 
 	decodedManifests = filteredResults
 
+	if jobInfo.ListFormat == helpers.ListFormatTree || jobInfo.ListFormat == helpers.ListFormatDOT {
+		return printDependencyTrees(jobInfo.ListFormat, dependencyTrees(linkManifests(decodedManifests)))
+	}
+
 	if !helpers.JSONOutput {
 		var output []string
 
@@ -104,12 +119,22 @@ func List(pctx context.Context, jobInfo *helpers.JobInfo, startswith string, bef
 			output = append(output, manifest.String())
 		}
 
+		if len(skippedManifests) > 0 {
+			output = append(output, fmt.Sprintf("There are %d older manifests at the target destination that were not downloaded:", len(skippedManifests)))
+			for _, obj := range skippedManifests {
+				output = append(output, fmt.Sprintf("\t%s (last modified %v)", obj.Name, obj.LastModified))
+			}
+		}
+
 		if len(localOnlyFiles) > 0 {
 			output = append(output, fmt.Sprintf("There are %d manifests found locally that are not on the target destination.", len(localOnlyFiles)))
 			localOnlyOuput := []string{"The following manifests were found locally and can be removed using the clean command."}
 			for _, filename := range localOnlyFiles {
 				manifestPath := filepath.Join(localCachePath, filename)
 				decodedManifest, derr := readManifest(ctx, manifestPath, jobInfo)
+				if errors.Is(derr, errManifestPart) {
+					continue
+				}
 				if derr != nil {
 					helpers.AppLogger.Warningf("Could not read local only manifest %s due to error %v", manifestPath, derr)
 					continue
@@ -201,18 +226,70 @@ func linkManifests(manifests []*helpers.JobInfo) map[string][]*helpers.JobInfo {
 	return manifestTree
 }
 
+// readManifest will read the manifest at the provided path, adding the volumes recorded in its parts if it was
+// split, see writeManifestParts. The parts are expected to be in the same local cache directory as the manifest.
 func readManifest(ctx context.Context, manifestPath string, j *helpers.JobInfo) (*helpers.JobInfo, error) {
-	decodedManifest := new(helpers.JobInfo)
+	manifest, err := readManifestIndex(ctx, manifestPath, j)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.ManifestPart > 0 {
+		return nil, errManifestPart
+	}
+
+	if err = readManifestParts(ctx, manifestPath, manifest, j); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// readManifestIndex is like readManifest but will not read the parts of a split manifest.
+func readManifestIndex(ctx context.Context, manifestPath string, j *helpers.JobInfo) (*helpers.JobInfo, error) {
+	if err := discoverDecryptionKey(manifestPath, j); err != nil {
+		return nil, err
+	}
+
+	rawManifest, err := readRawManifest(ctx, manifestPath, j)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeManifest(rawManifest, manifestPath)
+}
+
+// readRawManifest will return the decrypted and decompressed contents of the manifest at the provided path,
+// either JSON or binary, see helpers.IsBinaryManifest.
+func readRawManifest(ctx context.Context, manifestPath string, j *helpers.JobInfo) ([]byte, error) {
 	manifestVol, err := helpers.ExtractLocal(ctx, j, manifestPath, true)
 	if err != nil {
 		return nil, err
 	}
 	defer manifestVol.Close()
-	decoder := json.NewDecoder(manifestVol)
-	err = decoder.Decode(decodedManifest)
+
+	return ioutil.ReadAll(manifestVol)
+}
+
+func decodeManifest(rawManifest []byte, manifestPath string) (*helpers.JobInfo, error) {
+	if helpers.IsBinaryManifest(rawManifest) {
+		return helpers.DecodeBinaryManifest(rawManifest)
+	}
+
+	decodedManifest := new(helpers.JobInfo)
+	err := json.Unmarshal(rawManifest, decodedManifest)
 	if err != nil {
 		return nil, err
 	}
 
+	// Legacy or hand-made manifests may not record a compressor, detect it per volume instead
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(rawManifest, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["Compressor"]; !ok {
+		helpers.AppLogger.Infof("Manifest %s does not record a compressor, will try to detect it from each volume.", manifestPath)
+		decodedManifest.Compressor = helpers.AutoDetectCompressor
+	}
+
 	return decodedManifest, nil
 }
@@ -0,0 +1,176 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// ManifestNode is a backup set in the dependency tree of the backup sets of a dataset along with the incremental
+// backup sets that were sent from its snapshot.
+type ManifestNode struct {
+	Snapshot     string
+	CreationTime time.Time
+	Incremental  string          `json:",omitempty"`
+	MissingBase  bool            `json:",omitempty"`
+	Children     []*ManifestNode `json:",omitempty"`
+}
+
+// DatasetTree is the dependency tree of the backup sets of a dataset. Its roots are the full backup sets, and any
+// incremental backup set whose base could not be found.
+type DatasetTree struct {
+	Dataset string
+	Roots   []*ManifestNode
+}
+
+// dependencyTrees will build the dependency tree of each dataset from the provided manifests, grouped by dataset, linking
+// backup sets the same way prune does, see backupSetDependencies. An incremental backup set is shown below a full
+// backup set of its base snapshot if there is one, or else below the first backup set of its base snapshot. Datasets
+// are sorted by name and the backup sets of each in the order they were provided in.
+func dependencyTrees(manifestTree map[string][]*helpers.JobInfo) []DatasetTree {
+	datasets := make([]string, 0, len(manifestTree))
+	for dataset := range manifestTree {
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+
+	trees := make([]DatasetTree, 0, len(datasets))
+	for _, dataset := range datasets {
+		tree := DatasetTree{Dataset: dataset}
+		nodes := make(map[*helpers.JobInfo]*ManifestNode)
+		for _, manifest := range manifestTree[dataset] {
+			nodes[manifest] = &ManifestNode{
+				Snapshot:     manifest.BaseSnapshot.Name,
+				CreationTime: manifest.BaseSnapshot.CreationTime,
+				Incremental:  manifest.IncrementalSnapshot.Name,
+			}
+		}
+		deps := newBackupSetDependencies(manifestTree[dataset])
+		for _, manifest := range manifestTree[dataset] {
+			node := nodes[manifest]
+			if bases := deps.bases(manifest); len(bases) > 0 {
+				parent := nodes[bases[0]]
+				for _, base := range bases {
+					if base.IncrementalSnapshot.Name == "" {
+						parent = nodes[base]
+						break
+					}
+				}
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+			node.MissingBase = node.Incremental != ""
+			tree.Roots = append(tree.Roots, node)
+		}
+		trees = append(trees, tree)
+	}
+
+	return trees
+}
+
+// printDependencyTrees will output the provided dependency trees in the provided format, either as an indented
+// tree, JSON when requested, or as a graph in the DOT language.
+func printDependencyTrees(format string, trees []DatasetTree) error {
+	switch {
+	case format == helpers.ListFormatDOT:
+		fmt.Fprint(helpers.Stdout, renderDependencyDOT(trees))
+	case helpers.JSONOutput:
+		j, jerr := json.Marshal(trees)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(helpers.Stdout, string(j))
+	default:
+		fmt.Fprint(helpers.Stdout, renderDependencyTree(trees))
+	}
+
+	return nil
+}
+
+// renderDependencyTree will render the provided dependency trees as text, indenting each incremental backup set
+// below the backup set it was sent from.
+func renderDependencyTree(trees []DatasetTree) string {
+	var b strings.Builder
+	var render func(node *ManifestNode, depth int)
+	render = func(node *ManifestNode, depth int) {
+		kind := "full"
+		if node.Incremental != "" {
+			kind = fmt.Sprintf("incremental from @%s", node.Incremental)
+		}
+		if node.MissingBase {
+			kind += ", base not found"
+		}
+		fmt.Fprintf(&b, "%s@%s (%s, %s)\n", strings.Repeat("  ", depth), node.Snapshot, kind, node.CreationTime.Format(time.RFC3339))
+		for _, child := range node.Children {
+			render(child, depth+1)
+		}
+	}
+
+	for _, tree := range trees {
+		fmt.Fprintln(&b, tree.Dataset)
+		for _, root := range tree.Roots {
+			render(root, 1)
+		}
+	}
+
+	return b.String()
+}
+
+// renderDependencyDOT will render the provided dependency trees as a directed graph in the DOT language, with an
+// edge from each backup set to the incremental backup sets sent from its snapshot. Full backup sets are drawn as boxes.
+func renderDependencyDOT(trees []DatasetTree) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "digraph backups {")
+	id := 0
+	var render func(dataset string, node *ManifestNode) int
+	render = func(dataset string, node *ManifestNode) int {
+		nodeID := id
+		id++
+		attrs := ""
+		if node.Incremental == "" {
+			attrs = ", shape=box"
+		} else if node.MissingBase {
+			attrs = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "\tn%d [label=%q%s];\n", nodeID, fmt.Sprintf("%s@%s", dataset, node.Snapshot), attrs)
+		for _, child := range node.Children {
+			fmt.Fprintf(&b, "\tn%d -> n%d;\n", nodeID, render(dataset, child))
+		}
+		return nodeID
+	}
+
+	for _, tree := range trees {
+		for _, root := range tree.Roots {
+			render(tree.Dataset, root)
+		}
+	}
+	fmt.Fprintln(&b, "}")
+
+	return b.String()
+}
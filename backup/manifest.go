@@ -0,0 +1,135 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// redactedManifestFields are the fields of a manifest that identify the keys used to encrypt and sign a backup set.
+var redactedManifestFields = []string{"EncryptTo", "SignFrom"}
+
+// ExtractManifest will download the manifest for the backup set described by the provided JobInfo and
+// write it, decrypted and decompressed, in its JSON form to outputPath, converting binary manifests to JSON.
+// Unless includeKeyInfo is set, the identities of the keys used to encrypt and sign the backup set are redacted.
+func ExtractManifest(pctx context.Context, jobInfo *helpers.JobInfo, outputPath string, includeKeyInfo bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	manifestPath, err := syncManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not retrieve the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	rawManifest, err := readRawManifest(ctx, manifestPath, jobInfo)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	if helpers.IsBinaryManifest(rawManifest) {
+		if rawManifest, err = binaryManifestToJSON(rawManifest); err != nil {
+			helpers.AppLogger.Errorf("Could not convert the binary manifest to JSON due to error - %v.", err)
+			return err
+		}
+	}
+
+	if !includeKeyInfo {
+		if rawManifest, err = redactManifest(rawManifest); err != nil {
+			helpers.AppLogger.Errorf("Could not redact the manifest due to error - %v.", err)
+			return err
+		}
+	}
+
+	if err = ioutil.WriteFile(outputPath, rawManifest, 0600); err != nil {
+		helpers.AppLogger.Errorf("Could not write the manifest to %s due to error - %v.", outputPath, err)
+		return err
+	}
+
+	helpers.AppLogger.Noticef("Wrote the manifest for %s@%s to %s.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, outputPath)
+	return nil
+}
+
+// binaryManifestToJSON will convert a manifest written in the binary format to the JSON written by the json format.
+func binaryManifestToJSON(rawManifest []byte) ([]byte, error) {
+	decodedManifest, err := helpers.DecodeBinaryManifest(rawManifest)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decodedManifest)
+}
+
+// redactManifest will blank out the key identities found in the provided manifest and any of its group members.
+func redactManifest(rawManifest []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawManifest, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, field := range redactedManifestFields {
+		if _, ok := fields[field]; ok {
+			fields[field] = json.RawMessage(`""`)
+		}
+	}
+
+	if rawMembers, ok := fields["GroupMembers"]; ok {
+		var members []json.RawMessage
+		if err := json.Unmarshal(rawMembers, &members); err != nil {
+			return nil, err
+		}
+		for idx := range members {
+			redacted, err := redactManifest(members[idx])
+			if err != nil {
+				return nil, err
+			}
+			members[idx] = redacted
+		}
+		redactedMembers, err := json.Marshal(members)
+		if err != nil {
+			return nil, err
+		}
+		fields["GroupMembers"] = redactedMembers
+	}
+
+	return json.Marshal(fields)
+}
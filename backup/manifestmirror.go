@@ -0,0 +1,238 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// manifestLocation is where a copy of the manifest of a backup set is written to besides the manifest itself.
+type manifestLocation struct {
+	destination string
+	prefix      string
+}
+
+// manifestMirrors will return the locations the copies of the manifests of the provided job are written to, in the
+// order they are tried when the manifest cannot be downloaded: the mirror prefixes in each destination, then the
+// manifest prefix and the mirror prefixes in each mirror destination.
+func manifestMirrors(j *helpers.JobInfo) []manifestLocation {
+	var mirrors []manifestLocation
+	for _, destination := range j.Destinations {
+		if destination == backends.DeleteBackendPrefix+"://" {
+			continue
+		}
+		for _, prefix := range j.ManifestMirrorPrefixes {
+			mirrors = append(mirrors, manifestLocation{destination, prefix})
+		}
+	}
+	for _, destination := range j.ManifestMirrorDestinations {
+		mirrors = append(mirrors, manifestLocation{destination, j.ManifestPrefix})
+		for _, prefix := range j.ManifestMirrorPrefixes {
+			mirrors = append(mirrors, manifestLocation{destination, prefix})
+		}
+	}
+	return mirrors
+}
+
+// mirrorObjectName returns the object name of the copy of the provided manifest under the provided prefix.
+func mirrorObjectName(j *helpers.JobInfo, manifestName, prefix string) string {
+	return prefix + strings.TrimPrefix(manifestName, j.ManifestPrefix)
+}
+
+// uploadManifestMirrors will write the copies of the final manifest of the provided job, and of its parts if it was
+// split, to its mirror locations. It is called once the manifest was uploaded to every destination, after all of the
+// volumes, and uploads the copy saved to the local cache so every copy is byte-identical to the manifest.
+func uploadManifestMirrors(ctx context.Context, j *helpers.JobInfo) error {
+	mirrors := manifestMirrors(j)
+	if len(mirrors) == 0 {
+		return nil
+	}
+
+	manifestName, err := manifestObjectName(ctx, j)
+	if err != nil {
+		return err
+	}
+
+	var cached string
+	for _, destination := range j.Destinations {
+		if destination != backends.DeleteBackendPrefix+"://" {
+			cached = filepath.Join(helpers.WorkingDir, "cache", fmt.Sprintf("%x", md5.Sum([]byte(destination))), fmt.Sprintf("%x", md5.Sum([]byte(manifestName))))
+			break
+		}
+	}
+	if cached == "" {
+		helpers.AppLogger.Warningf("No manifest was written for %s, not writing any copies of it.", manifestName)
+		return nil
+	}
+
+	// The parts are copied before the manifest tying them together
+	for _, name := range append(append([]string{}, j.ManifestParts...), manifestName) {
+		path := filepath.Join(filepath.Dir(cached), fmt.Sprintf("%x", md5.Sum([]byte(name))))
+		mirror, err := copyCachedManifest(ctx, path)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not copy the manifest %s due to error - %v", path, err)
+			return err
+		}
+
+		for _, m := range mirrors {
+			mirror.ObjectName = mirrorObjectName(j, name, m.prefix)
+			if err = uploadManifest(ctx, j, mirror, m.destination); err != nil {
+				helpers.AppLogger.Errorf("Could not upload a copy of the manifest to %s as %s due to error - %v.", m.destination, mirror.ObjectName, err)
+				mirror.DeleteVolume()
+				return err
+			}
+			helpers.AppLogger.Debugf("Uploaded a copy of the manifest to %s as %s.", m.destination, mirror.ObjectName)
+		}
+		mirror.DeleteVolume()
+	}
+	helpers.AppLogger.Infof("Wrote %d copies of the manifest %s.", len(mirrors), manifestName)
+
+	return nil
+}
+
+// downloadManifest will download the manifest with the provided object name from the provided backend to the
+// provided path. When it cannot be downloaded, e.g. as it is missing, its copies are tried in order instead.
+func downloadManifest(ctx context.Context, j *helpers.JobInfo, backend backends.Backend, manifestName, toPath string) error {
+	err := downloadFrom(ctx, backend, manifestName, toPath)
+	if err == nil {
+		return nil
+	}
+
+	for _, m := range manifestMirrors(j) {
+		name := mirrorObjectName(j, manifestName, m.prefix)
+		helpers.AppLogger.Warningf("Could not download the manifest %s, trying its copy %s in %s - %v", manifestName, name, m.destination, err)
+
+		mirrorBackend := backend
+		if !isDestination(j, m.destination) {
+			if mirrorBackend, err = prepareBackend(ctx, j, m.destination, nil); err != nil {
+				continue
+			}
+		}
+		err = downloadFrom(ctx, mirrorBackend, name, toPath)
+		if mirrorBackend != backend {
+			mirrorBackend.Close()
+		}
+		if err == nil {
+			helpers.AppLogger.Noticef("Downloaded the manifest %s from its copy %s in %s.", manifestName, name, m.destination)
+			return nil
+		}
+	}
+
+	return err
+}
+
+// isDestination returns whether the provided destination is one of the destinations of the job.
+func isDestination(j *helpers.JobInfo, destination string) bool {
+	for _, d := range j.Destinations {
+		if d == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadFrom will prepare and download the provided object to the provided path, removing what was written on failure.
+func downloadFrom(ctx context.Context, backend backends.Backend, objectName, toPath string) error {
+	if err := backend.PreDownload(ctx, []string{objectName}); err != nil {
+		helpers.AppLogger.Errorf("Error trying to pre download manifest volume %s - %v", objectName, err)
+		return err
+	}
+	if err := downloadTo(ctx, backend, objectName, toPath); err != nil {
+		os.Remove(toPath)
+		return err
+	}
+	return nil
+}
+
+// hasManifestMirrorPrefix returns whether the provided object is a copy of a manifest, stored under one of the mirror prefixes.
+func hasManifestMirrorPrefix(j *helpers.JobInfo, objectName string) bool {
+	for _, prefix := range j.ManifestMirrorPrefixes {
+		if strings.HasPrefix(objectName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// listManifestMirrors will list the copies of manifests under the mirror prefixes of the provided backend, returning
+// the name of each manifest not found in the provided manifests mapped to the first copy of it found.
+func listManifestMirrors(ctx context.Context, j *helpers.JobInfo, backend backends.Backend, manifests []string) (map[string]string, error) {
+	found := make(map[string]bool, len(manifests))
+	for _, manifest := range manifests {
+		found[manifest] = true
+	}
+
+	sources := make(map[string]string)
+	for _, prefix := range j.ManifestMirrorPrefixes {
+		copies, err := backend.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range copies {
+			manifest := j.ManifestPrefix + strings.TrimPrefix(name, prefix)
+			if found[manifest] {
+				continue
+			}
+			helpers.AppLogger.Warningf("The manifest %s is missing, using its copy %s instead.", manifest, name)
+			found[manifest] = true
+			sources[manifest] = name
+		}
+	}
+
+	return sources, nil
+}
+
+// listSelectedManifestMirrors is like listManifestMirrors but will map each manifest not found in the provided
+// objects to the details of the first copy of it found, so it can be selected by when it was last modified.
+func listSelectedManifestMirrors(ctx context.Context, j *helpers.JobInfo, lister backends.DetailedLister, objects []backends.ObjectInfo) (map[string]backends.ObjectInfo, error) {
+	found := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		found[obj.Name] = true
+	}
+
+	sources := make(map[string]backends.ObjectInfo)
+	for _, prefix := range j.ManifestMirrorPrefixes {
+		copies, err := lister.ListDetailed(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range copies {
+			manifest := j.ManifestPrefix + strings.TrimPrefix(obj.Name, prefix)
+			if found[manifest] {
+				continue
+			}
+			helpers.AppLogger.Warningf("The manifest %s is missing, using its copy %s instead.", manifest, obj.Name)
+			found[manifest] = true
+			sources[manifest] = obj
+		}
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,196 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/miolini/datacounter"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+)
+
+// errManifestPart is returned when reading a part of a split manifest as a manifest, see helpers.JobInfo.ManifestParts.
+var errManifestPart = errors.New("the object is a part of a split manifest, not a manifest")
+
+// writeManifestParts will split the volumes of the provided job into parts when its manifest, with the provided object
+// name, would be larger than MaxManifestSize MiB. Each part is written to the local cache of every destination and its
+// object name recorded in the job, the manifest then only needs to tie the parts together.
+func writeManifestParts(ctx context.Context, j *helpers.JobInfo, manifestName, format string) error {
+	j.ManifestParts = nil
+	if j.MaxManifestSize == 0 {
+		return nil
+	}
+
+	maxSize := j.MaxManifestSize * 1024 * 1024
+	counter := datacounter.NewWriterCounter(ioutil.Discard)
+	if err := helpers.EncodeManifest(counter, j, format); err != nil {
+		return err
+	}
+	if counter.Count() <= maxSize {
+		return nil
+	}
+	if len(j.Volumes) == 0 {
+		// The volumes of grouped backups are recorded by each member, which are not split
+		helpers.AppLogger.Warningf("The manifest %s is larger than %d MiB but has no volumes of its own to split into parts.", manifestName, j.MaxManifestSize)
+		return nil
+	}
+
+	parts, err := helpers.SplitManifestVolumes(j.Volumes, maxSize)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(parts))
+	for idx, volumes := range parts {
+		part := &helpers.JobInfo{
+			VolumeName:          j.VolumeName,
+			BaseSnapshot:        j.BaseSnapshot,
+			IncrementalSnapshot: j.IncrementalSnapshot,
+			Version:             j.Version,
+			ManifestPart:        idx + 1,
+			Volumes:             volumes,
+		}
+		partVol, err := helpers.CreateManifestVolume(ctx, j)
+		if err != nil {
+			return err
+		}
+		partVol.ObjectName = helpers.ManifestPartName(manifestName, part.ManifestPart)
+		err = helpers.EncodeManifest(partVol, part, format)
+		if cerr := partVol.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = cacheManifest(j, partVol)
+		}
+		partVol.DeleteVolume()
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not write part %d of the manifest %s due to error - %v", part.ManifestPart, manifestName, err)
+			return err
+		}
+		names = append(names, partVol.ObjectName)
+	}
+	j.ManifestParts = names
+	helpers.AppLogger.Infof("The manifest %s is larger than %d MiB, split its %d volumes into %d parts.", manifestName, j.MaxManifestSize, len(j.Volumes), len(names))
+
+	return nil
+}
+
+// uploadManifestParts will upload the parts of the split manifest of the provided job from the local cache to every
+// destination. It is called before the manifest is uploaded so the parts are in place once the manifest is found.
+func uploadManifestParts(ctx context.Context, j *helpers.JobInfo) error {
+	for _, destination := range j.Destinations {
+		if destination == backends.DeleteBackendPrefix+"://" {
+			continue
+		}
+		cache := filepath.Join(helpers.WorkingDir, "cache", fmt.Sprintf("%x", md5.Sum([]byte(destination))))
+		for _, name := range j.ManifestParts {
+			partVol, err := copyCachedManifest(ctx, filepath.Join(cache, fmt.Sprintf("%x", md5.Sum([]byte(name)))))
+			if err != nil {
+				helpers.AppLogger.Errorf("Could not read the manifest part %s from the local cache due to error - %v", name, err)
+				return err
+			}
+			partVol.ObjectName = name
+			err = uploadManifest(ctx, j, partVol, destination)
+			partVol.DeleteVolume()
+			if err != nil {
+				helpers.AppLogger.Errorf("Could not upload the manifest part %s to %s due to error - %v.", name, destination, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyCachedManifest will copy the manifest, or manifest part, at the provided path in the local cache to a volume ready to upload.
+func copyCachedManifest(ctx context.Context, cached string) (*helpers.VolumeInfo, error) {
+	f, err := os.Open(cached)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vol, err := helpers.CreateSimpleVolume(ctx, false, "")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(vol, f)
+	if cerr := vol.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		vol.DeleteVolume()
+		return nil, err
+	}
+	vol.IsManifest = true
+	vol.IsFinalManifest = true
+
+	return vol, nil
+}
+
+// syncManifestParts will download the parts of the split manifest at the provided path that are missing from the local cache.
+func syncManifestParts(ctx context.Context, j *helpers.JobInfo, backend backends.Backend, manifestPath string) error {
+	manifest, err := readManifestIndex(ctx, manifestPath, j)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range manifest.ManifestParts {
+		partPath := filepath.Join(filepath.Dir(manifestPath), fmt.Sprintf("%x", md5.Sum([]byte(name))))
+		if _, err = os.Stat(partPath); err == nil {
+			continue
+		}
+		if err = downloadManifest(ctx, j, backend, name, partPath); err != nil {
+			helpers.AppLogger.Errorf("Could not download the manifest part %s due to error - %v", name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// readManifestParts will add the volumes recorded in the parts of the provided split manifest, read from the local cache
+// directory of the manifest at the provided path, to the manifest in order.
+func readManifestParts(ctx context.Context, manifestPath string, manifest *helpers.JobInfo, j *helpers.JobInfo) error {
+	for idx, name := range manifest.ManifestParts {
+		partPath := filepath.Join(filepath.Dir(manifestPath), fmt.Sprintf("%x", md5.Sum([]byte(name))))
+		rawPart, err := readRawManifest(ctx, partPath, j)
+		if err != nil {
+			return fmt.Errorf("could not read the manifest part %s - %v", name, err)
+		}
+		part, err := decodeManifest(rawPart, partPath)
+		if err != nil {
+			return fmt.Errorf("could not decode the manifest part %s - %v", name, err)
+		}
+		if part.ManifestPart != idx+1 || part.VolumeName != manifest.VolumeName || part.BaseSnapshot.Name != manifest.BaseSnapshot.Name {
+			return fmt.Errorf("the manifest part %s is not part %d of the manifest of %s@%s", name, idx+1, manifest.VolumeName, manifest.BaseSnapshot.Name)
+		}
+		manifest.Volumes = append(manifest.Volumes, part.Volumes...)
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+var (
+	errCopyNotSupported  = errors.New("the destination cannot copy objects without downloading them")
+	errMigrationMismatch = errors.New("the copy of the manifest does not match the manifest it was copied from")
+)
+
+// prefixedBackend presents the objects under a prefix of a backend as if they were at its root, so the backup sets
+// stored under the prefix are read the same way as the backup sets stored at the root of a destination. Only reading,
+// listing and deleting objects is supported.
+type prefixedBackend struct {
+	backends.Backend
+	prefix string
+}
+
+func (p *prefixedBackend) PreDownload(ctx context.Context, objects []string) error {
+	prefixed := make([]string, len(objects))
+	for idx := range objects {
+		prefixed[idx] = p.prefix + objects[idx]
+	}
+	return p.Backend.PreDownload(ctx, prefixed)
+}
+
+func (p *prefixedBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return p.Backend.Download(ctx, p.prefix+filename)
+}
+
+func (p *prefixedBackend) Delete(ctx context.Context, filename string) error {
+	return p.Backend.Delete(ctx, p.prefix+filename)
+}
+
+func (p *prefixedBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := p.Backend.List(ctx, p.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]string, len(objects))
+	for idx := range objects {
+		l[idx] = strings.TrimPrefix(objects[idx], p.prefix)
+	}
+	return l, nil
+}
+
+// prefixedURI returns the URI of the provided prefix of the provided destination.
+func prefixedURI(target, prefix string) string {
+	return strings.TrimSuffix(target, "/") + "/" + prefix
+}
+
+// Migrate will copy every object of the backup set of the provided job, and of its group members, from the fromPrefix
+// to the toPrefix of its destination without downloading them, deleting the objects under the fromPrefix afterwards if
+// move is set, except for the volumes other backup sets under the fromPrefix share with it. Volumes are copied first
+// and verified against the checksums listed in the manifest before the manifest is copied, so a backup set only shows
+// under the toPrefix once it is complete. Object names are recorded relative to the prefix they are stored under, the
+// manifest is copied as is and still verifies against the signature it was written with. Migrations can be run again to
+// resume where they stopped, objects already copied are not copied again.
+func Migrate(pctx context.Context, jobInfo *helpers.JobInfo, fromPrefix, toPrefix string, move bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	copier, ok := backend.(backends.Copier)
+	if !ok {
+		helpers.AppLogger.Errorf("The backend for target %s cannot copy objects, the backup set would have to be uploaded again.", target)
+		return errCopyNotSupported
+	}
+	source := &prefixedBackend{backend, fromPrefix}
+	destination := &prefixedBackend{backend, toPrefix}
+
+	sourceCachePath, err := getCacheDir(prefixedURI(target, fromPrefix))
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, err)
+		return err
+	}
+	destinationCachePath, err := getCacheDir(prefixedURI(target, toPrefix))
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, err)
+		return err
+	}
+
+	manifestName, err := manifestObjectName(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+	manifestPath, err := syncManifest(ctx, jobInfo, source, sourceCachePath)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not retrieve the manifest for %s@%s under %q due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, fromPrefix, err)
+		return err
+	}
+	manifest, err := readManifest(ctx, manifestPath, jobInfo)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	volumes := manifest.AllVolumes()
+	objects := make([]string, 0, len(volumes)+1)
+	sizes := make(map[string]int64, len(volumes))
+	for _, vol := range volumes {
+		objects = append(objects, vol.ObjectName)
+		sizes[vol.ObjectName] = int64(vol.Size)
+	}
+	if manifest.RestoreScript != "" {
+		objects = append(objects, manifest.RestoreScript)
+		sizes[manifest.RestoreScript] = -1
+	}
+	if manifest.Checksums != "" {
+		objects = append(objects, manifest.Checksums)
+		sizes[manifest.Checksums] = -1
+	}
+	// The parts of a split manifest are copied with the volumes, before the manifest tying them together
+	for _, part := range manifest.ManifestParts {
+		objects = append(objects, part)
+		sizes[part] = -1
+	}
+
+	// Resume where a previous migration stopped, objects already under the toPrefix are not copied again
+	toCopy, err := pendingCopies(ctx, backend, toPrefix, objects, sizes)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not list the objects already copied to %q due to error - %v.", toPrefix, err)
+		return err
+	}
+	helpers.AppLogger.Infof("Copying %d of the %d objects of the backup set %s@%s from %q to %q.", len(toCopy), len(objects), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, fromPrefix, toPrefix)
+	if err = copyObjects(ctx, jobInfo, copier, source, fromPrefix, toPrefix, toCopy); err != nil {
+		return err
+	}
+
+	// The copies are verified before the manifest makes the backup set show under the toPrefix
+	algorithms := make(map[*helpers.VolumeInfo]string)
+	checkHashAlgorithms(manifest, "", algorithms, false)
+	failed := 0
+	for _, result := range verifyVolumeChecksums(ctx, destination, volumes, algorithms) {
+		if result.Valid {
+			continue
+		}
+		failed++
+		// Bad copies are copied again when the migration is resumed
+		if derr := destination.Delete(ctx, result.Object); derr != nil {
+			helpers.AppLogger.Warningf("Could not delete the bad copy of %s due to error - %v", result.Object, derr)
+		}
+	}
+	if failed > 0 {
+		helpers.AppLogger.Errorf("%d of the %d volumes copied to %q failed verification, run the migration again to copy them again.", failed, len(volumes), toPrefix)
+		return errIntegrityVerificationFailed
+	}
+
+	if err = copyObjects(ctx, jobInfo, copier, source, fromPrefix, toPrefix, []string{manifestName}); err != nil {
+		return err
+	}
+	if err = verifyManifestCopy(ctx, destination, destinationCachePath, manifestName, manifestPath); err != nil {
+		destination.Delete(ctx, manifestName)
+		return err
+	}
+	helpers.AppLogger.Noticef("Copied the backup set %s@%s from %q to %q.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, fromPrefix, toPrefix)
+
+	if !move {
+		return nil
+	}
+
+	// Volumes deduplicated with other backup sets under the fromPrefix are still referenced by them and are kept
+	refs, err := otherReferences(ctx, jobInfo, source, sourceCachePath, manifestPath)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the backup sets under %q due to error - %v.", fromPrefix, err)
+		return err
+	}
+	toDelete := make([]string, 0, len(objects))
+	for _, object := range objects {
+		if refs[object] > 0 {
+			helpers.AppLogger.Infof("Keeping %s under %q, %d other backup sets still refer to it.", object, fromPrefix, refs[object])
+			continue
+		}
+		toDelete = append(toDelete, object)
+	}
+
+	// The manifest is deleted last so an interrupted move can still be resumed
+	if err = deleteMigrated(ctx, backend, target, fromPrefix, toDelete); err != nil {
+		return err
+	}
+	if err = deleteMigrated(ctx, backend, target, fromPrefix, []string{manifestName}); err != nil {
+		return err
+	}
+	os.Remove(manifestPath)
+	helpers.AppLogger.Noticef("Deleted the backup set %s@%s from %q.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, fromPrefix)
+
+	return nil
+}
+
+// pendingCopies will return the provided objects that are not under the provided prefix yet, or were copied with
+// another size than the one provided for them, if the backend reports sizes. A negative size is not checked.
+func pendingCopies(ctx context.Context, backend backends.Backend, prefix string, objects []string, sizes map[string]int64) ([]string, error) {
+	copied := make(map[string]int64)
+	if lister, ok := backend.(backends.DetailedLister); ok {
+		details, err := lister.ListDetailed(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, detail := range details {
+			copied[strings.TrimPrefix(detail.Name, prefix)] = detail.Size
+		}
+	} else {
+		names, err := backend.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			copied[strings.TrimPrefix(name, prefix)] = -1
+		}
+	}
+
+	var pending []string
+	for _, object := range objects {
+		size, ok := copied[object]
+		if ok && (size < 0 || sizes[object] < 0 || size == sizes[object]) {
+			helpers.AppLogger.Debugf("%s was already copied to %q, skipping it.", object, prefix)
+			continue
+		}
+		pending = append(pending, object)
+	}
+	return pending, nil
+}
+
+// copyObjects will restore the provided objects under the fromPrefix, if required, and copy them under the toPrefix,
+// retrying each copy as configured for uploads.
+func copyObjects(ctx context.Context, j *helpers.JobInfo, copier backends.Copier, source backends.Backend, fromPrefix, toPrefix string, objects []string) error {
+	if len(objects) == 0 {
+		return nil
+	}
+	if err := source.PreDownload(ctx, objects); err != nil {
+		helpers.AppLogger.Errorf("Error trying to pre download the objects to copy - %v", err)
+		return err
+	}
+
+	var group *errgroup.Group
+	group, ctx = errgroup.WithContext(ctx)
+
+	c := make(chan string, len(objects))
+	for _, object := range objects {
+		c <- object
+	}
+	close(c)
+
+	workers := j.MaxParallelUploads
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		group.Go(func() error {
+			for object := range c {
+				be := backoff.NewExponentialBackOff()
+				be.MaxInterval = j.MaxBackoffTime
+				be.MaxElapsedTime = j.MaxRetryTime
+				operation := func() error {
+					return copier.Copy(ctx, fromPrefix+object, toPrefix+object)
+				}
+				if err := backoff.Retry(operation, backoff.WithContext(be, ctx)); err != nil {
+					helpers.AppLogger.Errorf("Could not copy %s from %q to %q due to error - %v", object, fromPrefix, toPrefix, err)
+					return err
+				}
+				helpers.AppLogger.Debugf("Copied %s from %q to %q.", object, fromPrefix, toPrefix)
+			}
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// verifyManifestCopy will download the copy of the manifest with the provided name to the provided cache and compare
+// it against the manifest at manifestPath it was copied from.
+func verifyManifestCopy(ctx context.Context, backend backends.Backend, localCachePath, manifestName, manifestPath string) error {
+	copyPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestName))))
+	os.Remove(copyPath)
+	if err := downloadFrom(ctx, backend, manifestName, copyPath); err != nil {
+		helpers.AppLogger.Errorf("Could not download the copy of the manifest %s due to error - %v", manifestName, err)
+		return err
+	}
+
+	expected, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	copied, err := ioutil.ReadFile(copyPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, copied) {
+		os.Remove(copyPath)
+		helpers.AppLogger.Errorf("The copy of the manifest %s does not match the manifest it was copied from.", manifestName)
+		return errMigrationMismatch
+	}
+	return nil
+}
+
+// otherReferences will count how many of the backup sets found through the provided backend, other than the one with
+// the manifest at the provided path, refer to each object.
+func otherReferences(ctx context.Context, j *helpers.JobInfo, backend backends.Backend, localCachePath, manifestPath string) (map[string]int, error) {
+	safeManifests, _, err := syncCache(ctx, j, localCachePath, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]int)
+	for _, manifest := range safeManifests {
+		otherPath := filepath.Join(localCachePath, manifest)
+		if otherPath == manifestPath {
+			continue
+		}
+		decodedManifest, err := readManifest(ctx, otherPath, j)
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest %s due to error - %v", otherPath, err)
+		}
+		for _, vol := range decodedManifest.AllVolumes() {
+			refs[vol.ObjectName]++
+		}
+	}
+	return refs, nil
+}
+
+// deleteMigrated will delete the provided objects under the provided prefix, skipping those already deleted.
+func deleteMigrated(ctx context.Context, backend backends.Backend, target, prefix string, objects []string) error {
+	listed, err := backend.List(ctx, prefix)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not list the objects under %q due to error - %v", prefix, err)
+		return err
+	}
+	exists := make(map[string]bool, len(listed))
+	for _, name := range listed {
+		exists[name] = true
+	}
+
+	var toDelete []string
+	for _, object := range objects {
+		if exists[prefix+object] {
+			toDelete = append(toDelete, prefix+object)
+		}
+	}
+	return deleteObjects(ctx, backend, target, toDelete)
+}
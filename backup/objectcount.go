@@ -0,0 +1,107 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// ErrTooManyObjects is returned when a backup would push the number of objects in a destination past the configured maximum.
+var ErrTooManyObjects = errors.New("the backup would exceed the maximum number of objects allowed in the destination")
+
+// plannedObjectCount will return the number of objects a backup is expected to upload to each destination,
+// given the estimated size of its send stream. Volumes are compressed so this is an upper bound.
+func plannedObjectCount(j *helpers.JobInfo, estimate uint64) int {
+	volumes := 1
+	if !j.SingleObject && j.VolumeSize > 0 {
+		volumeBytes := j.VolumeSize * humanize.MiByte
+		volumes = int((estimate + volumeBytes - 1) / volumeBytes)
+		if volumes < 1 {
+			volumes = 1
+		}
+	}
+
+	// Along with the manifest, and the restore script and checksums if any
+	planned := volumes + 1
+	if j.GenerateRestoreScript {
+		planned++
+	}
+	if j.GenerateChecksums {
+		planned++
+	}
+
+	return planned
+}
+
+// checkObjectCount will warn when the provided number of existing and planned objects in a destination reaches
+// the warning threshold, and fail with ErrTooManyObjects when it exceeds the maximum. A threshold of 0 is disabled.
+func checkObjectCount(destination string, existing, planned, warnAt, max int) error {
+	total := existing + planned
+	switch {
+	case max > 0 && total > max:
+		helpers.AppLogger.Errorf("This backup would bring the number of objects in %s to %d (%d existing and up to %d new), past the maximum of %d. Consider larger volumes (--volsize) or a date-partitioned prefix in the destination URI.", destination, total, existing, planned, max)
+		return ErrTooManyObjects
+	case warnAt > 0 && total >= warnAt:
+		helpers.AppLogger.Warningf("This backup will bring the number of objects in %s to %d (%d existing and up to %d new), reaching the warning threshold of %d. Some providers degrade with this many objects under a single prefix, consider larger volumes (--volsize) or a date-partitioned prefix in the destination URI.", destination, total, existing, planned, warnAt)
+	}
+
+	return nil
+}
+
+// checkDestinationObjectCounts will count the objects already in each destination and check the count the
+// backup would bring each of them to against the configured thresholds.
+func checkDestinationObjectCounts(ctx context.Context, j *helpers.JobInfo) error {
+	var estimate uint64
+	if !j.SingleObject {
+		var err error
+		if estimate, err = helpers.GetZFSSendEstimate(ctx, j); err != nil {
+			helpers.AppLogger.Warningf("Could not estimate the size of the send stream, will only count a single new volume towards the number of objects in each destination - %v", err)
+		}
+	}
+	planned := plannedObjectCount(j, estimate)
+
+	for _, destination := range j.Destinations {
+		backend, err := prepareBackend(ctx, j, destination, nil)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not initialize backend for destination %s due to error - %v.", destination, err)
+			return err
+		}
+		existing, err := backend.List(ctx, "")
+		backend.Close()
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not count the objects in destination %s due to error - %v.", destination, err)
+			return err
+		}
+		helpers.AppLogger.Debugf("Found %d objects in destination %s, the backup will add up to %d.", len(existing), destination, planned)
+
+		if err = checkObjectCount(destination, len(existing), planned, j.ObjectCountWarning, j.MaxObjectCount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// pruneBackupSets will split the provided manifests into the backup sets to keep and those the retention policy allows
+// to delete. Per dataset, the newest keepFullCount full backup sets are kept along with every incremental backup set
+// descending from them, and any backup set whose snapshot is newer than keepDuration. The newest backup set of each
+// dataset is always kept, and so is every backup set a kept incremental backup set depends on, so a chain that is
+// retained can always be restored. A zero keepFullCount or keepDuration disables that part of the policy.
+func pruneBackupSets(manifests []*helpers.JobInfo, keepFullCount int, keepDuration time.Duration, now time.Time) (keep, prune []*helpers.JobInfo) {
+	datasets := make(map[string][]*helpers.JobInfo)
+	for _, manifest := range manifests {
+		datasets[manifest.VolumeName] = append(datasets[manifest.VolumeName], manifest)
+	}
+
+	retained := make(map[*helpers.JobInfo]bool)
+	for _, snapList := range datasets {
+		sets := make([]*helpers.JobInfo, len(snapList))
+		copy(sets, snapList)
+		sort.SliceStable(sets, func(i, j int) bool {
+			return backupSetTime(sets[i]).After(backupSetTime(sets[j]))
+		})
+
+		// Incremental backup sets depend on every backup set of their base snapshot, not only the designated parent
+		deps := newBackupSetDependencies(sets)
+
+		var retain func(set *helpers.JobInfo)
+		retain = func(set *helpers.JobInfo) {
+			if retained[set] {
+				return
+			}
+			retained[set] = true
+			for _, base := range deps.bases(set) {
+				retain(base)
+			}
+		}
+		var retainDescendants func(set *helpers.JobInfo)
+		retainDescendants = func(set *helpers.JobInfo) {
+			retain(set)
+			for _, child := range deps.incrementals(set) {
+				if !retained[child] {
+					retainDescendants(child)
+				}
+			}
+		}
+
+		fulls := 0
+		for idx, set := range sets {
+			switch {
+			case idx == 0:
+				retain(set)
+			case keepDuration > 0 && now.Sub(backupSetTime(set)) < keepDuration:
+				retain(set)
+			}
+			if set.IncrementalSnapshot.Name == "" && fulls < keepFullCount {
+				fulls++
+				retainDescendants(set)
+			}
+		}
+	}
+
+	for _, manifest := range manifests {
+		if retained[manifest] {
+			keep = append(keep, manifest)
+		} else {
+			prune = append(prune, manifest)
+		}
+	}
+	return keep, prune
+}
+
+// backupSetTime is when the snapshot of the backup set was taken, or when the backup set was started if that is unknown.
+func backupSetTime(j *helpers.JobInfo) time.Time {
+	if j.BaseSnapshot.CreationTime.IsZero() {
+		return j.StartTime
+	}
+	return j.BaseSnapshot.CreationTime
+}
@@ -0,0 +1,410 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+var (
+	errQuorumUnreachable = errors.New("not enough destinations are available to reach the upload quorum")
+	errNotSupported      = errors.New("operation not supported when restoring from multiple destinations")
+)
+
+// quorumUploader uploads each volume to several destinations at once, e.g. buckets in different regions,
+// considering a volume uploaded once a quorum of the destinations acknowledged it. The uploads to the
+// remaining destinations are retried in the background. A destination being down does not fail the backup
+// as long as the quorum can still be reached.
+type quorumUploader struct {
+	quorum       int
+	backends     []backends.Backend
+	destinations []string
+
+	// The uploads still in progress after their volume reached the quorum, they run outside of the
+	// pipeline so the backup completes without waiting for them
+	pending sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// newQuorumUploader will return a quorumUploader whose uploads run until ctx is done or finish is called.
+func newQuorumUploader(ctx context.Context, quorum int) *quorumUploader {
+	q := &quorumUploader{quorum: quorum}
+	q.ctx, q.cancel = context.WithCancel(ctx)
+	return q
+}
+
+// prepareQuorumUploader will initialize the backends for all destinations of the provided job, skipping the
+// destinations that cannot be initialized as long as the quorum can still be reached.
+func prepareQuorumUploader(ctx context.Context, j *helpers.JobInfo, uploadBuffer chan bool) (*quorumUploader, error) {
+	q := newQuorumUploader(ctx, j.UploadQuorum)
+	for _, destination := range j.Destinations {
+		if destination == backends.DeleteBackendPrefix+"://" {
+			continue
+		}
+		backend, berr := prepareBackend(ctx, j, destination, uploadBuffer)
+		if berr != nil {
+			helpers.AppLogger.Warningf("Could not initialize backend for destination %s, continuing with the remaining destinations - %v", destination, berr)
+			continue
+		}
+		if _, cerr := getCacheDir(destination); cerr != nil {
+			helpers.AppLogger.Errorf("Could not create cache for destination %s due to error - %v.", destination, cerr)
+			return nil, cerr
+		}
+		q.backends = append(q.backends, backend)
+		q.destinations = append(q.destinations, destination)
+	}
+
+	if len(q.backends) < q.quorum {
+		helpers.AppLogger.Errorf("Only %d destinations are available, an upload quorum of %d cannot be reached.", len(q.backends), q.quorum)
+		for _, backend := range q.backends {
+			backend.Close()
+		}
+		q.cancel()
+		return nil, errQuorumUnreachable
+	}
+
+	return q, nil
+}
+
+// chain will upload each volume read from in to a quorum of destinations before passing it along.
+func (q *quorumUploader) chain(ctx context.Context, in <-chan *helpers.VolumeInfo, j *helpers.JobInfo) (<-chan *helpers.VolumeInfo, *errgroup.Group) {
+	out := make(chan *helpers.VolumeInfo)
+	var gwg *errgroup.Group
+	gwg, ctx = errgroup.WithContext(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(j.MaxParallelUploads)
+	for i := 0; i < j.MaxParallelUploads; i++ {
+		gwg.Go(func() error {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case vol, ok := <-in:
+					if !ok {
+						return nil
+					}
+					if vol.SharedObject {
+						helpers.AppLogger.Debugf("Skipping volume %s as it was uploaded by another backup set", vol.ObjectName)
+						if err := sendVolume(ctx, out, vol); err != nil {
+							return err
+						}
+						continue
+					}
+					if err := q.upload(ctx, vol, j); err != nil {
+						return err
+					}
+					if err := sendVolume(ctx, out, vol); err != nil {
+						return err
+					}
+				}
+			}
+		})
+	}
+
+	gwg.Go(func() error {
+		wg.Wait()
+		helpers.AppLogger.Debugf("Quorum uploader: closing out channel.")
+		close(out)
+		return nil
+	})
+
+	return out, gwg
+}
+
+// upload will upload the provided volume to all destinations at once and return once a quorum of them
+// acknowledged it. The destinations the volume was uploaded to are recorded in its Placement. The uploads
+// are not cancelled with ctx once the quorum is reached, see finish.
+func (q *quorumUploader) upload(ctx context.Context, vol *helpers.VolumeInfo, j *helpers.JobInfo) error {
+	results := make(chan error, len(q.backends))
+	for idx := range q.backends {
+		// Each destination reads the volume on its own, even once the volume was passed along and deleted
+		replica, err := vol.Replica()
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not open volume %s for upload due to error - %v", vol.ObjectName, err)
+			return err
+		}
+
+		backend, destination := q.backends[idx], q.destinations[idx]
+		prefix := strings.Split(destination, "://")[0]
+		q.pending.Add(1)
+		go func() {
+			defer q.pending.Done()
+			defer replica.Close()
+
+			be := backoff.NewExponentialBackOff()
+			be.MaxInterval = j.MaxBackoffTime
+			be.MaxElapsedTime = j.MaxRetryTime
+			retryconf := backoff.WithContext(be, q.ctx)
+
+			uctx, span := startUploadSpan(q.ctx, vol, prefix)
+			span.SetAttributes(attribute.String("zfsbackup.destination", destination))
+			start := time.Now()
+			operation := withUploadDeadline(uctx, j, replica, prefix, func(actx context.Context) func() error {
+				return replicaUploadWrapper(actx, backend, replica, prefix)
+			})
+			if j.VerifyUploads == helpers.VerifyUploadsReadback {
+				operation = withReadback(uctx, backend, replica, prefix, j.HashAlgorithm, operation)
+			}
+			err := backoff.Retry(countAttempts(operation, span), retryconf)
+			helpers.EndSpan(span, err)
+			if err == nil && j.UploadObserver != nil && !vol.IsManifest {
+				j.UploadObserver(vol.Size, time.Since(start))
+			}
+			if err == nil {
+				manifestmutex.Lock()
+				vol.Placement = append(vol.Placement, destination)
+				manifestmutex.Unlock()
+				helpers.AppLogger.Debugf("%s backend: Processed volume %s", prefix, vol.ObjectName)
+			} else {
+				helpers.AppLogger.Warningf("Could not upload volume %s to destination %s due to error - %v", vol.ObjectName, destination, err)
+			}
+			results <- err
+		}()
+	}
+
+	var acknowledged, failed int
+	for range q.backends {
+		var err error
+		select {
+		case err = <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err != nil {
+			failed++
+		} else {
+			acknowledged++
+		}
+
+		if acknowledged >= q.quorum {
+			helpers.AppLogger.Debugf("Volume %s reached the upload quorum of %d destinations.", vol.ObjectName, q.quorum)
+			return nil
+		}
+		if len(q.backends)-failed < q.quorum {
+			break
+		}
+	}
+
+	helpers.AppLogger.Errorf("Volume %s was only uploaded to %d of %d destinations, an upload quorum of %d is required.", vol.ObjectName, acknowledged, len(q.backends), q.quorum)
+	return errQuorumUnreachable
+}
+
+// wait will wait for the uploads still in progress after their volume reached the quorum.
+func (q *quorumUploader) wait() {
+	q.pending.Wait()
+}
+
+// finish will give the uploads still in progress after their volume reached the quorum up to timeout to
+// complete before cancelling them, a timeout of 0 cancels them right away. The destinations they were
+// uploading to can be missing volumes, which are restored from the destinations that acknowledged them.
+func (q *quorumUploader) finish(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		q.wait()
+		close(done)
+	}()
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			helpers.AppLogger.Warningf("Cancelling the uploads to the destinations that did not acknowledge their volume within %v of the backup completing.", timeout)
+		}
+	}
+	q.cancel()
+	<-done
+}
+
+func replicaUploadWrapper(ctx context.Context, b backends.Backend, replica *helpers.VolumeInfo, prefix string) func() error {
+	return func() error {
+		if err := replica.Rewind(); err != nil {
+			helpers.AppLogger.Debugf("%s: Error while rewinding volume %s - %v", prefix, replica.ObjectName, err)
+			return err
+		}
+
+		err := b.Upload(ctx, replica)
+		if err != nil {
+			helpers.AppLogger.Debugf("%s: Error while uploading volume %s - %v", prefix, replica.ObjectName, err)
+		}
+		return err
+	}
+}
+
+// placementBackend restores from several destinations holding the same backup sets, e.g. buckets in
+// different regions uploaded to with a quorum. Each object is downloaded from the first destination
+// it is available from, preferring the destinations recorded in the placement of its volume.
+type placementBackend struct {
+	backends     []backends.Backend
+	destinations []string
+
+	mutex     sync.Mutex
+	placement map[string][]string
+}
+
+// preparePlacementBackend will initialize the backends for all destinations of the provided job, skipping
+// the destinations that cannot be initialized.
+func preparePlacementBackend(ctx context.Context, j *helpers.JobInfo) (*placementBackend, error) {
+	p := &placementBackend{placement: make(map[string][]string)}
+	var lastErr error
+	for _, destination := range j.Destinations {
+		backend, berr := prepareBackend(ctx, j, destination, nil)
+		if berr != nil {
+			helpers.AppLogger.Warningf("Could not initialize backend for destination %s, continuing with the remaining destinations - %v", destination, berr)
+			lastErr = berr
+			continue
+		}
+		p.backends = append(p.backends, backend)
+		p.destinations = append(p.destinations, destination)
+	}
+
+	if len(p.backends) == 0 {
+		return nil, lastErr
+	}
+
+	return p, nil
+}
+
+// place will record the destinations each of the provided volumes was uploaded to.
+func (p *placementBackend) place(volumes []*helpers.VolumeInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, vol := range volumes {
+		if len(vol.Placement) > 0 {
+			p.placement[vol.ObjectName] = vol.Placement
+		}
+	}
+}
+
+// candidates will return the indexes of the backends to try for the provided object, in order.
+func (p *placementBackend) candidates(filename string) []int {
+	p.mutex.Lock()
+	placement := p.placement[filename]
+	p.mutex.Unlock()
+
+	var preferred, others []int
+	for idx, destination := range p.destinations {
+		placed := false
+		for _, placedAt := range placement {
+			if placedAt == destination {
+				placed = true
+				break
+			}
+		}
+		if placed {
+			preferred = append(preferred, idx)
+		} else {
+			others = append(others, idx)
+		}
+	}
+
+	return append(preferred, others...)
+}
+
+// Init is a no-op, the backends are initialized by preparePlacementBackend.
+func (p *placementBackend) Init(ctx context.Context, conf *backends.BackendConfig, opts ...backends.Option) error {
+	return nil
+}
+
+// Upload is not supported.
+func (p *placementBackend) Upload(ctx context.Context, vol *helpers.VolumeInfo) error {
+	return errNotSupported
+}
+
+// Delete is not supported.
+func (p *placementBackend) Delete(ctx context.Context, filename string) error {
+	return errNotSupported
+}
+
+// List will list the objects of the first destination that can be listed.
+func (p *placementBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	var err error
+	for idx, backend := range p.backends {
+		var objects []string
+		if objects, err = backend.List(ctx, prefix); err == nil {
+			return objects, nil
+		}
+		helpers.AppLogger.Warningf("Could not list destination %s, trying the next one - %v", p.destinations[idx], err)
+	}
+	return nil, err
+}
+
+// PreDownload will prepare the provided objects for download in every destination, it only fails when
+// none of the destinations could prepare them.
+func (p *placementBackend) PreDownload(ctx context.Context, objects []string) error {
+	var err error
+	var prepared bool
+	for idx, backend := range p.backends {
+		if perr := backend.PreDownload(ctx, objects); perr != nil {
+			helpers.AppLogger.Warningf("Could not prepare objects for download from destination %s - %v", p.destinations[idx], perr)
+			err = perr
+			continue
+		}
+		prepared = true
+	}
+	if prepared {
+		return nil
+	}
+	return err
+}
+
+// Download will download the requested object from the first destination it is available from.
+func (p *placementBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	err := fmt.Errorf("no destination to download %s from", filename)
+	for _, idx := range p.candidates(filename) {
+		var r io.ReadCloser
+		if r, err = p.backends[idx].Download(ctx, filename); err == nil {
+			return r, nil
+		}
+		helpers.AppLogger.Warningf("Could not download %s from destination %s, trying the next one - %v", filename, p.destinations[idx], err)
+	}
+	return nil, err
+}
+
+// Close will close the backends of all destinations.
+func (p *placementBackend) Close() error {
+	var err error
+	for _, backend := range p.backends {
+		if cerr := backend.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
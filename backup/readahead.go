@@ -0,0 +1,103 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"context"
+	"sync"
+)
+
+// readAhead bounds how far ahead of the volume being received the volumes of a backup set are downloaded, by number
+// of volumes and by the total size of the volumes downloaded but not received yet. Volumes are allowed to start
+// downloading in order, and the next volume to receive is always allowed so the restore cannot stall.
+type readAhead struct {
+	volumes int
+	bytes   uint64
+	sizes   []uint64
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// next is the index of the next volume to receive, started the number of volumes allowed to download and held
+	// the size of those not received yet
+	next    int
+	started int
+	held    uint64
+}
+
+// newReadAhead will return a readAhead for volumes of the provided sizes, allowing up to the provided number of
+// volumes and bytes to download ahead of the volume being received. A limit of 0 is unbounded.
+func newReadAhead(volumes int, bytes uint64, sizes []uint64) *readAhead {
+	r := &readAhead{volumes: volumes, bytes: bytes, sizes: sizes}
+	r.cond = sync.NewCond(&r.mutex)
+	return r
+}
+
+// acquire will block until the volume at the provided index may start downloading or the context is done.
+func (r *readAhead) acquire(ctx context.Context, idx int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.allowed(idx) {
+		// Wake up once cancelled
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				r.mutex.Lock()
+				r.cond.Broadcast()
+				r.mutex.Unlock()
+			case <-done:
+			}
+		}()
+	}
+	for !r.allowed(idx) && ctx.Err() == nil {
+		r.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.started++
+	r.held += r.sizes[idx]
+	r.cond.Broadcast()
+	return nil
+}
+
+func (r *readAhead) allowed(idx int) bool {
+	if idx != r.started {
+		// Volumes start in order
+		return false
+	}
+	if idx == r.next {
+		return true
+	}
+	if r.volumes > 0 && idx >= r.next+r.volumes {
+		return false
+	}
+	return r.bytes == 0 || r.held+r.sizes[idx] <= r.bytes
+}
+
+// received will record the volume at the provided index, the next one in order, was handed to the receive.
+func (r *readAhead) received(idx int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.next = idx + 1
+	r.held -= r.sizes[idx]
+	r.cond.Broadcast()
+}
@@ -0,0 +1,84 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// errReadbackMismatch is returned when a volume read back right after its upload does not match what was uploaded.
+var errReadbackMismatch = errors.New("the volume read back from the destination does not match the uploaded volume")
+
+// withReadback will wrap the provided upload operation so the volume is downloaded again as soon as it was uploaded
+// and its checksum, computed with the provided hash algorithm, compared against the volume's, failing the operation on a mismatch so it is retried. Once the
+// retries are exhausted the error names the mismatched object. Piped volumes cannot be uploaded again and are not read back.
+func withReadback(ctx context.Context, b backends.Backend, vol *helpers.VolumeInfo, prefix, hashAlgorithm string, upload func() error) func() error {
+	if vol.IsUsingPipe() {
+		return upload
+	}
+
+	return func() error {
+		if err := upload(); err != nil {
+			return err
+		}
+		err := verifyReadback(ctx, b, vol, prefix, hashAlgorithm)
+		if errors.Is(err, errReadbackMismatch) {
+			helpers.AppLogger.Warningf("%s backend: %v, uploading it again.", prefix, err)
+		}
+		return err
+	}
+}
+
+// verifyReadback will download the provided volume from the backend and compare its checksum, computed with the hash
+// algorithm registered under the provided name, against the volume's.
+func verifyReadback(ctx context.Context, b backends.Backend, vol *helpers.VolumeInfo, prefix, hashAlgorithm string) error {
+	factory, err := helpers.GetHash(hashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	r, err := b.Download(ctx, vol.ObjectName)
+	if err != nil {
+		helpers.AppLogger.Debugf("%s: Error while reading back volume %s - %v", prefix, vol.ObjectName, err)
+		return err
+	}
+	defer r.Close()
+
+	hasher := factory()
+	if _, err = io.Copy(hasher, r); err != nil {
+		helpers.AppLogger.Debugf("%s: Error while reading back volume %s - %v", prefix, vol.ObjectName, err)
+		return err
+	}
+	if sum, expected := fmt.Sprintf("%x", hasher.Sum(nil)), vol.Checksum(hashAlgorithm); sum != expected {
+		return fmt.Errorf("%w: %s was read back with the checksum %s but %s was uploaded", errReadbackMismatch, vol.ObjectName, sum, expected)
+	}
+
+	helpers.AppLogger.Debugf("%s backend: Volume %s was read back and matches the uploaded volume", prefix, vol.ObjectName)
+	return nil
+}
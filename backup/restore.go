@@ -34,6 +34,7 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/dustin/go-humanize"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/kietdlam/zfsbackup-go/backends"
@@ -45,6 +46,8 @@ import (
 type downloadSequence struct {
 	volume *helpers.VolumeInfo
 	c      chan<- *helpers.VolumeInfo
+	// The position of the volume in its backup set
+	index int
 }
 
 // AutoRestore will compute which snapshots need to be restored to get to the snapshot provided,
@@ -55,7 +58,7 @@ func AutoRestore(pctx context.Context, jobInfo *helpers.JobInfo) error {
 
 	// Prepare the backend client
 	target := jobInfo.Destinations[0]
-	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	backend, berr := prepareRestoreBackend(ctx, jobInfo)
 	if berr != nil {
 		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
 		return berr
@@ -81,13 +84,25 @@ func AutoRestore(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		return derr
 	}
 	manifestTree := linkManifests(decodedManifests)
-	var ok bool
-	var volumeSnaps []*helpers.JobInfo
-	if volumeSnaps, ok = manifestTree[jobInfo.VolumeName]; !ok {
+	volumeSnaps, ok := manifestTree[jobInfo.VolumeName]
+	if !ok {
 		helpers.AppLogger.Errorf("Could not find any snapshots for volume %s, none found on target.", jobInfo.VolumeName)
 		return errors.New("could not determine any snapshots for provided volume")
 	}
 
+	if err := withRollback(ctx, jobInfo, func() error { return restoreChain(ctx, jobInfo, volumeSnaps) }); err != nil {
+		return err
+	}
+
+	helpers.AppLogger.Noticef("Done.")
+
+	return nil
+}
+
+// restoreChain will restore the snapshot of the provided JobInfo, or the latest one found if none was provided,
+// along with any of the backup sets it increments from that are not found locally. The provided backup sets of
+// the volume must be sorted by creation time and linked to their parents.
+func restoreChain(ctx context.Context, jobInfo *helpers.JobInfo, volumeSnaps []*helpers.JobInfo) error {
 	// Restore to the latest snapshot available for the volume provided if no snapshot was provided
 	if jobInfo.BaseSnapshot.Name == "" {
 		helpers.AppLogger.Infof("Trying to determine latest snapshot for volume %s.", jobInfo.VolumeName)
@@ -108,20 +123,12 @@ func AutoRestore(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		return errors.New("could not find snapshot provided")
 	}
 
+	targetJob := jobToRestore
+
 	// We have the snapshot we'd like to restore to, let's figure out whats already found locally and restore as required
 	jobsToRestore := make([]*helpers.JobInfo, 0, 10)
 	helpers.AppLogger.Infof("Calculating how to restore to %s.", jobInfo.BaseSnapshot.Name)
-	volume := jobInfo.LocalVolume
-	parts := strings.Split(jobInfo.VolumeName, "/")
-	if jobInfo.FullPath {
-		parts[0] = volume
-		volume = strings.Join(parts, "/")
-	}
-
-	if jobInfo.LastPath {
-		volume = fmt.Sprintf("%s/%s", volume, parts[len(parts)-1])
-	}
-
+	volume := jobInfo.ReceiveTarget()
 	snapshots, err := helpers.GetSnapshots(ctx, volume)
 	if err != nil {
 		// TODO: There are some error cases that are ok to ignore!
@@ -158,7 +165,7 @@ func AutoRestore(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		}
 		if jobToRestore.ParentSnap == nil {
 			helpers.AppLogger.Errorf("Want to restore parent snap %s but it is not found in the backend, aborting.", jobToRestore.IncrementalSnapshot.Name)
-			return errors.New("could not find parent snapshot")
+			return &helpers.OperationError{Op: "restore", Dataset: jobInfo.VolumeName, Kind: helpers.ErrChainBroken, Err: fmt.Errorf("the backup set of %s, which %s increments from, was not found", jobToRestore.IncrementalSnapshot.Name, jobToRestore.BaseSnapshot.Name)}
 		}
 		jobToRestore = jobToRestore.ParentSnap
 	}
@@ -166,33 +173,54 @@ func AutoRestore(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	helpers.AppLogger.Infof("Need to restore %d snapshots.", len(jobsToRestore))
 
 	// We have a list of snapshots we need to restore, start at the end and work our way down
+	ordered := make([]*helpers.JobInfo, 0, len(jobsToRestore))
 	for i := len(jobsToRestore) - 1; i >= 0; i-- {
-		jobInfo.BaseSnapshot = jobsToRestore[i].BaseSnapshot
-		jobInfo.IncrementalSnapshot = jobsToRestore[i].IncrementalSnapshot
-		jobInfo.Volumes = jobsToRestore[i].Volumes
-		jobInfo.Compressor = jobsToRestore[i].Compressor
-		jobInfo.Separator = jobsToRestore[i].Separator
-		helpers.AppLogger.Infof("Restoring snapshot %s (%d/%d)", jobInfo.BaseSnapshot.Name, len(jobsToRestore)-i, len(jobsToRestore))
-		if err := Receive(ctx, jobInfo); err != nil {
+		ordered = append(ordered, jobsToRestore[i])
+	}
+	if jobInfo.RestoreStateFile != "" {
+		if err = resumeRestoreState(ctx, jobInfo, ordered, restoreSnapshotChain(targetJob)); err != nil {
+			return err
+		}
+	}
+
+	for idx, job := range ordered {
+		jobInfo.BaseSnapshot = job.BaseSnapshot
+		jobInfo.IncrementalSnapshot = job.IncrementalSnapshot
+		jobInfo.Volumes = job.Volumes
+		jobInfo.Compressor = job.Compressor
+		jobInfo.Separator = job.Separator
+		jobInfo.KeyCase = job.KeyCase
+		jobInfo.KeyDatasetSeparator = job.KeyDatasetSeparator
+		jobInfo.KeyPrefix = job.KeyPrefix
+		helpers.AppLogger.Infof("Restoring snapshot %s (%d/%d)", jobInfo.BaseSnapshot.Name, idx+1, len(ordered))
+		if err := receive(ctx, jobInfo); err != nil {
 			helpers.AppLogger.Errorf("Failed to restore snapshot.")
 			return err
 		}
 	}
 
-	helpers.AppLogger.Noticef("Done.")
+	if jobInfo.RestoreState != nil {
+		if err := jobInfo.RestoreState.Remove(); err != nil {
+			helpers.AppLogger.Warningf("Could not delete the restore state %s of the completed restore - %v", jobInfo.RestoreStateFile, err)
+		}
+	}
 
 	return nil
 }
 
 // Receive will download and restore the backup job described to the Volume target provided.
-func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
+func Receive(ctx context.Context, jobInfo *helpers.JobInfo) error {
+	return withRollback(ctx, jobInfo, func() error { return receive(ctx, jobInfo) })
+}
+
+func receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
 	target := jobInfo.Destinations[0]
 
 	// Prepare the backend client
-	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	backend, berr := prepareRestoreBackend(ctx, jobInfo)
 	if berr != nil {
 		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
 		return berr
@@ -206,19 +234,13 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		return cerr
 	}
 
-	// See if the snapshots we want to restore already exist
-	volume := jobInfo.LocalVolume
-	parts := strings.Split(jobInfo.VolumeName, "/")
-	if jobInfo.FullPath {
-		parts[0] = volume
-		volume = strings.Join(parts, "/")
-	}
-
-	if jobInfo.LastPath {
-		volume = fmt.Sprintf("%s/%s", volume, parts[len(parts)-1])
+	// See if the snapshots we want to restore already exist, this can only be checked locally
+	volume := jobInfo.ReceiveTarget()
+	if jobInfo.SSHHost != "" {
+		helpers.AppLogger.Infof("Not checking for existing snapshots of %s on the remote host %s, the remote zfs receive will fail if the backup cannot be applied.", volume, jobInfo.SSHHost)
 	}
 
-	if jobInfo.BaseSnapshot.CreationTime.IsZero() {
+	if jobInfo.SSHHost == "" && jobInfo.BaseSnapshot.CreationTime.IsZero() {
 		if ok, verr := validateSnapShotExists(ctx, &jobInfo.BaseSnapshot, volume); verr != nil {
 			helpers.AppLogger.Errorf("Cannot validate if selected base snapshot exists due to error - %v", verr)
 			return verr
@@ -229,49 +251,257 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	}
 
 	// Check that we have the parent snap shot this wants to restore from
-	if jobInfo.IncrementalSnapshot.Name != "" && jobInfo.IncrementalSnapshot.CreationTime.IsZero() {
+	if jobInfo.SSHHost == "" && jobInfo.IncrementalSnapshot.Name != "" && jobInfo.IncrementalSnapshot.CreationTime.IsZero() {
 		if ok, verr := validateSnapShotExists(ctx, &jobInfo.IncrementalSnapshot, volume); verr != nil {
 			helpers.AppLogger.Errorf("Cannot validate if selected incremental snapshot exists due to error - %v", verr)
 			return verr
 		} else if !ok {
 			helpers.AppLogger.Errorf("Selected incremental snapshot does not exist!")
-			return fmt.Errorf("selected incremental snapshot does not exist")
+			return &helpers.OperationError{Op: "restore", Dataset: jobInfo.VolumeName, Kind: helpers.ErrChainBroken, Err: fmt.Errorf("the snapshot %s, which %s increments from, does not exist on %s", jobInfo.IncrementalSnapshot.Name, jobInfo.BaseSnapshot.Name, volume)}
 		}
 	}
 
-	// Compute the Manifest File
-	tempManifest, err := helpers.CreateManifestVolume(ctx, jobInfo)
+	manifest, err := fetchManifest(ctx, jobInfo, backend, localCachePath)
 	if err != nil {
-		helpers.AppLogger.Errorf("Error trying to create manifest volume - %v", err)
 		return err
 	}
-	tempManifest.Close()
-	tempManifest.DeleteVolume()
-	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(tempManifest.ObjectName)))
+
+	if err = receiveManifestWithRetry(ctx, jobInfo, manifest, backend); err != nil {
+		return err
+	}
+
+	helpers.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+	return nil
+}
+
+// ReceiveGroup will restore each member of a grouped backup, in the order they were backed up.
+// Members whose snapshot already exists locally are skipped.
+func ReceiveGroup(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	target := jobInfo.Destinations[0]
+
+	// Prepare the backend client
+	backend, berr := prepareRestoreBackend(ctx, jobInfo)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	manifest, err := fetchManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.GroupMembers) == 0 {
+		helpers.AppLogger.Errorf("The backup set %s@%s is not a grouped backup.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		return fmt.Errorf("backup set %s@%s is not a grouped backup", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+	}
+
+	for idx, memberJob := range groupReceiveJobs(jobInfo, manifest) {
+		if memberJob.SSHHost == "" {
+			if ok, verr := validateSnapShotExists(ctx, &memberJob.BaseSnapshot, memberJob.ReceiveTarget()); verr != nil {
+				helpers.AppLogger.Errorf("Cannot validate if snapshot %s@%s already exists due to error - %v", memberJob.VolumeName, memberJob.BaseSnapshot.Name, verr)
+				return verr
+			} else if ok {
+				helpers.AppLogger.Noticef("Snapshot %s@%s already exists, skipping.", memberJob.VolumeName, memberJob.BaseSnapshot.Name)
+				continue
+			}
+		}
+
+		helpers.AppLogger.Infof("Restoring %s@%s (%d of %d) from group %s.", memberJob.VolumeName, memberJob.BaseSnapshot.Name, idx+1, len(manifest.GroupMembers), manifest.GroupName)
+		if err = receiveManifestWithRetry(ctx, memberJob, manifest.GroupMembers[idx], backend); err != nil {
+			helpers.AppLogger.Errorf("Could not restore %s@%s from group %s due to error - %v", memberJob.VolumeName, memberJob.BaseSnapshot.Name, manifest.GroupName, err)
+			return err
+		}
+	}
+
+	helpers.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+	return nil
+}
+
+// groupReceiveJobs will return the receive options for each member of the provided group manifest,
+// in the order they should be restored.
+func groupReceiveJobs(jobInfo *helpers.JobInfo, manifest *helpers.JobInfo) []*helpers.JobInfo {
+	jobs := make([]*helpers.JobInfo, len(manifest.GroupMembers))
+	for idx, member := range manifest.GroupMembers {
+		memberJob := *jobInfo
+		memberJob.VolumeName = member.VolumeName
+		memberJob.BaseSnapshot = member.BaseSnapshot
+		memberJob.IncrementalSnapshot = member.IncrementalSnapshot
+		memberJob.GroupName = ""
+		memberJob.GroupMembers = nil
+		jobs[idx] = &memberJob
+	}
+
+	return jobs
+}
+
+// fetchManifest will read the manifest for the provided job from the local cache, downloading it first if required.
+func fetchManifest(ctx context.Context, jobInfo *helpers.JobInfo, backend backends.Backend, localCachePath string) (*helpers.JobInfo, error) {
+	manifestPath, err := syncManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := readManifest(ctx, manifestPath, jobInfo)
+	if err != nil {
+		helpers.AppLogger.Errorf("Error trying to retrieve manifest volume - %v", err)
+		return nil, err
+	}
+
+	if err = manifest.CheckReaderVersion(); err != nil {
+		helpers.AppLogger.Errorf("Refusing to restore - %v", err)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// syncManifest will make sure the manifest for the provided job is in the local cache, downloading it if required,
+// and return its path.
+func syncManifest(ctx context.Context, jobInfo *helpers.JobInfo, backend backends.Backend, localCachePath string) (string, error) {
+	manifestName, err := manifestObjectName(ctx, jobInfo)
+	if err != nil {
+		return "", err
+	}
+	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifestName)))
 	safeManifestPath := filepath.Join(localCachePath, safeManifestFile)
 
 	// Check to see if we have the manifest file locally
-	manifest, err := readManifest(ctx, safeManifestPath, jobInfo)
+	if _, err = os.Stat(safeManifestPath); os.IsNotExist(err) {
+		// Try and download the manifest file from the backend, or one of its copies
+		if err = downloadManifest(ctx, jobInfo, backend, manifestName, safeManifestPath); err != nil {
+			return "", err
+		}
+	}
+
+	if err = syncManifestParts(ctx, jobInfo, backend, safeManifestPath); err != nil {
+		return "", err
+	}
+
+	return safeManifestPath, nil
+}
+
+// manifestObjectName will compute the object name of the manifest for the provided job.
+func manifestObjectName(ctx context.Context, jobInfo *helpers.JobInfo) (string, error) {
+	tempManifest, err := helpers.CreateManifestVolume(ctx, jobInfo)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = backend.PreDownload(ctx, []string{tempManifest.ObjectName})
-			if err != nil {
-				helpers.AppLogger.Errorf("Error trying to pre download manifest volume %s - %v", tempManifest.ObjectName, err)
-				return err
-			}
-			// Try and download the manifest file from the backend
-			downloadTo(ctx, backend, tempManifest.ObjectName, safeManifestPath)
-			manifest, err = readManifest(ctx, safeManifestPath, jobInfo)
+		helpers.AppLogger.Errorf("Error trying to create manifest volume - %v", err)
+		return "", err
+	}
+	tempManifest.Close()
+	tempManifest.DeleteVolume()
+
+	return tempManifest.ObjectName, nil
+}
+
+// prepareRestoreBackend will prepare the backend to restore from. Additional destinations, e.g. the other
+// regions of a backup uploaded with a quorum, are used when the first destination is not available.
+func prepareRestoreBackend(ctx context.Context, jobInfo *helpers.JobInfo) (backends.Backend, error) {
+	if len(jobInfo.Destinations) == 1 {
+		return prepareBackend(ctx, jobInfo, jobInfo.Destinations[0], nil)
+	}
+	return preparePlacementBackend(ctx, jobInfo)
+}
+
+// receiveManifestWithRetry will restore the provided manifest, retrying when receiving on a remote host and ssh
+// fails (e.g. the connection dropped), or when the local zfs receive fails with a transient error, see retryZFS.
+// The zfs receive discards a partially received stream, so the backup set is downloaded and sent again from the start.
+func receiveManifestWithRetry(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo, backend backends.Backend) error {
+	if jobInfo.SSHHost == "" {
+		// Except when receiving with -s to resume, the partially received state it keeps would fail the receive again
+		return retryZFS(ctx, jobInfo, "zfs receive", func() error {
+			return receiveManifest(ctx, jobInfo, manifest, backend)
+		}, func() bool { return jobInfo.RestoreStateFile == "" })
+	}
+
+	be := backoff.NewExponentialBackOff()
+	be.MaxInterval = jobInfo.MaxBackoffTime
+	be.MaxElapsedTime = jobInfo.MaxRetryTime
+	retryconf := backoff.WithContext(be, ctx)
+
+	operation := func() error {
+		err := receiveManifest(ctx, jobInfo, manifest, backend)
+		if err != nil && !helpers.IsSSHError(err) {
+			helpers.AppLogger.Errorf("The zfs receive on the remote host %s failed - %v", jobInfo.SSHHost, err)
+			return backoff.Permanent(err)
 		}
 		if err != nil {
-			helpers.AppLogger.Errorf("Error trying to retrieve manifest volume - %v", err)
-			return err
+			helpers.AppLogger.Warningf("ssh to %s failed while receiving %s@%s, retrying - %v", jobInfo.SSHHost, manifest.VolumeName, manifest.BaseSnapshot.Name, err)
 		}
+		return err
 	}
 
+	return backoff.Retry(operation, retryconf)
+}
+
+// receiveManifest will download the volumes described in the provided manifest and pipe them to a zfs receive command,
+// recording the restore in the audit log.
+func receiveManifest(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo, backend backends.Backend) error {
+	err := receiveBackupSet(ctx, jobInfo, manifest, backend)
+	recordAuditEvent(helpers.NewAuditEvent(helpers.AuditRestore, manifest.VolumeName, manifest.BaseSnapshot.Name, restoreTarget(jobInfo), manifest.ZFSStreamBytes, err))
+	return err
+}
+
+func receiveBackupSet(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo, backend backends.Backend) error {
 	manifest.ManifestPrefix = jobInfo.ManifestPrefix
 	manifest.SignKey = jobInfo.SignKey
 	manifest.EncryptKey = jobInfo.EncryptKey
+	manifest.TrustedSigners = jobInfo.TrustedSigners
+	manifest.DecompressCommand = jobInfo.DecompressCommand
+	manifest.VerifyStream = jobInfo.VerifyStream
+	manifest.RestoreState = jobInfo.RestoreState
+	helpers.ThrottleDownloads(jobInfo.MaxDownloadBytesPerSecond)
+
+	if manifest.VerifyStream && manifest.StreamSHA256 == "" {
+		helpers.AppLogger.Errorf("The backup set %s@%s does not record a digest of its send stream to verify it against.", manifest.VolumeName, manifest.BaseSnapshot.Name)
+		return fmt.Errorf("no stream digest recorded for backup set %s@%s", manifest.VolumeName, manifest.BaseSnapshot.Name)
+	}
+
+	// Raw streams keep the encryption they were sent with, whether the parent is encrypted can only be checked locally
+	var err error
+	if manifest.RawSend {
+		err = jobInfo.PrepareRawReceive()
+	} else if jobInfo.SSHHost == "" && jobInfo.OutputFile == "" {
+		err = jobInfo.PrepareEncryptedParentReceive(ctx, manifest.Properties || manifest.Replication)
+	}
+	if err != nil {
+		helpers.AppLogger.Errorf("Cannot restore the backup set %s@%s - %v", manifest.VolumeName, manifest.BaseSnapshot.Name, err)
+		return err
+	}
+	if jobInfo.SSHHost == "" && jobInfo.OutputFile == "" {
+		checkStreamFeatures(ctx, jobInfo, manifest)
+	}
+
+	if p, ok := backend.(*placementBackend); ok {
+		p.place(manifest.Volumes)
+	}
+
+	if manifest.SingleObject && len(manifest.Volumes) != 1 {
+		helpers.AppLogger.Errorf("The backup set %s@%s was streamed as a single object but its manifest lists %d objects.", manifest.VolumeName, manifest.BaseSnapshot.Name, len(manifest.Volumes))
+		return fmt.Errorf("expected a single object for backup set %s@%s, found %d", manifest.VolumeName, manifest.BaseSnapshot.Name, len(manifest.Volumes))
+	}
+
+	if _, err := helpers.GetHash(manifest.HashAlgorithm); err != nil {
+		helpers.AppLogger.Errorf("The backup set %s@%s was verified with the hash algorithm %s which has not been registered.", manifest.VolumeName, manifest.BaseSnapshot.Name, manifest.HashAlgorithm)
+		return err
+	}
+
+	if jobInfo.OutputFile != "" {
+		if err := checkOutputFile(jobInfo.OutputFile, manifest.ZFSStreamBytes); err != nil {
+			return err
+		}
+	}
 
 	// Get list of Objects
 	toDownload := make([]string, len(manifest.Volumes))
@@ -295,6 +525,26 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		usePipe = true
 	}
 
+	var partialDir string
+	if jobInfo.ResumableRestore && !usePipe && len(jobInfo.Destinations) > 0 {
+		if partialDir, err = resumeDir(jobInfo.Destinations[0]); err != nil {
+			helpers.AppLogger.Errorf("Cannot resume the downloads of the backup set %s@%s - %v", manifest.VolumeName, manifest.BaseSnapshot.Name, err)
+			return err
+		}
+	}
+
+	if manifest.RestoreState != nil {
+		// The volumes received are kept in the partial download directory until the backup set was received
+		if partialDir == "" {
+			helpers.AppLogger.Errorf("Persisting the restore state requires a resumable restore with a file buffer.")
+			return fmt.Errorf("restore state requires a resumable restore")
+		}
+		if err = manifest.RestoreState.Begin(manifest.BaseSnapshot); err != nil {
+			helpers.AppLogger.Errorf("Could not save the restore state %s due to error - %v", jobInfo.RestoreStateFile, err)
+			return err
+		}
+	}
+
 	downloadChannel := make(chan downloadSequence, len(manifest.Volumes))
 	bufferChannel := make(chan interface{}, fileBufferSize)
 	orderedChannels := make([]chan *helpers.VolumeInfo, len(manifest.Volumes))
@@ -304,15 +554,26 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	for idx := range manifest.Volumes {
 		c := make(chan *helpers.VolumeInfo, 1)
 		orderedChannels[idx] = c
-		downloadChannel <- downloadSequence{manifest.Volumes[idx], c}
+		downloadChannel <- downloadSequence{volume: manifest.Volumes[idx], c: c, index: idx}
 	}
 	close(downloadChannel)
 
 	var wg *errgroup.Group
 	wg, ctx = errgroup.WithContext(ctx)
 
-	// Kick off go routines to download
-	for i := 0; i < fileBufferSize; i++ {
+	// Volumes are downloaded in order, no further ahead of the volume being received than the read-ahead allows
+	sizes := make([]uint64, len(manifest.Volumes))
+	for idx := range manifest.Volumes {
+		sizes[idx] = manifest.Volumes[idx].Size
+	}
+	ahead := newReadAhead(jobInfo.ReadAheadVolumes, jobInfo.ReadAheadSize*humanize.MiByte, sizes)
+
+	// Kick off go routines to download, the volumes downloaded wait in the file buffer to be received in order
+	downloaders := fileBufferSize
+	if jobInfo.MaxParallelDownloads > 0 && jobInfo.MaxParallelDownloads < downloaders {
+		downloaders = jobInfo.MaxParallelDownloads
+	}
+	for i := 0; i < downloaders; i++ {
 		wg.Go(func() error {
 			for {
 				select {
@@ -323,6 +584,9 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 						return nil
 					}
 					defer close(sequence.c)
+					if err := ahead.acquire(ctx, sequence.index); err != nil {
+						return err
+					}
 					select {
 					case <-ctx.Done():
 						return ctx.Err()
@@ -335,7 +599,12 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 					retryconf := backoff.WithContext(be, ctx)
 
 					operation := func() error {
-						oerr := processSequence(ctx, sequence, backend, usePipe)
+						var oerr error
+						if partialDir != "" {
+							oerr = resumeSequence(ctx, sequence, backend, partialDir, manifest.HashAlgorithm)
+						} else {
+							oerr = processSequence(ctx, sequence, backend, usePipe, manifest.HashAlgorithm)
+						}
 						if oerr != nil {
 							helpers.AppLogger.Warningf("error trying to download file %s - %v", sequence.volume.ObjectName, oerr)
 						}
@@ -357,22 +626,35 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 	orderedVolumes := make(chan *helpers.VolumeInfo, len(toDownload))
 	wg.Go(func() error {
 		defer close(orderedVolumes)
-		for _, c := range orderedChannels {
+		for idx, c := range orderedChannels {
+			// Volumes that were never picked up are not closed when aborting, do not wait on them
+			var vol *helpers.VolumeInfo
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case orderedVolumes <- <-c:
-				continue
+			case vol = <-c:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case orderedVolumes <- vol:
+				ahead.received(idx)
 			}
 		}
 		return nil
 	})
 
-	// Prepare ZFS Receive command
-	cmd := helpers.GetZFSReceiveCommand(ctx, jobInfo)
-	wg.Go(func() error {
-		return receiveStream(ctx, cmd, manifest, orderedVolumes, bufferChannel)
-	})
+	if jobInfo.OutputFile != "" {
+		wg.Go(func() error {
+			return writeStreamFile(ctx, jobInfo.OutputFile, manifest, orderedVolumes, bufferChannel)
+		})
+	} else {
+		// Prepare ZFS Receive command
+		cmd := helpers.GetZFSReceiveCommand(ctx, jobInfo)
+		wg.Go(func() error {
+			return receiveStream(ctx, cmd, manifest, orderedVolumes, bufferChannel)
+		})
+	}
 
 	// Wait for processes to finish
 	err = wg.Wait()
@@ -381,29 +663,116 @@ func Receive(pctx context.Context, jobInfo *helpers.JobInfo) error {
 		return err
 	}
 
-	helpers.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+	if manifest.RestoreState != nil {
+		if err = completeRestoreState(manifest, partialDir); err != nil {
+			return err
+		}
+	}
+
+	if jobInfo.SyncUserProperties && jobInfo.OutputFile == "" {
+		if err := applyUserProperties(ctx, jobInfo, manifest); err != nil {
+			return err
+		}
+	}
+
+	return surfaceMetadata(ctx, jobInfo, manifest)
+}
+
+// surfaceMetadata will append the metadata recorded in the provided manifest to the metadata file, and pass it to the
+// post restore hook, of the restore, once the backup set it describes was received.
+func surfaceMetadata(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo) error {
+	if jobInfo.MetadataFile == "" && jobInfo.PostRestoreHook == "" {
+		return nil
+	}
+
+	record := &helpers.MetadataRecord{
+		VolumeName: manifest.VolumeName,
+		Snapshot:   manifest.BaseSnapshot.Name,
+		Metadata:   manifest.Metadata,
+	}
+	if jobInfo.OutputFile == "" {
+		record.Target = jobInfo.ReceiveTarget()
+	}
+
+	if jobInfo.MetadataFile != "" {
+		if err := helpers.AppendMetadataFile(jobInfo.MetadataFile, record); err != nil {
+			helpers.AppLogger.Errorf("Could not write the metadata of the backup set %s@%s to %s - %v", manifest.VolumeName, manifest.BaseSnapshot.Name, jobInfo.MetadataFile, err)
+			return err
+		}
+	}
+
+	if jobInfo.PostRestoreHook != "" && jobInfo.OutputFile == "" {
+		helpers.AppLogger.Infof("Running the post restore hook for the backup set %s@%s received into %s.", manifest.VolumeName, manifest.BaseSnapshot.Name, record.Target)
+		if err := helpers.RunPostRestoreHook(ctx, jobInfo.PostRestoreHook, record); err != nil {
+			helpers.AppLogger.Errorf("The post restore hook failed for the backup set %s@%s - %v", manifest.VolumeName, manifest.BaseSnapshot.Name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyUserProperties will set the user properties recorded in the provided manifest on the dataset it was received into.
+func applyUserProperties(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo) error {
+	props := jobInfo.UserPropertiesToApply(manifest)
+	if len(props) == 0 {
+		return nil
+	}
+
+	if jobInfo.SSHHost != "" {
+		helpers.AppLogger.Warningf("Cannot reapply the %d user properties of the backup set %s@%s when receiving on the remote host %s, skipping them.", len(props), manifest.VolumeName, manifest.BaseSnapshot.Name, jobInfo.SSHHost)
+		return nil
+	}
+
+	target := jobInfo.ReceiveTarget()
+	helpers.AppLogger.Infof("Reapplying %d user properties of the backup set %s@%s to %s.", len(props), manifest.VolumeName, manifest.BaseSnapshot.Name, target)
+	if err := helpers.SetUserProperties(ctx, target, props); err != nil {
+		helpers.AppLogger.Errorf("Could not reapply the user properties of the backup set %s@%s - %v", manifest.VolumeName, manifest.BaseSnapshot.Name, err)
+		return err
+	}
+
 	return nil
 }
 
-func processSequence(ctx context.Context, sequence downloadSequence, backend backends.Backend, usePipe bool) error {
+// checkStreamFeatures will warn when the pool the backup set described by the manifest is received into lacks a feature
+// its stream needs, as recorded by the send flags in the manifest, as the receive will then likely fail.
+func checkStreamFeatures(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo) {
+	features := manifest.StreamFeatures()
+	if len(features) == 0 {
+		return
+	}
+
+	pool := strings.SplitN(jobInfo.ReceiveTarget(), "/", 2)[0]
+	missing, err := helpers.MissingPoolFeatures(ctx, pool, features)
+	if err != nil {
+		helpers.AppLogger.Warningf("Could not check whether the pool %s has the features %s needed to receive the backup set %s@%s - %v", pool, strings.Join(features, ", "), manifest.VolumeName, manifest.BaseSnapshot.Name, err)
+		return
+	}
+	if len(missing) > 0 {
+		helpers.AppLogger.Warningf("The backup set %s@%s was sent with flags that need the pool features %s which are not enabled on the pool %s, the receive will likely fail.", manifest.VolumeName, manifest.BaseSnapshot.Name, strings.Join(missing, ", "), pool)
+	}
+}
+
+func processSequence(ctx context.Context, sequence downloadSequence, backend backends.Backend, usePipe bool, hashAlgorithm string) error {
 	r, rerr := backend.Download(ctx, sequence.volume.ObjectName)
 	if rerr != nil {
 		helpers.AppLogger.Infof("Could not get %s due to error %v.", sequence.volume.ObjectName, rerr)
 		return rerr
 	}
 	defer r.Close()
-	vol, err := helpers.CreateSimpleVolume(ctx, usePipe)
+	vol, err := helpers.CreateSimpleVolume(ctx, usePipe, hashAlgorithm)
 	if err != nil {
 		helpers.AppLogger.Noticef("Could not create temporary file to download %s due to error - %v.", sequence.volume.ObjectName, err)
 		return err
 	}
 
 	vol.ObjectName = sequence.volume.ObjectName
+	vol.Compressor = sequence.volume.Compressor
 	if usePipe {
 		sequence.c <- vol
 	}
 
-	_, err = io.Copy(vol, r)
+	_, err = io.Copy(vol, helpers.BackupDownloadThrottle.Reader(r))
 	if err != nil {
 		helpers.AppLogger.Noticef("Could not download file %s to the local cache dir due to error - %v.", sequence.volume.ObjectName, err)
 		vol.Close()
@@ -418,14 +787,15 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 		return cerr
 	}
 
-	// Verify the SHA256 Hash, if it doesn't match, ditch it!
-	if vol.SHA256Sum != sequence.volume.SHA256Sum {
-		helpers.AppLogger.Infof("Hash mismatch for %s, got %s but expected %s. Retrying.", sequence.volume.ObjectName, vol.SHA256Sum, sequence.volume.SHA256Sum)
+	// Verify the Hash, if it doesn't match, ditch it! Backup sets that do not record a hash algorithm are verified with SHA256
+	got, expected := vol.Checksum(hashAlgorithm), sequence.volume.Checksum(hashAlgorithm)
+	if got != expected {
+		helpers.AppLogger.Infof("Hash mismatch for %s, got %s but expected %s. Retrying.", sequence.volume.ObjectName, got, expected)
 		if usePipe {
 			return backoff.Permanent(fmt.Errorf("cannot retry when using no file buffer, aborting"))
 		}
 		vol.DeleteVolume()
-		return fmt.Errorf("SHA256 hash mismatch for %s, got %s but expected %s", sequence.volume.ObjectName, vol.SHA256Sum, sequence.volume.SHA256Sum)
+		return &helpers.OperationError{Op: "download", Volume: sequence.volume.ObjectName, Kind: helpers.ErrChecksumMismatch, Err: fmt.Errorf("got %s but expected %s", got, expected)}
 	}
 	helpers.AppLogger.Debugf("Downloaded %s.", sequence.volume.ObjectName)
 
@@ -438,8 +808,9 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 
 func receiveStream(ctx context.Context, cmd *exec.Cmd, j *helpers.JobInfo, c <-chan *helpers.VolumeInfo, buffer <-chan interface{}) error {
 	cin, cout := io.Pipe()
+	stderr := helpers.NewStderrCapture(os.Stderr)
 	cmd.Stdin = cin
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = stderr
 	var group *errgroup.Group
 	var once sync.Once
 	group, ctx = errgroup.WithContext(ctx)
@@ -449,7 +820,7 @@ func receiveStream(ctx context.Context, cmd *exec.Cmd, j *helpers.JobInfo, c <-c
 	err := cmd.Start()
 	if err != nil {
 		helpers.AppLogger.Errorf("Error starting zfs command - %v", err)
-		return err
+		return zfsError("zfs receive", j.VolumeName, err)
 	}
 
 	defer func() {
@@ -467,40 +838,34 @@ func receiveStream(ctx context.Context, cmd *exec.Cmd, j *helpers.JobInfo, c <-c
 		}
 	}()
 
+	// The end of the stream is held back from zfs receive until the reassembled stream was verified
+	var out io.Writer = cout
+	var digest *digestWriter
+	if j.VerifyStream {
+		digest = newDigestWriter(cout, streamDigestHoldBack)
+		out = digest
+	}
+
 	// Extract ZFS stream from files and send it to the zfs command
 	group.Go(func() error {
 		defer once.Do(func() { cout.Close() })
-		for {
-			select {
-			case vol, ok := <-c:
-				if !ok {
-					return nil
-				}
-				helpers.AppLogger.Debugf("Processing %s.", vol.ObjectName)
-				eerr := vol.Extract(ctx, j, false)
-				if eerr != nil {
-					helpers.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, eerr)
-					return err
-				}
-				_, eerr = io.Copy(cout, vol)
-				if eerr != nil {
-					helpers.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, eerr)
-					return eerr
-				}
-				vol.Close()
-				vol.DeleteVolume()
-				helpers.AppLogger.Debugf("Processed %s.", vol.ObjectName)
-				vol = nil
-				<-buffer
-			case <-ctx.Done():
-				return ctx.Err()
-			}
+		if err := copyVolumes(ctx, j, c, buffer, out); err != nil {
+			return err
+		}
+		if digest == nil {
+			return nil
+		}
+		if verr := digest.Verify(j.StreamSHA256); verr != nil {
+			helpers.AppLogger.Errorf("The reassembled send stream of %s@%s failed verification, aborting the receive - %v", j.VolumeName, j.BaseSnapshot.Name, verr)
+			return &helpers.OperationError{Op: "restore", Dataset: j.VolumeName, Kind: helpers.ErrChecksumMismatch, Err: verr}
 		}
+		helpers.AppLogger.Infof("The reassembled send stream of %s@%s matches the digest recorded when it was backed up.", j.VolumeName, j.BaseSnapshot.Name)
+		return nil
 	})
 
 	group.Go(func() error {
 		defer once.Do(func() { cout.Close() })
-		return cmd.Wait()
+		return zfsError("zfs receive", j.VolumeName, stderr.Wrap(cmd.Wait()))
 	})
 
 	// Wait for the command to finish
@@ -514,6 +879,41 @@ func receiveStream(ctx context.Context, cmd *exec.Cmd, j *helpers.JobInfo, c <-c
 	return nil
 }
 
+// copyVolumes will extract the ordered volumes received on the provided channel to the provided
+// writer, deleting each volume once written, until the channel is closed.
+func copyVolumes(ctx context.Context, j *helpers.JobInfo, c <-chan *helpers.VolumeInfo, buffer <-chan interface{}, out io.Writer) error {
+	for {
+		select {
+		case vol, ok := <-c:
+			if !ok {
+				return nil
+			}
+			helpers.AppLogger.Debugf("Processing %s.", vol.ObjectName)
+			if err := vol.Extract(ctx, j, false); err != nil {
+				helpers.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, err)
+				return err
+			}
+			n, err := io.Copy(out, vol)
+			if err != nil {
+				helpers.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, err)
+				return err
+			}
+			vol.Close()
+			if j.RestoreState == nil {
+				vol.DeleteVolume()
+			} else if err = j.RestoreState.VolumeReceived(uint64(n)); err != nil {
+				// The volume is kept in the local cache until its snapshot was received, see completeRestoreState
+				helpers.AppLogger.Errorf("Could not save the restore state due to error - %v", err)
+				return err
+			}
+			helpers.AppLogger.Debugf("Processed %s.", vol.ObjectName)
+			<-buffer
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func downloadTo(ctx context.Context, backend backends.Backend, objectName, toPath string) error {
 	r, rerr := backend.Download(ctx, objectName)
 	if rerr == nil {
@@ -537,3 +937,57 @@ func downloadTo(ctx context.Context, backend backends.Backend, objectName, toPat
 	}
 	return nil
 }
+
+// ReadVolumeRange will return length bytes of the zfs stream stored in the provided volume starting at offset. Only
+// the blocks of the volume needed are downloaded and decompressed, which requires the volume to be compressed with
+// the seekable zstd compressor, not encrypted or signed, and the backend to support ranged downloads.
+func ReadVolumeRange(ctx context.Context, backend backends.Backend, manifest *helpers.JobInfo, vol *helpers.VolumeInfo, offset, length int64) ([]byte, error) {
+	if vol.Compressor != helpers.SeekableZstdCompressor {
+		return nil, fmt.Errorf("volume %s was compressed with %s, ranged reads require the %s compressor", vol.ObjectName, vol.Compressor, helpers.SeekableZstdCompressor)
+	}
+	if manifest.EncryptTo != "" || manifest.SignFrom != "" {
+		return nil, fmt.Errorf("volume %s is encrypted or signed and cannot be read by range", vol.ObjectName)
+	}
+	rangeBackend, ok := backend.(backends.RangeDownloader)
+	if !ok {
+		return nil, fmt.Errorf("the backend for volume %s does not support ranged downloads", vol.ObjectName)
+	}
+
+	reader, err := helpers.NewSeekableZstdReader(&backendReaderAt{ctx, rangeBackend, vol.ObjectName}, int64(vol.Size))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if size := reader.Size(); offset+length > size {
+		length = size - offset
+	}
+	if length <= 0 {
+		return nil, io.EOF
+	}
+
+	buf := make([]byte, length)
+	n, err := reader.ReadAt(buf, offset)
+	return buf[:n], err
+}
+
+// backendReaderAt implements io.ReaderAt by downloading the requested range of an object for every read.
+type backendReaderAt struct {
+	ctx        context.Context
+	backend    backends.RangeDownloader
+	objectName string
+}
+
+func (b *backendReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r, err := b.backend.DownloadRange(b.ctx, b.objectName, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
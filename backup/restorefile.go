@@ -0,0 +1,238 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// ErrInsufficientSpace is returned when there is not enough free disk space to write a send stream to a file.
+var ErrInsufficientSpace = errors.New("not enough free disk space to write the send stream")
+
+// RestoreToFile will download the backup job described and write its reassembled send stream to the
+// OutputFile instead of receiving it, e.g. to carry it to an air-gapped system and zfs receive it there.
+// Each volume is verified as it is downloaded, and the whole stream if its digest was recorded.
+func RestoreToFile(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	target := jobInfo.Destinations[0]
+
+	// Prepare the backend client
+	backend, berr := prepareRestoreBackend(ctx, jobInfo)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	manifest, err := fetchManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		return err
+	}
+
+	if jobInfo.OutputLength > 0 {
+		if err = writeStreamRange(ctx, jobInfo, manifest, backend); err != nil {
+			return err
+		}
+		helpers.AppLogger.Noticef("Wrote the range of the send stream of %s@%s starting at offset %d to %s.", manifest.VolumeName, manifest.BaseSnapshot.Name, jobInfo.OutputOffset, jobInfo.OutputFile)
+		helpers.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+		return nil
+	}
+
+	if err = receiveManifest(ctx, jobInfo, manifest, backend); err != nil {
+		return err
+	}
+
+	helpers.AppLogger.Noticef("Wrote the send stream of %s@%s to %s, it can be restored with: zfs receive <filesystem> < %s", manifest.VolumeName, manifest.BaseSnapshot.Name, jobInfo.OutputFile, jobInfo.OutputFile)
+	helpers.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+	return nil
+}
+
+// checkOutputFile will make sure the provided path does not exist yet and there is enough free disk space
+// to write a send stream of the provided size to it. Streams of an unknown size, e.g. from legacy backups,
+// are not checked against the free disk space.
+func checkOutputFile(path string, size uint64) error {
+	if _, err := os.Stat(path); err == nil {
+		helpers.AppLogger.Errorf("Will not overwrite the existing file %s with the send stream.", path)
+		return fmt.Errorf("the file %s already exists", path)
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(path), &stat); err != nil {
+		helpers.AppLogger.Warningf("Could not check the free disk space available to write %s, continuing anyway - %v", path, err)
+		return nil
+	}
+
+	if available := uint64(stat.Bavail) * uint64(stat.Bsize); available < size {
+		helpers.AppLogger.Errorf("The send stream requires %s but only %s are available to write %s.", humanize.IBytes(size), humanize.IBytes(available), path)
+		return ErrInsufficientSpace
+	}
+
+	return nil
+}
+
+// writeStreamFile will extract the ordered volumes received on the provided channel to the provided path.
+// The stream is written to a temporary file next to it, only renamed once complete and verified, so an
+// incomplete stream is never left behind at the provided path.
+func writeStreamFile(ctx context.Context, path string, j *helpers.JobInfo, c <-chan *helpers.VolumeInfo, buffer <-chan interface{}) (err error) {
+	partial := path + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not create %s to write the send stream to - %v", partial, err)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(partial)
+		}
+	}()
+
+	helpers.AppLogger.Infof("Writing the send stream of %s@%s to %s.", j.VolumeName, j.BaseSnapshot.Name, path)
+	digest := newDigestWriter(f, 0)
+	if err = copyVolumes(ctx, j, c, buffer, digest); err != nil {
+		if isNoSpace(err) {
+			helpers.AppLogger.Errorf("Ran out of disk space while writing the send stream to %s.", path)
+			return ErrInsufficientSpace
+		}
+		return err
+	}
+
+	if j.StreamSHA256 == "" {
+		helpers.AppLogger.Warningf("The backup set %s@%s does not record a digest of its send stream, only its volumes were verified.", j.VolumeName, j.BaseSnapshot.Name)
+	} else if err = digest.Verify(j.StreamSHA256); err != nil {
+		helpers.AppLogger.Errorf("The reassembled send stream of %s@%s failed verification - %v", j.VolumeName, j.BaseSnapshot.Name, err)
+		return &helpers.OperationError{Op: "restore", Dataset: j.VolumeName, Kind: helpers.ErrChecksumMismatch, Err: err}
+	}
+
+	if err = f.Sync(); err != nil {
+		if isNoSpace(err) {
+			return ErrInsufficientSpace
+		}
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(partial, path)
+}
+
+// writeStreamRange will write OutputLength bytes of the send stream of the provided backup set, starting at
+// OutputOffset, to the OutputFile. Only the blocks of the volumes the range spans are downloaded and decompressed,
+// see ReadVolumeRange, so the volumes and stream cannot be verified against their checksums. The range is cut
+// short if the stream ends before it.
+func writeStreamRange(ctx context.Context, jobInfo *helpers.JobInfo, manifest *helpers.JobInfo, backend backends.Backend) (err error) {
+	path := jobInfo.OutputFile
+	if err = checkOutputFile(path, uint64(jobInfo.OutputLength)); err != nil {
+		return err
+	}
+
+	partial := path + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not create %s to write the send stream to - %v", partial, err)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(partial)
+		}
+	}()
+
+	helpers.AppLogger.Infof("Writing %d bytes of the send stream of %s@%s starting at offset %d to %s.", jobInfo.OutputLength, manifest.VolumeName, manifest.BaseSnapshot.Name, jobInfo.OutputOffset, path)
+	offset, remaining := jobInfo.OutputOffset, jobInfo.OutputLength
+	for _, vol := range manifest.Volumes {
+		if remaining == 0 {
+			break
+		}
+		if vol.ZFSStreamBytes == 0 {
+			helpers.AppLogger.Errorf("The backup set %s@%s does not record the size of the send stream in volume %s, it cannot be read by range.", manifest.VolumeName, manifest.BaseSnapshot.Name, vol.ObjectName)
+			return fmt.Errorf("no stream size recorded for volume %s", vol.ObjectName)
+		}
+		// Volumes before the range are skipped without downloading them
+		if size := int64(vol.ZFSStreamBytes); offset >= size {
+			offset -= size
+			continue
+		}
+
+		data, rerr := ReadVolumeRange(ctx, backend, manifest, vol, offset, remaining)
+		if rerr != nil && rerr != io.EOF {
+			helpers.AppLogger.Errorf("Could not read the range of the send stream from volume %s - %v", vol.ObjectName, rerr)
+			return rerr
+		}
+		if _, err = f.Write(data); err != nil {
+			if isNoSpace(err) {
+				return ErrInsufficientSpace
+			}
+			return err
+		}
+		offset = 0
+		remaining -= int64(len(data))
+	}
+
+	if remaining == jobInfo.OutputLength {
+		helpers.AppLogger.Errorf("The send stream of %s@%s ends before offset %d.", manifest.VolumeName, manifest.BaseSnapshot.Name, jobInfo.OutputOffset)
+		return fmt.Errorf("offset %d is past the end of the send stream", jobInfo.OutputOffset)
+	} else if remaining > 0 {
+		helpers.AppLogger.Warningf("The send stream of %s@%s ends %d bytes before the end of the range requested.", manifest.VolumeName, manifest.BaseSnapshot.Name, remaining)
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// isNoSpace will return true if the provided error was caused by the disk being full.
+func isNoSpace(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	return err == syscall.ENOSPC
+}
@@ -0,0 +1,134 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// resumeRestoreState will read the state of the auto restore of jobInfo from its restore state file, starting a new
+// one if there is none, before the provided backup sets are restored, oldest first. The state must describe a restore
+// through the provided chain of snapshots, see RestoreState.Validate, and match what the target holds, see resumeRestore.
+func resumeRestoreState(ctx context.Context, jobInfo *helpers.JobInfo, jobs []*helpers.JobInfo, chain []helpers.SnapshotInfo) error {
+	target := jobInfo.ReceiveTarget()
+	state, err := helpers.ReadRestoreState(jobInfo.RestoreStateFile)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the restore state %s due to error - %v", jobInfo.RestoreStateFile, err)
+		return err
+	}
+	if state != nil {
+		if err = state.Validate(jobInfo.VolumeName, target, jobInfo.BaseSnapshot.Name, chain); err != nil {
+			helpers.AppLogger.Errorf("Cannot resume the restore from %s, delete it to restore from the start - %v", jobInfo.RestoreStateFile, err)
+			return err
+		}
+	}
+
+	token, err := helpers.GetReceiveResumeToken(ctx, target)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not check %s for a partially received stream due to error - %v", target, err)
+		return err
+	}
+
+	abort, err := resumeRestore(state, jobs, token)
+	if err != nil {
+		helpers.AppLogger.Errorf("Cannot resume the restore into %s from %s - %v", target, jobInfo.RestoreStateFile, err)
+		return err
+	}
+
+	if state == nil {
+		state = helpers.NewRestoreState(jobInfo.RestoreStateFile, jobInfo.VolumeName, target, jobInfo.BaseSnapshot.Name)
+	} else {
+		helpers.AppLogger.Noticef("Resuming the restore of %s@%s, %d snapshots were received already.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, len(state.Completed))
+		if state.InProgress != nil && len(jobs) > 0 && state.InProgress.Equal(&jobs[0].BaseSnapshot) {
+			helpers.AppLogger.Noticef("%d volumes (%s) of %s were received before the restore stopped, receiving it again from its first volume. The volumes already downloaded are read from the local cache.", state.Volumes, humanize.IBytes(state.Bytes), state.InProgress.Name)
+		}
+	}
+	if abort {
+		// A stored stream cannot continue from a resume token, the partially received state only blocks receiving it again
+		helpers.AppLogger.Noticef("Discarding the partially received state of %s left by the interrupted restore.", target)
+		if err = helpers.AbortPartialReceive(ctx, target); err != nil {
+			helpers.AppLogger.Errorf("Could not discard the partially received state of %s due to error - %v", target, err)
+			return err
+		}
+	}
+
+	jobInfo.RestoreState = state
+	return nil
+}
+
+// resumeRestore will decide whether the restore of the provided backup sets, oldest first, can resume given its state,
+// nil if it was not started before, and the receive_resume_token of its target, and whether the partially received
+// state of the target must be discarded first. The backup sets are those whose snapshot the target does not hold, so
+// one the state records as received means the target was changed since, e.g. rolled back. Only partially received
+// state the restore state shows the restore was receiving is discarded, never state left by anything else.
+func resumeRestore(state *helpers.RestoreState, jobs []*helpers.JobInfo, resumeToken string) (bool, error) {
+	if state != nil {
+		for _, job := range jobs {
+			if state.IsCompleted(&job.BaseSnapshot) {
+				return false, fmt.Errorf("%w: the snapshot %s it records as received is missing from the target", helpers.ErrRestoreStateMismatch, job.BaseSnapshot.Name)
+			}
+		}
+	}
+	if resumeToken == "" {
+		return false, nil
+	}
+	if state == nil || state.InProgress == nil || len(jobs) == 0 || !state.InProgress.Equal(&jobs[0].BaseSnapshot) {
+		return false, errors.New("the target holds a partially received stream this restore did not leave, discard it with zfs receive -A to restore into it")
+	}
+	return true, nil
+}
+
+// restoreSnapshotChain will return the snapshots of the provided backup set and of those it increments from, oldest first.
+func restoreSnapshotChain(job *helpers.JobInfo) []helpers.SnapshotInfo {
+	var chain []helpers.SnapshotInfo
+	for ; job != nil; job = job.ParentSnap {
+		chain = append([]helpers.SnapshotInfo{job.BaseSnapshot}, chain...)
+		if job.IncrementalSnapshot.Name == "" {
+			break
+		}
+	}
+	return chain
+}
+
+// completeRestoreState will record the backup set described by the provided manifest as received in its restore state
+// and delete its volumes, kept in the provided directory of the local cache until then to receive it again had the
+// restore stopped.
+func completeRestoreState(manifest *helpers.JobInfo, partialDir string) error {
+	if err := manifest.RestoreState.Complete(); err != nil {
+		helpers.AppLogger.Errorf("Could not save the restore state due to error - %v", err)
+		return err
+	}
+
+	for _, vol := range manifest.Volumes {
+		if err := os.Remove(partialVolumePath(partialDir, vol.ObjectName)); err != nil && !os.IsNotExist(err) {
+			helpers.AppLogger.Warningf("Could not delete the downloaded volume %s from the local cache - %v", vol.ObjectName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+// resumeDir will return the directory in the local cache the volumes restored from the provided destination are
+// downloaded to when the restore is resumable, creating it if needed.
+func resumeDir(destination string) (string, error) {
+	cacheDir, err := getCacheDir(destination)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(cacheDir, "partial")
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("could not create partial download directory %s due to an error: %v", dir, err)
+	}
+
+	return dir, nil
+}
+
+// partialVolumePath returns the path in the provided directory the object is downloaded to. Object names may contain
+// separators and characters not allowed in file names so they are hashed instead.
+func partialVolumePath(dir, objectName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%x", md5.Sum([]byte(objectName))))
+}
+
+// downloadRemainder will return the part of the object starting at offset, downloading only that range when the
+// backend supports ranged downloads, or downloading the whole object and skipping the first offset bytes otherwise.
+func downloadRemainder(ctx context.Context, backend backends.Backend, objectName string, offset, size int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return backend.Download(ctx, objectName)
+	}
+
+	if rangeBackend, ok := backend.(backends.RangeDownloader); ok {
+		return rangeBackend.DownloadRange(ctx, objectName, offset, size-offset)
+	}
+
+	helpers.AppLogger.Debugf("The backend does not support ranged downloads, downloading %s again and skipping the first %d bytes.", objectName, offset)
+	r, err := backend.Download(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// resumeSequence will download the volume of the provided sequence to the provided directory like processSequence,
+// except that what was downloaded is kept when the download fails. The number of bytes already downloaded is tracked
+// by the size of the partial file, so a retry, or a restore run again after failing, only downloads the remainder of
+// the volume, and a volume already downloaded but not received yet is not downloaded again. Since a zfs receive cannot
+// resume from the middle of a stream it did not send, the volumes are still received from the first one on.
+func resumeSequence(ctx context.Context, sequence downloadSequence, backend backends.Backend, dir, hashAlgorithm string) error {
+	path := partialVolumePath(dir, sequence.volume.ObjectName)
+	vol, offset, err := helpers.ResumeSimpleVolume(ctx, path, hashAlgorithm)
+	if err != nil {
+		helpers.AppLogger.Noticef("Could not open the file to download %s to due to error - %v.", sequence.volume.ObjectName, err)
+		return err
+	}
+
+	vol.ObjectName = sequence.volume.ObjectName
+	vol.Compressor = sequence.volume.Compressor
+
+	size := int64(sequence.volume.Size)
+	switch {
+	case offset > size:
+		helpers.AppLogger.Infof("The partial download of %s is larger than the volume, downloading it again.", sequence.volume.ObjectName)
+		vol.Close()
+		vol.DeleteVolume()
+		return fmt.Errorf("partial download of %s holds %d bytes, more than the %d bytes of the volume", sequence.volume.ObjectName, offset, size)
+	case offset == size:
+		helpers.AppLogger.Debugf("Reusing %s, it was already downloaded.", sequence.volume.ObjectName)
+	default:
+		if offset > 0 {
+			helpers.AppLogger.Infof("Resuming the download of %s from byte %d of %d.", sequence.volume.ObjectName, offset, size)
+		}
+		r, rerr := downloadRemainder(ctx, backend, sequence.volume.ObjectName, offset, size)
+		if rerr != nil {
+			helpers.AppLogger.Infof("Could not get %s due to error %v.", sequence.volume.ObjectName, rerr)
+			vol.Close()
+			return rerr
+		}
+		_, err = io.Copy(vol, helpers.BackupDownloadThrottle.Reader(r))
+		r.Close()
+		if err != nil {
+			// Keep what was downloaded so far to resume from
+			helpers.AppLogger.Noticef("Could not download file %s to the local cache dir due to error - %v.", sequence.volume.ObjectName, err)
+			vol.Close()
+			return err
+		}
+	}
+
+	if cerr := vol.Close(); cerr != nil {
+		helpers.AppLogger.Noticef("Could not close the file to download %s to due to error - %v.", sequence.volume.ObjectName, cerr)
+		return cerr
+	}
+
+	// Verify the Hash over the whole volume, if it doesn't match, ditch it and start over
+	got, expected := vol.Checksum(hashAlgorithm), sequence.volume.Checksum(hashAlgorithm)
+	if got != expected {
+		helpers.AppLogger.Infof("Hash mismatch for %s, got %s but expected %s. Retrying.", sequence.volume.ObjectName, got, expected)
+		vol.DeleteVolume()
+		return &helpers.OperationError{Op: "download", Volume: sequence.volume.ObjectName, Kind: helpers.ErrChecksumMismatch, Err: fmt.Errorf("got %s but expected %s", got, expected)}
+	}
+	helpers.AppLogger.Debugf("Downloaded %s.", sequence.volume.ObjectName)
+
+	sequence.c <- vol
+
+	return nil
+}
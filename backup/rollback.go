@@ -0,0 +1,157 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// restoreCheckpointPrefix names the snapshots taken of a receive target before restoring into it
+const restoreCheckpointPrefix = "zfsbackup-pre-restore-"
+
+// rollbackAction is what has to be done to return a receive target to its state before a failed restore.
+type rollbackAction int
+
+const (
+	// The target did not exist and was not created, there is nothing to undo
+	rollbackNothing rollbackAction = iota
+	// The target existed, roll it back to the snapshot taken before the restore
+	rollbackToCheckpoint
+	// The target was created by the restore, destroy it
+	rollbackDestroyTarget
+)
+
+// restoreCheckpoint records the state of a receive target before restoring into it.
+type restoreCheckpoint struct {
+	target   string
+	existed  bool
+	snapshot string
+	// Whether the snapshot was taken for the restore rather than already existing
+	created bool
+}
+
+// decide will return what has to be done to undo a failed restore, given whether the target exists afterwards.
+func (c *restoreCheckpoint) decide(existsNow bool) rollbackAction {
+	switch {
+	case c.existed:
+		return rollbackToCheckpoint
+	case existsNow:
+		return rollbackDestroyTarget
+	default:
+		return rollbackNothing
+	}
+}
+
+// checkpointRestore will note the most recent snapshot of the receive target of the provided job, if it exists, so a
+// failed restore can be rolled back to it. An incremental restore requires the snapshot it increments from to be the
+// most recent one, so a snapshot is only taken when the target has none.
+func checkpointRestore(ctx context.Context, j *helpers.JobInfo) (*restoreCheckpoint, error) {
+	c := &restoreCheckpoint{target: j.ReceiveTarget()}
+
+	var err error
+	if c.existed, err = helpers.DatasetExists(ctx, c.target); err != nil {
+		return nil, err
+	}
+	if !c.existed {
+		helpers.AppLogger.Infof("%s does not exist yet, it will be destroyed if the restore fails.", c.target)
+		return c, nil
+	}
+
+	snapshots, err := helpers.GetSnapshots(ctx, c.target)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		c.snapshot = snapshots[0].Name
+	} else {
+		c.snapshot = fmt.Sprintf("%s%d", restoreCheckpointPrefix, time.Now().UnixNano())
+		if _, err = helpers.CreateSnapshot(ctx, c.target, c.snapshot); err != nil {
+			return nil, err
+		}
+		c.created = true
+	}
+	helpers.AppLogger.Infof("%s will be rolled back to %s@%s if the restore fails.", c.target, c.target, c.snapshot)
+
+	return c, nil
+}
+
+// rollback will return the receive target to its state before the restore.
+func (c *restoreCheckpoint) rollback(ctx context.Context) error {
+	existsNow, err := helpers.DatasetExists(ctx, c.target)
+	if err != nil {
+		return err
+	}
+
+	switch c.decide(existsNow) {
+	case rollbackToCheckpoint:
+		snapshot := fmt.Sprintf("%s@%s", c.target, c.snapshot)
+		helpers.AppLogger.Noticef("Rolling %s back to %s.", c.target, snapshot)
+		if err = helpers.RollbackSnapshot(ctx, snapshot); err != nil {
+			return err
+		}
+		return c.release(ctx)
+	case rollbackDestroyTarget:
+		helpers.AppLogger.Noticef("Destroying %s as it was partially created by the restore.", c.target)
+		return helpers.DestroyDataset(ctx, c.target, true)
+	}
+
+	return nil
+}
+
+// release will remove the snapshot taken of the receive target for the restore, if any.
+func (c *restoreCheckpoint) release(ctx context.Context) error {
+	if !c.created {
+		return nil
+	}
+	return helpers.DestroyDataset(ctx, fmt.Sprintf("%s@%s", c.target, c.snapshot), false)
+}
+
+// withRollback will run the provided restore and, if the job asks for it, return the receive target to its state
+// before the restore if it fails, so no half-applied restore is left behind.
+func withRollback(ctx context.Context, j *helpers.JobInfo, restore func() error) error {
+	if !j.RollbackOnFailure {
+		return restore()
+	}
+
+	c, err := checkpointRestore(ctx, j)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not record the state of %s before restoring into it, aborting - %v", j.ReceiveTarget(), err)
+		return err
+	}
+
+	if err = restore(); err != nil {
+		// The restore may have failed because the context was cancelled, still undo it
+		if rerr := c.rollback(context.Background()); rerr != nil {
+			helpers.AppLogger.Errorf("Could not roll back %s after the restore failed, it may be left half-restored - %v", c.target, rerr)
+		}
+		return err
+	}
+
+	if rerr := c.release(ctx); rerr != nil {
+		helpers.AppLogger.Warningf("Could not remove the snapshot %s@%s taken before the restore - %v", c.target, c.snapshot, rerr)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// ErrAlreadyRunning is returned when another invocation is already backing up the same dataset to the same destinations.
+var ErrAlreadyRunning = errors.New("another backup of the same dataset to the same destinations is already running")
+
+// How often to check whether a run lock held by another invocation was released while waiting for it
+var runLockPollInterval = time.Second
+
+// runLock is an exclusive lock on a backup of a dataset to a set of destinations, held with flock(2) so
+// it is released by the kernel if the process holding it crashes.
+type runLock struct {
+	f *os.File
+}
+
+// runLockPath will return the path of the lock file for backups of the dataset to the destinations, regardless
+// of the order the destinations are provided in.
+func runLockPath(j *helpers.JobInfo) string {
+	destinations := append([]string(nil), j.Destinations...)
+	sort.Strings(destinations)
+	key := fmt.Sprintf("%s|%s", j.VolumeName, strings.Join(destinations, ","))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("zfsbackup.%x.lck", md5.Sum([]byte(key))))
+}
+
+// acquireRunLock will lock the file at the provided path. If another invocation holds the lock, ErrAlreadyRunning
+// is returned unless wait is true, in which case it waits until the lock is released or the context is done.
+// It reports whether it had to wait for the lock.
+func acquireRunLock(ctx context.Context, path string, wait bool) (*runLock, bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	waited := false
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, false, err
+		}
+		if !wait {
+			f.Close()
+			return nil, false, ErrAlreadyRunning
+		}
+
+		if !waited {
+			helpers.AppLogger.Noticef("Another backup of the same dataset to the same destinations is running, waiting for it to finish.")
+			waited = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, waited, ctx.Err()
+		case <-time.After(runLockPollInterval):
+		}
+	}
+
+	// Record who holds the lock for anyone investigating, the lock itself is the flock
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	if err != nil {
+		helpers.AppLogger.Warningf("Could not record the process holding the lock %s - %v", path, err)
+	}
+
+	return &runLock{f: f}, waited, nil
+}
+
+// release will unlock and close the lock file. The file is left in place as removing it could let another
+// invocation lock a new file while a third still waits on the removed one.
+func (l *runLock) release() error {
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
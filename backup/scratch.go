@@ -0,0 +1,103 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// ErrInsufficientScratch is returned when the scratch filesystem does not have the free space or inodes to buffer the volumes of a backup.
+var ErrInsufficientScratch = errors.New("not enough free space or inodes on the scratch filesystem to buffer the volumes of the backup")
+
+// estimateScratchUsage will return the number of bytes and inodes needed on the scratch filesystem to buffer
+// the volumes of a backup, up to MaxFileBuffer volumes of VolumeSize MiB along with the manifest. Nothing
+// is buffered when streaming straight to the destination.
+func estimateScratchUsage(j *helpers.JobInfo) (bytes, inodes uint64) {
+	if j.MaxFileBuffer == 0 || j.SingleObject {
+		return 0, 0
+	}
+
+	volumes := uint64(j.MaxFileBuffer)
+	return volumes * j.VolumeSize * humanize.MiByte, volumes + 1
+}
+
+// checkScratchUsage will compare the bytes and inodes needed on the scratch filesystem at the provided path
+// against what is available, warning or, with fail set, returning ErrInsufficientScratch when short of either.
+// Filesystems that do not report their inodes, reporting a total of 0, are only checked for free space.
+func checkScratchUsage(path string, bytes, inodes, availBytes, availInodes, totalInodes uint64, fail bool) error {
+	var short bool
+	if availBytes < bytes {
+		short = true
+		logScratch(fail, "Buffering the volumes of the backup requires up to %s on the scratch filesystem at %s but only %s are available. Consider lowering --maxFileBuffer or --volsize.", humanize.IBytes(bytes), path, humanize.IBytes(availBytes))
+	}
+	if totalInodes > 0 && availInodes < inodes {
+		short = true
+		logScratch(fail, "Buffering the volumes of the backup requires up to %d inodes on the scratch filesystem at %s but only %d are available.", inodes, path, availInodes)
+	}
+
+	if short && fail {
+		return ErrInsufficientScratch
+	}
+
+	return nil
+}
+
+func logScratch(fail bool, format string, args ...interface{}) {
+	if fail {
+		helpers.AppLogger.Errorf(format, args...)
+	} else {
+		helpers.AppLogger.Warningf(format, args...)
+	}
+}
+
+// checkScratchSpace will verify the scratch filesystem has the free space and inodes to buffer the volumes of
+// the backup before it starts, according to the ScratchCheck option of the provided JobInfo.
+func checkScratchSpace(j *helpers.JobInfo) error {
+	if j.ScratchCheck == "" || j.ScratchCheck == helpers.ScratchCheckOff {
+		return nil
+	}
+
+	bytes, inodes := estimateScratchUsage(j)
+	if bytes == 0 && inodes == 0 {
+		return nil
+	}
+
+	path := helpers.BackupTempdir
+	if path == "" {
+		path = os.TempDir()
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		helpers.AppLogger.Warningf("Could not check the free space and inodes available on the scratch filesystem at %s, continuing anyway - %v", path, err)
+		return nil
+	}
+
+	helpers.AppLogger.Debugf("Buffering the volumes of the backup requires up to %s and %d inodes on the scratch filesystem at %s.", humanize.IBytes(bytes), inodes, path)
+	return checkScratchUsage(path, bytes, inodes, uint64(stat.Bavail)*uint64(stat.Bsize), uint64(stat.Ffree), uint64(stat.Files), j.ScratchCheck == helpers.ScratchCheckFail)
+}
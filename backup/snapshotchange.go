@@ -0,0 +1,108 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// ErrSnapshotChanged is returned when a backup failed because its snapshot was destroyed or created again while it was being sent.
+var ErrSnapshotChanged = errors.New("the snapshot being backed up was destroyed or created again during the backup")
+
+// recordSnapshotGUIDs will record the GUIDs of the snapshots of the provided JobInfo so a snapshot destroyed and
+// created again under the same name can be detected. Snapshots whose GUID cannot be read are not checked.
+func recordSnapshotGUIDs(ctx context.Context, j *helpers.JobInfo) {
+	for _, snapshot := range []*helpers.SnapshotInfo{&j.BaseSnapshot, &j.IncrementalSnapshot} {
+		if snapshot.Name == "" {
+			continue
+		}
+		guid, err := helpers.GetZFSProperty(ctx, "guid", snapshotSource(j, snapshot))
+		if err != nil {
+			helpers.AppLogger.Debugf("Could not get the GUID of %s@%s, changes to it during the backup will not be detected - %v", j.VolumeName, snapshot.Name, err)
+			guid = ""
+		}
+		snapshot.GUID = guid
+	}
+}
+
+// snapshotChanged will check whether the provided snapshot of the dataset of the provided JobInfo was destroyed,
+// or created again, since its GUID was recorded.
+func snapshotChanged(ctx context.Context, j *helpers.JobInfo, snapshot *helpers.SnapshotInfo) bool {
+	if snapshot.Name == "" || snapshot.GUID == "" {
+		return false
+	}
+
+	guid, err := helpers.GetZFSProperty(ctx, "guid", snapshotSource(j, snapshot))
+	if err != nil {
+		return strings.Contains(err.Error(), "does not exist")
+	}
+	return guid != snapshot.GUID
+}
+
+// snapshotSource will return the full name of the provided snapshot of the provided JobInfo, the bookmark is
+// named in place of the snapshot the job increments from when its stream is sent from one.
+func snapshotSource(j *helpers.JobInfo, snapshot *helpers.SnapshotInfo) string {
+	if snapshot == &j.IncrementalSnapshot {
+		return j.IncrementalSource()
+	}
+	return j.VolumeName + "@" + snapshot.Name
+}
+
+// checkSnapshotsChanged will return ErrSnapshotChanged in place of the provided error of a failed backup if any
+// of its snapshots was destroyed or created again while it was being sent, as this is what made the send fail.
+func checkSnapshotsChanged(ctx context.Context, j *helpers.JobInfo, err error) error {
+	for _, snapshot := range []*helpers.SnapshotInfo{&j.BaseSnapshot, &j.IncrementalSnapshot} {
+		if snapshotChanged(ctx, j, snapshot) {
+			helpers.AppLogger.Errorf("The snapshot %s@%s was destroyed or created again during the backup, which failed with - %v", j.VolumeName, snapshot.Name, err)
+			return ErrSnapshotChanged
+		}
+	}
+	return err
+}
+
+// restartBackup will prepare the provided JobInfo, whose backup failed with ErrSnapshotChanged, to be backed up
+// again from scratch with the snapshot created again under the same name. A backup cannot be restarted when the
+// snapshot it increments from changed, or when its snapshot was destroyed and not created again.
+func restartBackup(ctx context.Context, j *helpers.JobInfo, destinations []string) bool {
+	if snapshotChanged(ctx, j, &j.IncrementalSnapshot) {
+		helpers.AppLogger.Errorf("Cannot restart the backup of %s, the snapshot %s it increments from changed.", j.VolumeName, j.IncrementalSnapshot.Name)
+		return false
+	}
+
+	creationTime, err := helpers.GetCreationDate(ctx, j.VolumeName+"@"+j.BaseSnapshot.Name)
+	if err != nil {
+		helpers.AppLogger.Errorf("Cannot restart the backup of %s, the snapshot %s was not created again - %v", j.VolumeName, j.BaseSnapshot.Name, err)
+		return false
+	}
+
+	helpers.AppLogger.Warningf("Restarting the backup of %s@%s from scratch with the snapshot created again.", j.VolumeName, j.BaseSnapshot.Name)
+	j.BaseSnapshot.CreationTime = creationTime
+	j.Destinations = destinations
+	j.Volumes = nil
+	j.Resume = false
+	j.StartAtVolume = 0
+	return true
+}
@@ -0,0 +1,76 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/dustin/go-humanize"
+)
+
+// The tail of the send stream held back until its digest was verified, comfortably larger than
+// the END record zfs receive needs to complete.
+const streamDigestHoldBack = 64 * humanize.KiByte
+
+// ErrStreamDigestMismatch is returned when the digest of the reassembled send stream does not
+// match the digest recorded when the backup was taken.
+var ErrStreamDigestMismatch = errors.New("the reassembled send stream does not match the digest recorded when the backup was taken")
+
+// digestWriter will hash everything written through it while holding back the tail of the
+// stream, so the receiving end does not see the end of the stream until its digest was verified.
+type digestWriter struct {
+	w        io.Writer
+	hash     hash.Hash
+	tail     []byte
+	holdBack int
+}
+
+func newDigestWriter(w io.Writer, holdBack int) *digestWriter {
+	return &digestWriter{w: w, hash: sha256.New(), tail: make([]byte, 0, 2*holdBack), holdBack: holdBack}
+}
+
+// Write will hash the provided bytes and pass on whatever is no longer part of the held back tail.
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.hash.Write(p)
+	d.tail = append(d.tail, p...)
+	if over := len(d.tail) - d.holdBack; over > 0 {
+		if _, err := d.w.Write(d.tail[:over]); err != nil {
+			return 0, err
+		}
+		d.tail = d.tail[:copy(d.tail, d.tail[over:])]
+	}
+	return len(p), nil
+}
+
+// Verify will compare the digest of the stream written so far against the expected one, only
+// passing on the held back tail of the stream if they match.
+func (d *digestWriter) Verify(expected string) error {
+	if sum := fmt.Sprintf("%x", d.hash.Sum(nil)); sum != expected {
+		return ErrStreamDigestMismatch
+	}
+	_, err := d.w.Write(d.tail)
+	d.tail = d.tail[:0]
+	return err
+}
@@ -27,7 +27,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/kietdlam/zfsbackup-go/backends"
 	"github.com/kietdlam/zfsbackup-go/helpers"
@@ -35,6 +37,9 @@ import (
 	//"../helpers"
 )
 
+// backendForURI returns the backend for a destination URI, it is replaced in tests to prepare mock backends.
+var backendForURI = backends.GetBackendForURI
+
 func prepareBackend(ctx context.Context, j *helpers.JobInfo, backendURI string, uploadBuffer chan bool) (backends.Backend, error) {
 	helpers.AppLogger.Debugf("Initializing Backend %s", backendURI)
 	conf := &backends.BackendConfig{
@@ -44,16 +49,44 @@ func prepareBackend(ctx context.Context, j *helpers.JobInfo, backendURI string,
 		MaxBackoffTime:          j.MaxBackoffTime,
 		MaxRetryTime:            j.MaxRetryTime,
 		UploadChunkSize:         j.UploadChunkSize * 1024 * 1024,
+		UploadPartRetries:       j.UploadPartRetries,
+		DNSCacheTTL:             j.DNSCacheTTL,
+		MaxConnsPerHost:         j.MaxConnsPerHost,
+		IPFamily:                j.IPFamily,
+		MaxParallelRestores:     j.MaxParallelRestores,
+		RestoreRequestRate:      j.RestoreRequestRate,
+		ImmutabilityPeriod:      j.ImmutabilityPeriod,
+		ImmutabilityLocked:      j.ImmutabilityLocked,
+		LegalHold:               j.LegalHold,
+		ConditionalUpload:       j.ConditionalUpload,
+		InitRetryTime:           j.InitRetryTime,
+		VerifyUploads:           j.VerifyUploads == helpers.VerifyUploadsETag,
+		ClockSkewCheck:          j.ClockSkewCheck,
+		MaxClockSkew:            j.MaxClockSkew,
+		StorageClass:            j.StorageClass,
+		S3SSE:                   j.ServerSideEncryption,
+		S3KMSKeyID:              j.KMSKeyID,
+		RequestTimeout:          j.RequestTimeout,
+	}
+	if j.ExpiresAt != nil {
+		conf.ExpiresAt = *j.ExpiresAt
+		conf.ExpiryTagging = backends.S3ExpiryTagging(*j.ExpiresAt, j.StartTime)
 	}
 
-	backend, err := backends.GetBackendForURI(backendURI)
+	backend, err := backendForURI(backendURI)
 	if err != nil {
 		return nil, err
 	}
 
-	err = backend.Init(ctx, conf)
+	if err = backend.Init(ctx, conf); err != nil {
+		kind := helpers.ErrBackendUnreachable
+		if backends.IsAuthError(err) {
+			kind = helpers.ErrAuthFailed
+		}
+		return backend, &helpers.OperationError{Op: "initialize " + backendURI, Dataset: j.VolumeName, Kind: kind, Err: err}
+	}
 
-	return backend, err
+	return backend, nil
 }
 
 func getCacheDir(backendURI string) (string, error) {
@@ -75,10 +108,23 @@ func syncCache(ctx context.Context, j *helpers.JobInfo, localCache string, backe
 		return nil, nil, fmt.Errorf("could not list manifest files from the backed due to error - %v", merr)
 	}
 
+	// Add the manifests only found as copies under the mirror prefixes, downloading the copy in their place
+	sources, merr := listManifestMirrors(ctx, j, backend, manifests)
+	if merr != nil {
+		return nil, nil, fmt.Errorf("could not list manifest copies from the backed due to error - %v", merr)
+	}
+	for manifest := range sources {
+		manifests = append(manifests, manifest)
+	}
+
 	// Make it safe for local file system storage
 	safeManifests := make([]string, len(manifests))
+	parts := make(map[string]bool)
 	for idx := range manifests {
 		safeManifests[idx] = fmt.Sprintf("%x", md5.Sum([]byte(manifests[idx])))
+		if helpers.IsManifestPart(manifests[idx]) {
+			parts[safeManifests[idx]] = true
+		}
 	}
 
 	// Check what manifests we have locally, and if we are missing any, download them
@@ -108,6 +154,12 @@ func syncCache(ctx context.Context, j *helpers.JobInfo, localCache string, backe
 		}
 	}
 
+	for idx, manifest := range manifests {
+		if source, ok := sources[manifest]; ok {
+			manifests[idx] = source
+		}
+	}
+
 	pderr := backend.PreDownload(ctx, manifests)
 	if pderr != nil {
 		return nil, nil, fmt.Errorf("could not prepare manifests for download due to error - %v", pderr)
@@ -124,7 +176,125 @@ func syncCache(ctx context.Context, j *helpers.JobInfo, localCache string, backe
 
 	safeManifests = append(safeManifests, foundFiles...)
 
-	return safeManifests, localOnlyFiles, nil
+	// The parts of split manifests are synced with the manifests but are read as part of their manifest
+	manifestsOnly := safeManifests[:0]
+	for _, safeManifest := range safeManifests {
+		if !parts[safeManifest] {
+			manifestsOnly = append(manifestsOnly, safeManifest)
+		}
+	}
+
+	return manifestsOnly, localOnlyFiles, nil
+}
+
+// syncSelectedCache is like syncCache but will only download the manifests selected by the list
+// options in the provided JobInfo, ordered by when they were last modified in the backend. The
+// details of manifests that were not selected are returned without downloading or parsing them.
+// If the backend cannot report object details, all manifests are synced instead.
+func syncSelectedCache(ctx context.Context, j *helpers.JobInfo, localCache string, backend backends.Backend) ([]string, []backends.ObjectInfo, error) {
+	lister, ok := backend.(backends.DetailedLister)
+	if !ok {
+		helpers.AppLogger.Warningf("The backend does not support listing object details, all manifests will be synced.")
+		safeManifests, _, err := syncCache(ctx, j, localCache, backend)
+		return safeManifests, nil, err
+	}
+
+	objects, lerr := lister.ListDetailed(ctx, j.ManifestPrefix)
+	if lerr != nil {
+		return nil, nil, fmt.Errorf("could not list manifest files from the backed due to error - %v", lerr)
+	}
+
+	// Add the manifests only found as copies under the mirror prefixes, downloading the copy in their place
+	sources, merr := listSelectedManifestMirrors(ctx, j, lister, objects)
+	if merr != nil {
+		return nil, nil, fmt.Errorf("could not list manifest copies from the backed due to error - %v", merr)
+	}
+	for manifest, source := range sources {
+		source.Name = manifest
+		objects = append(objects, source)
+	}
+
+	// The parts of split manifests are downloaded along with the selected manifests they belong to
+	manifests := objects[:0:0]
+	var parts []string
+	for _, obj := range objects {
+		if helpers.IsManifestPart(obj.Name) {
+			parts = append(parts, obj.Name)
+		} else {
+			manifests = append(manifests, obj)
+		}
+	}
+
+	selected, skipped := selectManifests(manifests, j.ListLimit, j.ListNewerThan, time.Now())
+
+	// Only download what we don't already have locally
+	safeManifests := make([]string, len(selected))
+	var toDownload []string
+	var toDownloadSafe []string
+	for idx := range selected {
+		safeManifests[idx] = fmt.Sprintf("%x", md5.Sum([]byte(selected[idx].Name)))
+		names := []string{selected[idx].Name}
+		for _, part := range parts {
+			if strings.HasPrefix(part, selected[idx].Name+".part") {
+				names = append(names, part)
+			}
+		}
+		for _, name := range names {
+			safeName := fmt.Sprintf("%x", md5.Sum([]byte(name)))
+			if _, serr := os.Stat(filepath.Join(localCache, safeName)); serr == nil {
+				continue
+			}
+			if source, ok := sources[name]; ok {
+				name = source.Name
+			}
+			toDownload = append(toDownload, name)
+			toDownloadSafe = append(toDownloadSafe, safeName)
+		}
+	}
+
+	pderr := backend.PreDownload(ctx, toDownload)
+	if pderr != nil {
+		return nil, nil, fmt.Errorf("could not prepare manifests for download due to error - %v", pderr)
+	}
+
+	if len(toDownload) > 0 {
+		helpers.AppLogger.Debugf("Syncing %d of %d manifests to local cache.", len(toDownload), len(manifests))
+
+		for idx, manifest := range toDownload {
+			if derr := downloadTo(ctx, backend, manifest, filepath.Join(localCache, toDownloadSafe[idx])); derr != nil {
+				return nil, nil, derr
+			}
+		}
+	}
+
+	return safeManifests, skipped, nil
+}
+
+// selectManifests will order the provided objects from newest to oldest and split them into those
+// that are within the provided limit and age, and those that are not. A limit or age of 0 is ignored.
+func selectManifests(objects []backends.ObjectInfo, limit int, newerThan time.Duration, now time.Time) ([]backends.ObjectInfo, []backends.ObjectInfo) {
+	sorted := make([]backends.ObjectInfo, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastModified.After(sorted[j].LastModified)
+	})
+
+	var selected, skipped []backends.ObjectInfo
+	for _, obj := range sorted {
+		if limit > 0 && len(selected) >= limit {
+			skipped = append(skipped, obj)
+			continue
+		}
+
+		if newerThan > 0 && obj.LastModified.Before(now.Add(-newerThan)) {
+			skipped = append(skipped, obj)
+			continue
+		}
+
+		selected = append(selected, obj)
+	}
+
+	return selected, skipped
 }
 
 func validateSnapShotExists(ctx context.Context, snapshot *helpers.SnapshotInfo, target string) (bool, error) {
@@ -0,0 +1,639 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../helpers"
+)
+
+var (
+	errSignatureVerificationFailed = errors.New("one or more objects of the backup set failed signature verification")
+	errIntegrityVerificationFailed = errors.New("the backup set failed integrity verification")
+	errVerificationFailed          = errors.New("one or more volumes of the backup set failed verification")
+)
+
+// SignatureResult is the outcome of verifying the signature of a single object of a backup set.
+type SignatureResult struct {
+	Object      string
+	SignerKeyID string `json:",omitempty"`
+	Valid       bool
+	Error       string `json:",omitempty"`
+}
+
+// VerifySignatures will download the manifest and every volume of the backup set described by the
+// provided JobInfo, verify each was signed by the JobInfo's SignKey while discarding their decrypted
+// contents, and output the signer and outcome for each. An error is returned if any of them failed verification.
+func VerifySignatures(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	if jobInfo.SignKey == nil || jobInfo.EncryptKey == nil {
+		helpers.AppLogger.Errorf("The key the backup set was encrypted to and a key to verify its signatures with are required.")
+		return errors.New("no keys provided to decrypt the backup set and verify its signatures with")
+	}
+
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	// Verify the manifest as found in the target destination, not as cached locally
+	manifestName, err := manifestObjectName(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+	results := verifyObjectSignatures(ctx, backend, []string{manifestName}, jobInfo)
+	if !results[0].Valid {
+		helpers.AppLogger.Errorf("The manifest for %s@%s failed signature verification, will not trust the volumes it lists.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		if rerr := reportSignatures(jobInfo, results); rerr != nil {
+			return rerr
+		}
+		return errSignatureVerificationFailed
+	}
+
+	manifestPath, err := syncManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not retrieve the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	manifest, err := readManifest(ctx, manifestPath, jobInfo)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	volumes := manifest.AllVolumes()
+	toVerify := make([]string, len(volumes))
+	for idx := range volumes {
+		toVerify[idx] = volumes[idx].ObjectName
+	}
+	results = append(results, verifyObjectSignatures(ctx, backend, toVerify, jobInfo)...)
+	if err = reportSignatures(jobInfo, results); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if !result.Valid {
+			failed++
+		}
+	}
+	if failed > 0 {
+		helpers.AppLogger.Errorf("%d of %d objects of the backup set %s@%s failed signature verification.", failed, len(results), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		return errSignatureVerificationFailed
+	}
+
+	helpers.AppLogger.Noticef("All %d objects of the backup set %s@%s are signed by the expected key.", len(results), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+	return nil
+}
+
+// verifyObjectSignatures will restore the provided objects, if required, and then download and verify
+// the signature of each of them in order.
+func verifyObjectSignatures(ctx context.Context, backend backends.Backend, toDownload []string, jobInfo *helpers.JobInfo) []SignatureResult {
+	results := make([]SignatureResult, 0, len(toDownload))
+	if err := backend.PreDownload(ctx, toDownload); err != nil {
+		helpers.AppLogger.Errorf("Error trying to pre download backup set objects - %v", err)
+		for _, name := range toDownload {
+			results = append(results, SignatureResult{Object: name, Error: err.Error()})
+		}
+		return results
+	}
+
+	for _, name := range toDownload {
+		helpers.AppLogger.Debugf("Verifying the signature of object %s.", name)
+		r, err := backend.Download(ctx, name)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not download object %s due to error - %v", name, err)
+			results = append(results, SignatureResult{Object: name, Error: err.Error()})
+			continue
+		}
+		results = append(results, verifySignature(name, r, jobInfo.SignKey, jobInfo.TrustedSigners))
+		r.Close()
+	}
+
+	return results
+}
+
+// verifySignature will verify the signature of the provided object was made by the provided key, which
+// must also be one of the trusted signers if any are provided.
+func verifySignature(name string, r io.Reader, key *openpgp.Entity, trustedSigners []string) SignatureResult {
+	result := SignatureResult{Object: name}
+	keyID, err := helpers.VerifySignature(r, trustedSigners)
+	if keyID != 0 {
+		result.SignerKeyID = fmt.Sprintf("%016X", keyID)
+	}
+	if err == nil && !helpers.EntityHasKeyID(key, keyID) {
+		err = fmt.Errorf("signed by key %s instead of the expected key %s", result.SignerKeyID, key.PrimaryKey.KeyIdString())
+	}
+	if err != nil {
+		helpers.AppLogger.Warningf("Object %s failed signature verification - %v", name, err)
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Valid = true
+	return result
+}
+
+// reportSignatures will output the provided results.
+func reportSignatures(jobInfo *helpers.JobInfo, results []SignatureResult) error {
+	if helpers.JSONOutput {
+		j, jerr := json.Marshal(results)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(helpers.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf("Signature verification of backup set %s@%s:\n", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)}
+	for _, result := range results {
+		status := "PASS"
+		if !result.Valid {
+			status = "FAIL"
+		}
+		line := fmt.Sprintf("%s\t%s\t%s", status, result.SignerKeyID, result.Object)
+		if result.Error != "" {
+			line = fmt.Sprintf("%s\t%s", line, result.Error)
+		}
+		output = append(output, line)
+	}
+	fmt.Fprintln(helpers.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
+
+// IntegrityResult is the outcome of verifying the merkle root of a backup set or the checksum of one of its volumes.
+type IntegrityResult struct {
+	Object string
+	Valid  bool
+	Error  string `json:",omitempty"`
+}
+
+// VerifyIntegrity will download the manifest of the backup set described by the provided JobInfo, recompute the
+// merkle root over the checksums of its volumes and compare it against the root stored in the manifest. Unless rootOnly
+// is set, every volume is then downloaded and its checksum compared against the one listed in the manifest, which
+// together with a matching root proves the integrity of the whole backup set. An error is returned if any check failed.
+func VerifyIntegrity(pctx context.Context, jobInfo *helpers.JobInfo, rootOnly bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	manifestPath, err := syncManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not retrieve the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	manifest, err := readManifest(ctx, manifestPath, jobInfo)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	rootResult := IntegrityResult{Object: fmt.Sprintf("merkle root %s", manifest.MerkleRoot), Valid: true}
+	if err = manifest.VerifyMerkleRoot(); err != nil {
+		helpers.AppLogger.Errorf("The merkle root of the backup set %s@%s could not be verified - %v", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		rootResult = IntegrityResult{Object: rootResult.Object, Error: err.Error()}
+	}
+	results := []IntegrityResult{rootResult}
+
+	// Each backup set is verified with the hash algorithm it recorded, whatever the current default
+	algorithms := make(map[*helpers.VolumeInfo]string)
+	results = append(results, checkHashAlgorithms(manifest, "", algorithms, jobInfo.StrictHashAlgorithm)...)
+
+	if !rootOnly {
+		results = append(results, verifyVolumeChecksums(ctx, backend, manifest.AllVolumes(), algorithms)...)
+	}
+	if err = reportIntegrity(jobInfo, results); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if !result.Valid {
+			failed++
+		}
+	}
+	if failed > 0 {
+		helpers.AppLogger.Errorf("%d of %d integrity checks of the backup set %s@%s failed.", failed, len(results), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		return errIntegrityVerificationFailed
+	}
+
+	helpers.AppLogger.Noticef("The backup set %s@%s passed all %d integrity checks.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, len(results))
+	return nil
+}
+
+// VerifyCiphertext will download the checksums uploaded alongside the backup set described by the provided JobInfo
+// with the checksums option, and then every volume listed in it, comparing the SHA256 checksum of each volume as it is
+// stored against the one listed. Unlike VerifyIntegrity, the manifest is not read and nothing is decrypted, so the
+// integrity of the stored objects can be verified without the keys of the backup set. An error is returned if any
+// check failed.
+func VerifyCiphertext(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	name := jobInfo.ChecksumsObjectName()
+	r, err := backend.Download(ctx, name)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not download the checksums %s of the backup set %s@%s, was it backed up with the checksums option? - %v", name, jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+	checksums, err := helpers.ParseChecksums(r)
+	r.Close()
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the checksums %s of the backup set %s@%s due to error - %v", name, jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	volumes := make([]*helpers.VolumeInfo, 0, len(checksums))
+	for _, checksum := range checksums {
+		volumes = append(volumes, &helpers.VolumeInfo{ObjectName: checksum.Object, SHA256Sum: checksum.SHA256Sum})
+	}
+	results := verifyVolumeChecksums(ctx, backend, volumes, nil)
+	if err = reportIntegrity(jobInfo, results); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if !result.Valid {
+			failed++
+		}
+	}
+	if failed > 0 {
+		helpers.AppLogger.Errorf("%d of %d objects of the backup set %s@%s do not match their checksums.", failed, len(results), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		return errIntegrityVerificationFailed
+	}
+
+	helpers.AppLogger.Noticef("All %d objects of the backup set %s@%s match their checksums.", len(results), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+	return nil
+}
+
+// checkHashAlgorithms will record the hash algorithm each volume of the provided backup set, and of its group members, was
+// verified with in algorithms. Members that do not record a hash algorithm inherit the one of their group. Each backup set
+// recording a deprecated hash algorithm is warned about, or reported as a failed check when strict is set.
+func checkHashAlgorithms(j *helpers.JobInfo, inherited string, algorithms map[*helpers.VolumeInfo]string, strict bool) []IntegrityResult {
+	var results []IntegrityResult
+	algorithm := j.HashAlgorithm
+	if algorithm == "" {
+		algorithm = inherited
+	}
+	for _, vol := range j.Volumes {
+		algorithms[vol] = algorithm
+	}
+
+	if helpers.IsDeprecatedHash(j.HashAlgorithm) {
+		object := fmt.Sprintf("hash algorithm %s of %s@%s", algorithm, j.VolumeName, j.BaseSnapshot.Name)
+		if strict {
+			helpers.AppLogger.Errorf("The backup set %s@%s was verified with the deprecated hash algorithm %s.", j.VolumeName, j.BaseSnapshot.Name, algorithm)
+			results = append(results, IntegrityResult{Object: object, Error: "deprecated hash algorithm"})
+		} else {
+			helpers.AppLogger.Warningf("The backup set %s@%s was verified with the deprecated hash algorithm %s.", j.VolumeName, j.BaseSnapshot.Name, algorithm)
+		}
+	}
+
+	for _, member := range j.GroupMembers {
+		results = append(results, checkHashAlgorithms(member, algorithm, algorithms, strict)...)
+	}
+
+	return results
+}
+
+// verifyVolumeChecksums will restore the provided volumes, if required, and then download each of them in order and
+// compare their checksum against the one listed in the manifest. Volumes are hashed with the algorithm recorded for them
+// in algorithms, volumes without one, or without a checksum computed with it, are verified with their SHA256 checksum.
+func verifyVolumeChecksums(ctx context.Context, backend backends.Backend, volumes []*helpers.VolumeInfo, algorithms map[*helpers.VolumeInfo]string) []IntegrityResult {
+	results := make([]IntegrityResult, 0, len(volumes))
+	toDownload := make([]string, len(volumes))
+	for idx := range volumes {
+		toDownload[idx] = volumes[idx].ObjectName
+	}
+	if err := backend.PreDownload(ctx, toDownload); err != nil {
+		helpers.AppLogger.Errorf("Error trying to pre download backup set volumes - %v", err)
+		for _, name := range toDownload {
+			results = append(results, IntegrityResult{Object: name, Error: err.Error()})
+		}
+		return results
+	}
+
+	for _, vol := range volumes {
+		helpers.AppLogger.Debugf("Verifying the checksum of volume %s.", vol.ObjectName)
+		result := IntegrityResult{Object: vol.ObjectName}
+		r, err := backend.Download(ctx, vol.ObjectName)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not download volume %s due to error - %v", vol.ObjectName, err)
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		algorithm := algorithms[vol]
+		expected := vol.Checksum(algorithm)
+		if algorithm == "" || expected == "" {
+			algorithm, expected = helpers.SHA256Hash, vol.SHA256Sum
+		}
+		factory, err := helpers.GetHash(algorithm)
+		if err != nil {
+			r.Close()
+			helpers.AppLogger.Errorf("Could not verify volume %s with the hash algorithm %s due to error - %v", vol.ObjectName, algorithm, err)
+			result.Error = fmt.Sprintf("%v: %s", err, algorithm)
+			results = append(results, result)
+			continue
+		}
+		hasher := factory()
+		_, err = io.Copy(hasher, r)
+		r.Close()
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not read volume %s due to error - %v", vol.ObjectName, err)
+			result.Error = err.Error()
+		} else if sum := fmt.Sprintf("%x", hasher.Sum(nil)); sum != expected {
+			helpers.AppLogger.Warningf("Volume %s has the %s checksum %s but the manifest lists %s.", vol.ObjectName, algorithm, sum, expected)
+			result.Error = fmt.Sprintf("%s checksum mismatch, got %s but expected %s", algorithm, sum, expected)
+		} else {
+			result.Valid = true
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// reportIntegrity will output the provided results.
+func reportIntegrity(jobInfo *helpers.JobInfo, results []IntegrityResult) error {
+	if helpers.JSONOutput {
+		j, jerr := json.Marshal(results)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(helpers.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf("Integrity verification of backup set %s@%s:\n", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)}
+	for _, result := range results {
+		status := "PASS"
+		if !result.Valid {
+			status = "FAIL"
+		}
+		line := fmt.Sprintf("%s\t%s", status, result.Object)
+		if result.Error != "" {
+			line = fmt.Sprintf("%s\t%s", line, result.Error)
+		}
+		output = append(output, line)
+	}
+	fmt.Fprintln(helpers.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
+
+// VerificationReport is the outcome of verifying every volume of a backup set could be restored.
+type VerificationReport struct {
+	Valid   bool
+	Results []IntegrityResult
+}
+
+// Verify will download the manifest and every volume of the backup set described by the provided JobInfo, compare the
+// checksum of each volume against the one listed in the manifest and then decrypt and decompress it, discarding its
+// contents, to prove the backup set can be restored without writing to any dataset. The outcome for each volume is
+// output along with the overall result. An error is returned if any volume failed verification.
+func Verify(pctx context.Context, jobInfo *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		helpers.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(target)
+	if cerr != nil {
+		helpers.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	manifestPath, err := syncManifest(ctx, jobInfo, backend, localCachePath)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not retrieve the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	manifest, err := readManifest(ctx, manifestPath, jobInfo)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the manifest for %s@%s due to error - %v.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, err)
+		return err
+	}
+
+	report := VerificationReport{Results: verifyBackupSet(ctx, backend, manifest, jobInfo)}
+	failed := 0
+	for _, result := range report.Results {
+		if !result.Valid {
+			failed++
+		}
+	}
+	report.Valid = failed == 0
+	if err = reportVerification(jobInfo, report); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		helpers.AppLogger.Errorf("%d of %d checks of the backup set %s@%s failed verification.", failed, len(report.Results), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		return errVerificationFailed
+	}
+
+	helpers.AppLogger.Noticef("The backup set %s@%s passed all %d verification checks.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, len(report.Results))
+	return nil
+}
+
+// verifyBackupSet will restore the volumes of the provided backup set, and of its group members, if required, and then
+// verify each of them in order with the keys provided in the JobInfo.
+func verifyBackupSet(ctx context.Context, backend backends.Backend, manifest *helpers.JobInfo, jobInfo *helpers.JobInfo) []IntegrityResult {
+	// Each volume is verified with the hash algorithm and extracted with the compressor of the backup set it belongs to
+	algorithms := make(map[*helpers.VolumeInfo]string)
+	results := checkHashAlgorithms(manifest, "", algorithms, jobInfo.StrictHashAlgorithm)
+	owners := make(map[*helpers.VolumeInfo]*helpers.JobInfo)
+	volumeOwners(manifest, jobInfo, owners)
+
+	volumes := manifest.AllVolumes()
+	toDownload := make([]string, len(volumes))
+	for idx := range volumes {
+		toDownload[idx] = volumes[idx].ObjectName
+	}
+	if err := backend.PreDownload(ctx, toDownload); err != nil {
+		helpers.AppLogger.Errorf("Error trying to pre download backup set volumes - %v", err)
+		for _, name := range toDownload {
+			results = append(results, IntegrityResult{Object: name, Error: err.Error()})
+		}
+		return results
+	}
+
+	for _, vol := range volumes {
+		results = append(results, verifyVolume(ctx, backend, vol, owners[vol], algorithms[vol]))
+	}
+
+	return results
+}
+
+// volumeOwners will record the backup set each volume of the provided backup set, and of its group members, belongs
+// to in owners, providing each with the keys of the JobInfo to extract its volumes with.
+func volumeOwners(j *helpers.JobInfo, jobInfo *helpers.JobInfo, owners map[*helpers.VolumeInfo]*helpers.JobInfo) {
+	j.SignKey = jobInfo.SignKey
+	j.EncryptKey = jobInfo.EncryptKey
+	j.TrustedSigners = jobInfo.TrustedSigners
+	j.DecompressCommand = jobInfo.DecompressCommand
+	for _, vol := range j.Volumes {
+		owners[vol] = j
+	}
+	for _, member := range j.GroupMembers {
+		volumeOwners(member, jobInfo, owners)
+	}
+}
+
+// verifyVolume will download the provided volume to the local cache dir, discarding it if its checksum does not match
+// the one listed in the manifest, and then read it through to the end, decrypting and decompressing it as a restore would.
+func verifyVolume(ctx context.Context, backend backends.Backend, vol *helpers.VolumeInfo, owner *helpers.JobInfo, algorithm string) IntegrityResult {
+	helpers.AppLogger.Debugf("Verifying volume %s.", vol.ObjectName)
+	result := IntegrityResult{Object: vol.ObjectName}
+
+	// Volumes without a checksum computed with their hash algorithm are verified with their SHA256 checksum
+	if vol.Checksum(algorithm) == "" {
+		algorithm = ""
+	}
+	c := make(chan *helpers.VolumeInfo, 1)
+	if err := processSequence(ctx, downloadSequence{volume: vol, c: c}, backend, false, algorithm); err != nil {
+		helpers.AppLogger.Warningf("Volume %s failed verification - %v", vol.ObjectName, err)
+		result.Error = err.Error()
+		return result
+	}
+	local := <-c
+	defer local.DeleteVolume()
+
+	err := local.Extract(ctx, owner, false)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, local)
+	}
+	if cerr := local.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		helpers.AppLogger.Warningf("Volume %s could not be extracted - %v", vol.ObjectName, err)
+		result.Error = fmt.Sprintf("could not extract volume - %v", err)
+		return result
+	}
+
+	result.Valid = true
+	return result
+}
+
+// reportVerification will output the provided report.
+func reportVerification(jobInfo *helpers.JobInfo, report VerificationReport) error {
+	if helpers.JSONOutput {
+		j, jerr := json.Marshal(report)
+		if jerr != nil {
+			helpers.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(helpers.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf("Verification of backup set %s@%s:\n", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)}
+	passed := 0
+	for _, result := range report.Results {
+		status := "PASS"
+		if !result.Valid {
+			status = "FAIL"
+		} else {
+			passed++
+		}
+		line := fmt.Sprintf("%s\t%s", status, result.Object)
+		if result.Error != "" {
+			line = fmt.Sprintf("%s\t%s", line, result.Error)
+		}
+		output = append(output, line)
+	}
+	overall := "PASS"
+	if !report.Valid {
+		overall = "FAIL"
+	}
+	output = append(output, fmt.Sprintf("\nOverall: %s (%d of %d checks passed)", overall, passed, len(report.Results)))
+	fmt.Fprintln(helpers.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
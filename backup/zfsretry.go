@@ -0,0 +1,81 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cenkalti/backoff"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// retryZFS will run the provided operation, running it again with backoff up to ZFSRetries times while it fails with
+// a transient zfs error, see helpers.IsTransientZFSError, and canRetry, if provided, allows it. These retries are
+// separate from those of the backends. Permanent errors, and errors once the context is done, are returned at once.
+func retryZFS(ctx context.Context, j *helpers.JobInfo, op string, operation func() error, canRetry func() bool) error {
+	if j.ZFSRetries <= 0 {
+		return operation()
+	}
+
+	patterns := j.ZFSRetryPatterns
+	if patterns == nil {
+		patterns = helpers.DefaultTransientZFSErrors
+	}
+
+	be := backoff.NewExponentialBackOff()
+	if j.MaxBackoffTime > 0 {
+		be.MaxInterval = j.MaxBackoffTime
+	}
+	be.MaxElapsedTime = 0
+	retryconf := backoff.WithContext(backoff.WithMaxRetries(be, uint64(j.ZFSRetries)), ctx)
+
+	return backoff.Retry(func() error {
+		err := operation()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !helpers.IsTransientZFSError(err, patterns) || (canRetry != nil && !canRetry()) {
+			return backoff.Permanent(err)
+		}
+		helpers.AppLogger.Warningf("The %s of %s failed with a transient error, retrying - %v", op, j.VolumeName, err)
+		return err
+	}, retryconf)
+}
+
+// runZFSSend will run the zfs send command of the provided job again, writing its stream to out.
+func runZFSSend(ctx context.Context, j *helpers.JobInfo, out io.Writer) error {
+	cmd := helpers.GetZFSSendCommand(ctx, j)
+	stderr := helpers.NewStderrCapture(os.Stderr)
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+
+	helpers.AppLogger.Infof("Starting zfs send command again: %s", strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		helpers.AppLogger.Errorf("Error starting zfs command - %v", err)
+		return zfsError("zfs send", j.VolumeName, err)
+	}
+	return zfsError("zfs send", j.VolumeName, stderr.Wrap(cmd.Wait()))
+}
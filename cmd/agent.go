@@ -0,0 +1,141 @@
+//go:build agent
+// +build agent
+
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kietdlam/zfsbackup-go/agent"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../agent"
+	//"../helpers"
+)
+
+var (
+	agentListen   string
+	agentTLSCert  string
+	agentTLSKey   string
+	agentClientCA string
+	agentInsecure bool
+)
+
+// agentCmd represents the agent command, it is only built with the agent build tag (go build -tags agent)
+var agentCmd = &cobra.Command{
+	Use:   "agent [flags]",
+	Short: "agent will serve a gRPC API for a central controller to start, watch, and cancel backups and restores on this host.",
+	Long: `agent will serve a gRPC API for a central controller to start, watch, and cancel backups and restores
+on this host, see agent/agent.proto. Each backup and restore uses the options provided to this command,
+with the datasets, snapshots, and destinations provided by the controller. Controllers must authenticate
+with a client certificate signed by the --clientCA.`,
+	PreRunE: validateAgentFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var tlsConfig *tls.Config
+		if !agentInsecure {
+			var err error
+			if tlsConfig, err = agent.ServerTLSConfig(agentTLSCert, agentTLSKey, agentClientCA); err != nil {
+				helpers.AppLogger.Errorf("Could not load the TLS certificates of the agent - %v", err)
+				return err
+			}
+		}
+
+		listener, err := net.Listen("tcp", agentListen)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not listen on %s - %v", agentListen, err)
+			return err
+		}
+
+		helpers.AppLogger.Noticef("Serving the agent API on %s.", listener.Addr())
+		return agent.NewServer(agent.NewService(&jobInfo), tlsConfig).Serve(listener)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(agentCmd)
+
+	agentCmd.Flags().StringVar(&agentListen, "listen", "localhost:7415", "the address to serve the agent API on.")
+	agentCmd.Flags().StringVar(&agentTLSCert, "tlsCert", "", "the path to the PEM encoded certificate of the agent.")
+	agentCmd.Flags().StringVar(&agentTLSKey, "tlsKey", "", "the path to the PEM encoded private key of the agent.")
+	agentCmd.Flags().StringVar(&agentClientCA, "clientCA", "", "the path to the PEM encoded CA certificates controllers must present a client certificate signed by.")
+	agentCmd.Flags().BoolVar(&agentInsecure, "insecure", false, "set this flag to serve the agent API without TLS or authenticating controllers. Only use this over a trusted transport.")
+
+	// Options of the backups and restores run by the agent
+	agentCmd.Flags().Uint64Var(&jobInfo.VolumeSize, "volsize", 200, "the maximum size (in MiB) a volume should be before splitting to a new volume.")
+	agentCmd.Flags().StringVar(&jobInfo.Compressor, "compressor", helpers.InternalCompressor, "specify to use the internal (parallel) gzip implementation or an external binary (e.g. gzip, bzip2, pigz, lzma, xz, etc.) Syntax must be similar to the gzip compression tool) to compress the stream for storage. Please take into consideration time, memory, and CPU usage for any of the compressors used.")
+	agentCmd.Flags().IntVar(&jobInfo.CompressionLevel, "compressionLevel", 6, "the compression level to use with the compressor. Valid values are between 1-9, or 1-22 for the zstd, zstd-seekable and adaptive compressors.")
+	agentCmd.Flags().IntVar(&jobInfo.MaxFileBuffer, "maxFileBuffer", 5, "the maximum number of files to have active during the upload process. Should be set to at least the number of max parallel uploads. Set to 0 to bypass local storage and upload straight to your destination - this will limit you to a single destination and disable any hash checks for the upload where available.")
+	agentCmd.Flags().IntVar(&jobInfo.MaxParallelUploads, "maxParallelUploads", 4, "the maximum number of uploads to run in parallel.")
+	agentCmd.Flags().DurationVar(&jobInfo.MaxRetryTime, "maxRetryTime", 12*time.Hour, "the maximum time that can elapse when retrying a failed upload or download. Use 0 for no limit.")
+	agentCmd.Flags().DurationVar(&jobInfo.MaxBackoffTime, "maxBackoffTime", 30*time.Minute, "the maximum delay you'd want a worker to sleep before retrying an upload or download.")
+	agentCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names.")
+	agentCmd.Flags().IntVar(&jobInfo.UploadChunkSize, "uploadChunkSize", 10, "the chunk size, in MiB, to use when uploading. A minimum of 5MiB and maximum of 100MiB is enforced.")
+}
+
+// ResetAgentJobInfo exists solely for integration testing
+func ResetAgentJobInfo() {
+	resetRootFlags()
+	agentListen = "localhost:7415"
+	agentTLSCert = ""
+	agentTLSKey = ""
+	agentClientCA = ""
+	agentInsecure = false
+	jobInfo.VolumeSize = 200
+	jobInfo.Compressor = helpers.InternalCompressor
+	jobInfo.CompressionLevel = 6
+	jobInfo.MaxFileBuffer = 5
+	jobInfo.MaxParallelUploads = 4
+	jobInfo.MaxRetryTime = 12 * time.Hour
+	jobInfo.MaxBackoffTime = 30 * time.Minute
+	jobInfo.Separator = "|"
+	jobInfo.UploadChunkSize = 10
+}
+
+func validateAgentFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+
+	if !agentInsecure && (agentTLSCert == "" || agentTLSKey == "" || agentClientCA == "") {
+		helpers.AppLogger.Errorf("The --tlsCert, --tlsKey, and --clientCA flags are required to authenticate controllers, or set the --insecure flag to serve the agent API without TLS.")
+		return errInvalidInput
+	}
+	if agentInsecure {
+		helpers.AppLogger.Warningf("Serving the agent API without TLS, anyone able to connect to %s can backup and restore datasets on this host.", agentListen)
+	}
+
+	// The options the agent does not expose keep their defaults
+	jobInfo.HashAlgorithm = helpers.SHA256Hash
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	jobInfo.FullIfOlderThan = -1 * time.Minute
+	if err := jobInfo.ValidateSendFlags(); err != nil {
+		helpers.AppLogger.Error(err)
+		return errInvalidInput
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../helpers"
+)
+
+// verifyAuditLogCmd represents the verify-audit-log command
+var verifyAuditLogCmd = &cobra.Command{
+	Use:   "verify-audit-log [flags] path",
+	Short: "verify-audit-log will verify the hash chain of an audit log written with the auditLog and auditHashChain options.",
+	Long:  `verify-audit-log will read every record of the provided audit log and check each record chained by the auditHashChain option matches its hash and follows the record before it, detecting records that were modified, inserted or deleted. Records deleted from the end of the audit log cannot be detected, nor can records written before hash chaining was enabled be verified.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			cmd.Usage()
+			return errInvalidInput
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not open the audit log %s due to error - %v", args[0], err)
+			return err
+		}
+		defer f.Close()
+
+		verified, err := helpers.VerifyAuditLog(f)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not verify the audit log %s - %v", args[0], err)
+			return err
+		}
+
+		fmt.Fprintf(helpers.Stdout, "Verified the hash chain of %d records of the audit log %s.\n", verified, args[0])
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyAuditLogCmd)
+}
@@ -22,20 +22,27 @@ package cmd
 
 import (
 	"context"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/kietdlam/zfsbackup-go/backup"
+	"github.com/kietdlam/zfsbackup-go/helpers"
 	//"../backup"
+	//"../helpers"
 )
 
 var cleanLocal bool
 
 // cleanCmd represents the clean command
 var cleanCmd = &cobra.Command{
-	Use:           "clean [flags] uri",
-	Short:         "Clean will delete any objects in the target that are not found in the manifest files found in the target.",
-	Long:          `Clean will delete any objects in the target that are not found in the manifest files found in the target.`,
+	Use:   "clean [flags] uri",
+	Short: "Clean will delete any objects in the target that are not found in the manifest files found in the target.",
+	Long: `Clean will delete any objects in the target that are not found in the manifest files found in the target.
+
+With --keepFullCount or --keepDuration, old backup sets are pruned first: their manifests are deleted along with any of
+their volumes no other backup set references. An incremental backup set is never left without the backup sets it
+depends on.`,
 	SilenceErrors: true,
 	PreRunE:       validateCleanFlags,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -49,6 +56,9 @@ func init() {
 
 	cleanCmd.Flags().BoolVarP(&cleanLocal, "cleanLocal", "", false, "Delete any files found in the local cache that shouldn't be there.")
 	cleanCmd.Flags().BoolVarP(&jobInfo.Force, "force", "", false, "This will force the deletion of broken backup sets (sets where volumes expected in the manifest file are not found). Use with caution.")
+	cleanCmd.Flags().DurationVar(&jobInfo.GracePeriod, "gracePeriod", 24*time.Hour, "only delete unreferenced objects last modified longer ago than this so the volumes of a backup still in progress are not deleted before its manifest is uploaded. Objects the backend does not report a modification time for are aged by the end time of the backup set they belong to, and kept if they belong to none. Use 0 to delete all unreferenced objects.")
+	cleanCmd.Flags().IntVar(&jobInfo.KeepFullCount, "keepFullCount", 0, "prune old backup sets, keeping the newest this many full backup sets of each dataset along with their incremental backup sets. Backup sets a kept incremental backup set depends on and the newest backup set of each dataset are never deleted.")
+	cleanCmd.Flags().DurationVar(&jobInfo.KeepDuration, "keepDuration", 0, "prune old backup sets, keeping those whose snapshot is newer than this (e.g. 720h) along with the backup sets they depend on. May be combined with --keepFullCount to keep the backup sets either retains.")
 }
 
 func validateCleanFlags(cmd *cobra.Command, args []string) error {
@@ -56,5 +66,13 @@ func validateCleanFlags(cmd *cobra.Command, args []string) error {
 		cmd.Usage()
 		return errInvalidInput
 	}
+	if jobInfo.GracePeriod < 0 {
+		helpers.AppLogger.Errorf("The grace period must not be negative.")
+		return errInvalidInput
+	}
+	if jobInfo.KeepFullCount < 0 || jobInfo.KeepDuration < 0 {
+		helpers.AppLogger.Errorf("The --keepFullCount and --keepDuration flags must not be negative.")
+		return errInvalidInput
+	}
 	return nil
 }
@@ -0,0 +1,87 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kietdlam/zfsbackup-go/backup"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backup"
+	//"../helpers"
+)
+
+var (
+	priceTablePath string
+	priceTable     *backup.PriceTable
+)
+
+// costCmd represents the cost command
+var costCmd = &cobra.Command{
+	Use:   "cost [flags] uri",
+	Short: "cost will estimate the monthly storage cost of the backup sets found at the provided target.",
+	Long: `cost will estimate the monthly storage cost of each backup set found at the provided target, and of all of them together,
+from the volume sizes recorded in their manifests, the storage class of each object (where reported by the backend) and the provided price table.
+The estimate is an approximation and does not include the manifests, request or retrieval fees, or minimum storage durations.
+
+The price table is a JSON file listing the monthly price per GiB of each storage class, e.g.:
+
+	{"Currency": "USD", "Default": 0.023, "StorageClasses": {"STANDARD": 0.023, "GLACIER": 0.004, "Cool": 0.01}}`,
+	PreRunE: validateCostFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.Destinations = []string{args[0]}
+		return backup.EstimateCost(context.Background(), &jobInfo, priceTable)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(costCmd)
+
+	costCmd.Flags().StringVar(&priceTablePath, "priceTable", "", "the path to a JSON file listing the monthly price per GiB of each storage class (required).")
+}
+
+func validateCostFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+
+	if priceTablePath == "" {
+		helpers.AppLogger.Errorf("A price table must be provided with the priceTable flag.")
+		return errInvalidInput
+	}
+
+	var err error
+	if priceTable, err = backup.LoadPriceTable(priceTablePath); err != nil {
+		helpers.AppLogger.Errorf("Could not load the price table due to error - %v", err)
+		return err
+	}
+	return nil
+}
+
+// ResetCostJobInfo exists solely for integration testing
+func ResetCostJobInfo() {
+	resetRootFlags()
+	priceTablePath = ""
+	priceTable = nil
+}
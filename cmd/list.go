@@ -74,6 +74,9 @@ func init() {
 	listCmd.Flags().StringVar(&startsWith, "volumeName", "", "Filter results to only this volume name, can end with a '*' to match as only a prefix")
 	listCmd.Flags().StringVar(&beforeStr, "before", "", "Filter results to only this backups before this specified date & time (format: yyyy-MM-ddTHH:mm:ss, parsed in local TZ)")
 	listCmd.Flags().StringVar(&afterStr, "after", "", "Filter results to only this backups after this specified date & time (format: yyyy-MM-ddTHH:mm:ss, parsed in local TZ)")
+	listCmd.Flags().IntVar(&jobInfo.ListLimit, "limit", 0, "Only download and read the N most recently modified manifests at the target, older manifests are summarized from the listing. 0 means no limit.")
+	listCmd.Flags().DurationVar(&jobInfo.ListNewerThan, "newerThan", 0, "Only download and read manifests modified at the target within this duration (e.g. 72h), older manifests are summarized from the listing. 0 means no limit.")
+	listCmd.Flags().StringVar(&jobInfo.ListFormat, "format", helpers.ListFormatList, "how to output the backup sets, either list, tree to show the incremental backup sets of each dataset indented below the backup set they depend on (as JSON with the jsonOutput option), or dot to output that dependency tree as a graph in the DOT language.")
 }
 
 func validateListFlags(cmd *cobra.Command, args []string) error {
@@ -82,6 +85,18 @@ func validateListFlags(cmd *cobra.Command, args []string) error {
 		return errInvalidInput
 	}
 
+	if jobInfo.ListLimit < 0 || jobInfo.ListNewerThan < 0 {
+		helpers.AppLogger.Errorf("The --limit and --newerThan options must not be negative.")
+		return errInvalidInput
+	}
+
+	switch jobInfo.ListFormat {
+	case helpers.ListFormatList, helpers.ListFormatTree, helpers.ListFormatDOT:
+	default:
+		helpers.AppLogger.Errorf("Invalid list format %s provided, expected one of %s, %s or %s.", jobInfo.ListFormat, helpers.ListFormatList, helpers.ListFormatTree, helpers.ListFormatDOT)
+		return errInvalidInput
+	}
+
 	if beforeStr != "" {
 		parsed, perr := time.ParseInLocation(time.RFC3339[:19], beforeStr, time.Local)
 		if perr != nil {
@@ -110,4 +125,5 @@ func ResetListJobInfo() {
 	afterStr = ""
 	before = time.Time{}
 	after = time.Time{}
+	jobInfo.ListFormat = helpers.ListFormatList
 }
@@ -0,0 +1,97 @@
+// Copyright © 2017 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kietdlam/zfsbackup-go/backup"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backup"
+	//"../helpers"
+)
+
+var includeKeyInfo bool
+
+// manifestCmd represents the manifest command
+var manifestCmd = &cobra.Command{
+	Use:     "manifest [flags] filesystem|volume@snapshot uri output_file",
+	Short:   "manifest will write the manifest of a backup set to a local file without restoring any data.",
+	Long:    `manifest will download, decrypt, and decompress the manifest of the backup set for the provided snapshot and write it to a local file in its JSON form without restoring any data.`,
+	PreRunE: validateManifestFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.ExtractManifest(context.Background(), &jobInfo, args[2], includeKeyInfo)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(manifestCmd)
+
+	manifestCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "Used to specify the snapshot the backup set was incremented from.")
+	manifestCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names (used only for the manifest we are looking for).")
+	manifestCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case used for dataset and snapshot names in object names, either preserve or lower (used only for the manifest we are looking for).")
+	manifestCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "the string used in place of the '/' between dataset names in object names (used only for the manifest we are looking for).")
+	manifestCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path or hash (used only for the manifest we are looking for).")
+	manifestCmd.Flags().BoolVar(&includeKeyInfo, "includeKeyInfo", false, "include the identities of the keys used to encrypt and sign the backup set, these are redacted by default.")
+}
+
+// ResetManifestJobInfo exists solely for integration testing
+func ResetManifestJobInfo() {
+	resetRootFlags()
+	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+	jobInfo.Separator = "|"
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	includeKeyInfo = false
+}
+
+func validateManifestFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 3 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) != 2 {
+		helpers.AppLogger.Errorf("Invalid snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
+	jobInfo.Destinations = []string{args[1]}
+
+	if jobInfo.IncrementalSnapshot.Name != "" {
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+	}
+
+	return nil
+}
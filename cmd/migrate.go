@@ -0,0 +1,110 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kietdlam/zfsbackup-go/backup"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backup"
+	//"../helpers"
+)
+
+var (
+	migrateFromPrefix string
+	migrateToPrefix   string
+	migrateMove       bool
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:     "migrate [flags] filesystem|volume@snapshot uri",
+	Short:   "migrate will copy, or move, a backup set from one prefix of the target to another without uploading it again.",
+	Long:    `migrate will copy every object of the backup set for the provided snapshot, and of its group members, from the fromPrefix to the toPrefix of the target with server-side copies, copying objects too large for a single request in parts. The volumes are copied first and verified against the checksums listed in the manifest, then the manifest is copied as is. The objects under the fromPrefix are deleted once the backup set is copied when the move option is provided. A migration that stopped, e.g. as it was interrupted, can be resumed by running it again, objects already copied are not copied again. Only the s3 and file targets, along with the mem target used for testing, support copying objects.`,
+	PreRunE: validateMigrateFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Migrate(context.Background(), &jobInfo, migrateFromPrefix, migrateToPrefix, migrateMove)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVar(&migrateFromPrefix, "fromPrefix", "", "the prefix of the target the backup set is stored under, e.g. backups/old/. Defaults to the root of the target.")
+	migrateCmd.Flags().StringVar(&migrateToPrefix, "toPrefix", "", "the prefix of the target to copy the backup set to, e.g. backups/new/. Defaults to the root of the target.")
+	migrateCmd.Flags().BoolVar(&migrateMove, "move", false, "set this flag to delete the objects of the backup set under the fromPrefix once it was copied and verified.")
+	migrateCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "Used to specify the snapshot the backup set was incremented from.")
+	migrateCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names (used only for the manifest we are looking for).")
+	migrateCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case used for dataset and snapshot names in object names, either preserve or lower (used only for the manifest we are looking for).")
+	migrateCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "the string used in place of the '/' between dataset names in object names (used only for the manifest we are looking for).")
+	migrateCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path or hash (used only for the manifest we are looking for).")
+}
+
+// ResetMigrateJobInfo exists solely for integration testing
+func ResetMigrateJobInfo() {
+	resetRootFlags()
+	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+	jobInfo.Separator = "|"
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	migrateFromPrefix = ""
+	migrateToPrefix = ""
+	migrateMove = false
+}
+
+func validateMigrateFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) != 2 {
+		helpers.AppLogger.Errorf("Invalid snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+		return errInvalidInput
+	}
+
+	if migrateFromPrefix == migrateToPrefix {
+		helpers.AppLogger.Errorf("The fromPrefix and toPrefix options must be different.")
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
+	jobInfo.Destinations = []string{args[1]}
+
+	if jobInfo.IncrementalSnapshot.Name != "" {
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+	}
+
+	return nil
+}
@@ -36,6 +36,11 @@ import (
 	//"../helpers"
 )
 
+var (
+	receiveGroup     bool
+	maxDownloadSpeed uint64
+)
+
 // receiveCmd represents the receive command
 var receiveCmd = &cobra.Command{
 	Use:     "receive [flags] filesystem|volume|snapshot-to-restore uri local_volume",
@@ -45,6 +50,18 @@ var receiveCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		helpers.AppLogger.Infof("Limiting the number of active files to %d", jobInfo.MaxFileBuffer)
 
+		if receiveGroup {
+			return backup.ReceiveGroup(context.Background(), &jobInfo)
+		}
+
+		if len(jobInfo.BatchSelectors) > 0 || jobInfo.BatchAll {
+			return backup.BatchRestore(context.Background(), &jobInfo)
+		}
+
+		if jobInfo.OutputFile != "" {
+			return backup.RestoreToFile(context.Background(), &jobInfo)
+		}
+
 		if jobInfo.AutoRestore {
 			return backup.AutoRestore(context.Background(), &jobInfo)
 		}
@@ -56,37 +73,161 @@ func init() {
 	RootCmd.AddCommand(receiveCmd)
 
 	// ZFS recv command options
+	receiveCmd.Flags().BoolVar(&jobInfo.RollbackOnFailure, "rollbackOnFailure", false, "set this flag to roll the local volume back to its most recent snapshot if the restore fails, or to destroy it if it did not exist before the restore, so no half-applied restore is left behind. Any changes made to the local volume since its most recent snapshot are discarded on failure.")
 	receiveCmd.Flags().BoolVar(&jobInfo.AutoRestore, "auto", false, "Automatically restore to the snapshot provided, or to the latest snapshot of the volume provided, cannot be used with the --incremental flag.")
 	receiveCmd.Flags().BoolVarP(&jobInfo.FullPath, "fullPath", "d", false, "See the -d flag on zfs recv for more information")
 	receiveCmd.Flags().BoolVarP(&jobInfo.LastPath, "lastPath", "e", false, "See the -e flag for zfs recv for more information.")
 	receiveCmd.Flags().BoolVarP(&jobInfo.Force, "force", "F", false, "See the -F flag for zfs recv for more information.")
 	receiveCmd.Flags().BoolVarP(&jobInfo.NotMounted, "unmounted", "u", false, "See the -u flag for zfs recv for more information.")
 	receiveCmd.Flags().StringVarP(&jobInfo.Origin, "origin", "o", "", "See the -o flag on zfs recv for more information.")
+	receiveCmd.Flags().StringArrayVar(&jobInfo.PropertyOverrides, "property", nil, "Set a property=value on the received dataset, may be repeated (e.g. --property readonly=on). See the -o flag on zfs recv for more information. Overrides take precedence over properties included in the stream by zfsbackup send -p.")
+	receiveCmd.Flags().BoolVar(&jobInfo.SyncUserProperties, "userProperties", false, "set this flag to reapply the user properties (module:property) recorded in the manifest by zfsbackup send --userProperties to the received dataset once it was received. Properties set with --property are left as overridden. Not supported with --sshHost.")
+	receiveCmd.Flags().StringSliceVar(&jobInfo.UserPropertyNamespaces, "userPropertyNamespaces", nil, "a comma separated list of the namespaces, the module part of their names, of the user properties to reapply with --userProperties. All of them are reapplied by default.")
+	receiveCmd.Flags().StringVar(&jobInfo.MetadataFile, "metadataFile", "", "append a line of JSON with the metadata recorded by zfsbackup send --metadata or --metadataHook to this file for each backup set received, along with the dataset and snapshot it was backed up from and the dataset it was received into.")
+	receiveCmd.Flags().StringVar(&jobInfo.PostRestoreHook, "postRestoreHook", "", "the path to an executable to run once each backup set was received, with the dataset received into and the dataset and snapshot it was backed up from as its arguments. It is passed the metadata of the backup set as a line of JSON on its standard input, formatted like the lines of --metadataFile, the restore fails if it exits with an error. Not supported with --outputFile.")
+	receiveCmd.Flags().StringVar(&jobInfo.DecompressCommand, "decompressCommand", "", "the command to pipe volumes compressed with the external compressor through to decompress them, e.g. \"zstd -d -c --long=27\". Arguments are split on whitespace. Defaults to the program of the command recorded in the manifest with the -d and -c flags.")
 	receiveCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "Used to specify the snapshot target to restore from.")
 	receiveCmd.Flags().IntVar(&jobInfo.MaxFileBuffer, "maxFileBuffer", 5, "the maximum number of files to have active during the upload process. Should be set to at least the number of max parallel uploads. Set to 0 to bypass local storage and upload straight to your destination - this will limit you to a single destination and disable any hash checks for the upload where available.")
+	receiveCmd.Flags().BoolVar(&jobInfo.ResumableRestore, "resumableRestore", false, "set this flag to download the volumes to the local cache dir and keep them there until received, so a failed download is retried from where it stopped and running the same restore again after it failed reuses the volumes already downloaded and only downloads the remainder of the volume in progress, by range where the backend supports it. The zfs receive itself starts over. Requires a file buffer.")
+	receiveCmd.Flags().StringVar(&jobInfo.RestoreStateFile, "restoreStateFile", "", "persist the progress of an auto restore to this file, the snapshots received and the volumes of the snapshot being received, so running the same restore again after it stopped, e.g. on a reboot, resumes near where it left off. The snapshot in progress is received again from its first volume, as a stored stream cannot continue a partial receive, but its volumes are kept in the local cache until it was received so they are not downloaded again. The receive is run with -s and the partially received state it leaves is discarded on resume. Requires the --auto and --resumableRestore flags.")
+	receiveCmd.Flags().IntVar(&jobInfo.MaxParallelDownloads, "maxParallelDownloads", 0, "the maximum number of volumes of a backup set to download at a time. The volumes are downloaded to the file buffer and received in order, so no more than --maxFileBuffer volumes are downloaded at a time. Use 0 to download as many volumes at a time as the file buffer holds.")
+	receiveCmd.Flags().IntVar(&jobInfo.ReadAheadVolumes, "readAheadVolumes", 0, "the maximum number of volumes to download ahead of the volume being received, keeping zfs receive fed through network hiccups on bursty links. The volumes are downloaded in order and wait in the file buffer, so no more than --maxFileBuffer volumes are held. Use 0 to read ahead as many volumes as the file buffer holds.")
+	receiveCmd.Flags().Uint64Var(&jobInfo.ReadAheadSize, "readAheadSize", 0, "the maximum size (in MiB) of the volumes downloaded ahead of the volume being received, bounding the space used by the file buffer. The next volume to receive is always downloaded. Use 0 for no limit.")
 	receiveCmd.Flags().DurationVar(&jobInfo.MaxRetryTime, "maxRetryTime", 12*time.Hour, "the maximum time that can elapse when retrying a failed download. Use 0 for no limit.")
+	receiveCmd.Flags().Uint64Var(&maxDownloadSpeed, "maxDownloadSpeed", 0, "the maximum download speed (in KB/s) the program should use between all download workers. Use 0 for no limit")
 	receiveCmd.Flags().DurationVar(&jobInfo.MaxBackoffTime, "maxBackoffTime", 30*time.Minute, "the maximum delay you'd want a worker to sleep before retrying an download.")
 	receiveCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names (used only for the initial manifest we are looking for).")
+	receiveCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case used for dataset and snapshot names in object names, either preserve or lower (used only for the initial manifest we are looking for).")
+	receiveCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "the string used in place of the '/' between dataset names in object names (used only for the initial manifest we are looking for).")
+	receiveCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path or hash (used only for the initial manifest we are looking for).")
+	receiveCmd.Flags().StringVar(&jobInfo.SSHHost, "sshHost", "", "restore onto this remote host ([user@]host) by piping the stream to zfs receive over ssh instead of running it locally. Snapshots that already exist on the remote host are not detected, the remote zfs receive will fail instead. Cannot be used with the --auto flag.")
+	receiveCmd.Flags().StringArrayVar(&jobInfo.SSHOptions, "sshOption", nil, "an option to pass to ssh with -o when using --sshHost, may be repeated (e.g. --sshOption Port=2222 --sshOption IdentityFile=/root/.ssh/restore).")
+	receiveCmd.Flags().StringSliceVar(&jobInfo.TrustedSigners, "trustedSigners", nil, "a comma separated list of the key IDs or fingerprints of the keys trusted to sign backups. The restore is aborted if the backup set is unsigned or signed by any other key, even if it is in the provided keyrings. A key is trusted if it, or the primary key it belongs to, is listed. By default any key in the provided keyrings is trusted.")
+	receiveCmd.Flags().BoolVar(&jobInfo.DiscoverDecryptionKey, "discoverKey", false, "set this flag to decrypt the backup set with whichever private key of the secret key ring it was encrypted to, found from the recipients of its manifest, instead of providing it with the encryptTo option. Passphrase protected keys are decrypted with the passphrase provided. Requires the secretKeyRingPath option, keys held by gpg-agent are not supported.")
+	receiveCmd.Flags().BoolVar(&jobInfo.VerifyStream, "verifyStream", false, "set this flag to compare a digest of the reassembled send stream against the one recorded when the backup was taken. The end of the stream is held back from zfs receive until it matches so a mismatched stream is not received (earlier snapshots of a replication stream may already have been). Catches reassembly issues the per-volume checksums cannot.")
+	receiveCmd.Flags().BoolVar(&receiveGroup, "group", false, "Restore every dataset of the grouped backup set provided, in the order they were backed up. Requires the -d or -e flag so each dataset is received under local_volume.")
+	receiveCmd.Flags().StringSliceVar(&jobInfo.BatchSelectors, "batch", nil, "a comma separated list of datasets, to restore their newest snapshot, or dataset@snapshot to restore as a batch, along with any snapshots they increment from that are not found locally. Only the uri and local_volume arguments are expected. A summary of each restore is output once all of them are done.")
+	receiveCmd.Flags().BoolVar(&jobInfo.BatchAll, "batchAll", false, "restore the newest snapshot of every dataset found in the target destination as a batch, see --batch.")
+	receiveCmd.Flags().StringArrayVar(&jobInfo.TargetMap, "targetMap", nil, "receive a dataset of a batch restore into the local volume provided (e.g. --targetMap tank/db=restore/db) instead of under local_volume with the -d or -e option, may be repeated.")
+	receiveCmd.Flags().IntVar(&jobInfo.MaxParallelBatchRestores, "maxParallelBatchRestores", 1, "the maximum number of backup sets of a batch restore to download and receive at a time.")
+	receiveCmd.Flags().StringVar(&jobInfo.OutputFile, "outputFile", "", "write the reassembled send stream of the backup set to this file instead of receiving it, e.g. to carry it to an air-gapped system and zfs receive it there later. The local_volume argument is not expected. The volumes are verified as they are downloaded, as is the whole stream if its digest was recorded, and the file is only created once complete.")
+	receiveCmd.Flags().Int64Var(&jobInfo.OutputOffset, "outputOffset", 0, "the offset in the send stream of the range to write to the --outputFile, see --outputLength.")
+	receiveCmd.Flags().Int64Var(&jobInfo.OutputLength, "outputLength", 0, "only write this many bytes of the send stream, starting at --outputOffset, to the --outputFile, e.g. to inspect part of a large backup set. Only the blocks of the volumes the range spans are downloaded, which requires the backup set to be compressed with the seekable zstd compressor, not encrypted or signed, and the backend to support ranged downloads. The volumes cannot be verified as they are only partly downloaded. Use 0 to write the whole stream.")
 }
 
 // ResetReceiveJobInfo exists solely for integration testing
 func ResetReceiveJobInfo() {
 	resetRootFlags()
 	jobInfo.AutoRestore = false
+	jobInfo.RollbackOnFailure = false
+	maxDownloadSpeed = 0
 	jobInfo.FullPath = false
 	jobInfo.LastPath = false
 	jobInfo.Force = false
 	jobInfo.NotMounted = false
 	jobInfo.Origin = ""
+	jobInfo.PropertyOverrides = nil
+	jobInfo.SyncUserProperties = false
+	jobInfo.UserPropertyNamespaces = nil
+	jobInfo.MetadataFile = ""
+	jobInfo.PostRestoreHook = ""
 	jobInfo.BaseSnapshot = helpers.SnapshotInfo{}
 	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
 	jobInfo.MaxFileBuffer = 5
+	jobInfo.ResumableRestore = false
+	jobInfo.RestoreStateFile = ""
+	jobInfo.RestoreState = nil
 	jobInfo.MaxRetryTime = 12 * time.Hour
 	jobInfo.MaxBackoffTime = 30 * time.Minute
 	jobInfo.Separator = "|"
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	jobInfo.SSHHost = ""
+	jobInfo.SSHOptions = nil
+	jobInfo.TrustedSigners = nil
+	jobInfo.DiscoverDecryptionKey = false
+	jobInfo.DecompressCommand = ""
+	jobInfo.VerifyStream = false
+	jobInfo.BatchSelectors = nil
+	jobInfo.BatchAll = false
+	jobInfo.TargetMap = nil
+	jobInfo.MaxParallelBatchRestores = 1
+	jobInfo.MaxParallelDownloads = 0
+	jobInfo.ReadAheadVolumes = 0
+	jobInfo.ReadAheadSize = 0
+	jobInfo.OutputFile = ""
+	jobInfo.OutputOffset = 0
+	jobInfo.OutputLength = 0
+	receiveGroup = false
 }
 
 func validateReceiveFlags(cmd *cobra.Command, args []string) error {
+	if jobInfo.RollbackOnFailure && (jobInfo.SSHHost != "" || jobInfo.OutputFile != "" || receiveGroup) {
+		helpers.AppLogger.Errorf("The --rollbackOnFailure flag is not supported when receiving on a remote host, writing the stream to a file, or restoring a grouped backup.")
+		return errInvalidInput
+	}
+
+	if jobInfo.RestoreStateFile != "" {
+		if !jobInfo.AutoRestore || len(jobInfo.BatchSelectors) > 0 || jobInfo.BatchAll || jobInfo.OutputFile != "" || receiveGroup {
+			helpers.AppLogger.Errorf("The --restoreStateFile flag can only be used with the --auto flag, and not with the --batch, --batchAll, --outputFile or --group flags.")
+			return errInvalidInput
+		}
+		if !jobInfo.ResumableRestore || jobInfo.RollbackOnFailure {
+			helpers.AppLogger.Errorf("The --restoreStateFile flag requires the --resumableRestore flag to keep the volumes downloaded, and cannot be used with the --rollbackOnFailure flag which discards the snapshots received.")
+			return errInvalidInput
+		}
+	}
+
+	if jobInfo.MaxParallelDownloads < 0 {
+		helpers.AppLogger.Errorf("The number of parallel downloads must be greater than or equal to 0. %d was given.", jobInfo.MaxParallelDownloads)
+		return errInvalidInput
+	}
+
+	if jobInfo.ReadAheadVolumes < 0 {
+		helpers.AppLogger.Errorf("The number of volumes to read ahead must be greater than or equal to 0. %d was given.", jobInfo.ReadAheadVolumes)
+		return errInvalidInput
+	}
+
+	if (jobInfo.ReadAheadVolumes > 0 || jobInfo.ReadAheadSize > 0) && jobInfo.MaxFileBuffer == 0 {
+		helpers.AppLogger.Errorf("The --readAheadVolumes and --readAheadSize flags require a file buffer to download the volumes to, set --maxFileBuffer above 0.")
+		return errInvalidInput
+	}
+
+	if jobInfo.DiscoverDecryptionKey {
+		if err := unlockDiscoverableKeys(); err != nil {
+			return err
+		}
+	}
+
+	if len(jobInfo.BatchSelectors) > 0 || jobInfo.BatchAll {
+		return validateBatchReceiveFlags(cmd, args)
+	}
+
+	if len(jobInfo.TargetMap) > 0 {
+		helpers.AppLogger.Errorf("The --targetMap flag can only be used with the --batch or --batchAll flags.")
+		return errInvalidInput
+	}
+
+	if jobInfo.OutputOffset < 0 || jobInfo.OutputLength < 0 {
+		helpers.AppLogger.Errorf("The --outputOffset and --outputLength flags must be greater than or equal to 0. %d and %d were given.", jobInfo.OutputOffset, jobInfo.OutputLength)
+		return errInvalidInput
+	}
+
+	if (jobInfo.OutputOffset > 0 || jobInfo.OutputLength > 0) && jobInfo.OutputFile == "" {
+		helpers.AppLogger.Errorf("The --outputOffset and --outputLength flags can only be used with the --outputFile flag.")
+		return errInvalidInput
+	}
+
+	if jobInfo.OutputOffset > 0 && jobInfo.OutputLength == 0 {
+		helpers.AppLogger.Errorf("The --outputOffset flag requires the --outputLength flag to select the range of the send stream to write.")
+		return errInvalidInput
+	}
+
+	if jobInfo.OutputFile != "" {
+		return validateOutputFileReceiveFlags(cmd, args)
+	}
+
 	if len(args) != 3 {
 		cmd.Usage()
 		return errInvalidInput
@@ -101,6 +242,11 @@ func validateReceiveFlags(cmd *cobra.Command, args []string) error {
 		jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
 	}
 
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
 	if jobInfo.FullPath && jobInfo.LastPath {
 		helpers.AppLogger.Errorf("The -d and -e options are mutually exclusive, please select only one!")
 		return errInvalidInput
@@ -110,31 +256,254 @@ func validateReceiveFlags(cmd *cobra.Command, args []string) error {
 	jobInfo.Destinations = strings.Split(args[1], ",")
 	jobInfo.LocalVolume = args[2]
 
+	if err := jobInfo.ValidateReceiveTarget(); err != nil {
+		helpers.AppLogger.Errorf("Invalid local volume provided - %v", err)
+		return errInvalidInput
+	}
+
 	// Intelligently restore to the snapshot wanted
 	if jobInfo.AutoRestore && jobInfo.IncrementalSnapshot.Name != "" {
 		helpers.AppLogger.Errorf("Cannot request auto restore option and provide an incremental snapshot to restore from.")
 		return errInvalidInput
 	}
 
+	if receiveGroup {
+		if jobInfo.AutoRestore || jobInfo.IncrementalSnapshot.Name != "" {
+			helpers.AppLogger.Errorf("Cannot request a grouped restore with the auto restore option or an incremental snapshot to restore from.")
+			return errInvalidInput
+		}
+		if !jobInfo.FullPath && !jobInfo.LastPath {
+			helpers.AppLogger.Errorf("A grouped restore requires either the -d or -e option so each dataset can be received under %s.", jobInfo.LocalVolume)
+			return errInvalidInput
+		}
+	}
+
 	// Remove 'origin=' from beggining of -o argument
 	jobInfo.Origin = strings.TrimPrefix(jobInfo.Origin, "origin=")
 
-	if !jobInfo.AutoRestore {
-		// Let's see if we already have this snap shot
-		creationTime, err := helpers.GetCreationDate(context.TODO(), fmt.Sprintf("%s@%s", jobInfo.LocalVolume, jobInfo.BaseSnapshot.Name))
-		if err == nil {
-			jobInfo.BaseSnapshot.CreationTime = creationTime
+	if err := jobInfo.ValidatePropertyOverrides(); err != nil {
+		helpers.AppLogger.Errorf("Invalid property override provided - %v", err)
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateUserPropertyNamespaces(); err != nil {
+		helpers.AppLogger.Errorf("Invalid user property namespace provided - %v", err)
+		return errInvalidInput
+	}
+
+	if jobInfo.ResumableRestore && jobInfo.MaxFileBuffer == 0 {
+		helpers.AppLogger.Errorf("The --resumableRestore flag requires a file buffer to download the volumes to, set --maxFileBuffer above 0.")
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateTrustedSigners(); err != nil {
+		helpers.AppLogger.Errorf("Invalid trusted signer provided - %v", err)
+		return errInvalidInput
+	}
+
+	if len(jobInfo.TrustedSigners) > 0 && jobInfo.EncryptKey == nil && jobInfo.SignKey == nil && !jobInfo.DiscoverDecryptionKey {
+		helpers.AppLogger.Errorf("Signatures can only be checked against the trusted signers when the encryptTo, signFrom or discoverKey options are provided.")
+		return errInvalidInput
+	}
+
+	if jobInfo.SSHHost != "" {
+		if strings.HasPrefix(jobInfo.SSHHost, "-") || strings.ContainsAny(jobInfo.SSHHost, " \t") {
+			helpers.AppLogger.Errorf("Invalid ssh host provided, expected [user@]host, got %s instead", jobInfo.SSHHost)
+			return errInvalidInput
 		}
+		if jobInfo.AutoRestore {
+			helpers.AppLogger.Errorf("Cannot request the auto restore option when receiving on a remote host, the snapshots to restore are computed from the local snapshots.")
+			return errInvalidInput
+		}
+	} else if len(jobInfo.SSHOptions) > 0 {
+		helpers.AppLogger.Errorf("The --sshOption flag can only be used with the --sshHost flag.")
+		return errInvalidInput
+	}
+
+	if !jobInfo.AutoRestore {
 		if jobInfo.IncrementalSnapshot.Name != "" {
 			jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
 			jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
-			creationTime, err = helpers.GetCreationDate(context.TODO(), fmt.Sprintf("%s@%s", jobInfo.LocalVolume, jobInfo.IncrementalSnapshot.Name))
+		}
+
+		// Let's see if we already have this snap shot, this can only be checked locally
+		if jobInfo.SSHHost == "" {
+			creationTime, err := helpers.GetCreationDate(context.TODO(), fmt.Sprintf("%s@%s", jobInfo.ReceiveTarget(), jobInfo.BaseSnapshot.Name))
 			if err == nil {
-				jobInfo.IncrementalSnapshot.CreationTime = creationTime
+				jobInfo.BaseSnapshot.CreationTime = creationTime
+			}
+			if jobInfo.IncrementalSnapshot.Name != "" {
+				creationTime, err = helpers.GetCreationDate(context.TODO(), fmt.Sprintf("%s@%s", jobInfo.ReceiveTarget(), jobInfo.IncrementalSnapshot.Name))
+				if err == nil {
+					jobInfo.IncrementalSnapshot.CreationTime = creationTime
+				}
 			}
 		}
 	}
 
+	return validateReceiveDestinations()
+}
+
+// validateBatchReceiveFlags will validate the flags of a batch restore, which expects the uri and local_volume arguments.
+func validateBatchReceiveFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+	jobInfo.StartTime = time.Now()
+
+	if len(jobInfo.BatchSelectors) > 0 && jobInfo.BatchAll {
+		helpers.AppLogger.Errorf("The --batch and --batchAll flags are mutually exclusive, please select only one!")
+		return errInvalidInput
+	}
+
+	if receiveGroup || jobInfo.AutoRestore || jobInfo.IncrementalSnapshot.Name != "" || jobInfo.Origin != "" {
+		helpers.AppLogger.Errorf("Cannot request a batch restore with the group or auto restore options, an incremental snapshot to restore from, or an origin.")
+		return errInvalidInput
+	}
+
+	if jobInfo.SSHHost != "" || len(jobInfo.SSHOptions) > 0 {
+		helpers.AppLogger.Errorf("Cannot request a batch restore on a remote host, the snapshots to restore are computed from the local snapshots.")
+		return errInvalidInput
+	}
+
+	if jobInfo.MaxParallelBatchRestores < 1 {
+		helpers.AppLogger.Errorf("The number of parallel batch restores must be greater than 0. %d was given.", jobInfo.MaxParallelBatchRestores)
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
+	if jobInfo.FullPath && jobInfo.LastPath {
+		helpers.AppLogger.Errorf("The -d and -e options are mutually exclusive, please select only one!")
+		return errInvalidInput
+	}
+
+	for _, selector := range jobInfo.BatchSelectors {
+		if err := helpers.ValidateDatasetName(selector); err != nil {
+			helpers.AppLogger.Errorf("Invalid dataset or snapshot provided to restore - %v", err)
+			return errInvalidInput
+		}
+	}
+
+	if err := jobInfo.ValidateTargetMap(); err != nil {
+		helpers.AppLogger.Errorf("Invalid target mapping provided - %v", err)
+		return errInvalidInput
+	}
+
+	if !jobInfo.FullPath && !jobInfo.LastPath && len(jobInfo.TargetMap) == 0 {
+		helpers.AppLogger.Errorf("A batch restore requires either the -d or -e option, or a --targetMap for the datasets, so each dataset can be received into its own local volume.")
+		return errInvalidInput
+	}
+
+	jobInfo.Destinations = strings.Split(args[0], ",")
+	jobInfo.LocalVolume = args[1]
+
+	if err := jobInfo.ValidatePropertyOverrides(); err != nil {
+		helpers.AppLogger.Errorf("Invalid property override provided - %v", err)
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateUserPropertyNamespaces(); err != nil {
+		helpers.AppLogger.Errorf("Invalid user property namespace provided - %v", err)
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateTrustedSigners(); err != nil {
+		helpers.AppLogger.Errorf("Invalid trusted signer provided - %v", err)
+		return errInvalidInput
+	}
+
+	if len(jobInfo.TrustedSigners) > 0 && jobInfo.EncryptKey == nil && jobInfo.SignKey == nil && !jobInfo.DiscoverDecryptionKey {
+		helpers.AppLogger.Errorf("Signatures can only be checked against the trusted signers when the encryptTo, signFrom or discoverKey options are provided.")
+		return errInvalidInput
+	}
+
+	return validateReceiveDestinations()
+}
+
+// validateOutputFileReceiveFlags will validate the flags of a restore to a file, which expects the snapshot and uri arguments.
+func validateOutputFileReceiveFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+	jobInfo.StartTime = time.Now()
+
+	if receiveGroup || jobInfo.AutoRestore {
+		helpers.AppLogger.Errorf("Cannot write the send stream to a file with the group or auto restore options, only a single backup set can be written.")
+		return errInvalidInput
+	}
+
+	if jobInfo.SSHHost != "" || len(jobInfo.SSHOptions) > 0 || jobInfo.FullPath || jobInfo.LastPath || jobInfo.Force || jobInfo.NotMounted || jobInfo.Origin != "" || len(jobInfo.PropertyOverrides) > 0 || jobInfo.SyncUserProperties {
+		helpers.AppLogger.Errorf("The zfs receive options cannot be used when writing the send stream to a file, provide them to zfs receive when restoring the file instead.")
+		return errInvalidInput
+	}
+
+	if jobInfo.PostRestoreHook != "" {
+		helpers.AppLogger.Errorf("The --postRestoreHook flag cannot be used when writing the send stream to a file as nothing is received, use --metadataFile to get the metadata of the backup set instead.")
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) != 2 {
+		helpers.AppLogger.Errorf("Invalid base snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+		return errInvalidInput
+	}
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
+	if jobInfo.IncrementalSnapshot.Name != "" {
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+	}
+
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
+	if err := jobInfo.ValidateTrustedSigners(); err != nil {
+		helpers.AppLogger.Errorf("Invalid trusted signer provided - %v", err)
+		return errInvalidInput
+	}
+
+	if len(jobInfo.TrustedSigners) > 0 && jobInfo.EncryptKey == nil && jobInfo.SignKey == nil && !jobInfo.DiscoverDecryptionKey {
+		helpers.AppLogger.Errorf("Signatures can only be checked against the trusted signers when the encryptTo, signFrom or discoverKey options are provided.")
+		return errInvalidInput
+	}
+
+	jobInfo.Destinations = strings.Split(args[1], ",")
+
+	return validateReceiveDestinations()
+}
+
+// unlockDiscoverableKeys will check the options required to discover the key a backup set was encrypted to, and decrypt
+// the passphrase protected private keys of the secret key ring it is discovered from.
+func unlockDiscoverableKeys() error {
+	if jobInfo.EncryptTo != "" {
+		helpers.AppLogger.Errorf("The --discoverKey flag cannot be used along with the encryptTo option.")
+		return errInvalidInput
+	}
+
+	if secretKeyRingPath == "" {
+		helpers.AppLogger.Errorf("The --discoverKey flag requires the secretKeyRingPath option to discover the key from.")
+		return errInvalidInput
+	}
+
+	if helpers.HasEncryptedPrivateKeys() {
+		validatePassphrase()
+		if locked := helpers.UnlockPrivateKeys(passphrase); locked > 0 {
+			helpers.AppLogger.Warningf("%d private key(s) of the secret key ring could not be decrypted with the passphrase provided and will not be tried.", locked)
+		}
+	}
+
+	return nil
+}
+
+func validateReceiveDestinations() error {
 	for _, destination := range jobInfo.Destinations {
 		_, err := backends.GetBackendForURI(destination)
 		if err == backends.ErrInvalidPrefix {
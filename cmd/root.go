@@ -21,6 +21,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -29,14 +30,18 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	humanize "github.com/dustin/go-humanize"
-	"github.com/juju/ratelimit"
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/kietdlam/zfsbackup-go/backends"
+	"github.com/kietdlam/zfsbackup-go/backup"
 	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backends"
+	//"../backup"
 	//"../helpers"
 )
 
@@ -46,7 +51,12 @@ var (
 	secretKeyRingPath string
 	publicKeyRingPath string
 	workingDirectory  string
+	otlpEndpoint      string
+	classLimits       []string
 	errInvalidInput   = errors.New("invalid input")
+
+	// shutdownTracing will flush any pending spans to the configured OTLP endpoint, if any.
+	shutdownTracing func(context.Context) error
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -67,10 +77,30 @@ destination of your choosing.`,
 
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// The process exits with the status backup.ExitStatus maps the error of the command to.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
-		os.Exit(-1)
+	err := RootCmd.Execute()
+	flushTracing()
+	if err == nil && jobInfo.Unchanged {
+		err = backup.ErrNothingToBackUp
+	}
+	if status := backup.ExitStatus(err); status != backup.ExitSuccess {
+		os.Exit(status)
+	}
+}
+
+// flushTracing will export any spans still buffered before the process exits.
+func flushTracing() {
+	if shutdownTracing == nil {
+		return
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		helpers.AppLogger.Warningf("Could not export traces to %s - %v", otlpEndpoint, err)
+	}
+	shutdownTracing = nil
 }
 
 func init() {
@@ -80,10 +110,27 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&publicKeyRingPath, "publicKeyRingPath", "", "the path to the PGP public key ring")
 	RootCmd.PersistentFlags().StringVar(&workingDirectory, "workingDirectory", "~/.zfsbackup", "the working directory path for zfsbackup.")
 	RootCmd.PersistentFlags().StringVar(&jobInfo.ManifestPrefix, "manifestPrefix", "manifests", "the prefix to use for all manifest files.")
+	RootCmd.PersistentFlags().StringSliceVar(&jobInfo.ManifestMirrorPrefixes, "manifestMirrorPrefix", nil, "a comma separated list of prefixes to write a byte-identical copy of each manifest under in every destination once the backup set is complete. The copies are tried in order when a manifest is missing from --manifestPrefix and are not removed by clean unless their backup set is. Prefixes must not start with one another (e.g. manifests and mirror/manifests).")
+	RootCmd.PersistentFlags().StringSliceVar(&jobInfo.ManifestMirrorDestinations, "manifestMirrorDestination", nil, "a comma separated list of additional destinations to write a byte-identical copy of each manifest to, under --manifestPrefix and every --manifestMirrorPrefix, once the backup set is complete. They are tried in order after the destinations when a manifest cannot be downloaded.")
 	RootCmd.PersistentFlags().StringVar(&jobInfo.EncryptTo, "encryptTo", "", "the email of the user to encrypt the data to from the provided public keyring.")
 	RootCmd.PersistentFlags().StringVar(&jobInfo.SignFrom, "signFrom", "", "the email of the user to sign on behalf of from the provided private keyring.")
 	RootCmd.PersistentFlags().StringVar(&helpers.ZFSPath, "zfsPath", "zfs", "the path to the zfs executable.")
+	RootCmd.PersistentFlags().IntVar(&jobInfo.ZFSRetries, "zfsRetries", 0, "the number of times to run zfs send or receive again, with a backoff, when it fails with error output matching a --zfsRetryPattern, e.g. as the dataset is briefly busy. A send is only run again if none of its stream was read yet. A receive downloads the whole backup set again on each retry, which can be costly for large backup sets. Errors such as a dataset that does not exist are never retried. Use 0 to not retry.")
+	RootCmd.PersistentFlags().StringArrayVar(&jobInfo.ZFSRetryPatterns, "zfsRetryPattern", append([]string(nil), helpers.DefaultTransientZFSErrors...), "a case insensitive pattern of the error output of zfs send or receive for failures worth retrying, see --zfsRetries. May be repeated, providing it replaces the default patterns.")
 	RootCmd.PersistentFlags().BoolVar(&helpers.JSONOutput, "jsonOutput", false, "dump results as a JSON string - on success only")
+	RootCmd.PersistentFlags().DurationVar(&jobInfo.DNSCacheTTL, "dnsCacheTTL", 0, "cache DNS lookups made by the backends for this long so connections across parallel requests reuse them (only supported by the s3 backend). Use 0 to disable.")
+	RootCmd.PersistentFlags().IntVar(&jobInfo.MaxParallelRestores, "maxParallelRestores", 10, "the maximum number of objects to request a restore from Glacier for, or check on, at a time before downloading them (only supported by the s3 backend).")
+	RootCmd.PersistentFlags().Float64Var(&jobInfo.RestoreRequestRate, "restoreRequestRate", 0, "the maximum number of Glacier restore requests to issue per second, throttled requests are retried with a backoff (only supported by the s3 backend). Use 0 for no limit.")
+	RootCmd.PersistentFlags().StringArrayVar(&classLimits, "classLimit", nil, "cap the requests of an operation on the objects of a storage class as class:operation=concurrency[,rate], where operation is one of upload, download or restore, concurrency the number of requests at a time (0 for no cap) and rate the number of requests per second, e.g. --classLimit GLACIER:restore=5,2.5 --classLimit DEEP_ARCHIVE:restore=2. The class * applies to objects of any other, or unknown, storage class. May be repeated (only supported by the s3 backend, uploads are made to the STANDARD class unless --storageClass is given).")
+	RootCmd.PersistentFlags().IntVar(&jobInfo.MaxConnsPerHost, "maxConnsPerHost", 0, "the maximum number of connections, including idle ones kept alive for reuse, the backends should keep open per host (only supported by the s3 backend). Use 0 for the default behavior.")
+	RootCmd.PersistentFlags().StringVar(&jobInfo.IPFamily, "ipFamily", backends.IPFamilyAny, "the address family the backends should connect to their endpoints over, one of any, ipv4, ipv6, prefer-ipv4, or prefer-ipv6 (only supported by the s3 backend). The prefer options fall back to the other address family if a connection could not be made.")
+	RootCmd.PersistentFlags().DurationVar(&jobInfo.InitRetryTime, "initRetryTime", 5*time.Minute, "the maximum time to retry reaching a destination for when starting up, e.g. if the object store is briefly unreachable when a scheduled backup starts. Network failures and unavailable or throttling services are retried, denied requests are not. Use 0 to not retry.")
+	RootCmd.PersistentFlags().DurationVar(&jobInfo.RequestTimeout, "requestTimeout", 5*time.Minute, "the maximum time to wait on a single request to a destination (a list, get, head, delete, or the part of an upload) before it is canceled and retried, separate from how long the whole operation may take. Downloads are only timed until the destination starts responding, not while their data is transferred. Use 0 to wait indefinitely (only supported by the s3, swift, gs, azure, and b2 backends).")
+	RootCmd.PersistentFlags().StringVar(&jobInfo.ClockSkewCheck, "clockSkewCheck", backends.ClockSkewCheckWarn, "compare the clock of this host against the time reported by a destination when connecting to it, either off, warn to log a warning or fail to stop when they are further apart than --maxClockSkew, as requests are refused once their signatures are too old (only supported by the s3 backend).")
+	RootCmd.PersistentFlags().DurationVar(&jobInfo.MaxClockSkew, "maxClockSkew", 5*time.Minute, "the maximum difference allowed between the clock of this host and the time reported by a destination, see --clockSkewCheck. S3 refuses requests signed more than 15 minutes off its own clock.")
+	RootCmd.PersistentFlags().StringVar(&helpers.AuditLogPath, "auditLog", "", "append a record of every backup, restore, and deletion of an object (dataset, snapshot, target, result, bytes, who and when) to this file as a line of JSON, synced to disk before moving on. Separate from, and not affected by, the logging options. Leave empty to disable.")
+	RootCmd.PersistentFlags().BoolVar(&helpers.AuditHashChain, "auditHashChain", false, "set this flag to chain each record of the --auditLog to the one before it by their SHA256 hashes, so modified, inserted or deleted records can be detected with the verify-audit-log command.")
+	RootCmd.PersistentFlags().StringVar(&otlpEndpoint, "otlpEndpoint", "", "the URL of an OTLP/HTTP collector to export OpenTelemetry traces of each job to (e.g. http://localhost:4318). Leave empty to disable tracing.")
 	passphrase = []byte(os.Getenv("PGP_PASSPHRASE"))
 }
 
@@ -95,10 +142,26 @@ func resetRootFlags() {
 	publicKeyRingPath = ""
 	workingDirectory = "~/.zfsbackup"
 	jobInfo.ManifestPrefix = "manifests"
+	jobInfo.ManifestMirrorPrefixes = nil
+	jobInfo.ManifestMirrorDestinations = nil
 	jobInfo.EncryptTo = ""
 	jobInfo.SignFrom = ""
 	helpers.ZFSPath = "zfs"
 	helpers.JSONOutput = false
+	jobInfo.ZFSRetries = 0
+	jobInfo.ZFSRetryPatterns = append([]string(nil), helpers.DefaultTransientZFSErrors...)
+	jobInfo.MaxParallelRestores = 10
+	jobInfo.RestoreRequestRate = 0
+	jobInfo.IPFamily = backends.IPFamilyAny
+	jobInfo.InitRetryTime = 5 * time.Minute
+	jobInfo.RequestTimeout = 5 * time.Minute
+	jobInfo.ClockSkewCheck = backends.ClockSkewCheckWarn
+	jobInfo.MaxClockSkew = 5 * time.Minute
+	otlpEndpoint = ""
+	classLimits = nil
+	helpers.BackupClassLimiter = nil
+	helpers.AuditLogPath = ""
+	helpers.AuditHashChain = false
 }
 
 func processFlags(cmd *cobra.Command, args []string) error {
@@ -129,6 +192,55 @@ func processFlags(cmd *cobra.Command, args []string) error {
 		helpers.AppLogger.Warningf("Ignoring user provided number of cores (%d) and using the number of detected cores (%d).", numCores, runtime.NumCPU())
 		numCores = runtime.NumCPU()
 	}
+	if jobInfo.MaxParallelRestores <= 0 || jobInfo.RestoreRequestRate < 0 {
+		helpers.AppLogger.Errorf("The maximum number of parallel restores must be greater than 0 and the restore request rate must not be negative. %d and %v were given.", jobInfo.MaxParallelRestores, jobInfo.RestoreRequestRate)
+		return errInvalidInput
+	}
+
+	if err := backends.ValidateClockSkewCheck(jobInfo.ClockSkewCheck); err != nil || jobInfo.MaxClockSkew < 0 {
+		helpers.AppLogger.Errorf("Invalid clock skew check provided, expected one of off, warn or fail and a maximum clock skew of 0 or more. %s and %v were given.", jobInfo.ClockSkewCheck, jobInfo.MaxClockSkew)
+		return errInvalidInput
+	}
+
+	if jobInfo.ZFSRetries < 0 {
+		helpers.AppLogger.Errorf("The number of zfs retries must not be negative. %d was given.", jobInfo.ZFSRetries)
+		return errInvalidInput
+	}
+
+	if jobInfo.RequestTimeout < 0 {
+		helpers.AppLogger.Errorf("The request timeout must not be negative. %v was given.", jobInfo.RequestTimeout)
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateManifestMirrors(); err != nil {
+		helpers.AppLogger.Errorf("Invalid manifest mirror provided - %v", err)
+		return errInvalidInput
+	}
+
+	if len(classLimits) > 0 {
+		limiter, err := helpers.NewClassLimiter(classLimits)
+		if err != nil {
+			helpers.AppLogger.Errorf("Invalid storage class limit provided - %v", err)
+			return errInvalidInput
+		}
+		helpers.BackupClassLimiter = limiter
+	}
+
+	if err := backends.ValidateIPFamily(jobInfo.IPFamily); err != nil {
+		helpers.AppLogger.Errorf("Invalid address family provided - %v", err)
+		return errInvalidInput
+	}
+
+	if otlpEndpoint != "" {
+		shutdown, err := helpers.InitTracing(context.Background(), otlpEndpoint)
+		if err != nil {
+			helpers.AppLogger.Errorf("Could not setup tracing to %s due to an error - %v", otlpEndpoint, err)
+			return errInvalidInput
+		}
+		shutdownTracing = shutdown
+		helpers.AppLogger.Infof("Exporting traces to %s", otlpEndpoint)
+	}
+
 	helpers.AppLogger.Infof("Setting number of cores to: %d", numCores)
 	runtime.GOMAXPROCS(numCores)
 
@@ -161,7 +273,7 @@ func processFlags(cmd *cobra.Command, args []string) error {
 	if jobInfo.EncryptTo != "" {
 		if jobInfo.EncryptKey = helpers.GetPublicKeyByEmail(jobInfo.EncryptTo); jobInfo.EncryptKey == nil {
 			helpers.AppLogger.Errorf("Could not find public key for %s", jobInfo.EncryptTo)
-			return errInvalidInput
+			return &helpers.OperationError{Op: "encrypt", Kind: helpers.ErrKeyMissing, Err: fmt.Errorf("could not find public key for %s", jobInfo.EncryptTo)}
 		}
 
 		if jobInfo.EncryptKey.PrivateKey != nil && jobInfo.EncryptKey.PrivateKey.Encrypted {
@@ -186,7 +298,7 @@ func processFlags(cmd *cobra.Command, args []string) error {
 	if jobInfo.SignFrom != "" {
 		if jobInfo.SignKey = helpers.GetPrivateKeyByEmail(jobInfo.SignFrom); jobInfo.SignKey == nil {
 			helpers.AppLogger.Errorf("Could not find private key for %s", jobInfo.SignFrom)
-			return errInvalidInput
+			return &helpers.OperationError{Op: "sign", Kind: helpers.ErrKeyMissing, Err: fmt.Errorf("could not find private key for %s", jobInfo.SignFrom)}
 		}
 
 		if jobInfo.SignKey.PrivateKey != nil && jobInfo.SignKey.PrivateKey.Encrypted {
@@ -279,10 +391,8 @@ func setupGlobalVars() error {
 		}
 	}
 
-	if maxUploadSpeed != 0 {
-		helpers.AppLogger.Infof("Limiting the upload speed to %s/s.", humanize.Bytes(maxUploadSpeed*humanize.KByte))
-		helpers.BackupUploadBucket = ratelimit.NewBucketWithRate(float64(maxUploadSpeed*humanize.KByte), int64(maxUploadSpeed*humanize.KByte))
-	}
+	jobInfo.MaxUploadBytesPerSecond = maxUploadSpeed * humanize.KByte
+	jobInfo.MaxDownloadBytesPerSecond = maxDownloadSpeed * humanize.KByte
 	return nil
 }
 
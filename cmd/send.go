@@ -23,10 +23,13 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/kietdlam/zfsbackup-go/backends"
 	"github.com/kietdlam/zfsbackup-go/backup"
@@ -41,6 +44,10 @@ var (
 	fullIncremental string
 	maxUploadSpeed  uint64
 	passphrase      []byte
+	startWindow     string
+	compressionCPUs string
+	uploadCPUs      string
+	metadataPairs   []string
 )
 
 // sendCmd represents the send command
@@ -63,7 +70,40 @@ var sendCmd = &cobra.Command{
 			helpers.AppLogger.Infof("Will be signed from %s", jobInfo.SignFrom)
 		}
 
-		return backup.Backup(context.Background(), &jobInfo)
+		// Uploads can be paused, e.g. to yield all bandwidth to something urgent, and resumed with signals
+		helpers.BackupUploadGate = helpers.NewUploadGate()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, helpers.PauseSignal, helpers.ResumeSignal)
+		go helpers.BackupUploadGate.Watch(signals)
+		defer func() {
+			signal.Stop(signals)
+			close(signals)
+		}()
+		helpers.AppLogger.Infof("Send SIGUSR1 to pause the uploads and SIGUSR2 to resume them.")
+
+		ctx, span := helpers.StartSpan(context.Background(), "send",
+			attribute.StringSlice("zfsbackup.destinations", jobInfo.Destinations),
+			attribute.String("zfsbackup.group", jobInfo.GroupName),
+			attribute.Int("zfsbackup.datasets", len(jobInfo.Datasets)),
+		)
+
+		var err error
+		if jobInfo.GroupName != "" {
+			err = backup.BackupGroup(ctx, &jobInfo)
+		} else if len(jobInfo.Datasets) > 0 {
+			err = backup.BackupDatasets(ctx, &jobInfo)
+		} else {
+			err = backup.Backup(ctx, &jobInfo)
+		}
+		helpers.EndSpan(span, err)
+
+		if jobInfo.MetricsTextfileDir != "" && !jobInfo.DryRun {
+			if merr := helpers.WriteTextfileMetrics(jobInfo.MetricsTextfileDir, &jobInfo, err, time.Now()); merr != nil {
+				helpers.AppLogger.Warningf("Could not write metrics file to %s due to error - %v", jobInfo.MetricsTextfileDir, merr)
+			}
+		}
+
+		return err
 	},
 }
 
@@ -73,26 +113,88 @@ func init() {
 	// ZFS send command options
 	sendCmd.Flags().BoolVarP(&jobInfo.Replication, "replication", "R", false, "See the -R flag on zfs send for more information")
 	sendCmd.Flags().BoolVarP(&jobInfo.Deduplication, "deduplication", "D", false, "See the -D flag for zfs send for more information.")
-	sendCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "See the -i flag on zfs send for more information")
+	sendCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "See the -i flag on zfs send for more information. A bookmark (#bookmark) can be incremented from in place of a snapshot, the backup set is then recorded as incrementing from the snapshot the bookmark was created from, which must have been backed up to every destination.")
 	sendCmd.Flags().StringVarP(&fullIncremental, "intermediary", "I", "", "See the -I flag on zfs send for more information")
 	sendCmd.Flags().BoolVarP(&jobInfo.Properties, "properties", "p", false, "See the -p flag on zfs send for more information.")
+	sendCmd.Flags().BoolVarP(&jobInfo.LargeBlocks, "largeBlocks", "L", false, "See the -L flag on zfs send for more information. The pool the backup is restored to must have the large_blocks feature enabled.")
+	sendCmd.Flags().BoolVarP(&jobInfo.CompressedSend, "compressed", "c", false, "See the -c flag on zfs send for more information. The pool the backup is restored to must support the compression used by the dataset.")
+	sendCmd.Flags().BoolVarP(&jobInfo.RawSend, "raw", "w", false, "See the -w flag on zfs send for more information. The blocks of an encrypted dataset are sent still encrypted, so --encryptTo is not needed to keep the backup encrypted, and are restored with the encryption of the dataset. Incremental backups must be sent raw as well to be received on top of a raw backup set.")
+	sendCmd.Flags().BoolVar(&jobInfo.SyncUserProperties, "userProperties", false, "set this flag to record the user properties (module:property) set on the dataset, locally or received, in the manifest so zfsbackup receive --userProperties can reapply them. Unlike -p, only user properties are recorded and the send stream is left as is.")
+	sendCmd.Flags().StringSliceVar(&jobInfo.UserPropertyNamespaces, "userPropertyNamespaces", nil, "a comma separated list of the namespaces, the module part of their names, of the user properties to record with --userProperties (e.g. com.example,backup). All of them are recorded by default.")
+	sendCmd.Flags().StringArrayVar(&metadataPairs, "metadata", nil, "record a key=value in the metadata of the manifest, may be repeated (e.g. --metadata layout=v2). The metadata is surfaced after restoring the backup set with zfsbackup receive --metadataFile or --postRestoreHook.")
+	sendCmd.Flags().StringVar(&jobInfo.MetadataHook, "metadataHook", "", "the path to an executable to run with the dataset and snapshot being backed up as its arguments before sending it, each key=value line it prints is recorded in the metadata of the manifest, taking precedence over --metadata. Empty lines and lines starting with # are ignored, the backup fails if it exits with an error.")
 
 	// Specific to download only
 	sendCmd.Flags().Uint64Var(&jobInfo.VolumeSize, "volsize", 200, "the maximum size (in MiB) a volume should be before splitting to a new volume. Note: zfsbackup will try its best to stay close/under this limit but it is not garaunteed.")
-	sendCmd.Flags().IntVar(&jobInfo.CompressionLevel, "compressionLevel", 6, "the compression level to use with the compressor. Valid values are between 1-9.")
+	sendCmd.Flags().BoolVar(&jobInfo.SingleObject, "singleObject", false, "set this flag to stream the backup to the destination as a single object instead of splitting it into volumes. Requires a single destination.")
+	sendCmd.Flags().Uint64Var(&jobInfo.SingleObjectBelow, "singleObjectBelow", 0, "stream the backup as a single object instead of splitting it into volumes if the send stream is estimated to be smaller than this many MiB and a single destination is provided. Use 0 to disable.")
+	sendCmd.Flags().StringVar(&jobInfo.CompressCommand, "compressCommand", "", "the command to pipe the stream through to compress it with the external compressor, e.g. \"zstd --long=27 -T0\". Arguments are split on whitespace and --compressionLevel is not added to them. The command is recorded in the manifest, provide the command to decompress the volumes with to zfsbackup receive --decompressCommand if the program of the command does not decompress them when run with the -d and -c flags.")
+	sendCmd.Flags().IntVar(&jobInfo.CompressionLevel, "compressionLevel", 6, "the compression level to use with the compressor. Valid values are between 1-9, or 1-22 for the zstd, zstd-seekable and adaptive compressors.")
+	sendCmd.Flags().BoolVar(&jobInfo.AdaptiveCompressionLevel, "adaptiveCompressionLevel", false, "set this flag to adapt the compression level of each volume to the upload throughput, starting at --compressionLevel. The level is lowered when volumes are compressed slower than they are uploaded and raised when there is CPU headroom to spare, between --minCompressionLevel and --maxCompressionLevel. The level used is recorded for each volume in the manifest.")
+	sendCmd.Flags().IntVar(&jobInfo.MinCompressionLevel, "minCompressionLevel", 1, "the lowest compression level to use when using --adaptiveCompressionLevel.")
+	sendCmd.Flags().IntVar(&jobInfo.MaxCompressionLevel, "maxCompressionLevel", 9, "the highest compression level to use when using --adaptiveCompressionLevel, up to 9, or 22 for the zstd compressors.")
+	sendCmd.Flags().IntVar(&jobInfo.CompressionBlockSize, "compressionBlockSize", helpers.DefaultCompressionBlockSize, "the size, in KiB, of the blocks compressed independently by the zstd-seekable compressor. Smaller blocks allow reading smaller ranges of a volume at the cost of a worse compression ratio. A minimum of 64KiB and maximum of 64MiB is enforced.")
+	sendCmd.Flags().StringVar(&compressionCPUs, "compressionCPUs", "", "ADVANCED, Linux only: pin the worker compressing and encrypting the send stream, along with the zfs send and external compressor processes it starts, to these CPUs, e.g. the cpulist of the NUMA node closest to the disks (0-7,16-23). The goroutines the internal compressors start are not pinned, Go only allows pinning the thread of the calling goroutine.")
+	sendCmd.Flags().StringVar(&uploadCPUs, "uploadCPUs", "", "ADVANCED, Linux only: pin the upload workers to these CPUs, e.g. the cpulist of the NUMA node closest to the NIC (0-7,16-23). Goroutines started by the backends' clients are not pinned.")
+	sendCmd.Flags().IntVar(&jobInfo.CompressionConcurrency, "compressionConcurrency", 1, "the number of blocks of each volume the zstd-seekable compressor will compress in parallel. The blocks are written out in order so the volumes are identical to those compressed one block at a time. Use 0 to use one per CPU.")
+	sendCmd.Flags().Int64Var(&jobInfo.StartAtVolume, "startAtVolume", 0, "EXPERT OPTION: start uploading at this volume number instead of resuming from where the previous attempt left off. The previous volumes are trusted to be intact at the destination(s) and are only checked for existence. Requires the local manifest from the previous attempt and the same command line arguments.")
+	sendCmd.Flags().BoolVar(&jobInfo.DedupVolumes, "dedupVolumes", false, "set this flag to reference volumes that are identical to ones already uploaded by other backup sets in the target destination(s) instead of uploading them again. The clean command will only delete such volumes once no backup set refers to them. Has no effect with --encryptTo or --signFrom, as encrypted or signed volumes are never identical.")
 	sendCmd.Flags().BoolVar(&jobInfo.Resume, "resume", false, "set this flag to true when you want to try and resume a previously cancled or failed backup. It is up to the caller to ensure the same command line arguments are provided between the original backup and the resumed one.")
 	sendCmd.Flags().BoolVar(&jobInfo.Full, "full", false, "set this flag to take a full backup of the specified volume using the most recent snapshot.")
+	sendCmd.Flags().BoolVar(&jobInfo.DryRun, "dryRun", false, "set this flag to estimate the size of the send stream with zfs send -nP and log the volumes it would be split into and uploaded to each destination as, without sending the stream, running any hooks, uploading anything or writing a manifest. The destination(s) are only read from to select the snapshots when using a \"smart\" option.")
 	sendCmd.Flags().BoolVar(&jobInfo.Incremental, "increment", false, "set this flag to do an incremental backup of the most recent snapshot from the most recent snapshot found in the target.")
 	sendCmd.Flags().DurationVar(&jobInfo.FullIfOlderThan, "fullIfOlderThan", -1*time.Minute, "set this flag to do an incremental backup of the most recent snapshot from the most recent snapshot found in the target unless the it's been greater than the time specified in this flag, then do a full backup.")
-	sendCmd.Flags().StringVar(&jobInfo.Compressor, "compressor", helpers.InternalCompressor, "specify to use the internal (parallel) gzip implementation or an external binary (e.g. gzip, bzip2, pigz, lzma, xz, etc.) Syntax must be similar to the gzip compression tool) to compress the stream for storage. Please take into consideration time, memory, and CPU usage for any of the compressors used. All manifests utilize the internal compressor.")
+	sendCmd.Flags().StringVar(&jobInfo.SnapshotTemplate, "snapshotTemplate", "", "take a snapshot of each dataset to backup, named after this template, and back it up. Only provide the dataset(s) when using this flag. The template may use the strftime-like tokens %Y %y %m %d %H %M %S %j %s %Z, %n for the last component of the dataset name, and %D for the dataset name with each / replaced by _ (e.g. zfsbackup-%Y-%m-%dT%H-%M). Can be combined with a \"smart\" option to choose what the new snapshot increments from.")
+	sendCmd.Flags().BoolVar(&jobInfo.WaitForLock, "waitForLock", false, "set this flag to wait for another backup of the same dataset to the same destinations to finish instead of exiting with an already running status (exit status 75). When using a \"smart\" option, what to backup is decided again once the other backup finishes.")
+	sendCmd.Flags().BoolVar(&jobInfo.StrictSnapshotOrder, "strictSnapshotOrder", false, "set this flag to fail instead of warning when a snapshot along the incremental chain was created before the snapshot it increments from, e.g. due to renamed snapshots or clock issues.")
+	sendCmd.Flags().StringVar(&jobInfo.Compressor, "compressor", helpers.InternalCompressor, "specify to use the internal (parallel) gzip implementation, the builtin zstd implementation (zstd), the builtin zstd implementation compressing blocks of --compressionBlockSize independently so ranges of a volume can be decompressed on their own (zstd-seekable), adaptive to select between zstd and no compression for each volume based on a sample of its data, an external binary (e.g. gzip, bzip2, pigz, lzma, xz, etc.) Syntax must be similar to the gzip compression tool), or external to pipe the stream through the command line given with --compressCommand, to compress the stream for storage. Please take into consideration time, memory, and CPU usage for any of the compressors used. All manifests utilize the internal compressor, at up to level 9.")
 
 	sendCmd.Flags().IntVar(&jobInfo.MaxFileBuffer, "maxFileBuffer", 5, "the maximum number of files to have active during the upload process. Should be set to at least the number of max parallel uploads. Set to 0 to bypass local storage and upload straight to your destination - this will limit you to a single destination and disable any hash checks for the upload where available.")
 	sendCmd.Flags().IntVar(&jobInfo.MaxParallelUploads, "maxParallelUploads", 4, "the maximum number of uploads to run in parallel.")
+	sendCmd.Flags().BoolVar(&jobInfo.AutoTuneUploads, "autoTuneUploads", false, "set this flag to tune the number of parallel uploads to each destination, starting at --minParallelUploads and ramping up to --maxParallelUploads while throughput improves. The number of parallel uploads is halved when uploads fail (e.g. due to throttling) and the settled number is reported at the end.")
+	sendCmd.Flags().IntVar(&jobInfo.MinParallelUploads, "minParallelUploads", 1, "the minimum number of uploads to run in parallel when using --autoTuneUploads.")
+	sendCmd.Flags().IntVar(&jobInfo.ObjectCountWarning, "objectCountWarning", 0, "warn when a backup would bring the number of objects in a destination, counting the objects already there and the volumes planned from an estimate of the send stream, to this many. Some providers degrade past a certain number of objects under a single prefix. Use 0 to disable.")
+	sendCmd.Flags().IntVar(&jobInfo.MaxObjectCount, "maxObjectCount", 0, "fail a backup before it starts if it would bring the number of objects in a destination past this many, see --objectCountWarning. Use 0 to disable.")
+	sendCmd.Flags().StringVar(&jobInfo.OnSnapshotChange, "onSnapshotChange", helpers.SnapshotChangeAbort, "what to do when the backup fails because the snapshot being sent was destroyed or created again under the same name, detected by its GUID. Either abort to fail the backup with a clear error, or restart to back up the snapshot created again from scratch, once. A backup is never restarted when the snapshot it increments from changed.")
+	sendCmd.Flags().StringVar(&jobInfo.ScratchCheck, "scratchCheck", helpers.ScratchCheckWarn, "check the scratch filesystem in the working directory has the free space and inodes to buffer --maxFileBuffer volumes of --volsize before the backup starts, either off, warn to log a warning or fail to stop the backup when it does not.")
+	sendCmd.Flags().StringVar(&startWindow, "startWindow", "", "only start the backup if it is started within this time of day, in the local time zone, formatted as HH:MM-HH:MM (e.g. 22:00-06:00). Otherwise the backup is not started, without touching the destination(s), and the program exits with a status of 3 so delayed backups do not run into peak hours.")
+	sendCmd.Flags().BoolVar(&jobInfo.CheckDestinationSpace, "checkDestinationSpace", false, "set this flag to fail a backup before it starts if a destination does not have the free space to store it, estimated from the size of the send stream. Only destinations that can report their free space are checked (supported by the file and ssh backends, the latter only when the server supports the statvfs extension, and by the swift backend when the account has a quota set).")
+	sendCmd.Flags().Uint64Var(&jobInfo.MinFreeSpace, "minFreeSpace", 0, "the free space (in MiB) to keep in each destination once the backup is stored when using --checkDestinationSpace.")
+	sendCmd.Flags().IntVar(&jobInfo.UploadQuorum, "uploadQuorum", 0, "upload each volume to all destinations at once, e.g. buckets in different regions, and consider it uploaded once this many destinations acknowledged it. The remaining destinations are retried in the background and a destination being down does not fail the backup as long as the quorum is reached. The destinations each volume was uploaded to are recorded in the manifest so it can be restored by providing any of them. Use 0 to upload to each destination in turn.")
+	sendCmd.Flags().DurationVar(&jobInfo.QuorumStragglerTimeout, "quorumStragglerTimeout", 10*time.Minute, "how long to wait, once the manifest is uploaded, for the uploads to the destinations that did not acknowledge a volume within the --uploadQuorum before cancelling them. The backup is complete without them. Use 0 to cancel them right away.")
 	sendCmd.Flags().Uint64Var(&maxUploadSpeed, "maxUploadSpeed", 0, "the maximum upload speed (in KB/s) the program should use between all upload workers. Use 0 for no limit")
+	sendCmd.Flags().DurationVar(&jobInfo.UploadTimeout, "uploadTimeout", 0, "cancel and retry the upload of a volume that did not complete within this long, e.g. when it stalled on a half-open connection. Added to the time allowed by --minUploadSpeed when both are set. Use 0 to disable.")
+	sendCmd.Flags().Uint64Var(&jobInfo.MinUploadThroughput, "minUploadSpeed", 0, "cancel and retry the upload of a volume that did not complete within the time it takes to upload it at this speed (in KB/s), allowing at least a minute per upload unless --uploadTimeout is set. Use 0 to disable.")
 	sendCmd.Flags().DurationVar(&jobInfo.MaxRetryTime, "maxRetryTime", 12*time.Hour, "the maximum time that can elapse when retrying a failed upload. Use 0 for no limit.")
 	sendCmd.Flags().DurationVar(&jobInfo.MaxBackoffTime, "maxBackoffTime", 30*time.Minute, "the maximum delay you'd want a worker to sleep before retrying an upload.")
 	sendCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names.")
+	sendCmd.Flags().StringVar(&jobInfo.HashAlgorithm, "hashAlgorithm", helpers.SHA256Hash, "the hash algorithm used to verify the integrity of each volume when restoring, either md5 or sha256 unless others have been registered. It is recorded in the manifest.")
+	sendCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case to use for dataset and snapshot names in object names, either preserve or lower. Use lower when moving backups between providers that do not treat object names as case sensitive.")
+	sendCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "replace the '/' between dataset names with this string in object names. Useful for providers that treat '/' as a path delimiter.")
+	sendCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path to use the full path of the dataset (including the pool) or hash to also add a hash of the path. Use hash to keep the object names of datasets unique when they only differ in ways normalized by --keyCase. It is recorded in the manifest.")
 	sendCmd.Flags().IntVar(&jobInfo.UploadChunkSize, "uploadChunkSize", 10, "the chunk size, in MiB, to use when uploading. A minimum of 5MiB and maximum of 100MiB is enforced.")
+	sendCmd.Flags().IntVar(&jobInfo.UploadPartRetries, "uploadPartRetries", 5, "the number of times a single failed chunk of a volume is retried on its own before the whole volume upload is retried (only supported by the s3 backend). Retries back off up to --maxBackoffTime. Use 0 to keep the default of the backend.")
+	sendCmd.Flags().BoolVar(&jobInfo.GenerateChecksums, "checksums", false, "set this flag to upload the SHA256 checksums of the volumes, as they are stored after compression and encryption, in the format of sha256sum alongside the backup set. They are not encrypted, so zfsbackup verify-integrity --keyless can verify the stored objects without the keys of the backup set.")
+	sendCmd.Flags().BoolVar(&jobInfo.GenerateRestoreScript, "restoreScript", false, "set this flag to upload a bash script alongside the backup set documenting its objects and the commands (sha256sum, gpg, gzip/zstd, zfs receive) needed to restore it manually if zfsbackup is not available. It is not a substitute for the receive command.")
+	sendCmd.Flags().StringVar(&jobInfo.GroupName, "group", "", "backup a comma separated list of datasets as a single backup set with this name. The datasets are backed up in order and the backup set is only written if all of them succeed.")
+	sendCmd.Flags().StringVar(&jobInfo.SnapshotList, "snapshotList", "", "read the snapshots to backup, in order, from this file (use - for stdin) instead of the command line, only the destination(s) are provided as arguments. Each line holds a dataset@snapshot to backup, optionally followed by the snapshot of the same dataset it increments from (e.g. tank/data@daily2 @daily1). Blank lines and lines starting with # are ignored.")
+	sendCmd.Flags().StringArrayVar(&jobInfo.DatasetOverrides, "datasetOverride", nil, "override the compressor, compressionLevel, and/or encryptTo settings for a single dataset, may be repeated (e.g. --datasetOverride tank/media:compressor=none,encryptTo=none). Use an encryptTo of none to store the dataset without encryption or signing. The effective settings are recorded in the dataset's manifest, restore it with matching keys.")
+	sendCmd.Flags().StringVar(&jobInfo.MaxFailures, "maxFailures", "", "when backing up a comma separated list of datasets independently, abort the remaining datasets once more than this many (e.g. 3) or this percentage (e.g. 25%) of them have failed. By default every dataset is attempted.")
+	sendCmd.Flags().BoolVar(&jobInfo.SkipUnchanged, "skipUnchanged", false, "skip incremental backups of datasets with no more than --unchangedThreshold bytes written since the snapshot they increment from (their written@<snapshot> property) instead of creating a near-empty backup set. Skipped datasets are reported as unchanged in the summary and increment from the same snapshot next time.")
+	sendCmd.Flags().Uint64Var(&jobInfo.UnchangedThreshold, "unchangedThreshold", 0, "the number of bytes written since the last backed up snapshot at or below which a dataset is considered unchanged with --skipUnchanged. Use 0 to only skip datasets with nothing written.")
+	sendCmd.Flags().StringVar(&jobInfo.MetricsTextfileDir, "metricsTextfileDir", "", "write the outcome of the backup (last success time, bytes, duration, and status) to a .prom file in this directory for the Prometheus node_exporter textfile collector.")
+	sendCmd.Flags().DurationVar(&jobInfo.ImmutabilityPeriod, "immutabilityPeriod", 0, "apply a time-based retention policy to each uploaded object so it cannot be modified or deleted for this long (only supported by the azure backend, the container must have version-level immutability support enabled). Use 0 to disable.")
+	sendCmd.Flags().BoolVar(&jobInfo.ImmutabilityLocked, "immutabilityLocked", false, "set this flag to lock the retention policies applied with --immutabilityPeriod so they can no longer be shortened or removed.")
+	sendCmd.Flags().BoolVar(&jobInfo.LegalHold, "legalHold", false, "set this flag to place a legal hold on each uploaded object so it cannot be modified or deleted until the hold is cleared (only supported by the azure backend, the container must have version-level immutability support enabled).")
+	sendCmd.Flags().BoolVar(&jobInfo.ConditionalUpload, "conditionalUpload", false, "set this flag to upload volumes with a conditional request (If-None-Match: *) that fails if the object already exists, in which case the volume is treated as already uploaded and skipped. Makes retried or racing uploads safe without overwriting a good object (only supported by the s3 backend).")
+	sendCmd.Flags().StringVar(&jobInfo.VerifyUploads, "verifyUploads", "", "verify each uploaded object once its upload completes, retrying the upload on a mismatch. Use etag (the default when no value is given) to check the size and ETag of each object against the volume (only supported by the s3 backend), or readback to download each volume again and compare its checksum against the volume, failing the backup with an error naming the object if it still does not match after the retries. readback roughly doubles the bandwidth used, requires a maxFileBuffer greater than 0 and is not supported for destinations uploading to an archival storage class.")
+	sendCmd.Flags().Lookup("verifyUploads").NoOptDefVal = helpers.VerifyUploadsETag
+	sendCmd.Flags().StringVar(&jobInfo.StorageClass, "storageClass", "", "the storage class to upload volumes to, e.g. STANDARD_IA, INTELLIGENT_TIERING, GLACIER_IR, GLACIER or DEEP_ARCHIVE. Manifests are always uploaded to the STANDARD class so backup sets can be listed without restoring them first, and volumes in GLACIER or DEEP_ARCHIVE must be restored before they can be received (only supported by the s3 backend). Leave empty to use the STANDARD class.")
+	sendCmd.Flags().StringVar(&jobInfo.ServerSideEncryption, "serverSideEncryption", "", "encrypt uploaded objects at rest in the destination, either AES256 for keys managed by S3 (SSE-S3) or aws:kms for keys managed by KMS (SSE-KMS). Objects are decrypted transparently when downloaded (only supported by the s3 backend). Leave empty to use the default encryption of the bucket.")
+	sendCmd.Flags().StringVar(&jobInfo.KMSKeyID, "kmsKeyID", "", "the ID, ARN or alias of the KMS key to encrypt uploaded objects with when --serverSideEncryption is aws:kms. Leave empty to use the AWS managed key of the account.")
+	sendCmd.Flags().StringVar(&jobInfo.ManifestFormat, "manifestFormat", helpers.ManifestFormatJSON, "the format to write manifests in, either json or binary. The binary format is a compact gob encoding that is smaller and faster to parse for backup sets with many volumes or datasets, but cannot be read by versions of zfsbackup older than this one. Manifests in either format are detected and read automatically.")
+	sendCmd.Flags().Uint64Var(&jobInfo.MaxManifestSize, "maxManifestSize", 0, "the maximum size (in MiB) of a manifest before its list of volumes is split into manifest parts, uploaded as separate objects next to the manifest which ties them together. Useful for very large (e.g. recursive) backups with many volumes. Split manifests are reassembled automatically but cannot be read by versions of zfsbackup older than this one. Use 0 to never split manifests.")
+	sendCmd.Flags().DurationVar(&jobInfo.ExpireAfter, "expireAfter", 0, "set an expiry this long after the start of the backup on each uploaded object and record it in the manifest (e.g. 720h). Objects are uploaded with an Expires header and a zfsbackup-expire-days=<days> tag for a bucket lifecycle rule to expire them, the clean command removes the remains of expired backup sets (only supported by the s3 backend). Use 0 to disable.")
 }
 
 // ResetSendJobInfo exists solely for integration testing
@@ -102,39 +204,110 @@ func ResetSendJobInfo() {
 	jobInfo.Replication = false
 	jobInfo.Deduplication = false
 	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+	jobInfo.IncrementalBookmark = ""
 	jobInfo.BaseSnapshot = helpers.SnapshotInfo{}
 	fullIncremental = ""
 	jobInfo.Properties = false
+	jobInfo.LargeBlocks = false
+	jobInfo.CompressedSend = false
+	jobInfo.RawSend = false
+	jobInfo.SyncUserProperties = false
+	jobInfo.UserPropertyNamespaces = nil
+	metadataPairs = nil
+	jobInfo.Metadata = nil
+	jobInfo.MetadataHook = ""
 
 	// Specific to download only
 	jobInfo.VolumeSize = 200
 	jobInfo.CompressionLevel = 6
+	jobInfo.CompressionBlockSize = helpers.DefaultCompressionBlockSize
+	jobInfo.CompressionConcurrency = 1
+	jobInfo.SingleObject = false
+	jobInfo.SingleObjectBelow = 0
 	jobInfo.Resume = false
+	jobInfo.StartAtVolume = 0
+	jobInfo.DedupVolumes = false
 	jobInfo.Full = false
+	jobInfo.DryRun = false
 	jobInfo.Incremental = false
 	jobInfo.FullIfOlderThan = -1 * time.Minute
+	jobInfo.StrictSnapshotOrder = false
+	jobInfo.SnapshotTemplate = ""
+	jobInfo.WaitForLock = false
 
 	jobInfo.MaxFileBuffer = 5
 	jobInfo.MaxParallelUploads = 4
 	maxUploadSpeed = 0
+	jobInfo.UploadTimeout = 0
+	jobInfo.MinUploadThroughput = 0
 	jobInfo.MaxRetryTime = 12 * time.Hour
 	jobInfo.MaxBackoffTime = 30 * time.Minute
 	jobInfo.Separator = "|"
+	jobInfo.HashAlgorithm = helpers.SHA256Hash
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
 	jobInfo.UploadChunkSize = 10
+	jobInfo.UploadPartRetries = 5
 	jobInfo.Compressor = helpers.InternalCompressor
+	jobInfo.CompressCommand = ""
+	jobInfo.GenerateRestoreScript = false
+	jobInfo.GenerateChecksums = false
+	jobInfo.GroupName = ""
+	jobInfo.MaxFailures = ""
+	jobInfo.SkipUnchanged = false
+	jobInfo.UnchangedThreshold = 0
+	jobInfo.UploadQuorum = 0
+	jobInfo.QuorumStragglerTimeout = 10 * time.Minute
+	jobInfo.ObjectCountWarning = 0
+	jobInfo.MaxObjectCount = 0
+	jobInfo.CheckDestinationSpace = false
+	jobInfo.MinFreeSpace = 0
+	jobInfo.ScratchCheck = helpers.ScratchCheckWarn
+	jobInfo.StartWindow = nil
+	startWindow = ""
+	jobInfo.CompressionCPUs = nil
+	jobInfo.UploadCPUs = nil
+	compressionCPUs = ""
+	uploadCPUs = ""
+	jobInfo.OnSnapshotChange = helpers.SnapshotChangeAbort
+	jobInfo.AutoTuneUploads = false
+	jobInfo.MinParallelUploads = 1
+	jobInfo.AdaptiveCompressionLevel = false
+	jobInfo.MinCompressionLevel = 1
+	jobInfo.MaxCompressionLevel = 9
+	jobInfo.DatasetOverrides = nil
+	jobInfo.SnapshotList = ""
+	jobInfo.GroupMembers = nil
+	jobInfo.MetricsTextfileDir = ""
+	jobInfo.ImmutabilityPeriod = 0
+	jobInfo.ImmutabilityLocked = false
+	jobInfo.LegalHold = false
+	jobInfo.ConditionalUpload = false
+	jobInfo.VerifyUploads = ""
+	jobInfo.StorageClass = ""
+	jobInfo.ServerSideEncryption = ""
+	jobInfo.KMSKeyID = ""
+	jobInfo.ManifestFormat = helpers.ManifestFormatJSON
+	jobInfo.MaxManifestSize = 0
+	jobInfo.ExpireAfter = 0
+	jobInfo.ExpiresAt = nil
 }
 
 func updateJobInfo(args []string) error {
 	jobInfo.StartTime = time.Now()
 	jobInfo.Version = helpers.VersionNumber
 
+	if err := jobInfo.CheckStartWindow(jobInfo.StartTime); err != nil {
+		helpers.AppLogger.Errorf("The backup was started at %s, outside of its allowed start window of %s, it will not be started.", jobInfo.StartTime.Format("15:04"), jobInfo.StartWindow)
+		return err
+	}
+
 	if fullIncremental != "" {
 		jobInfo.IncrementalSnapshot.Name = fullIncremental
 		jobInfo.IntermediaryIncremental = true
 	}
 
-	parts := strings.Split(args[0], "@")
-	jobInfo.VolumeName = parts[0]
 	jobInfo.Destinations = strings.Split(args[1], ",")
 
 	if len(jobInfo.Destinations) > 1 && jobInfo.MaxFileBuffer == 0 {
@@ -153,41 +326,196 @@ func updateJobInfo(args []string) error {
 		}
 	}
 
+	if jobInfo.ExpireAfter > 0 {
+		for _, destination := range jobInfo.Destinations {
+			if !strings.HasPrefix(destination, backends.AWSS3BackendPrefix+"://") {
+				helpers.AppLogger.Warningf("Objects uploaded to %s will not expire, only the s3 backend supports the --expireAfter flag.", destination)
+			}
+		}
+	}
+
+	if jobInfo.StorageClass != "" {
+		for _, destination := range jobInfo.Destinations {
+			if !strings.HasPrefix(destination, backends.AWSS3BackendPrefix+"://") {
+				helpers.AppLogger.Warningf("Volumes uploaded to %s will use its default storage class, only the s3 backend supports the --storageClass flag.", destination)
+			}
+		}
+	}
+
+	if jobInfo.SnapshotList != "" {
+		return updateJobInfoFromList()
+	}
+
+	if jobInfo.GroupName != "" {
+		for _, dataset := range strings.Split(args[0], ",") {
+			member := jobInfo
+			member.GroupName = ""
+			member.GroupMembers = nil
+			member.Destinations = append([]string(nil), jobInfo.Destinations...)
+			if err := updateSnapshotInfo(&member, dataset); err != nil {
+				return err
+			}
+			jobInfo.GroupMembers = append(jobInfo.GroupMembers, &member)
+		}
+		if err := helpers.CheckKeyCollisions(jobInfo.GroupMembers); err != nil {
+			helpers.AppLogger.Errorf("Cannot backup the datasets provided - %v", err)
+			return errInvalidInput
+		}
+
+		// The group's manifest is named after the group and the time it was taken
+		jobInfo.VolumeName = jobInfo.GroupName
+		jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: jobInfo.StartTime.UTC().Format("20060102T150405Z"), CreationTime: jobInfo.StartTime}
+		jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+		jobInfo.IncrementalBookmark = ""
+		jobInfo.IntermediaryIncremental = false
+		return nil
+	}
+
+	if datasets := strings.Split(args[0], ","); len(datasets) > 1 {
+		for _, dataset := range datasets {
+			member := jobInfo
+			member.Datasets = nil
+			member.Destinations = append([]string(nil), jobInfo.Destinations...)
+			if err := updateSnapshotInfo(&member, dataset); err == backup.ErrNoOp {
+				helpers.AppLogger.Noticef("Nothing new to backup for %s, skipping it.", dataset)
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := member.ApplyDatasetOverride(); err != nil {
+				helpers.AppLogger.Errorf("Could not apply the dataset override for %s - %v", member.VolumeName, err)
+				return errInvalidInput
+			}
+			jobInfo.Datasets = append(jobInfo.Datasets, &member)
+		}
+		if len(jobInfo.Datasets) == 0 {
+			return backup.ErrNoOp
+		}
+		if err := helpers.CheckKeyCollisions(jobInfo.Datasets); err != nil {
+			helpers.AppLogger.Errorf("Cannot backup the datasets provided - %v", err)
+			return errInvalidInput
+		}
+
+		// The run is reported under the list of datasets it was given
+		jobInfo.VolumeName = args[0]
+		return nil
+	}
+
+	if err := updateSnapshotInfo(&jobInfo, args[0]); err != nil {
+		return err
+	}
+	if err := jobInfo.ApplyDatasetOverride(); err != nil {
+		helpers.AppLogger.Errorf("Could not apply the dataset override for %s - %v", jobInfo.VolumeName, err)
+		return errInvalidInput
+	}
+
+	return nil
+}
+
+// updateJobInfoFromList will add a dataset to backup for each snapshot read from the snapshot list, in order.
+func updateJobInfoFromList() error {
+	entries, err := helpers.LoadSnapshotList(jobInfo.SnapshotList)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not read the snapshot list %s - %v", jobInfo.SnapshotList, err)
+		return errInvalidInput
+	}
+	if len(entries) == 0 {
+		helpers.AppLogger.Errorf("The snapshot list %s does not list any snapshots to backup.", jobInfo.SnapshotList)
+		return errInvalidInput
+	}
+
+	for _, entry := range entries {
+		member := jobInfo
+		member.Datasets = nil
+		member.Destinations = append([]string(nil), jobInfo.Destinations...)
+		member.IncrementalSnapshot = helpers.SnapshotInfo{Name: entry.Incremental}
+		// Checks the snapshot, and the one it increments from, exist and are in order
+		if err = updateSnapshotInfo(&member, fmt.Sprintf("%s@%s", entry.Dataset, entry.Snapshot)); err != nil {
+			helpers.AppLogger.Errorf("Invalid entry %s in the snapshot list - %v", entry, err)
+			return err
+		}
+		if err = member.ApplyDatasetOverride(); err != nil {
+			helpers.AppLogger.Errorf("Could not apply the dataset override for %s - %v", member.VolumeName, err)
+			return errInvalidInput
+		}
+		jobInfo.Datasets = append(jobInfo.Datasets, &member)
+	}
+	if err = helpers.CheckKeyCollisions(jobInfo.Datasets); err != nil {
+		helpers.AppLogger.Errorf("Cannot backup the datasets in the snapshot list %s - %v", jobInfo.SnapshotList, err)
+		return errInvalidInput
+	}
+
+	// The run is reported under the list it was given
+	jobInfo.VolumeName = jobInfo.SnapshotList
+	return nil
+}
+
+func updateSnapshotInfo(j *helpers.JobInfo, target string) error {
+	smart := j.Full || j.Incremental || j.FullIfOlderThan != -1*time.Minute
+	if j.SnapshotTemplate != "" {
+		snapshot, err := takeSnapshot(j, target)
+		if err != nil {
+			return err
+		}
+		// A "smart" option will pick up the new snapshot as the most recent one
+		if !smart {
+			target = fmt.Sprintf("%s@%s", target, snapshot)
+		}
+	}
+
+	parts := strings.Split(target, "@")
+	j.VolumeName = parts[0]
+
 	// If we aren't using a "smart" option, rely on the user to provide the snapshots to use!
-	if !jobInfo.Full && !jobInfo.Incremental && jobInfo.FullIfOlderThan == -1*time.Minute {
+	if !smart {
 		if len(parts) != 2 {
-			helpers.AppLogger.Errorf("Invalid base snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+			helpers.AppLogger.Errorf("Invalid base snapshot provided. Expected format <volume>@<snapshot>, got %s instead", target)
 			return errInvalidInput
 		}
-		jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
-		creationTime, err := helpers.GetCreationDate(context.TODO(), args[0])
+		j.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
+		creationTime, err := helpers.GetCreationDate(context.TODO(), target)
 		if err != nil {
 			helpers.AppLogger.Errorf("Error trying to get creation date of specified base snapshot - %v", err)
 			return err
 		}
-		jobInfo.BaseSnapshot.CreationTime = creationTime
+		j.BaseSnapshot.CreationTime = creationTime
 
-		if jobInfo.IncrementalSnapshot.Name != "" {
-			jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
-			jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+		if j.IncrementalSnapshot.Name != "" {
+			j.IncrementalSnapshot.Name = strings.TrimPrefix(j.IncrementalSnapshot.Name, j.VolumeName)
+			if strings.HasPrefix(j.IncrementalSnapshot.Name, "#") {
+				// The backup set is received on top of the snapshot the bookmark was created from, found by its GUID
+				j.IncrementalBookmark = strings.TrimPrefix(j.IncrementalSnapshot.Name, "#")
+				j.IncrementalSnapshot = helpers.SnapshotInfo{}
+				if err = backup.ResolveIncrementalBookmark(context.TODO(), j); err != nil {
+					helpers.AppLogger.Errorf("Refusing to send an incremental backup from the bookmark %s - %v", j.IncrementalBookmark, err)
+					return err
+				}
+				return nil
+			}
+			j.IncrementalSnapshot.Name = strings.TrimPrefix(j.IncrementalSnapshot.Name, "@")
 
-			creationTime, err = helpers.GetCreationDate(context.TODO(), fmt.Sprintf("%s@%s", jobInfo.VolumeName, jobInfo.IncrementalSnapshot.Name))
+			creationTime, err = helpers.GetCreationDate(context.TODO(), j.IncrementalSource())
 			if err != nil {
 				helpers.AppLogger.Errorf("Error trying to get creation date of specified incremental snapshot - %v", err)
 				return err
 			}
-			jobInfo.IncrementalSnapshot.CreationTime = creationTime
+			j.IncrementalSnapshot.CreationTime = creationTime
+
+			if err = j.CheckSnapshotChain([]helpers.SnapshotInfo{j.IncrementalSnapshot, j.BaseSnapshot}); err != nil {
+				helpers.AppLogger.Errorf("Refusing to send an incremental backup - %v", err)
+				return err
+			}
 		}
 	} else {
 		// Some basic checks here
 		onlyOneCheck := 0
-		if jobInfo.Full {
+		if j.Full {
 			onlyOneCheck++
 		}
-		if jobInfo.Incremental {
+		if j.Incremental {
 			onlyOneCheck++
 		}
-		if jobInfo.FullIfOlderThan != -1*time.Minute {
+		if j.FullIfOlderThan != -1*time.Minute {
 			onlyOneCheck++
 		}
 		if onlyOneCheck > 1 {
@@ -198,7 +526,7 @@ func updateJobInfo(args []string) error {
 			helpers.AppLogger.Errorf("When using a smart option, please only specify the volume to backup, do not include any snapshot information.")
 			return errInvalidInput
 		}
-		if err := backup.ProcessSmartOptions(context.Background(), &jobInfo); err != nil {
+		if err := backup.ProcessSmartOptions(context.Background(), j); err != nil {
 			helpers.AppLogger.Errorf("Error while trying to process smart option - %v", err)
 			return err
 		}
@@ -208,21 +536,270 @@ func updateJobInfo(args []string) error {
 	return nil
 }
 
+// takeSnapshot will take a snapshot of the dataset named after the snapshot name template and return its name.
+func takeSnapshot(j *helpers.JobInfo, dataset string) (string, error) {
+	name, err := helpers.RenderSnapshotName(j.SnapshotTemplate, dataset, j.StartTime)
+	if err != nil {
+		helpers.AppLogger.Errorf("Could not name the snapshot of %s - %v", dataset, err)
+		return "", err
+	}
+
+	if _, err = helpers.CreateSnapshot(context.TODO(), dataset, name); err == helpers.ErrSnapshotExists {
+		helpers.AppLogger.Errorf("Could not create the snapshot %s@%s as it already exists, the snapshot name template must render a different name for each backup.", dataset, name)
+		return "", err
+	} else if err != nil {
+		helpers.AppLogger.Errorf("Could not create the snapshot %s@%s - %v", dataset, name, err)
+		return "", err
+	}
+
+	helpers.AppLogger.Infof("Created snapshot %s@%s.", dataset, name)
+	return name, nil
+}
+
 func validateSendFlags(cmd *cobra.Command, args []string) error {
+	// The snapshots to backup are read from the list, only the destinations are provided
+	if jobInfo.SnapshotList != "" && len(args) == 1 {
+		args = []string{"", args[0]}
+	} else if jobInfo.SnapshotList != "" {
+		helpers.AppLogger.Errorf("Only provide the destination(s) when reading the snapshots to backup from a list.")
+		return errInvalidInput
+	}
+
 	if len(args) != 2 {
 		cmd.Usage()
 		return errInvalidInput
 	}
 
+	if jobInfo.SnapshotList != "" && (jobInfo.GroupName != "" || jobInfo.Full || jobInfo.Incremental || jobInfo.FullIfOlderThan != -1*time.Minute || jobInfo.IncrementalSnapshot.Name != "" || fullIncremental != "") {
+		helpers.AppLogger.Errorf("The --snapshotList flag cannot be combined with the --group flag, a \"smart\" option, or the -i and -I flags, the list provides the snapshots to increment from.")
+		return errInvalidInput
+	}
+
 	if jobInfo.IncrementalSnapshot.Name != "" && fullIncremental != "" {
 		helpers.AppLogger.Errorf("The flags -i and -I are mutually exclusive. Please specify only one of these flags.")
 		return errInvalidInput
 	}
 
+	if strings.Contains(fullIncremental, "#") {
+		helpers.AppLogger.Errorf("The -I flag requires a snapshot, a bookmark can only be incremented from with the -i flag.")
+		return errInvalidInput
+	}
+
+	if jobInfo.SnapshotTemplate != "" {
+		if jobInfo.SnapshotList != "" || jobInfo.Resume || jobInfo.StartAtVolume > 0 {
+			helpers.AppLogger.Errorf("The --snapshotTemplate flag cannot be combined with the --snapshotList flag or resuming a backup.")
+			return errInvalidInput
+		}
+		timed := true
+		for _, dataset := range strings.Split(args[0], ",") {
+			if strings.Contains(dataset, "@") {
+				helpers.AppLogger.Errorf("When using the --snapshotTemplate flag, please only specify the dataset(s) to snapshot and backup, do not include any snapshot information.")
+				return errInvalidInput
+			}
+			var err error
+			if timed, err = helpers.ValidateSnapshotTemplate(jobInfo.SnapshotTemplate, dataset); err != nil {
+				helpers.AppLogger.Errorf("Invalid snapshot name template - %v", err)
+				return errInvalidInput
+			}
+		}
+		if !timed {
+			helpers.AppLogger.Warningf("The snapshot name template %s does not use any date or time tokens, the backup will fail if a snapshot of the same name already exists.", jobInfo.SnapshotTemplate)
+		}
+	}
+
 	if err := jobInfo.ValidateSendFlags(); err != nil {
 		helpers.AppLogger.Error(err)
 		return err
 	}
 
+	// Only record a block size in the manifest when it is used
+	if jobInfo.Compressor != helpers.SeekableZstdCompressor {
+		jobInfo.CompressionBlockSize = 0
+	}
+
+	if jobInfo.CompressCommand != "" && jobInfo.Compressor != helpers.ExternalCompressor {
+		helpers.AppLogger.Errorf("The --compressCommand flag requires --compressor to be %s, %s was given.", helpers.ExternalCompressor, jobInfo.Compressor)
+		return errInvalidInput
+	}
+
+	if jobInfo.GroupName != "" && (jobInfo.Resume || jobInfo.StartAtVolume > 0) {
+		helpers.AppLogger.Errorf("Resuming a grouped backup is not supported.")
+		return errInvalidInput
+	}
+
+	if jobInfo.DryRun && (jobInfo.GroupName != "" || jobInfo.Resume || jobInfo.StartAtVolume > 0) {
+		helpers.AppLogger.Errorf("The --dryRun flag cannot be combined with the --group flag or resuming a backup.")
+		return errInvalidInput
+	}
+
+	if jobInfo.DryRun && jobInfo.SnapshotTemplate != "" {
+		helpers.AppLogger.Errorf("The --dryRun flag cannot be combined with the --snapshotTemplate flag, a snapshot would be taken.")
+		return errInvalidInput
+	}
+
+	if jobInfo.GroupName != "" && len(jobInfo.DatasetOverrides) > 0 {
+		helpers.AppLogger.Errorf("Overriding the settings of datasets in a grouped backup is not supported.")
+		return errInvalidInput
+	}
+
+	if jobInfo.GroupName != "" && jobInfo.GenerateRestoreScript {
+		helpers.AppLogger.Errorf("Generating a restore script for a grouped backup is not supported.")
+		return errInvalidInput
+	}
+
+	multipleDatasets := jobInfo.GroupName == "" && (strings.Contains(args[0], ",") || jobInfo.SnapshotList != "")
+	if multipleDatasets && (jobInfo.Resume || jobInfo.StartAtVolume > 0) {
+		helpers.AppLogger.Errorf("Resuming a backup of multiple datasets is not supported.")
+		return errInvalidInput
+	}
+
+	if jobInfo.MaxFailures != "" && !multipleDatasets {
+		helpers.AppLogger.Errorf("The --maxFailures flag is only supported when backing up a comma separated list of datasets without the --group flag or a --snapshotList.")
+		return errInvalidInput
+	}
+
+	if jobInfo.SkipUnchanged && (jobInfo.GroupName != "" || jobInfo.SnapshotList != "" || jobInfo.Resume || jobInfo.StartAtVolume > 0) {
+		helpers.AppLogger.Errorf("The --skipUnchanged flag cannot be combined with the --group flag, a --snapshotList, or resuming a backup.")
+		return errInvalidInput
+	}
+
+	if jobInfo.SingleObject && (len(strings.Split(args[1], ",")) != 1 || jobInfo.Resume || jobInfo.StartAtVolume > 0) {
+		helpers.AppLogger.Errorf("Streaming a backup as a single object requires a single destination and cannot be resumed.")
+		return errInvalidInput
+	}
+
+	if jobInfo.UploadQuorum < 0 || jobInfo.UploadQuorum > len(strings.Split(args[1], ",")) {
+		helpers.AppLogger.Errorf("The upload quorum must be between 0 and the number of destinations provided. Was given %d", jobInfo.UploadQuorum)
+		return errInvalidInput
+	}
+
+	if jobInfo.StartAtVolume < 0 {
+		helpers.AppLogger.Errorf("The volume number to start at must be greater than or equal to 0. Was given %d", jobInfo.StartAtVolume)
+		return errInvalidInput
+	}
+
+	if jobInfo.DedupVolumes && jobInfo.MaxFileBuffer == 0 {
+		helpers.AppLogger.Errorf("The --dedupVolumes flag requires volumes to be buffered locally, please set --maxFileBuffer to a value greater than 0.")
+		return errInvalidInput
+	}
+
+	if jobInfo.DedupVolumes && (jobInfo.EncryptTo != "" || jobInfo.SignFrom != "") {
+		helpers.AppLogger.Warningf("The --dedupVolumes flag has no effect with --encryptTo or --signFrom, encrypted or signed volumes are never identical to volumes already uploaded.")
+	}
+
+	if jobInfo.OnSnapshotChange != helpers.SnapshotChangeAbort && jobInfo.OnSnapshotChange != helpers.SnapshotChangeRestart {
+		helpers.AppLogger.Errorf("The snapshot change policy provided (%s) is not one of %s or %s.", jobInfo.OnSnapshotChange, helpers.SnapshotChangeAbort, helpers.SnapshotChangeRestart)
+		return errInvalidInput
+	}
+
+	switch jobInfo.ScratchCheck {
+	case helpers.ScratchCheckOff, helpers.ScratchCheckWarn, helpers.ScratchCheckFail:
+	default:
+		helpers.AppLogger.Errorf("The scratch check provided (%s) is not one of %s, %s or %s.", jobInfo.ScratchCheck, helpers.ScratchCheckOff, helpers.ScratchCheckWarn, helpers.ScratchCheckFail)
+		return errInvalidInput
+	}
+
+	if startWindow != "" {
+		window, err := helpers.ParseStartWindow(startWindow)
+		if err != nil {
+			helpers.AppLogger.Error(err)
+			return errInvalidInput
+		}
+		jobInfo.StartWindow = window
+	}
+
+	if compressionCPUs != "" {
+		cpus, err := helpers.ParseCPUSet(compressionCPUs)
+		if err != nil {
+			helpers.AppLogger.Errorf("Invalid compression CPUs provided - %v", err)
+			return errInvalidInput
+		}
+		jobInfo.CompressionCPUs = cpus
+	}
+
+	if uploadCPUs != "" {
+		cpus, err := helpers.ParseCPUSet(uploadCPUs)
+		if err != nil {
+			helpers.AppLogger.Errorf("Invalid upload CPUs provided - %v", err)
+			return errInvalidInput
+		}
+		jobInfo.UploadCPUs = cpus
+	}
+
+	switch jobInfo.VerifyUploads {
+	case "", helpers.VerifyUploadsETag, helpers.VerifyUploadsReadback:
+	default:
+		helpers.AppLogger.Errorf("Invalid upload verification provided, expected one of %s or %s, got %q.", helpers.VerifyUploadsETag, helpers.VerifyUploadsReadback, jobInfo.VerifyUploads)
+		return errInvalidInput
+	}
+
+	if jobInfo.VerifyUploads == helpers.VerifyUploadsReadback && jobInfo.MaxFileBuffer == 0 {
+		helpers.AppLogger.Errorf("The --verifyUploads=readback flag requires volumes to be buffered locally, please set --maxFileBuffer to a value greater than 0.")
+		return errInvalidInput
+	}
+
+	if jobInfo.VerifyUploads == helpers.VerifyUploadsReadback && backends.IsS3ArchiveStorageClass(jobInfo.StorageClass) {
+		helpers.AppLogger.Errorf("The --verifyUploads=readback flag cannot be used when uploading to the %s storage class, its objects must be restored before they can be downloaded again.", jobInfo.StorageClass)
+		return errInvalidInput
+	}
+
+	if jobInfo.KMSKeyID != "" && !strings.HasPrefix(jobInfo.ServerSideEncryption, "aws:kms") {
+		helpers.AppLogger.Errorf("The --kmsKeyID flag requires --serverSideEncryption to be aws:kms, %q was given.", jobInfo.ServerSideEncryption)
+		return errInvalidInput
+	}
+
+	if helpers.IsDeprecatedHash(jobInfo.HashAlgorithm) {
+		helpers.AppLogger.Warningf("The hash algorithm %s is deprecated, backup sets using it will fail verify-integrity with the strictHash option. Consider using %s instead.", jobInfo.HashAlgorithm, helpers.SHA256Hash)
+	}
+
+	if err := helpers.ValidateManifestFormat(jobInfo.ManifestFormat); err != nil {
+		helpers.AppLogger.Errorf("The manifest format provided (%s) is not one of %s or %s.", jobInfo.ManifestFormat, helpers.ManifestFormatJSON, helpers.ManifestFormatBinary)
+		return errInvalidInput
+	}
+
+	if jobInfo.MetricsTextfileDir != "" {
+		if info, err := os.Stat(jobInfo.MetricsTextfileDir); err != nil || !info.IsDir() {
+			helpers.AppLogger.Errorf("The metrics textfile directory provided (%s) does not exist or is not a directory.", jobInfo.MetricsTextfileDir)
+			return errInvalidInput
+		}
+	}
+
+	if jobInfo.ImmutabilityPeriod < 0 {
+		helpers.AppLogger.Errorf("The immutability period must be greater than or equal to 0. Was given %v", jobInfo.ImmutabilityPeriod)
+		return errInvalidInput
+	}
+
+	if jobInfo.ImmutabilityLocked && jobInfo.ImmutabilityPeriod == 0 {
+		helpers.AppLogger.Errorf("The --immutabilityLocked flag requires an --immutabilityPeriod to be set.")
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateUserPropertyNamespaces(); err != nil {
+		helpers.AppLogger.Errorf("Invalid user property namespace provided - %v", err)
+		return errInvalidInput
+	}
+
+	metadata, err := helpers.ParseMetadata(metadataPairs)
+	if err != nil {
+		helpers.AppLogger.Errorf("Invalid metadata provided - %v", err)
+		return errInvalidInput
+	}
+	jobInfo.Metadata = metadata
+
+	if jobInfo.UploadTimeout < 0 {
+		helpers.AppLogger.Errorf("The upload timeout must be greater than or equal to 0. Was given %v", jobInfo.UploadTimeout)
+		return errInvalidInput
+	}
+
+	if jobInfo.ExpireAfter < 0 {
+		helpers.AppLogger.Errorf("The expiry must be greater than or equal to 0. Was given %v", jobInfo.ExpireAfter)
+		return errInvalidInput
+	}
+
+	if strings.ContainsAny(jobInfo.GroupName, "@,") || (jobInfo.Separator != "" && strings.Contains(jobInfo.GroupName, jobInfo.Separator)) {
+		helpers.AppLogger.Errorf("The group name provided (%s) should not contain '@', ',', or the separator %s.", jobInfo.GroupName, jobInfo.Separator)
+		return errInvalidInput
+	}
+
 	return updateJobInfo(args)
 }
@@ -0,0 +1,274 @@
+// Copyright © 2017 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kietdlam/zfsbackup-go/backup"
+	"github.com/kietdlam/zfsbackup-go/helpers"
+	//"../backup"
+	//"../helpers"
+)
+
+var (
+	signedBy       string
+	merkleRootOnly bool
+	keyless        bool
+	repairCache    bool
+)
+
+// verifySignaturesCmd represents the verify-signatures command
+var verifySignaturesCmd = &cobra.Command{
+	Use:     "verify-signatures [flags] filesystem|volume@snapshot uri",
+	Short:   "verify-signatures will verify every object of a backup set is signed by the expected key without restoring any data.",
+	Long:    `verify-signatures will download the manifest and every volume of the backup set for the provided snapshot, verify each was signed by the expected key while discarding their contents, and report the signer and outcome for each object. Volumes are restored first where required (e.g. from Glacier).`,
+	PreRunE: validateVerifySignaturesFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.VerifySignatures(context.Background(), &jobInfo)
+	},
+}
+
+// verifyIntegrityCmd represents the verify-integrity command
+var verifyIntegrityCmd = &cobra.Command{
+	Use:     "verify-integrity [flags] filesystem|volume@snapshot uri",
+	Short:   "verify-integrity will verify the merkle root and volume checksums of a backup set without restoring any data.",
+	Long:    `verify-integrity will download the manifest of the backup set for the provided snapshot, recompute the merkle root over the checksums of its volumes and compare it against the root stored in the manifest. Every volume is then downloaded and its checksum, computed with the hash algorithm recorded in the manifest, compared against the one listed in the manifest, unless the rootOnly option is provided. With the keyless option, the manifest is not read and every volume is instead compared against the checksums uploaded alongside the backup set by send --checksums, which needs none of its keys. Volumes are restored first where required (e.g. from Glacier).`,
+	PreRunE: validateVerifyIntegrityFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if keyless {
+			return backup.VerifyCiphertext(context.Background(), &jobInfo)
+		}
+		return backup.VerifyIntegrity(context.Background(), &jobInfo, merkleRootOnly)
+	},
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:     "verify [flags] filesystem|volume@snapshot uri",
+	Short:   "verify will check every volume of a backup set can be restored without writing to any dataset.",
+	Long:    `verify will download the manifest and every volume of the backup set for the provided snapshot, compare the checksum of each volume against the one listed in the manifest and then decrypt and decompress it while discarding its contents. The outcome for each volume is reported along with the overall result, nothing is written to any ZFS dataset. Volumes are restored first where required (e.g. from Glacier).`,
+	PreRunE: validateVerifyFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Verify(context.Background(), &jobInfo)
+	},
+}
+
+// verifyCacheCmd represents the verify-cache command
+var verifyCacheCmd = &cobra.Command{
+	Use:     "verify-cache [flags] uri",
+	Short:   "verify-cache will compare the local cache of manifests against the manifests found in the target.",
+	Long:    `verify-cache will compare the local cache of manifests, which list, clean and receive read from, against the manifests found in the target and report any manifest missing from the cache, cached but no longer found in the target, or cached with a different size (e.g. truncated). With the repair option a cache that differs is rebuilt from the manifests found in the target and swapped in place of the old one once complete.`,
+	PreRunE: validateVerifyCacheFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.Destinations = []string{args[0]}
+		return backup.VerifyCache(context.Background(), &jobInfo, repairCache)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifySignaturesCmd)
+	RootCmd.AddCommand(verifyIntegrityCmd)
+	RootCmd.AddCommand(verifyCmd)
+	RootCmd.AddCommand(verifyCacheCmd)
+
+	verifySignaturesCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "Used to specify the snapshot the backup set was incremented from.")
+	verifySignaturesCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names (used only for the manifest we are looking for).")
+	verifySignaturesCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case used for dataset and snapshot names in object names, either preserve or lower (used only for the manifest we are looking for).")
+	verifySignaturesCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "the string used in place of the '/' between dataset names in object names (used only for the manifest we are looking for).")
+	verifySignaturesCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path or hash (used only for the manifest we are looking for).")
+	verifySignaturesCmd.Flags().StringVar(&signedBy, "signedBy", "", "the email of the user the backup set is expected to be signed by from the provided public keyring. Defaults to the signFrom key.")
+	verifySignaturesCmd.Flags().StringSliceVar(&jobInfo.TrustedSigners, "trustedSigners", nil, "a comma separated list of the key IDs or fingerprints of the keys trusted to sign backups. Objects signed by any other key fail verification even if it is in the provided keyrings. A key is trusted if it, or the primary key it belongs to, is listed.")
+
+	verifyIntegrityCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "Used to specify the snapshot the backup set was incremented from.")
+	verifyIntegrityCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names (used only for the manifest we are looking for).")
+	verifyIntegrityCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case used for dataset and snapshot names in object names, either preserve or lower (used only for the manifest we are looking for).")
+	verifyIntegrityCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "the string used in place of the '/' between dataset names in object names (used only for the manifest we are looking for).")
+	verifyIntegrityCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path or hash (used only for the manifest we are looking for).")
+	verifyIntegrityCmd.Flags().BoolVar(&keyless, "keyless", false, "only verify the checksum of each volume as it is stored against the checksums uploaded alongside the backup set by zfsbackup send --checksums, without reading the manifest. No keys are needed to verify encrypted backup sets this way.")
+	verifyIntegrityCmd.Flags().BoolVar(&merkleRootOnly, "rootOnly", false, "only verify the merkle root against the volume checksums listed in the manifest, without downloading the volumes.")
+	verifyIntegrityCmd.Flags().BoolVar(&jobInfo.StrictHashAlgorithm, "strictHash", false, "set this flag to fail the verification of backup sets that recorded a deprecated hash algorithm (md5) instead of warning about them. Volumes are always verified with the hash algorithm recorded by their backup set, not the current default.")
+
+	verifyCmd.Flags().StringVarP(&jobInfo.IncrementalSnapshot.Name, "incremental", "i", "", "Used to specify the snapshot the backup set was incremented from.")
+	verifyCmd.Flags().StringVar(&jobInfo.Separator, "separator", "|", "the separator to use between object component names (used only for the manifest we are looking for).")
+	verifyCmd.Flags().StringVar(&jobInfo.KeyCase, "keyCase", helpers.KeyCasePreserve, "the case used for dataset and snapshot names in object names, either preserve or lower (used only for the manifest we are looking for).")
+	verifyCmd.Flags().StringVar(&jobInfo.KeyDatasetSeparator, "keyDatasetSeparator", "", "the string used in place of the '/' between dataset names in object names (used only for the manifest we are looking for).")
+	verifyCmd.Flags().StringVar(&jobInfo.KeyPrefix, "keyPrefix", helpers.KeyPrefixPath, "how datasets are identified in object names, either path or hash (used only for the manifest we are looking for).")
+	verifyCmd.Flags().BoolVar(&jobInfo.StrictHashAlgorithm, "strictHash", false, "set this flag to fail the verification of backup sets that recorded a deprecated hash algorithm (md5) instead of warning about them.")
+	verifyCmd.Flags().StringVar(&jobInfo.DecompressCommand, "decompressCommand", "", "the command to pipe volumes compressed with the external compressor through to decompress them, e.g. \"zstd -d -c --long=27\". Arguments are split on whitespace. Defaults to the program of the command recorded in the manifest with the -d and -c flags.")
+	verifyCmd.Flags().StringSliceVar(&jobInfo.TrustedSigners, "trustedSigners", nil, "a comma separated list of the key IDs or fingerprints of the keys trusted to sign backups. Volumes signed by any other key fail verification.")
+
+	verifyCacheCmd.Flags().BoolVar(&repairCache, "repair", false, "rebuild the local cache of manifests from the manifests found in the target if it differs.")
+}
+
+// ResetVerifySignaturesJobInfo exists solely for integration testing
+func ResetVerifySignaturesJobInfo() {
+	resetRootFlags()
+	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+	jobInfo.Separator = "|"
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	jobInfo.TrustedSigners = nil
+	signedBy = ""
+}
+
+// ResetVerifyIntegrityJobInfo exists solely for integration testing
+func ResetVerifyIntegrityJobInfo() {
+	resetRootFlags()
+	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+	jobInfo.Separator = "|"
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	merkleRootOnly = false
+	keyless = false
+	jobInfo.StrictHashAlgorithm = false
+}
+
+// ResetVerifyJobInfo exists solely for integration testing
+func ResetVerifyJobInfo() {
+	resetRootFlags()
+	jobInfo.IncrementalSnapshot = helpers.SnapshotInfo{}
+	jobInfo.Separator = "|"
+	jobInfo.KeyCase = helpers.KeyCasePreserve
+	jobInfo.KeyDatasetSeparator = ""
+	jobInfo.KeyPrefix = helpers.KeyPrefixPath
+	jobInfo.StrictHashAlgorithm = false
+	jobInfo.TrustedSigners = nil
+	jobInfo.DecompressCommand = ""
+}
+
+// ResetVerifyCacheJobInfo exists solely for integration testing
+func ResetVerifyCacheJobInfo() {
+	resetRootFlags()
+	repairCache = false
+}
+
+func validateVerifySignaturesFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) != 2 {
+		helpers.AppLogger.Errorf("Invalid snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
+	if signedBy != "" {
+		if jobInfo.SignKey = helpers.GetPublicKeyByEmail(signedBy); jobInfo.SignKey == nil {
+			helpers.AppLogger.Errorf("Could not find public key for %s", signedBy)
+			return &helpers.OperationError{Op: "verify signatures", Kind: helpers.ErrKeyMissing, Err: fmt.Errorf("could not find public key for %s", signedBy)}
+		}
+	}
+
+	if jobInfo.SignKey == nil {
+		helpers.AppLogger.Errorf("You must provide the key the backup set is expected to be signed by with the signedBy or signFrom options.")
+		return errInvalidInput
+	}
+
+	if jobInfo.EncryptKey == nil {
+		helpers.AppLogger.Errorf("You must provide the key the backup set was encrypted to with the encryptTo option, its signatures can only be verified once decrypted.")
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateTrustedSigners(); err != nil {
+		helpers.AppLogger.Errorf("Invalid trusted signer provided - %v", err)
+		return errInvalidInput
+	}
+
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
+	jobInfo.Destinations = []string{args[1]}
+
+	if jobInfo.IncrementalSnapshot.Name != "" {
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+	}
+
+	return nil
+}
+
+func validateVerifyIntegrityFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) != 2 {
+		helpers.AppLogger.Errorf("Invalid snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+		return errInvalidInput
+	}
+
+	if err := jobInfo.ValidateKeyNormalization(); err != nil {
+		helpers.AppLogger.Error(err)
+		return err
+	}
+
+	if keyless && merkleRootOnly {
+		helpers.AppLogger.Errorf("The --keyless and --rootOnly flags cannot be used together, the merkle root is recorded in the manifest.")
+		return errInvalidInput
+	}
+
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = helpers.SnapshotInfo{Name: parts[1]}
+	jobInfo.Destinations = []string{args[1]}
+
+	if jobInfo.IncrementalSnapshot.Name != "" {
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
+		jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+	}
+
+	return nil
+}
+
+func validateVerifyFlags(cmd *cobra.Command, args []string) error {
+	if err := validateVerifyIntegrityFlags(cmd, args); err != nil {
+		return err
+	}
+
+	if err := jobInfo.ValidateTrustedSigners(); err != nil {
+		helpers.AppLogger.Errorf("Invalid trusted signer provided - %v", err)
+		return errInvalidInput
+	}
+
+	return nil
+}
+
+func validateVerifyCacheFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		cmd.Usage()
+		return errInvalidInput
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxCPU is the highest CPU number that can be pinned to, the size of the kernel's default CPU set.
+const maxCPU = 1023
+
+// ParseCPUSet will parse a comma separated list of CPU numbers and ranges, e.g. 0-3,8,10-11, as
+// found in /sys/devices/system/node/node*/cpulist, and return the sorted CPU numbers it lists.
+func ParseCPUSet(list string) ([]int, error) {
+	seen := make(map[int]bool)
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU %q in the CPU list %q", part, list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid CPU range %q in the CPU list %q", part, list)
+			}
+		}
+		if first < 0 || last < first || last > maxCPU {
+			return nil, fmt.Errorf("invalid CPU range %q in the CPU list %q, CPUs must be between 0 and %d", part, list, maxCPU)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// PinToCPUs will lock the calling goroutine to the OS thread it runs on and restrict that thread to the
+// provided CPUs, returning a function to call from the same goroutine once done to restore the CPUs the
+// thread could run on and unlock it. Nothing is pinned when no CPUs are provided or on platforms other
+// than Linux.
+//
+// Go schedules goroutines, not threads, so only the calling goroutine is pinned: goroutines it starts,
+// such as the ones the gzip and zstd encoders compress blocks with, run on any CPU. Processes it starts,
+// such as zfs send or an external compressor, inherit the CPUs of the thread and are pinned too.
+func PinToCPUs(cpus []int) (func(), error) {
+	if len(cpus) == 0 {
+		return func() {}, nil
+	}
+
+	runtime.LockOSThread()
+	restore, err := setThreadAffinity(cpus)
+	if err != nil || restore == nil {
+		runtime.UnlockOSThread()
+		return func() {}, err
+	}
+
+	return func() {
+		if rerr := restore(); rerr != nil {
+			// Leave the thread locked so it exits along with the goroutine instead of running others on the wrong CPUs
+			AppLogger.Warningf("Could not restore the CPUs the thread can run on - %v", rerr)
+			return
+		}
+		runtime.UnlockOSThread()
+	}, nil
+}
@@ -0,0 +1,108 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseCPUSet(t *testing.T) {
+	testCases := []struct {
+		list     string
+		expected []int
+		valid    bool
+	}{
+		{"0", []int{0}, true},
+		{"0-3,8,10-11", []int{0, 1, 2, 3, 8, 10, 11}, true},
+		{" 8, 2-3 ,3", []int{2, 3, 8}, true},
+		{"1023", []int{1023}, true},
+		{"", nil, false},
+		{"0,", nil, false},
+		{"3-1", nil, false},
+		{"-1", nil, false},
+		{"0-1024", nil, false},
+		{"0-a", nil, false},
+		{"node0", nil, false},
+	}
+
+	for idx, c := range testCases {
+		cpus, err := ParseCPUSet(c.list)
+		if c.valid && err != nil {
+			t.Errorf("%d: unexpected error parsing %q - %v", idx, c.list, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%d: expected an error parsing %q", idx, c.list)
+		} else if c.valid && !reflect.DeepEqual(cpus, c.expected) {
+			t.Errorf("%d: expected %v, got %v", idx, c.expected, cpus)
+		}
+	}
+}
+
+func TestPinToCPUs(t *testing.T) {
+	// The status of the calling thread lists the CPUs it may run on, where supported
+	allowedCPUs := func() string {
+		status, err := ioutil.ReadFile("/proc/thread-self/status")
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "Cpus_allowed_list:") {
+				return strings.TrimSpace(strings.TrimPrefix(line, "Cpus_allowed_list:"))
+			}
+		}
+		return ""
+	}
+
+	testCases := []struct {
+		cpus    []int
+		allowed string
+	}{
+		{nil, ""},
+		{[]int{0}, "0"},
+	}
+
+	for idx, c := range testCases {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			before := allowedCPUs()
+
+			release, err := PinToCPUs(c.cpus)
+			if err != nil {
+				t.Errorf("%d: unexpected error pinning to CPUs %v - %v", idx, c.cpus, err)
+				return
+			}
+			if allowed := allowedCPUs(); runtime.GOOS == "linux" && before != "" && c.allowed != "" && allowed != c.allowed {
+				t.Errorf("%d: expected the thread to be pinned to CPUs %s, got %s", idx, c.allowed, allowed)
+			}
+			release()
+			if after := allowedCPUs(); after != before {
+				t.Errorf("%d: expected the thread's CPUs to be restored to %s, got %s", idx, before, after)
+			}
+		}()
+		<-done
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Operations and results recorded in the audit log.
+const (
+	AuditBackup  = "backup"
+	AuditRestore = "restore"
+	AuditDelete  = "delete"
+
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	// AuditRetained is the result of deleting an object still under a retention policy or legal hold.
+	AuditRetained = "retained"
+)
+
+// auditTailSize is how much of the end of the audit log is read to find the hash of its last event, far more than an event takes.
+const auditTailSize = 64 * 1024
+
+var (
+	// AuditLogPath is the path of the append-only audit log of backups, restores and deletions, disabled if empty.
+	AuditLogPath string
+	// AuditHashChain will chain each event of the audit log to the previous one by their hashes, see VerifyAuditLog.
+	AuditHashChain bool
+
+	auditMutex sync.Mutex
+
+	// ErrAuditChainBroken is returned when an event of the audit log does not match its hash or does not follow the previous event.
+	ErrAuditChainBroken = errors.New("the hash chain of the audit log is broken, it was tampered with")
+)
+
+// AuditEvent is a single operation recorded in the audit log, written as a line of JSON.
+type AuditEvent struct {
+	Time      time.Time
+	Operation string
+	User      string
+	Host      string
+	Dataset   string `json:",omitempty"`
+	Snapshot  string `json:",omitempty"`
+	Target    string
+	Result    string
+	Error     string `json:",omitempty"`
+	Bytes     uint64 `json:",omitempty"`
+	// The hash of the previous event and of this one, when hash chaining is enabled
+	PrevHash string `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+}
+
+// NewAuditEvent will return an event recording the provided operation, successful unless an error is provided.
+func NewAuditEvent(operation, dataset, snapshot, target string, bytes uint64, err error) *AuditEvent {
+	event := &AuditEvent{
+		Operation: operation,
+		Dataset:   dataset,
+		Snapshot:  snapshot,
+		Target:    target,
+		Result:    AuditSuccess,
+		Bytes:     bytes,
+	}
+	if err != nil {
+		event.Result = AuditFailure
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// hash will return the SHA256 hash of the event, covering the hash of the previous event but not its own.
+func (e *AuditEvent) hash() string {
+	unhashed := *e
+	unhashed.Hash = ""
+	b, _ := json.Marshal(&unhashed)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// RecordAuditEvent will append the provided event to the audit log, if enabled, along with who and when it was
+// recorded by, and sync it to disk before returning. The audit log is locked while appending so concurrent
+// executions do not interleave or break the hash chain.
+func RecordAuditEvent(e *AuditEvent) error {
+	if AuditLogPath == "" {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	e.Host, _ = os.Hostname()
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	f, err := os.OpenFile(AuditLogPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	if AuditHashChain {
+		if e.PrevHash, err = lastAuditHash(f); err != nil {
+			return err
+		}
+		e.Hash = e.hash()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lastAuditHash will return the hash of the last event of the provided audit log, empty if it has none or it is not chained.
+func lastAuditHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return "", err
+	}
+
+	offset := info.Size() - auditTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err = f.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	var last AuditEvent
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		return "", fmt.Errorf("could not read the last event of the audit log - %v", err)
+	}
+	return last.Hash, nil
+}
+
+// VerifyAuditLog will check the hash chain of the provided audit log, returning the number of chained events verified.
+// Each chained event must match its hash and follow the event before it, so modified, inserted or deleted events are
+// detected, except for events deleted from the end of the log. Events recorded before hash chaining was enabled are
+// not verified.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, auditTailSize), auditTailSize)
+
+	var prevHash string
+	var verified, line int
+	for scanner.Scan() {
+		line++
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			AppLogger.Errorf("Could not read event %d of the audit log - %v", line, err)
+			return verified, ErrAuditChainBroken
+		}
+
+		switch {
+		case event.Hash == "" && prevHash == "":
+			// Not chained yet
+			continue
+		case event.Hash == "":
+			AppLogger.Errorf("Event %d of the audit log is not chained to the events before it.", line)
+			return verified, ErrAuditChainBroken
+		case event.PrevHash != prevHash:
+			AppLogger.Errorf("Event %d of the audit log does not follow the event before it.", line)
+			return verified, ErrAuditChainBroken
+		case event.hash() != event.Hash:
+			AppLogger.Errorf("Event %d of the audit log does not match its hash.", line)
+			return verified, ErrAuditChainBroken
+		}
+		prevHash = event.Hash
+		verified++
+	}
+
+	return verified, scanner.Err()
+}
@@ -0,0 +1,165 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordAuditEvent(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupaudit")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+	defer func() { AuditLogPath, AuditHashChain = "", false }()
+
+	// Nothing is recorded when the audit log is disabled
+	if err = RecordAuditEvent(NewAuditEvent(AuditBackup, "tank/data", "snap", "file:///backups", 10, nil)); err != nil {
+		t.Errorf("expected nothing to be recorded without an audit log, got %v", err)
+	}
+
+	AuditLogPath = filepath.Join(workingDir, "audit.log")
+	if err = ioutil.WriteFile(AuditLogPath, []byte("{\"Operation\":\"backup\"}\n"), 0600); err != nil {
+		t.Fatalf("could not write audit log - %v", err)
+	}
+
+	events := []*AuditEvent{
+		NewAuditEvent(AuditBackup, "tank/data", "snap", "file:///backups", 10, nil),
+		NewAuditEvent(AuditRestore, "tank/data", "snap", "tank/restored", 20, errors.New("receive failed")),
+		NewAuditEvent(AuditDelete, "", "", "/backups/object", 0, nil),
+	}
+	for idx, e := range events {
+		if err = RecordAuditEvent(e); err != nil {
+			t.Fatalf("%d: could not record event - %v", idx, err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(AuditLogPath)
+	if err != nil {
+		t.Fatalf("could not read audit log - %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != len(events)+1 || lines[0] != "{\"Operation\":\"backup\"}" {
+		t.Fatalf("expected the events to be appended to the existing record, got %q", b)
+	}
+	for idx, e := range events {
+		var recorded AuditEvent
+		if err = json.Unmarshal([]byte(lines[idx+1]), &recorded); err != nil {
+			t.Errorf("%d: could not read recorded event - %v", idx, err)
+			continue
+		}
+		if recorded.Operation != e.Operation || recorded.Target != e.Target || recorded.Result != e.Result || recorded.Bytes != e.Bytes || recorded.Error != e.Error {
+			t.Errorf("%d: expected event %+v to be recorded, got %+v", idx, e, recorded)
+		}
+		if recorded.Time.IsZero() || recorded.User == "" || recorded.Hash != "" {
+			t.Errorf("%d: expected an unchained event recorded with who and when, got %+v", idx, recorded)
+		}
+	}
+	if events[1].Result != AuditFailure {
+		t.Errorf("expected a failed operation to be recorded as a failure, got %s", events[1].Result)
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupaudit")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+	defer func() { AuditLogPath, AuditHashChain = "", false }()
+
+	// An event recorded before hash chaining was enabled is not verified
+	AuditLogPath = filepath.Join(workingDir, "audit.log")
+	if err = RecordAuditEvent(NewAuditEvent(AuditBackup, "tank/data", "snap1", "file:///backups", 10, nil)); err != nil {
+		t.Fatalf("could not record event - %v", err)
+	}
+
+	// Events recorded concurrently are chained one after the other
+	AuditHashChain = true
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rerr := RecordAuditEvent(NewAuditEvent(AuditDelete, "", "", "/backups/object", 0, nil)); rerr != nil {
+				t.Errorf("could not record event - %v", rerr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, err := ioutil.ReadFile(AuditLogPath)
+	if err != nil {
+		t.Fatalf("could not read audit log - %v", err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	lines = lines[:len(lines)-1]
+
+	tamper := func(line string, f func(*AuditEvent)) string {
+		var e AuditEvent
+		json.Unmarshal([]byte(line), &e)
+		f(&e)
+		out, _ := json.Marshal(&e)
+		return string(out) + "\n"
+	}
+	join := func(parts ...[]string) string {
+		var out []string
+		for _, p := range parts {
+			out = append(out, p...)
+		}
+		return strings.Join(out, "")
+	}
+
+	testCases := []struct {
+		log      string
+		verified int
+		valid    func(error) bool
+	}{
+		{join(lines), 10, func(e error) bool { return e == nil }},
+		// Events deleted from the end cannot be detected
+		{join(lines[:8]), 7, func(e error) bool { return e == nil }},
+		{join(lines[:3], lines[4:]), 2, func(e error) bool { return e == ErrAuditChainBroken }},
+		{join(lines[:3], []string{tamper(lines[3], func(e *AuditEvent) { e.Result = AuditFailure })}, lines[4:]), 2, func(e error) bool { return e == ErrAuditChainBroken }},
+		{join(lines[:3], []string{tamper(lines[3], func(e *AuditEvent) { e.Bytes = 1; e.Hash = e.hash() })}, lines[4:]), 3, func(e error) bool { return e == ErrAuditChainBroken }},
+		{join(lines[:3], []string{tamper(lines[3], func(e *AuditEvent) { e.Hash = "" })}, lines[4:]), 2, func(e error) bool { return e == ErrAuditChainBroken }},
+		{join(lines[:3], lines[4:5], lines[3:4], lines[5:]), 2, func(e error) bool { return e == ErrAuditChainBroken }},
+		{join(lines[:3], []string{"not json\n"}, lines[3:]), 2, func(e error) bool { return e == ErrAuditChainBroken }},
+	}
+
+	for idx, c := range testCases {
+		verified, err := VerifyAuditLog(bytes.NewBufferString(c.log))
+		if !c.valid(err) {
+			t.Errorf("%d: did not get the expected error, got %v instead", idx, err)
+		}
+		if verified != c.verified {
+			t.Errorf("%d: expected %d events to be verified, got %d", idx, c.verified, verified)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ObjectChecksum is the SHA256 checksum of an object as it is stored in a destination, after it was compressed and
+// encrypted, as listed in the checksums object of a backup set.
+type ObjectChecksum struct {
+	Object    string
+	SHA256Sum string
+}
+
+// ChecksumsObjectName returns the name of the object the checksums of this backup set are uploaded as.
+func (j *JobInfo) ChecksumsObjectName() string {
+	return fmt.Sprintf("%s.sha256sums", strings.Join(j.objectNameParts(), j.Separator))
+}
+
+// WriteChecksums will write out the SHA256 checksum of each volume of this backup set, including the volumes of its
+// group members when written for a group's manifest, in the format of sha256sum. The checksums are computed over the
+// volumes as they are stored, so they can be verified without the keys the backup set was encrypted with and without
+// reading its manifest.
+func (j *JobInfo) WriteChecksums(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, vol := range j.AllVolumes() {
+		if vol.SHA256Sum == "" {
+			return fmt.Errorf("the SHA256 checksum of volume %s was not recorded", vol.ObjectName)
+		}
+		fmt.Fprintf(bw, "%s  %s\n", vol.SHA256Sum, vol.ObjectName)
+	}
+	return bw.Flush()
+}
+
+// ParseChecksums will parse the checksums written by WriteChecksums, in order.
+func ParseChecksums(r io.Reader) ([]ObjectChecksum, error) {
+	var checksums []ObjectChecksum
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) != 2 || len(parts[0]) != 64 || parts[1] == "" {
+			return nil, fmt.Errorf("line %d of the checksums is not in the format of sha256sum", line)
+		}
+		checksums = append(checksums, ObjectChecksum{Object: parts[1], SHA256Sum: parts[0]})
+	}
+	return checksums, scanner.Err()
+}
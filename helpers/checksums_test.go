@@ -0,0 +1,75 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	sum1, sum2 := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	j := &JobInfo{
+		VolumeName:   "backups",
+		BaseSnapshot: SnapshotInfo{Name: "snap"},
+		Separator:    "|",
+		Volumes:      []*VolumeInfo{{ObjectName: "backups|snap.zstream.gz.pgp.vol1", SHA256Sum: sum1}},
+		GroupMembers: []*JobInfo{{Volumes: []*VolumeInfo{{ObjectName: "tank/db|snap.zstream.gz.pgp.vol1", SHA256Sum: sum2}}}},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := j.WriteChecksums(buf); err != nil {
+		t.Fatalf("could not write checksums - %v", err)
+	}
+	if expected := sum1 + "  backups|snap.zstream.gz.pgp.vol1\n" + sum2 + "  tank/db|snap.zstream.gz.pgp.vol1\n"; buf.String() != expected {
+		t.Errorf("expected the checksums in the format of sha256sum %q, got %q", expected, buf.String())
+	}
+	if name := j.ChecksumsObjectName(); name != "backups|snap.sha256sums" {
+		t.Errorf("expected the checksums to be named backups|snap.sha256sums, got %s", name)
+	}
+
+	checksums, err := ParseChecksums(buf)
+	if err != nil {
+		t.Fatalf("could not parse checksums - %v", err)
+	}
+	expected := []ObjectChecksum{{"backups|snap.zstream.gz.pgp.vol1", sum1}, {"tank/db|snap.zstream.gz.pgp.vol1", sum2}}
+	if !reflect.DeepEqual(checksums, expected) {
+		t.Errorf("expected the checksums %v, got %v", expected, checksums)
+	}
+
+	testCases := []string{
+		"abc  vol1\n",
+		sum1 + " vol1\n",
+		sum1 + "  \n",
+	}
+	for idx, c := range testCases {
+		if _, err := ParseChecksums(strings.NewReader(c)); err == nil {
+			t.Errorf("%d: expected an error parsing %q", idx, c)
+		}
+	}
+
+	j.Volumes[0].SHA256Sum = ""
+	if err := j.WriteChecksums(&bytes.Buffer{}); err == nil {
+		t.Errorf("expected an error writing the checksums of a volume without a SHA256 checksum")
+	}
+}
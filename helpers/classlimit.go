@@ -0,0 +1,165 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// BackupClassLimiter caps the requests made per storage class and operation if we need one.
+var BackupClassLimiter *ClassLimiter
+
+const (
+	// OperationUpload is the operation of uploading an object.
+	OperationUpload = "upload"
+	// OperationDownload is the operation of downloading an object, or part of it.
+	OperationDownload = "download"
+	// OperationRestore is the operation of requesting an object be restored from an archival storage class, e.g. Glacier.
+	OperationRestore = "restore"
+	// AnyStorageClass matches the objects of any storage class without a limit of their own, or whose class is not known.
+	AnyStorageClass = "*"
+)
+
+// classLimit caps the requests of one operation on the objects of one storage class.
+type classLimit struct {
+	slots  chan struct{}     // nil when the number of concurrent requests is not capped
+	bucket *ratelimit.Bucket // nil when the rate of requests is not capped
+}
+
+// ClassLimiter caps the number of concurrent requests, and the rate they are made at, separately for each storage
+// class and operation, e.g. so restoring a backup set from Glacier does not exceed the limits of restore requests
+// while downloading objects from the STANDARD class proceeds as fast as it can. It is shared by every backend.
+type ClassLimiter struct {
+	limits map[string]*classLimit
+}
+
+// NewClassLimiter will parse the provided limits, in the form class:operation=concurrency[,rate], into a ClassLimiter.
+// The class is the storage class as reported by the backend, e.g. GLACIER or DEEP_ARCHIVE, or * to match any other
+// class, and the operation is one of upload, download or restore. A concurrency of 0 only limits the rate, in requests
+// per second, and a missing rate only limits the concurrency, e.g. GLACIER:restore=5,2.5 or STANDARD:download=8.
+func NewClassLimiter(specs []string) (*ClassLimiter, error) {
+	l := &ClassLimiter{limits: make(map[string]*classLimit)}
+	for _, spec := range specs {
+		key, limit, err := parseClassLimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.limits[key]; ok {
+			return nil, fmt.Errorf("the limit %s was already provided for the same storage class and operation", spec)
+		}
+		l.limits[key] = limit
+	}
+	return l, nil
+}
+
+func parseClassLimit(spec string) (string, *classLimit, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("invalid limit %s, expected class:operation=concurrency[,rate]", spec)
+	}
+	target := strings.SplitN(parts[0], ":", 2)
+	if len(target) != 2 || target[0] == "" {
+		return "", nil, fmt.Errorf("invalid limit %s, expected class:operation=concurrency[,rate]", spec)
+	}
+	switch target[1] {
+	case OperationUpload, OperationDownload, OperationRestore:
+	default:
+		return "", nil, fmt.Errorf("invalid operation %s in limit %s, expected one of %s, %s or %s", target[1], spec, OperationUpload, OperationDownload, OperationRestore)
+	}
+
+	values := strings.SplitN(parts[1], ",", 2)
+	concurrency, err := strconv.Atoi(values[0])
+	if err != nil || concurrency < 0 {
+		return "", nil, fmt.Errorf("invalid concurrency %s in limit %s, expected a number of requests of 0 or more", values[0], spec)
+	}
+	var rate float64
+	if len(values) == 2 {
+		if rate, err = strconv.ParseFloat(values[1], 64); err != nil || rate <= 0 {
+			return "", nil, fmt.Errorf("invalid rate %s in limit %s, expected a number of requests per second greater than 0", values[1], spec)
+		}
+	}
+	if concurrency == 0 && rate == 0 {
+		return "", nil, fmt.Errorf("the limit %s does not limit the concurrency or the rate of requests", spec)
+	}
+
+	limit := new(classLimit)
+	if concurrency > 0 {
+		limit.slots = make(chan struct{}, concurrency)
+	}
+	if rate > 0 {
+		limit.bucket = ratelimit.NewBucketWithRate(rate, 1)
+	}
+	return classKey(target[0], target[1]), limit, nil
+}
+
+// classKey returns the key of the limit of the provided storage class and operation, storage classes are case insensitive.
+func classKey(class, operation string) string {
+	return strings.ToUpper(class) + ":" + operation
+}
+
+// Acquire will wait until a request of the provided operation can be made on an object of the provided storage
+// class, or the context is canceled. The returned function must be called once the request is done. Objects whose
+// class is unknown should be acquired with an empty class, only the limits of AnyStorageClass apply to them.
+// Requests are not limited when called on a nil ClassLimiter.
+func (l *ClassLimiter) Acquire(ctx context.Context, class, operation string) (func(), error) {
+	release := func() {}
+	if l == nil {
+		return release, nil
+	}
+
+	limit, ok := l.limits[classKey(class, operation)]
+	if !ok {
+		if limit, ok = l.limits[classKey(AnyStorageClass, operation)]; !ok {
+			return release, nil
+		}
+	}
+
+	if limit.slots != nil {
+		select {
+		case limit.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-limit.slots }) }
+	}
+
+	if limit.bucket != nil {
+		if wait := limit.bucket.Take(1); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	return release, nil
+}
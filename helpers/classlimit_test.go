@@ -0,0 +1,182 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package helpers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewClassLimiter(t *testing.T) {
+	testCases := []struct {
+		specs []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"GLACIER:restore=5"}, true},
+		{[]string{"GLACIER:restore=5,2.5", "DEEP_ARCHIVE:restore=0,0.5", "*:download=8"}, true},
+		{[]string{"GLACIER:restore=5", "glacier:restore=2"}, false},
+		{[]string{"GLACIER:restore=5", "GLACIER:download=2"}, true},
+		{[]string{"GLACIER:restore"}, false},
+		{[]string{"GLACIER=5"}, false},
+		{[]string{":restore=5"}, false},
+		{[]string{"GLACIER:delete=5"}, false},
+		{[]string{"GLACIER:restore=-1"}, false},
+		{[]string{"GLACIER:restore=five"}, false},
+		{[]string{"GLACIER:restore=5,0"}, false},
+		{[]string{"GLACIER:restore=0"}, false},
+	}
+
+	for idx, c := range testCases {
+		if _, err := NewClassLimiter(c.specs); (err == nil) != c.valid {
+			t.Errorf("%d: expected %v to be valid: %v, got error %v", idx, c.specs, c.valid, err)
+		}
+	}
+}
+
+func TestClassLimiterConcurrency(t *testing.T) {
+	l, err := NewClassLimiter([]string{"GLACIER:restore=2", "*:restore=3", "STANDARD:download=1"})
+	if err != nil {
+		t.Fatalf("could not create limiter - %v", err)
+	}
+
+	testCases := []struct {
+		class     string
+		operation string
+		max       int
+	}{
+		{"GLACIER", OperationRestore, 2},
+		{"glacier", OperationRestore, 2},
+		// Other and unknown classes fall back to the * limit
+		{"DEEP_ARCHIVE", OperationRestore, 3},
+		{"", OperationRestore, 3},
+		{"STANDARD", OperationDownload, 1},
+		// Operations without a limit are not capped
+		{"GLACIER", OperationDownload, 10},
+		{"STANDARD", OperationUpload, 10},
+	}
+
+	for idx, c := range testCases {
+		var mutex sync.Mutex
+		var inFlight, max int
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := l.Acquire(context.Background(), c.class, c.operation)
+				if err != nil {
+					t.Errorf("%d: could not acquire - %v", idx, err)
+					return
+				}
+				mutex.Lock()
+				inFlight++
+				if inFlight > max {
+					max = inFlight
+				}
+				mutex.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mutex.Lock()
+				inFlight--
+				mutex.Unlock()
+				release()
+			}()
+		}
+		wg.Wait()
+
+		if max > c.max {
+			t.Errorf("%d: expected at most %d requests in flight, got %d", idx, c.max, max)
+		}
+		if c.max == 10 && max < 2 {
+			t.Errorf("%d: expected the requests to run concurrently, got at most %d in flight", idx, max)
+		}
+	}
+}
+
+func TestClassLimiterRate(t *testing.T) {
+	l, err := NewClassLimiter([]string{"GLACIER:restore=0,20"})
+	if err != nil {
+		t.Fatalf("could not create limiter - %v", err)
+	}
+
+	// The first request is made right away, the next ones every 50ms
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		release, err := l.Acquire(context.Background(), "GLACIER", OperationRestore)
+		if err != nil {
+			t.Fatalf("could not acquire - %v", err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("expected 4 requests at 20 per second to take at least 150ms, took %v", elapsed)
+	}
+
+	// Other classes are not rate limited
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		release, _ := l.Acquire(context.Background(), "STANDARD", OperationRestore)
+		release()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected requests of other classes to not be rate limited, took %v", elapsed)
+	}
+}
+
+func TestClassLimiterCancel(t *testing.T) {
+	l, err := NewClassLimiter([]string{"GLACIER:restore=1"})
+	if err != nil {
+		t.Fatalf("could not create limiter - %v", err)
+	}
+
+	release, err := l.Acquire(context.Background(), "GLACIER", OperationRestore)
+	if err != nil {
+		t.Fatalf("could not acquire - %v", err)
+	}
+
+	// Waiting on a slot should stop once canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = l.Acquire(ctx, "GLACIER", OperationRestore); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Releasing more than once should not free up more slots
+	release()
+	release()
+	if release, err = l.Acquire(context.Background(), "GLACIER", OperationRestore); err != nil {
+		t.Fatalf("could not acquire - %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = l.Acquire(ctx, "GLACIER", OperationRestore); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	release()
+
+	// A nil limiter does not limit anything
+	var none *ClassLimiter
+	if release, err = none.Acquire(context.Background(), "GLACIER", OperationRestore); err != nil {
+		t.Errorf("expected a nil limiter to not limit requests, got %v", err)
+	}
+	release()
+}
@@ -0,0 +1,237 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+)
+
+const (
+	// AutoDetectCompressor is used when a manifest does not record which compressor
+	// was used (e.g. legacy or hand-made backups). The format of each volume will be
+	// detected by inspecting its leading magic bytes.
+	AutoDetectCompressor = "auto-detect"
+
+	// AdaptiveCompressor will select a codec for each volume based on how compressible
+	// the start of the volume's data is. The selected codec is recorded per volume.
+	AdaptiveCompressor = "adaptive"
+	// ZstdCompressor uses the builtin zstd implementation.
+	ZstdCompressor = "zstd"
+	// NoCompressor stores the volume as-is.
+	NoCompressor = "none"
+	// ExternalCompressor pipes the volume through the command line recorded as the CompressCommand of the
+	// manifest, and through the DecompressCommand to restore it.
+	ExternalCompressor = "external"
+
+	// GzipAlgorithm and ZstdAlgorithm are recorded as the CompressionAlgorithm of backup sets compressed by the builtin
+	// compressors, so they can be decompressed without knowing which compressor wrote them.
+	GzipAlgorithm = "gzip"
+	ZstdAlgorithm = "zstd"
+
+	// The highest compression level of the zstd compressors, other compressors only go up to 9 like gzip
+	maxZstdCompressionLevel = 22
+	maxCompressionLevel     = 9
+
+	// CompressibilityProbeSize is the number of bytes sampled from the start of a volume
+	// when using the AdaptiveCompressor.
+	CompressibilityProbeSize = 256 * 1024
+	// Samples that do not compress to less than this ratio of their original size are stored as-is.
+	incompressibleRatio = 0.95
+
+	// Formats that can be detected by SniffCompressionFormat
+	gzipFormat = "gzip"
+	zstdFormat = "zstd"
+	lz4Format  = "lz4"
+	zfsFormat  = "zfs"
+
+	sniffLength = 16
+)
+
+var (
+	// ErrUnknownCompression is returned when the compression format of a volume
+	// could not be identified from its contents.
+	ErrUnknownCompression = errors.New("could not identify the compression format from the volume's contents, expected a gzip, zstd, or lz4 compressed stream or an uncompressed zfs send stream")
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	// The DRR_BEGIN record of a zfs send stream carries this magic number at offset 8,
+	// it may be written in either byte order depending on the sending host.
+	zfsStreamMagicLE = []byte{0xac, 0xcb, 0xba, 0xf5, 0x02, 0x00, 0x00, 0x00}
+	zfsStreamMagicBE = []byte{0x00, 0x00, 0x00, 0x02, 0xf5, 0xba, 0xcb, 0xac}
+)
+
+// SelectCompressor will compress the provided sample and return the codec that should be
+// used for a volume starting with it when using the AdaptiveCompressor.
+func SelectCompressor(sample []byte) string {
+	if len(sample) == 0 {
+		return NoCompressor
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		AppLogger.Warningf("Could not create encoder to probe volume compressibility, will store the volume as-is - %v", err)
+		return NoCompressor
+	}
+	defer encoder.Close()
+
+	compressed := encoder.EncodeAll(sample, make([]byte, 0, len(sample)))
+	ratio := float64(len(compressed)) / float64(len(sample))
+	AppLogger.Debugf("Volume sample of %d bytes compressed to %.2f of its size.", len(sample), ratio)
+	if ratio >= incompressibleRatio {
+		return NoCompressor
+	}
+
+	return ZstdCompressor
+}
+
+// CompressionLevelLimit will return the highest compression level supported by the provided compressor. The zstd
+// compressors support levels up to 22, mapped onto the speeds of the builtin implementation, while gzip and the
+// external compressors only support levels up to 9.
+func CompressionLevelLimit(compressor string) int {
+	switch compressor {
+	case ZstdCompressor, SeekableZstdCompressor, AdaptiveCompressor:
+		return maxZstdCompressionLevel
+	default:
+		return maxCompressionLevel
+	}
+}
+
+// CompressorAlgorithm will return the algorithm the provided builtin compressor compresses volumes with, or an empty
+// string for external compressors and uncompressed volumes.
+func CompressorAlgorithm(compressor string) string {
+	switch compressor {
+	case InternalCompressor:
+		return GzipAlgorithm
+	case ZstdCompressor, SeekableZstdCompressor, AdaptiveCompressor:
+		return ZstdAlgorithm
+	default:
+		return ""
+	}
+}
+
+// algorithmCompressor will return the builtin compressor that decompresses volumes compressed with the provided
+// algorithm, or an empty string if there is none.
+func algorithmCompressor(algorithm string) string {
+	switch algorithm {
+	case GzipAlgorithm:
+		return InternalCompressor
+	case ZstdAlgorithm:
+		return ZstdCompressor
+	default:
+		return ""
+	}
+}
+
+// manifestCompressionLevel will return the gzip compression level manifests are written at, the level of the job
+// capped to the highest level gzip supports as the zstd compressors go beyond it.
+func manifestCompressionLevel(level int) int {
+	if level > maxCompressionLevel {
+		return maxCompressionLevel
+	}
+	return level
+}
+
+// CompressCommandLine will return the arguments of the command volumes are piped through to compress them when
+// using the ExternalCompressor. Arguments are split on whitespace, no shell quoting is supported.
+func (j *JobInfo) CompressCommandLine() []string {
+	return strings.Fields(j.CompressCommand)
+}
+
+// DecompressCommandLine will return the arguments of the command volumes compressed with the ExternalCompressor
+// are piped through to decompress them. Without a DecompressCommand, the program of the CompressCommand is run with
+// the -d and -c flags, the syntax of gzip, zstd, xz and most other compression tools.
+func (j *JobInfo) DecompressCommandLine() []string {
+	if j.DecompressCommand != "" {
+		return strings.Fields(j.DecompressCommand)
+	}
+	args := j.CompressCommandLine()
+	if len(args) == 0 {
+		return nil
+	}
+	return []string{args[0], "-d", "-c"}
+}
+
+// SniffCompressionFormat will peek at the beginning of the provided reader and
+// try to identify the compression format used. It returns the detected format
+// along with a reader that will replay the peeked bytes.
+func SniffCompressionFormat(r io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReaderSize(r, sniffLength)
+	header, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return gzipFormat, br, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return zstdFormat, br, nil
+	case bytes.HasPrefix(header, lz4Magic):
+		return lz4Format, br, nil
+	case len(header) == sniffLength && (bytes.Equal(header[8:], zfsStreamMagicLE) || bytes.Equal(header[8:], zfsStreamMagicBE)):
+		return zfsFormat, br, nil
+	}
+
+	return "", nil, ErrUnknownCompression
+}
+
+// newSniffedDecompressor will detect the compression format used for the provided
+// reader and return a reader that decompresses it accordingly. Uncompressed zfs
+// send streams are returned as-is.
+func newSniffedDecompressor(r io.Reader) (io.ReadCloser, error) {
+	format, br, err := SniffCompressionFormat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	AppLogger.Debugf("Detected %s format for volume with no recorded compressor.", format)
+	return newFormatDecompressor(br, format)
+}
+
+// newFormatDecompressor will return a reader that decompresses the provided reader
+// from the provided format, as detected by SniffCompressionFormat. Uncompressed zfs
+// send streams are returned as-is.
+func newFormatDecompressor(br io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case gzipFormat:
+		return gzip.NewReader(br)
+	case zstdFormat:
+		decoder, derr := zstd.NewReader(br)
+		if derr != nil {
+			return nil, derr
+		}
+		return decoder.IOReadCloser(), nil
+	case lz4Format:
+		return ioutil.NopCloser(lz4.NewReader(br)), nil
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
@@ -0,0 +1,669 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+)
+
+func zfsStreamHeader(magic []byte) []byte {
+	header := make([]byte, 8, 64)
+	return append(append(header, magic...), make([]byte, 48)...)
+}
+
+func compressPayload(t *testing.T, format string, payload []byte) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case gzipFormat:
+		w = gzip.NewWriter(buf)
+	case zstdFormat:
+		w, err = zstd.NewWriter(buf)
+	case lz4Format:
+		w = lz4.NewWriter(buf)
+	default:
+		t.Fatalf("unknown format %s", format)
+	}
+	if err != nil {
+		t.Fatalf("could not create %s writer - %v", format, err)
+	}
+	if _, err = w.Write(payload); err != nil {
+		t.Fatalf("could not compress payload with %s - %v", format, err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not close %s writer - %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffCompressionFormat(t *testing.T) {
+	payload := make([]byte, 1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+
+	testCases := []struct {
+		input  []byte
+		format string
+		err    error
+	}{
+		{compressPayload(t, gzipFormat, payload), gzipFormat, nil},
+		{compressPayload(t, zstdFormat, payload), zstdFormat, nil},
+		{compressPayload(t, lz4Format, payload), lz4Format, nil},
+		{zfsStreamHeader(zfsStreamMagicLE), zfsFormat, nil},
+		{zfsStreamHeader(zfsStreamMagicBE), zfsFormat, nil},
+		{payload[:8], "", ErrUnknownCompression},
+		{[]byte("this is not a compressed stream"), "", ErrUnknownCompression},
+	}
+
+	for idx, c := range testCases {
+		format, r, err := SniffCompressionFormat(bytes.NewReader(c.input))
+		if err != c.err {
+			t.Errorf("%d: expected error %v, got %v", idx, c.err, err)
+			continue
+		}
+		if format != c.format {
+			t.Errorf("%d: expected format %s, got %s", idx, c.format, format)
+		}
+		if err != nil {
+			continue
+		}
+		// The peeked bytes should be replayed to the caller
+		replayed, rerr := ioutil.ReadAll(r)
+		if rerr != nil {
+			t.Errorf("%d: unexpected error reading from the returned reader - %v", idx, rerr)
+		} else if !bytes.Equal(replayed, c.input) {
+			t.Errorf("%d: returned reader did not replay the input", idx)
+		}
+	}
+}
+
+func TestExtractAutoDetect(t *testing.T) {
+	payload := make([]byte, 1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+
+	testCases := []struct {
+		input []byte
+		valid func(error) bool
+	}{
+		{compressPayload(t, gzipFormat, payload), func(e error) bool { return e == nil }},
+		{compressPayload(t, zstdFormat, payload), func(e error) bool { return e == nil }},
+		{compressPayload(t, lz4Format, payload), func(e error) bool { return e == nil }},
+		{payload, func(e error) bool { return e != nil }},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{Compressor: AutoDetectCompressor}
+		f, err := ioutil.TempFile("", "zfsbackupsniffertest")
+		if err != nil {
+			t.Fatalf("could not create temp file - %v", err)
+		}
+		defer os.Remove(f.Name())
+		if _, err = f.Write(c.input); err != nil {
+			t.Fatalf("could not write temp file - %v", err)
+		}
+		f.Close()
+
+		vol, err := ExtractLocal(context.Background(), j, f.Name(), false)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		extracted, rerr := ioutil.ReadAll(vol)
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted volume - %v", idx, rerr)
+		} else if !reflect.DeepEqual(extracted, payload) {
+			t.Errorf("%d: extracted bytes not equal to the original payload", idx)
+		}
+		vol.Close()
+	}
+}
+
+func TestExtractAutoDetectVolumes(t *testing.T) {
+	payload := make([]byte, 3*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	stream := append(zfsStreamHeader(zfsStreamMagicLE), payload...)
+	third := len(stream) / 3
+	chunks := [][]byte{stream[:third], stream[third : 2*third], stream[2*third:]}
+
+	testCases := []struct {
+		compress func([]byte) []byte
+	}{
+		// Only the first volume of an uncompressed stream can be identified, the others are read the same way
+		{func(b []byte) []byte { return b }},
+		{func(b []byte) []byte { return compressPayload(t, gzipFormat, b) }},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{Compressor: AutoDetectCompressor}
+		var extracted []byte
+		for vidx, chunk := range chunks {
+			f, err := ioutil.TempFile("", "zfsbackupsniffertest")
+			if err != nil {
+				t.Fatalf("could not create temp file - %v", err)
+			}
+			defer os.Remove(f.Name())
+			if _, err = f.Write(c.compress(chunk)); err != nil {
+				t.Fatalf("could not write temp file - %v", err)
+			}
+			f.Close()
+
+			vol, err := ExtractLocal(context.Background(), j, f.Name(), false)
+			if err != nil {
+				t.Fatalf("%d: could not extract volume %d - %v", idx, vidx+1, err)
+			}
+			b, err := ioutil.ReadAll(vol)
+			if err != nil {
+				t.Fatalf("%d: could not read volume %d - %v", idx, vidx+1, err)
+			}
+			vol.Close()
+			extracted = append(extracted, b...)
+		}
+		if !bytes.Equal(extracted, stream) {
+			t.Errorf("%d: extracted volumes not equal to the original stream", idx)
+		}
+	}
+}
+
+func TestSelectCompressor(t *testing.T) {
+	random := make([]byte, CompressibilityProbeSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), CompressibilityProbeSize/44)
+
+	testCases := []struct {
+		sample     []byte
+		compressor string
+	}{
+		{random, NoCompressor},
+		{compressPayload(t, gzipFormat, random), NoCompressor},
+		{text, ZstdCompressor},
+		{make([]byte, CompressibilityProbeSize), ZstdCompressor},
+		{nil, NoCompressor},
+	}
+
+	for idx, c := range testCases {
+		if compressor := SelectCompressor(c.sample); compressor != c.compressor {
+			t.Errorf("%d: expected compressor %s, got %s", idx, c.compressor, compressor)
+		}
+	}
+}
+
+func TestPerVolumeCompressorRoundTrip(t *testing.T) {
+	random := make([]byte, 1024*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1024*1024/44)
+
+	j := &JobInfo{
+		VolumeName:       "tank/test",
+		BaseSnapshot:     SnapshotInfo{Name: "snap"},
+		Compressor:       AdaptiveCompressor,
+		CompressionLevel: 6,
+		Separator:        "|",
+		MaxFileBuffer:    1,
+	}
+
+	testCases := []struct {
+		payload    []byte
+		compressor string
+	}{
+		{random, NoCompressor},
+		{text, ZstdCompressor},
+		{random, NoCompressor},
+	}
+
+	for idx, c := range testCases {
+		compressor := SelectCompressor(c.payload[:CompressibilityProbeSize])
+		if compressor != c.compressor {
+			t.Errorf("%d: expected compressor %s to be selected, got %s", idx, c.compressor, compressor)
+		}
+		vol, err := CreateBackupVolumeWithCompressor(context.Background(), j, int64(idx+1), compressor)
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, err)
+		}
+		defer vol.DeleteVolume()
+		if _, err = vol.Write(c.payload); err != nil {
+			t.Fatalf("%d: could not write to volume - %v", idx, err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, err)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+
+	// The codec of each volume should survive the manifest
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		t.Fatalf("could not encode manifest - %v", err)
+	}
+	manifest := new(JobInfo)
+	if err = json.Unmarshal(encoded, manifest); err != nil {
+		t.Fatalf("could not decode manifest - %v", err)
+	}
+
+	for idx, c := range testCases {
+		if manifest.Volumes[idx].Compressor != c.compressor {
+			t.Errorf("%d: expected compressor %s recorded in the manifest, got %s", idx, c.compressor, manifest.Volumes[idx].Compressor)
+			continue
+		}
+		level := j.CompressionLevel
+		if c.compressor == NoCompressor {
+			level = 0
+		}
+		if manifest.Volumes[idx].CompressionLevel != level {
+			t.Errorf("%d: expected compression level %d recorded in the manifest, got %d", idx, level, manifest.Volumes[idx].CompressionLevel)
+		}
+
+		// Restore each volume the way a downloaded volume would be
+		vol := &VolumeInfo{ObjectName: manifest.Volumes[idx].ObjectName, Compressor: manifest.Volumes[idx].Compressor, filename: j.Volumes[idx].filename}
+		if err = vol.Extract(context.Background(), manifest, false); err != nil {
+			t.Errorf("%d: could not extract volume - %v", idx, err)
+			continue
+		}
+		extracted, rerr := ioutil.ReadAll(vol)
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted volume - %v", idx, rerr)
+		} else if !bytes.Equal(extracted, c.payload) {
+			t.Errorf("%d: extracted bytes not equal to the original payload", idx)
+		}
+		vol.Close()
+	}
+}
+
+func TestCompressionLevelLimit(t *testing.T) {
+	testCases := []struct {
+		compressor string
+		level      int
+		valid      bool
+	}{
+		{InternalCompressor, 9, true},
+		{InternalCompressor, 10, false},
+		{ZstdCompressor, 19, true},
+		{ZstdCompressor, 22, true},
+		{ZstdCompressor, 23, false},
+		{SeekableZstdCompressor, 22, true},
+		{AdaptiveCompressor, 22, true},
+		{"xz", 10, false},
+		{ZstdCompressor, 0, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{
+			Compressor:         c.compressor,
+			CompressionLevel:   c.level,
+			MaxFileBuffer:      1,
+			MaxParallelUploads: 1,
+			MaxBackoffTime:     time.Minute,
+			Separator:          "|",
+			UploadChunkSize:    10,
+		}
+		if c.compressor == SeekableZstdCompressor {
+			j.CompressionBlockSize = DefaultCompressionBlockSize
+		}
+		if err := j.ValidateSendFlags(); (err == nil) != c.valid {
+			t.Errorf("%d: expected level %d of the %s compressor to be valid=%v, got error %v", idx, c.level, c.compressor, c.valid, err)
+		}
+	}
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	// Random bytes with runs of repeated ones, so the payload is neither trivial nor incompressible
+	payload := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+	for i := 0; i < len(payload); i += 4096 {
+		copy(payload[i:i+2048], bytes.Repeat(payload[i:i+1], 2048))
+	}
+
+	testCases := []struct {
+		compressor string
+		level      int
+	}{
+		{InternalCompressor, 6},
+		{ZstdCompressor, 1},
+		{ZstdCompressor, 6},
+		{ZstdCompressor, 19},
+		{ZstdCompressor, 22},
+		{SeekableZstdCompressor, 22},
+		{NoCompressor, 1},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{
+			VolumeName:       "tank/test",
+			BaseSnapshot:     SnapshotInfo{Name: "snap"},
+			Compressor:       c.compressor,
+			CompressionLevel: c.level,
+			Separator:        "|",
+			MaxFileBuffer:    1,
+		}
+		if c.compressor == SeekableZstdCompressor {
+			j.CompressionBlockSize = DefaultCompressionBlockSize
+		}
+
+		vol, err := CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, err)
+		}
+		defer vol.DeleteVolume()
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("%d: could not write to volume - %v", idx, err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, err)
+		}
+		j.Volumes = append(j.Volumes, vol)
+
+		// The manifest records the compressor, restores pick the decompressor from it
+		encoded, err := json.Marshal(j)
+		if err != nil {
+			t.Fatalf("%d: could not encode manifest - %v", idx, err)
+		}
+		manifest := new(JobInfo)
+		if err = json.Unmarshal(encoded, manifest); err != nil {
+			t.Fatalf("%d: could not decode manifest - %v", idx, err)
+		}
+		if manifest.Compressor != c.compressor || manifest.CompressionLevel != c.level {
+			t.Errorf("%d: expected compressor %s (level %d) recorded in the manifest, got %s (level %d)", idx, c.compressor, c.level, manifest.Compressor, manifest.CompressionLevel)
+		}
+
+		restored := &VolumeInfo{ObjectName: vol.ObjectName, filename: vol.filename}
+		if err = restored.Extract(context.Background(), manifest, false); err != nil {
+			t.Errorf("%d: could not extract volume - %v", idx, err)
+			continue
+		}
+		extracted, rerr := ioutil.ReadAll(restored)
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted volume - %v", idx, rerr)
+		} else if !bytes.Equal(extracted, payload) {
+			t.Errorf("%d: extracted bytes not equal to the original payload", idx)
+		}
+		restored.Close()
+	}
+}
+
+func TestDecompressCommandLine(t *testing.T) {
+	testCases := []struct {
+		j        *JobInfo
+		expected []string
+	}{
+		{&JobInfo{}, nil},
+		{&JobInfo{CompressCommand: "zstd --long=27  -T0"}, []string{"zstd", "-d", "-c"}},
+		{&JobInfo{CompressCommand: "zstd --long=27 -T0", DecompressCommand: "zstd -d -c --long=27"}, []string{"zstd", "-d", "-c", "--long=27"}},
+		{&JobInfo{DecompressCommand: "cat"}, []string{"cat"}},
+	}
+
+	for idx, c := range testCases {
+		if args := c.j.DecompressCommandLine(); !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("%d: expected the decompress command line %v, got %v", idx, c.expected, args)
+		}
+	}
+
+	j := &JobInfo{Compressor: ExternalCompressor, CompressCommand: "zstd --long=27"}
+	if stages := j.RestoreStages(&VolumeInfo{}); len(stages) != 1 || stages[0] != "zstd -d -c" {
+		t.Errorf("expected the restore stages to decompress with the recorded command, got %v", stages)
+	}
+}
+
+func TestExternalCompressor(t *testing.T) {
+	payload := make([]byte, 512*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+
+	testCases := []struct {
+		compressCommand   string
+		decompressCommand string
+		createErr         bool
+		closeErr          bool
+		extractErr        bool
+	}{
+		// cat passes the stream through as-is, validating the plumbing of the external process
+		{"cat", "cat", false, false, false},
+		{"cat -u", "cat", false, false, false},
+		// A compressor exiting with an error fails the volume
+		{"false", "cat", false, true, false},
+		{"zfsbackup-no-such-compressor", "cat", true, false, false},
+		// As does a decompressor that cannot be started
+		{"cat", "zfsbackup-no-such-decompressor", false, false, true},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{
+			VolumeName:      "tank/test",
+			BaseSnapshot:    SnapshotInfo{Name: "snap"},
+			Compressor:      ExternalCompressor,
+			CompressCommand: c.compressCommand,
+			Separator:       "|",
+			MaxFileBuffer:   1,
+		}
+
+		vol, err := CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if (err != nil) != c.createErr {
+			t.Errorf("%d: expected an error creating the volume %v, got %v", idx, c.createErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		defer vol.DeleteVolume()
+		_, err = vol.Write(payload)
+		if cerr := vol.Close(); err == nil {
+			err = cerr
+		}
+		if (err != nil) != c.closeErr {
+			t.Errorf("%d: expected an error writing the volume %v, got %v", idx, c.closeErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !strings.Contains(vol.ObjectName, ".cat") {
+			t.Errorf("%d: expected the volume to be named after the compress command, got %s", idx, vol.ObjectName)
+		}
+
+		// The command is recorded in the manifest, the decompress command is provided on restore
+		encoded, err := json.Marshal(j)
+		if err != nil {
+			t.Fatalf("%d: could not encode manifest - %v", idx, err)
+		}
+		manifest := new(JobInfo)
+		if err = json.Unmarshal(encoded, manifest); err != nil {
+			t.Fatalf("%d: could not decode manifest - %v", idx, err)
+		}
+		if manifest.CompressCommand != c.compressCommand {
+			t.Errorf("%d: expected the compress command %q recorded in the manifest, got %q", idx, c.compressCommand, manifest.CompressCommand)
+		}
+		manifest.DecompressCommand = c.decompressCommand
+
+		restored := &VolumeInfo{ObjectName: vol.ObjectName, filename: vol.filename}
+		err = restored.Extract(context.Background(), manifest, false)
+		if (err != nil) != c.extractErr {
+			t.Errorf("%d: expected an error extracting the volume %v, got %v", idx, c.extractErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		extracted, rerr := ioutil.ReadAll(restored)
+		if cerr := restored.Close(); rerr == nil {
+			rerr = cerr
+		}
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted volume - %v", idx, rerr)
+		} else if !bytes.Equal(extracted, payload) {
+			t.Errorf("%d: extracted bytes not equal to the original payload", idx)
+		}
+	}
+}
+
+func TestManifestCompressionLevel(t *testing.T) {
+	testCases := []struct {
+		compressor string
+		level      int
+	}{
+		{InternalCompressor, 6},
+		{InternalCompressor, 9},
+		// Manifests are always written with gzip, at most at its highest level
+		{ZstdCompressor, 19},
+		{SeekableZstdCompressor, 22},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{
+			VolumeName:       "tank/test",
+			BaseSnapshot:     SnapshotInfo{Name: "snap"},
+			Compressor:       c.compressor,
+			CompressionLevel: c.level,
+			Separator:        "|",
+			ManifestPrefix:   "manifests",
+			MaxFileBuffer:    1,
+		}
+		manifest, err := CreateManifestVolume(context.Background(), j)
+		if err != nil {
+			t.Errorf("%d: could not create manifest at level %d - %v", idx, c.level, err)
+			continue
+		}
+		defer manifest.DeleteVolume()
+		payload := []byte(j.String())
+		if _, err = manifest.Write(payload); err != nil {
+			t.Fatalf("%d: could not write to manifest - %v", idx, err)
+		}
+		if err = manifest.Close(); err != nil {
+			t.Fatalf("%d: could not close manifest - %v", idx, err)
+		}
+
+		restored := &VolumeInfo{ObjectName: manifest.ObjectName, filename: manifest.filename}
+		if err = restored.Extract(context.Background(), j, true); err != nil {
+			t.Errorf("%d: could not extract manifest - %v", idx, err)
+			continue
+		}
+		extracted, rerr := ioutil.ReadAll(restored)
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted manifest - %v", idx, rerr)
+		} else if !bytes.Equal(extracted, payload) {
+			t.Errorf("%d: extracted manifest not equal to the one written", idx)
+		}
+		restored.Close()
+	}
+}
+
+func TestCompressionAlgorithm(t *testing.T) {
+	testCases := []struct {
+		compressor string
+		algorithm  string
+	}{
+		{InternalCompressor, GzipAlgorithm},
+		{ZstdCompressor, ZstdAlgorithm},
+		{SeekableZstdCompressor, ZstdAlgorithm},
+		{AdaptiveCompressor, ZstdAlgorithm},
+		{"xz", ""},
+		{ExternalCompressor, ""},
+		{NoCompressor, ""},
+	}
+
+	payload := bytes.Repeat([]byte("zfsbackup"), 64*1024)
+	for idx, c := range testCases {
+		if algorithm := CompressorAlgorithm(c.compressor); algorithm != c.algorithm {
+			t.Errorf("%d: expected the %s compressor to use the %q algorithm, got %q", idx, c.compressor, c.algorithm, algorithm)
+		}
+		if c.algorithm == "" {
+			continue
+		}
+
+		// A manifest only recording the algorithm is restored with the builtin decompressor for it
+		j := &JobInfo{
+			VolumeName:       "tank/test",
+			BaseSnapshot:     SnapshotInfo{Name: "snap"},
+			Compressor:       algorithmCompressor(c.algorithm),
+			CompressionLevel: 3,
+			Separator:        "|",
+			MaxFileBuffer:    1,
+		}
+		vol, err := CreateBackupVolume(context.Background(), j, int64(idx+1))
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, err)
+		}
+		defer vol.DeleteVolume()
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("%d: could not write to volume - %v", idx, err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, err)
+		}
+
+		restored := &VolumeInfo{ObjectName: vol.ObjectName, filename: vol.filename}
+		if err = restored.Extract(context.Background(), &JobInfo{CompressionAlgorithm: c.algorithm}, false); err != nil {
+			t.Errorf("%d: could not extract volume - %v", idx, err)
+			continue
+		}
+		extracted, rerr := ioutil.ReadAll(restored)
+		if rerr != nil {
+			t.Errorf("%d: could not read extracted volume - %v", idx, rerr)
+		} else if !bytes.Equal(extracted, payload) {
+			t.Errorf("%d: extracted bytes not equal to the original payload", idx)
+		}
+		restored.Close()
+	}
+}
+
+func TestCompressionAlgorithmString(t *testing.T) {
+	testCases := []struct {
+		compressor string
+		level      int
+		expected   string
+	}{
+		{InternalCompressor, 6, "Compression Algorithm: gzip (level 6)"},
+		// The manifest is written at the capped gzip level, not the level of the volumes
+		{ZstdCompressor, 19, "Compression Algorithm: zstd (level 19, manifest at gzip level 9)"},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{CompressionAlgorithm: CompressorAlgorithm(c.compressor), CompressionLevel: c.level}
+		if out := j.String(); !strings.Contains(out, c.expected) {
+			t.Errorf("%d: expected %q in %q", idx, c.expected, out)
+		}
+	}
+}
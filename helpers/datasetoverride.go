@@ -0,0 +1,154 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NoEncryption can be used as the encryptTo setting of a DatasetOverride to store the dataset
+// without any PGP layer, which also means its volumes are not signed.
+const NoEncryption = "none"
+
+// DatasetOverride holds the settings used for a single dataset instead of the global ones.
+// Settings left unset keep their global value.
+type DatasetOverride struct {
+	Dataset          string
+	Compressor       string
+	CompressionLevel int
+	EncryptTo        string
+}
+
+// ParseDatasetOverride will parse an override of the form dataset:setting=value[,setting=value...]
+// where the settings are compressor, compressionLevel, and encryptTo (an email or none).
+func ParseDatasetOverride(override string) (*DatasetOverride, error) {
+	// Dataset names may contain ':' but the settings never do
+	idx := strings.LastIndex(override, ":")
+	if idx <= 0 || idx == len(override)-1 {
+		return nil, fmt.Errorf("invalid dataset override %q, expected the form dataset:setting=value[,setting=value...]", override)
+	}
+
+	o := &DatasetOverride{Dataset: override[:idx]}
+	for _, setting := range strings.Split(override[idx+1:], ",") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid setting %q in the dataset override for %s, expected setting=value", setting, o.Dataset)
+		}
+		switch parts[0] {
+		case "compressor":
+			o.Compressor = parts[1]
+		case "compressionLevel":
+			level, err := strconv.Atoi(parts[1])
+			if err != nil || level < 1 || level > maxZstdCompressionLevel {
+				return nil, fmt.Errorf("the compression level in the dataset override for %s must be between 1 and %d, was given %s", o.Dataset, maxZstdCompressionLevel, parts[1])
+			}
+			o.CompressionLevel = level
+		case "encryptTo":
+			o.EncryptTo = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown setting %s in the dataset override for %s, expected compressor, compressionLevel, or encryptTo", parts[0], o.Dataset)
+		}
+	}
+
+	if limit := CompressionLevelLimit(o.Compressor); o.Compressor != "" && o.CompressionLevel > limit {
+		return nil, fmt.Errorf("the compression level in the dataset override for %s must be between 1 and %d for the %s compressor, was given %d", o.Dataset, limit, o.Compressor, o.CompressionLevel)
+	}
+
+	return o, nil
+}
+
+// ValidateDatasetOverrides will check that each dataset override of this JobInfo can be parsed
+// and that no dataset is overridden more than once.
+func (j *JobInfo) ValidateDatasetOverrides() error {
+	seen := make(map[string]bool, len(j.DatasetOverrides))
+	for _, override := range j.DatasetOverrides {
+		o, err := ParseDatasetOverride(override)
+		if err != nil {
+			return err
+		}
+		if seen[o.Dataset] {
+			return fmt.Errorf("the dataset %s is overridden more than once", o.Dataset)
+		}
+		seen[o.Dataset] = true
+	}
+
+	return nil
+}
+
+// ApplyDatasetOverride will merge the override for this JobInfo's dataset, if any, over its
+// settings. The effective settings are recorded in the manifest of the backup set.
+func (j *JobInfo) ApplyDatasetOverride() error {
+	for _, override := range j.DatasetOverrides {
+		o, err := ParseDatasetOverride(override)
+		if err != nil {
+			return err
+		}
+		if o.Dataset != j.VolumeName {
+			continue
+		}
+
+		if o.Compressor != "" {
+			j.Compressor = o.Compressor
+			switch {
+			case j.Compressor != SeekableZstdCompressor:
+				j.CompressionBlockSize = 0
+			case j.CompressionBlockSize == 0:
+				j.CompressionBlockSize = DefaultCompressionBlockSize
+			}
+			if j.Compressor != ExternalCompressor {
+				j.CompressCommand = ""
+			}
+		}
+		if o.CompressionLevel != 0 {
+			j.CompressionLevel = o.CompressionLevel
+		}
+		if limit := CompressionLevelLimit(j.Compressor); j.CompressionLevel > limit {
+			return fmt.Errorf("the compression level %d in the dataset override for %s is above the highest level of the %s compressor (%d)", j.CompressionLevel, o.Dataset, j.Compressor, limit)
+		}
+
+		switch o.EncryptTo {
+		case "":
+		case NoEncryption:
+			j.EncryptTo, j.EncryptKey = "", nil
+			j.SignFrom, j.SignKey = "", nil
+		default:
+			key := GetPublicKeyByEmail(o.EncryptTo)
+			if key == nil {
+				return &OperationError{Op: "encrypt", Dataset: j.VolumeName, Kind: ErrKeyMissing, Err: fmt.Errorf("could not find public key for %s", o.EncryptTo)}
+			}
+			j.EncryptTo, j.EncryptKey = o.EncryptTo, key
+		}
+
+		AppLogger.Infof("Backing up %s with the compressor %s (level %d) and %s.", j.VolumeName, j.Compressor, j.CompressionLevel, describeEncryption(j))
+		return nil
+	}
+
+	return nil
+}
+
+func describeEncryption(j *JobInfo) string {
+	if j.EncryptKey == nil {
+		return "no encryption"
+	}
+	return fmt.Sprintf("encryption to %s", j.EncryptTo)
+}
@@ -0,0 +1,135 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestParseDatasetOverride(t *testing.T) {
+	testCases := []struct {
+		override string
+		expected *DatasetOverride
+		valid    bool
+	}{
+		{"tank/media:compressor=none,encryptTo=none", &DatasetOverride{Dataset: "tank/media", Compressor: NoCompressor, EncryptTo: NoEncryption}, true},
+		{"tank/db:compressionLevel=3", &DatasetOverride{Dataset: "tank/db", CompressionLevel: 3}, true},
+		{"tank/a:b:compressor=zstd,compressionLevel=9,encryptTo=backup@example.com", &DatasetOverride{Dataset: "tank/a:b", Compressor: ZstdCompressor, CompressionLevel: 9, EncryptTo: "backup@example.com"}, true},
+		{"tank/media", nil, false},
+		{":compressor=none", nil, false},
+		{"tank/media:", nil, false},
+		{"tank/media:compressor", nil, false},
+		{"tank/media:compressor=", nil, false},
+		{"tank/media:compressionLevel=19,compressor=zstd", &DatasetOverride{Dataset: "tank/media", Compressor: ZstdCompressor, CompressionLevel: 19}, true},
+		{"tank/media:compressor=internal,compressionLevel=10", nil, false},
+		{"tank/media:compressionLevel=23", nil, false},
+		{"tank/media:compressionLevel=fast", nil, false},
+		{"tank/media:cipher=aes", nil, false},
+	}
+
+	for idx, c := range testCases {
+		o, err := ParseDatasetOverride(c.override)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid=%v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, c.expected) {
+			t.Errorf("%d: expected %+v, got %+v", idx, c.expected, o)
+		}
+	}
+
+	j := &JobInfo{DatasetOverrides: []string{"tank/a:compressor=none", "tank/b:compressor=zstd", "tank/a:compressionLevel=1"}}
+	if err := j.ValidateDatasetOverrides(); err == nil {
+		t.Errorf("expected a dataset overridden more than once to be rejected")
+	}
+}
+
+func TestApplyDatasetOverride(t *testing.T) {
+	global := newTestEntity(t, "global@example.com")
+	other := newTestEntity(t, "other@example.com")
+	var otherID string
+	for id := range other.Identities {
+		otherID = id
+	}
+	origPubRing := pubRing
+	defer func() { pubRing = origPubRing }()
+	pubRing = openpgp.EntityList{global, other}
+
+	newJob := func(volume string, overrides ...string) *JobInfo {
+		return &JobInfo{
+			VolumeName:       volume,
+			Compressor:       ZstdCompressor,
+			CompressionLevel: 6,
+			EncryptTo:        "global@example.com",
+			EncryptKey:       global,
+			SignFrom:         "global@example.com",
+			SignKey:          global,
+			DatasetOverrides: overrides,
+		}
+	}
+
+	testCases := []struct {
+		job        *JobInfo
+		compressor string
+		level      int
+		blockSize  int
+		encryptKey *openpgp.Entity
+		signKey    *openpgp.Entity
+		valid      bool
+	}{
+		// Datasets without an override keep the global settings
+		{newJob("tank/db"), ZstdCompressor, 6, 0, global, global, true},
+		{newJob("tank/db", "tank/media:compressor=none,encryptTo=none"), ZstdCompressor, 6, 0, global, global, true},
+		{newJob("tank/media", "tank/media:compressor=none,encryptTo=none"), NoCompressor, 6, 0, nil, nil, true},
+		{newJob("tank/media", "tank/db:compressionLevel=1", "tank/media:compressionLevel=2"), ZstdCompressor, 2, 0, global, global, true},
+		{newJob("tank/media", "tank/media:encryptTo="+otherID), ZstdCompressor, 6, 0, other, global, true},
+		{newJob("tank/media", "tank/media:compressor="+SeekableZstdCompressor), SeekableZstdCompressor, 6, DefaultCompressionBlockSize, global, global, true},
+		{newJob("tank/media", "tank/media:encryptTo=unknown@example.com"), "", 0, 0, nil, nil, false},
+	}
+
+	for idx, c := range testCases {
+		err := c.job.ApplyDatasetOverride()
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid=%v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if err != nil {
+			var oerr *OperationError
+			if !errors.As(err, &oerr) || oerr.Kind != ErrKeyMissing || oerr.Dataset != c.job.VolumeName {
+				t.Errorf("%d: expected a missing key error for %s, got %v", idx, c.job.VolumeName, err)
+			}
+			continue
+		}
+		if c.job.Compressor != c.compressor || c.job.CompressionLevel != c.level || c.job.CompressionBlockSize != c.blockSize {
+			t.Errorf("%d: expected compressor %s (level %d, block size %d), got %s (level %d, block size %d)", idx, c.compressor, c.level, c.blockSize, c.job.Compressor, c.job.CompressionLevel, c.job.CompressionBlockSize)
+		}
+		if c.job.EncryptKey != c.encryptKey || c.job.SignKey != c.signKey {
+			t.Errorf("%d: expected encryption and signing keys %v and %v, got %v and %v", idx, c.encryptKey, c.signKey, c.job.EncryptKey, c.job.SignKey)
+		}
+		if (c.job.EncryptKey == nil) != (c.job.EncryptTo == "") {
+			t.Errorf("%d: expected the recorded encryptTo %q to match the encryption key", idx, c.job.EncryptTo)
+		}
+	}
+}
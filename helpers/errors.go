@@ -0,0 +1,79 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of failure an OperationError can be tested for with errors.Is, whatever operation failed.
+var (
+	// ErrBackendUnreachable is the kind of failure where a destination could not be initialized or written to.
+	ErrBackendUnreachable = errors.New("the backend could not be reached")
+	// ErrChainBroken is the kind of failure where a backup set, or the snapshot it increments from, is missing or out of order.
+	ErrChainBroken = errors.New("the chain of incremental backups is broken")
+	// ErrChecksumMismatch is the kind of failure where data does not match the checksum recorded for it.
+	ErrChecksumMismatch = errors.New("the data does not match its checksum")
+	// ErrKeyMissing is the kind of failure where a key needed to encrypt, sign or decrypt was not found.
+	ErrKeyMissing = errors.New("a required key was not found")
+	// ErrAuthFailed is the kind of failure where a destination rejected the credentials it was accessed with.
+	ErrAuthFailed = errors.New("the backend denied access")
+	// ErrZFSFailed is the kind of failure where a zfs command exited with an error.
+	ErrZFSFailed = errors.New("a zfs command failed")
+)
+
+// OperationError describes an operation that failed, the dataset and volume it failed on, if any, and why.
+// errors.Is matches its Kind as well as the underlying error, and errors.As will find it wrapped in other errors.
+type OperationError struct {
+	Op      string // The operation that failed, e.g. upload, download or restore
+	Dataset string // The dataset the operation was for, if any
+	Volume  string // The object name of the volume the operation was for, if any
+	Kind    error  // One of the kinds of failure above
+	Err     error  // The underlying error
+}
+
+func (e *OperationError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Dataset != "" {
+		fmt.Fprintf(&b, " of %s", e.Dataset)
+	}
+	if e.Volume != "" {
+		fmt.Fprintf(&b, " (volume %s)", e.Volume)
+	}
+	fmt.Fprintf(&b, " failed: %v", e.Kind)
+	if e.Err != nil {
+		fmt.Fprintf(&b, " - %v", e.Err)
+	}
+	return b.String()
+}
+
+// Unwrap returns the underlying error.
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the provided error is the kind of failure of this error.
+func (e *OperationError) Is(target error) bool {
+	return target == e.Kind
+}
@@ -0,0 +1,82 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestOperationError(t *testing.T) {
+	cause := errors.New("connection refused")
+
+	testCases := []struct {
+		err      *OperationError
+		matches  []error
+		excludes []error
+		message  string
+	}{
+		{
+			err:      &OperationError{Op: "upload to s3://bucket", Dataset: "tank/data", Volume: "vol1", Kind: ErrBackendUnreachable, Err: cause},
+			matches:  []error{ErrBackendUnreachable, cause},
+			excludes: []error{ErrChainBroken, ErrChecksumMismatch, ErrKeyMissing},
+			message:  "upload to s3://bucket of tank/data (volume vol1) failed: the backend could not be reached - connection refused",
+		},
+		{
+			err:      &OperationError{Op: "check snapshot chain", Dataset: "tank/data", Kind: ErrChainBroken, Err: fmt.Errorf("%w: b increments from a", ErrNonMonotonicSnapshots)},
+			matches:  []error{ErrChainBroken, ErrNonMonotonicSnapshots},
+			excludes: []error{ErrBackendUnreachable, cause},
+			message:  "check snapshot chain of tank/data failed: the chain of incremental backups is broken - snapshot creation times are not monotonic along the backup chain: b increments from a",
+		},
+		{
+			err:      &OperationError{Op: "decrypt", Kind: ErrKeyMissing},
+			matches:  []error{ErrKeyMissing},
+			excludes: []error{ErrChecksumMismatch, ErrNoDecryptionKey},
+			message:  "decrypt failed: a required key was not found",
+		},
+	}
+
+	for idx, c := range testCases {
+		if c.err.Error() != c.message {
+			t.Errorf("%d: expected message %q, got %q", idx, c.message, c.err.Error())
+		}
+
+		// The error should be found as-is and when wrapped by callers
+		for _, err := range []error{c.err, fmt.Errorf("could not back up: %w", c.err)} {
+			for _, target := range c.matches {
+				if !errors.Is(err, target) {
+					t.Errorf("%d: expected %v to match %v", idx, err, target)
+				}
+			}
+			for _, target := range c.excludes {
+				if errors.Is(err, target) {
+					t.Errorf("%d: expected %v not to match %v", idx, err, target)
+				}
+			}
+
+			var oerr *OperationError
+			if !errors.As(err, &oerr) || oerr != c.err {
+				t.Errorf("%d: expected to extract the operation error from %v, got %v", idx, err, oerr)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+const (
+	// MD5Hash is the name the md5 hash is registered under.
+	MD5Hash = "md5"
+	// SHA256Hash is the name the sha256 hash is registered under and the hash used to verify
+	// volumes of backup sets that do not record a hash algorithm.
+	SHA256Hash = "sha256"
+)
+
+// HashFactory returns a new hash.Hash used to compute the checksum of a volume.
+type HashFactory func() hash.Hash
+
+var (
+	// ErrUnknownHash is returned when looking up a hash algorithm that has not been registered.
+	ErrUnknownHash = errors.New("unknown hash algorithm")
+
+	hashesMutex sync.RWMutex
+	hashes      = map[string]HashFactory{
+		MD5Hash:    md5.New,
+		SHA256Hash: sha256.New,
+	}
+
+	// deprecatedHashes are still used to verify the backup sets recording them but should not be used by new backup sets.
+	deprecatedHashes = map[string]bool{
+		MD5Hash: true,
+	}
+)
+
+// RegisterHash will register the provided factory under the provided name so it can be used to
+// compute and verify the checksums of volumes. The name is recorded in the manifest of backup sets
+// using it, so the same factory must be registered under the same name to restore them.
+func RegisterHash(name string, factory HashFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("a name and a factory are required to register a hash algorithm")
+	}
+
+	hashesMutex.Lock()
+	defer hashesMutex.Unlock()
+	if _, ok := hashes[name]; ok {
+		return fmt.Errorf("a hash algorithm is already registered as %s", name)
+	}
+	hashes[name] = factory
+
+	return nil
+}
+
+// GetHash will return the factory registered under the provided name. An empty name returns the
+// factory of the SHA256Hash, which is used by backup sets that do not record a hash algorithm.
+func GetHash(name string) (HashFactory, error) {
+	if name == "" {
+		name = SHA256Hash
+	}
+
+	hashesMutex.RLock()
+	defer hashesMutex.RUnlock()
+	factory, ok := hashes[name]
+	if !ok {
+		return nil, ErrUnknownHash
+	}
+
+	return factory, nil
+}
+
+// IsDeprecatedHash will return true if the hash algorithm registered under the provided name is deprecated. Backup sets
+// using it can still be restored and verified, but new backup sets should use another algorithm.
+func IsDeprecatedHash(name string) bool {
+	return deprecatedHashes[name]
+}
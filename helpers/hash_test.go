@@ -0,0 +1,108 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func TestRegisterHash(t *testing.T) {
+	if _, err := GetHash("fnv128a"); err != nil {
+		if err = RegisterHash("fnv128a", fnv.New128a); err != nil {
+			t.Fatalf("could not register hash - %v", err)
+		}
+	}
+
+	if err := RegisterHash("fnv128a", fnv.New128a); err == nil {
+		t.Errorf("expected registering a hash under an existing name to fail")
+	}
+	if err := RegisterHash(SHA256Hash, fnv.New128a); err == nil {
+		t.Errorf("expected replacing a default hash to fail")
+	}
+	if err := RegisterHash("", fnv.New128a); err == nil {
+		t.Errorf("expected registering a hash without a name to fail")
+	}
+	if err := RegisterHash("nil", nil); err == nil {
+		t.Errorf("expected registering a hash without a factory to fail")
+	}
+
+	payload := []byte("zfs send stream")
+	custom := fnv.New128a()
+	custom.Write(payload)
+
+	testCases := []struct {
+		algorithm string
+		sum       string
+		err       error
+	}{
+		// Backup sets without a hash algorithm are verified with their sha256 checksum
+		{"", fmt.Sprintf("%x", sha256.Sum256(payload)), nil},
+		{MD5Hash, fmt.Sprintf("%x", md5.Sum(payload)), nil},
+		{SHA256Hash, fmt.Sprintf("%x", sha256.Sum256(payload)), nil},
+		{"fnv128a", fmt.Sprintf("%x", custom.Sum(nil)), nil},
+		{"unregistered", "", ErrUnknownHash},
+	}
+
+	for idx, c := range testCases {
+		vol, err := CreateSimpleVolume(context.Background(), false, c.algorithm)
+		if err != c.err {
+			t.Errorf("%d: expected error %v, got %v", idx, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("%d: could not write to volume - %v", idx, err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("%d: could not close volume - %v", idx, err)
+		}
+		vol.DeleteVolume()
+
+		if sum := vol.Checksum(c.algorithm); sum != c.sum {
+			t.Errorf("%d: expected a %s checksum of %q, got %q", idx, c.algorithm, c.sum, sum)
+		}
+	}
+}
+
+func TestIsDeprecatedHash(t *testing.T) {
+	testCases := []struct {
+		algorithm  string
+		deprecated bool
+	}{
+		{"", false},
+		{MD5Hash, true},
+		{SHA256Hash, false},
+		{"unregistered", false},
+	}
+
+	for idx, c := range testCases {
+		if deprecated := IsDeprecatedHash(c.algorithm); deprecated != c.deprecated {
+			t.Errorf("%d: expected %q to be deprecated: %v, got %v", idx, c.algorithm, c.deprecated, deprecated)
+		}
+	}
+}
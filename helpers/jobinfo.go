@@ -21,8 +21,11 @@
 package helpers
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,8 +33,51 @@ import (
 	"golang.org/x/crypto/openpgp"
 )
 
+const (
+	// KeyCasePreserve will use dataset and snapshot names as-is in object keys.
+	KeyCasePreserve = "preserve"
+	// KeyCaseLower will lowercase dataset and snapshot names in object keys.
+	KeyCaseLower = "lower"
+
+	// KeyPrefixPath will identify datasets by their full path, including the pool, in object keys.
+	KeyPrefixPath = "path"
+	// KeyPrefixHash will suffix the full path of datasets with a hash of it in object keys, keeping them unique
+	// even once normalized, e.g. when datasets only differ by case and are lowercased.
+	KeyPrefixHash = "hash"
+
+	// SnapshotChangeAbort will fail a backup whose snapshot was destroyed or created again while it was being sent.
+	SnapshotChangeAbort = "abort"
+	// SnapshotChangeRestart will restart a backup from scratch, once, when its snapshot was created again while it was being sent.
+	SnapshotChangeRestart = "restart"
+
+	// ScratchCheckOff will not check the scratch filesystem before a backup.
+	ScratchCheckOff = "off"
+	// ScratchCheckWarn will warn when the scratch filesystem lacks the space or inodes to buffer the volumes of a backup.
+	ScratchCheckWarn = "warn"
+	// ScratchCheckFail will fail a backup before it starts when the scratch filesystem lacks the space or inodes to buffer its volumes.
+	ScratchCheckFail = "fail"
+
+	// ListFormatList will list every backup set with its details.
+	ListFormatList = "list"
+	// ListFormatTree will list the backup sets of each dataset as a tree of full backups and the incrementals depending on them.
+	ListFormatTree = "tree"
+	// ListFormatDOT will output the dependency tree of the backup sets as a graph in the DOT language.
+	ListFormatDOT = "dot"
+
+	// VerifyUploadsETag will check the size and ETag of each uploaded object against the volume (only supported by the s3 backend).
+	VerifyUploadsETag = "etag"
+	// VerifyUploadsReadback will download each volume again once it is uploaded and compare its checksum against the volume.
+	VerifyUploadsReadback = "readback"
+)
+
+// keyPrefixHashBytes is the number of bytes of the SHA256 hash of a dataset's path used with KeyPrefixHash.
+const keyPrefixHashBytes = 6
+
 var (
 	disallowedSeps = regexp.MustCompile(`^[\w\-:\.]+`) // Disallowed by ZFS
+
+	// ErrNonMonotonicSnapshots is returned when a snapshot in a backup chain was created before the snapshot it increments from.
+	ErrNonMonotonicSnapshots = errors.New("snapshot creation times are not monotonic along the backup chain")
 )
 
 // JobInfo represents the relevant information for a job that can be used to read
@@ -55,20 +101,163 @@ type JobInfo struct {
 	Deduplication           bool
 	Properties              bool
 	IntermediaryIncremental bool
-	Resume                  bool `json:"-"`
+	// The stream was sent with large blocks (-L) and/or with its blocks compressed as stored on disk (-c), the
+	// receiving pool must support the features these need, see StreamFeatures
+	LargeBlocks    bool `json:",omitempty"`
+	CompressedSend bool `json:",omitempty"`
+	// The compression property of the dataset when its stream was sent compressed (-c), which its blocks are sent with
+	SendCompression string `json:",omitempty"`
+	// The stream was sent raw (-w), the blocks of an encrypted dataset are sent as stored on disk, still encrypted,
+	// and must be received raw as well, keeping the encryption of the sending dataset
+	RawSend bool `json:",omitempty"`
+	// The incremental stream was sent from this bookmark of the dataset instead of the snapshot it was created from,
+	// IncrementalSnapshot still describes that snapshot, which the backup set is received on top of
+	IncrementalBookmark string `json:",omitempty"`
+	// The algorithm the volumes were compressed with when using a builtin compressor, see CompressorAlgorithm
+	CompressionAlgorithm string `json:",omitempty"`
+	// Normalization applied to the dataset and snapshot names used in object keys
+	KeyCase             string `json:",omitempty"`
+	KeyDatasetSeparator string `json:",omitempty"`
+	KeyPrefix           string `json:",omitempty"`
+	// The send stream was uploaded as a single object instead of being split into volumes
+	SingleObject bool `json:",omitempty"`
+	// The user properties (module:property) of the dataset when it was backed up, reapplied after receiving it
+	UserProperties map[string]string `json:",omitempty"`
+	// User supplied key/values recorded when backing up, and surfaced after restoring, see MetadataRecord
+	Metadata map[string]string `json:",omitempty"`
+	// The name of the registered hash algorithm used to verify the volumes, sha256 if not set
+	HashAlgorithm string `json:",omitempty"`
+	// The size, in KiB, of the independently compressed blocks of volumes using the seekable zstd compressor
+	CompressionBlockSize int `json:",omitempty"`
+	// The command line the volumes were piped through to compress them when using the external compressor
+	CompressCommand string `json:",omitempty"`
+	// The oldest version of zfsbackup that can restore this backup, based on the features it uses
+	MinReaderVersion float64 `json:",omitempty"`
+	// The root of a Merkle tree over the SHA256 checksums of all the volumes, in order, see ComputeMerkleRoot
+	MerkleRoot string `json:",omitempty"`
+	// The SHA256 checksum of the whole send stream, before it was split into volumes
+	StreamSHA256 string `json:",omitempty"`
+	// Grouped backups are backed up and restored together, in order, under a single manifest
+	GroupName    string     `json:",omitempty"`
+	GroupMembers []*JobInfo `json:",omitempty"`
+	InGroup      bool       `json:"-"`
+	Resume       bool       `json:"-"`
+	// Expert option: start uploading at this volume number, trusting the previous volumes were uploaded
+	StartAtVolume int64 `json:"-"`
+	// Stream the backup as a single object if the send stream is estimated to be smaller than this many MiB
+	SingleObjectBelow uint64 `json:"-"`
+	// Reference identical volumes already uploaded by other backup sets instead of uploading them again
+	DedupVolumes bool `json:"-"`
+	// The volumes that can be shared, read once and reused by every member of a group
+	SharedVolumes map[string]*VolumeInfo `json:"-"`
+	// Upload a shell script documenting how to restore the backup set without zfsbackup alongside it
+	GenerateRestoreScript bool   `json:"-"`
+	RestoreScript         string `json:",omitempty"`
+	// Upload the checksums of the volumes as stored, unencrypted, alongside the backup set so they can be verified without its keys
+	GenerateChecksums bool   `json:"-"`
+	Checksums         string `json:",omitempty"`
+	// Manifests larger than MaxManifestSize MiB are split, the volumes are written to the ManifestParts objects, in order,
+	// which are read back when the manifest is read. Each part records its ManifestPart number, starting at 1.
+	MaxManifestSize uint64   `json:"-"`
+	ManifestParts   []string `json:",omitempty"`
+	ManifestPart    int      `json:",omitempty"`
+	// Uploaded objects are tagged to expire after ExpireAfter, at ExpiresAt (only supported by the s3 backend)
+	ExpireAfter time.Duration `json:"-"`
+	ExpiresAt   *time.Time    `json:",omitempty"`
+	// Datasets backed up independently, each under its own manifest, on a best-effort basis
+	Datasets []*JobInfo `json:"-"`
+	// Abort a multi-dataset run once more than this many (e.g. 3) or this percentage (e.g. 25%) of its datasets failed
+	MaxFailures string `json:"-"`
+	// Skip incremental backups with no more than UnchangedThreshold bytes written since the snapshot they increment from,
+	// no backup set is created and Unchanged is set instead
+	SkipUnchanged      bool   `json:"-"`
+	UnchangedThreshold uint64 `json:"-"`
+	Unchanged          bool   `json:"-"`
+	// Per-dataset compression and encryption settings merged over the global ones, see ParseDatasetOverride
+	DatasetOverrides []string `json:"-"`
+	// Read the snapshots to backup, in order, from this file (or stdin when "-"), see ReadSnapshotList
+	SnapshotList string `json:"-"`
 	// "Smart" Options
 	Full            bool          `json:"-"`
 	Incremental     bool          `json:"-"`
 	FullIfOlderThan time.Duration `json:"-"`
+	// Fail instead of warning when the creation times along the backup chain are out of order
+	StrictSnapshotOrder bool `json:"-"`
+	// Take a snapshot of each dataset, named after this template, before backing it up, see RenderSnapshotName
+	SnapshotTemplate string `json:"-"`
+	// Wait for another backup of the same dataset to the same destinations to finish instead of failing with ErrAlreadyRunning
+	WaitForLock bool `json:"-"`
 
 	// ZFS Receive options
-	Force       bool   `json:"-"`
-	FullPath    bool   `json:"-"`
-	LastPath    bool   `json:"-"`
-	NotMounted  bool   `json:"-"`
-	Origin      string `json:"-"`
-	LocalVolume string `json:"-"`
-	AutoRestore bool   `json:"-"`
+	Force             bool     `json:"-"`
+	FullPath          bool     `json:"-"`
+	LastPath          bool     `json:"-"`
+	NotMounted        bool     `json:"-"`
+	Origin            string   `json:"-"`
+	PropertyOverrides []string `json:"-"`
+	LocalVolume       string   `json:"-"`
+	AutoRestore       bool     `json:"-"`
+	SSHHost           string   `json:"-"`
+	SSHOptions        []string `json:"-"`
+	TrustedSigners    []string `json:"-"`
+	// Capture the user properties of the dataset in the manifest when backing up, and reapply them after receiving it,
+	// limited to the user properties in these namespaces if any
+	SyncUserProperties     bool     `json:"-"`
+	UserPropertyNamespaces []string `json:"-"`
+	// Record the output of this executable in the metadata of the manifest when backing up, see RunMetadataHook
+	MetadataHook string `json:"-"`
+	// Surface the metadata of each received backup set by appending it to this file and/or passing it to this
+	// executable once the backup set was received
+	MetadataFile    string `json:"-"`
+	PostRestoreHook string `json:"-"`
+	// The command line to pipe volumes compressed with the external compressor through to decompress them, see
+	// DecompressCommandLine
+	DecompressCommand string `json:"-"`
+	// Return the receive target to its state before the restore if the restore fails, see RollbackSnapshot
+	RollbackOnFailure bool `json:"-"`
+	// Compare the digest of the reassembled send stream against StreamSHA256 before completing the receive
+	VerifyStream bool `json:"-"`
+	// Exclude the encryption property of the stream so the received dataset inherits the encryption of its parent
+	InheritEncryption bool `json:"-"`
+	// Restore the newest or selected backup set of several datasets at once, see BatchRestore
+	BatchSelectors           []string `json:"-"`
+	BatchAll                 bool     `json:"-"`
+	TargetMap                []string `json:"-"`
+	MaxParallelBatchRestores int      `json:"-"`
+	// Write the reassembled send stream to this file instead of receiving it, e.g. to carry it to an air-gapped system
+	OutputFile string `json:"-"`
+	// Only write this range of the send stream to the OutputFile, downloading only the blocks of the volumes it spans
+	OutputOffset int64 `json:"-"`
+	OutputLength int64 `json:"-"`
+	// Keep the volumes downloaded in the cache dir until received so a restore run again after failing resumes their downloads, see resumeSequence
+	ResumableRestore bool `json:"-"`
+	// Persist the progress of an auto restore to this file so it resumes near where it stopped, see RestoreState
+	RestoreStateFile string        `json:"-"`
+	RestoreState     *RestoreState `json:"-"`
+	// Download at most this many volumes of a backup set at a time, 0 to download as many as the file buffer holds
+	MaxParallelDownloads int `json:"-"`
+	// Download at most this many volumes, and this many MiB of volumes, ahead of the volume being received, 0 for no limit
+	ReadAheadVolumes int    `json:"-"`
+	ReadAheadSize    uint64 `json:"-"`
+	// Decrypt the backup set with whichever private key of the secret key ring it was encrypted to, see FindDecryptionKey
+	DiscoverDecryptionKey bool `json:"-"`
+
+	// List options
+	ListLimit     int           `json:"-"`
+	ListNewerThan time.Duration `json:"-"`
+	// How to output the backup sets, see ListFormatList, ListFormatTree and ListFormatDOT
+	ListFormat string `json:"-"`
+
+	// Clean options
+	// Only delete unreferenced objects last modified longer ago than this, protecting the volumes of backups still in progress
+	GracePeriod time.Duration `json:"-"`
+	// Retention policy: keep this many full backup sets per dataset and the backup sets newer than KeepDuration, 0 to disable
+	KeepFullCount int           `json:"-"`
+	KeepDuration  time.Duration `json:"-"`
+
+	// Run zfs send and receive again up to this many times when they fail with error output matching ZFSRetryPatterns
+	ZFSRetries       int      `json:"-"`
+	ZFSRetryPatterns []string `json:"-"`
 
 	Destinations       []string        `json:"-"`
 	VolumeSize         uint64          `json:"-"`
@@ -81,12 +270,99 @@ type JobInfo struct {
 	SignKey            *openpgp.Entity `json:"-"`
 	ParentSnap         *JobInfo        `json:"-"`
 	UploadChunkSize    int             `json:"-"`
+	UploadPartRetries  int             `json:"-"`
+	DNSCacheTTL        time.Duration   `json:"-"`
+	MaxConnsPerHost    int             `json:"-"`
+	IPFamily           string          `json:"-"`
+	InitRetryTime      time.Duration   `json:"-"`
+	RequestTimeout     time.Duration   `json:"-"`
+	// Warn about, or fail on, a clock further off the clock of a backend than MaxClockSkew, see backends.ClockSkewCheckWarn
+	ClockSkewCheck string        `json:"-"`
+	MaxClockSkew   time.Duration `json:"-"`
+	// Write copies of the manifest under these prefixes, and to these destinations, tried in order when it is missing
+	ManifestMirrorPrefixes     []string `json:"-"`
+	ManifestMirrorDestinations []string `json:"-"`
+	// Cancel and retry the upload of a volume taking longer than UploadTimeout plus the time needed to upload it at MinUploadThroughput KiB/s
+	UploadTimeout       time.Duration `json:"-"`
+	MinUploadThroughput uint64        `json:"-"`
+	// Limit the rate of all uploads, and of all downloads, between them to this many bytes per second, see ThrottleUploads
+	MaxUploadBytesPerSecond   uint64 `json:"-"`
+	MaxDownloadBytesPerSecond uint64 `json:"-"`
+	// What to do when the snapshot being sent is destroyed or created again during the backup, either abort or restart
+	OnSnapshotChange string `json:"-"`
+	// Check the scratch filesystem can buffer the volumes of a backup before it starts, one of off, warn or fail
+	ScratchCheck string `json:"-"`
+	// Only start a backup within this time of day, exiting with ErrStartWindowMissed without touching any destination otherwise
+	StartWindow *StartWindow `json:"-"`
+	// Run the send pipeline without uploading anything or writing a manifest, logging what would be uploaded where instead
+	DryRun bool `json:"-"`
+
+	// Tune the number of parallel uploads between MinParallelUploads and MaxParallelUploads based on throughput
+	AutoTuneUploads    bool `json:"-"`
+	MinParallelUploads int  `json:"-"`
+
+	// Adapt the compression level of each volume, between MinCompressionLevel and MaxCompressionLevel, to the upload throughput
+	AdaptiveCompressionLevel bool `json:"-"`
+	MinCompressionLevel      int  `json:"-"`
+	MaxCompressionLevel      int  `json:"-"`
+	// Compress up to this many blocks of each volume at once with the zstd-seekable compressor, 0 for one per CPU
+	CompressionConcurrency int `json:"-"`
+	// Pin the goroutine compressing and encrypting the send stream, and the upload workers, to these CPUs (Linux only), see PinToCPUs
+	CompressionCPUs []int `json:"-"`
+	UploadCPUs      []int `json:"-"`
+	// Notified of the size of each volume uploaded and how long the upload took
+	UploadObserver func(size uint64, elapsed time.Duration) `json:"-"`
+
+	// Warn when, or fail if, a backup would bring the number of objects in a destination to this many
+	ObjectCountWarning int `json:"-"`
+	MaxObjectCount     int `json:"-"`
+
+	// Fail a backup before it starts if a destination reporting its free space would be left with less than MinFreeSpace MiB
+	CheckDestinationSpace bool   `json:"-"`
+	MinFreeSpace          uint64 `json:"-"`
+
+	// Upload each volume to all destinations at once and consider it uploaded once this many of them acknowledged it
+	UploadQuorum int `json:"-"`
+	// How long to wait for the uploads that missed the quorum once the backup completed before cancelling them
+	QuorumStragglerTimeout time.Duration `json:"-"`
+
+	// Limits applied when restoring objects from Glacier before downloading them (only supported by the s3 backend)
+	MaxParallelRestores int     `json:"-"`
+	RestoreRequestRate  float64 `json:"-"`
+
+	// Directory to write a Prometheus textfile collector metrics file to after each backup
+	MetricsTextfileDir string `json:"-"`
+
+	// Immutability options applied to uploaded objects (only supported by the azure backend)
+	ImmutabilityPeriod time.Duration `json:"-"`
+	ImmutabilityLocked bool          `json:"-"`
+	LegalHold          bool          `json:"-"`
+
+	// Upload volumes with a conditional request that fails if the object already exists (only supported by the s3 backend)
+	ConditionalUpload bool `json:"-"`
+	// How each uploaded object is verified before considering it uploaded, one of VerifyUploadsETag or VerifyUploadsReadback
+	VerifyUploads string `json:"-"`
+	// Upload volumes to this storage class instead of the default one (only supported by the s3 backend)
+	StorageClass string `json:"-"`
+	// Encrypt uploaded objects at rest with this server-side encryption, optionally with a KMS key of our own (only supported by the s3 backend)
+	ServerSideEncryption string `json:"-"`
+	KMSKeyID             string `json:"-"`
+
+	// Write manifests in this format, either json or binary, see EncodeManifest
+	ManifestFormat string `json:"-"`
+	// Fail the verification of backup sets recording a deprecated hash algorithm instead of warning, see IsDeprecatedHash
+	StrictHashAlgorithm bool `json:"-"`
+
+	// The format detected from the first volume of a backup set recording no compressor, applied to all of its volumes
+	detectedFormat string
 }
 
 // SnapshotInfo represents a snapshot with relevant information.
 type SnapshotInfo struct {
 	CreationTime time.Time
 	Name         string
+	// The GUID of the snapshot when it was backed up, it changes when the snapshot is destroyed and created again
+	GUID string `json:",omitempty"`
 }
 
 // Equal will test two SnapshotInfo objects for equality. This is based on the snapshot name and the time of creation
@@ -97,18 +373,53 @@ func (s *SnapshotInfo) Equal(t *SnapshotInfo) bool {
 	return strings.Compare(s.Name, t.Name) == 0 && s.CreationTime.Equal(t.CreationTime)
 }
 
+// CheckSnapshotChain will verify that the creation times of the provided chain of snapshots,
+// ordered from the oldest full backup to the snapshot being sent, are monotonic. Anomalies
+// are logged as warnings unless StrictSnapshotOrder is set, in which case an error is returned.
+func (j *JobInfo) CheckSnapshotChain(chain []SnapshotInfo) error {
+	for idx := 1; idx < len(chain); idx++ {
+		if !chain[idx].CreationTime.Before(chain[idx-1].CreationTime) {
+			continue
+		}
+
+		err := fmt.Errorf("%w: %s@%s (created %v) increments from %s@%s which was created later (%v)", ErrNonMonotonicSnapshots, j.VolumeName, chain[idx].Name, chain[idx].CreationTime, j.VolumeName, chain[idx-1].Name, chain[idx-1].CreationTime)
+		if j.StrictSnapshotOrder {
+			return &OperationError{Op: "check snapshot chain", Dataset: j.VolumeName, Kind: ErrChainBroken, Err: err}
+		}
+		AppLogger.Warningf("%v - the incremental base may not be what you expect, check for renamed snapshots or clock issues.", err)
+	}
+
+	return nil
+}
+
 // TotalBytesWritten will sum up the size of all underlying Volumes to give a total
 // that represents how many bytes have been written.
 func (j *JobInfo) TotalBytesWritten() uint64 {
 	var total uint64
 
-	for _, vol := range j.Volumes {
+	for _, vol := range j.AllVolumes() {
 		total += vol.Size
 	}
 
 	return total
 }
 
+// AllVolumes will return the Volumes of this JobInfo followed by the Volumes of
+// each of its group members, if any, in the order they were backed up.
+func (j *JobInfo) AllVolumes() []*VolumeInfo {
+	if len(j.GroupMembers) == 0 {
+		return j.Volumes
+	}
+
+	volumes := make([]*VolumeInfo, 0, len(j.Volumes))
+	volumes = append(volumes, j.Volumes...)
+	for _, member := range j.GroupMembers {
+		volumes = append(volumes, member.AllVolumes()...)
+	}
+
+	return volumes
+}
+
 // String will return a string representation of this JobInfo.
 func (j *JobInfo) String() string {
 	var output []string
@@ -116,16 +427,58 @@ func (j *JobInfo) String() string {
 	output = append(output, fmt.Sprintf("Snapshot: %s (%v)", j.BaseSnapshot.Name, j.BaseSnapshot.CreationTime))
 	if j.IncrementalSnapshot.Name != "" {
 		output = append(output, fmt.Sprintf("Incremental From Snapshot: %s (%v)", j.IncrementalSnapshot.Name, j.IncrementalSnapshot.CreationTime))
+		if j.IncrementalBookmark != "" {
+			output = append(output, fmt.Sprintf("Incremental From Bookmark: %s", j.IncrementalBookmark))
+		}
 		output = append(output, fmt.Sprintf("Intermediary: %v", j.IntermediaryIncremental))
 	}
+	for idx, member := range j.GroupMembers {
+		output = append(output, fmt.Sprintf("Group Member %d: %s@%s", idx+1, member.VolumeName, member.BaseSnapshot.Name))
+	}
 	output = append(output, fmt.Sprintf("Replication: %v", j.Replication))
+	if j.LargeBlocks {
+		output = append(output, "Large Blocks: true")
+	}
+	if j.CompressedSend && j.SendCompression != "" {
+		output = append(output, fmt.Sprintf("Compressed Send: true (%s)", j.SendCompression))
+	} else if j.CompressedSend {
+		output = append(output, "Compressed Send: true")
+	}
+	if j.RawSend {
+		output = append(output, "Raw Send: true")
+	}
+	if j.CompressionAlgorithm != "" {
+		level := fmt.Sprintf("level %d", j.CompressionLevel)
+		if manifestLevel := manifestCompressionLevel(j.CompressionLevel); manifestLevel != j.CompressionLevel {
+			level += fmt.Sprintf(", manifest at gzip level %d", manifestLevel)
+		}
+		output = append(output, fmt.Sprintf("Compression Algorithm: %s (%s)", j.CompressionAlgorithm, level))
+	}
+	if j.SingleObject {
+		output = append(output, "Single Object: true")
+	}
+	if len(j.UserProperties) > 0 {
+		output = append(output, fmt.Sprintf("User Properties: %d", len(j.UserProperties)))
+	}
+	if len(j.Metadata) > 0 {
+		output = append(output, fmt.Sprintf("Metadata: %d", len(j.Metadata)))
+	}
 	totalWrittenBytes := j.TotalBytesWritten()
-	output = append(output, fmt.Sprintf("Archives: %d - %d bytes (%s)", len(j.Volumes), totalWrittenBytes, humanize.IBytes(totalWrittenBytes)))
+	output = append(output, fmt.Sprintf("Archives: %d - %d bytes (%s)", len(j.AllVolumes()), totalWrittenBytes, humanize.IBytes(totalWrittenBytes)))
 	output = append(output, fmt.Sprintf("Volume Size (Raw): %d bytes (%s)", j.ZFSStreamBytes, humanize.IBytes(j.ZFSStreamBytes)))
+	if j.ExpiresAt != nil {
+		output = append(output, fmt.Sprintf("Expires: %v", *j.ExpiresAt))
+	}
 	output = append(output, fmt.Sprintf("Uploaded: %v (took %v)\n\n", j.StartTime, j.EndTime.Sub(j.StartTime)))
 	return strings.Join(output, "\n\t")
 }
 
+// Expired returns true if the backup set was uploaded with an expiry that has passed by now, in which case
+// its objects may already have been deleted by the lifecycle rules of the destination.
+func (j *JobInfo) Expired(now time.Time) bool {
+	return j.ExpiresAt != nil && !now.Before(*j.ExpiresAt)
+}
+
 // TotalBytesStreamedAndVols will sum up the streamed bytes of all underlying Volumes to give a total
 // that represents how many bytes have been streamed. It will stop at any out of order volume number.
 func (j *JobInfo) TotalBytesStreamedAndVols() (total uint64, volnum int64) {
@@ -166,8 +519,8 @@ func (j *JobInfo) ValidateSendFlags() error {
 		return fmt.Errorf("The max backoff time must be set to a value greater than 0. Was given %d", j.MaxBackoffTime)
 	}
 
-	if j.CompressionLevel < 1 || j.CompressionLevel > 9 {
-		return fmt.Errorf("The compression level specified must be between 1 and 9. Was given %d", j.CompressionLevel)
+	if limit := CompressionLevelLimit(j.Compressor); j.CompressionLevel < 1 || j.CompressionLevel > limit {
+		return fmt.Errorf("The compression level specified must be between 1 and %d for the %s compressor. Was given %d", limit, j.Compressor, j.CompressionLevel)
 	}
 
 	if disallowedSeps.MatchString(j.Separator) {
@@ -178,5 +531,168 @@ func (j *JobInfo) ValidateSendFlags() error {
 		return fmt.Errorf("The uploadChunkSize provided (%d) is not between 5 and 100", j.UploadChunkSize)
 	}
 
+	if j.Compressor == ExternalCompressor && len(j.CompressCommandLine()) == 0 {
+		return fmt.Errorf("The external compressor requires the command to compress volumes with to be provided")
+	}
+
+	if j.Compressor == SeekableZstdCompressor && (j.CompressionBlockSize < 64 || j.CompressionBlockSize > 64*1024) {
+		return fmt.Errorf("The compressionBlockSize provided (%d) is not between 64 and 65536 KiB", j.CompressionBlockSize)
+	}
+
+	if j.CompressionConcurrency < 0 {
+		return fmt.Errorf("The compressionConcurrency provided (%d) cannot be negative", j.CompressionConcurrency)
+	}
+
+	if j.AutoTuneUploads && (j.MinParallelUploads < 1 || j.MinParallelUploads > j.MaxParallelUploads) {
+		return fmt.Errorf("The minParallelUploads provided (%d) must be between 1 and the maxParallelUploads (%d)", j.MinParallelUploads, j.MaxParallelUploads)
+	}
+
+	if j.AdaptiveCompressionLevel {
+		if limit := CompressionLevelLimit(j.Compressor); j.MinCompressionLevel < 1 || j.MinCompressionLevel > j.CompressionLevel || j.CompressionLevel > j.MaxCompressionLevel || j.MaxCompressionLevel > limit {
+			return fmt.Errorf("The compression level (%d) must be between the minCompressionLevel (%d) and the maxCompressionLevel (%d), which must be between 1 and %d", j.CompressionLevel, j.MinCompressionLevel, j.MaxCompressionLevel, limit)
+		}
+		if j.Compressor == NoCompressor || j.Compressor == "" {
+			return fmt.Errorf("The compression level can only be adapted when compressing the volumes, no compressor was selected")
+		}
+		if j.MaxFileBuffer == 0 {
+			return fmt.Errorf("The compression level can only be adapted when volumes are buffered to disk, the maxFileBuffer must be greater than 0")
+		}
+	}
+
+	if j.ObjectCountWarning < 0 || j.MaxObjectCount < 0 {
+		return fmt.Errorf("The objectCountWarning (%d) and maxObjectCount (%d) provided must be greater than or equal to 0", j.ObjectCountWarning, j.MaxObjectCount)
+	}
+
+	if j.UploadPartRetries < 0 {
+		return fmt.Errorf("The uploadPartRetries provided (%d) must be greater than or equal to 0", j.UploadPartRetries)
+	}
+
+	if _, _, err := parseFailureThreshold(j.MaxFailures); err != nil {
+		return err
+	}
+
+	if err := j.ValidateDatasetOverrides(); err != nil {
+		return err
+	}
+
+	if _, err := GetHash(j.HashAlgorithm); err != nil {
+		return fmt.Errorf("The hash algorithm provided (%s) has not been registered", j.HashAlgorithm)
+	}
+
+	return j.ValidateKeyNormalization()
+}
+
+// FailureThresholdCrossed will return true if the provided number of failed datasets, out of the total
+// number of datasets in a multi-dataset run, crosses the MaxFailures threshold. An empty threshold is
+// never crossed.
+func (j *JobInfo) FailureThresholdCrossed(failed, total int) bool {
+	count, percent, err := parseFailureThreshold(j.MaxFailures)
+	switch {
+	case err != nil:
+		return false
+	case percent >= 0:
+		return total > 0 && float64(failed)*100/float64(total) > percent
+	case count >= 0:
+		return failed > count
+	}
+
+	return false
+}
+
+// parseFailureThreshold will parse the provided threshold as either a count or a percentage of datasets,
+// returning -1 for whichever was not provided.
+func parseFailureThreshold(threshold string) (int, float64, error) {
+	if threshold == "" {
+		return -1, -1, nil
+	}
+
+	if strings.HasSuffix(threshold, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(threshold, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return -1, -1, fmt.Errorf("The max failures percentage provided (%s) should be between 0%% and 100%%", threshold)
+		}
+		return -1, percent, nil
+	}
+
+	count, err := strconv.Atoi(threshold)
+	if err != nil || count < 0 {
+		return -1, -1, fmt.Errorf("The max failures provided (%s) should be a number of datasets greater than or equal to 0 or a percentage of them (e.g. 25%%)", threshold)
+	}
+	return count, -1, nil
+}
+
+// ValidateKeyNormalization will check if the object key normalization options assigned
+// to this JobInfo object are valid.
+func (j *JobInfo) ValidateKeyNormalization() error {
+	switch j.KeyCase {
+	case "", KeyCasePreserve, KeyCaseLower:
+	default:
+		return fmt.Errorf("The key case provided (%s) is not one of %s or %s", j.KeyCase, KeyCasePreserve, KeyCaseLower)
+	}
+
+	switch j.KeyPrefix {
+	case "", KeyPrefixPath, KeyPrefixHash:
+	default:
+		return fmt.Errorf("The key prefix provided (%s) is not one of %s or %s", j.KeyPrefix, KeyPrefixPath, KeyPrefixHash)
+	}
+
+	if j.KeyDatasetSeparator != "" && (strings.Contains(j.KeyDatasetSeparator, "/") || disallowedSeps.MatchString(j.KeyDatasetSeparator)) {
+		return fmt.Errorf("The key dataset separator provided (%s) should not be used as it can conflict with allowed characters in zfs components", j.KeyDatasetSeparator)
+	}
+
+	return nil
+}
+
+// ValidateManifestMirrors will return an error if a manifest mirror prefix is empty, or if a prefix starts with another
+// one, including the manifest prefix, as the manifests listed under it would also list the copies under the other.
+func (j *JobInfo) ValidateManifestMirrors() error {
+	prefixes := append([]string{j.ManifestPrefix}, j.ManifestMirrorPrefixes...)
+	for idx, prefix := range prefixes {
+		if prefix == "" {
+			return fmt.Errorf("The manifest mirror prefixes cannot be empty")
+		}
+		for _, other := range prefixes[idx+1:] {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return fmt.Errorf("The manifest prefixes %s and %s overlap, pick prefixes that do not start with one another (e.g. manifests and mirror/manifests)", prefix, other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// datasetKeyPart returns the normalized name of this JobInfo object's dataset as used in object keys.
+func (j *JobInfo) datasetKeyPart() string {
+	part := j.normalizeKeyPart(j.VolumeName)
+	if j.KeyPrefix == KeyPrefixHash {
+		sum := sha256.Sum256([]byte(j.VolumeName))
+		part = fmt.Sprintf("%s-%x", part, sum[:keyPrefixHashBytes])
+	}
+	return part
+}
+
+// CheckKeyCollisions will return an error if the objects of any two of the provided jobs backing up different
+// datasets would share the same dataset name in their keys once normalized, overwriting each other.
+func CheckKeyCollisions(jobs []*JobInfo) error {
+	datasets := make(map[string]string, len(jobs))
+	for _, j := range jobs {
+		key := j.datasetKeyPart()
+		if other, ok := datasets[key]; ok && other != j.VolumeName {
+			return fmt.Errorf("The datasets %s and %s would both be stored under %s in object names, use --keyPrefix %s or change the key normalization options", other, j.VolumeName, key, KeyPrefixHash)
+		}
+		datasets[key] = j.VolumeName
+	}
 	return nil
 }
+
+// normalizeKeyPart will apply the object key normalization options of this JobInfo object
+// to the provided dataset or snapshot name.
+func (j *JobInfo) normalizeKeyPart(part string) string {
+	if j.KeyCase == KeyCaseLower {
+		part = strings.ToLower(part)
+	}
+	if j.KeyDatasetSeparator != "" {
+		part = strings.Replace(part, "/", j.KeyDatasetSeparator, -1)
+	}
+	return part
+}
@@ -0,0 +1,211 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailureThresholdCrossed(t *testing.T) {
+	testCases := []struct {
+		threshold string
+		failed    int
+		total     int
+		crossed   bool
+		valid     bool
+	}{
+		{"", 10, 10, false, true},
+		{"0", 0, 10, false, true},
+		{"0", 1, 10, true, true},
+		{"3", 3, 10, false, true},
+		{"3", 4, 10, true, true},
+		{"25%", 2, 8, false, true},
+		{"25%", 3, 8, true, true},
+		{"0%", 1, 100, true, true},
+		{"100%", 10, 10, false, true},
+		{"-1", 1, 10, false, false},
+		{"101%", 1, 10, false, false},
+		{"many", 1, 10, false, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{MaxFailures: c.threshold}
+		if crossed := j.FailureThresholdCrossed(c.failed, c.total); crossed != c.crossed {
+			t.Errorf("%d: expected %d of %d failures crossing a threshold of %q to be %v, got %v", idx, c.failed, c.total, c.threshold, c.crossed, crossed)
+		}
+		if _, _, err := parseFailureThreshold(c.threshold); (err == nil) != c.valid {
+			t.Errorf("%d: expected threshold %q to be valid=%v, got error %v", idx, c.threshold, c.valid, err)
+		}
+	}
+}
+
+func TestCheckSnapshotChain(t *testing.T) {
+	snap := func(name string, hour int) SnapshotInfo {
+		return SnapshotInfo{Name: name, CreationTime: time.Date(2020, 1, 1, hour, 0, 0, 0, time.UTC)}
+	}
+
+	testCases := []struct {
+		chain  []SnapshotInfo
+		strict bool
+		valid  bool
+	}{
+		{nil, true, true},
+		{[]SnapshotInfo{snap("a", 1)}, true, true},
+		{[]SnapshotInfo{snap("a", 1), snap("b", 2), snap("c", 3)}, true, true},
+		// Snapshots taken within the same second share a creation time
+		{[]SnapshotInfo{snap("a", 1), snap("b", 1)}, true, true},
+		// b was renamed or taken with a skewed clock and appears older than its incremental base
+		{[]SnapshotInfo{snap("a", 2), snap("b", 1)}, true, false},
+		{[]SnapshotInfo{snap("a", 1), snap("b", 3), snap("c", 2)}, true, false},
+		{[]SnapshotInfo{snap("a", 1), snap("b", 3), snap("c", 2)}, false, true},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{VolumeName: "tank/data", StrictSnapshotOrder: c.strict}
+		err := j.CheckSnapshotChain(c.chain)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+		if err != nil && (!errors.Is(err, ErrChainBroken) || !errors.Is(err, ErrNonMonotonicSnapshots)) {
+			t.Errorf("%d: expected a broken chain error caused by non monotonic snapshots, got %v", idx, err)
+		}
+	}
+}
+
+func TestJobInfoExpired(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	testCases := []struct {
+		expiresAt *time.Time
+		expired   bool
+	}{
+		{nil, false},
+		{&past, true},
+		{&now, true},
+		{&future, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{ExpiresAt: c.expiresAt}
+		if expired := j.Expired(now); expired != c.expired {
+			t.Errorf("%d: expected expired to be %v, got %v", idx, c.expired, expired)
+		}
+	}
+}
+
+func TestCheckKeyCollisions(t *testing.T) {
+	testCases := []struct {
+		keyCase   string
+		keyPrefix string
+		datasets  []string
+		valid     bool
+	}{
+		// Datasets sharing a leaf name are kept apart by their pool and path
+		{KeyCasePreserve, KeyPrefixPath, []string{"pool1/data", "pool2/data", "pool1/home/data", "data"}, true},
+		{KeyCaseLower, KeyPrefixPath, []string{"pool1/data", "pool2/data", "pool1/home/data", "data"}, true},
+		{KeyCasePreserve, KeyPrefixHash, []string{"pool1/data", "pool2/data", "pool1/home/data", "data"}, true},
+		// The same dataset may be backed up several times
+		{KeyCaseLower, KeyPrefixPath, []string{"pool1/Data", "pool1/Data"}, true},
+		// Datasets only differing by case collide once lowercased, unless hashed
+		{KeyCasePreserve, KeyPrefixPath, []string{"pool1/Data", "pool1/data"}, true},
+		{KeyCaseLower, KeyPrefixPath, []string{"pool1/Data", "pool1/data"}, false},
+		{KeyCaseLower, "", []string{"Pool1/data", "pool2/data", "pool1/data"}, false},
+		{KeyCaseLower, KeyPrefixHash, []string{"pool1/Data", "pool1/data", "POOL1/DATA"}, true},
+	}
+
+	for idx, c := range testCases {
+		var jobs []*JobInfo
+		for _, dataset := range c.datasets {
+			jobs = append(jobs, &JobInfo{
+				VolumeName:   dataset,
+				BaseSnapshot: SnapshotInfo{Name: "snap"},
+				Separator:    "|",
+				KeyCase:      c.keyCase,
+				KeyPrefix:    c.keyPrefix,
+			})
+		}
+
+		err := CheckKeyCollisions(jobs)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+
+		// The object names of different datasets must not collide either
+		names := make(map[string]string)
+		for _, j := range jobs {
+			name := strings.Join(j.objectNameParts(), j.Separator)
+			if other, ok := names[name]; ok && other != j.VolumeName {
+				t.Errorf("%d: the datasets %s and %s share the object name %s", idx, other, j.VolumeName, name)
+			}
+			names[name] = j.VolumeName
+		}
+	}
+}
+
+func TestKeyPrefixHash(t *testing.T) {
+	j := &JobInfo{VolumeName: "Pool1/Data", BaseSnapshot: SnapshotInfo{Name: "Snap"}, KeyCase: KeyCaseLower, KeyDatasetSeparator: "+", KeyPrefix: KeyPrefixHash}
+	if err := j.ValidateKeyNormalization(); err != nil {
+		t.Fatalf("expected valid key normalization options, got error %v", err)
+	}
+
+	// The hash is of the dataset's path before it is normalized
+	expected := []string{"pool1+data-" + fmt.Sprintf("%x", sha256.Sum256([]byte("Pool1/Data")))[:2*keyPrefixHashBytes], "snap"}
+	if parts := j.objectNameParts(); !reflect.DeepEqual(parts, expected) {
+		t.Errorf("expected object name parts %v, got %v", expected, parts)
+	}
+
+	j.KeyPrefix = "leaf"
+	if err := j.ValidateKeyNormalization(); err == nil {
+		t.Errorf("expected an error for an unknown key prefix, got none")
+	}
+}
+
+func TestValidateManifestMirrors(t *testing.T) {
+	testCases := []struct {
+		prefix  string
+		mirrors []string
+		valid   bool
+	}{
+		{"manifests", nil, true},
+		{"manifests", []string{"mirror/manifests", "backup-manifests"}, true},
+		{"manifests", []string{"manifests-copy"}, false},
+		{"manifests", []string{"mirror/manifests", "mirror"}, false},
+		{"manifests", []string{"manifests"}, false},
+		{"manifests", []string{""}, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{ManifestPrefix: c.prefix, ManifestMirrorPrefixes: c.mirrors}
+		if err := j.ValidateManifestMirrors(); (err == nil) != c.valid {
+			t.Errorf("%d: expected %v to be valid: %v, got error %v", idx, c.mirrors, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+const (
+	// ManifestFormatJSON will write manifests as JSON, readable by every version of zfsbackup.
+	ManifestFormatJSON = "json"
+	// ManifestFormatBinary will write manifests in a compact gob encoding that is faster to parse,
+	// useful for backup sets with many volumes or group members. Older versions cannot read them.
+	ManifestFormatBinary = "binary"
+)
+
+// binaryManifestMagic starts every binary manifest, JSON manifests never start with a NUL byte.
+var binaryManifestMagic = []byte("\x00zfsbackup-gob\x00")
+
+// manifestPartRegex matches the object names of the parts of split manifests, see ManifestPartName.
+var manifestPartRegex = regexp.MustCompile(`\.part[0-9]+$`)
+
+// ErrInvalidManifestFormat is returned when a manifest format is neither ManifestFormatJSON nor ManifestFormatBinary.
+var ErrInvalidManifestFormat = errors.New("the manifest format must be one of json or binary")
+
+// manifestRecord holds the fields of a JobInfo written to a binary manifest, which are the fields
+// written to a JSON manifest. Fields are matched by name so manifests written by other versions,
+// with more or fewer fields, can still be read.
+type manifestRecord struct {
+	StartTime               time.Time
+	EndTime                 time.Time
+	VolumeName              string
+	BaseSnapshot            SnapshotInfo
+	IncrementalSnapshot     SnapshotInfo
+	Compressor              string
+	CompressionLevel        int
+	Separator               string
+	ZFSCommandLine          string
+	ZFSStreamBytes          uint64
+	Volumes                 []*volumeRecord
+	Version                 float64
+	EncryptTo               string
+	SignFrom                string
+	Replication             bool
+	Deduplication           bool
+	Properties              bool
+	IntermediaryIncremental bool
+	LargeBlocks             bool
+	CompressedSend          bool
+	SendCompression         string
+	RawSend                 bool
+	IncrementalBookmark     string
+	CompressionAlgorithm    string
+	KeyCase                 string
+	KeyDatasetSeparator     string
+	KeyPrefix               string
+	SingleObject            bool
+	UserProperties          map[string]string
+	Metadata                map[string]string
+	HashAlgorithm           string
+	CompressionBlockSize    int
+	CompressCommand         string
+	MinReaderVersion        float64
+	MerkleRoot              string
+	StreamSHA256            string
+	GroupName               string
+	GroupMembers            []*manifestRecord
+	RestoreScript           string
+	Checksums               string
+	ManifestParts           []string
+	ManifestPart            int
+	ExpiresAt               *time.Time
+}
+
+// volumeRecord holds the fields of a VolumeInfo written to a binary manifest.
+type volumeRecord struct {
+	ObjectName       string
+	VolumeNumber     int64
+	SHA256Sum        string
+	MD5Sum           string
+	CRC32CSum32      uint32
+	HashSum          string
+	Size             uint64
+	ZFSStreamBytes   uint64
+	Compressor       string
+	SharedObject     bool
+	Placement        []string
+	CreateTime       time.Time
+	CloseTime        time.Time
+	IsManifest       bool
+	IsFinalManifest  bool
+	CompressionLevel int
+}
+
+// ValidateManifestFormat will return ErrInvalidManifestFormat if the provided format is not a known manifest format.
+func ValidateManifestFormat(format string) error {
+	switch format {
+	case ManifestFormatJSON, ManifestFormatBinary:
+		return nil
+	default:
+		return ErrInvalidManifestFormat
+	}
+}
+
+// IsBinaryManifest will return true if the provided decrypted and decompressed manifest was written in ManifestFormatBinary.
+func IsBinaryManifest(rawManifest []byte) bool {
+	return bytes.HasPrefix(rawManifest, binaryManifestMagic)
+}
+
+// EncodeManifest will write the provided JobInfo as a manifest in the provided format to w.
+func EncodeManifest(w io.Writer, j *JobInfo, format string) error {
+	switch format {
+	case ManifestFormatJSON:
+		return json.NewEncoder(w).Encode(j)
+	case ManifestFormatBinary:
+		if _, err := w.Write(binaryManifestMagic); err != nil {
+			return err
+		}
+		return gob.NewEncoder(w).Encode(newManifestRecord(j))
+	default:
+		return ErrInvalidManifestFormat
+	}
+}
+
+// ManifestPartName returns the object name of the provided part, starting at 1, of the manifest with the provided object name.
+func ManifestPartName(manifestName string, part int) string {
+	return fmt.Sprintf("%s.part%d", manifestName, part)
+}
+
+// IsManifestPart returns whether the provided object name is that of a part of a split manifest, see ManifestPartName.
+func IsManifestPart(objectName string) bool {
+	return manifestPartRegex.MatchString(objectName)
+}
+
+// SplitManifestVolumes will split the provided volumes, in order, into parts that should each encode to no more than
+// maxSize bytes. The size of each volume is estimated from its JSON encoding, which is larger than its binary encoding.
+// A part holds at least one volume, however large it is.
+func SplitManifestVolumes(volumes []*VolumeInfo, maxSize uint64) ([][]*VolumeInfo, error) {
+	var parts [][]*VolumeInfo
+	var part []*VolumeInfo
+	var size uint64
+	for _, vol := range volumes {
+		encoded, err := json.Marshal(vol)
+		if err != nil {
+			return nil, err
+		}
+		volSize := uint64(len(encoded)) + 1
+		if len(part) > 0 && size+volSize > maxSize {
+			parts = append(parts, part)
+			part, size = nil, 0
+		}
+		part = append(part, vol)
+		size += volSize
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// DecodeBinaryManifest will decode a manifest written in ManifestFormatBinary, see IsBinaryManifest.
+func DecodeBinaryManifest(rawManifest []byte) (*JobInfo, error) {
+	if !IsBinaryManifest(rawManifest) {
+		return nil, errors.New("the manifest is not in the binary format")
+	}
+	record := new(manifestRecord)
+	if err := gob.NewDecoder(bytes.NewReader(rawManifest[len(binaryManifestMagic):])).Decode(record); err != nil {
+		return nil, err
+	}
+	return record.jobInfo(), nil
+}
+
+func newManifestRecord(j *JobInfo) *manifestRecord {
+	r := &manifestRecord{
+		StartTime:               j.StartTime,
+		EndTime:                 j.EndTime,
+		VolumeName:              j.VolumeName,
+		BaseSnapshot:            j.BaseSnapshot,
+		IncrementalSnapshot:     j.IncrementalSnapshot,
+		Compressor:              j.Compressor,
+		CompressionLevel:        j.CompressionLevel,
+		Separator:               j.Separator,
+		ZFSCommandLine:          j.ZFSCommandLine,
+		ZFSStreamBytes:          j.ZFSStreamBytes,
+		Version:                 j.Version,
+		EncryptTo:               j.EncryptTo,
+		SignFrom:                j.SignFrom,
+		Replication:             j.Replication,
+		Deduplication:           j.Deduplication,
+		Properties:              j.Properties,
+		IntermediaryIncremental: j.IntermediaryIncremental,
+		LargeBlocks:             j.LargeBlocks,
+		CompressedSend:          j.CompressedSend,
+		SendCompression:         j.SendCompression,
+		RawSend:                 j.RawSend,
+		IncrementalBookmark:     j.IncrementalBookmark,
+		CompressionAlgorithm:    j.CompressionAlgorithm,
+		KeyCase:                 j.KeyCase,
+		KeyDatasetSeparator:     j.KeyDatasetSeparator,
+		KeyPrefix:               j.KeyPrefix,
+		SingleObject:            j.SingleObject,
+		UserProperties:          j.UserProperties,
+		Metadata:                j.Metadata,
+		HashAlgorithm:           j.HashAlgorithm,
+		CompressionBlockSize:    j.CompressionBlockSize,
+		CompressCommand:         j.CompressCommand,
+		MinReaderVersion:        j.MinReaderVersion,
+		MerkleRoot:              j.MerkleRoot,
+		StreamSHA256:            j.StreamSHA256,
+		GroupName:               j.GroupName,
+		RestoreScript:           j.RestoreScript,
+		Checksums:               j.Checksums,
+		ManifestParts:           j.ManifestParts,
+		ManifestPart:            j.ManifestPart,
+		ExpiresAt:               j.ExpiresAt,
+	}
+	for _, vol := range j.Volumes {
+		r.Volumes = append(r.Volumes, &volumeRecord{
+			ObjectName:       vol.ObjectName,
+			VolumeNumber:     vol.VolumeNumber,
+			SHA256Sum:        vol.SHA256Sum,
+			MD5Sum:           vol.MD5Sum,
+			CRC32CSum32:      vol.CRC32CSum32,
+			HashSum:          vol.HashSum,
+			Size:             vol.Size,
+			ZFSStreamBytes:   vol.ZFSStreamBytes,
+			Compressor:       vol.Compressor,
+			SharedObject:     vol.SharedObject,
+			Placement:        vol.Placement,
+			CreateTime:       vol.CreateTime,
+			CloseTime:        vol.CloseTime,
+			IsManifest:       vol.IsManifest,
+			IsFinalManifest:  vol.IsFinalManifest,
+			CompressionLevel: vol.CompressionLevel,
+		})
+	}
+	for _, member := range j.GroupMembers {
+		r.GroupMembers = append(r.GroupMembers, newManifestRecord(member))
+	}
+	return r
+}
+
+func (r *manifestRecord) jobInfo() *JobInfo {
+	j := &JobInfo{
+		StartTime:               r.StartTime,
+		EndTime:                 r.EndTime,
+		VolumeName:              r.VolumeName,
+		BaseSnapshot:            r.BaseSnapshot,
+		IncrementalSnapshot:     r.IncrementalSnapshot,
+		Compressor:              r.Compressor,
+		CompressionLevel:        r.CompressionLevel,
+		Separator:               r.Separator,
+		ZFSCommandLine:          r.ZFSCommandLine,
+		ZFSStreamBytes:          r.ZFSStreamBytes,
+		Version:                 r.Version,
+		EncryptTo:               r.EncryptTo,
+		SignFrom:                r.SignFrom,
+		Replication:             r.Replication,
+		Deduplication:           r.Deduplication,
+		Properties:              r.Properties,
+		IntermediaryIncremental: r.IntermediaryIncremental,
+		LargeBlocks:             r.LargeBlocks,
+		CompressedSend:          r.CompressedSend,
+		SendCompression:         r.SendCompression,
+		RawSend:                 r.RawSend,
+		IncrementalBookmark:     r.IncrementalBookmark,
+		CompressionAlgorithm:    r.CompressionAlgorithm,
+		KeyCase:                 r.KeyCase,
+		KeyDatasetSeparator:     r.KeyDatasetSeparator,
+		KeyPrefix:               r.KeyPrefix,
+		SingleObject:            r.SingleObject,
+		UserProperties:          r.UserProperties,
+		Metadata:                r.Metadata,
+		HashAlgorithm:           r.HashAlgorithm,
+		CompressionBlockSize:    r.CompressionBlockSize,
+		CompressCommand:         r.CompressCommand,
+		MinReaderVersion:        r.MinReaderVersion,
+		MerkleRoot:              r.MerkleRoot,
+		StreamSHA256:            r.StreamSHA256,
+		GroupName:               r.GroupName,
+		RestoreScript:           r.RestoreScript,
+		Checksums:               r.Checksums,
+		ManifestParts:           r.ManifestParts,
+		ManifestPart:            r.ManifestPart,
+		ExpiresAt:               r.ExpiresAt,
+	}
+	for _, vol := range r.Volumes {
+		j.Volumes = append(j.Volumes, &VolumeInfo{
+			ObjectName:       vol.ObjectName,
+			VolumeNumber:     vol.VolumeNumber,
+			SHA256Sum:        vol.SHA256Sum,
+			MD5Sum:           vol.MD5Sum,
+			CRC32CSum32:      vol.CRC32CSum32,
+			HashSum:          vol.HashSum,
+			Size:             vol.Size,
+			ZFSStreamBytes:   vol.ZFSStreamBytes,
+			Compressor:       vol.Compressor,
+			SharedObject:     vol.SharedObject,
+			Placement:        vol.Placement,
+			CreateTime:       vol.CreateTime,
+			CloseTime:        vol.CloseTime,
+			IsManifest:       vol.IsManifest,
+			IsFinalManifest:  vol.IsFinalManifest,
+			CompressionLevel: vol.CompressionLevel,
+		})
+	}
+	for _, member := range r.GroupMembers {
+		j.GroupMembers = append(j.GroupMembers, member.jobInfo())
+	}
+	return j
+}
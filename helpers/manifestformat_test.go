@@ -0,0 +1,229 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestFormatFields(t *testing.T) {
+	// Every field written to a JSON manifest must be written to a binary manifest
+	testCases := []struct {
+		persisted interface{}
+		record    interface{}
+	}{
+		{JobInfo{}, manifestRecord{}},
+		{VolumeInfo{}, volumeRecord{}},
+	}
+
+	for idx, c := range testCases {
+		persisted := reflect.TypeOf(c.persisted)
+		record := reflect.TypeOf(c.record)
+		for i := 0; i < persisted.NumField(); i++ {
+			field := persisted.Field(i)
+			if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+				continue
+			}
+			if _, ok := record.FieldByName(field.Name); !ok {
+				t.Errorf("%d: the field %s.%s is missing from %s", idx, persisted.Name(), field.Name, record.Name())
+			}
+		}
+	}
+}
+
+func TestEncodeManifest(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+	expires := now.Add(720 * time.Hour)
+	j := &JobInfo{
+		StartTime:           now,
+		EndTime:             now.Add(time.Hour),
+		VolumeName:          "tank/data",
+		BaseSnapshot:        SnapshotInfo{Name: "snap2", CreationTime: now, GUID: "123"},
+		IncrementalSnapshot: SnapshotInfo{Name: "snap1", CreationTime: now.Add(-time.Hour)},
+		Compressor:          ZstdCompressor,
+		CompressionLevel:    3,
+		Separator:           "|",
+		LargeBlocks:         true,
+		CompressedSend:      true,
+		SendCompression:     "zstd",
+		RawSend:             true,
+		IncrementalBookmark: "snap1",
+		ZFSStreamBytes:      4096,
+		Version:             VersionNumber,
+		EncryptTo:           "backups@example.com",
+		UserProperties:      map[string]string{"com.example:owner": "ops"},
+		Metadata:            map[string]string{"layout": "channel-program v2", "owner": "ops=db"},
+		HashAlgorithm:       SHA256Hash,
+		MinReaderVersion:    .4,
+		MerkleRoot:          "abc",
+		ManifestParts:       []string{"manifests|tank/data|snap1|to|snap2.manifest.part1"},
+		ExpiresAt:           &expires,
+		Volumes: []*VolumeInfo{
+			{ObjectName: "vol1", VolumeNumber: 1, SHA256Sum: "aa", Size: 10, CreateTime: now, CloseTime: now, Placement: []string{"file:///a"}},
+			{ObjectName: "vol2", VolumeNumber: 2, MD5Sum: "bb", CRC32CSum32: 7, Compressor: NoCompressor, SharedObject: true, CompressionLevel: 1},
+		},
+		GroupMembers: []*JobInfo{{VolumeName: "tank/data/child", Volumes: []*VolumeInfo{{ObjectName: "child1"}}}},
+		// Not written to manifests
+		ManifestPrefix: "manifests",
+		Destinations:   []string{"file:///backups"},
+	}
+	j.CompressionAlgorithm = CompressorAlgorithm(j.Compressor)
+
+	var jsonManifest, binaryManifest bytes.Buffer
+	if err := EncodeManifest(&jsonManifest, j, ManifestFormatJSON); err != nil {
+		t.Fatalf("could not encode JSON manifest - %v", err)
+	}
+	if err := EncodeManifest(&binaryManifest, j, ManifestFormatBinary); err != nil {
+		t.Fatalf("could not encode binary manifest - %v", err)
+	}
+	if err := EncodeManifest(&bytes.Buffer{}, j, "xml"); err != ErrInvalidManifestFormat {
+		t.Errorf("expected %v encoding an unknown format, got %v", ErrInvalidManifestFormat, err)
+	}
+
+	if IsBinaryManifest(jsonManifest.Bytes()) || !IsBinaryManifest(binaryManifest.Bytes()) {
+		t.Errorf("the format of the manifests was not detected")
+	}
+	if _, err := DecodeBinaryManifest(jsonManifest.Bytes()); err == nil {
+		t.Errorf("expected an error decoding a JSON manifest as a binary manifest")
+	}
+
+	fromJSON := new(JobInfo)
+	if err := json.Unmarshal(jsonManifest.Bytes(), fromJSON); err != nil {
+		t.Fatalf("could not decode JSON manifest - %v", err)
+	}
+	fromBinary, err := DecodeBinaryManifest(binaryManifest.Bytes())
+	if err != nil {
+		t.Fatalf("could not decode binary manifest - %v", err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromBinary) {
+		t.Errorf("the binary manifest does not match the JSON manifest\n%+v\n%+v", fromJSON, fromBinary)
+	}
+	if !fromBinary.LargeBlocks || !fromBinary.CompressedSend || fromBinary.SendCompression != "zstd" || !fromBinary.RawSend || fromBinary.IncrementalBookmark != "snap1" || fromBinary.CompressionAlgorithm != ZstdAlgorithm {
+		t.Errorf("expected the send flags to be written to the manifest")
+	}
+	if !reflect.DeepEqual(fromBinary.Metadata, j.Metadata) {
+		t.Errorf("expected the metadata %v to be written to the manifest, got %v", j.Metadata, fromBinary.Metadata)
+	}
+	if fromBinary.ManifestPrefix != "" || fromBinary.Destinations != nil {
+		t.Errorf("expected the runtime options not to be written to the binary manifest")
+	}
+}
+
+func TestDecodeBinaryManifestVersions(t *testing.T) {
+	// Binary manifests written by versions with fewer or more fields
+	type olderRecord struct {
+		VolumeName string
+		Volumes    []*struct{ ObjectName string }
+	}
+	type newerRecord struct {
+		VolumeName   string
+		FutureOption string
+		GroupMembers []*newerRecord
+	}
+
+	testCases := []struct {
+		record interface{}
+		want   *JobInfo
+	}{
+		{&olderRecord{VolumeName: "tank/old", Volumes: []*struct{ ObjectName string }{{ObjectName: "vol1"}}}, &JobInfo{VolumeName: "tank/old", Volumes: []*VolumeInfo{{ObjectName: "vol1"}}}},
+		{&newerRecord{VolumeName: "tank/new", FutureOption: "x", GroupMembers: []*newerRecord{{VolumeName: "tank/new/child"}}}, &JobInfo{VolumeName: "tank/new", GroupMembers: []*JobInfo{{VolumeName: "tank/new/child"}}}},
+	}
+
+	for idx, c := range testCases {
+		raw := bytes.NewBuffer(append([]byte{}, binaryManifestMagic...))
+		if err := gob.NewEncoder(raw).Encode(c.record); err != nil {
+			t.Fatalf("%d: could not encode record - %v", idx, err)
+		}
+		decoded, err := DecodeBinaryManifest(raw.Bytes())
+		if err != nil {
+			t.Errorf("%d: could not decode manifest - %v", idx, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, c.want) {
+			t.Errorf("%d: expected %+v, got %+v", idx, c.want, decoded)
+		}
+	}
+}
+
+func TestManifestParts(t *testing.T) {
+	manifestName := "manifests|tank/data|snap1.manifest.gz.pgp"
+	for idx, c := range []struct {
+		objectName string
+		part       bool
+	}{
+		{manifestName, false},
+		{ManifestPartName(manifestName, 1), true},
+		{ManifestPartName(manifestName, 12), true},
+		{"manifests|tank/data|part1.manifest", false},
+		{"tank/data|snap1.zstream.gz.vol1", false},
+	} {
+		if IsManifestPart(c.objectName) != c.part {
+			t.Errorf("%d: expected %s to be a manifest part: %v", idx, c.objectName, c.part)
+		}
+	}
+
+	volumes := make([]*VolumeInfo, 10)
+	for idx := range volumes {
+		volumes[idx] = &VolumeInfo{ObjectName: fmt.Sprintf("tank/data|snap1.zstream.gz.vol%d", idx+1), VolumeNumber: int64(idx + 1)}
+	}
+	encoded, err := json.Marshal(volumes[9])
+	if err != nil {
+		t.Fatalf("could not encode volume - %v", err)
+	}
+	volSize := uint64(len(encoded)) + 1
+
+	testCases := []struct {
+		maxSize uint64
+		parts   []int
+	}{
+		{1 << 20, []int{10}},
+		{4 * volSize, []int{4, 4, 2}},
+		{volSize, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		// A volume larger than the maximum size still gets a part of its own
+		{1, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+
+	for idx, c := range testCases {
+		parts, err := SplitManifestVolumes(volumes, c.maxSize)
+		if err != nil {
+			t.Errorf("%d: could not split volumes - %v", idx, err)
+			continue
+		}
+		var sizes []int
+		var joined []*VolumeInfo
+		for _, part := range parts {
+			sizes = append(sizes, len(part))
+			joined = append(joined, part...)
+		}
+		if !reflect.DeepEqual(sizes, c.parts) {
+			t.Errorf("%d: expected parts of %v volumes, got %v", idx, c.parts, sizes)
+		}
+		if !reflect.DeepEqual(joined, volumes) {
+			t.Errorf("%d: expected the parts to hold every volume, in order", idx)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Domain separation prefixes for the leaves and interior nodes of the Merkle tree, as
+// used by RFC 6962, so a leaf can never be passed off as an interior node.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// ErrMerkleRootMismatch is returned when the Merkle root recomputed from the volume checksums
+// listed in a manifest does not match the root stored in it.
+var ErrMerkleRootMismatch = errors.New("the merkle root computed from the volume checksums does not match the one stored in the manifest")
+
+// MerkleRoot will return the root of the Merkle tree built over the provided leaves, in order,
+// following the construction of RFC 6962 using SHA-256.
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		h := sha256.New()
+		h.Write([]byte{merkleLeafPrefix})
+		h.Write(leaves[0])
+		return h.Sum(nil)
+	}
+
+	// Split at the largest power of two smaller than the number of leaves
+	k := 1
+	for k<<1 < len(leaves) {
+		k <<= 1
+	}
+
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(MerkleRoot(leaves[:k]))
+	h.Write(MerkleRoot(leaves[k:]))
+	return h.Sum(nil)
+}
+
+// ComputeMerkleRoot will return the hex encoded Merkle root over the SHA256 checksums of
+// all the volumes of this JobInfo, in the order they are restored.
+func (j *JobInfo) ComputeMerkleRoot() (string, error) {
+	volumes := j.AllVolumes()
+	leaves := make([][]byte, len(volumes))
+	for idx, vol := range volumes {
+		digest, err := hex.DecodeString(vol.SHA256Sum)
+		if err != nil || len(digest) != sha256.Size {
+			return "", fmt.Errorf("volume %s does not have a valid sha256 checksum recorded", vol.ObjectName)
+		}
+		leaves[idx] = digest
+	}
+
+	return hex.EncodeToString(MerkleRoot(leaves)), nil
+}
+
+// VerifyMerkleRoot will recompute the Merkle root over the volume checksums of this JobInfo
+// and compare it against the one stored in the manifest.
+func (j *JobInfo) VerifyMerkleRoot() error {
+	if j.MerkleRoot == "" {
+		return fmt.Errorf("the manifest for %s@%s does not record a merkle root", j.VolumeName, j.BaseSnapshot.Name)
+	}
+
+	root, err := j.ComputeMerkleRoot()
+	if err != nil {
+		return err
+	}
+	if root != j.MerkleRoot {
+		return ErrMerkleRootMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func merkleLeaf(data []byte) []byte {
+	h := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return h[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.Sum256(append(append([]byte{merkleNodePrefix}, left...), right...))
+	return h[:]
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := make([][]byte, 7)
+	for idx := range leaves {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("volume %d", idx)))
+		leaves[idx] = digest[:]
+	}
+	l := make([][]byte, len(leaves))
+	for idx := range leaves {
+		l[idx] = merkleLeaf(leaves[idx])
+	}
+	empty := sha256.Sum256(nil)
+
+	testCases := []struct {
+		leaves [][]byte
+		root   []byte
+	}{
+		{nil, empty[:]},
+		{leaves[:1], l[0]},
+		{leaves[:2], merkleNode(l[0], l[1])},
+		{leaves[:3], merkleNode(merkleNode(l[0], l[1]), l[2])},
+		{leaves[:4], merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3]))},
+		{leaves[:5], merkleNode(merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3])), l[4])},
+		{leaves[:7], merkleNode(merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3])), merkleNode(merkleNode(l[4], l[5]), l[6]))},
+	}
+
+	for idx, c := range testCases {
+		if root := MerkleRoot(c.leaves); !bytes.Equal(root, c.root) {
+			t.Errorf("%d: expected root %x, got %x", idx, c.root, root)
+		}
+	}
+
+	// The order of the leaves is part of the root
+	if bytes.Equal(MerkleRoot([][]byte{leaves[0], leaves[1]}), MerkleRoot([][]byte{leaves[1], leaves[0]})) {
+		t.Errorf("expected reordered leaves to produce a different root")
+	}
+}
+
+func TestVerifyMerkleRoot(t *testing.T) {
+	newJob := func(count int) *JobInfo {
+		j := &JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap"}}
+		for idx := 0; idx < count; idx++ {
+			j.Volumes = append(j.Volumes, &VolumeInfo{
+				ObjectName: fmt.Sprintf("tank/data|snap.zstream.vol%d", idx+1),
+				SHA256Sum:  fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("volume %d", idx)))),
+			})
+		}
+		root, err := j.ComputeMerkleRoot()
+		if err != nil {
+			t.Fatalf("could not compute merkle root - %v", err)
+		}
+		j.MerkleRoot = root
+		return j
+	}
+
+	testCases := []struct {
+		volumes int
+		alter   func(j *JobInfo)
+		valid   func(error) bool
+	}{
+		{5, func(j *JobInfo) {}, func(e error) bool { return e == nil }},
+		{1, func(j *JobInfo) {}, func(e error) bool { return e == nil }},
+		// A single altered volume checksum, at any position, should change the root
+		{5, func(j *JobInfo) { j.Volumes[0].SHA256Sum = fmt.Sprintf("%x", sha256.Sum256([]byte("altered"))) }, func(e error) bool { return e == ErrMerkleRootMismatch }},
+		{5, func(j *JobInfo) { j.Volumes[3].SHA256Sum = fmt.Sprintf("%x", sha256.Sum256([]byte("altered"))) }, func(e error) bool { return e == ErrMerkleRootMismatch }},
+		{5, func(j *JobInfo) { j.Volumes[4].SHA256Sum = fmt.Sprintf("%x", sha256.Sum256([]byte("altered"))) }, func(e error) bool { return e == ErrMerkleRootMismatch }},
+		// Dropping or reordering volumes should change the root
+		{5, func(j *JobInfo) { j.Volumes = j.Volumes[:4] }, func(e error) bool { return e == ErrMerkleRootMismatch }},
+		{5, func(j *JobInfo) { j.Volumes[1], j.Volumes[2] = j.Volumes[2], j.Volumes[1] }, func(e error) bool { return e == ErrMerkleRootMismatch }},
+		// An altered root should not verify
+		{5, func(j *JobInfo) { j.MerkleRoot = fmt.Sprintf("%x", sha256.Sum256([]byte("altered"))) }, func(e error) bool { return e == ErrMerkleRootMismatch }},
+		{5, func(j *JobInfo) { j.MerkleRoot = "" }, func(e error) bool { return e != nil && e != ErrMerkleRootMismatch }},
+		{5, func(j *JobInfo) { j.Volumes[2].SHA256Sum = "not a checksum" }, func(e error) bool { return e != nil && e != ErrMerkleRootMismatch }},
+	}
+
+	for idx, c := range testCases {
+		j := newJob(c.volumes)
+		c.alter(j)
+		if err := j.VerifyMerkleRoot(); !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+		}
+	}
+}
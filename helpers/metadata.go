@@ -0,0 +1,165 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// metadataFileMutex serializes the lines appended to metadata files by backup sets restored in parallel.
+var metadataFileMutex sync.Mutex
+
+// MetadataRecord is the line appended to the metadata file of a restore for each backup set received.
+type MetadataRecord struct {
+	VolumeName string
+	Snapshot   string
+	Target     string `json:",omitempty"`
+	Metadata   map[string]string
+}
+
+// validateMetadataKey will check the provided metadata key can be written to, and parsed back from, a key=value line.
+func validateMetadataKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("the metadata key cannot be empty")
+	}
+	if strings.ContainsAny(key, "=\n") {
+		return fmt.Errorf("the metadata key %q cannot contain an equal sign or a newline", key)
+	}
+	return nil
+}
+
+// ParseMetadata will parse the provided key=value pairs into a map of metadata, later pairs overriding earlier ones
+// of the same key.
+func ParseMetadata(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	metadata := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("the metadata %q is not in the key=value format", pair)
+		}
+		if err := validateMetadataKey(parts[0]); err != nil {
+			return nil, err
+		}
+		metadata[parts[0]] = parts[1]
+	}
+	return metadata, nil
+}
+
+// ParseMetadataOutput will parse the output of a metadata hook, a key=value pair per line. Empty lines and lines
+// starting with a # are ignored.
+func ParseMetadataOutput(output []byte) (map[string]string, error) {
+	var pairs []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pairs = append(pairs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ParseMetadata(pairs)
+}
+
+// RunMetadataHook will run the provided executable with the dataset and snapshot being backed up as its arguments,
+// returning the metadata it printed on its standard output, see ParseMetadataOutput.
+func RunMetadataHook(ctx context.Context, hook, dataset, snapshot string) (map[string]string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, hook, dataset, snapshot)
+	AppLogger.Debugf("Running the metadata hook with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return ParseMetadataOutput(b.Bytes())
+}
+
+// MergeMetadata will return the metadata of every provided map combined, the values of later maps overriding those of
+// earlier ones with the same key. Returns nil if there is no metadata at all.
+func MergeMetadata(maps ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, m := range maps {
+		for key, value := range m {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// AppendMetadataFile will append the provided record as a line of JSON to the metadata file at the provided path,
+// creating it if needed.
+func AppendMetadataFile(path string, record *MetadataRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	metadataFileMutex.Lock()
+	defer metadataFileMutex.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RunPostRestoreHook will run the provided executable with the dataset received into, and the dataset and snapshot it
+// was backed up from, as its arguments, passing the record of the backup set as JSON on its standard input.
+func RunPostRestoreHook(ctx context.Context, hook string, record *MetadataRecord) error {
+	input, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	errB := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, hook, record.Target, record.VolumeName, record.Snapshot)
+	AppLogger.Debugf("Running the post restore hook with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	testCases := []struct {
+		pairs    []string
+		metadata map[string]string
+		valid    bool
+	}{
+		{nil, nil, true},
+		{[]string{"layout=v2", "owner=ops=db", "empty="}, map[string]string{"layout": "v2", "owner": "ops=db", "empty": ""}, true},
+		{[]string{"layout=v1", "layout=v2"}, map[string]string{"layout": "v2"}, true},
+		{[]string{"layout"}, nil, false},
+		{[]string{"=v2"}, nil, false},
+	}
+
+	for idx, c := range testCases {
+		metadata, err := ParseMetadata(c.pairs)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if c.valid && !reflect.DeepEqual(metadata, c.metadata) {
+			t.Errorf("%d: expected metadata %v, got %v", idx, c.metadata, metadata)
+		}
+	}
+}
+
+func TestParseMetadataOutput(t *testing.T) {
+	testCases := []struct {
+		output   string
+		metadata map[string]string
+		valid    bool
+	}{
+		{"", nil, true},
+		{"# generated by the layout program\nlayout=v2\r\n\n  \nzcp.quota=10G\n", map[string]string{"layout": "v2", "zcp.quota": "10G"}, true},
+		{"layout=v2\nnot a pair\n", nil, false},
+	}
+
+	for idx, c := range testCases {
+		metadata, err := ParseMetadataOutput([]byte(c.output))
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if c.valid && !reflect.DeepEqual(metadata, c.metadata) {
+			t.Errorf("%d: expected metadata %v, got %v", idx, c.metadata, metadata)
+		}
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	testCases := []struct {
+		maps     []map[string]string
+		metadata map[string]string
+	}{
+		{nil, nil},
+		{[]map[string]string{nil, {}}, nil},
+		{[]map[string]string{{"a": "1", "b": "2"}, nil, {"b": "3"}}, map[string]string{"a": "1", "b": "3"}},
+	}
+
+	for idx, c := range testCases {
+		if metadata := MergeMetadata(c.maps...); !reflect.DeepEqual(metadata, c.metadata) {
+			t.Errorf("%d: expected metadata %v, got %v", idx, c.metadata, metadata)
+		}
+	}
+}
+
+func TestMetadataHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadatahooks")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeHook := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatalf("could not write the %s hook - %v", name, err)
+		}
+		return path
+	}
+	inputPath := filepath.Join(dir, "input")
+	metadataHook := writeHook("metadata", "echo \"dataset=$1\"\necho \"snapshot=$2\"\n")
+	failingHook := writeHook("failing", "echo oops >&2\nexit 3\n")
+	restoreHook := writeHook("restore", "echo \"$1 $2 $3\" > "+inputPath+"\ncat >> "+inputPath+"\n")
+
+	metadata, err := RunMetadataHook(context.Background(), metadataHook, "tank/data", "snap1")
+	if err != nil {
+		t.Fatalf("unexpected error running the metadata hook - %v", err)
+	}
+	if expected := map[string]string{"dataset": "tank/data", "snapshot": "snap1"}; !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected metadata %v from the hook, got %v", expected, metadata)
+	}
+	if _, err := RunMetadataHook(context.Background(), failingHook, "tank/data", "snap1"); err == nil {
+		t.Errorf("expected an error from a failing metadata hook")
+	}
+
+	record := &MetadataRecord{VolumeName: "tank/data", Snapshot: "snap1", Target: "restore/data", Metadata: metadata}
+	if err := RunPostRestoreHook(context.Background(), restoreHook, record); err != nil {
+		t.Fatalf("unexpected error running the post restore hook - %v", err)
+	}
+	input, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		t.Fatalf("could not read the input of the post restore hook - %v", err)
+	}
+	recordJSON, _ := json.Marshal(record)
+	if expected := "restore/data tank/data snap1\n" + string(recordJSON); string(input) != expected {
+		t.Errorf("expected the post restore hook to get %q, got %q", expected, string(input))
+	}
+	if err := RunPostRestoreHook(context.Background(), failingHook, record); err == nil {
+		t.Errorf("expected an error from a failing post restore hook")
+	}
+}
+
+func TestAppendMetadataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadatafile")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.jsonl")
+
+	records := []*MetadataRecord{
+		{VolumeName: "tank/data", Snapshot: "snap1", Target: "restore/data", Metadata: map[string]string{"layout": "v2"}},
+		{VolumeName: "tank/logs", Snapshot: "snap2"},
+	}
+	for idx, record := range records {
+		if err := AppendMetadataFile(path, record); err != nil {
+			t.Fatalf("%d: could not append to the metadata file - %v", idx, err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open the metadata file - %v", err)
+	}
+	defer f.Close()
+
+	idx := 0
+	scanner := bufio.NewScanner(f)
+	for ; scanner.Scan(); idx++ {
+		record := new(MetadataRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Errorf("%d: could not decode the metadata file line - %v", idx, err)
+			continue
+		}
+		if idx < len(records) && !reflect.DeepEqual(record, records[idx]) {
+			t.Errorf("%d: expected record %+v, got %+v", idx, records[idx], record)
+		}
+	}
+	if idx != len(records) {
+		t.Errorf("expected %d lines in the metadata file, got %d", len(records), idx)
+	}
+}
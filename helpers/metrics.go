@@ -0,0 +1,141 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metricsPrefix            = "zfsbackup_"
+	lastSuccessTimestampName = metricsPrefix + "last_success_timestamp_seconds"
+)
+
+var (
+	metricsLabelEscaper  = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	metricsFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9_\-.]`)
+)
+
+type textfileMetric struct {
+	name  string
+	help  string
+	value float64
+}
+
+// TextfileMetricsPath returns the path of the metrics file written for the dataset (or group) of the provided job.
+func TextfileMetricsPath(dir string, j *JobInfo) string {
+	return filepath.Join(dir, fmt.Sprintf("zfsbackup_%s.prom", metricsFileNameChars.ReplaceAllString(j.VolumeName, "_")))
+}
+
+// WriteTextfileMetrics will atomically write the outcome of the provided backup job to a file in the provided
+// directory using the Prometheus exposition format, suitable for the node_exporter textfile collector. runErr
+// should be the error returned by the backup, if any. The time of the last successful backup is carried over
+// from a previously written file when the backup failed.
+func WriteTextfileMetrics(dir string, j *JobInfo, runErr error, now time.Time) error {
+	path := TextfileMetricsPath(dir, j)
+
+	success, lastSuccess := 0.0, 0.0
+	if runErr == nil {
+		success = 1
+		lastSuccess = float64(now.Unix())
+	} else if previous, ok := readTextfileMetric(path, lastSuccessTimestampName); ok {
+		lastSuccess = previous
+	}
+
+	endTime := j.EndTime
+	if runErr != nil || endTime.IsZero() {
+		endTime = now
+	}
+
+	metrics := []textfileMetric{
+		{metricsPrefix + "last_run_timestamp_seconds", "Time the last backup finished, in seconds since the epoch.", float64(now.Unix())},
+		{lastSuccessTimestampName, "Time the last successful backup finished, in seconds since the epoch.", lastSuccess},
+		{metricsPrefix + "last_run_success", "Whether the last backup succeeded (1) or failed (0).", success},
+		{metricsPrefix + "last_run_duration_seconds", "Duration of the last backup in seconds.", endTime.Sub(j.StartTime).Seconds()},
+		{metricsPrefix + "last_run_zfs_stream_bytes", "Number of bytes read from the zfs send stream during the last backup.", float64(j.ZFSStreamBytes)},
+		{metricsPrefix + "last_run_written_bytes", "Number of bytes written to the destination(s) during the last backup.", float64(j.TotalBytesWritten())},
+		{metricsPrefix + "last_run_volumes", "Number of volumes written during the last backup.", float64(len(j.AllVolumes()))},
+	}
+
+	labels := fmt.Sprintf(`{dataset="%s"}`, metricsLabelEscaper.Replace(j.VolumeName))
+	var output []string
+	for _, metric := range metrics {
+		output = append(output,
+			fmt.Sprintf("# HELP %s %s", metric.name, metric.help),
+			fmt.Sprintf("# TYPE %s gauge", metric.name),
+			fmt.Sprintf("%s%s %s", metric.name, labels, strconv.FormatFloat(metric.value, 'f', -1, 64)),
+		)
+	}
+
+	// Write to a temporary file in the same directory and rename it so the collector never reads a partial file
+	tempFile, err := ioutil.TempFile(dir, ".zfsbackup_metrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err = tempFile.WriteString(strings.Join(output, "\n") + "\n"); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err = tempFile.Chmod(0644); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err = tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+// readTextfileMetric will return the value of the named metric from a previously written metrics file.
+func readTextfileMetric(path, name string) (float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name+"{") && !strings.HasPrefix(line, name+" ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, perr := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if perr != nil {
+			return 0, false
+		}
+		return value, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,239 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	expositionSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*")*,?)?\})? (\S+)( -?[0-9]+)?$`)
+	expositionHelp   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) .*$`)
+	expositionType   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram|summary|untyped)$`)
+)
+
+// parseExposition will validate the contents of a file in the Prometheus text exposition format
+// and return the value of each sample, keyed by its name and labels.
+func parseExposition(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	samples := make(map[string]float64)
+	typed := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# HELP "):
+			if !expositionHelp.MatchString(line) {
+				return nil, fmt.Errorf("line %d: malformed HELP line %q", lineNum, line)
+			}
+		case strings.HasPrefix(line, "# TYPE "):
+			matches := expositionType.FindStringSubmatch(line)
+			if matches == nil {
+				return nil, fmt.Errorf("line %d: malformed TYPE line %q", lineNum, line)
+			}
+			if typed[matches[1]] {
+				return nil, fmt.Errorf("line %d: duplicate TYPE line for %s", lineNum, matches[1])
+			}
+			if _, ok := samples[matches[1]]; ok {
+				return nil, fmt.Errorf("line %d: TYPE line for %s after its samples", lineNum, matches[1])
+			}
+			typed[matches[1]] = true
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			matches := expositionSample.FindStringSubmatch(line)
+			if matches == nil {
+				return nil, fmt.Errorf("line %d: malformed sample %q", lineNum, line)
+			}
+			value, perr := strconv.ParseFloat(matches[3], 64)
+			if perr != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q - %v", lineNum, matches[3], perr)
+			}
+			key := matches[1] + matches[2]
+			if _, ok := samples[key]; ok {
+				return nil, fmt.Errorf("line %d: duplicate sample %s", lineNum, key)
+			}
+			samples[key] = value
+			samples[matches[1]] = value
+		}
+	}
+
+	return samples, scanner.Err()
+}
+
+func TestParseExposition(t *testing.T) {
+	testCases := []struct {
+		contents string
+		valid    bool
+	}{
+		{"# HELP a_metric Some help.\n# TYPE a_metric gauge\na_metric{dataset=\"tank/a\"} 1.5\n", true},
+		{"a_metric 1\nother_metric{a=\"b\",c=\"d\\\"\"} -2 1600000000\n", true},
+		{"a metric 1\n", false},
+		{"a_metric{dataset=tank} 1\n", false},
+		{"a_metric one\n", false},
+		{"# TYPE a_metric gauge\n# TYPE a_metric gauge\n", false},
+		{"# TYPE a_metric sometype\n", false},
+	}
+
+	dir, err := ioutil.TempDir("", "zfsbackupmetricstest")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for idx, c := range testCases {
+		path := filepath.Join(dir, fmt.Sprintf("%d.prom", idx))
+		if err = ioutil.WriteFile(path, []byte(c.contents), 0644); err != nil {
+			t.Fatalf("%d: could not write file - %v", idx, err)
+		}
+		if _, err = parseExposition(path); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+	}
+}
+
+func TestWriteTextfileMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfsbackupmetricstest")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1600000000, 0)
+	j := &JobInfo{
+		VolumeName:     "tank/my \"data\"",
+		StartTime:      start,
+		EndTime:        start.Add(90 * time.Second),
+		ZFSStreamBytes: 2048,
+		Volumes:        []*VolumeInfo{{Size: 1000}, {Size: 24}},
+	}
+
+	testCases := []struct {
+		now         time.Time
+		runErr      error
+		success     float64
+		lastSuccess float64
+		duration    float64
+	}{
+		{start.Add(100 * time.Second), nil, 1, float64(start.Unix() + 100), 90},
+		// A failed run keeps the time of the previous success
+		{start.Add(200 * time.Second), errors.New("failed"), 0, float64(start.Unix() + 100), 200},
+		{start.Add(300 * time.Second), nil, 1, float64(start.Unix() + 300), 90},
+	}
+
+	for idx, c := range testCases {
+		if err = WriteTextfileMetrics(dir, j, c.runErr, c.now); err != nil {
+			t.Fatalf("%d: could not write metrics - %v", idx, err)
+		}
+
+		samples, perr := parseExposition(TextfileMetricsPath(dir, j))
+		if perr != nil {
+			t.Errorf("%d: metrics file is not in a valid exposition format - %v", idx, perr)
+			continue
+		}
+
+		expected := map[string]float64{
+			"zfsbackup_last_run_timestamp_seconds":     float64(c.now.Unix()),
+			"zfsbackup_last_success_timestamp_seconds": c.lastSuccess,
+			"zfsbackup_last_run_success":               c.success,
+			"zfsbackup_last_run_duration_seconds":      c.duration,
+			"zfsbackup_last_run_zfs_stream_bytes":      2048,
+			"zfsbackup_last_run_written_bytes":         1024,
+			"zfsbackup_last_run_volumes":               2,
+		}
+		for name, value := range expected {
+			if got, ok := samples[name+`{dataset="tank/my \"data\""}`]; !ok {
+				t.Errorf("%d: metric %s not found for the dataset", idx, name)
+			} else if math.Abs(got-value) > 1e-9 {
+				t.Errorf("%d: expected %s to be %v, got %v", idx, name, value, got)
+			}
+		}
+	}
+
+	// Only the metrics file should be left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not read dir - %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != "zfsbackup_tank_my__data_.prom" {
+		t.Errorf("expected only the metrics file in the directory, got %d files", len(files))
+	}
+}
+
+func TestWriteTextfileMetricsGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfsbackupmetricstest")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The stream bytes of a group already include those of its members
+	start := time.Unix(1600000000, 0)
+	j := &JobInfo{
+		VolumeName:     "mygroup",
+		StartTime:      start,
+		EndTime:        start.Add(10 * time.Second),
+		ZFSStreamBytes: 3072,
+		GroupMembers: []*JobInfo{
+			{VolumeName: "tank/a", ZFSStreamBytes: 1024, Volumes: []*VolumeInfo{{Size: 500}}},
+			{VolumeName: "tank/b", ZFSStreamBytes: 2048, Volumes: []*VolumeInfo{{Size: 700}, {Size: 100}}},
+		},
+	}
+
+	if err = WriteTextfileMetrics(dir, j, nil, start.Add(10*time.Second)); err != nil {
+		t.Fatalf("could not write metrics - %v", err)
+	}
+	samples, err := parseExposition(TextfileMetricsPath(dir, j))
+	if err != nil {
+		t.Fatalf("metrics file is not in a valid exposition format - %v", err)
+	}
+
+	expected := map[string]float64{
+		"zfsbackup_last_run_zfs_stream_bytes": 3072,
+		"zfsbackup_last_run_written_bytes":    1300,
+		"zfsbackup_last_run_volumes":          3,
+	}
+	for name, value := range expected {
+		if got, ok := samples[name+`{dataset="mygroup"}`]; !ok {
+			t.Errorf("metric %s not found for the group", name)
+		} else if got != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, got)
+		}
+	}
+}
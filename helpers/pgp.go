@@ -21,16 +21,30 @@
 package helpers
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 var (
 	pubRing openpgp.EntityList
 	secRing openpgp.EntityList
+
+	// ErrNotSigned is returned when verifying the signature of a message that was not signed.
+	ErrNotSigned = errors.New("the message is not signed")
+	// ErrUnknownSigner is returned when verifying the signature of a message signed by a key not found in the loaded key rings.
+	ErrUnknownSigner = errors.New("the message was signed by a key not found in the loaded key rings")
+	// ErrUntrustedSigner is returned when a message was signed by a key that is not one of the trusted signers.
+	ErrUntrustedSigner = errors.New("the message was signed by a key that is not one of the trusted signers")
+	// ErrNoDecryptionKey is returned when none of the keys a message was encrypted to has its private key in the loaded secret key ring.
+	ErrNoDecryptionKey = errors.New("none of the keys the message was encrypted to were found in the secret key ring")
 )
 
 // GetPublicKeyByEmail will return the key from the pubpoic PGP ring (if available) matching
@@ -55,6 +69,172 @@ func promptFunc(keys []openpgp.Key, symmetric bool) ([]byte, error) {
 	panic("secret keys should have been decrypted already")
 }
 
+// VerifySignature will read the signed, and optionally encrypted, message from the provided reader,
+// discarding its contents, and return the ID of the key that signed it. An error is returned if the
+// message is not signed, was signed by an unknown or untrusted key, or if its signature does not match
+// its contents. Any key found in the loaded key rings is trusted if no trusted signers are provided.
+func VerifySignature(r io.Reader, trustedSigners []string) (uint64, error) {
+	config := new(packet.Config)
+	config.DefaultCompressionAlgo = packet.CompressionNone
+	config.DefaultCipher = packet.CipherAES256
+	md, err := openpgp.ReadMessage(r, getCombinedKeyRing(), promptFunc, config)
+	if err != nil {
+		return 0, err
+	}
+
+	// The signature is only checked once the whole message has been read
+	if _, err = io.Copy(ioutil.Discard, md.UnverifiedBody); err != nil {
+		return md.SignedByKeyId, err
+	}
+
+	switch {
+	case !md.IsSigned:
+		return 0, ErrNotSigned
+	case md.SignedBy == nil:
+		return md.SignedByKeyId, ErrUnknownSigner
+	case md.SignatureError != nil:
+		return md.SignedByKeyId, md.SignatureError
+	case !isTrustedSigner(trustedSigners, md.SignedBy):
+		return md.SignedByKeyId, ErrUntrustedSigner
+	}
+
+	return md.SignedByKeyId, nil
+}
+
+// ValidateTrustedSigners will check that each trusted signer of this JobInfo object is a 16 character
+// long key ID or a 40 character fingerprint, normalizing them to upper case hex without spaces or 0x prefix.
+func (j *JobInfo) ValidateTrustedSigners() error {
+	for idx, signer := range j.TrustedSigners {
+		normalized := strings.ToUpper(strings.Replace(signer, " ", "", -1))
+		normalized = strings.TrimPrefix(normalized, "0X")
+		if len(normalized) != 16 && len(normalized) != 40 {
+			return fmt.Errorf("the trusted signer %s must be a 16 character key ID or a 40 character fingerprint", signer)
+		}
+		if _, err := hex.DecodeString(normalized); err != nil {
+			return fmt.Errorf("the trusted signer %s is not a hex encoded key ID or fingerprint", signer)
+		}
+		j.TrustedSigners[idx] = normalized
+	}
+
+	return nil
+}
+
+// isTrustedSigner will check whether the provided signing key, or the entity it belongs to, matches one
+// of the provided normalized key IDs or fingerprints. Any key is trusted when none are provided.
+func isTrustedSigner(trustedSigners []string, key *openpgp.Key) bool {
+	if len(trustedSigners) == 0 {
+		return true
+	}
+	if key == nil || key.PublicKey == nil {
+		return false
+	}
+
+	candidates := []*packet.PublicKey{key.PublicKey}
+	if key.Entity != nil && key.Entity.PrimaryKey != nil {
+		candidates = append(candidates, key.Entity.PrimaryKey)
+	}
+	for _, publicKey := range candidates {
+		keyID := fmt.Sprintf("%016X", publicKey.KeyId)
+		fingerprint := fmt.Sprintf("%X", publicKey.Fingerprint[:])
+		for _, signer := range trustedSigners {
+			if signer == keyID || signer == fingerprint {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// EntityHasKeyID will return true if the provided key ID belongs to the entity's primary key or one of its subkeys.
+func EntityHasKeyID(entity *openpgp.Entity, keyID uint64) bool {
+	if entity == nil {
+		return false
+	}
+	if entity.PrimaryKey != nil && entity.PrimaryKey.KeyId == keyID {
+		return true
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PublicKey != nil && subkey.PublicKey.KeyId == keyID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindDecryptionKey will read the keys the PGP message from the provided reader was encrypted to and return the entity
+// of the loaded secret key ring holding the decrypted private key of one of them, along with the IDs of the keys the
+// message was encrypted to. ErrNoDecryptionKey is returned if none was found, and a nil entity if the message is not
+// encrypted to any key, e.g. when it is not a PGP message at all.
+func FindDecryptionKey(r io.Reader) (*openpgp.Entity, []uint64, error) {
+	var recipients []uint64
+	packets := packet.NewReader(r)
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			if len(recipients) == 0 {
+				return nil, nil, nil
+			}
+			return nil, recipients, err
+		}
+		encryptedKey, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			// The keys a message was encrypted to are listed before its encrypted contents
+			break
+		}
+		recipients = append(recipients, encryptedKey.KeyId)
+	}
+	if len(recipients) == 0 {
+		return nil, nil, nil
+	}
+
+	for _, keyID := range recipients {
+		for _, key := range secRing.KeysById(keyID) {
+			if key.PrivateKey != nil && !key.PrivateKey.Encrypted {
+				return key.Entity, recipients, nil
+			}
+		}
+	}
+
+	return nil, recipients, ErrNoDecryptionKey
+}
+
+// HasEncryptedPrivateKeys will return true if a private key, or subkey, of the loaded secret key ring is protected by a passphrase.
+func HasEncryptedPrivateKeys() bool {
+	for _, entity := range secRing {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			return true
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// UnlockPrivateKeys will decrypt the private keys, and subkeys, of the loaded secret key ring protected by the provided
+// passphrase. The number of keys left encrypted, e.g. as they are protected by another passphrase, is returned.
+func UnlockPrivateKeys(passphrase []byte) int {
+	locked := 0
+	unlock := func(key *packet.PrivateKey) {
+		if key != nil && key.Encrypted && key.Decrypt(passphrase) != nil {
+			locked++
+		}
+	}
+	for _, entity := range secRing {
+		unlock(entity.PrivateKey)
+		for _, subkey := range entity.Subkeys {
+			unlock(subkey.PrivateKey)
+		}
+	}
+
+	return locked
+}
+
 func getKeyByEmail(keyring openpgp.EntityList, email string) *openpgp.Entity {
 	for _, entity := range keyring {
 		for _, ident := range entity.Identities {
@@ -0,0 +1,278 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	gzip "github.com/klauspost/pgzip"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func newTestEntity(t *testing.T, email string) *openpgp.Entity {
+	t.Helper()
+	entity, err := openpgp.NewEntity(email, "", email, &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		t.Fatalf("could not generate key for %s - %v", email, err)
+	}
+	return entity
+}
+
+func pgpMessage(t *testing.T, to, signer *openpgp.Entity, payload []byte) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	w, err := openpgp.Encrypt(buf, []*openpgp.Entity{to}, signer, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		t.Fatalf("could not create message - %v", err)
+	}
+	if _, err = w.Write(payload); err != nil {
+		t.Fatalf("could not write message - %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not close message - %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifySignature(t *testing.T) {
+	expected := newTestEntity(t, "expected@example.com")
+	unknown := newTestEntity(t, "unknown@example.com")
+	oldPubRing, oldSecRing := pubRing, secRing
+	pubRing, secRing = nil, openpgp.EntityList{expected}
+	defer func() { pubRing, secRing = oldPubRing, oldSecRing }()
+
+	payload := bytes.Repeat([]byte("zfs send stream"), 64*1024)
+	tampered := pgpMessage(t, expected, expected, payload)
+	tampered[len(tampered)/2] ^= 0xff
+
+	testCases := []struct {
+		message []byte
+		keyID   uint64
+		valid   func(error) bool
+	}{
+		{pgpMessage(t, expected, expected, payload), expected.PrimaryKey.KeyId, func(e error) bool { return e == nil }},
+		{tampered, expected.PrimaryKey.KeyId, func(e error) bool { return e != nil }},
+		{pgpMessage(t, expected, unknown, payload), unknown.PrimaryKey.KeyId, func(e error) bool { return e == ErrUnknownSigner }},
+		{pgpMessage(t, expected, nil, payload), 0, func(e error) bool { return e == ErrNotSigned }},
+		{payload, 0, func(e error) bool { return e != nil }},
+	}
+
+	for idx, c := range testCases {
+		keyID, err := VerifySignature(bytes.NewReader(c.message), nil)
+		if !c.valid(err) {
+			t.Errorf("%d: error %v did not pass validation function", idx, err)
+			continue
+		}
+		if err == nil && keyID != c.keyID {
+			t.Errorf("%d: expected signer key ID %X, got %X", idx, c.keyID, keyID)
+		}
+		if err == ErrUnknownSigner && keyID != c.keyID {
+			t.Errorf("%d: expected unknown signer key ID %X, got %X", idx, c.keyID, keyID)
+		}
+	}
+
+	if !EntityHasKeyID(expected, expected.PrimaryKey.KeyId) || !EntityHasKeyID(expected, expected.Subkeys[0].PublicKey.KeyId) {
+		t.Errorf("expected the primary and sub key IDs to belong to the entity")
+	}
+	if EntityHasKeyID(expected, unknown.PrimaryKey.KeyId) || EntityHasKeyID(nil, expected.PrimaryKey.KeyId) {
+		t.Errorf("expected a key ID of another entity to not belong to the entity")
+	}
+}
+
+func TestTrustedSigners(t *testing.T) {
+	trusted := newTestEntity(t, "trusted@example.com")
+	untrusted := newTestEntity(t, "untrusted@example.com")
+	oldPubRing, oldSecRing := pubRing, secRing
+	pubRing, secRing = openpgp.EntityList{untrusted}, openpgp.EntityList{trusted}
+	defer func() { pubRing, secRing = oldPubRing, oldSecRing }()
+
+	// Trusted signers may be provided as key IDs or fingerprints in any case, spacing, or with a 0x prefix
+	fingerprint := fmt.Sprintf("%x", trusted.PrimaryKey.Fingerprint[:])
+	j := &JobInfo{TrustedSigners: []string{"0x" + strings.ToLower(untrusted.PrimaryKey.KeyIdString()[:8]) + strings.ToLower(untrusted.PrimaryKey.KeyIdString()[8:]), fingerprint[:20] + " " + fingerprint[20:]}}
+	if err := j.ValidateTrustedSigners(); err != nil {
+		t.Fatalf("expected the trusted signers to be valid, got error %v", err)
+	}
+	expected := []string{untrusted.PrimaryKey.KeyIdString(), strings.ToUpper(fingerprint)}
+	if !reflect.DeepEqual(j.TrustedSigners, expected) {
+		t.Errorf("expected normalized trusted signers %v, got %v", expected, j.TrustedSigners)
+	}
+	for idx, signer := range []string{"", "ABCDEF", "ZZZZZZZZZZZZZZZZ", strings.Repeat("A", 20)} {
+		if err := (&JobInfo{TrustedSigners: []string{signer}}).ValidateTrustedSigners(); err == nil {
+			t.Errorf("%d: expected trusted signer %q to be invalid", idx, signer)
+		}
+	}
+
+	payload := bytes.Repeat([]byte("zfs send stream"), 64*1024)
+	testCases := []struct {
+		signer         *openpgp.Entity
+		trustedSigners []string
+		err            error
+	}{
+		// Any key in the keyrings is trusted when no trusted signers are provided
+		{trusted, nil, nil},
+		{untrusted, nil, nil},
+		{trusted, []string{trusted.PrimaryKey.KeyIdString()}, nil},
+		{trusted, []string{strings.ToUpper(fingerprint)}, nil},
+		{untrusted, []string{trusted.PrimaryKey.KeyIdString()}, ErrUntrustedSigner},
+		{nil, []string{trusted.PrimaryKey.KeyIdString()}, ErrNotSigned},
+	}
+
+	for idx, c := range testCases {
+		message := pgpMessage(t, trusted, c.signer, payload)
+		if _, err := VerifySignature(bytes.NewReader(message), c.trustedSigners); err != c.err {
+			t.Errorf("%d: expected verification error %v, got %v", idx, c.err, err)
+		}
+
+		// A restore should fail the same way once the volume has been read
+		f, err := ioutil.TempFile("", "zfsbackuptrustedsignertest")
+		if err != nil {
+			t.Fatalf("could not create temp file - %v", err)
+		}
+		defer os.Remove(f.Name())
+		compressed := bytes.NewBuffer(nil)
+		gw := gzip.NewWriter(compressed)
+		if _, err = gw.Write(payload); err != nil {
+			t.Fatalf("could not compress payload - %v", err)
+		}
+		gw.Close()
+		if _, err = f.Write(pgpMessage(t, trusted, c.signer, compressed.Bytes())); err != nil {
+			t.Fatalf("could not write temp file - %v", err)
+		}
+		f.Close()
+
+		restoreJob := &JobInfo{Compressor: InternalCompressor, EncryptKey: trusted, TrustedSigners: c.trustedSigners}
+		vol, err := ExtractLocal(context.Background(), restoreJob, f.Name(), false)
+		if err != nil {
+			t.Errorf("%d: could not extract volume - %v", idx, err)
+			continue
+		}
+		_, err = ioutil.ReadAll(vol)
+		vol.Close()
+		if err != c.err {
+			t.Errorf("%d: expected restore error %v, got %v", idx, c.err, err)
+		}
+	}
+}
+
+func TestFindDecryptionKey(t *testing.T) {
+	owner := newTestEntity(t, "owner@example.com")
+	other := newTestEntity(t, "other@example.com")
+	stranger := newTestEntity(t, "stranger@example.com")
+	locked := newTestEntity(t, "locked@example.com")
+	for _, subkey := range locked.Subkeys {
+		subkey.PrivateKey.Encrypted = true
+	}
+
+	oldSecRing := secRing
+	defer func() { secRing = oldSecRing }()
+
+	gzipped := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(gzipped)
+	if _, err := gw.Write([]byte("not encrypted")); err != nil {
+		t.Fatalf("could not write gzip payload - %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("could not close gzip payload - %v", err)
+	}
+
+	testCases := []struct {
+		ring       openpgp.EntityList
+		message    []byte
+		key        *openpgp.Entity
+		recipients bool
+		err        error
+	}{
+		{
+			ring:       openpgp.EntityList{other, owner},
+			message:    pgpMessage(t, owner, nil, []byte("payload")),
+			key:        owner,
+			recipients: true,
+		},
+		{
+			ring:       openpgp.EntityList{other},
+			message:    pgpMessage(t, stranger, nil, []byte("payload")),
+			recipients: true,
+			err:        ErrNoDecryptionKey,
+		},
+		{
+			ring:       openpgp.EntityList{other, locked},
+			message:    pgpMessage(t, locked, nil, []byte("payload")),
+			recipients: true,
+			err:        ErrNoDecryptionKey,
+		},
+		{
+			ring:    openpgp.EntityList{owner},
+			message: []byte("{\"VolumeName\": \"pool/fs\"}"),
+		},
+		{
+			ring:    openpgp.EntityList{owner},
+			message: gzipped.Bytes(),
+		},
+	}
+
+	for idx, c := range testCases {
+		secRing = c.ring
+		key, recipients, err := FindDecryptionKey(bytes.NewReader(c.message))
+		if err != c.err {
+			t.Errorf("%d: expected error %v, got %v", idx, c.err, err)
+		}
+		if key != c.key {
+			t.Errorf("%d: expected key %v, got %v", idx, c.key, key)
+		}
+		if (len(recipients) > 0) != c.recipients {
+			t.Errorf("%d: expected recipients to be listed (%v), got %v", idx, c.recipients, recipients)
+		}
+	}
+}
+
+func TestUnlockPrivateKeys(t *testing.T) {
+	unlocked := newTestEntity(t, "unlocked@example.com")
+	locked := newTestEntity(t, "locked@example.com")
+	for _, subkey := range locked.Subkeys {
+		subkey.PrivateKey.Encrypted = true
+	}
+
+	oldSecRing := secRing
+	defer func() { secRing = oldSecRing }()
+
+	secRing = openpgp.EntityList{unlocked}
+	if HasEncryptedPrivateKeys() {
+		t.Errorf("expected no encrypted private keys to be reported")
+	}
+	if count := UnlockPrivateKeys([]byte("passphrase")); count != 0 {
+		t.Errorf("expected no keys to be left locked, got %d", count)
+	}
+
+	secRing = openpgp.EntityList{unlocked, locked}
+	if !HasEncryptedPrivateKeys() {
+		t.Errorf("expected encrypted private keys to be reported")
+	}
+}
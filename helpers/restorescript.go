@@ -0,0 +1,121 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RestoreScriptObjectName returns the name of the object the restore script of this backup set is uploaded as.
+func (j *JobInfo) RestoreScriptObjectName() string {
+	return fmt.Sprintf("%s.restore.sh", strings.Join(j.objectNameParts(), j.Separator))
+}
+
+// RestoreStages returns the commands, in order, that will turn the object of the provided volume back
+// into its part of the zfs send stream when the object is fed to the first command's stdin.
+func (j *JobInfo) RestoreStages(vol *VolumeInfo) []string {
+	var stages []string
+	if j.EncryptTo != "" || j.SignFrom != "" {
+		stages = append(stages, "gpg --quiet --decrypt")
+	}
+
+	compressor := j.Compressor
+	if vol.Compressor != "" {
+		compressor = vol.Compressor
+	}
+	switch compressor {
+	case InternalCompressor:
+		stages = append(stages, "gzip -dc")
+	case ZstdCompressor, SeekableZstdCompressor:
+		stages = append(stages, "zstd -dc")
+	case ExternalCompressor:
+		args := j.DecompressCommandLine()
+		for idx := range args {
+			args[idx] = shellQuote(args[idx])
+		}
+		stages = append(stages, strings.Join(args, " "))
+	case "", NoCompressor:
+	default:
+		stages = append(stages, shellQuote(compressor)+" -c -d")
+	}
+
+	if len(stages) == 0 {
+		stages = append(stages, "cat")
+	}
+	return stages
+}
+
+// WriteRestoreScript will write out a bash script documenting the objects of this backup set and the
+// commands needed to verify, decrypt, decompress, and receive them without zfsbackup. It is meant as
+// a safety net for disaster recovery and is not a substitute for the receive command. The provided
+// destinations are listed as the places the objects can be downloaded from.
+func (j *JobInfo) WriteRestoreScript(w io.Writer, destinations []string) error {
+	bw := bufio.NewWriter(w)
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format+"\n", args...)
+	}
+
+	p("#!/bin/bash")
+	p("# Restore script for %s@%s generated by %s v%s.", j.VolumeName, j.BaseSnapshot.Name, ProgramName, Version())
+	p("#")
+	p("# This documents the objects of the backup set and the commands needed to restore it without %s,", ProgramName)
+	p("# prefer using the receive command when it is available. Download the objects listed below from one")
+	p("# of the destinations, keeping their names, then run this script from the directory they were saved to:")
+	p("#")
+	p("#   TARGET=pool/dataset RECEIVE_FLAGS=-F bash %s", shellQuote(j.RestoreScriptObjectName()))
+	p("#")
+	for _, destination := range destinations {
+		p("# Destination: %s", destination)
+	}
+	if j.IncrementalSnapshot.Name != "" {
+		p("# Incremental from: %s@%s, which must already exist in TARGET", j.VolumeName, j.IncrementalSnapshot.Name)
+	}
+	if j.EncryptTo != "" {
+		p("# Encrypted to: %s", j.EncryptTo)
+	}
+	if j.SignFrom != "" {
+		p("# Signed by: %s", j.SignFrom)
+	}
+	p("")
+	p("set -euo pipefail")
+	p(`: "${TARGET:?set TARGET to the dataset to receive the backup set into}"`)
+	p("")
+	p("# Verify the integrity of each object")
+	p("sha256sum -c - <<'EOF'")
+	for _, vol := range j.Volumes {
+		p("%s  %s", vol.SHA256Sum, vol.ObjectName)
+	}
+	p("EOF")
+	p("")
+	p("# Decrypt and decompress each object, in order, and receive the resulting zfs send stream")
+	p("{")
+	for _, vol := range j.Volumes {
+		stages := j.RestoreStages(vol)
+		stages[0] = fmt.Sprintf("%s < %s", stages[0], shellQuote(vol.ObjectName))
+		p("\t%s", strings.Join(stages, " | "))
+	}
+	p(`} | zfs receive ${RECEIVE_FLAGS:-} "$TARGET"`)
+
+	return bw.Flush()
+}
@@ -0,0 +1,95 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteRestoreScript(t *testing.T) {
+	volumes := []*VolumeInfo{
+		{ObjectName: "tank/data|snap.zstream.gz.pgp.vol1", SHA256Sum: "1111"},
+		{ObjectName: "tank/data|snap.zstream.pgp.vol2", SHA256Sum: "2222", Compressor: NoCompressor},
+	}
+
+	testCases := []struct {
+		j        *JobInfo
+		expected []string
+		excluded []string
+	}{
+		{
+			&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap"}, Separator: "|", Compressor: InternalCompressor, EncryptTo: "user@domain.com", Volumes: volumes},
+			[]string{
+				"1111  tank/data|snap.zstream.gz.pgp.vol1",
+				"2222  tank/data|snap.zstream.pgp.vol2",
+				"gpg --quiet --decrypt < 'tank/data|snap.zstream.gz.pgp.vol1' | gzip -dc\n",
+				"gpg --quiet --decrypt < 'tank/data|snap.zstream.pgp.vol2'\n",
+				`} | zfs receive ${RECEIVE_FLAGS:-} "$TARGET"`,
+				"# Encrypted to: user@domain.com",
+				"# Destination: s3://bucket/prefix",
+				"bash 'tank/data|snap.restore.sh'",
+			},
+			[]string{"Incremental from"},
+		},
+		{
+			&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, IncrementalSnapshot: SnapshotInfo{Name: "snap1"}, Separator: "|", Compressor: "xz", Volumes: []*VolumeInfo{{ObjectName: "tank/data|snap1|to|snap2.zstream.xz.vol1", SHA256Sum: "3333"}}},
+			[]string{
+				"xz -c -d < 'tank/data|snap1|to|snap2.zstream.xz.vol1'\n",
+				"# Incremental from: tank/data@snap1",
+			},
+			[]string{"gpg"},
+		},
+		{
+			&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap"}, Separator: "|", Compressor: SeekableZstdCompressor, SingleObject: true, Volumes: []*VolumeInfo{{ObjectName: "tank/data|snap.zstream.zst", SHA256Sum: "4444"}}},
+			[]string{"zstd -dc < 'tank/data|snap.zstream.zst'\n"},
+			[]string{"gpg"},
+		},
+		{
+			&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap"}, Separator: "|", Compressor: NoCompressor, Volumes: []*VolumeInfo{{ObjectName: "tank/data|snap.zstream.vol1", SHA256Sum: "5555"}}},
+			[]string{"\tcat < 'tank/data|snap.zstream.vol1'\n"},
+			[]string{"gzip", "zstd"},
+		},
+	}
+
+	for idx, c := range testCases {
+		buf := bytes.NewBuffer(nil)
+		if err := c.j.WriteRestoreScript(buf, []string{"s3://bucket/prefix"}); err != nil {
+			t.Errorf("%d: could not write restore script - %v", idx, err)
+			continue
+		}
+		script := buf.String()
+		if !strings.HasPrefix(script, "#!/bin/bash\n") {
+			t.Errorf("%d: expected the script to start with a shebang", idx)
+		}
+		for _, expected := range c.expected {
+			if !strings.Contains(script, expected) {
+				t.Errorf("%d: expected the script to contain %q, got:\n%s", idx, expected, script)
+			}
+		}
+		for _, excluded := range c.excluded {
+			if strings.Contains(script, excluded) {
+				t.Errorf("%d: expected the script to not contain %q, got:\n%s", idx, excluded, script)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrRestoreStateMismatch is returned when a restore state file describes a different restore than the one resumed.
+var ErrRestoreStateMismatch = errors.New("the restore state does not match the restore")
+
+// RestoreState is the progress of an auto restore, persisted to a local file as each volume is received so a restore
+// interrupted, e.g. by a reboot, resumes near where it stopped instead of from the first backup set.
+type RestoreState struct {
+	VolumeName string
+	Target     string
+	// The snapshot being restored to, and those of the chain leading to it that were received already, in order
+	Snapshot  string
+	Completed []SnapshotInfo `json:",omitempty"`
+	// The snapshot being received, the number of its volumes and bytes of its stream received so far
+	InProgress *SnapshotInfo `json:",omitempty"`
+	Volumes    int           `json:",omitempty"`
+	Bytes      uint64        `json:",omitempty"`
+	Updated    time.Time
+
+	path string
+}
+
+// NewRestoreState will return the state of a restore of the snapshot of volumeName into target, saved to path.
+func NewRestoreState(path, volumeName, target, snapshot string) *RestoreState {
+	return &RestoreState{VolumeName: volumeName, Target: target, Snapshot: snapshot, path: path}
+}
+
+// ReadRestoreState will read the restore state saved to path, returning nil if there is none.
+func ReadRestoreState(path string) (*RestoreState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := new(RestoreState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not parse restore state %s: %v", path, err)
+	}
+	state.path = path
+	return state, nil
+}
+
+// Validate will check the state describes a restore of the provided snapshot of volumeName into target, through the
+// provided chain of snapshots, oldest first. The snapshots completed and in progress must be found in the chain in
+// the order they were received, so a state left by another restore, or by backup sets since replaced, is not resumed.
+func (s *RestoreState) Validate(volumeName, target, snapshot string, chain []SnapshotInfo) error {
+	if s.VolumeName != volumeName || s.Target != target || s.Snapshot != snapshot {
+		return fmt.Errorf("%w: it restores %s@%s into %s, not %s@%s into %s", ErrRestoreStateMismatch, s.VolumeName, s.Snapshot, s.Target, volumeName, snapshot, target)
+	}
+
+	received := s.Completed
+	if s.InProgress != nil {
+		received = append(received[:len(received):len(received)], *s.InProgress)
+	}
+	next := 0
+	for _, snap := range received {
+		found := false
+		for next < len(chain) {
+			next++
+			if chain[next-1].Equal(&snap) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: the snapshot %s (created %v) is not part of the chain restored", ErrRestoreStateMismatch, snap.Name, snap.CreationTime)
+		}
+	}
+	return nil
+}
+
+// IsCompleted will return true if the provided snapshot was received already.
+func (s *RestoreState) IsCompleted(snapshot *SnapshotInfo) bool {
+	for idx := range s.Completed {
+		if s.Completed[idx].Equal(snapshot) {
+			return true
+		}
+	}
+	return false
+}
+
+// Begin will record that the provided snapshot is being received, from its first volume.
+func (s *RestoreState) Begin(snapshot SnapshotInfo) error {
+	s.InProgress = &snapshot
+	s.Volumes = 0
+	s.Bytes = 0
+	return s.Save()
+}
+
+// VolumeReceived will record that the next volume of the snapshot in progress, holding size bytes of its stream, was received.
+func (s *RestoreState) VolumeReceived(size uint64) error {
+	s.Volumes++
+	s.Bytes += size
+	return s.Save()
+}
+
+// Complete will record that the snapshot in progress was received.
+func (s *RestoreState) Complete() error {
+	if s.InProgress != nil && !s.IsCompleted(s.InProgress) {
+		s.Completed = append(s.Completed, *s.InProgress)
+	}
+	s.InProgress = nil
+	s.Volumes = 0
+	s.Bytes = 0
+	return s.Save()
+}
+
+// Save will write the state to its file, replacing it atomically so an interruption never leaves a partial state behind.
+func (s *RestoreState) Save() error {
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.path), ".zfsbackup_restore_state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err = tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	// The state must survive a power loss, not only the process stopping
+	if err = tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err = tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), s.path)
+}
+
+// Remove will delete the state file once the restore is done.
+func (s *RestoreState) Remove() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreStateSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfsbackup_restore_state")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "restore.json")
+
+	if state, rerr := ReadRestoreState(path); rerr != nil || state != nil {
+		t.Fatalf("expected no restore state before one was saved, got %v, %v", state, rerr)
+	}
+
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	full := SnapshotInfo{Name: "full", CreationTime: created}
+	inc := SnapshotInfo{Name: "inc", CreationTime: created.Add(time.Hour)}
+
+	state := NewRestoreState(path, "tank/data", "restore/data", "inc")
+	steps := []func() error{
+		func() error { return state.Begin(full) },
+		func() error { return state.VolumeReceived(100) },
+		func() error { return state.Complete() },
+		func() error { return state.Begin(inc) },
+		func() error { return state.VolumeReceived(100) },
+		func() error { return state.VolumeReceived(50) },
+	}
+	for idx, step := range steps {
+		if err = step(); err != nil {
+			t.Fatalf("%d: could not save the restore state: %v", idx, err)
+		}
+	}
+
+	read, err := ReadRestoreState(path)
+	if err != nil || read == nil {
+		t.Fatalf("could not read the restore state back: %v", err)
+	}
+	if read.VolumeName != "tank/data" || read.Target != "restore/data" || read.Snapshot != "inc" {
+		t.Errorf("expected the restore of tank/data@inc into restore/data, got %s@%s into %s", read.VolumeName, read.Snapshot, read.Target)
+	}
+	if len(read.Completed) != 1 || !read.IsCompleted(&full) || read.IsCompleted(&inc) {
+		t.Errorf("expected only %v to be completed, got %v", full, read.Completed)
+	}
+	if read.InProgress == nil || !read.InProgress.Equal(&inc) || read.Volumes != 2 || read.Bytes != 150 {
+		t.Errorf("expected 2 volumes and 150 bytes of %v in progress, got %d volumes and %d bytes of %v", inc, read.Volumes, read.Bytes, read.InProgress)
+	}
+
+	// The state read back keeps recording to the same file
+	if err = read.Complete(); err != nil {
+		t.Fatalf("could not save the restore state: %v", err)
+	}
+	if read, err = ReadRestoreState(path); err != nil || read.InProgress != nil || len(read.Completed) != 2 {
+		t.Errorf("expected two completed snapshots and none in progress, got %v (%v)", read, err)
+	}
+
+	if err = read.Remove(); err != nil {
+		t.Errorf("could not remove the restore state: %v", err)
+	}
+	if err = read.Remove(); err != nil {
+		t.Errorf("expected removing a removed restore state to succeed, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected no files left behind, found %d", len(files))
+	}
+
+	if err = ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatalf("could not write restore state: %v", err)
+	}
+	if _, err = ReadRestoreState(path); err == nil {
+		t.Errorf("expected an error reading a corrupt restore state")
+	}
+}
+
+func TestRestoreStateValidate(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s1 := SnapshotInfo{Name: "s1", CreationTime: created}
+	s2 := SnapshotInfo{Name: "s2", CreationTime: created.Add(time.Hour)}
+	s3 := SnapshotInfo{Name: "s3", CreationTime: created.Add(2 * time.Hour)}
+	recreated := SnapshotInfo{Name: "s2", CreationTime: created.Add(90 * time.Minute)}
+	chain := []SnapshotInfo{s1, s2, s3}
+
+	testCases := []struct {
+		state *RestoreState
+		valid bool
+	}{
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3"}, true},
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3", Completed: []SnapshotInfo{s1, s2}, InProgress: &s3}, true},
+		// Snapshots found on the target were not received by the restore
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3", Completed: []SnapshotInfo{s2}, InProgress: &s3}, true},
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3", InProgress: &s1}, true},
+		// Another restore
+		{&RestoreState{VolumeName: "tank/other", Target: "restore/data", Snapshot: "s3"}, false},
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/other", Snapshot: "s3"}, false},
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s2"}, false},
+		// Out of order, or snapshots not part of the chain, e.g. the backup set was replaced
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3", Completed: []SnapshotInfo{s2, s1}}, false},
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3", Completed: []SnapshotInfo{s1}, InProgress: &s1}, false},
+		{&RestoreState{VolumeName: "tank/data", Target: "restore/data", Snapshot: "s3", Completed: []SnapshotInfo{s1, recreated}}, false},
+	}
+
+	for idx, c := range testCases {
+		err := c.state.Validate("tank/data", "restore/data", "s3", chain)
+		if c.valid && err != nil {
+			t.Errorf("%d: expected the restore state to be valid, got %v", idx, err)
+		}
+		if !c.valid && !errors.Is(err, ErrRestoreStateMismatch) {
+			t.Errorf("%d: expected a restore state mismatch, got %v", idx, err)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// SeekableZstdCompressor compresses each block of a volume as an independent zstd frame and
+	// appends a seek table so a range of the volume can be decompressed without reading all of it.
+	// The output is a regular zstd stream that any zstd decoder can read sequentially.
+	SeekableZstdCompressor = "zstd-seekable"
+
+	// DefaultCompressionBlockSize is the size, in KiB, of the uncompressed data in each block of a seekable volume.
+	DefaultCompressionBlockSize = 1024
+
+	// The seek table follows the zstd seekable format, see
+	// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+	seekTableMagic       = 0x184D2A5E
+	seekableMagic        = 0x8F92EAB1
+	seekTableFooterSize  = 9
+	seekTableEntrySize   = 8
+	skippableHeaderSize  = 8
+	seekTableChecksumBit = 1 << 7
+)
+
+// ErrInvalidSeekTable is returned when a seekable volume does not end with a valid seek table.
+var ErrInvalidSeekTable = errors.New("the volume does not end with a valid zstd seek table")
+
+// SeekableFrame describes a single independently compressed block of a seekable volume.
+type SeekableFrame struct {
+	CompressedOffset   int64
+	CompressedSize     int64
+	DecompressedOffset int64
+	DecompressedSize   int64
+}
+
+// seekableZstdWriter will buffer writes into blocks, compressing each one as its own zstd frame. Up to concurrency
+// blocks are compressed at once, they are written out in order as soon as they and the blocks before them are done.
+type seekableZstdWriter struct {
+	w           io.Writer
+	encoder     *zstd.Encoder
+	blockSize   int
+	concurrency int
+	buf         []byte
+	inflight    []*seekableBlock
+	free        []*seekableBlock
+	frames      []SeekableFrame
+	closed      bool
+}
+
+// seekableBlock is a block of a seekable volume being compressed, done is closed once out holds its zstd frame.
+type seekableBlock struct {
+	in   []byte
+	out  []byte
+	done chan struct{}
+}
+
+func newSeekableZstdWriter(w io.Writer, blockSize int, level int, concurrency int) (*seekableZstdWriter, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultCompressionBlockSize
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(concurrency))
+	if err != nil {
+		return nil, err
+	}
+	size := blockSize * humanize.KiByte
+	return &seekableZstdWriter{w: w, encoder: encoder, blockSize: size, concurrency: concurrency, buf: make([]byte, 0, size)}, nil
+}
+
+func (s *seekableZstdWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):s.blockSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == s.blockSize {
+			if err := s.flushBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flushBlock will start compressing the buffered block, first writing out the oldest block being compressed if
+// there are already as many blocks being compressed as allowed.
+func (s *seekableZstdWriter) flushBlock() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	if len(s.inflight) >= s.concurrency {
+		if err := s.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	block := &seekableBlock{in: s.buf, done: make(chan struct{})}
+	if n := len(s.free); n > 0 {
+		// Reuse the buffers of a block already written out
+		block.out = s.free[n-1].out
+		s.buf = s.free[n-1].in[:0]
+		s.free = s.free[:n-1]
+	} else {
+		s.buf = make([]byte, 0, s.blockSize)
+	}
+	go func() {
+		block.out = s.encoder.EncodeAll(block.in, block.out[:0])
+		close(block.done)
+	}()
+	s.inflight = append(s.inflight, block)
+	return nil
+}
+
+// writeBlock will wait for the oldest block being compressed and write out its frame.
+func (s *seekableZstdWriter) writeBlock() error {
+	block := s.inflight[0]
+	<-block.done
+	s.inflight = s.inflight[1:]
+	if _, err := s.w.Write(block.out); err != nil {
+		return err
+	}
+
+	frame := SeekableFrame{CompressedSize: int64(len(block.out)), DecompressedSize: int64(len(block.in))}
+	if n := len(s.frames); n > 0 {
+		last := s.frames[n-1]
+		frame.CompressedOffset = last.CompressedOffset + last.CompressedSize
+		frame.DecompressedOffset = last.DecompressedOffset + last.DecompressedSize
+	}
+	s.frames = append(s.frames, frame)
+	s.free = append(s.free, block)
+	return nil
+}
+
+// Close will compress any remaining data and write out the seek table. It does not close the underlying writer.
+func (s *seekableZstdWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	defer func() {
+		// Let any blocks left over after a failed write finish before releasing the encoder
+		for _, block := range s.inflight {
+			<-block.done
+		}
+		s.encoder.Close()
+	}()
+
+	if err := s.flushBlock(); err != nil {
+		return err
+	}
+	for len(s.inflight) > 0 {
+		if err := s.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	tableSize := len(s.frames)*seekTableEntrySize + seekTableFooterSize
+	table := make([]byte, skippableHeaderSize+tableSize)
+	binary.LittleEndian.PutUint32(table[0:], seekTableMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(tableSize))
+	entry := table[skippableHeaderSize:]
+	for _, frame := range s.frames {
+		binary.LittleEndian.PutUint32(entry[0:], uint32(frame.CompressedSize))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(frame.DecompressedSize))
+		entry = entry[seekTableEntrySize:]
+	}
+	// The descriptor byte (entry[4]) is left as 0 as no checksums are stored
+	binary.LittleEndian.PutUint32(entry[0:], uint32(len(s.frames)))
+	binary.LittleEndian.PutUint32(entry[5:], seekableMagic)
+
+	_, err := s.w.Write(table)
+	return err
+}
+
+// ReadSeekTable will read the seek table found at the end of a seekable volume of the provided size.
+func ReadSeekTable(r io.ReaderAt, size int64) ([]SeekableFrame, error) {
+	if size < skippableHeaderSize+seekTableFooterSize {
+		return nil, ErrInvalidSeekTable
+	}
+
+	footer := make([]byte, seekTableFooterSize)
+	if _, err := r.ReadAt(footer, size-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, ErrInvalidSeekTable
+	}
+	entrySize := int64(seekTableEntrySize)
+	if footer[4]&seekTableChecksumBit != 0 {
+		entrySize += 4
+	}
+	count := int64(binary.LittleEndian.Uint32(footer[0:]))
+	tableSize := count*entrySize + seekTableFooterSize
+	if tableSize+skippableHeaderSize > size {
+		return nil, ErrInvalidSeekTable
+	}
+
+	table := make([]byte, skippableHeaderSize+tableSize)
+	if _, err := r.ReadAt(table, size-int64(len(table))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:]) != seekTableMagic || int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, ErrInvalidSeekTable
+	}
+
+	frames := make([]SeekableFrame, count)
+	var compressedOffset, decompressedOffset int64
+	for idx := range frames {
+		entry := table[skippableHeaderSize+int64(idx)*entrySize:]
+		frames[idx] = SeekableFrame{
+			CompressedOffset:   compressedOffset,
+			CompressedSize:     int64(binary.LittleEndian.Uint32(entry[0:])),
+			DecompressedOffset: decompressedOffset,
+			DecompressedSize:   int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		compressedOffset += frames[idx].CompressedSize
+		decompressedOffset += frames[idx].DecompressedSize
+	}
+	if compressedOffset+int64(len(table)) != size {
+		return nil, ErrInvalidSeekTable
+	}
+
+	return frames, nil
+}
+
+// SeekableZstdReader provides random access to the decompressed contents of a seekable volume,
+// only reading the compressed blocks needed to serve each read.
+type SeekableZstdReader struct {
+	r       io.ReaderAt
+	frames  []SeekableFrame
+	decoder *zstd.Decoder
+}
+
+// NewSeekableZstdReader will read the seek table of the seekable volume of the provided size from r.
+func NewSeekableZstdReader(r io.ReaderAt, size int64) (*SeekableZstdReader, error) {
+	frames, err := ReadSeekTable(r, size)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &SeekableZstdReader{r: r, frames: frames, decoder: decoder}, nil
+}
+
+// Size returns the decompressed size of the volume.
+func (s *SeekableZstdReader) Size() int64 {
+	if len(s.frames) == 0 {
+		return 0
+	}
+	last := s.frames[len(s.frames)-1]
+	return last.DecompressedOffset + last.DecompressedSize
+}
+
+// ReadAt will decompress len(p) bytes starting at the provided offset of the decompressed volume.
+func (s *SeekableZstdReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	idx := sort.Search(len(s.frames), func(i int) bool {
+		return s.frames[i].DecompressedOffset+s.frames[i].DecompressedSize > off
+	})
+
+	read := 0
+	var compressed, decompressed []byte
+	for ; read < len(p) && idx < len(s.frames); idx++ {
+		frame := s.frames[idx]
+		if int64(cap(compressed)) < frame.CompressedSize {
+			compressed = make([]byte, frame.CompressedSize)
+		}
+		compressed = compressed[:frame.CompressedSize]
+		if _, err := s.r.ReadAt(compressed, frame.CompressedOffset); err != nil {
+			return read, err
+		}
+
+		var err error
+		decompressed, err = s.decoder.DecodeAll(compressed, decompressed[:0])
+		if err != nil {
+			return read, err
+		}
+		if int64(len(decompressed)) != frame.DecompressedSize {
+			return read, fmt.Errorf("block %d decompressed to %d bytes, expected %d", idx, len(decompressed), frame.DecompressedSize)
+		}
+
+		read += copy(p[read:], decompressed[off+int64(read)-frame.DecompressedOffset:])
+	}
+
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close releases the resources used by the decoder.
+func (s *SeekableZstdReader) Close() error {
+	s.decoder.Close()
+	return nil
+}
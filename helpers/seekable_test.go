@@ -0,0 +1,267 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestSeekableZstd(t *testing.T) {
+	payload := make([]byte, 1024*1024+123)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not read in random data for testing - %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w, err := newSeekableZstdWriter(buf, 64, 6, 1)
+	if err != nil {
+		t.Fatalf("could not create seekable writer - %v", err)
+	}
+	// Write in uneven chunks to cross block boundaries
+	for p := payload; len(p) > 0; {
+		n := 10000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatalf("could not write to seekable writer - %v", err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not close seekable writer - %v", err)
+	}
+	compressed := buf.Bytes()
+
+	// Any zstd decoder should be able to read the volume sequentially
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("could not create decoder - %v", err)
+	}
+	sequential, err := ioutil.ReadAll(decoder)
+	decoder.Close()
+	if err != nil {
+		t.Fatalf("could not decode volume sequentially - %v", err)
+	} else if !bytes.Equal(sequential, payload) {
+		t.Errorf("sequentially decoded bytes not equal to the original payload")
+	}
+
+	frames, err := ReadSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatalf("could not read seek table - %v", err)
+	}
+	if len(frames) != 17 {
+		t.Errorf("expected 17 blocks of at most 64KiB, got %d", len(frames))
+	}
+
+	reader, err := NewSeekableZstdReader(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatalf("could not create seekable reader - %v", err)
+	}
+	defer reader.Close()
+	if reader.Size() != int64(len(payload)) {
+		t.Errorf("expected a decompressed size of %d, got %d", len(payload), reader.Size())
+	}
+
+	testCases := []struct {
+		offset int64
+		length int
+		err    error
+	}{
+		{0, 100, nil},
+		{64*1024 - 10, 20, nil},
+		{100000, 300000, nil},
+		{int64(len(payload)) - 100, 100, nil},
+		{int64(len(payload)) - 100, 200, io.EOF},
+		{int64(len(payload)), 10, io.EOF},
+	}
+
+	for idx, c := range testCases {
+		p := make([]byte, c.length)
+		n, rerr := reader.ReadAt(p, c.offset)
+		if rerr != c.err {
+			t.Errorf("%d: expected error %v, got %v", idx, c.err, rerr)
+		}
+		end := c.offset + int64(c.length)
+		if end > int64(len(payload)) {
+			end = int64(len(payload))
+		}
+		if !bytes.Equal(p[:n], payload[c.offset:end]) {
+			t.Errorf("%d: read %d bytes not equal to the requested region of the payload", idx, n)
+		}
+	}
+
+	// Truncated or non-seekable volumes should be rejected
+	for idx, invalid := range [][]byte{compressed[:len(compressed)-1], payload, nil} {
+		if _, err = ReadSeekTable(bytes.NewReader(invalid), int64(len(invalid))); err == nil {
+			t.Errorf("%d: expected an error reading the seek table of an invalid volume", idx)
+		}
+	}
+}
+
+// seekableTestPayload returns size bytes alternating between compressible text and random data.
+func seekableTestPayload(t testing.TB, size int) []byte {
+	payload := make([]byte, 0, size)
+	text := []byte("zfsbackup-go seekable zstd parallel compression test payload ")
+	random := make([]byte, 100*1024)
+	for len(payload) < size {
+		for i := 0; i < 1500 && len(payload) < size; i++ {
+			payload = append(payload, text...)
+		}
+		if _, err := rand.Read(random); err != nil {
+			t.Fatalf("could not read in random data for testing - %v", err)
+		}
+		payload = append(payload, random...)
+	}
+	return payload[:size]
+}
+
+func compressSeekable(payload []byte, blockSize, concurrency int) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w, err := newSeekableZstdWriter(buf, blockSize, 6, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	for p := payload; len(p) > 0; {
+		n := 1000003
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = w.Write(p[:n]); err != nil {
+			return nil, err
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type failingWriter struct {
+	left int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, io.ErrShortWrite
+	}
+	f.left--
+	return len(p), nil
+}
+
+func TestSeekableZstdConcurrency(t *testing.T) {
+	payload := seekableTestPayload(t, 24*1024*1024+77)
+	expected, err := compressSeekable(payload, 256, 1)
+	if err != nil {
+		t.Fatalf("could not compress payload - %v", err)
+	}
+
+	testCases := []struct {
+		concurrency int
+	}{
+		{1},
+		{2},
+		{8},
+		{0},
+	}
+
+	for idx, c := range testCases {
+		compressed, cerr := compressSeekable(payload, 256, c.concurrency)
+		if cerr != nil {
+			t.Errorf("%d: could not compress payload - %v", idx, cerr)
+			continue
+		}
+		// The blocks must be written in order regardless of which finished compressing first
+		if !bytes.Equal(compressed, expected) {
+			t.Errorf("%d: volume compressed with a concurrency of %d differs from one compressed a block at a time", idx, c.concurrency)
+		}
+
+		decoder, derr := zstd.NewReader(bytes.NewReader(compressed))
+		if derr != nil {
+			t.Fatalf("could not create decoder - %v", derr)
+		}
+		sequential, derr := ioutil.ReadAll(decoder)
+		decoder.Close()
+		if derr != nil {
+			t.Errorf("%d: could not decode volume sequentially - %v", idx, derr)
+		} else if !bytes.Equal(sequential, payload) {
+			t.Errorf("%d: sequentially decoded bytes not equal to the original payload", idx)
+		}
+
+		if frames, ferr := ReadSeekTable(bytes.NewReader(compressed), int64(len(compressed))); ferr != nil || len(frames) != 97 {
+			t.Errorf("%d: expected 97 blocks of at most 256KiB, got %d - %v", idx, len(frames), ferr)
+		}
+		reader, rerr := NewSeekableZstdReader(bytes.NewReader(compressed), int64(len(compressed)))
+		if rerr != nil {
+			t.Errorf("%d: could not create seekable reader - %v", idx, rerr)
+			continue
+		}
+		p := make([]byte, 3*256*1024)
+		offset := int64(len(payload) / 2)
+		if n, rerr := reader.ReadAt(p, offset); rerr != nil || !bytes.Equal(p[:n], payload[offset:offset+int64(len(p))]) {
+			t.Errorf("%d: read %d bytes not equal to the requested region of the payload - %v", idx, n, rerr)
+		}
+		reader.Close()
+	}
+
+	// A failure writing out a block should be returned once it is written out
+	for idx, left := range []int{0, 3} {
+		w, werr := newSeekableZstdWriter(&failingWriter{left: left}, 64, 6, 4)
+		if werr != nil {
+			t.Fatalf("could not create seekable writer - %v", werr)
+		}
+		_, werr = w.Write(payload[:2*1024*1024])
+		if cerr := w.Close(); werr == nil && cerr != io.ErrShortWrite {
+			t.Errorf("%d: expected error %v, got %v", idx, io.ErrShortWrite, cerr)
+		} else if werr != nil && werr != io.ErrShortWrite {
+			t.Errorf("%d: expected error %v, got %v", idx, io.ErrShortWrite, werr)
+		}
+	}
+}
+
+func BenchmarkSeekableZstdWriter(b *testing.B) {
+	payload := seekableTestPayload(b, 32*1024*1024)
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				w, err := newSeekableZstdWriter(ioutil.Discard, DefaultCompressionBlockSize, 6, concurrency)
+				if err != nil {
+					b.Fatalf("could not create seekable writer - %v", err)
+				}
+				if _, err = w.Write(payload); err != nil {
+					b.Fatalf("could not write to seekable writer - %v", err)
+				}
+				if err = w.Close(); err != nil {
+					b.Fatalf("could not close seekable writer - %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SnapshotListEntry is a snapshot to backup read from a snapshot list, along with the snapshot the
+// backup increments from, if any.
+type SnapshotListEntry struct {
+	Dataset     string
+	Snapshot    string
+	Incremental string
+}
+
+// String will return the entry as it would be written in a snapshot list.
+func (e SnapshotListEntry) String() string {
+	if e.Incremental == "" {
+		return fmt.Sprintf("%s@%s", e.Dataset, e.Snapshot)
+	}
+	return fmt.Sprintf("%s@%s @%s", e.Dataset, e.Snapshot, e.Incremental)
+}
+
+// LoadSnapshotList will read the snapshot list at the provided path, or from stdin when the path is "-".
+func LoadSnapshotList(path string) ([]SnapshotListEntry, error) {
+	if path == "-" {
+		return ReadSnapshotList(os.Stdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadSnapshotList(f)
+}
+
+// ReadSnapshotList will read the snapshots to backup, in order, from the provided reader. Each line holds a
+// snapshot in the form dataset@snapshot, optionally followed by the snapshot of the same dataset the backup
+// increments from (e.g. "tank/data@daily2 @daily1"). Blank lines and lines starting with # are ignored.
+// An incremental whose base is also listed must come after it.
+func ReadSnapshotList(r io.Reader) ([]SnapshotListEntry, error) {
+	var entries []SnapshotListEntry
+	var lines []int
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		entry, err := parseSnapshotListEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Map each listed snapshot to its position in the list
+	positions := make(map[string]int, len(entries))
+	for idx, entry := range entries {
+		name := fmt.Sprintf("%s@%s", entry.Dataset, entry.Snapshot)
+		if _, ok := positions[name]; ok {
+			return nil, fmt.Errorf("line %d: the snapshot %s is listed more than once", lines[idx], name)
+		}
+		positions[name] = idx
+	}
+
+	for idx, entry := range entries {
+		if entry.Incremental == "" {
+			continue
+		}
+		base := fmt.Sprintf("%s@%s", entry.Dataset, entry.Incremental)
+		if pos, ok := positions[base]; ok && pos > idx {
+			return nil, fmt.Errorf("line %d: the snapshot %s@%s increments from %s which is listed after it on line %d", lines[idx], entry.Dataset, entry.Snapshot, base, lines[pos])
+		}
+	}
+
+	return entries, nil
+}
+
+// parseSnapshotListEntry will parse a single, non-empty, line of a snapshot list.
+func parseSnapshotListEntry(text string) (SnapshotListEntry, error) {
+	fields := strings.Fields(text)
+	if len(fields) > 2 {
+		return SnapshotListEntry{}, fmt.Errorf("expected a snapshot optionally followed by the snapshot it increments from, got %q", text)
+	}
+
+	parts := strings.Split(fields[0], "@")
+	if len(parts) != 2 || parts[1] == "" {
+		return SnapshotListEntry{}, fmt.Errorf("expected a snapshot of the form dataset@snapshot, got %s", fields[0])
+	}
+	if err := ValidateDatasetName(fields[0]); err != nil {
+		return SnapshotListEntry{}, err
+	}
+	entry := SnapshotListEntry{Dataset: parts[0], Snapshot: parts[1]}
+
+	if len(fields) == 2 {
+		// The base may be given as dataset@snapshot, @snapshot, or snapshot
+		base := fields[1]
+		if idx := strings.Index(base, "@"); idx >= 0 {
+			if idx > 0 && base[:idx] != entry.Dataset {
+				return SnapshotListEntry{}, fmt.Errorf("the snapshot %s must increment from a snapshot of %s, got %s", fields[0], entry.Dataset, base)
+			}
+			base = base[idx+1:]
+		}
+		if err := ValidateDatasetName(fmt.Sprintf("%s@%s", entry.Dataset, base)); err != nil {
+			return SnapshotListEntry{}, fmt.Errorf("invalid snapshot to increment from provided, got %s", fields[1])
+		}
+		if base == entry.Snapshot {
+			return SnapshotListEntry{}, fmt.Errorf("the snapshot %s cannot increment from itself", fields[0])
+		}
+		entry.Incremental = base
+	}
+
+	return entry, nil
+}
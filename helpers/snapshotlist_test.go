@@ -0,0 +1,100 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSnapshotList(t *testing.T) {
+	testCases := []struct {
+		list    string
+		entries []SnapshotListEntry
+		valid   bool
+	}{
+		{"", nil, true},
+		{"tank/data@daily1\n", []SnapshotListEntry{{"tank/data", "daily1", ""}}, true},
+		{
+			"# catch up tank/data\n\ntank/data@daily1\ntank/data@daily2 @daily1\n  tank/data@daily3   tank/data@daily2  \ntank/home@weekly2 weekly1\n",
+			[]SnapshotListEntry{{"tank/data", "daily1", ""}, {"tank/data", "daily2", "daily1"}, {"tank/data", "daily3", "daily2"}, {"tank/home", "weekly2", "weekly1"}},
+			true,
+		},
+		// The base of an incremental need not be listed, e.g. when it was backed up before
+		{"tank/data@daily3 @daily2\ntank/data@daily4 @daily3\n", []SnapshotListEntry{{"tank/data", "daily3", "daily2"}, {"tank/data", "daily4", "daily3"}}, true},
+		{"tank/data\n", nil, false},
+		{"tank/data@\n", nil, false},
+		{"tank/data@daily1@daily2\n", nil, false},
+		{"1tank/data@daily1\n", nil, false},
+		{"tank/data@daily2 @daily1 @daily0\n", nil, false},
+		{"tank/data@daily2 tank/home@daily1\n", nil, false},
+		{"tank/data@daily2 @\n", nil, false},
+		{"tank/data@daily2 @daily/1\n", nil, false},
+		{"tank/data@daily2 daily2\n", nil, false},
+		{"tank/data@daily1\ntank/data@daily1\n", nil, false},
+		// An incremental must come after its base when both are listed
+		{"tank/data@daily2 @daily1\ntank/data@daily1\n", nil, false},
+	}
+
+	for idx, c := range testCases {
+		entries, err := ReadSnapshotList(strings.NewReader(c.list))
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(entries, c.entries) {
+			t.Errorf("%d: expected entries %v, got %v", idx, c.entries, entries)
+		}
+	}
+}
+
+func TestLoadSnapshotList(t *testing.T) {
+	f, err := ioutil.TempFile("", "zfsbackupsnapshotlist")
+	if err != nil {
+		t.Fatalf("could not create temp file - %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString("tank/data@daily1\ntank/data@daily2 @daily1\n"); err != nil {
+		t.Fatalf("could not write snapshot list - %v", err)
+	}
+	f.Close()
+
+	entries, err := LoadSnapshotList(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error loading the snapshot list - %v", err)
+	}
+	expected := []string{"tank/data@daily1", "tank/data@daily2 @daily1"}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %v", len(expected), entries)
+	}
+	for idx, entry := range entries {
+		if entry.String() != expected[idx] {
+			t.Errorf("%d: expected entry %s, got %s", idx, expected[idx], entry)
+		}
+	}
+
+	if _, err = LoadSnapshotList(f.Name() + ".missing"); err == nil {
+		t.Errorf("expected an error loading a missing snapshot list")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotTemplateTokens renders each strftime-like token supported in snapshot name templates.
+var snapshotTemplateTokens = map[byte]func(dataset string, t time.Time) string{
+	'Y': func(_ string, t time.Time) string { return fmt.Sprintf("%04d", t.Year()) },
+	'y': func(_ string, t time.Time) string { return fmt.Sprintf("%02d", t.Year()%100) },
+	'm': func(_ string, t time.Time) string { return fmt.Sprintf("%02d", int(t.Month())) },
+	'd': func(_ string, t time.Time) string { return fmt.Sprintf("%02d", t.Day()) },
+	'H': func(_ string, t time.Time) string { return fmt.Sprintf("%02d", t.Hour()) },
+	'M': func(_ string, t time.Time) string { return fmt.Sprintf("%02d", t.Minute()) },
+	'S': func(_ string, t time.Time) string { return fmt.Sprintf("%02d", t.Second()) },
+	'j': func(_ string, t time.Time) string { return fmt.Sprintf("%03d", t.YearDay()) },
+	's': func(_ string, t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	'Z': func(_ string, t time.Time) string { name, _ := t.Zone(); return name },
+	'n': func(dataset string, _ time.Time) string { return dataset[strings.LastIndex(dataset, "/")+1:] },
+	'D': func(dataset string, _ time.Time) string { return strings.Replace(dataset, "/", "_", -1) },
+}
+
+// Tokens that do not depend on the time a snapshot is taken
+const staticSnapshotTemplateTokens = "nDZ"
+
+// RenderSnapshotName will render the provided snapshot name template for the dataset at the provided time.
+// The template may use the following tokens:
+//
+//	%Y %y	the year with four or two digits
+//	%m %d	the month and the day of the month
+//	%H %M %S	the hour, minute, and second
+//	%j	the day of the year
+//	%s	the seconds since the Unix epoch
+//	%Z	the abbreviated name of the time zone
+//	%n	the last component of the dataset name (e.g. data for tank/data)
+//	%D	the dataset name with each / replaced by _
+//
+// e.g. "zfsbackup-%Y-%m-%dT%H-%M" renders as "zfsbackup-2024-06-01T03-00". An error is returned if the
+// template uses an unknown token or the rendered name is not a legal zfs snapshot name for the dataset.
+func RenderSnapshotName(template, dataset string, t time.Time) (string, error) {
+	var name strings.Builder
+	for idx := 0; idx < len(template); idx++ {
+		if template[idx] != '%' {
+			name.WriteByte(template[idx])
+			continue
+		}
+		idx++
+		if idx == len(template) {
+			return "", fmt.Errorf("the snapshot name template %s ends with an incomplete token", template)
+		}
+		token, ok := snapshotTemplateTokens[template[idx]]
+		if !ok {
+			return "", fmt.Errorf("the snapshot name template %s uses the unknown token %%%c", template, template[idx])
+		}
+		name.WriteString(token(dataset, t))
+	}
+
+	if name.Len() == 0 {
+		return "", fmt.Errorf("the snapshot name template %s renders an empty name", template)
+	}
+	if err := ValidateDatasetName(fmt.Sprintf("%s@%s", dataset, name.String())); err != nil {
+		return "", fmt.Errorf("the snapshot name template %s does not render a legal snapshot name - %v", template, err)
+	}
+
+	return name.String(), nil
+}
+
+// ValidateSnapshotTemplate will check the provided snapshot name template renders a legal snapshot name.
+// It returns false if the template does not depend on the time, in which case every snapshot taken
+// of a dataset with it would collide.
+func ValidateSnapshotTemplate(template, dataset string) (bool, error) {
+	if _, err := RenderSnapshotName(template, dataset, time.Now()); err != nil {
+		return false, err
+	}
+
+	for idx := 0; idx < len(template)-1; idx++ {
+		if template[idx] != '%' {
+			continue
+		}
+		idx++
+		if !strings.ContainsRune(staticSnapshotTemplateTokens, rune(template[idx])) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,94 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSnapshotName(t *testing.T) {
+	at := time.Date(2024, time.June, 1, 3, 0, 9, 0, time.UTC)
+
+	testCases := []struct {
+		template string
+		dataset  string
+		name     string
+		valid    bool
+	}{
+		{"zfsbackup-%Y-%m-%dT%H-%M", "tank/data", "zfsbackup-2024-06-01T03-00", true},
+		{"%y%m%d.%H%M%S", "tank/data", "240601.030009", true},
+		{"daily_%j_%Z", "tank", "daily_153_UTC", true},
+		{"auto-%s", "tank/data", "auto-1717210809", true},
+		{"%n-%Y%m%d", "tank/home/user", "user-20240601", true},
+		{"%D:%H:%M", "tank/home/user", "tank_home_user:03:00", true},
+		{"static", "tank/data", "static", true},
+		// Unknown or incomplete tokens
+		{"zfsbackup-%Q", "tank/data", "", false},
+		{"100%%-%d", "tank/data", "", false},
+		{"zfsbackup-%", "tank/data", "", false},
+		// Names that are not legal zfs snapshot names
+		{"", "tank/data", "", false},
+		{"zfsbackup/%Y", "tank/data", "", false},
+		{"zfsbackup@%Y", "tank/data", "", false},
+		{"zfsbackup+%Y", "tank/data", "", false},
+		{"zfsbackup-%D-%s", "tank/" + strings.Repeat("long", 60), "", false},
+	}
+
+	for idx, c := range testCases {
+		name, err := RenderSnapshotName(c.template, c.dataset, at)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if c.valid && name != c.name {
+			t.Errorf("%d: expected snapshot name %s, got %s", idx, c.name, name)
+		}
+	}
+}
+
+func TestValidateSnapshotTemplate(t *testing.T) {
+	testCases := []struct {
+		template string
+		timed    bool
+		valid    bool
+	}{
+		{"zfsbackup-%Y-%m-%dT%H-%M", true, true},
+		{"%n-%s", true, true},
+		// Names that never change collide with the snapshot taken by the previous backup
+		{"static", false, true},
+		{"%n-%D", false, true},
+		{"backup-%Q", false, false},
+		{"backup/%Y", false, false},
+	}
+
+	for idx, c := range testCases {
+		timed, err := ValidateSnapshotTemplate(c.template, "tank/data")
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if timed != c.timed {
+			t.Errorf("%d: expected the template to depend on the time to be %v, got %v", idx, c.timed, timed)
+		}
+	}
+}
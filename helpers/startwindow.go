@@ -0,0 +1,83 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrStartWindowMissed is returned when a backup was started outside of its allowed start window.
+var ErrStartWindowMissed = errors.New("the backup was not started within its allowed start window")
+
+// StartWindow is the time of day, in the local time zone, a backup is allowed to start in. The window
+// spans midnight when it ends before it begins, e.g. 22:00-06:00.
+type StartWindow struct {
+	Begin time.Duration
+	End   time.Duration
+}
+
+// ParseStartWindow will parse a start window in the HH:MM-HH:MM format.
+func ParseStartWindow(window string) (*StartWindow, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid start window %q, expected the HH:MM-HH:MM format", window)
+	}
+
+	var bounds [2]time.Duration
+	for idx, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid start window %q, expected the HH:MM-HH:MM format", window)
+		}
+		bounds[idx] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if bounds[0] == bounds[1] {
+		return nil, fmt.Errorf("invalid start window %q, it must not begin and end at the same time", window)
+	}
+
+	return &StartWindow{Begin: bounds[0], End: bounds[1]}, nil
+}
+
+// Contains returns true if the time of day of t is within the window. The window includes the minute
+// it begins at but not the one it ends at.
+func (w *StartWindow) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	if w.Begin < w.End {
+		return offset >= w.Begin && offset < w.End
+	}
+	return offset >= w.Begin || offset < w.End
+}
+
+func (w *StartWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(w.Begin.Hours()), int(w.Begin.Minutes())%60, int(w.End.Hours()), int(w.End.Minutes())%60)
+}
+
+// CheckStartWindow will return ErrStartWindowMissed if the job has a start window that does not contain
+// the provided start time.
+func (j *JobInfo) CheckStartWindow(start time.Time) error {
+	if j.StartWindow == nil || j.StartWindow.Contains(start) {
+		return nil
+	}
+	return ErrStartWindowMissed
+}
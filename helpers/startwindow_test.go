@@ -0,0 +1,94 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStartWindow(t *testing.T) {
+	testCases := []struct {
+		window   string
+		expected string
+		valid    bool
+	}{
+		{"22:00-06:00", "22:00-06:00", true},
+		{"01:30-4:05", "01:30-04:05", true},
+		{" 09:00 - 17:00 ", "09:00-17:00", true},
+		{"22:00", "", false},
+		{"22:00-06:00-07:00", "", false},
+		{"25:00-06:00", "", false},
+		{"22:00-6pm", "", false},
+		{"06:00-06:00", "", false},
+		{"", "", false},
+	}
+
+	for idx, c := range testCases {
+		window, err := ParseStartWindow(c.window)
+		if c.valid && err != nil {
+			t.Errorf("%d: unexpected error parsing %q - %v", idx, c.window, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%d: expected an error parsing %q", idx, c.window)
+		} else if c.valid && window.String() != c.expected {
+			t.Errorf("%d: expected %s, got %s", idx, c.expected, window)
+		}
+	}
+}
+
+func TestCheckStartWindow(t *testing.T) {
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2024, 3, 9, hour, minute, second, 0, time.Local)
+	}
+
+	testCases := []struct {
+		window string
+		start  time.Time
+		err    error
+	}{
+		{"", at(12, 0, 0), nil},
+		{"09:00-17:00", at(9, 0, 0), nil},
+		{"09:00-17:00", at(12, 30, 0), nil},
+		{"09:00-17:00", at(16, 59, 59), nil},
+		{"09:00-17:00", at(17, 0, 0), ErrStartWindowMissed},
+		{"09:00-17:00", at(8, 59, 59), ErrStartWindowMissed},
+		{"22:00-06:00", at(23, 15, 0), nil},
+		{"22:00-06:00", at(0, 0, 0), nil},
+		{"22:00-06:00", at(5, 59, 0), nil},
+		{"22:00-06:00", at(6, 0, 0), ErrStartWindowMissed},
+		{"22:00-06:00", at(12, 0, 0), ErrStartWindowMissed},
+		{"22:00-06:00", at(21, 59, 59), ErrStartWindowMissed},
+	}
+
+	for idx, c := range testCases {
+		j := JobInfo{}
+		if c.window != "" {
+			window, err := ParseStartWindow(c.window)
+			if err != nil {
+				t.Fatalf("%d: could not parse %q - %v", idx, c.window, err)
+			}
+			j.StartWindow = window
+		}
+		if err := j.CheckStartWindow(c.start); err != c.err {
+			t.Errorf("%d: expected error %v for a start at %s, got %v", idx, c.err, c.start.Format("15:04:05"), err)
+		}
+	}
+}
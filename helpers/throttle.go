@@ -0,0 +1,108 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"io"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/juju/ratelimit"
+)
+
+var (
+	// BackupUploadThrottle limits the rate volumes are read at by uploads if we need one.
+	BackupUploadThrottle *Throttle
+	// BackupDownloadThrottle limits the rate objects are read at by downloads if we need one.
+	BackupDownloadThrottle *Throttle
+
+	throttleMutex sync.Mutex
+)
+
+// Throttle limits the rate bytes are read from, or written to, the readers and writers it wraps to a number of bytes
+// per second shared between all of them. It is a token bucket holding up to a second worth of bytes, so bursts of up to
+// a second worth of bytes are let through at once. A nil Throttle does not limit anything.
+type Throttle struct {
+	bytesPerSecond uint64
+	bucket         *ratelimit.Bucket
+}
+
+// NewThrottle will return a Throttle allowing the provided number of bytes per second, or nil if it is 0 (unlimited).
+func NewThrottle(bytesPerSecond uint64) *Throttle {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &Throttle{
+		bytesPerSecond: bytesPerSecond,
+		bucket:         ratelimit.NewBucketWithRate(float64(bytesPerSecond), int64(bytesPerSecond)),
+	}
+}
+
+// BytesPerSecond will return the number of bytes per second allowed by the Throttle, 0 if it is unlimited.
+func (t *Throttle) BytesPerSecond() uint64 {
+	if t == nil {
+		return 0
+	}
+	return t.bytesPerSecond
+}
+
+// Reader will return a reader that reads from the provided reader no faster than the Throttle allows.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return ratelimit.Reader(r, t.bucket)
+}
+
+// Writer will return a writer that writes to the provided writer no faster than the Throttle allows.
+func (t *Throttle) Writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return ratelimit.Writer(w, t.bucket)
+}
+
+// ThrottleUploads will limit the rate of all uploads, between them, to the provided number of bytes per second, see
+// BackupUploadThrottle. The current throttle is kept if it already allows that rate so it stays shared. Use 0 for no limit.
+func ThrottleUploads(bytesPerSecond uint64) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+	if BackupUploadThrottle.BytesPerSecond() == bytesPerSecond {
+		return
+	}
+	BackupUploadThrottle = NewThrottle(bytesPerSecond)
+	if bytesPerSecond != 0 {
+		AppLogger.Infof("Limiting the upload speed to %s/s.", humanize.Bytes(bytesPerSecond))
+	}
+}
+
+// ThrottleDownloads is like ThrottleUploads but will limit the rate of all downloads, see BackupDownloadThrottle.
+func ThrottleDownloads(bytesPerSecond uint64) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+	if BackupDownloadThrottle.BytesPerSecond() == bytesPerSecond {
+		return
+	}
+	BackupDownloadThrottle = NewThrottle(bytesPerSecond)
+	if bytesPerSecond != 0 {
+		AppLogger.Infof("Limiting the download speed to %s/s.", humanize.Bytes(bytesPerSecond))
+	}
+}
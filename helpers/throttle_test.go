@@ -0,0 +1,115 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	const rate = 100 * 1000
+
+	testCases := []struct {
+		bytesPerSecond uint64
+		size           int64
+		copies         int
+		writer         bool
+		minDuration    time.Duration
+	}{
+		// The bucket starts with a second worth of bytes, the rest is limited to the rate
+		{rate, 250 * 1000, 1, false, 1500 * time.Millisecond},
+		{rate, 250 * 1000, 1, true, 1500 * time.Millisecond},
+		// Concurrent copies share the rate
+		{rate, 125 * 1000, 2, false, 1500 * time.Millisecond},
+		// Unlimited
+		{0, 10 * 1024 * 1024, 1, false, 0},
+	}
+
+	for idx, c := range testCases {
+		throttle := NewThrottle(c.bytesPerSecond)
+		if (throttle == nil) != (c.bytesPerSecond == 0) || throttle.BytesPerSecond() != c.bytesPerSecond {
+			t.Errorf("%d: expected a throttle of %d bytes per second, got %v", idx, c.bytesPerSecond, throttle)
+			continue
+		}
+
+		var wg sync.WaitGroup
+		copied := make([]int64, c.copies)
+		start := time.Now()
+		for i := 0; i < c.copies; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				src := io.Reader(bytes.NewReader(make([]byte, c.size)))
+				dst := io.Writer(ioutil.Discard)
+				if c.writer {
+					dst = throttle.Writer(dst)
+				} else {
+					src = throttle.Reader(src)
+				}
+				copied[i], _ = io.Copy(dst, src)
+			}(i)
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+
+		for i, n := range copied {
+			if n != c.size {
+				t.Errorf("%d: expected copy %d to copy %d bytes, got %d", idx, i, c.size, n)
+			}
+		}
+		if elapsed < c.minDuration {
+			t.Errorf("%d: expected the throttled copy to take at least %v, took %v", idx, c.minDuration, elapsed)
+		}
+		if c.bytesPerSecond == 0 && elapsed > time.Second {
+			t.Errorf("%d: expected the unthrottled copy to complete quickly, took %v", idx, elapsed)
+		}
+	}
+}
+
+func TestThrottleUploads(t *testing.T) {
+	defer ThrottleUploads(0)
+	defer ThrottleDownloads(0)
+
+	ThrottleUploads(1000)
+	shared := BackupUploadThrottle
+	ThrottleUploads(1000)
+	if BackupUploadThrottle != shared || shared.BytesPerSecond() != 1000 {
+		t.Errorf("expected the upload throttle to be kept for the same rate")
+	}
+	ThrottleUploads(2000)
+	if BackupUploadThrottle == shared || BackupUploadThrottle.BytesPerSecond() != 2000 {
+		t.Errorf("expected a new upload throttle for a different rate")
+	}
+	ThrottleUploads(0)
+	if BackupUploadThrottle != nil {
+		t.Errorf("expected no upload throttle without a rate")
+	}
+
+	ThrottleDownloads(1000)
+	if BackupDownloadThrottle.BytesPerSecond() != 1000 || BackupUploadThrottle != nil {
+		t.Errorf("expected only downloads to be throttled")
+	}
+}
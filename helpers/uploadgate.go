@@ -0,0 +1,131 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// BackupUploadGate can pause the bytes fed into uploads if we need one.
+var BackupUploadGate *UploadGate
+
+const (
+	// PauseSignal (SIGUSR1) pauses the uploads of an in-progress backup.
+	PauseSignal = syscall.SIGUSR1
+	// ResumeSignal (SIGUSR2) resumes the uploads of an in-progress backup.
+	ResumeSignal = syscall.SIGUSR2
+)
+
+// UploadGate can pause and resume the bytes read from volumes being uploaded. Reads made
+// while it is paused block until it is resumed, so in-flight uploads are held open instead
+// of being aborted.
+type UploadGate struct {
+	mutex  sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+// NewUploadGate will return an open UploadGate.
+func NewUploadGate() *UploadGate {
+	return &UploadGate{}
+}
+
+// Pause will close the gate, returning false if it was already paused.
+func (g *UploadGate) Pause() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.resume = make(chan struct{})
+	return true
+}
+
+// Resume will open the gate and release any blocked reads, returning false if it was not paused.
+func (g *UploadGate) Resume() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resume)
+	return true
+}
+
+// Paused will return true if the gate is currently paused.
+func (g *UploadGate) Paused() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.paused
+}
+
+// Wait will block until the gate is open.
+func (g *UploadGate) Wait() {
+	g.mutex.Lock()
+	if !g.paused {
+		g.mutex.Unlock()
+		return
+	}
+	resume := g.resume
+	g.mutex.Unlock()
+	<-resume
+}
+
+// Reader will return a reader that waits for the gate to be open before each read.
+func (g *UploadGate) Reader(r io.Reader) io.Reader {
+	return &gatedReader{gate: g, r: r}
+}
+
+// Watch will pause and resume the gate as the PauseSignal and ResumeSignal are received on
+// the provided channel, logging each transition, until it is closed.
+func (g *UploadGate) Watch(signals <-chan os.Signal) {
+	for sig := range signals {
+		switch sig {
+		case PauseSignal:
+			if g.Pause() {
+				AppLogger.Noticef("Received SIGUSR1, pausing uploads. In-flight uploads are held open, send SIGUSR2 to resume.")
+			} else {
+				AppLogger.Infof("Received SIGUSR1 but uploads are already paused.")
+			}
+		case ResumeSignal:
+			if g.Resume() {
+				AppLogger.Noticef("Received SIGUSR2, resuming uploads.")
+			} else {
+				AppLogger.Infof("Received SIGUSR2 but uploads are not paused.")
+			}
+		}
+	}
+}
+
+type gatedReader struct {
+	gate *UploadGate
+	r    io.Reader
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	g.gate.Wait()
+	return g.r.Read(p)
+}
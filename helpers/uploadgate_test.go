@@ -0,0 +1,128 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUploadGateTransitions(t *testing.T) {
+	g := NewUploadGate()
+
+	testCases := []struct {
+		action     func() bool
+		transition bool
+		paused     bool
+	}{
+		{g.Resume, false, false},
+		{g.Pause, true, true},
+		{g.Pause, false, true},
+		{g.Resume, true, false},
+		{g.Resume, false, false},
+		{g.Pause, true, true},
+	}
+
+	for idx, c := range testCases {
+		if transition := c.action(); transition != c.transition {
+			t.Errorf("%d: expected transition to be %v, got %v", idx, c.transition, transition)
+		}
+		if g.Paused() != c.paused {
+			t.Errorf("%d: expected paused to be %v, got %v", idx, c.paused, g.Paused())
+		}
+	}
+}
+
+func TestUploadGateReader(t *testing.T) {
+	g := NewUploadGate()
+	payload := []byte("zfs send stream")
+
+	// An open gate should not block reads
+	data, err := ioutil.ReadAll(g.Reader(bytes.NewReader(payload)))
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("expected to read the payload through an open gate, got %q - %v", data, err)
+	}
+
+	// Reads should block while paused and be released once resumed
+	g.Pause()
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(g.Reader(bytes.NewReader(payload)))
+		done <- data
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected the read to block while the gate is paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	g.Resume()
+	select {
+	case data = <-done:
+		if !bytes.Equal(data, payload) {
+			t.Errorf("expected to read the payload once resumed, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the read to complete once the gate was resumed")
+	}
+}
+
+func TestUploadGateWatch(t *testing.T) {
+	g := NewUploadGate()
+	signals := make(chan os.Signal)
+	stopped := make(chan bool)
+	go func() {
+		g.Watch(signals)
+		close(stopped)
+	}()
+
+	testCases := []struct {
+		signal os.Signal
+		paused bool
+	}{
+		{PauseSignal, true},
+		{PauseSignal, true},
+		{os.Interrupt, true},
+		{ResumeSignal, false},
+		{ResumeSignal, false},
+		{PauseSignal, true},
+	}
+
+	for idx, c := range testCases {
+		signals <- c.signal
+		// Sending the next signal ensures the previous one was handled
+		signals <- nil
+		if g.Paused() != c.paused {
+			t.Errorf("%d: expected paused to be %v after %v, got %v", idx, c.paused, c.signal, g.Paused())
+		}
+	}
+
+	close(signals)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Watch to return once the signals channel is closed")
+	}
+}
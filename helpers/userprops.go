@@ -0,0 +1,129 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// IsUserProperty will check whether the provided property name is a user property, named module:property.
+func IsUserProperty(name string) bool {
+	return strings.Contains(name, ":")
+}
+
+// inNamespaces will check whether the provided user property belongs to one of the provided namespaces, the module
+// part of its name. Every user property belongs to an empty list of namespaces.
+func inNamespaces(name string, namespaces []string) bool {
+	if len(namespaces) == 0 {
+		return true
+	}
+	namespace := strings.SplitN(name, ":", 2)[0]
+	for _, n := range namespaces {
+		if n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseUserProperties will parse the output of "zfs get -H -o property,value", keeping only the user properties
+// belonging to the provided namespaces, or all of them if none are provided.
+func ParseUserProperties(output []byte, namespaces []string) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 || !IsUserProperty(parts[0]) || !inNamespaces(parts[0], namespaces) {
+			continue
+		}
+		props[parts[0]] = parts[1]
+	}
+	return props
+}
+
+// GetUserProperties will return the user properties set on the provided dataset, either locally or received,
+// belonging to the provided namespaces, or all of them if none are provided.
+func GetUserProperties(ctx context.Context, dataset string, namespaces []string) (map[string]string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, ZFSPath, "get", "-H", "-p", "-o", "property,value", "-s", "local,received", "all", dataset)
+	AppLogger.Debugf("Getting ZFS user properties with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return ParseUserProperties(b.Bytes(), namespaces), nil
+}
+
+// SetUserProperties will set the provided user properties on the provided dataset, in order of their names.
+func SetUserProperties(ctx context.Context, dataset string, props map[string]string) error {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := runZFSCommand(ctx, "set", name+"="+props[name], dataset); err != nil {
+			return fmt.Errorf("could not set the user property %s on %s - %v", name, dataset, err)
+		}
+	}
+	return nil
+}
+
+// UserPropertiesToApply will return the user properties of the provided manifest to set on the received dataset,
+// those belonging to the namespaces of this JobInfo object, or all of them if none were provided. Properties
+// overridden on the receive are left as set by the override.
+func (j *JobInfo) UserPropertiesToApply(manifest *JobInfo) map[string]string {
+	overridden := make(map[string]bool, len(j.PropertyOverrides))
+	for _, override := range j.PropertyOverrides {
+		overridden[strings.SplitN(override, "=", 2)[0]] = true
+	}
+
+	props := make(map[string]string, len(manifest.UserProperties))
+	for name, value := range manifest.UserProperties {
+		if inNamespaces(name, j.UserPropertyNamespaces) && !overridden[name] {
+			props[name] = value
+		}
+	}
+	return props
+}
+
+// ValidateUserPropertyNamespaces will check that each user property namespace of this JobInfo object is a valid
+// module name, the part of a user property's name before the colon.
+func (j *JobInfo) ValidateUserPropertyNamespaces() error {
+	for _, namespace := range j.UserPropertyNamespaces {
+		if namespace == "" {
+			return fmt.Errorf("the user property namespace cannot be empty")
+		}
+		for _, c := range namespace {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-.", c)) {
+				return fmt.Errorf("the user property namespace %s has characters not allowed by zfs, it should not include the colon", namespace)
+			}
+		}
+	}
+	return nil
+}
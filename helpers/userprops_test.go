@@ -0,0 +1,155 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUserProperties(t *testing.T) {
+	output := []byte("com.example:owner\tdb-team\ncompression\tlz4\ncom.example:note\twith\ttabs\nbackup:tier\tgold\n\n")
+
+	testCases := []struct {
+		namespaces []string
+		props      map[string]string
+	}{
+		{nil, map[string]string{"com.example:owner": "db-team", "com.example:note": "with\ttabs", "backup:tier": "gold"}},
+		{[]string{"com.example"}, map[string]string{"com.example:owner": "db-team", "com.example:note": "with\ttabs"}},
+		{[]string{"backup", "other"}, map[string]string{"backup:tier": "gold"}},
+		{[]string{"other"}, map[string]string{}},
+	}
+
+	for idx, c := range testCases {
+		if props := ParseUserProperties(output, c.namespaces); !reflect.DeepEqual(props, c.props) {
+			t.Errorf("%d: expected user properties %v, got %v", idx, c.props, props)
+		}
+	}
+}
+
+func TestValidateUserPropertyNamespaces(t *testing.T) {
+	testCases := []struct {
+		namespaces []string
+		valid      bool
+	}{
+		{nil, true},
+		{[]string{"com.example", "backup_tool-2"}, true},
+		{[]string{""}, false},
+		{[]string{"com.example:owner"}, false},
+		{[]string{"with space"}, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{UserPropertyNamespaces: c.namespaces}
+		if err := j.ValidateUserPropertyNamespaces(); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+	}
+}
+
+func TestUserPropertiesToApply(t *testing.T) {
+	manifest := &JobInfo{UserProperties: map[string]string{"com.example:owner": "db-team", "backup:tier": "gold"}}
+
+	testCases := []struct {
+		namespaces []string
+		overrides  []string
+		props      map[string]string
+	}{
+		{nil, nil, map[string]string{"com.example:owner": "db-team", "backup:tier": "gold"}},
+		{[]string{"backup"}, nil, map[string]string{"backup:tier": "gold"}},
+		// Overrides set on the receive win over the recorded user properties
+		{nil, []string{"backup:tier=silver", "readonly=on"}, map[string]string{"com.example:owner": "db-team"}},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{UserPropertyNamespaces: c.namespaces, PropertyOverrides: c.overrides}
+		if props := j.UserPropertiesToApply(manifest); !reflect.DeepEqual(props, c.props) {
+			t.Errorf("%d: expected user properties %v, got %v", idx, c.props, props)
+		}
+	}
+}
+
+func TestUserPropertiesRoundTrip(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupuserprops")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to report the user properties of a dataset and record those set on it
+	setPath := filepath.Join(workingDir, "set")
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in
+	get) printf 'com.example:owner\tdb-team\nbackup:tier\tgold\nother:flag\ton\n' ;;
+	set) case "$3" in restore/readonly) echo "cannot set property for '$3': permission denied" >&2; exit 1 ;; esac; echo "$2 $3" >> %s ;;
+esac
+`, setPath)
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	ZFSPath = zfsPath
+	defer func() { ZFSPath = "zfs" }()
+
+	props, err := GetUserProperties(context.Background(), "tank/db", []string{"com.example", "backup"})
+	if err != nil {
+		t.Fatalf("could not get user properties - %v", err)
+	}
+
+	// The user properties are recorded in the manifest
+	b, err := json.Marshal(&JobInfo{VolumeName: "tank/db", UserProperties: props})
+	if err != nil {
+		t.Fatalf("could not marshal manifest - %v", err)
+	}
+	manifest := new(JobInfo)
+	if err = json.Unmarshal(b, manifest); err != nil {
+		t.Fatalf("could not unmarshal manifest - %v", err)
+	}
+	if !reflect.DeepEqual(manifest.UserProperties, props) {
+		t.Errorf("expected the user properties %v to be recorded in the manifest, got %v", props, manifest.UserProperties)
+	}
+	if b, _ = json.Marshal(&JobInfo{}); strings.Contains(string(b), "UserProperties") {
+		t.Errorf("expected a manifest without user properties to not record them, got %s", b)
+	}
+
+	// And reapplied in order of their names
+	if err = SetUserProperties(context.Background(), "restore/db", manifest.UserProperties); err != nil {
+		t.Fatalf("could not set user properties - %v", err)
+	}
+	set, err := ioutil.ReadFile(setPath)
+	if err != nil {
+		t.Fatalf("could not read the user properties set - %v", err)
+	}
+	if expected := "backup:tier=gold restore/db\ncom.example:owner=db-team restore/db\n"; string(set) != expected {
+		t.Errorf("expected the user properties set to be %q, got %q", expected, set)
+	}
+
+	if err = SetUserProperties(context.Background(), "restore/readonly", manifest.UserProperties); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the failure to set a user property to be returned, got %v", err)
+	}
+}
@@ -24,12 +24,81 @@ import "fmt"
 
 const (
 	// VersionNumber represents the current version of zfsbackup
-	VersionNumber = .3
+	VersionNumber = .5
 	// ProgramName is the name for zfsbackup
 	ProgramName = "zfsbackup"
+
+	// Versions of zfsbackup that first supported restoring backups using a feature
+	baseReaderVersion          = .3
+	compressionReaderVersion   = .4 // builtin zstd and per volume (adaptive) compression
+	singleObjectReaderVersion  = .4
+	groupReaderVersion         = .4
+	seekableReaderVersion      = .5
+	manifestPartsReaderVersion = .5
+	externalReaderVersion      = .5 // command lines recorded for the external compressor
 )
 
 // Version will return the current version of zfsbackup
 func Version() string {
-	return fmt.Sprintf("%.2g", VersionNumber)
+	return formatVersion(VersionNumber)
+}
+
+func formatVersion(version float64) string {
+	return fmt.Sprintf("%.2g", version)
+}
+
+// RequiredReaderVersion will compute the oldest version of zfsbackup that can restore the backup
+// described by this JobInfo object, based on the features it actually uses.
+func (j *JobInfo) RequiredReaderVersion() float64 {
+	version := baseReaderVersion
+	require := func(v float64) {
+		if v > version {
+			version = v
+		}
+	}
+
+	if j.Compressor == ZstdCompressor || j.Compressor == AdaptiveCompressor {
+		require(compressionReaderVersion)
+	}
+	if j.Compressor == SeekableZstdCompressor {
+		require(seekableReaderVersion)
+	}
+	if j.Compressor == ExternalCompressor {
+		require(externalReaderVersion)
+	}
+	for _, vol := range j.Volumes {
+		switch vol.Compressor {
+		case "":
+		case SeekableZstdCompressor:
+			require(seekableReaderVersion)
+		default:
+			require(compressionReaderVersion)
+		}
+	}
+
+	if j.SingleObject {
+		require(singleObjectReaderVersion)
+	}
+
+	if len(j.ManifestParts) > 0 {
+		require(manifestPartsReaderVersion)
+	}
+
+	if len(j.GroupMembers) > 0 {
+		require(groupReaderVersion)
+	}
+	for _, member := range j.GroupMembers {
+		require(member.RequiredReaderVersion())
+	}
+
+	return version
+}
+
+// CheckReaderVersion will return an error if the backup described by this JobInfo object requires a
+// newer version of zfsbackup to be restored than the one running.
+func (j *JobInfo) CheckReaderVersion() error {
+	if j.MinReaderVersion > VersionNumber {
+		return fmt.Errorf("the backup set %s@%s was created by %s v%s and requires v%s or newer to be restored, this is v%s", j.VolumeName, j.BaseSnapshot.Name, ProgramName, formatVersion(j.Version), formatVersion(j.MinReaderVersion), Version())
+	}
+	return nil
 }
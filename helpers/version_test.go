@@ -0,0 +1,71 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"testing"
+)
+
+func TestRequiredReaderVersion(t *testing.T) {
+	testCases := []struct {
+		j       *JobInfo
+		version float64
+	}{
+		{&JobInfo{Compressor: InternalCompressor}, .3},
+		{&JobInfo{Compressor: "xz", Volumes: []*VolumeInfo{{}}}, .3},
+		{&JobInfo{Compressor: ZstdCompressor}, .4},
+		{&JobInfo{Compressor: AdaptiveCompressor}, .4},
+		{&JobInfo{Compressor: InternalCompressor, Volumes: []*VolumeInfo{{}, {Compressor: NoCompressor}}}, .4},
+		{&JobInfo{Compressor: InternalCompressor, SingleObject: true}, .4},
+		{&JobInfo{GroupMembers: []*JobInfo{{Compressor: InternalCompressor}}}, .4},
+		{&JobInfo{Compressor: SeekableZstdCompressor}, .5},
+		{&JobInfo{Compressor: ExternalCompressor, CompressCommand: "zstd --long=27"}, .5},
+		{&JobInfo{Compressor: InternalCompressor, ManifestParts: []string{"manifest.part1"}}, .5},
+		{&JobInfo{Compressor: AdaptiveCompressor, Volumes: []*VolumeInfo{{Compressor: ZstdCompressor}, {Compressor: SeekableZstdCompressor}}}, .5},
+	}
+
+	for idx, c := range testCases {
+		if version := c.j.RequiredReaderVersion(); version != c.version {
+			t.Errorf("%d: expected a required reader version of %v, got %v", idx, c.version, version)
+		}
+	}
+}
+
+func TestCheckReaderVersion(t *testing.T) {
+	testCases := []struct {
+		minReaderVersion float64
+		valid            bool
+	}{
+		// Manifests written before the floor was recorded
+		{0, true},
+		{.3, true},
+		{VersionNumber, true},
+		{VersionNumber + .1, false},
+		{1, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap"}, Version: VersionNumber, MinReaderVersion: c.minReaderVersion}
+		if err := j.CheckReaderVersion(); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+	}
+}
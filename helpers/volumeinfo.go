@@ -33,12 +33,13 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/juju/ratelimit"
+	"github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/miolini/datacounter"
 	"golang.org/x/crypto/openpgp"
@@ -47,8 +48,6 @@ import (
 
 var (
 	printCompressCMD sync.Once
-	// BackupUploadBucket is the bandwidth rate-limit bucket if we need one.
-	BackupUploadBucket *ratelimit.Bucket
 	// BackupTempdir is the scratch space for our output
 	BackupTempdir string
 	// WorkingDir is the directory that all the cache/scratch work is done for this program
@@ -70,16 +69,23 @@ type VolumeInfo struct {
 	MD5             hash.Hash   `json:"-"`
 	CRC32C          hash.Hash32 `json:"-"`
 	SHA1            hash.Hash   `json:"-"`
+	Hash            hash.Hash   `json:"-"`
 	SHA1Sum         string      `json:"-"`
 	SHA256Sum       string
 	MD5Sum          string
 	CRC32CSum32     uint32
+	HashSum         string `json:",omitempty"`
 	Size            uint64
 	ZFSStreamBytes  uint64
+	Compressor      string   `json:",omitempty"`
+	SharedObject    bool     `json:",omitempty"`
+	Placement       []string `json:",omitempty"` // The destinations this volume was uploaded to when uploading with a quorum
 	CreateTime      time.Time
 	CloseTime       time.Time
 	IsManifest      bool
 	IsFinalManifest bool
+	// The compression level the volume was compressed with, it may differ between volumes when adapted to the upload throughput
+	CompressionLevel int `json:",omitempty"`
 
 	filename string
 	w        io.Writer
@@ -94,14 +100,20 @@ type VolumeInfo struct {
 	rw  io.ReadCloser
 	cmd *exec.Cmd
 	// PGP objects
-	pgpw io.WriteCloser
-	pgpr *openpgp.MessageDetails
+	pgpw           io.WriteCloser
+	pgpr           *openpgp.MessageDetails
+	trustedSigners []string
 	// Detail Objects
 	counter   *datacounter.WriterCounter
 	usingPipe bool
 	isClosed  bool
 	isOpened  bool
 	lock      sync.Mutex
+
+	// The name of the registered hash algorithm the HashSum is computed with
+	hashAlgorithm string
+	// The number of bytes already written to a resumed volume before it was opened, see ResumeSimpleVolumeWithHash
+	resumedBytes uint64
 }
 
 // ByVolumeNumber is used to sort a VolumeInfo slice by VolumeNumber.
@@ -131,11 +143,29 @@ func (v *VolumeInfo) Read(p []byte) (int, error) {
 			if v.pgpr.SignedBy == nil {
 				return i, fmt.Errorf("did not have ths key signature to verify the message with")
 			}
+			if !isTrustedSigner(v.trustedSigners, v.pgpr.SignedBy) {
+				return i, ErrUntrustedSigner
+			}
+		} else if len(v.trustedSigners) > 0 {
+			return i, ErrNotSigned
 		}
 	}
 	return i, err
 }
 
+// Checksum will return the checksum of the volume computed with the hash algorithm registered under the provided name.
+// The md5 and sha256 checksums are recorded for every volume, as are those of backup sets without a hash algorithm.
+func (v *VolumeInfo) Checksum(hashAlgorithm string) string {
+	switch hashAlgorithm {
+	case "", SHA256Hash:
+		return v.SHA256Sum
+	case MD5Hash:
+		return v.MD5Sum
+	default:
+		return v.HashSum
+	}
+}
+
 // IsUsingPipe will return true when the volume is a glorified pipe
 func (v *VolumeInfo) IsUsingPipe() bool {
 	return v.usingPipe
@@ -149,11 +179,14 @@ func (v *VolumeInfo) Seek(offset int64, whence int) (int64, error) {
 	return v.fw.Seek(offset, whence)
 }
 
-// ReadAt will passthru the command to the underlying *os.File
+// ReadAt will passthru the command to the underlying *os.File, waiting while uploads are paused
 func (v *VolumeInfo) ReadAt(p []byte, off int64) (int, error) {
 	if v.usingPipe {
 		return 0, fmt.Errorf("cannot ReadAt on a piped reader")
 	}
+	if BackupUploadGate != nil {
+		BackupUploadGate.Wait()
+	}
 	return v.fw.ReadAt(p, off)
 }
 
@@ -171,13 +204,68 @@ func (v *VolumeInfo) OpenVolume() error {
 		return err
 	}
 	v.fw = f
-	v.r = f
 	v.isClosed = false
 	v.isOpened = true
-	if BackupUploadBucket != nil {
-		v.r = ratelimit.Reader(v.r, BackupUploadBucket)
+	v.limitReader()
+
+	return nil
+}
+
+// limitReader will read this volume from its file, rate limited and paused along with the other uploads.
+func (v *VolumeInfo) limitReader() {
+	v.r = v.fw
+	v.r = BackupUploadThrottle.Reader(v.r)
+	if BackupUploadGate != nil {
+		v.r = BackupUploadGate.Reader(v.r)
+	}
+}
+
+// Replica will return a copy of this volume with its own handle on the volume's file so it can be uploaded
+// alongside this volume, e.g. to several destinations at once. The handle remains valid once the volume is
+// deleted. Call Rewind before each upload attempt and Close once done with the replica.
+func (v *VolumeInfo) Replica() (*VolumeInfo, error) {
+	if v.usingPipe {
+		return nil, fmt.Errorf("cannot replicate the piped volume %s", v.ObjectName)
+	}
+	f, err := os.Open(v.filename)
+	if err != nil {
+		return nil, err
 	}
 
+	return &VolumeInfo{
+		ObjectName:       v.ObjectName,
+		VolumeNumber:     v.VolumeNumber,
+		SHA1Sum:          v.SHA1Sum,
+		SHA256Sum:        v.SHA256Sum,
+		MD5Sum:           v.MD5Sum,
+		CRC32CSum32:      v.CRC32CSum32,
+		HashSum:          v.HashSum,
+		Size:             v.Size,
+		ZFSStreamBytes:   v.ZFSStreamBytes,
+		Compressor:       v.Compressor,
+		CompressionLevel: v.CompressionLevel,
+		SharedObject:     v.SharedObject,
+		CreateTime:       v.CreateTime,
+		CloseTime:        v.CloseTime,
+		IsManifest:       v.IsManifest,
+		IsFinalManifest:  v.IsFinalManifest,
+		filename:         v.filename,
+		fw:               f,
+		hashAlgorithm:    v.hashAlgorithm,
+	}, nil
+}
+
+// Rewind will seek back to the start of a replica's file so it can be read again.
+func (v *VolumeInfo) Rewind() error {
+	if v.fw == nil {
+		return fmt.Errorf("the volume %s is not a replica", v.ObjectName)
+	}
+	if _, err := v.fw.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	v.isOpened = true
+	v.limitReader()
+
 	return nil
 }
 
@@ -212,11 +300,19 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 			return perr
 		}
 		v.pgpr = pgpReader
+		v.trustedSigners = j.TrustedSigners
 		v.r = pgpReader.UnverifiedBody
 	}
 
 	var err error
 	compressor := j.Compressor
+	if v.Compressor != "" {
+		compressor = v.Compressor
+	}
+	if compressor == "" {
+		// Backup sets that only record the algorithm are decompressed with the builtin decompressor for it
+		compressor = algorithmCompressor(j.CompressionAlgorithm)
+	}
 	if isManifest {
 		compressor = InternalCompressor
 	}
@@ -228,9 +324,42 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 			return err
 		}
 		v.r = v.rw
-	case "":
+	case ZstdCompressor, SeekableZstdCompressor:
+		decoder, derr := zstd.NewReader(v.r)
+		if derr != nil {
+			return derr
+		}
+		v.rw = decoder.IOReadCloser()
+		v.r = v.rw
+	case AutoDetectCompressor:
+		// Only the first volume of an uncompressed stream starts with its DRR_BEGIN record, the volumes of a backup set
+		// are extracted in order so the format detected from the first one is used for the others
+		if j.detectedFormat == "" {
+			if j.detectedFormat, v.r, err = SniffCompressionFormat(v.r); err != nil {
+				return fmt.Errorf("could not determine how to decompress volume %s - %v", v.ObjectName, err)
+			}
+			AppLogger.Debugf("Detected %s format for backup set %s@%s with no recorded compressor.", j.detectedFormat, j.VolumeName, j.BaseSnapshot.Name)
+		}
+		v.rw, err = newFormatDecompressor(v.r, j.detectedFormat)
+		if err != nil {
+			return fmt.Errorf("could not decompress volume %s as %s - %v", v.ObjectName, j.detectedFormat, err)
+		}
+		v.r = v.rw
+	case AdaptiveCompressor:
+		v.rw, err = newSniffedDecompressor(v.r)
+		if err != nil {
+			return fmt.Errorf("could not determine how to decompress volume %s - %v", v.ObjectName, err)
+		}
+		v.r = v.rw
+	case "", NoCompressor:
 	default:
-		v.cmd = exec.CommandContext(ctx, compressor, "-c", "-d")
+		args := []string{compressor, "-c", "-d"}
+		if compressor == ExternalCompressor {
+			if args = j.DecompressCommandLine(); len(args) == 0 {
+				return fmt.Errorf("no command was recorded to decompress volume %s with, please provide one", v.ObjectName)
+			}
+		}
+		v.cmd = exec.CommandContext(ctx, args[0], args[1:]...)
 		v.cmd.Stdin = v.r
 
 		decompressor, err := v.cmd.StdoutPipe()
@@ -241,7 +370,9 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 		v.r = v.rw
 		v.cmd.Stderr = os.Stderr
 
-		v.cmd.Start()
+		if err := v.cmd.Start(); err != nil {
+			return fmt.Errorf("could not start the decompressor %s for volume %s - %w", strings.Join(v.cmd.Args, " "), v.ObjectName, err)
+		}
 	}
 	return nil
 }
@@ -298,7 +429,7 @@ func (v *VolumeInfo) Close() error {
 		// If we used an external (de)compressor, wait for it to close as well
 		if v.cmd != nil {
 			if err := v.cmd.Wait(); err != nil {
-				return err
+				return fmt.Errorf("the external command %s failed - %w", strings.Join(v.cmd.Args, " "), err)
 			}
 			v.cmd = nil
 		}
@@ -350,7 +481,7 @@ func (v *VolumeInfo) Close() error {
 
 	// Record computed metrics and release resources
 	if v.counter != nil {
-		v.Size = v.counter.Count()
+		v.Size = v.resumedBytes + v.counter.Count()
 		v.counter = nil
 	}
 
@@ -374,6 +505,12 @@ func (v *VolumeInfo) Close() error {
 		v.SHA1 = nil
 	}
 
+	// The md5 and sha256 checksums are computed for every volume and recorded on their own, see Checksum
+	if v.Hash != nil {
+		v.HashSum = fmt.Sprintf("%x", v.Hash.Sum(nil))
+		v.Hash = nil
+	}
+
 	v.w = nil
 	if v.pr == nil {
 		v.r = nil
@@ -403,17 +540,14 @@ func (v *VolumeInfo) CopyTo(dest string) (err error) {
 
 // prepareVolume returns a VolumeInfo, filename parts, extension parts, and an error
 // compress -> encrypt/sign -> output
-func prepareVolume(ctx context.Context, j *JobInfo, pipe bool, isManifest bool) (*VolumeInfo, []string, []string, error) {
-	v, err := CreateSimpleVolume(ctx, pipe)
+func prepareVolume(ctx context.Context, j *JobInfo, pipe bool, compressorName string, level int) (*VolumeInfo, []string, []string, error) {
+	v, err := CreateSimpleVolume(ctx, pipe, j.HashAlgorithm)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	extensions := make([]string, 0, 2)
-
 	// Prepare the Encryption/Signing writer, if required
 	if j.EncryptKey != nil || j.SignKey != nil {
-		extensions = append(extensions, "pgp")
 		config := new(packet.Config)
 		config.DefaultCompressionAlgo = packet.CompressionNone // We will do our own, thank you very much!
 		config.DefaultCipher = packet.CipherAES256
@@ -427,26 +561,50 @@ func prepareVolume(ctx context.Context, j *JobInfo, pipe bool, isManifest bool)
 		v.w = pgpWriter
 	}
 
-	compressorName := j.Compressor
-	if isManifest {
-		compressorName = InternalCompressor
-	}
-
 	// Prepare the compression writer, if any
 	switch compressorName {
 	case InternalCompressor:
-		v.cw, _ = gzip.NewWriterLevel(v.w, j.CompressionLevel)
+		encoder, err := gzip.NewWriterLevel(v.w, level)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not create the gzip compressor - %v", err)
+		}
+		v.cw = encoder
 		v.w = v.cw
-		extensions = append([]string{"gz"}, extensions...)
 		printCompressCMD.Do(func() {
-			AppLogger.Infof("Will be using internal gzip compressor with compression level %d.", j.CompressionLevel)
+			AppLogger.Infof("Will be using internal gzip compressor with compression level %d.", level)
 		})
-	case "":
+	case ZstdCompressor:
+		encoder, err := zstd.NewWriter(v.w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		v.cw = encoder
+		v.w = v.cw
+		printCompressCMD.Do(func() {
+			AppLogger.Infof("Will be using internal zstd compressor with compression level %d.", level)
+		})
+	case SeekableZstdCompressor:
+		encoder, err := newSeekableZstdWriter(v.w, j.CompressionBlockSize, level, j.CompressionConcurrency)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		v.cw = encoder
+		v.w = v.cw
+		printCompressCMD.Do(func() {
+			AppLogger.Infof("Will be using internal seekable zstd compressor with compression level %d and %dKiB blocks, compressing up to %d at once.", level, j.CompressionBlockSize, encoder.concurrency)
+		})
+	case "", NoCompressor:
 		printCompressCMD.Do(func() { AppLogger.Infof("Will not be using any compression.") })
 	default:
-		extensions = append([]string{compressorName}, extensions...)
+		args := []string{compressorName, "-c", fmt.Sprintf("-%d", level)}
+		if compressorName == ExternalCompressor {
+			// The command line carries its own flags, including any compression level
+			if args = j.CompressCommandLine(); len(args) == 0 {
+				return nil, nil, nil, fmt.Errorf("no command was provided to compress volumes with")
+			}
+		}
 
-		v.cmd = exec.CommandContext(ctx, compressorName, "-c", fmt.Sprintf("-%d", j.CompressionLevel))
+		v.cmd = exec.CommandContext(ctx, args[0], args[1:]...)
 		v.cmd.Stdout = v.w
 
 		compressor, err := v.cmd.StdinPipe()
@@ -458,25 +616,36 @@ func prepareVolume(ctx context.Context, j *JobInfo, pipe bool, isManifest bool)
 		v.cmd.Stderr = os.Stderr
 
 		printCompressCMD.Do(func() {
-			AppLogger.Infof("Will be using the external binary %s for compression with compression level %d. The executing command will be: %s", j.Compressor, j.CompressionLevel, strings.Join(v.cmd.Args, " "))
+			if compressorName == ExternalCompressor {
+				AppLogger.Infof("Will be using the external command %s for compression.", strings.Join(v.cmd.Args, " "))
+				return
+			}
+			AppLogger.Infof("Will be using the external binary %s for compression with compression level %d. The executing command will be: %s", j.Compressor, level, strings.Join(v.cmd.Args, " "))
 		})
 
 		err = v.cmd.Start()
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, fmt.Errorf("could not start the compressor %s - %w", strings.Join(v.cmd.Args, " "), err)
 		}
 
-		// TODO: Signal properly if the process closes prematurely
+		// A compressor exiting prematurely fails the writes to its stdin, and Close with its exit status
 	}
 
-	nameParts := []string{j.VolumeName}
+	return v, j.objectNameParts(), j.volumeExtensions(compressorName), nil
+}
+
+// objectNameParts returns the normalized parts of the names of objects belonging to this backup set
+func (j *JobInfo) objectNameParts() []string {
+	var nameParts []string
 	if j.IncrementalSnapshot.Name != "" {
 		nameParts = append(nameParts, j.IncrementalSnapshot.Name, "to", j.BaseSnapshot.Name)
 	} else {
 		nameParts = append(nameParts, j.BaseSnapshot.Name)
 	}
-
-	return v, nameParts, extensions, nil
+	for idx := range nameParts {
+		nameParts[idx] = j.normalizeKeyPart(nameParts[idx])
+	}
+	return append([]string{j.datasetKeyPart()}, nameParts...)
 }
 
 // CreateManifestVolume will call CreateSimpleVolume and add options to compress,
@@ -487,7 +656,7 @@ func CreateManifestVolume(ctx context.Context, j *JobInfo) (*VolumeInfo, error)
 	extensions := []string{"manifest"}
 	nameParts := []string{j.ManifestPrefix}
 
-	v, baseParts, ext, err := prepareVolume(ctx, j, false, true)
+	v, baseParts, ext, err := prepareVolume(ctx, j, false, InternalCompressor, manifestCompressionLevel(j.CompressionLevel))
 	if err != nil {
 		return nil, err
 	}
@@ -505,38 +674,89 @@ func CreateManifestVolume(ctx context.Context, j *JobInfo) (*VolumeInfo, error)
 // encrypt, and/or sign the file as it is written depending on the provided options.
 // It will also name the file accordingly as a volume as part of backup set.
 func CreateBackupVolume(ctx context.Context, j *JobInfo, volnum int64) (*VolumeInfo, error) {
-	// Create and name the backup file
-	extensions := []string{"zstream"}
+	compressor := j.Compressor
+	if compressor == AdaptiveCompressor {
+		// Nothing to probe, default to compressing the volume
+		compressor = ZstdCompressor
+	}
+	return CreateBackupVolumeWithCompressor(ctx, j, volnum, compressor)
+}
 
+// CreateBackupVolumeWithCompressor is like CreateBackupVolume but will compress the
+// volume using the provided compressor instead of the one configured in the JobInfo.
+// The compressor used is recorded in the volume.
+func CreateBackupVolumeWithCompressor(ctx context.Context, j *JobInfo, volnum int64, compressor string) (*VolumeInfo, error) {
+	return CreateBackupVolumeWithLevel(ctx, j, volnum, compressor, j.CompressionLevel)
+}
+
+// CreateBackupVolumeWithLevel is like CreateBackupVolumeWithCompressor but will also use the
+// provided compression level instead of the one configured in the JobInfo. The level used
+// is recorded in the volume if it was compressed.
+func CreateBackupVolumeWithLevel(ctx context.Context, j *JobInfo, volnum int64, compressor string, level int) (*VolumeInfo, error) {
+	// Create and name the backup file
 	pipe := false
-	if j.MaxFileBuffer == 0 {
+	if j.MaxFileBuffer == 0 || j.SingleObject {
 		pipe = true
 	}
 
-	v, nameParts, ext, err := prepareVolume(ctx, j, pipe, false)
+	v, _, _, err := prepareVolume(ctx, j, pipe, compressor, level)
 	if err != nil {
 		return nil, err
 	}
 
 	v.VolumeNumber = volnum
-	extensions = append(extensions, ext...)
-	extensions = append(extensions, fmt.Sprintf("vol%d", v.VolumeNumber))
-
-	v.ObjectName = fmt.Sprintf("%s.%s", strings.Join(nameParts, j.Separator), strings.Join(extensions, "."))
+	v.Compressor = compressor
+	if compressor != "" && compressor != NoCompressor {
+		v.CompressionLevel = level
+	}
+	v.ObjectName = j.BackupVolumeObjectName(volnum, compressor)
 
 	return v, nil
 }
 
+// BackupVolumeObjectName will return the name of the object the volume with the provided number would be uploaded
+// as when compressed with the provided compressor, without creating the volume. Volumes of the AdaptiveCompressor
+// are named as if compressed with zstd, those found to be incompressible are not.
+func (j *JobInfo) BackupVolumeObjectName(volnum int64, compressor string) string {
+	extensions := append([]string{"zstream"}, j.volumeExtensions(compressor)...)
+	if !j.SingleObject {
+		extensions = append(extensions, fmt.Sprintf("vol%d", volnum))
+	}
+
+	return fmt.Sprintf("%s.%s", strings.Join(j.objectNameParts(), j.Separator), strings.Join(extensions, "."))
+}
+
+// volumeExtensions returns the extensions of the name of a volume compressed with the provided compressor and
+// encrypted or signed as configured, in the order they are applied to it.
+func (j *JobInfo) volumeExtensions(compressor string) []string {
+	var extensions []string
+	switch compressor {
+	case InternalCompressor:
+		extensions = append(extensions, "gz")
+	case ZstdCompressor, SeekableZstdCompressor, AdaptiveCompressor:
+		extensions = append(extensions, "zst")
+	case "", NoCompressor:
+	case ExternalCompressor:
+		if args := j.CompressCommandLine(); len(args) > 0 {
+			extensions = append(extensions, filepath.Base(args[0]))
+		}
+	default:
+		extensions = append(extensions, compressor)
+	}
+	if j.EncryptKey != nil || j.SignKey != nil {
+		extensions = append(extensions, "pgp")
+	}
+	return extensions
+}
+
 // CreateSimpleVolume will create a temporary file to write to. If
 // MaxParallelUploads is set to 0, no temporary file will be used and an OS Pipe
-// will be used instead.
-func CreateSimpleVolume(ctx context.Context, pipe bool) (*VolumeInfo, error) {
-	v := &VolumeInfo{
-		SHA256:     sha256.New(),
-		CRC32C:     crc32.New(crc32.MakeTable(crc32.Castagnoli)),
-		MD5:        md5.New(),
-		SHA1:       sha1.New(),
-		CreateTime: time.Now(),
+// will be used instead. The checksum of the volume is also computed with the hash
+// algorithm registered under the provided name, see Checksum.
+func CreateSimpleVolume(ctx context.Context, pipe bool, hashAlgorithm string) (*VolumeInfo, error) {
+	v, err := newHashedVolume(hashAlgorithm)
+	if err != nil {
+		return nil, err
 	}
 
 	if pipe {
@@ -545,8 +765,9 @@ func CreateSimpleVolume(ctx context.Context, pipe bool) (*VolumeInfo, error) {
 		v.w = v.pw
 		v.isOpened = true
 		v.usingPipe = true
-		if BackupUploadBucket != nil {
-			v.r = ratelimit.Reader(v.r, BackupUploadBucket)
+		v.r = BackupUploadThrottle.Reader(v.r)
+		if BackupUploadGate != nil {
+			v.r = BackupUploadGate.Reader(v.r)
 		}
 	} else {
 		tempFile, err := ioutil.TempFile(BackupTempdir, LogModuleName)
@@ -558,16 +779,82 @@ func CreateSimpleVolume(ctx context.Context, pipe bool) (*VolumeInfo, error) {
 		v.w = v.fw
 	}
 
+	v.wrapWriter()
+	return v, nil
+}
+
+// ResumeSimpleVolume will open the volume partially written to the provided path, or create it if it does not
+// exist, so the rest of it can be appended to it. The hashes are computed over the whole volume, including the part
+// already written, and the number of bytes already written is returned as the offset to resume writing from.
+func ResumeSimpleVolume(ctx context.Context, path, hashAlgorithm string) (*VolumeInfo, int64, error) {
+	v, err := newHashedVolume(hashAlgorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Hash the part already written, leaving the file positioned at its end to append to it
+	hashes := []io.Writer{v.SHA256, v.CRC32C, v.MD5, v.SHA1}
+	if v.Hash != nil {
+		hashes = append(hashes, v.Hash)
+	}
+	offset, err := io.Copy(io.MultiWriter(hashes...), f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	v.fw = f
+	v.filename = path
+	v.w = v.fw
+	v.resumedBytes = uint64(offset)
+
+	v.wrapWriter()
+	return v, offset, nil
+}
+
+// newHashedVolume returns a volume with the hashes to compute over its contents, to be wrapped by wrapWriter once its underlying writer is set.
+func newHashedVolume(hashAlgorithm string) (*VolumeInfo, error) {
+	v := &VolumeInfo{
+		SHA256:        sha256.New(),
+		CRC32C:        crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		MD5:           md5.New(),
+		SHA1:          sha1.New(),
+		CreateTime:    time.Now(),
+		hashAlgorithm: hashAlgorithm,
+	}
+
+	switch hashAlgorithm {
+	case "", MD5Hash, SHA256Hash:
+	default:
+		factory, err := GetHash(hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		v.Hash = factory()
+	}
+
+	return v, nil
+}
+
+// wrapWriter will buffer the writes to the underlying writer of the volume, computing its hashes and counting the bytes written.
+func (v *VolumeInfo) wrapWriter() {
 	// Buffer the writes to double the default block size (128KB)
 	v.bufw = bufio.NewWriterSize(v.w, BufferSize)
 	v.w = v.bufw
 
 	// Compute hashes
-	v.w = io.MultiWriter(v.w, v.SHA256, v.CRC32C, v.MD5, v.SHA1)
+	if v.Hash != nil {
+		v.w = io.MultiWriter(v.w, v.SHA256, v.CRC32C, v.MD5, v.SHA1, v.Hash)
+	} else {
+		v.w = io.MultiWriter(v.w, v.SHA256, v.CRC32C, v.MD5, v.SHA1)
+	}
 
 	// Add a writer that counts how many bytes have been written
 	v.counter = datacounter.NewWriterCounter(v.w)
 	v.w = v.counter
-
-	return v, nil
 }
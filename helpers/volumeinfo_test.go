@@ -0,0 +1,189 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestObjectKeyNormalization(t *testing.T) {
+	testCases := []struct {
+		keyCase      string
+		datasetSep   string
+		incremental  string
+		volumeKey    string
+		manifestKey  string
+		validOptions bool
+	}{
+		{"", "", "", "Tank/Data|Snap2.zstream.gz.vol1", "manifests|Tank/Data|Snap2.manifest.gz", true},
+		{KeyCasePreserve, "", "Snap1", "Tank/Data|Snap1|to|Snap2.zstream.gz.vol1", "manifests|Tank/Data|Snap1|to|Snap2.manifest.gz", true},
+		{KeyCaseLower, "", "", "tank/data|snap2.zstream.gz.vol1", "manifests|tank/data|snap2.manifest.gz", true},
+		{KeyCaseLower, "+", "Snap1", "tank+data|snap1|to|snap2.zstream.gz.vol1", "manifests|tank+data|snap1|to|snap2.manifest.gz", true},
+		{"", "+", "", "Tank+Data|Snap2.zstream.gz.vol1", "manifests|Tank+Data|Snap2.manifest.gz", true},
+		{"upper", "", "", "", "", false},
+		{"", "_", "", "", "", false},
+		{"", "+/", "", "", "", false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{
+			VolumeName:          "Tank/Data",
+			BaseSnapshot:        SnapshotInfo{Name: "Snap2"},
+			IncrementalSnapshot: SnapshotInfo{Name: c.incremental},
+			Compressor:          InternalCompressor,
+			CompressionLevel:    6,
+			Separator:           "|",
+			ManifestPrefix:      "manifests",
+			MaxFileBuffer:       1,
+			KeyCase:             c.keyCase,
+			KeyDatasetSeparator: c.datasetSep,
+		}
+
+		if err := j.ValidateKeyNormalization(); (err == nil) != c.validOptions {
+			t.Errorf("%d: expected valid options to be %v, got error %v", idx, c.validOptions, err)
+			continue
+		}
+		if !c.validOptions {
+			continue
+		}
+
+		vol, err := CreateBackupVolume(context.Background(), j, 1)
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, err)
+		}
+		vol.Close()
+		vol.DeleteVolume()
+		if vol.ObjectName != c.volumeKey {
+			t.Errorf("%d: expected volume key %s, got %s", idx, c.volumeKey, vol.ObjectName)
+		}
+
+		manifest, err := CreateManifestVolume(context.Background(), j)
+		if err != nil {
+			t.Fatalf("%d: could not create manifest - %v", idx, err)
+		}
+		manifest.Close()
+		manifest.DeleteVolume()
+		if manifest.ObjectName != c.manifestKey {
+			t.Errorf("%d: expected manifest key %s, got %s", idx, c.manifestKey, manifest.ObjectName)
+		}
+	}
+}
+
+func TestResumeSimpleVolume(t *testing.T) {
+	payload := bytes.Repeat([]byte("zfs stream"), 64*1024)
+
+	testCases := []struct {
+		algorithm string
+		written   int
+	}{
+		{"", 0},
+		{"", len(payload) / 3},
+		{MD5Hash, len(payload) / 2},
+		{SHA256Hash, len(payload)},
+	}
+
+	for idx, c := range testCases {
+		expected, err := CreateSimpleVolume(context.Background(), false, c.algorithm)
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, err)
+		}
+		expected.Write(payload)
+		expected.Close()
+		expected.DeleteVolume()
+
+		// Write part of the payload, then resume the volume to write the rest of it
+		path := filepath.Join(t.TempDir(), "partial")
+		if err = ioutil.WriteFile(path, payload[:c.written], 0600); err != nil {
+			t.Fatalf("%d: could not write partial volume - %v", idx, err)
+		}
+		vol, offset, err := ResumeSimpleVolume(context.Background(), path, c.algorithm)
+		if err != nil {
+			t.Errorf("%d: could not resume volume - %v", idx, err)
+			continue
+		}
+		if offset != int64(c.written) {
+			t.Errorf("%d: expected to resume from offset %d, got %d", idx, c.written, offset)
+		}
+		vol.Write(payload[offset:])
+		if err = vol.Close(); err != nil {
+			t.Errorf("%d: could not close volume - %v", idx, err)
+			continue
+		}
+
+		if vol.Size != uint64(len(payload)) {
+			t.Errorf("%d: expected size %d, got %d", idx, len(payload), vol.Size)
+		}
+		if vol.SHA256Sum != expected.SHA256Sum || vol.MD5Sum != expected.MD5Sum || vol.CRC32CSum32 != expected.CRC32CSum32 || vol.HashSum != expected.HashSum {
+			t.Errorf("%d: expected the hashes of the whole volume, got sha256 %s md5 %s", idx, vol.SHA256Sum, vol.MD5Sum)
+		}
+		written, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(written, payload) {
+			t.Errorf("%d: expected the volume to hold the whole payload, got %d bytes (%v)", idx, len(written), err)
+		}
+	}
+}
+
+func TestBackupVolumeObjectName(t *testing.T) {
+	testCases := []struct {
+		compressor string
+		keyCase    string
+	}{
+		{InternalCompressor, ""},
+		{ZstdCompressor, KeyCaseLower},
+		{SeekableZstdCompressor, ""},
+		{NoCompressor, ""},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{
+			VolumeName:           "Tank/Data",
+			BaseSnapshot:         SnapshotInfo{Name: "Snap2"},
+			IncrementalSnapshot:  SnapshotInfo{Name: "Snap1"},
+			Compressor:           c.compressor,
+			CompressionLevel:     6,
+			CompressionBlockSize: DefaultCompressionBlockSize,
+			Separator:            "|",
+			MaxFileBuffer:        1,
+			KeyCase:              c.keyCase,
+		}
+
+		// The name is predicted without creating the volume, it must match the name of the volume once created
+		vol, err := CreateBackupVolume(context.Background(), j, 3)
+		if err != nil {
+			t.Fatalf("%d: could not create volume - %v", idx, err)
+		}
+		vol.Close()
+		vol.DeleteVolume()
+		if name := j.BackupVolumeObjectName(3, c.compressor); name != vol.ObjectName {
+			t.Errorf("%d: expected the volume to be named %s, got %s", idx, vol.ObjectName, name)
+		}
+	}
+
+	// A single object is not numbered
+	j := &JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap"}, Separator: "|", SingleObject: true}
+	if name := j.BackupVolumeObjectName(1, InternalCompressor); name != "tank/data|snap.zstream.gz" {
+		t.Errorf("expected the single object to be named tank/data|snap.zstream.gz, got %s", name)
+	}
+}
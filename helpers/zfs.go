@@ -23,18 +23,242 @@ package helpers
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// ZFSPath is the path to the zfs binary
+// ZFSPath is the path to the zfs binary, ZpoolPath the path to the zpool binary, SSHPath is the path to the ssh binary
+// used to receive on a remote host
 var (
-	ZFSPath = "zfs"
+	ZFSPath   = "zfs"
+	ZpoolPath = "zpool"
+	SSHPath   = "ssh"
+
+	shellSafe = regexp.MustCompile(`^[a-zA-Z0-9@%+=:,./_\-]+$`)
+
+	datasetComponent = regexp.MustCompile(`^[a-zA-Z0-9_\-.: ]+$`)
+)
+
+const (
+	maxDatasetNameLength = 255
+
+	// ssh exits with this status when it fails itself (e.g. could not connect), as opposed to
+	// passing through the exit status of the remote command.
+	sshErrorExitStatus = 255
 )
 
+// ValidateDatasetName will check that the provided name is a valid zfs dataset name, optionally
+// followed by a snapshot name.
+func ValidateDatasetName(name string) error {
+	if len(name) > maxDatasetNameLength {
+		return fmt.Errorf("the dataset name %s is longer than %d characters", name, maxDatasetNameLength)
+	}
+
+	dataset := name
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		dataset = name[:idx]
+		if snapshot := name[idx+1:]; !datasetComponent.MatchString(snapshot) {
+			return fmt.Errorf("the snapshot name in %s is empty or contains characters not allowed by zfs", name)
+		}
+	}
+
+	for idx, component := range strings.Split(dataset, "/") {
+		if !datasetComponent.MatchString(component) || component == "." || component == ".." {
+			return fmt.Errorf("the dataset name %s has an empty component or one with characters not allowed by zfs", name)
+		}
+		if idx == 0 && !(component[0] >= 'a' && component[0] <= 'z' || component[0] >= 'A' && component[0] <= 'Z') {
+			return fmt.Errorf("the pool name in %s must begin with a letter", name)
+		}
+	}
+
+	return nil
+}
+
+// ReceiveTarget will compute the dataset the backup described by this JobInfo object will be
+// received into, taking the -d and -e options of zfs receive into account.
+func (j *JobInfo) ReceiveTarget() string {
+	volume := j.LocalVolume
+	parts := strings.Split(j.VolumeName, "/")
+	if j.FullPath {
+		// -d discards the pool name of the sent dataset
+		parts[0] = volume
+		volume = strings.Join(parts, "/")
+	}
+
+	if j.LastPath {
+		// -e only keeps the last element of the sent dataset
+		volume = fmt.Sprintf("%s/%s", volume, parts[len(parts)-1])
+	}
+
+	return volume
+}
+
+// ValidateReceiveTarget will check that the dataset the backup described by this JobInfo
+// object will be received into is valid.
+func (j *JobInfo) ValidateReceiveTarget() error {
+	if j.FullPath && j.LastPath {
+		return fmt.Errorf("the -d and -e options are mutually exclusive")
+	}
+
+	if (j.FullPath || j.LastPath) && strings.ContainsAny(j.LocalVolume, "@#") {
+		return fmt.Errorf("the local volume %s must be a filesystem when using the -d or -e options", j.LocalVolume)
+	}
+
+	target := j.ReceiveTarget()
+	if err := ValidateDatasetName(target); err != nil {
+		return fmt.Errorf("cannot receive into %s - %v", target, err)
+	}
+
+	return nil
+}
+
+// ReceiveParent will return the dataset the dataset received for this JobInfo object is created under,
+// or an empty string when receiving into the root dataset of a pool.
+func (j *JobInfo) ReceiveParent() string {
+	target := j.ReceiveTarget()
+	if idx := strings.LastIndex(target, "/"); idx > 0 {
+		return target[:idx]
+	}
+	return ""
+}
+
+// IsEncrypted will check whether the provided dataset, or its nearest existing ancestor when it does not
+// exist yet, is encrypted.
+func IsEncrypted(ctx context.Context, dataset string) (bool, error) {
+	for dataset != "" {
+		value, err := GetZFSProperty(ctx, "encryption", dataset)
+		if err == nil {
+			return value != "" && value != "off" && value != "-", nil
+		}
+		if !strings.Contains(err.Error(), "dataset does not exist") {
+			return false, err
+		}
+
+		idx := strings.LastIndex(dataset, "/")
+		if idx < 0 {
+			break
+		}
+		dataset = dataset[:idx]
+	}
+
+	return false, nil
+}
+
+// PrepareEncryptedParentReceive will check whether the dataset received for this JobInfo object is created
+// under an encrypted parent. The datasets restored from a (non-raw) backup must inherit the parent's encryption
+// there, so the encryption property carried by streams sent with properties (-p or -R) is excluded from the
+// receive. Overriding the encryption property to off conflicts with the parent and is an error.
+// Raw streams (-w) are not prepared here, see PrepareRawReceive.
+func (j *JobInfo) PrepareEncryptedParentReceive(ctx context.Context, sentProperties bool) error {
+	j.InheritEncryption = false
+	parent := j.ReceiveParent()
+	if parent == "" {
+		return nil
+	}
+
+	encrypted, err := IsEncrypted(ctx, parent)
+	if err != nil {
+		AppLogger.Warningf("Could not check whether %s is encrypted, receiving the stream as-is - %v", parent, err)
+		return nil
+	}
+	if !encrypted {
+		return nil
+	}
+
+	for _, override := range j.PropertyOverrides {
+		if override == "encryption=off" {
+			return fmt.Errorf("cannot receive %s unencrypted, its parent %s is encrypted and the children of an encrypted dataset must be encrypted as well", j.ReceiveTarget(), parent)
+		}
+	}
+
+	if sentProperties {
+		AppLogger.Infof("The parent %s is encrypted, %s will inherit its encryption instead of the encryption property of the stream.", parent, j.ReceiveTarget())
+		j.InheritEncryption = true
+	}
+
+	return nil
+}
+
+// PrepareRawReceive will check that the receive of a raw stream (-w) for this JobInfo object keeps the encryption
+// of the sending dataset. The received dataset becomes its own encryption root, even under an encrypted parent, so
+// the encryption properties cannot be overridden or excluded on the receive.
+func (j *JobInfo) PrepareRawReceive() error {
+	j.InheritEncryption = false
+	for _, override := range j.PropertyOverrides {
+		property := strings.SplitN(override, "=", 2)[0]
+		if property == "encryption" || property == "keyformat" || property == "keylocation" || property == "pbkdf2iters" {
+			return fmt.Errorf("cannot override the %s property of %s, the backup set was sent raw and keeps the encryption of the dataset it was sent from", property, j.ReceiveTarget())
+		}
+	}
+
+	return nil
+}
+
+// ValidatePropertyOverrides will check that each property override of this JobInfo object
+// is of the form property=value. The origin can only be set with the Origin option.
+func (j *JobInfo) ValidatePropertyOverrides() error {
+	seen := make(map[string]bool, len(j.PropertyOverrides))
+	for _, override := range j.PropertyOverrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("the property override %s must be of the form property=value", override)
+		}
+
+		property := parts[0]
+		for _, c := range property {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-.:", c)) {
+				return fmt.Errorf("the property name %s has characters not allowed by zfs", property)
+			}
+		}
+		if property == "origin" {
+			return fmt.Errorf("the origin cannot be set with a property override, use the origin option instead")
+		}
+		if seen[property] {
+			return fmt.Errorf("the property %s is overridden more than once", property)
+		}
+		seen[property] = true
+	}
+
+	return nil
+}
+
+// ValidateTargetMap will check that each entry of the TargetMap is of the form dataset=local_volume, mapping
+// each dataset only once, to a valid local volume.
+func (j *JobInfo) ValidateTargetMap() error {
+	seen := make(map[string]bool, len(j.TargetMap))
+	for _, entry := range j.TargetMap {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("the target mapping %s must be of the form dataset=local_volume", entry)
+		}
+		if err := ValidateDatasetName(parts[1]); err != nil {
+			return fmt.Errorf("the target mapping %s has an invalid local volume - %v", entry, err)
+		}
+		if seen[parts[0]] {
+			return fmt.Errorf("the dataset %s is mapped more than once", parts[0])
+		}
+		seen[parts[0]] = true
+	}
+
+	return nil
+}
+
+// MappedTarget will return the local volume the provided dataset is mapped to by the TargetMap, if any.
+func (j *JobInfo) MappedTarget(dataset string) (string, bool) {
+	for _, entry := range j.TargetMap {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 && parts[0] == dataset {
+			return parts[1], true
+		}
+	}
+
+	return "", false
+}
+
 // GetCreationDate will use the zfs command to get and parse the creation datetime
 // of the specified volume/snapshot
 func GetCreationDate(ctx context.Context, target string) (time.Time, error) {
@@ -61,7 +285,7 @@ func GetSnapshots(ctx context.Context, target string) ([]SnapshotInfo, error) {
 	}
 	err = cmd.Start()
 	if err != nil {
-		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+		return nil, fmt.Errorf("%s (%w)", strings.TrimSpace(errB.String()), err)
 	}
 	var snapshots []SnapshotInfo
 	for {
@@ -83,6 +307,128 @@ func GetSnapshots(ctx context.Context, target string) ([]SnapshotInfo, error) {
 	return snapshots, nil
 }
 
+// GetBookmarks will retrieve all bookmarks for the given target. The creation time and GUID of a bookmark are
+// those of the snapshot it was created from.
+func GetBookmarks(ctx context.Context, target string) ([]SnapshotInfo, error) {
+	errB := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, ZFSPath, "list", "-H", "-d", "1", "-p", "-t", "bookmark", "-o", "name,creation,guid", "-S", "creation", target)
+	AppLogger.Debugf("Getting ZFS Bookmarks with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%w)", strings.TrimSpace(errB.String()), err)
+	}
+
+	var bookmarks []SnapshotInfo
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		creation, perr := strconv.ParseInt(fields[1], 10, 64)
+		if perr != nil {
+			return nil, perr
+		}
+		bookmarks = append(bookmarks, SnapshotInfo{
+			Name:         fields[0][strings.Index(fields[0], "#")+1:],
+			CreationTime: time.Unix(creation, 0),
+			GUID:         fields[2],
+		})
+	}
+
+	return bookmarks, nil
+}
+
+// ErrSnapshotExists is returned by CreateSnapshot when the dataset already has a snapshot of the same name.
+var ErrSnapshotExists = errors.New("a snapshot of the same name already exists")
+
+// CreateSnapshot will take a snapshot of the dataset with the provided name and return its details. ErrSnapshotExists
+// is returned if the dataset already has a snapshot with that name, e.g. when a snapshot name template does not
+// change often enough for how often backups are taken.
+func CreateSnapshot(ctx context.Context, dataset, name string) (SnapshotInfo, error) {
+	snapshots, err := GetSnapshots(ctx, dataset)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return SnapshotInfo{}, ErrSnapshotExists
+		}
+	}
+
+	target := fmt.Sprintf("%s@%s", dataset, name)
+	if err = runZFSCommand(ctx, "snapshot", target); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	creationTime, err := GetCreationDate(ctx, target)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	return SnapshotInfo{Name: name, CreationTime: creationTime}, nil
+}
+
+// DatasetExists will check whether the provided dataset or snapshot exists.
+func DatasetExists(ctx context.Context, name string) (bool, error) {
+	errB := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, ZFSPath, "list", "-H", "-o", "name", name)
+	AppLogger.Debugf("Checking if ZFS dataset exists with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(errB.String(), "does not exist") {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return true, nil
+}
+
+// RollbackSnapshot will roll the dataset of the provided snapshot back to it, destroying any later snapshots.
+func RollbackSnapshot(ctx context.Context, snapshot string) error {
+	return runZFSCommand(ctx, "rollback", "-r", snapshot)
+}
+
+// DestroyDataset will destroy the provided dataset or snapshot, along with its descendants if recursive is true.
+func DestroyDataset(ctx context.Context, name string, recursive bool) error {
+	if recursive {
+		return runZFSCommand(ctx, "destroy", "-r", name)
+	}
+	return runZFSCommand(ctx, "destroy", name)
+}
+
+// GetReceiveResumeToken will return the receive_resume_token of the provided dataset, left by an interrupted zfs
+// receive -s, or an empty string if there is none or the dataset does not exist.
+func GetReceiveResumeToken(ctx context.Context, dataset string) (string, error) {
+	exists, err := DatasetExists(ctx, dataset)
+	if err != nil || !exists {
+		return "", err
+	}
+	token, err := GetZFSProperty(ctx, "receive_resume_token", dataset)
+	if err != nil || token == "-" {
+		return "", err
+	}
+	return token, nil
+}
+
+// AbortPartialReceive will discard the partially received state of the provided dataset left by an interrupted zfs
+// receive -s, see GetReceiveResumeToken.
+func AbortPartialReceive(ctx context.Context, dataset string) error {
+	return runZFSCommand(ctx, "receive", "-A", dataset)
+}
+
+// runZFSCommand will run the zfs command with the provided arguments, returning its stderr output on failure.
+func runZFSCommand(ctx context.Context, args ...string) error {
+	errB := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, ZFSPath, args...)
+	AppLogger.Debugf("Running ZFS command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
 // GetZFSProperty will return the raw value returned by the "zfs get" command for
 // the given property on the given target.
 func GetZFSProperty(ctx context.Context, prop, target string) (string, error) {
@@ -99,6 +445,100 @@ func GetZFSProperty(ctx context.Context, prop, target string) (string, error) {
 	return strings.TrimSpace(b.String()), nil
 }
 
+// GetWrittenSince will return the number of bytes of referenced space written to the provided snapshot of the dataset
+// since the earlier snapshot of the same dataset provided, as reported by its written@<since> property.
+func GetWrittenSince(ctx context.Context, dataset, snapshot, since string) (uint64, error) {
+	value, err := GetZFSProperty(ctx, "written@"+since, dataset+"@"+snapshot)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// GetZFSSendEstimate will use the zfs command to estimate the size, in bytes, of the send
+// stream described by the provided JobInfo without sending any data.
+func GetZFSSendEstimate(ctx context.Context, j *JobInfo) (uint64, error) {
+	cmd := GetZFSSendCommand(ctx, j)
+	cmd.Args = append([]string{cmd.Args[0], cmd.Args[1], "-nP"}, cmd.Args[2:]...)
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("could not find the estimated size in the output of %s", strings.Join(cmd.Args, " "))
+}
+
+// StreamFeatures will return the pool features the receiving pool needs to receive the stream sent for this JobInfo
+// object. Blocks larger than 128KiB sent with -L need large_blocks, blocks sent compressed with -c keep the compression
+// of the sending dataset and need the matching feature to be written as-is, see CompressionFeature. Raw streams (-w) of
+// an encrypted dataset need the encryption feature to be received with their encryption intact.
+func (j *JobInfo) StreamFeatures() []string {
+	var features []string
+	if j.LargeBlocks {
+		features = append(features, "large_blocks")
+	}
+	if j.CompressedSend {
+		if feature := CompressionFeature(j.SendCompression); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	if j.RawSend {
+		features = append(features, "encryption")
+	}
+	return features
+}
+
+// CompressionFeature will return the pool feature needed to write blocks compressed as described by the provided value of
+// the compression property, or an empty string if none is needed. Manifests written before the compression property was
+// recorded leave it empty, lz4 is assumed for those as it is the default compression.
+func CompressionFeature(compression string) string {
+	switch {
+	case compression == "", compression == "on", compression == "lz4":
+		return "lz4_compress"
+	case strings.HasPrefix(compression, "zstd"):
+		return "zstd_compress"
+	default:
+		// off, lzjb, gzip, gzip-N, zle
+		return ""
+	}
+}
+
+// MissingPoolFeatures will return those of the provided features that are neither enabled nor active on the provided pool.
+func MissingPoolFeatures(ctx context.Context, pool string, features []string) ([]string, error) {
+	var missing []string
+	for _, feature := range features {
+		b := new(bytes.Buffer)
+		errB := new(bytes.Buffer)
+		cmd := exec.CommandContext(ctx, ZpoolPath, "get", "-H", "-o", "value", "feature@"+feature, pool)
+		AppLogger.Debugf("Getting pool feature with command \"%s\"", strings.Join(cmd.Args, " "))
+		cmd.Stdout = b
+		cmd.Stderr = errB
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+		}
+		if state := strings.TrimSpace(b.String()); state != "enabled" && state != "active" {
+			missing = append(missing, feature)
+		}
+	}
+	return missing, nil
+}
+
+// IncrementalSource will return the full name of the snapshot, or the bookmark if the stream is sent from one,
+// the incremental stream of this JobInfo is sent from.
+func (j *JobInfo) IncrementalSource() string {
+	if j.IncrementalBookmark != "" {
+		return fmt.Sprintf("%s#%s", j.VolumeName, j.IncrementalBookmark)
+	}
+	return fmt.Sprintf("%s@%s", j.VolumeName, j.IncrementalSnapshot.Name)
+}
+
 // GetZFSSendCommand will return the send command to use for the given JobInfo
 func GetZFSSendCommand(ctx context.Context, j *JobInfo) *exec.Cmd {
 
@@ -120,12 +560,30 @@ func GetZFSSendCommand(ctx context.Context, j *JobInfo) *exec.Cmd {
 		zfsArgs = append(zfsArgs, "-p")
 	}
 
+	if j.LargeBlocks {
+		AppLogger.Infof("Enabling the large block (-L) flag on the send.")
+		zfsArgs = append(zfsArgs, "-L")
+	}
+
+	if j.CompressedSend {
+		AppLogger.Infof("Enabling the compressed (-c) flag on the send.")
+		zfsArgs = append(zfsArgs, "-c")
+	}
+
+	if j.RawSend {
+		AppLogger.Infof("Enabling the raw (-w) flag on the send.")
+		zfsArgs = append(zfsArgs, "-w")
+	}
+
 	if j.IntermediaryIncremental && j.IncrementalSnapshot.Name != "" {
 		AppLogger.Infof("Enabling an incremental stream with all intermediary snapshots (-I) on the send to snapshot %s", j.IncrementalSnapshot.Name)
 		zfsArgs = append(zfsArgs, "-I", j.IncrementalSnapshot.Name)
 	}
 
-	if !j.IntermediaryIncremental && j.IncrementalSnapshot.Name != "" {
+	if !j.IntermediaryIncremental && j.IncrementalBookmark != "" {
+		AppLogger.Infof("Enabling an incremental stream (-i) on the send from bookmark %s", j.IncrementalBookmark)
+		zfsArgs = append(zfsArgs, "-i", j.IncrementalSource())
+	} else if !j.IntermediaryIncremental && j.IncrementalSnapshot.Name != "" {
 		AppLogger.Infof("Enabling an incremental stream (-i) on the send to snapshot %s", j.IncrementalSnapshot.Name)
 		zfsArgs = append(zfsArgs, "-i", j.IncrementalSnapshot.Name)
 	}
@@ -167,8 +625,63 @@ func GetZFSReceiveCommand(ctx context.Context, j *JobInfo) *exec.Cmd {
 		zfsArgs = append(zfsArgs, "-o", "origin="+j.Origin)
 	}
 
+	for _, override := range j.PropertyOverrides {
+		AppLogger.Infof("Overriding the property %s (-o) on the receive.", override)
+		zfsArgs = append(zfsArgs, "-o", override)
+	}
+
+	if j.InheritEncryption {
+		AppLogger.Infof("Excluding the encryption property (-x) on the receive.")
+		zfsArgs = append(zfsArgs, "-x", "encryption")
+	}
+
+	if j.RestoreStateFile != "" {
+		AppLogger.Infof("Enabling the resumable (-s) flag on the receive to detect partially received state when the restore is resumed.")
+		zfsArgs = append(zfsArgs, "-s")
+	}
+
 	zfsArgs = append(zfsArgs, j.LocalVolume)
+	if j.SSHHost != "" {
+		return getSSHReceiveCommand(ctx, j, zfsArgs)
+	}
 	cmd := exec.CommandContext(ctx, ZFSPath, zfsArgs...)
 
 	return cmd
 }
+
+// getSSHReceiveCommand will wrap the provided zfs receive arguments in an ssh command that runs them on the
+// remote host of the given JobInfo. The remote command is run by a shell so each argument is quoted.
+func getSSHReceiveCommand(ctx context.Context, j *JobInfo, zfsArgs []string) *exec.Cmd {
+	AppLogger.Infof("Receiving on the remote host %s over ssh.", j.SSHHost)
+	remoteArgs := make([]string, 0, len(zfsArgs)+1)
+	for _, arg := range append([]string{"zfs"}, zfsArgs...) {
+		remoteArgs = append(remoteArgs, shellQuote(arg))
+	}
+
+	var sshArgs []string
+	for _, option := range j.SSHOptions {
+		sshArgs = append(sshArgs, "-o", option)
+	}
+	// Never prompt for a password, there is no terminal to answer it
+	sshArgs = append(sshArgs, "-o", "BatchMode=yes", "--", j.SSHHost, strings.Join(remoteArgs, " "))
+
+	return exec.CommandContext(ctx, SSHPath, sshArgs...)
+}
+
+// shellQuote will quote the provided argument for a POSIX shell if required.
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// IsSSHError will check whether the provided error is due to ssh itself failing, such as when it could
+// not connect to the remote host or the connection was dropped, rather than the remote command failing.
+func IsSSHError(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode() == sshErrorExitStatus
+	}
+	return false
+}
@@ -0,0 +1,519 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetZFSSendCommand(t *testing.T) {
+	testCases := []struct {
+		j    *JobInfo
+		args []string
+	}{
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}}, []string{"send", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, LargeBlocks: true}, []string{"send", "-L", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, CompressedSend: true}, []string{"send", "-c", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, IncrementalSnapshot: SnapshotInfo{Name: "snap1"}, Properties: true, LargeBlocks: true, CompressedSend: true}, []string{"send", "-p", "-L", "-c", "-i", "snap1", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, RawSend: true}, []string{"send", "-w", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, IncrementalSnapshot: SnapshotInfo{Name: "snap1"}, RawSend: true}, []string{"send", "-w", "-i", "snap1", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap3"}, IncrementalSnapshot: SnapshotInfo{Name: "snap1"}, IntermediaryIncremental: true, Replication: true, RawSend: true}, []string{"send", "-R", "-w", "-I", "snap1", "tank/data@snap3"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, IncrementalSnapshot: SnapshotInfo{Name: "snap1"}, IncrementalBookmark: "snap1"}, []string{"send", "-i", "tank/data#snap1", "tank/data@snap2"}},
+		{&JobInfo{VolumeName: "tank/data", BaseSnapshot: SnapshotInfo{Name: "snap2"}, IncrementalSnapshot: SnapshotInfo{Name: "snap1"}, IncrementalBookmark: "kept", RawSend: true}, []string{"send", "-w", "-i", "tank/data#kept", "tank/data@snap2"}},
+	}
+
+	for idx, c := range testCases {
+		cmd := GetZFSSendCommand(context.Background(), c.j)
+		if !reflect.DeepEqual(cmd.Args[1:], c.args) {
+			t.Errorf("%d: expected send command arguments %v, got %v", idx, c.args, cmd.Args[1:])
+		}
+	}
+}
+
+func TestMissingPoolFeatures(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackuppoolfeatures")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zpool binary to report the state of a few features
+	zpoolPath := filepath.Join(workingDir, "zpool")
+	script := `#!/bin/sh
+case "$6" in
+	tank) echo active ;;
+	fresh) echo enabled ;;
+	legacy) echo disabled ;;
+	*) echo "cannot open '$6': no such pool" >&2; exit 1 ;;
+esac
+`
+	if err = ioutil.WriteFile(zpoolPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zpool binary - %v", err)
+	}
+	ZpoolPath = zpoolPath
+	defer func() { ZpoolPath = "zpool" }()
+
+	features := (&JobInfo{LargeBlocks: true, CompressedSend: true}).StreamFeatures()
+	testCases := []struct {
+		pool    string
+		missing []string
+		valid   bool
+	}{
+		{"tank", nil, true},
+		{"fresh", nil, true},
+		{"legacy", []string{"large_blocks", "lz4_compress"}, true},
+		{"missing", nil, false},
+	}
+
+	for idx, c := range testCases {
+		missing, err := MissingPoolFeatures(context.Background(), c.pool, features)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if !reflect.DeepEqual(missing, c.missing) {
+			t.Errorf("%d: expected missing features %v, got %v", idx, c.missing, missing)
+		}
+	}
+}
+
+func TestStreamFeatures(t *testing.T) {
+	testCases := []struct {
+		j        *JobInfo
+		features []string
+	}{
+		{&JobInfo{}, nil},
+		{&JobInfo{LargeBlocks: true, RawSend: true}, []string{"large_blocks", "encryption"}},
+		// Manifests written before the compression was recorded assume lz4
+		{&JobInfo{CompressedSend: true}, []string{"lz4_compress"}},
+		{&JobInfo{CompressedSend: true, SendCompression: "on"}, []string{"lz4_compress"}},
+		{&JobInfo{CompressedSend: true, SendCompression: "lz4"}, []string{"lz4_compress"}},
+		{&JobInfo{CompressedSend: true, SendCompression: "zstd"}, []string{"zstd_compress"}},
+		{&JobInfo{LargeBlocks: true, CompressedSend: true, SendCompression: "zstd-fast-10"}, []string{"large_blocks", "zstd_compress"}},
+		{&JobInfo{CompressedSend: true, SendCompression: "gzip-9"}, nil},
+		{&JobInfo{CompressedSend: true, SendCompression: "lzjb"}, nil},
+		{&JobInfo{CompressedSend: true, SendCompression: "off"}, nil},
+		// The compression only matters when the blocks are sent compressed
+		{&JobInfo{SendCompression: "zstd"}, nil},
+	}
+
+	for idx, c := range testCases {
+		if features := c.j.StreamFeatures(); !reflect.DeepEqual(features, c.features) {
+			t.Errorf("%d: expected the features %v, got %v", idx, c.features, features)
+		}
+	}
+}
+
+func TestGetZFSReceiveCommand(t *testing.T) {
+	testCases := []struct {
+		j    *JobInfo
+		args []string
+	}{
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup/data"}, []string{"receive", "backup/data"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup", FullPath: true}, []string{"receive", "-d", "backup"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup", LastPath: true}, []string{"receive", "-e", "backup"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup", LastPath: true, NotMounted: true, Force: true}, []string{"receive", "-e", "-u", "-F", "backup"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup", FullPath: true, Origin: "backup/base@snap"}, []string{"receive", "-d", "-o", "origin=backup/base@snap", "backup"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup/data", PropertyOverrides: []string{"readonly=on"}}, []string{"receive", "-o", "readonly=on", "backup/data"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup", FullPath: true, Origin: "backup/base@snap", PropertyOverrides: []string{"readonly=on", "mountpoint=none"}}, []string{"receive", "-d", "-o", "origin=backup/base@snap", "-o", "readonly=on", "-o", "mountpoint=none", "backup"}},
+		// Under an encrypted parent the encryption property of the stream is excluded
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data", InheritEncryption: true}, []string{"receive", "-x", "encryption", "secure/data"}},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure", FullPath: true, Force: true, PropertyOverrides: []string{"readonly=on"}, InheritEncryption: true}, []string{"receive", "-d", "-F", "-o", "readonly=on", "-x", "encryption", "secure"}},
+		// Restores persisting their progress leave partially received state behind to detect on resume
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup/data", Force: true, RestoreStateFile: "/var/lib/restore.json"}, []string{"receive", "-F", "-s", "backup/data"}},
+	}
+
+	for idx, c := range testCases {
+		cmd := GetZFSReceiveCommand(context.Background(), c.j)
+		if !reflect.DeepEqual(cmd.Args[1:], c.args) {
+			t.Errorf("%d: expected receive command arguments %v, got %v", idx, c.args, cmd.Args[1:])
+		}
+	}
+}
+
+func TestGetZFSReceiveCommandOverSSH(t *testing.T) {
+	testCases := []struct {
+		j    *JobInfo
+		args []string
+	}{
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "backup/data", SSHHost: "standby"}, []string{"ssh", "-o", "BatchMode=yes", "--", "standby", "zfs receive backup/data"}},
+		{
+			&JobInfo{VolumeName: "tank/data", LocalVolume: "backup", FullPath: true, Force: true, SSHHost: "root@standby", SSHOptions: []string{"Port=2222", "IdentityFile=/root/.ssh/restore"}},
+			[]string{"ssh", "-o", "Port=2222", "-o", "IdentityFile=/root/.ssh/restore", "-o", "BatchMode=yes", "--", "root@standby", "zfs receive -d -F backup"},
+		},
+		// Arguments are run by the remote shell and must be quoted
+		{
+			&JobInfo{VolumeName: "tank/data", LocalVolume: "backup/my data", SSHHost: "standby", PropertyOverrides: []string{"readonly=on", "com.example:note=it's a standby"}},
+			[]string{"ssh", "-o", "BatchMode=yes", "--", "standby", `zfs receive -o readonly=on -o 'com.example:note=it'\''s a standby' 'backup/my data'`},
+		},
+	}
+
+	for idx, c := range testCases {
+		cmd := GetZFSReceiveCommand(context.Background(), c.j)
+		if !reflect.DeepEqual(cmd.Args, c.args) {
+			t.Errorf("%d: expected remote receive command arguments %v, got %v", idx, c.args, cmd.Args)
+		}
+	}
+}
+
+func TestIsSSHError(t *testing.T) {
+	testCases := []struct {
+		exitStatus string
+		sshError   bool
+	}{
+		{"0", false},
+		{"1", false},
+		{"2", false},
+		{"255", true},
+	}
+
+	for idx, c := range testCases {
+		err := exec.Command("sh", "-c", "exit "+c.exitStatus).Run()
+		if IsSSHError(err) != c.sshError {
+			t.Errorf("%d: expected exit status %s to be an ssh error=%v, got error %v", idx, c.exitStatus, c.sshError, err)
+		}
+	}
+	if IsSSHError(errors.New("not an exit error")) {
+		t.Errorf("expected an error that is not an exit error to not be an ssh error")
+	}
+}
+
+func TestValidatePropertyOverrides(t *testing.T) {
+	testCases := []struct {
+		overrides []string
+		valid     bool
+	}{
+		{nil, true},
+		{[]string{"readonly=on"}, true},
+		{[]string{"readonly=on", "mountpoint=none", "canmount=noauto"}, true},
+		{[]string{"com.example:backup=standby"}, true},
+		{[]string{"mountpoint=/mnt/with=equals"}, true},
+		{[]string{"compression="}, true},
+		{[]string{"readonly"}, false},
+		{[]string{"=on"}, false},
+		{[]string{"read only=on"}, false},
+		{[]string{"origin=backup/base@snap"}, false},
+		{[]string{"readonly=on", "readonly=off"}, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{PropertyOverrides: c.overrides}
+		if err := j.ValidatePropertyOverrides(); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+	}
+}
+
+func TestValidateTargetMap(t *testing.T) {
+	testCases := []struct {
+		targetMap []string
+		valid     bool
+	}{
+		{nil, true},
+		{[]string{"tank/db=restore/db"}, true},
+		{[]string{"tank/db=restore/db", "tank/app=restore/app"}, true},
+		{[]string{"tank/db"}, false},
+		{[]string{"=restore/db"}, false},
+		{[]string{"tank/db="}, false},
+		{[]string{"tank/db=1restore/db"}, false},
+		{[]string{"tank/db=restore/db", "tank/db=restore/other"}, false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{TargetMap: c.targetMap}
+		if err := j.ValidateTargetMap(); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+	}
+
+	j := &JobInfo{TargetMap: []string{"tank/db=restore/db", "tank/app=restore/app"}}
+	if target, ok := j.MappedTarget("tank/app"); !ok || target != "restore/app" {
+		t.Errorf("expected tank/app to be mapped to restore/app, got %s (%v)", target, ok)
+	}
+	if target, ok := j.MappedTarget("tank"); ok {
+		t.Errorf("did not expect tank to be mapped, got %s", target)
+	}
+}
+
+func TestReceiveTarget(t *testing.T) {
+	testCases := []struct {
+		volumeName  string
+		localVolume string
+		fullPath    bool
+		lastPath    bool
+		target      string
+		valid       bool
+	}{
+		{"tank/home/user", "backup/restored", false, false, "backup/restored", true},
+		{"tank/home/user", "backup/restored@snap", false, false, "backup/restored@snap", true},
+		// -d discards the pool name of the sent dataset
+		{"tank/home/user", "backup", true, false, "backup/home/user", true},
+		{"tank", "backup/tank", true, false, "backup/tank", true},
+		// -e only keeps the last element of the sent dataset
+		{"tank/home/user", "backup/users", false, true, "backup/users/user", true},
+		{"tank", "backup", false, true, "backup/tank", true},
+		{"tank/home/user", "backup", true, true, "", false},
+		{"tank/home/user", "backup@snap", false, true, "", false},
+		{"tank/home/user", "backup/", false, true, "", false},
+		{"tank/home/user", "backup//users", false, true, "", false},
+		{"tank/home/user", "1backup", false, false, "", false},
+		{"tank/home/user", "backup/us*rs", false, false, "", false},
+		{"tank/home/user", "backup/" + strings.Repeat("a", 250), false, true, "", false},
+	}
+
+	for idx, c := range testCases {
+		j := &JobInfo{VolumeName: c.volumeName, LocalVolume: c.localVolume, FullPath: c.fullPath, LastPath: c.lastPath}
+		err := j.ValidateReceiveTarget()
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if c.valid && j.ReceiveTarget() != c.target {
+			t.Errorf("%d: expected to receive into %s, got %s", idx, c.target, j.ReceiveTarget())
+		}
+	}
+}
+
+func TestPrepareEncryptedParentReceive(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupencryptedparent")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to report the encryption of a few datasets
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+case "$7" in
+	secure) echo aes-256-gcm ;;
+	plain) echo off ;;
+	legacy) echo "bad property list: invalid property 'encryption'" >&2; exit 1 ;;
+	*) echo "cannot open '$7': dataset does not exist" >&2; exit 1 ;;
+esac
+`
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	ZFSPath = zfsPath
+	defer func() { ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		j              *JobInfo
+		sentProperties bool
+		inherit        bool
+		valid          bool
+	}{
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data"}, true, true, true},
+		// Streams sent without properties inherit the parent's encryption as-is
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data"}, false, false, true},
+		// The nearest existing ancestor decides
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/missing/data"}, true, true, true},
+		{&JobInfo{VolumeName: "tank/home/user", LocalVolume: "secure", FullPath: true}, true, true, true},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "plain/data"}, true, false, true},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "missing/data"}, true, false, true},
+		// Receiving into the root dataset of a pool has no parent
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure"}, true, false, true},
+		// A zfs version without encryption support cannot tell, the stream is received as-is
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "legacy/data"}, true, false, true},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data", PropertyOverrides: []string{"encryption=off"}}, true, false, false},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "plain/data", PropertyOverrides: []string{"encryption=off"}}, true, false, true},
+	}
+
+	for idx, c := range testCases {
+		err := c.j.PrepareEncryptedParentReceive(context.Background(), c.sentProperties)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if c.j.InheritEncryption != c.inherit {
+			t.Errorf("%d: expected inherit encryption to be %v, got %v", idx, c.inherit, c.j.InheritEncryption)
+		}
+	}
+}
+
+func TestPrepareRawReceive(t *testing.T) {
+	testCases := []struct {
+		j     *JobInfo
+		valid bool
+	}{
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data"}, true},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data", InheritEncryption: true}, true},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data", PropertyOverrides: []string{"compression=lz4", "mountpoint=none"}}, true},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data", PropertyOverrides: []string{"encryption=off"}}, false},
+		{&JobInfo{VolumeName: "tank/data", LocalVolume: "secure/data", PropertyOverrides: []string{"keylocation=file:///etc/key"}}, false},
+	}
+
+	for idx, c := range testCases {
+		err := c.j.PrepareRawReceive()
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+		}
+		if c.j.InheritEncryption {
+			t.Errorf("%d: expected a raw receive to not inherit the encryption of the parent", idx)
+		}
+	}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupcreatesnapshot")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to list an existing snapshot and refuse to snapshot a read-only dataset
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+case "$1" in
+	list) printf 'tank/data@zfsbackup-2024-06-01T03-00\t1717210800\n' ;;
+	snapshot) case "$2" in tank/readonly@*) echo "cannot create snapshot '$2': permission denied" >&2; exit 1 ;; esac ;;
+	get) echo 1717210809 ;;
+esac
+`
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	ZFSPath = zfsPath
+	defer func() { ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		dataset string
+		name    string
+		errTest func(error) bool
+	}{
+		{"tank/data", "zfsbackup-2024-06-01T04-00", func(e error) bool { return e == nil }},
+		// The template rendered the name of a snapshot taken by a previous backup
+		{"tank/data", "zfsbackup-2024-06-01T03-00", func(e error) bool { return e == ErrSnapshotExists }},
+		{"tank/readonly", "zfsbackup-2024-06-01T04-00", func(e error) bool { return e != nil && e != ErrSnapshotExists }},
+	}
+
+	for idx, c := range testCases {
+		snapshot, err := CreateSnapshot(context.Background(), c.dataset, c.name)
+		if !c.errTest(err) {
+			t.Errorf("%d: did not get the expected error, got %v instead", idx, err)
+			continue
+		}
+		if err == nil && (snapshot.Name != c.name || snapshot.CreationTime.Unix() != 1717210809) {
+			t.Errorf("%d: expected snapshot %s created at 1717210809, got %s created at %d", idx, c.name, snapshot.Name, snapshot.CreationTime.Unix())
+		}
+	}
+}
+
+func TestGetWrittenSince(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupwritten")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to report what was written to a few snapshots since daily1
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+[ "$6" = "written@daily1" ] || { echo "bad property '$6'" >&2; exit 1; }
+case "$7" in
+	tank/idle@daily2) echo 0 ;;
+	tank/busy@daily2) echo 1048576 ;;
+	tank/odd@daily2) echo - ;;
+	*) echo "cannot open '$7': dataset does not exist" >&2; exit 1 ;;
+esac
+`
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	ZFSPath = zfsPath
+	defer func() { ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		dataset string
+		written uint64
+		valid   bool
+	}{
+		{"tank/idle", 0, true},
+		{"tank/busy", 1048576, true},
+		{"tank/odd", 0, false},
+		{"tank/missing", 0, false},
+	}
+
+	for idx, c := range testCases {
+		written, err := GetWrittenSince(context.Background(), c.dataset, "daily2", "daily1")
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if written != c.written {
+			t.Errorf("%d: expected %d bytes written, got %d", idx, c.written, written)
+		}
+	}
+}
+
+func TestGetBookmarks(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "zfsbackupbookmarks")
+	if err != nil {
+		t.Fatalf("could not create temp dir - %v", err)
+	}
+	defer os.RemoveAll(workingDir)
+
+	// Fake the zfs binary to list the bookmarks of a few datasets
+	zfsPath := filepath.Join(workingDir, "zfs")
+	script := `#!/bin/sh
+[ "$7" = "bookmark" ] || { echo "bad type '$7'" >&2; exit 1; }
+case "${12}" in
+	tank/data) printf 'tank/data#daily2\t1500000200\t222\ntank/data#daily1\t1500000100\t111\n' ;;
+	tank/empty) ;;
+	*) echo "cannot open '${12}': dataset does not exist" >&2; exit 1 ;;
+esac
+`
+	if err = ioutil.WriteFile(zfsPath, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write fake zfs binary - %v", err)
+	}
+	ZFSPath = zfsPath
+	defer func() { ZFSPath = "zfs" }()
+
+	testCases := []struct {
+		dataset   string
+		bookmarks []SnapshotInfo
+		valid     bool
+	}{
+		{"tank/data", []SnapshotInfo{{Name: "daily2", CreationTime: time.Unix(1500000200, 0), GUID: "222"}, {Name: "daily1", CreationTime: time.Unix(1500000100, 0), GUID: "111"}}, true},
+		{"tank/empty", nil, true},
+		{"tank/missing", nil, false},
+	}
+
+	for idx, c := range testCases {
+		bookmarks, err := GetBookmarks(context.Background(), c.dataset)
+		if (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v, got error %v", idx, c.valid, err)
+			continue
+		}
+		if !reflect.DeepEqual(bookmarks, c.bookmarks) {
+			t.Errorf("%d: expected bookmarks %v, got %v", idx, c.bookmarks, bookmarks)
+		}
+	}
+}
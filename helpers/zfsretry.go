@@ -0,0 +1,123 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultTransientZFSErrors are the patterns of the error output of zfs commands that failed for a reason expected
+// to go away on its own, e.g. a dataset held busy by another operation or a pool briefly suspended.
+var DefaultTransientZFSErrors = []string{
+	"dataset is busy",
+	"pool I/O is currently suspended",
+	"resource temporarily unavailable",
+	"device busy",
+}
+
+// permanentZFSErrors are the patterns of the error output of zfs commands that will fail the same way when run
+// again. They take precedence over the transient patterns so e.g. a dataset that does not exist is never retried.
+var permanentZFSErrors = []string{
+	"does not exist",
+	"no such pool",
+	"permission denied",
+	"invalid",
+}
+
+// maxZFSStderr is how much of the end of the error output of a zfs command is kept to classify its failure.
+const maxZFSStderr = 4096
+
+// ZFSCommandError is a zfs command that exited with an error, along with the end of its error output.
+type ZFSCommandError struct {
+	Stderr string
+	Err    error
+}
+
+func (e *ZFSCommandError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (%v)", e.Stderr, e.Err)
+}
+
+// Unwrap returns the error the command exited with.
+func (e *ZFSCommandError) Unwrap() error {
+	return e.Err
+}
+
+// StderrCapture is the error output of a command, passed through to another writer and with its end kept to
+// tell why the command failed, see ZFSCommandError.
+type StderrCapture struct {
+	out  io.Writer
+	mu   sync.Mutex
+	tail []byte
+}
+
+// NewStderrCapture will return a StderrCapture passing what is written to it through to out.
+func NewStderrCapture(out io.Writer) *StderrCapture {
+	return &StderrCapture{out: out}
+}
+
+func (s *StderrCapture) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	s.tail = append(s.tail, p...)
+	if len(s.tail) > maxZFSStderr {
+		s.tail = s.tail[len(s.tail)-maxZFSStderr:]
+	}
+	s.mu.Unlock()
+	return s.out.Write(p)
+}
+
+// Wrap will return the provided error of the command along with the end of its error output, or nil if err is nil.
+func (s *StderrCapture) Wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &ZFSCommandError{Stderr: strings.TrimSpace(string(s.tail)), Err: err}
+}
+
+// IsTransientZFSError will check whether the provided error is a zfs command that failed with error output matching
+// any of the provided patterns, case insensitively, and none of the patterns of failures that are permanent.
+func IsTransientZFSError(err error, patterns []string) bool {
+	var zfsErr *ZFSCommandError
+	if !errors.As(err, &zfsErr) || IsSSHError(err) {
+		return false
+	}
+
+	stderr := strings.ToLower(zfsErr.Stderr)
+	for _, pattern := range permanentZFSErrors {
+		if strings.Contains(stderr, pattern) {
+			return false
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(stderr, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestIsTransientZFSError(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 1").Run()
+	sshExit := exec.Command("sh", "-c", "exit 255").Run()
+
+	testCases := []struct {
+		err       error
+		patterns  []string
+		transient bool
+	}{
+		{&ZFSCommandError{Stderr: "cannot receive incremental stream: dataset is busy", Err: exitErr}, DefaultTransientZFSErrors, true},
+		{&ZFSCommandError{Stderr: "cannot open 'tank/data@snap1': dataset is busy", Err: exitErr}, DefaultTransientZFSErrors, true},
+		{&ZFSCommandError{Stderr: "cannot send 'tank/data': pool I/O is currently suspended", Err: exitErr}, DefaultTransientZFSErrors, true},
+		{&ZFSCommandError{Stderr: "cannot open 'tank/data': Resource temporarily unavailable", Err: exitErr}, DefaultTransientZFSErrors, true},
+		{&ZFSCommandError{Stderr: "cannot destroy 'tank/data': Device busy", Err: exitErr}, DefaultTransientZFSErrors, true},
+		// Permanent failures are never retried, even when matching a transient pattern too
+		{&ZFSCommandError{Stderr: "cannot open 'tank/data': dataset does not exist", Err: exitErr}, DefaultTransientZFSErrors, false},
+		{&ZFSCommandError{Stderr: "cannot open 'nope/data': no such pool 'nope'", Err: exitErr}, DefaultTransientZFSErrors, false},
+		{&ZFSCommandError{Stderr: "cannot receive: invalid backup stream", Err: exitErr}, DefaultTransientZFSErrors, false},
+		{&ZFSCommandError{Stderr: "cannot send 'tank/data': permission denied", Err: exitErr}, DefaultTransientZFSErrors, false},
+		{&ZFSCommandError{Stderr: "cannot open 'tank/gone': dataset does not exist\ncannot open 'tank/data': dataset is busy", Err: exitErr}, DefaultTransientZFSErrors, false},
+		{&ZFSCommandError{Stderr: "cannot receive new filesystem stream: destination has snapshots", Err: exitErr}, DefaultTransientZFSErrors, false},
+		{&ZFSCommandError{Err: exitErr}, DefaultTransientZFSErrors, false},
+		// Custom patterns replace the default ones
+		{&ZFSCommandError{Stderr: "cannot send: lock held by another process", Err: exitErr}, []string{"Lock Held"}, true},
+		{&ZFSCommandError{Stderr: "cannot send: dataset is busy", Err: exitErr}, []string{"lock held"}, false},
+		{&ZFSCommandError{Stderr: "cannot send: dataset is busy", Err: exitErr}, nil, false},
+		// Wrapped errors are classified, ssh failures and errors without the output of zfs are not
+		{&OperationError{Op: "zfs send", Kind: ErrZFSFailed, Err: &ZFSCommandError{Stderr: "dataset is busy", Err: exitErr}}, DefaultTransientZFSErrors, true},
+		{fmt.Errorf("restore failed - %w", &ZFSCommandError{Stderr: "dataset is busy", Err: exitErr}), DefaultTransientZFSErrors, true},
+		{&ZFSCommandError{Stderr: "dataset is busy", Err: sshExit}, DefaultTransientZFSErrors, false},
+		{errors.New("dataset is busy"), DefaultTransientZFSErrors, false},
+		{nil, DefaultTransientZFSErrors, false},
+	}
+
+	for idx, c := range testCases {
+		if transient := IsTransientZFSError(c.err, c.patterns); transient != c.transient {
+			t.Errorf("%d: expected %v to be transient=%v, got %v", idx, c.err, c.transient, transient)
+		}
+	}
+}
+
+func TestStderrCapture(t *testing.T) {
+	out := new(bytes.Buffer)
+	capture := NewStderrCapture(out)
+	if capture.Wrap(nil) != nil {
+		t.Errorf("expected no error to stay nil")
+	}
+
+	fmt.Fprintf(capture, "%s", strings.Repeat("x", 2*maxZFSStderr))
+	fmt.Fprintf(capture, "cannot open 'tank/data': dataset is busy\n")
+	if out.Len() != 2*maxZFSStderr+len("cannot open 'tank/data': dataset is busy\n") {
+		t.Errorf("expected the error output to be passed through, got %d bytes", out.Len())
+	}
+
+	exitErr := exec.Command("sh", "-c", "exit 1").Run()
+	err := capture.Wrap(exitErr)
+	var zfsErr *ZFSCommandError
+	if !errors.As(err, &zfsErr) || len(zfsErr.Stderr) > maxZFSStderr || !strings.HasSuffix(zfsErr.Stderr, "dataset is busy") {
+		t.Errorf("expected the end of the error output to be kept, got %v", err)
+	}
+	var e *exec.ExitError
+	if !errors.As(err, &e) {
+		t.Errorf("expected the exit error to be unwrapped from %v", err)
+	}
+}